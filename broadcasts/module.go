@@ -20,7 +20,7 @@
 )
 
 func init() {
-	module = modules.Register("broadcasts", prep, start, nil, "updates", "netenv", "notifications")
+	module = modules.Register("broadcasts", prep, start, nil, "updates", "netenv", "notifications", "interception")
 }
 
 func prep() error {
@@ -16,6 +16,7 @@
 	"github.com/spf13/cobra"
 	"github.com/tevino/abool"
 
+	"github.com/safing/portbase/updater"
 	"github.com/safing/portmaster/updates/helper"
 )
 
@@ -211,6 +212,7 @@ func runAndRestart(opts *Options, args []string) error {
 	tries := 0
 	for {
 		tryAgain, err := execute(opts, args)
+		logRestartReason(opts)
 		if err != nil {
 			log.Printf("%s failed with: %s\n", opts.Identifier, err)
 			tries++
@@ -240,6 +242,57 @@ func runAndRestart(opts *Options, args []string) error {
 	}
 }
 
+// logRestartReason logs and removes the restart reason written by the
+// component before exiting.
+func logRestartReason(opts *Options) {
+	reason, err := helper.ConsumeRestartReason(dataRoot.Path)
+	switch {
+	case err != nil:
+		log.Printf("failed to get restart reason of %s: %s\n", opts.Identifier, err)
+	case reason != nil:
+		log.Printf(
+			"%s %s requested restart at %s: %s\n",
+			opts.Identifier,
+			reason.Version,
+			reason.Time.Format(time.RFC3339),
+			reason.Reason,
+		)
+	}
+}
+
+// checkPendingUpdate validates the binary to be started again, if the
+// component staged an update to be applied on its next start. If the binary
+// is not runnable, its version is blacklisted, so that the previous version is
+// started on the next try.
+func checkPendingUpdate(opts *Options, file *updater.File, binPath string) error {
+	pending, err := helper.ReadPendingUpdate(dataRoot.Path)
+	switch {
+	case err != nil:
+		log.Printf("failed to get pending update: %s\n", err)
+		return nil
+	case pending == nil || pending.Identifier != opts.Identifier:
+		return nil
+	}
+
+	if err := helper.RemovePendingUpdate(dataRoot.Path); err != nil {
+		log.Printf("%s\n", err)
+	}
+	log.Printf(
+		"applying update of %s to %s staged at %s\n",
+		opts.Identifier,
+		file.Version(),
+		pending.Time.Format(time.RFC3339),
+	)
+
+	if err := helper.ValidateBinary(binPath, runtime.GOOS, runtime.GOARCH); err != nil {
+		if blErr := file.Blacklist(); blErr != nil {
+			log.Printf("failed to blacklist %s %s: %s\n", opts.Identifier, file.Version(), blErr)
+		}
+		return fmt.Errorf("staged update %s is invalid: %w", file.Version(), err)
+	}
+	return nil
+}
+
 func fixExecPerm(path string) error {
 	if onWindows {
 		return nil
@@ -337,6 +390,11 @@ func execute(opts *Options, args []string) (cont bool, err error) {
 		return true, err
 	}
 
+	// validate an update that is applied on this start
+	if err := checkPendingUpdate(opts, file, binPath); err != nil {
+		return true, err
+	}
+
 	log.Printf("starting %s %s\n", binPath, strings.Join(args, " "))
 
 	// create command
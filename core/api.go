@@ -125,6 +125,7 @@ func restart(_ *api.Request) (msg string, err error) {
 	log.Info("core: user requested restart via action")
 
 	// Let the updates module handle restarting.
+	updates.SetRestartReason("user requested restart via action")
 	updates.RestartNow()
 
 	return "restart initiated", nil
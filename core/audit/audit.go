@@ -0,0 +1,219 @@
+// Package audit sends events to the Linux audit subsystem, so that they are
+// recorded by auditd together with the other audit events of the system.
+// It is independent of the regular logging and is only active if enabled via
+// the --audit-events flag. Events are tagged with the key set with the
+// --audit-key flag, which can be used to search for them, eg. with
+// "ausearch -m TRUSTED_APP -i | grep portmaster". Events are limited to the
+// rate set with the --audit-rate-limit flag.
+package audit
+
+import (
+	"encoding/hex"
+	"flag"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tevino/abool"
+
+	"github.com/safing/portbase/log"
+)
+
+const (
+	// auditTrustedApp is the message type for events of trusted applications
+	// (AUDIT_TRUSTED_APP), which carry free-form key-value pairs.
+	auditTrustedApp = 1121
+
+	// eventQueueSize is the amount of events that are queued for sending.
+	// Events are dropped while the queue is full.
+	eventQueueSize = 1000
+
+	// droppedReportInterval defines how often dropped events are reported.
+	droppedReportInterval = time.Minute
+)
+
+// Field is a key-value pair of an audit event.
+type Field struct {
+	Name  string
+	Value string
+}
+
+var (
+	enabled   bool
+	key       string
+	rateLimit uint
+
+	// events holds the encoded events to be sent by the event writer.
+	events      = make(chan string, eventQueueSize)
+	writerStart sync.Once
+	// newWriter connects to the audit subsystem.
+	newWriter = connect
+
+	// disabled is set when the audit subsystem could not be connected to or
+	// rejected an event in a way that will not change, eg. because of missing
+	// permissions.
+	disabled = abool.New()
+
+	// dropped counts the events that were dropped because of the rate limit or
+	// because the queue was full.
+	dropped uint64
+
+	limiter = &rateLimiter{}
+)
+
+// writer is the connection to the audit subsystem.
+type writer interface {
+	// Write sends the message with the given type and returns the error
+	// reported by the audit subsystem.
+	Write(msgType uint16, msg string) error
+}
+
+func init() {
+	flag.BoolVar(&enabled, "audit-events", false, "send blocked connections to the Linux audit subsystem")
+	flag.StringVar(&key, "audit-key", "portmaster", "key to tag the events sent to the Linux audit subsystem with")
+	flag.UintVar(&rateLimit, "audit-rate-limit", 100, "maximum amount of events per second to send to the Linux audit subsystem; 0 disables the limit")
+}
+
+// Enabled returns whether events are sent to the audit subsystem.
+func Enabled() bool {
+	return enabled
+}
+
+// Dropped returns the amount of events that were dropped, because they
+// exceeded the rate limit or the queue was full.
+func Dropped() uint64 {
+	return atomic.LoadUint64(&dropped)
+}
+
+// Send queues an event of the given operation with the given fields for
+// sending to the audit subsystem, if enabled. Success describes whether the
+// audited action succeeded, which is recorded in the res field. Send never
+// blocks: Events are sent by a separate writer and are dropped if they exceed
+// the rate limit or the queue is full. Errors are only logged once and disable
+// sending events, such as if the audit subsystem is not available or the
+// process lacks the CAP_AUDIT_WRITE capability, as the audit subsystem is an
+// optional sink.
+func Send(op string, success bool, fields ...Field) {
+	if !enabled || disabled.IsSet() {
+		return
+	}
+	if !limiter.allow(time.Now(), rateLimit) {
+		atomic.AddUint64(&dropped, 1)
+		return
+	}
+
+	writerStart.Do(func() {
+		go writeEvents()
+	})
+	select {
+	case events <- encode(op, key, success, fields):
+	default:
+		atomic.AddUint64(&dropped, 1)
+	}
+}
+
+// writeEvents connects to the audit subsystem and sends the queued events,
+// until the audit subsystem fails permanently.
+func writeEvents() {
+	conn, err := newWriter()
+	if err != nil {
+		disabled.Set()
+		log.Warningf("audit: not sending events to the audit subsystem: %s", err)
+		return
+	}
+
+	var (
+		reportedDropped uint64
+		reportedAt      time.Time
+	)
+	for msg := range events {
+		if err := conn.Write(auditTrustedApp, msg); err != nil && permanentError(err) {
+			disabled.Set()
+			log.Warningf("audit: not sending events to the audit subsystem anymore: %s", err)
+			return
+		}
+
+		if d := Dropped(); d != reportedDropped && time.Since(reportedAt) > droppedReportInterval {
+			log.Warningf("audit: dropped %d events in total, because they exceeded the rate limit or the queue was full", d)
+			reportedDropped = d
+			reportedAt = time.Now()
+		}
+	}
+}
+
+// rateLimiter is a token bucket that allows a burst of one second worth of
+// events.
+type rateLimiter struct {
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// allow returns whether an event may be sent at the given time with the given
+// limit of events per second. A limit of 0 allows all events.
+func (l *rateLimiter) allow(now time.Time, limit uint) bool {
+	if limit == 0 {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	burst := float64(limit)
+	if l.last.IsZero() {
+		l.tokens = burst
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * float64(limit)
+		if l.tokens > burst {
+			l.tokens = burst
+		}
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// encode encodes the event as audit key-value pairs.
+func encode(op, key string, success bool, fields []Field) string {
+	buf := &strings.Builder{}
+	writeField(buf, "op", op)
+	writeField(buf, "key", key)
+	for _, field := range fields {
+		writeField(buf, field.Name, field.Value)
+	}
+
+	res := "failed"
+	if success {
+		res = "success"
+	}
+	buf.WriteString(" res=")
+	buf.WriteString(res)
+
+	return buf.String()
+}
+
+func writeField(buf *strings.Builder, name, value string) {
+	if buf.Len() > 0 {
+		buf.WriteByte(' ')
+	}
+	buf.WriteString(name)
+	buf.WriteByte('=')
+	buf.WriteString(encodeValue(value))
+}
+
+// encodeValue encodes the value like the audit subsystem encodes untrusted
+// strings: Values are quoted, unless they contain spaces, quotes or control
+// or non-ASCII characters, in which case they are hex encoded.
+func encodeValue(value string) string {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c <= ' ' || c == '"' || c >= 0x7f {
+			return strings.ToUpper(hex.EncodeToString([]byte(value)))
+		}
+	}
+	return `"` + value + `"`
+}
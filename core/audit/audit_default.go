@@ -0,0 +1,13 @@
+//go:build !linux
+
+package audit
+
+import "errors"
+
+func connect() (writer, error) {
+	return nil, errors.New("the audit subsystem is not supported on this platform")
+}
+
+func permanentError(_ error) bool {
+	return true
+}
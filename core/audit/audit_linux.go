@@ -0,0 +1,130 @@
+package audit
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ackTimeout defines how long to wait for the audit subsystem to acknowledge
+// an event.
+const ackTimeout = 100 * time.Millisecond
+
+// nativeEndian is the byte order of netlink message headers.
+var nativeEndian = func() binary.ByteOrder {
+	buf := [2]byte{}
+	*(*uint16)(unsafe.Pointer(&buf[0])) = 0x0102 //nolint:gosec // Endianness detection.
+	if buf[0] == 0x02 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// netlinkWriter sends events to the audit subsystem via netlink.
+type netlinkWriter struct {
+	fd  int
+	seq uint32
+}
+
+func connect() (writer, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_AUDIT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit netlink socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind audit netlink socket: %w", err)
+	}
+	tv := unix.NsecToTimeval(ackTimeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("failed to set audit netlink socket timeout: %w", err)
+	}
+
+	return &netlinkWriter{fd: fd}, nil
+}
+
+// Write implements writer.
+func (w *netlinkWriter) Write(msgType uint16, msg string) error {
+	seq := atomic.AddUint32(&w.seq, 1)
+
+	// The audit subsystem expects a NUL terminated message.
+	payload := append([]byte(msg), 0)
+	hdr := unix.NlMsghdr{
+		Len:   uint32(unix.NLMSG_HDRLEN + len(payload)),
+		Type:  msgType,
+		Flags: unix.NLM_F_REQUEST | unix.NLM_F_ACK,
+		Seq:   seq,
+	}
+	data := make([]byte, 0, nlmsgAlign(int(hdr.Len)))
+	data = append(data, encodeHeader(hdr)...)
+	data = append(data, payload...)
+	data = append(data, make([]byte, nlmsgAlign(len(data))-len(data))...)
+
+	if err := unix.Sendto(w.fd, data, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+	return w.readAck(seq)
+}
+
+// readAck reads the acknowledgement of the message with the given sequence
+// number and returns the error it reports.
+func (w *netlinkWriter) readAck(seq uint32) error {
+	buf := make([]byte, unix.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(w.fd, buf, 0)
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) {
+				// The event was sent, even if it was not acknowledged in time.
+				return nil
+			}
+			return err
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq || m.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return errors.New("invalid acknowledgement")
+			}
+			if errno := int32(nativeEndian.Uint32(m.Data[:4])); errno != 0 {
+				return unix.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+// permanentError returns whether sending events will keep failing with the
+// given error.
+func permanentError(err error) bool {
+	return errors.Is(err, unix.EPERM) ||
+		errors.Is(err, unix.EACCES) ||
+		errors.Is(err, unix.ECONNREFUSED) ||
+		errors.Is(err, unix.EPROTONOSUPPORT)
+}
+
+func nlmsgAlign(length int) int {
+	return (length + unix.NLMSG_ALIGNTO - 1) & ^(unix.NLMSG_ALIGNTO - 1)
+}
+
+func encodeHeader(hdr unix.NlMsghdr) []byte {
+	b := make([]byte, unix.NLMSG_HDRLEN)
+	nativeEndian.PutUint32(b[0:4], hdr.Len)
+	nativeEndian.PutUint16(b[4:6], hdr.Type)
+	nativeEndian.PutUint16(b[6:8], hdr.Flags)
+	nativeEndian.PutUint32(b[8:12], hdr.Seq)
+	nativeEndian.PutUint32(b[12:16], hdr.Pid)
+	return b
+}
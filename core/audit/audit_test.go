@@ -0,0 +1,169 @@
+package audit
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockWriter records the events written to it.
+type mockWriter struct {
+	lock    sync.Mutex
+	msgs    []string
+	err     error
+	written chan struct{}
+}
+
+func (w *mockWriter) Write(msgType uint16, msg string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	defer func() {
+		w.written <- struct{}{}
+	}()
+	if msgType != auditTrustedApp {
+		return errors.New("unexpected message type")
+	}
+	w.msgs = append(w.msgs, msg)
+	return w.err
+}
+
+func (w *mockWriter) setErr(err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.err = err
+}
+
+func (w *mockWriter) messages() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return append([]string(nil), w.msgs...)
+}
+
+func waitForWrite(t *testing.T, w *mockWriter) {
+	t.Helper()
+
+	select {
+	case <-w.written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not written")
+	}
+}
+
+// testWriter is the writer of the tests, as the event writer is only started
+// once per process.
+var testWriter = &mockWriter{written: make(chan struct{}, eventQueueSize)}
+
+func TestSend(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	mock := testWriter
+	newWriter = func() (writer, error) { return mock, nil }
+	enabled = true
+	rateLimit = 0
+	defer func() {
+		enabled = false
+		rateLimit = 100
+		newWriter = connect
+		mock.setErr(nil)
+	}()
+	sent := len(mock.messages())
+
+	Send("connection-blocked", false,
+		Field{Name: "exe", Value: "/usr/bin/curl"},
+		Field{Name: "reason", Value: "blocked by rule"},
+	)
+	waitForWrite(t, mock)
+	msgs := mock.messages()[sent:]
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(msgs))
+	}
+	expected := `op="connection-blocked" key="portmaster" exe="/usr/bin/curl" reason=626C6F636B65642062792072756C65 res=failed`
+	if msgs[0] != expected {
+		t.Errorf("unexpected event:\n%s\nexpected:\n%s", msgs[0], expected)
+	}
+
+	// Temporary errors do not disable sending events.
+	temporaryErr := errors.New("temporary")
+	mock.setErr(temporaryErr)
+	if permanentError(temporaryErr) {
+		t.Fatal("error should not be permanent")
+	}
+	Send("connection-blocked", false)
+	Send("connection-blocked", false)
+	waitForWrite(t, mock)
+	waitForWrite(t, mock)
+	if msgs := mock.messages()[sent:]; len(msgs) != 3 {
+		t.Errorf("expected 3 events, got %d", len(msgs))
+	}
+
+	// Events that exceed the rate limit are dropped.
+	rateLimit = 1
+	limiter = &rateLimiter{}
+	droppedBefore := Dropped()
+	Send("connection-blocked", false)
+	Send("connection-blocked", false)
+	waitForWrite(t, mock)
+	if msgs := mock.messages()[sent:]; len(msgs) != 4 {
+		t.Errorf("expected 4 events, got %d", len(msgs))
+	}
+	if d := Dropped() - droppedBefore; d != 1 {
+		t.Errorf("expected 1 dropped event, got %d", d)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+
+	l := &rateLimiter{}
+	now := time.Now()
+
+	// A burst of one second worth of events is allowed.
+	for i := 0; i < 10; i++ {
+		if !l.allow(now, 10) {
+			t.Fatalf("event %d of the burst should be allowed", i)
+		}
+	}
+	if l.allow(now, 10) {
+		t.Error("event exceeding the burst should be dropped")
+	}
+
+	// Tokens are refilled over time, up to the burst.
+	if !l.allow(now.Add(100*time.Millisecond), 10) {
+		t.Error("event should be allowed after refill")
+	}
+	if l.allow(now.Add(100*time.Millisecond), 10) {
+		t.Error("only one event should be refilled")
+	}
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if l.allow(now.Add(time.Hour), 10) {
+			allowed++
+		}
+	}
+	if allowed != 10 {
+		t.Errorf("expected a burst of 10 events after a long pause, got %d", allowed)
+	}
+
+	// A limit of 0 allows all events.
+	if !l.allow(now.Add(time.Hour), 0) {
+		t.Error("events should not be limited without a limit")
+	}
+}
+
+func TestEncodeValue(t *testing.T) {
+	t.Parallel()
+
+	for value, expected := range map[string]string{
+		"/usr/bin/curl": `"/usr/bin/curl"`,
+		"":              `""`,
+		"a b":           "612062",
+		`a"b`:           "612262",
+		"ä":             "C3A4",
+	} {
+		if got := encodeValue(value); got != expected {
+			t.Errorf("encodeValue(%q) = %s, expected %s", value, got, expected)
+		}
+	}
+}
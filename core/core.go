@@ -8,7 +8,7 @@
 	"github.com/safing/portbase/modules"
 	"github.com/safing/portbase/modules/subsystems"
 	_ "github.com/safing/portmaster/broadcasts"
-	_ "github.com/safing/portmaster/netenv"
+	"github.com/safing/portmaster/netenv"
 	_ "github.com/safing/portmaster/netquery"
 	_ "github.com/safing/portmaster/status"
 	_ "github.com/safing/portmaster/ui"
@@ -50,6 +50,9 @@ func init() {
 func prep() error {
 	registerEvents()
 
+	// Let automatic restarts wait for the network.
+	updates.SetRestartNetworkCheck(netenv.Online)
+
 	// init config
 	err := registerConfig()
 	if err != nil {
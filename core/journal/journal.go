@@ -0,0 +1,130 @@
+// Package journal sends structured events to the system journal.
+// It is independent of the regular logging and is only active if enabled via
+// the --journal-events flag.
+package journal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Priority is the syslog priority of an event.
+type Priority int
+
+// Priorities.
+const (
+	PriorityError   Priority = 3
+	PriorityWarning Priority = 4
+	PriorityNotice  Priority = 5
+	PriorityInfo    Priority = 6
+)
+
+// Fields holds the structured fields of an event. Field names are converted
+// to upper case and any characters other than letters, digits and
+// underscores are replaced by underscores.
+type Fields map[string]string
+
+// syslogIdentifier is used to identify the events of the Portmaster.
+const syslogIdentifier = "portmaster"
+
+var (
+	enabled bool
+
+	conn     sink
+	connErr  error
+	connOnce sync.Once
+)
+
+// sink is the connection to the journal.
+type sink interface {
+	Write(b []byte) (int, error)
+}
+
+func init() {
+	flag.BoolVar(&enabled, "journal-events", false, "send restart and interception events to the system journal as structured entries")
+}
+
+// Enabled returns whether events are sent to the journal.
+func Enabled() bool {
+	return enabled
+}
+
+// Send sends an event with the given message and fields to the journal, if
+// enabled. Errors are silently ignored, as the journal is an optional sink.
+func Send(priority Priority, message string, fields Fields) {
+	if !enabled {
+		return
+	}
+
+	connOnce.Do(func() {
+		conn, connErr = connect()
+	})
+	if connErr != nil {
+		return
+	}
+
+	_, _ = conn.Write(encode(priority, message, fields))
+}
+
+// encode encodes the event in the native journal protocol.
+func encode(priority Priority, message string, fields Fields) []byte {
+	buf := &bytes.Buffer{}
+	writeField(buf, "MESSAGE", message)
+	writeField(buf, "PRIORITY", strconv.Itoa(int(priority)))
+	writeField(buf, "SYSLOG_IDENTIFIER", syslogIdentifier)
+
+	// Write fields in a stable order.
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeField(buf, fieldName(name), fields[name])
+	}
+
+	return buf.Bytes()
+}
+
+func writeField(buf *bytes.Buffer, name, value string) {
+	// Values with newlines must be written with an explicit length.
+	if strings.Contains(value, "\n") {
+		buf.WriteString(name)
+		buf.WriteByte('\n')
+		_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+
+	buf.WriteString(name)
+	buf.WriteByte('=')
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// fieldName converts the name to a valid journal field name.
+func fieldName(name string) string {
+	name = strings.ToUpper(name)
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+
+	// Field names starting with an underscore are reserved for trusted fields.
+	name = strings.TrimLeft(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "FIELD_" + name
+	}
+
+	return name
+}
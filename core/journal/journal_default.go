@@ -0,0 +1,9 @@
+//go:build !linux
+
+package journal
+
+import "errors"
+
+func connect() (sink, error) {
+	return nil, errors.New("the system journal is not supported on this platform")
+}
@@ -0,0 +1,13 @@
+package journal
+
+import "net"
+
+// journalSocket is the socket of the native journal protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+func connect() (sink, error) {
+	return net.DialUnix("unixgram", nil, &net.UnixAddr{
+		Name: journalSocket,
+		Net:  "unixgram",
+	})
+}
@@ -0,0 +1,45 @@
+package journal
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	t.Parallel()
+
+	got := string(encode(PriorityNotice, "restart triggered", Fields{
+		"reason":  "update",
+		"_SECRET": "x",
+		"verdict": "line1\nline2",
+	}))
+
+	length := make([]byte, 8)
+	binary.LittleEndian.PutUint64(length, 11)
+	expected := "MESSAGE=restart triggered\n" +
+		"PRIORITY=5\n" +
+		"SYSLOG_IDENTIFIER=portmaster\n" +
+		"SECRET=x\n" +
+		"REASON=update\n" +
+		"VERDICT\n" + string(length) + "line1\nline2\n"
+	if got != expected {
+		t.Errorf("unexpected encoding:\n%q\nexpected:\n%q", got, expected)
+	}
+}
+
+func TestFieldName(t *testing.T) {
+	t.Parallel()
+
+	for name, expected := range map[string]string{
+		"reason":        "REASON",
+		"rule-key":      "RULE_KEY",
+		"_trusted":      "TRUSTED",
+		"1st":           "FIELD_1ST",
+		"":              "FIELD_",
+		"connection.id": "CONNECTION_ID",
+	} {
+		if got := fieldName(name); got != expected {
+			t.Errorf("fieldName(%q) = %q, expected %q", name, got, expected)
+		}
+	}
+}
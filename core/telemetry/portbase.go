@@ -0,0 +1,192 @@
+package telemetry
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/safing/portbase/api"
+	"github.com/safing/portbase/config"
+	"github.com/safing/portbase/log"
+	"github.com/safing/portbase/metrics"
+)
+
+var (
+	displayNames     = make(map[string]string)
+	displayNamesLock sync.Mutex
+)
+
+// DescribeMetric sets the human readable name of the metric with the given
+// name. It is used by the default sink for showing the metric in the
+// Portmaster and must be set before the metric is first emitted.
+func DescribeMetric(name, displayName string) {
+	displayNamesLock.Lock()
+	defer displayNamesLock.Unlock()
+
+	displayNames[name] = displayName
+}
+
+func getDisplayName(name string) string {
+	displayNamesLock.Lock()
+	defer displayNamesLock.Unlock()
+
+	return displayNames[name]
+}
+
+// portbaseSink registers the metrics with the Prometheus exporter of portbase
+// when they are first emitted.
+type portbaseSink struct {
+	lock sync.RWMutex
+
+	counters   map[string]*metrics.Counter
+	histograms map[string]*metrics.Histogram
+	gauges     map[string]*uint64
+	// failed holds the metrics that could not be registered, so that the
+	// error is only logged once.
+	failed map[string]struct{}
+}
+
+var defaultSink = &portbaseSink{
+	counters:   make(map[string]*metrics.Counter),
+	histograms: make(map[string]*metrics.Histogram),
+	gauges:     make(map[string]*uint64),
+	failed:     make(map[string]struct{}),
+}
+
+func newPortbaseSink() MetricsSink {
+	return defaultSink
+}
+
+// IncCounter implements MetricsSink.
+func (s *portbaseSink) IncCounter(name string, labels map[string]string, delta uint64) {
+	s.incCounter(metricKey(name, labels), name, labels, delta)
+}
+
+func (s *portbaseSink) incCounter(key, name string, labels map[string]string, delta uint64) {
+	s.lock.RLock()
+	counter, ok := s.counters[key]
+	s.lock.RUnlock()
+
+	if !ok {
+		s.lock.Lock()
+		counter, ok = s.counters[key]
+		if !ok {
+			var err error
+			counter, err = metrics.NewCounter(name, copyLabels(labels), metricOptions(name))
+			if !s.check(key, err) {
+				s.lock.Unlock()
+				return
+			}
+			s.counters[key] = counter
+		}
+		s.lock.Unlock()
+	}
+	counter.Add(int(delta))
+}
+
+// ObserveHistogram implements MetricsSink.
+func (s *portbaseSink) ObserveHistogram(name string, labels map[string]string, value float64) {
+	s.observeHistogram(metricKey(name, labels), name, labels, value)
+}
+
+func (s *portbaseSink) observeHistogram(key, name string, labels map[string]string, value float64) {
+	s.lock.RLock()
+	histogram, ok := s.histograms[key]
+	s.lock.RUnlock()
+
+	if !ok {
+		s.lock.Lock()
+		histogram, ok = s.histograms[key]
+		if !ok {
+			var err error
+			histogram, err = metrics.NewHistogram(name, copyLabels(labels), metricOptions(name))
+			if !s.check(key, err) {
+				s.lock.Unlock()
+				return
+			}
+			s.histograms[key] = histogram
+		}
+		s.lock.Unlock()
+	}
+	histogram.Update(value)
+}
+
+// SetGauge implements MetricsSink.
+func (s *portbaseSink) SetGauge(name string, labels map[string]string, value float64) {
+	s.setGauge(metricKey(name, labels), name, labels, value)
+}
+
+func (s *portbaseSink) setGauge(key, name string, labels map[string]string, value float64) {
+	s.lock.RLock()
+	gauge, ok := s.gauges[key]
+	s.lock.RUnlock()
+
+	if !ok {
+		s.lock.Lock()
+		gauge, ok = s.gauges[key]
+		if !ok {
+			bits := new(uint64)
+			_, err := metrics.NewGauge(name, copyLabels(labels), func() float64 {
+				return math.Float64frombits(atomic.LoadUint64(bits))
+			}, metricOptions(name))
+			if !s.check(key, err) {
+				s.lock.Unlock()
+				return
+			}
+			gauge = bits
+			s.gauges[key] = gauge
+		}
+		s.lock.Unlock()
+	}
+	atomic.StoreUint64(gauge, math.Float64bits(value))
+}
+
+// check returns whether the metric was registered and logs the error once
+// otherwise.
+func (s *portbaseSink) check(key string, err error) bool {
+	if err == nil {
+		return true
+	}
+	if _, ok := s.failed[key]; !ok {
+		s.failed[key] = struct{}{}
+		log.Warningf("telemetry: failed to register metric %s: %s", key, err)
+	}
+	return false
+}
+
+func metricOptions(name string) *metrics.Options {
+	return &metrics.Options{
+		Name:           getDisplayName(name),
+		Permission:     api.PermitUser,
+		ExpertiseLevel: config.ExpertiseLevelExpert,
+	}
+}
+
+// metricKey returns a key that identifies the metric with the given name and
+// labels.
+func metricKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	pairs := make([]string, 0, len(labels))
+	for labelName, value := range labels {
+		pairs = append(pairs, labelName+"="+value)
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+
+	c := make(map[string]string, len(labels))
+	for labelName, value := range labels {
+		c[labelName] = value
+	}
+	return c
+}
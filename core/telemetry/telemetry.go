@@ -0,0 +1,147 @@
+// Package telemetry decouples the instrumentation of the Portmaster from the
+// metrics exporter. Modules emit their metrics through the package functions,
+// which forward them to the registered MetricsSink. By default, metrics are
+// registered with the Prometheus exporter of portbase.
+//
+// Embedders that use another metrics system, such as StatsD or OpenTelemetry,
+// register their own sink at startup, before the modules are started:
+//
+//	telemetry.SetMetricsSink(mySink)
+//
+// Metric names use slashes as separators, eg. "firewall/verdict/latency/seconds",
+// and may be converted by the sink to the conventions of its backend.
+package telemetry
+
+import (
+	"sync"
+)
+
+// MetricsSink receives the metrics emitted by the modules. All methods may be
+// called concurrently and on hot paths, such as for every packet, and must
+// return quickly. The given labels must not be modified or retained.
+type MetricsSink interface {
+	// IncCounter increases the counter with the given name and labels by
+	// delta.
+	IncCounter(name string, labels map[string]string, delta uint64)
+	// ObserveHistogram adds the value to the histogram with the given name
+	// and labels. Durations are observed in seconds.
+	ObserveHistogram(name string, labels map[string]string, value float64)
+	// SetGauge sets the gauge with the given name and labels to the value.
+	SetGauge(name string, labels map[string]string, value float64)
+}
+
+var (
+	sink     MetricsSink = newPortbaseSink()
+	sinkLock sync.RWMutex
+)
+
+// SetMetricsSink sets the sink that all metrics are emitted to. A nil sink
+// restores the default sink, which registers the metrics with the Prometheus
+// exporter of portbase. The sink should be set at startup, before any metrics
+// are emitted, as values emitted before are not carried over.
+func SetMetricsSink(s MetricsSink) {
+	if s == nil {
+		s = newPortbaseSink()
+	}
+
+	sinkLock.Lock()
+	defer sinkLock.Unlock()
+
+	sink = s
+}
+
+func getSink() MetricsSink {
+	sinkLock.RLock()
+	defer sinkLock.RUnlock()
+
+	return sink
+}
+
+// IncCounter increases the counter with the given name and labels by delta.
+func IncCounter(name string, labels map[string]string, delta uint64) {
+	getSink().IncCounter(name, labels, delta)
+}
+
+// ObserveHistogram adds the value to the histogram with the given name and
+// labels. Durations are observed in seconds.
+func ObserveHistogram(name string, labels map[string]string, value float64) {
+	getSink().ObserveHistogram(name, labels, value)
+}
+
+// SetGauge sets the gauge with the given name and labels to the value.
+func SetGauge(name string, labels map[string]string, value float64) {
+	getSink().SetGauge(name, labels, value)
+}
+
+// Metric is a metric with a fixed name and labels. The labels are resolved to
+// the key of the metric in the default sink once when the metric is created,
+// instead of every time it is emitted, so metrics that are emitted on hot
+// paths, such as for every packet, should be created once and reused.
+type Metric struct {
+	name   string
+	labels map[string]string
+	key    string
+}
+
+// NewMetric returns a metric with the given name and labels. The labels must
+// not be modified afterwards.
+func NewMetric(name string, labels map[string]string) *Metric {
+	return &Metric{
+		name:   name,
+		labels: labels,
+		key:    metricKey(name, labels),
+	}
+}
+
+// Name returns the name of the metric.
+func (m *Metric) Name() string {
+	return m.name
+}
+
+// Labels returns the labels of the metric. They must not be modified.
+func (m *Metric) Labels() map[string]string {
+	return m.labels
+}
+
+// IncCounter increases the counter of the metric by delta.
+func (m *Metric) IncCounter(delta uint64) {
+	s := getSink()
+	if ps, ok := s.(*portbaseSink); ok {
+		ps.incCounter(m.key, m.name, m.labels, delta)
+		return
+	}
+	s.IncCounter(m.name, m.labels, delta)
+}
+
+// ObserveHistogram adds the value to the histogram of the metric.
+func (m *Metric) ObserveHistogram(value float64) {
+	s := getSink()
+	if ps, ok := s.(*portbaseSink); ok {
+		ps.observeHistogram(m.key, m.name, m.labels, value)
+		return
+	}
+	s.ObserveHistogram(m.name, m.labels, value)
+}
+
+// SetGauge sets the gauge of the metric to the value.
+func (m *Metric) SetGauge(value float64) {
+	s := getSink()
+	if ps, ok := s.(*portbaseSink); ok {
+		ps.setGauge(m.key, m.name, m.labels, value)
+		return
+	}
+	s.SetGauge(m.name, m.labels, value)
+}
+
+// NoopSink discards all metrics. It is intended for tests and embedders that
+// do not collect metrics.
+type NoopSink struct{}
+
+// IncCounter implements MetricsSink.
+func (NoopSink) IncCounter(string, map[string]string, uint64) {}
+
+// ObserveHistogram implements MetricsSink.
+func (NoopSink) ObserveHistogram(string, map[string]string, float64) {}
+
+// SetGauge implements MetricsSink.
+func (NoopSink) SetGauge(string, map[string]string, float64) {}
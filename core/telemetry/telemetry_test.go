@@ -0,0 +1,75 @@
+package telemetry
+
+import (
+	"testing"
+)
+
+type countingSink struct {
+	NoopSink
+
+	counters uint64
+}
+
+func (s *countingSink) IncCounter(_ string, _ map[string]string, delta uint64) {
+	s.counters += delta
+}
+
+func TestSetMetricsSink(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	custom := &countingSink{}
+	SetMetricsSink(custom)
+	IncCounter("test/custom/total", nil, 2)
+	if custom.counters != 2 {
+		t.Errorf("counter should have been emitted to the custom sink, got %d", custom.counters)
+	}
+
+	// Metrics with pre-resolved labels are emitted to the custom sink too.
+	NewMetric("test/custom/total", map[string]string{"a": "1"}).IncCounter(3)
+	if custom.counters != 5 {
+		t.Errorf("metric should have been emitted to the custom sink, got %d", custom.counters)
+	}
+
+	// A nil sink restores the default sink.
+	SetMetricsSink(nil)
+	if getSink() != defaultSink {
+		t.Fatal("default sink should have been restored")
+	}
+	IncCounter("test/custom/total", nil, 1)
+	if custom.counters != 5 {
+		t.Error("counter should not have been emitted to the custom sink")
+	}
+}
+
+func TestPortbaseSink(t *testing.T) {
+	t.Parallel()
+
+	labels := map[string]string{"b": "2", "a": "1"}
+	defaultSink.IncCounter("test/portbase/total", labels, 1)
+	defaultSink.IncCounter("test/portbase/total", map[string]string{"a": "1", "b": "2"}, 2)
+	metric := NewMetric("test/portbase/total", labels)
+	defaultSink.incCounter(metric.key, metric.Name(), metric.Labels(), 3)
+	defaultSink.ObserveHistogram("test/portbase/seconds", nil, 0.5)
+	defaultSink.SetGauge("test/portbase/gauge", nil, 3)
+	defaultSink.SetGauge("test/portbase/gauge", nil, 4)
+	// Invalid names are rejected by the exporter and only logged.
+	defaultSink.IncCounter("test/invalid name", nil, 1)
+
+	defaultSink.lock.RLock()
+	defer defaultSink.lock.RUnlock()
+
+	counter, ok := defaultSink.counters["test/portbase/total{a=1,b=2}"]
+	if !ok {
+		t.Fatal("counter should have been registered once for both label orders and the pre-resolved labels")
+	}
+	if counter.Get() != 6 {
+		t.Errorf("unexpected counter value %d", counter.Get())
+	}
+	if _, ok := defaultSink.histograms["test/portbase/seconds"]; !ok {
+		t.Error("histogram should have been registered")
+	}
+	if len(defaultSink.failed) != 1 {
+		t.Errorf("only the invalid metric should have failed to register: %v", defaultSink.failed)
+	}
+	if _, ok := defaultSink.failed["test/invalid name"]; !ok {
+		t.Error("invalid metric should have been recorded as failed")
+	}
+}
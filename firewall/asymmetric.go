@@ -0,0 +1,61 @@
+package firewall
+
+import (
+	"context"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/portmaster/process"
+	"github.com/safing/portmaster/profile"
+)
+
+// checkConntrackState handles connections that start with a packet that the
+// system integration explicitly reports as invalid, if asymmetric routing is
+// allowed: Return traffic of an asymmetric route is handled like the
+// connection it belongs to, all other invalid packets are dropped. Packets
+// with an unknown conntrack state are never handled, and neither are any
+// packets if asymmetric routing is not allowed.
+func checkConntrackState(ctx context.Context, conn *network.Connection, _ *profile.LayeredProfile, _ packet.Packet) bool {
+	if !allowAsymmetricRouting() {
+		return false
+	}
+	state, inboundPacket := conn.ConntrackState()
+	if state != packet.ConntrackStateInvalid {
+		return false
+	}
+
+	if isAsymmetricReturnTraffic(conn) {
+		log.Tracer(ctx).Debugf("filter: handling invalid packet of %s as return traffic of an asymmetric route", conn)
+		return false
+	}
+
+	if inboundPacket && !conn.Inbound {
+		log.Tracer(ctx).Debugf("filter: dropping invalid return packet of %s, which might be caused by asymmetric routing", conn)
+	}
+	conn.Drop("invalid packet that is not part of a tracked connection", CfgOptionAllowAsymmetricRoutingKey)
+	return true
+}
+
+// isAsymmetricReturnTraffic returns whether the connection was started by an
+// inbound packet that belongs to an outgoing connection of a local process.
+// This happens when the return packets are received on a different path than
+// the one the outgoing packets were sent on, so that connection tracking did
+// not see the connection being established.
+func isAsymmetricReturnTraffic(conn *network.Connection) bool {
+	_, inboundPacket := conn.ConntrackState()
+	if !inboundPacket || conn.Inbound {
+		return false
+	}
+
+	proc := conn.Process()
+	if proc == nil {
+		return false
+	}
+	switch proc.Pid {
+	case process.UnidentifiedProcessID, process.UnsolicitedProcessID:
+		// The outgoing connection must be attributed to a local process.
+		return false
+	}
+	return true
+}
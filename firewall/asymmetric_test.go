@@ -0,0 +1,85 @@
+package firewall
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/portmaster/process"
+)
+
+func newConntrackTestConn(t *testing.T, state packet.ConntrackState, inboundPacket bool) *network.Connection {
+	t.Helper()
+
+	conn, err := network.NewSimulatedConnectionForProcess(network.ConnSpec{
+		Protocol:   packet.TCP,
+		LocalPort:  40000,
+		RemoteIP:   net.ParseIP("192.0.2.1"),
+		RemotePort: 443,
+	}, &process.Process{Pid: 4242, Name: "asymmetric"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetConntrackState(state, inboundPacket)
+	return conn
+}
+
+//nolint:paralleltest // Modifies global state.
+func TestCheckConntrackState(t *testing.T) {
+	defer func(allow func() bool) {
+		allowAsymmetricRouting = allow
+	}(allowAsymmetricRouting)
+	allowAsymmetricRouting = func() bool { return false }
+
+	// Tracked packets are not handled.
+	conn := newConntrackTestConn(t, packet.ConntrackStateNew, false)
+	if checkConntrackState(context.Background(), conn, nil, nil) {
+		t.Error("tracked packet should not be handled")
+	}
+	conn = &network.Connection{}
+	if checkConntrackState(context.Background(), conn, nil, nil) {
+		t.Error("packet without conntrack information should not be handled")
+	}
+
+	// Return traffic of an asymmetric route is detected.
+	conn = newConntrackTestConn(t, packet.ConntrackStateInvalid, true)
+	if !isAsymmetricReturnTraffic(conn) {
+		t.Error("inbound packet of outgoing connection should be detected as return traffic")
+	}
+	if isAsymmetricReturnTraffic(newConntrackTestConn(t, packet.ConntrackStateInvalid, false)) {
+		t.Error("outbound packet should not be detected as return traffic")
+	}
+
+	// Invalid packets are not handled, unless asymmetric routing is allowed.
+	conn = &network.Connection{}
+	conn.SetConntrackState(packet.ConntrackStateInvalid, true)
+	if checkConntrackState(context.Background(), conn, nil, nil) {
+		t.Fatal("invalid packet should not be handled by default")
+	}
+
+	// Packets without conntrack information are not invalid.
+	allowAsymmetricRouting = func() bool { return true }
+	conn = &network.Connection{Inbound: true}
+	conn.SetConntrackState(packet.ConntrackStateUnknown, true)
+	if checkConntrackState(context.Background(), conn, nil, nil) {
+		t.Error("packet with unknown conntrack state should not be handled")
+	}
+
+	// Invalid return traffic is handled like its connection, if allowed.
+	conn = newConntrackTestConn(t, packet.ConntrackStateInvalid, true)
+	if checkConntrackState(context.Background(), conn, nil, nil) {
+		t.Error("invalid return traffic should be passed on to the other deciders")
+	}
+	if conn.Verdict.Firewall != network.VerdictUndecided {
+		t.Errorf("invalid return traffic should not get a verdict, got %s", conn.Verdict.Firewall)
+	}
+
+	// Other invalid packets are still dropped.
+	conn = &network.Connection{Inbound: true}
+	conn.SetConntrackState(packet.ConntrackStateInvalid, true)
+	if !checkConntrackState(context.Background(), conn, nil, nil) {
+		t.Error("invalid inbound packet should be dropped")
+	}
+}
@@ -0,0 +1,53 @@
+package firewall
+
+import (
+	"strconv"
+
+	"github.com/safing/portmaster/core/audit"
+	"github.com/safing/portmaster/network"
+)
+
+// auditBlockedConnection sends an event to the Linux audit subsystem, if the
+// connection was blocked or dropped. The connection must be locked.
+func auditBlockedConnection(conn *network.Connection) {
+	if !audit.Enabled() {
+		return
+	}
+
+	switch conn.Verdict.Firewall { //nolint:exhaustive // Only blocking verdicts are audited.
+	case network.VerdictBlock, network.VerdictDrop:
+	default:
+		return
+	}
+
+	audit.Send("connection-"+conn.Verdict.Firewall.Verb(), false, blockedConnectionAuditFields(conn)...)
+}
+
+// blockedConnectionAuditFields returns the audit fields describing the
+// blocked connection. The connection must be locked.
+func blockedConnectionAuditFields(conn *network.Connection) []audit.Field {
+	direction := "outbound"
+	if conn.Inbound {
+		direction = "inbound"
+	}
+
+	fields := []audit.Field{
+		{Name: "exe", Value: conn.ProcessContext.BinaryPath},
+		{Name: "pid", Value: strconv.Itoa(conn.ProcessContext.PID)},
+		{Name: "profile", Value: conn.ProcessContext.Profile},
+		{Name: "direction", Value: direction},
+		{Name: "proto", Value: strconv.Itoa(int(conn.IPProtocol))},
+	}
+	if conn.Entity != nil {
+		fields = append(fields,
+			audit.Field{Name: "raddr", Value: conn.Entity.IP.String()},
+			audit.Field{Name: "rport", Value: strconv.Itoa(int(conn.Entity.Port))},
+			audit.Field{Name: "domain", Value: conn.Entity.Domain},
+		)
+	}
+	return append(fields,
+		audit.Field{Name: "reason", Value: conn.Reason.Msg},
+		audit.Field{Name: "rule", Value: conn.Reason.OptionKey},
+		audit.Field{Name: "conn_id", Value: conn.ID},
+	)
+}
@@ -0,0 +1,48 @@
+package firewall
+
+import (
+	"net"
+	"testing"
+
+	"github.com/safing/portmaster/intel"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+func TestBlockedConnectionAuditFields(t *testing.T) {
+	t.Parallel()
+
+	conn := &network.Connection{
+		ID:         "6-10.0.0.1-40000-1.1.1.1-443",
+		IPProtocol: packet.TCP,
+		Entity:     &intel.Entity{IP: net.IPv4(1, 1, 1, 1), Port: 443, Domain: "example.com."},
+		ProcessContext: network.ProcessContext{
+			BinaryPath: "/usr/bin/curl",
+			PID:        1000,
+			Profile:    "curl",
+		},
+	}
+	conn.SetVerdict(network.VerdictBlock, "blocked by rule", "", nil)
+	conn.Reason.OptionKey = "filter/endpoints"
+
+	fields := make(map[string]string)
+	for _, field := range blockedConnectionAuditFields(conn) {
+		fields[field.Name] = field.Value
+	}
+	for name, expected := range map[string]string{
+		"exe":       "/usr/bin/curl",
+		"pid":       "1000",
+		"direction": "outbound",
+		"proto":     "6",
+		"raddr":     "1.1.1.1",
+		"rport":     "443",
+		"domain":    "example.com.",
+		"reason":    "blocked by rule",
+		"rule":      "filter/endpoints",
+		"conn_id":   conn.ID,
+	} {
+		if fields[name] != expected {
+			t.Errorf("field %s should be %q, got %q", name, expected, fields[name])
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tevino/abool"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+const engineBreakerTrippedID = "interception:engine-breaker-tripped"
+
+// EngineBreakerSettings configures the circuit breaker of the decision engine.
+type EngineBreakerSettings struct {
+	// Threshold is the amount of consecutive engine errors that trip the
+	// breaker.
+	Threshold int
+	// Window is the time span in which the consecutive errors must occur.
+	// Errors that are further apart start a new count.
+	Window time.Duration
+	// Cooldown defines how long the engine is bypassed after the breaker
+	// tripped.
+	Cooldown time.Duration
+	// FailVerdict is applied to all packets while the breaker is tripped.
+	// Must be network.VerdictAccept, network.VerdictBlock or
+	// network.VerdictDrop.
+	FailVerdict network.Verdict
+}
+
+// DefaultEngineBreakerSettings are the settings of the circuit breaker of the
+// decision engine, if not changed with SetEngineBreakerSettings.
+var DefaultEngineBreakerSettings = EngineBreakerSettings{
+	Threshold:   50,
+	Window:      10 * time.Second,
+	Cooldown:    30 * time.Second,
+	FailVerdict: network.VerdictAccept,
+}
+
+// EngineBreakerState describes the state of the circuit breaker of the
+// decision engine.
+type EngineBreakerState struct {
+	Settings EngineBreakerSettings
+	// Tripped is set while the engine is bypassed.
+	Tripped bool
+	// TrippedAt is the time the breaker tripped the last time.
+	TrippedAt time.Time `json:",omitempty"`
+	// ConsecutiveErrors is the current count of consecutive engine errors.
+	ConsecutiveErrors int
+	// Trips is the amount of times the breaker tripped.
+	Trips uint64
+}
+
+// engineBreaker bypasses the decision engine after repeated errors, so that
+// a failing engine does not drop all network traffic.
+type engineBreaker struct {
+	lock sync.Mutex
+
+	settings EngineBreakerSettings
+
+	consecutiveErrors int
+	firstError        time.Time
+	trippedAt         time.Time
+	trips             uint64
+
+	// hasErrors and tripped allow to check the state without locking on
+	// every packet.
+	hasErrors *abool.AtomicBool
+	tripped   *abool.AtomicBool
+
+	onTrip    func(settings EngineBreakerSettings, err error)
+	onRecover func()
+}
+
+var engineCircuitBreaker = newEngineBreaker(DefaultEngineBreakerSettings, reportEngineBreakerTrip, reportEngineBreakerRecovery)
+
+func newEngineBreaker(settings EngineBreakerSettings, onTrip func(settings EngineBreakerSettings, err error), onRecover func()) *engineBreaker {
+	return &engineBreaker{
+		settings:  settings,
+		hasErrors: abool.New(),
+		tripped:   abool.New(),
+		onTrip:    onTrip,
+		onRecover: onRecover,
+	}
+}
+
+// SetEngineBreakerSettings sets the settings of the circuit breaker of the
+// decision engine. The breaker trips after the configured amount of
+// consecutive engine errors, such as failing to load a profile, and then
+// applies the fail verdict to all packets without calling the engine until
+// the cooldown elapsed. This prevents a failing engine from dropping all
+// network traffic.
+func SetEngineBreakerSettings(settings EngineBreakerSettings) error {
+	switch {
+	case settings.Threshold < 1:
+		return errors.New("threshold must be at least 1")
+	case settings.Window <= 0:
+		return errors.New("window must be positive")
+	case settings.Cooldown <= 0:
+		return errors.New("cooldown must be positive")
+	}
+	switch settings.FailVerdict { //nolint:exhaustive // Only these are valid.
+	case network.VerdictAccept, network.VerdictBlock, network.VerdictDrop:
+	default:
+		return fmt.Errorf("unsupported fail verdict %s", settings.FailVerdict)
+	}
+
+	engineCircuitBreaker.lock.Lock()
+	defer engineCircuitBreaker.lock.Unlock()
+
+	engineCircuitBreaker.settings = settings
+	return nil
+}
+
+// EngineBreaker returns the state of the circuit breaker of the decision
+// engine.
+func EngineBreaker() EngineBreakerState {
+	return engineCircuitBreaker.state()
+}
+
+// allow returns whether the engine may be called. If the breaker is tripped
+// and the cooldown elapsed, the breaker is reset.
+func (b *engineBreaker) allow(now time.Time) bool {
+	if !b.tripped.IsSet() {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !b.tripped.IsSet() {
+		return true
+	}
+	if now.Sub(b.trippedAt) < b.settings.Cooldown {
+		return false
+	}
+
+	b.consecutiveErrors = 0
+	b.hasErrors.UnSet()
+	b.tripped.UnSet()
+	if b.onRecover != nil {
+		b.onRecover()
+	}
+	return true
+}
+
+// recordError records an engine error and trips the breaker if the threshold
+// is reached.
+func (b *engineBreaker) recordError(now time.Time, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.tripped.IsSet() {
+		return
+	}
+
+	if b.consecutiveErrors == 0 || now.Sub(b.firstError) > b.settings.Window {
+		b.consecutiveErrors = 0
+		b.firstError = now
+	}
+	b.consecutiveErrors++
+	b.hasErrors.Set()
+
+	if b.consecutiveErrors < b.settings.Threshold {
+		return
+	}
+
+	b.trippedAt = now
+	b.trips++
+	b.tripped.Set()
+	if b.onTrip != nil {
+		b.onTrip(b.settings, err)
+	}
+}
+
+// recordSuccess resets the count of consecutive engine errors.
+func (b *engineBreaker) recordSuccess() {
+	if !b.hasErrors.IsSet() {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.consecutiveErrors = 0
+	b.hasErrors.UnSet()
+}
+
+// failVerdict returns the verdict that is applied while the breaker is
+// tripped.
+func (b *engineBreaker) failVerdict() network.Verdict {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.settings.FailVerdict
+}
+
+func (b *engineBreaker) state() EngineBreakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return EngineBreakerState{
+		Settings:          b.settings,
+		Tripped:           b.tripped.IsSet(),
+		TrippedAt:         b.trippedAt,
+		ConsecutiveErrors: b.consecutiveErrors,
+		Trips:             b.trips,
+	}
+}
+
+// applyEngineBreakerVerdict applies the fail verdict of the circuit breaker
+// to the packet.
+func applyEngineBreakerVerdict(pkt packet.Packet) {
+	if err := applyFailVerdict(pkt, engineCircuitBreaker.failVerdict()); err != nil {
+		log.Warningf("filter: failed to apply fail verdict to packet %s while decision engine is bypassed: %s", pkt, err)
+	}
+}
+
+// applyFailVerdict applies the given fail verdict to the packet without
+// making it permanent, as the real verdict is decided later. Verdicts other
+// than network.VerdictAccept and network.VerdictBlock drop the packet.
+func applyFailVerdict(pkt packet.Packet, verdict network.Verdict) error {
+	switch verdict { //nolint:exhaustive // Only these are valid.
+	case network.VerdictAccept:
+		return pkt.Accept()
+	case network.VerdictBlock:
+		return pkt.Block()
+	default:
+		return pkt.Drop()
+	}
+}
+
+func reportEngineBreakerTrip(settings EngineBreakerSettings, err error) {
+	log.Criticalf(
+		"filter: decision engine failed %d times in a row, bypassing it for %s, packets are %s until then: %s",
+		settings.Threshold, settings.Cooldown, settings.FailVerdict.Verb(), err,
+	)
+	interceptionModule.Warning(
+		engineBreakerTrippedID,
+		"Decision Engine Failing",
+		fmt.Sprintf(
+			"The Portmaster failed to decide on network connections repeatedly and currently does not filter the network. Connections are %s until the decision engine is retried in %s. Error: %s",
+			settings.FailVerdict.Verb(), settings.Cooldown, err,
+		),
+	)
+}
+
+func reportEngineBreakerRecovery() {
+	log.Warning("filter: retrying decision engine after bypass")
+	interceptionModule.Resolve(engineBreakerTrippedID)
+}
@@ -0,0 +1,151 @@
+package firewall
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/safing/portmaster/network"
+)
+
+func TestEngineBreaker(t *testing.T) {
+	t.Parallel()
+
+	var trips, recoveries int
+	b := newEngineBreaker(EngineBreakerSettings{
+		Threshold:   3,
+		Window:      time.Second,
+		Cooldown:    10 * time.Second,
+		FailVerdict: network.VerdictAccept,
+	}, func(EngineBreakerSettings, error) {
+		trips++
+	}, func() {
+		recoveries++
+	})
+	engineErr := errors.New("profile database corrupted")
+	start := time.Now()
+
+	// Errors interrupted by a success do not trip the breaker.
+	b.recordError(start, engineErr)
+	b.recordError(start, engineErr)
+	b.recordSuccess()
+	b.recordError(start, engineErr)
+	b.recordError(start, engineErr)
+	if !b.allow(start) || trips != 0 {
+		t.Fatal("breaker should not have tripped after a success")
+	}
+
+	// Errors that are further apart than the window do not trip the breaker.
+	b.recordError(start.Add(2*time.Second), engineErr)
+	if !b.allow(start.Add(2*time.Second)) || trips != 0 {
+		t.Fatal("breaker should not have tripped with errors outside of the window")
+	}
+	if state := b.state(); state.ConsecutiveErrors != 1 {
+		t.Fatalf("count should have been restarted, got %d", state.ConsecutiveErrors)
+	}
+
+	// Consecutive errors within the window trip the breaker.
+	b.recordError(start.Add(2*time.Second), engineErr)
+	b.recordError(start.Add(2*time.Second), engineErr)
+	if b.allow(start.Add(3*time.Second)) || trips != 1 {
+		t.Fatal("breaker should have tripped")
+	}
+	state := b.state()
+	if !state.Tripped || state.Trips != 1 {
+		t.Fatalf("unexpected state %+v", state)
+	}
+
+	// Further errors while tripped are ignored.
+	b.recordError(start.Add(3*time.Second), engineErr)
+	if trips != 1 {
+		t.Fatal("breaker should not trip again while tripped")
+	}
+
+	// The breaker recovers after the cooldown.
+	if b.allow(start.Add(11 * time.Second)) {
+		t.Fatal("engine should still be bypassed during the cooldown")
+	}
+	if !b.allow(start.Add(12*time.Second)) || recoveries != 1 {
+		t.Fatal("breaker should have recovered after the cooldown")
+	}
+	state = b.state()
+	if state.Tripped || state.ConsecutiveErrors != 0 {
+		t.Fatalf("unexpected state after recovery %+v", state)
+	}
+}
+
+func TestSetEngineBreakerSettings(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func(orig EngineBreakerSettings) {
+		_ = SetEngineBreakerSettings(orig)
+	}(EngineBreaker().Settings)
+
+	valid := EngineBreakerSettings{
+		Threshold:   5,
+		Window:      time.Second,
+		Cooldown:    time.Minute,
+		FailVerdict: network.VerdictDrop,
+	}
+	if err := SetEngineBreakerSettings(valid); err != nil {
+		t.Fatal(err)
+	}
+	if EngineBreaker().Settings != valid {
+		t.Errorf("settings were not applied: %+v", EngineBreaker().Settings)
+	}
+
+	invalid := valid
+	invalid.Threshold = 0
+	if SetEngineBreakerSettings(invalid) == nil {
+		t.Error("threshold of 0 should be rejected")
+	}
+	invalid = valid
+	invalid.Cooldown = 0
+	if SetEngineBreakerSettings(invalid) == nil {
+		t.Error("cooldown of 0 should be rejected")
+	}
+	invalid = valid
+	invalid.FailVerdict = network.VerdictRerouteToTunnel
+	if SetEngineBreakerSettings(invalid) == nil {
+		t.Error("tunneling should be rejected as fail verdict")
+	}
+}
+
+func TestEngineBreakerErrors(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func(orig EngineBreakerSettings) {
+		_ = SetEngineBreakerSettings(orig)
+		engineCircuitBreaker.recordSuccess()
+	}(EngineBreaker().Settings)
+	if err := SetEngineBreakerSettings(EngineBreakerSettings{
+		Threshold:   10,
+		Window:      time.Minute,
+		Cooldown:    time.Minute,
+		FailVerdict: network.VerdictAccept,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	engineCircuitBreaker.recordSuccess()
+
+	// Failed connections are decisions of the engine and are not counted.
+	if err := issueVerdict(&network.Connection{}, &failingPacket{}, network.VerdictFailed, false); err != nil {
+		t.Fatal(err)
+	}
+	if errs := EngineBreaker().ConsecutiveErrors; errs != 0 {
+		t.Errorf("failed connection should not count as engine error, got %d errors", errs)
+	}
+
+	// Undecided packets are counted.
+	if err := issueVerdict(&network.Connection{}, &failingPacket{}, network.VerdictUndecided, false); err != nil {
+		t.Fatal(err)
+	}
+	if errs := EngineBreaker().ConsecutiveErrors; errs != 1 {
+		t.Errorf("undecided packet should count as engine error, got %d errors", errs)
+	}
+
+	// Errors while applying the verdict are counted.
+	pkt := &failingPacket{failures: 1, err: errors.New("packet gone")}
+	if err := issueVerdict(&network.Connection{}, pkt, network.VerdictAccept, false); err == nil {
+		t.Fatal("expected verdict error")
+	}
+	if errs := EngineBreaker().ConsecutiveErrors; errs != 2 {
+		t.Errorf("verdict error should count as engine error, got %d errors", errs)
+	}
+}
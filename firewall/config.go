@@ -7,6 +7,7 @@
 	"github.com/safing/portbase/config"
 	"github.com/safing/portbase/notifications"
 	"github.com/safing/portmaster/core"
+	"github.com/safing/portmaster/network/packet"
 	"github.com/safing/spn/captain"
 )
 
@@ -22,6 +23,14 @@
 	cfgOptionAskTimeoutOrder = 3
 	askTimeout               config.IntOption
 
+	CfgOptionAskTimeoutActionKey   = "filter/askTimeoutAction"
+	cfgOptionAskTimeoutActionOrder = 4
+	askTimeoutAction               config.StringOption
+
+	CfgOptionAskWithPayloadSnippetKey   = "filter/askWithPayloadSnippet"
+	cfgOptionAskWithPayloadSnippetOrder = 5
+	askWithPayloadSnippet               config.BoolOption
+
 	CfgOptionPermanentVerdictsKey   = "filter/permanentVerdicts"
 	cfgOptionPermanentVerdictsOrder = 96
 	permanentVerdicts               config.BoolOption
@@ -29,6 +38,57 @@
 	CfgOptionDNSQueryInterceptionKey   = "filter/dnsQueryInterception"
 	cfgOptionDNSQueryInterceptionOrder = 97
 	dnsQueryInterception               config.BoolOption
+
+	CfgOptionInheritRelatedVerdictsKey   = "filter/inheritRelatedVerdicts"
+	cfgOptionInheritRelatedVerdictsOrder = 98
+	inheritRelatedVerdicts               config.BoolOption
+
+	CfgOptionAlwaysAllowPMTUICMPKey   = "filter/alwaysAllowPMTUICMP"
+	cfgOptionAlwaysAllowPMTUICMPOrder = 99
+	alwaysAllowPMTUICMP               config.BoolOption
+
+	CfgOptionDetectProtocolsKey   = "filter/detectProtocols"
+	cfgOptionDetectProtocolsOrder = 100
+	detectProtocols               config.BoolOption
+
+	CfgOptionBlockProtocolsKey   = "filter/blockProtocols"
+	cfgOptionBlockProtocolsOrder = 101
+	blockProtocols               config.StringArrayOption
+
+	CfgOptionAllowAsymmetricRoutingKey   = "filter/allowAsymmetricRouting"
+	cfgOptionAllowAsymmetricRoutingOrder = 103
+	allowAsymmetricRouting               config.BoolOption
+
+	CfgOptionBlockedDNSResponseKey   = "filter/blockedDNSResponse"
+	cfgOptionBlockedDNSResponseOrder = 104
+	blockedDNSResponse               config.StringOption
+
+	CfgOptionPersistVerdictsKey   = "filter/persistVerdicts"
+	cfgOptionPersistVerdictsOrder = 105
+	persistVerdicts               config.BoolOption
+
+	CfgOptionAllowDiscoveryProtocolsKey   = "filter/allowDiscoveryProtocols"
+	cfgOptionAllowDiscoveryProtocolsOrder = 106
+	allowDiscoveryProtocols               config.BoolOption
+
+	CfgOptionAllowDHCPKey   = "filter/allowDHCP"
+	cfgOptionAllowDHCPOrder = 107
+	allowDHCP               config.BoolOption
+
+	CfgOptionDeviceRulesKey   = "filter/deviceRules"
+	cfgOptionDeviceRulesOrder = 108
+	deviceRules               config.StringArrayOption
+
+	CfgOptionMaxConnectionRateKey   = "filter/maxConnectionRate"
+	cfgOptionMaxConnectionRateOrder = 109
+	maxConnectionRate               config.IntOption
+)
+
+// Possible values of the blocked DNS response option.
+const (
+	blockedDNSResponseOff      = "off"
+	blockedDNSResponseNXDomain = string(packet.DNSResponseNXDomain)
+	blockedDNSResponseSinkhole = string(packet.DNSResponseSinkhole)
 )
 
 func registerConfig() error {
@@ -68,6 +128,223 @@ func registerConfig() error {
 	}
 	dnsQueryInterception = config.Concurrent.GetAsBool(CfgOptionDNSQueryInterceptionKey, true)
 
+	err = config.Register(&config.Option{
+		Name:           "Inherit Verdicts of Related Connections",
+		Key:            CfgOptionInheritRelatedVerdictsKey,
+		Description:    "Some protocols, like FTP or SIP, open additional connections that are tracked by the system as related to the connection that initiated them. If enabled, these related connections inherit the verdict of their initiating connection, instead of being filtered on their own.",
+		OptType:        config.OptTypeBool,
+		ExpertiseLevel: config.ExpertiseLevelDeveloper,
+		ReleaseLevel:   config.ReleaseLevelExperimental,
+		DefaultValue:   true,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionInheritRelatedVerdictsOrder,
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	inheritRelatedVerdicts = config.Concurrent.GetAsBool(CfgOptionInheritRelatedVerdictsKey, true)
+
+	err = config.Register(&config.Option{
+		Name:           "Always Allow Path MTU Discovery",
+		Key:            CfgOptionAlwaysAllowPMTUICMPKey,
+		Description:    "ICMP and ICMPv6 error messages inherit the verdict of the connection they refer to. If enabled, \"Fragmentation Needed\" and \"Packet Too Big\" messages are always allowed, as connections silently stall when path MTU discovery is broken.",
+		OptType:        config.OptTypeBool,
+		ExpertiseLevel: config.ExpertiseLevelDeveloper,
+		ReleaseLevel:   config.ReleaseLevelExperimental,
+		DefaultValue:   true,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionAlwaysAllowPMTUICMPOrder,
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	alwaysAllowPMTUICMP = config.Concurrent.GetAsBool(CfgOptionAlwaysAllowPMTUICMPKey, true)
+
+	err = config.Register(&config.Option{
+		Name:           "Detect Application Protocols",
+		Key:            CfgOptionDetectProtocolsKey,
+		Description:    "Detect the application protocol of allowed TCP and UDP connections, like HTTP, TLS, SSH or DNS, from the first data they send, regardless of the port they use. Connections cannot get permanent verdicts until their protocol is detected.",
+		OptType:        config.OptTypeBool,
+		ExpertiseLevel: config.ExpertiseLevelDeveloper,
+		ReleaseLevel:   config.ReleaseLevelExperimental,
+		DefaultValue:   false,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionDetectProtocolsOrder,
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	detectProtocols = config.Concurrent.GetAsBool(CfgOptionDetectProtocolsKey, false)
+
+	err = config.Register(&config.Option{
+		Name:            "Block Application Protocols",
+		Key:             CfgOptionBlockProtocolsKey,
+		Description:     "Block connections that use any of these application protocols, regardless of the port they use. For example, block \"http\" to block all plaintext HTTP. Requires application protocol detection to be enabled.",
+		OptType:         config.OptTypeStringArray,
+		ExpertiseLevel:  config.ExpertiseLevelDeveloper,
+		ReleaseLevel:    config.ReleaseLevelExperimental,
+		DefaultValue:    []string{},
+		ValidationRegex: "^(http|tls|ssh|dns)$",
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionBlockProtocolsOrder,
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	blockProtocols = config.Concurrent.GetAsStringArray(CfgOptionBlockProtocolsKey, []string{})
+
+	err = config.Register(&config.Option{
+		Name:           "Allow Asymmetric Routing",
+		Key:            CfgOptionAllowAsymmetricRoutingKey,
+		Description:    "On networks with asymmetric routing, return packets may arrive on a different path than the outgoing packets were sent on and are then considered invalid by connection tracking. Enable this to handle invalid packets that belong to an outgoing connection of a local process like the connection they belong to, and to drop all other packets that are explicitly reported as invalid. Packets without connection tracking information are never considered invalid. This weakens a security check, as it also lets through forged packets that match an outgoing connection, so only enable it if your network routes asymmetrically.",
+		OptType:        config.OptTypeBool,
+		ExpertiseLevel: config.ExpertiseLevelDeveloper,
+		ReleaseLevel:   config.ReleaseLevelExperimental,
+		DefaultValue:   false,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionAllowAsymmetricRoutingOrder,
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	allowAsymmetricRouting = config.Concurrent.GetAsBool(CfgOptionAllowAsymmetricRoutingKey, false)
+
+	err = config.Register(&config.Option{
+		Name:           "Blocked DNS Query Response",
+		Key:            CfgOptionBlockedDNSResponseKey,
+		Description:    "When a DNS query that does not go through the Portmaster is blocked, answer it with a forged response instead of only blocking it, so that the querying software does not wait for a timeout or retry with other servers. The response either states that the domain does not exist (NXDOMAIN) or points to an address that cannot be connected to (sinkhole).",
+		OptType:        config.OptTypeString,
+		ExpertiseLevel: config.ExpertiseLevelDeveloper,
+		ReleaseLevel:   config.ReleaseLevelExperimental,
+		DefaultValue:   blockedDNSResponseOff,
+		Annotations: config.Annotations{
+			config.DisplayHintAnnotation:  config.DisplayHintOneOf,
+			config.DisplayOrderAnnotation: cfgOptionBlockedDNSResponseOrder,
+			config.CategoryAnnotation:     "Advanced",
+		},
+		PossibleValues: []config.PossibleValue{
+			{
+				Name:        "Off",
+				Value:       blockedDNSResponseOff,
+				Description: "Only block the query",
+			},
+			{
+				Name:        "NXDOMAIN",
+				Value:       blockedDNSResponseNXDomain,
+				Description: "Respond that the domain does not exist",
+			},
+			{
+				Name:        "Sinkhole",
+				Value:       blockedDNSResponseSinkhole,
+				Description: "Respond with the unspecified address 0.0.0.0 or ::",
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	blockedDNSResponse = config.Concurrent.GetAsString(CfgOptionBlockedDNSResponseKey, blockedDNSResponseOff)
+
+	err = config.Register(&config.Option{
+		Name:           "Keep Verdicts Across Restarts",
+		Key:            CfgOptionPersistVerdictsKey,
+		Description:    "Save the verdicts of active connections when the Portmaster shuts down and restore them when it starts again within a few minutes, such as when restarting for an update. Established connections then keep their verdict instead of being evaluated again, which avoids a load spike on busy systems. Only verdicts of connections that are still tracked by the system are restored. This is not supported on Windows.",
+		OptType:        config.OptTypeBool,
+		ExpertiseLevel: config.ExpertiseLevelDeveloper,
+		ReleaseLevel:   config.ReleaseLevelExperimental,
+		DefaultValue:   false,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionPersistVerdictsOrder,
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	persistVerdicts = config.Concurrent.GetAsBool(CfgOptionPersistVerdictsKey, false)
+
+	err = config.Register(&config.Option{
+		Name:           "Allow Local Service Discovery",
+		Key:            CfgOptionAllowDiscoveryProtocolsKey,
+		Description:    "Always allow the multicast and broadcast traffic of essential local network protocols, regardless of the rules: mDNS (UDP 5353) and SSDP (UDP 1900) for discovering devices and services. Blocking these makes devices in the local network, such as printers and media players, disappear. DHCP is allowed by \"Always Allow DHCP\" instead.",
+		OptType:        config.OptTypeBool,
+		ExpertiseLevel: config.ExpertiseLevelExpert,
+		DefaultValue:   true,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionAllowDiscoveryProtocolsOrder,
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	allowDiscoveryProtocols = config.Concurrent.GetAsBool(CfgOptionAllowDiscoveryProtocolsKey, true)
+
+	err = config.Register(&config.Option{
+		Name:           "Always Allow DHCP",
+		Key:            CfgOptionAllowDHCPKey,
+		Description:    "Always allow DHCP (UDP 67/68) and DHCPv6 (UDP 546/547) packets in the local network, regardless of the rules, so that this device can always obtain and renew its IP addresses. Packets are only allowed if they are recognized as DHCP messages. If disabled, DHCP is handled like any other connection.",
+		OptType:        config.OptTypeBool,
+		ExpertiseLevel: config.ExpertiseLevelExpert,
+		DefaultValue:   true,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionAllowDHCPOrder,
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	allowDHCP = config.Concurrent.GetAsBool(CfgOptionAllowDHCPKey, true)
+
+	err = config.Register(&config.Option{
+		Name:            "Device Rules",
+		Key:             CfgOptionDeviceRulesKey,
+		Description:     "Allow (+) or block (-) connections that are forwarded by this device, based on the device they originate from. Devices are identified by their name, IP or MAC address, eg. \"- phone\" or \"+ 192.168.1.10\". The first matching rule is applied. Connections of other devices are handled like any other connection. Requires that a device identity resolver is set, eg. by a DHCP server integration.",
+		OptType:         config.OptTypeStringArray,
+		ExpertiseLevel:  config.ExpertiseLevelDeveloper,
+		ReleaseLevel:    config.ReleaseLevelExperimental,
+		DefaultValue:    []string{},
+		ValidationRegex: `^[+-] \S+$`,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionDeviceRulesOrder,
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	deviceRules = config.Concurrent.GetAsStringArray(CfgOptionDeviceRulesKey, []string{})
+
+	err = config.Register(&config.Option{
+		Name:           "Maximum Connection Rate",
+		Key:            CfgOptionMaxConnectionRateKey,
+		Description:    "Block connections whose traffic exceeds this rate in kilobytes per second, averaged over 30 seconds. The rate is checked every 5 seconds, so connections may exceed it briefly. Set to 0 to disable. Only supported on Linux and requires connection tracking accounting to be enabled (net.netfilter.nf_conntrack_acct).",
+		OptType:        config.OptTypeInt,
+		ExpertiseLevel: config.ExpertiseLevelDeveloper,
+		ReleaseLevel:   config.ReleaseLevelExperimental,
+		DefaultValue:   0,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionMaxConnectionRateOrder,
+			config.UnitAnnotation:         "kB/s",
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	maxConnectionRate = config.Concurrent.GetAsInt(CfgOptionMaxConnectionRateKey, 0)
+
 	err = config.Register(&config.Option{
 		Name:           "Prompt Desktop Notifications",
 		Key:            CfgOptionAskWithSystemNotificationsKey,
@@ -108,6 +385,58 @@ func registerConfig() error {
 	}
 	askTimeout = config.Concurrent.GetAsInt(CfgOptionAskTimeoutKey, 60)
 
+	err = config.Register(&config.Option{
+		Name:           "Prompt Pending Action",
+		Key:            CfgOptionAskTimeoutActionKey,
+		Description:    "What to do with a connection when a prompt is not answered in time. The connection is held for a few seconds while waiting for an answer. Until the prompt is answered, the action is applied to every packet of the connection, but never made permanent, so that answering the prompt later applies the answer to the following packets.",
+		OptType:        config.OptTypeString,
+		ExpertiseLevel: config.ExpertiseLevelExpert,
+		DefaultValue:   askTimeoutActionBlock,
+		Annotations: config.Annotations{
+			config.DisplayHintAnnotation:  config.DisplayHintOneOf,
+			config.DisplayOrderAnnotation: cfgOptionAskTimeoutActionOrder,
+			config.CategoryAnnotation:     "General",
+		},
+		PossibleValues: []config.PossibleValue{
+			{
+				Name:        "Block",
+				Value:       askTimeoutActionBlock,
+				Description: "Block the connection",
+			},
+			{
+				Name:        "Drop",
+				Value:       askTimeoutActionDrop,
+				Description: "Drop the connection without feedback",
+			},
+			{
+				Name:        "Allow",
+				Value:       askTimeoutActionPermit,
+				Description: "Allow the connection",
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	askTimeoutAction = config.Concurrent.GetAsString(CfgOptionAskTimeoutActionKey, askTimeoutActionBlock)
+
+	err = config.Register(&config.Option{
+		Name:           "Prompt Payload Snippet",
+		Key:            CfgOptionAskWithPayloadSnippetKey,
+		Description:    "Include the start of the payload of the packet that triggered a prompt in the prompt notification, so that it can be inspected before answering. The payload may contain sensitive data, which is then also visible wherever the notification is shown.",
+		OptType:        config.OptTypeBool,
+		ExpertiseLevel: config.ExpertiseLevelDeveloper,
+		DefaultValue:   false,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionAskWithPayloadSnippetOrder,
+			config.CategoryAnnotation:     "General",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	askWithPayloadSnippet = config.Concurrent.GetAsBool(CfgOptionAskWithPayloadSnippetKey, false)
+
 	return nil
 }
 
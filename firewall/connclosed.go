@@ -0,0 +1,41 @@
+package firewall
+
+import (
+	"time"
+
+	"github.com/safing/portmaster/firewall/interception"
+	"github.com/safing/portmaster/network"
+)
+
+// openConnectionMinAge defines how long a connection must exist before it is
+// reconciled with the connections tracked by the OS, as new connections might
+// not be tracked yet.
+const openConnectionMinAge = 10 * time.Second
+
+// handleConnectionClosed releases the state that is kept for the connection
+// with the given ID, when the OS stopped tracking it.
+func handleConnectionClosed(connKey string) {
+	connectionRates.remove(connKey)
+	interception.UnpinConnection(connKey)
+	connectionTarpit.remove(connKey)
+
+	restoredVerdictsLock.Lock()
+	delete(restoredVerdicts, connKey)
+	restoredVerdictsLock.Unlock()
+}
+
+// openConnectionIDs returns the IDs of the active IP connections that should
+// be tracked by the OS.
+func openConnectionIDs() []string {
+	startedBefore := time.Now().Add(-openConnectionMinAge).Unix()
+
+	var ids []string
+	for _, conn := range network.GetAllConnections() {
+		conn.Lock()
+		if conn.Type == network.IPConnection && conn.Ended == 0 && conn.Started < startedBefore {
+			ids = append(ids, conn.ID)
+		}
+		conn.Unlock()
+	}
+	return ids
+}
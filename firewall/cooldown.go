@@ -0,0 +1,298 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/safing/portbase/api"
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/portmaster/profile"
+)
+
+// RemoteCooldown describes a remote that is blocked until a point in time.
+type RemoteCooldown struct {
+	// Remote is the blocked network, which holds only the remote IP.
+	Remote string
+	// Until holds the number of seconds in UNIX epoch time at which the
+	// cooldown ends.
+	Until int64
+	// Remaining is the remaining time in seconds until the cooldown ends.
+	Remaining int64
+}
+
+// remoteCooldowns holds the remotes that are blocked until a point in time.
+var remoteCooldowns = newCooldownList(nil)
+
+func init() {
+	// Set here, as the decider of the cooldowns would otherwise be part of an
+	// initialization cycle.
+	remoteCooldowns.onExpire = func(remote netip.Prefix) {
+		reEvaluateRemote(remote, network.GetAllConnections(), reEvaluateConnection)
+	}
+}
+
+// BlockRemoteUntil blocks all connections to and from the given IP until the
+// given time, regardless of the rules, for example after repeated blocked
+// attempts. Existing connections of the remote are re-evaluated and blocked as
+// well. When the time is up, the connections of the remote are re-evaluated
+// again. Blocking a remote that is already blocked replaces the end of the
+// cooldown.
+func BlockRemoteUntil(ip netip.Addr, until time.Time) error {
+	remote, err := cooldownPrefix(ip)
+	if err != nil {
+		return err
+	}
+	if !until.After(time.Now()) {
+		return errors.New("cooldown must end in the future")
+	}
+
+	remoteCooldowns.add(remote, until)
+	log.Infof("filter: blocking remote %s until %s", remote.Addr(), until.Format(time.RFC3339))
+	reEvaluateRemote(remote, network.GetAllConnections(), reEvaluateConnection)
+	return nil
+}
+
+// ClearRemoteCooldown ends the cooldown of the given IP before it expires and
+// re-evaluates the connections of the remote. It returns whether the remote
+// was in a cooldown.
+func ClearRemoteCooldown(ip netip.Addr) bool {
+	remote, err := cooldownPrefix(ip)
+	if err != nil || !remoteCooldowns.remove(remote) {
+		return false
+	}
+
+	log.Infof("filter: ended cooldown of remote %s", remote.Addr())
+	reEvaluateRemote(remote, network.GetAllConnections(), reEvaluateConnection)
+	return true
+}
+
+// RemoteCooldowns returns the remotes that are currently in a cooldown,
+// ordered by the end of the cooldown.
+func RemoteCooldowns() []RemoteCooldown {
+	return remoteCooldowns.list(time.Now())
+}
+
+// cooldownPrefix returns the network of a cooldown for the IP, which only
+// holds the IP itself.
+func cooldownPrefix(ip netip.Addr) (netip.Prefix, error) {
+	if !ip.IsValid() {
+		return netip.Prefix{}, errors.New("invalid IP")
+	}
+	ip = ip.Unmap()
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// checkRemoteCooldown blocks connections to and from remotes in a cooldown.
+func checkRemoteCooldown(_ context.Context, conn *network.Connection, _ *profile.LayeredProfile, _ packet.Packet) bool {
+	if conn.Entity == nil || conn.Entity.IP == nil {
+		return false
+	}
+	remote, ok := remoteCooldowns.lookup(conn.Entity.IP, time.Now())
+	if !ok {
+		return false
+	}
+
+	conn.Block(fmt.Sprintf("remote is in a cooldown until %s", remote.Format(time.RFC3339)), noReasonOptionKey)
+	return true
+}
+
+// reEvaluateRemote re-evaluates the connections of the remote and resets
+// their permanent verdicts in the system integration, so that their packets
+// reach the firewall again. Connections with a pinned verdict are skipped, see
+// PinConnectionVerdict.
+func reEvaluateRemote(
+	remote netip.Prefix,
+	conns []*network.Connection,
+	reEvaluate func(context.Context, *network.Connection) bool,
+) {
+	ctx, tracer := log.AddTracer(context.Background())
+	defer tracer.Submit()
+
+	var reEvaluated, changedVerdicts int
+	for _, conn := range conns {
+		func() {
+			conn.Lock()
+			defer conn.Unlock()
+
+			if conn.Entity == nil || verdictPinned(conn) {
+				return
+			}
+			ip, ok := netip.AddrFromSlice(conn.Entity.IP)
+			if !ok || !remote.Contains(ip.Unmap()) {
+				return
+			}
+			reEvaluated++
+
+			if reEvaluate(ctx, conn) {
+				changedVerdicts++
+			}
+
+			if conn.Type == network.IPConnection && conn.VerdictPermanent {
+				if err := resetVerdictOfConnection(connectionInfo(conn)); err != nil {
+					tracer.Warningf("filter: failed to reset permanent verdict of %s: %s", conn, err)
+				}
+			}
+		}()
+	}
+
+	tracer.Infof("filter: re-evaluated %d connections of remote %s, %d changed", reEvaluated, remote.Addr(), changedVerdicts)
+}
+
+// cooldownList holds remotes that are blocked until a point in time.
+type cooldownList struct {
+	lock sync.Mutex
+
+	entries map[netip.Prefix]*cooldownEntry
+	// onExpire is called when a cooldown expires.
+	onExpire func(remote netip.Prefix)
+}
+
+type cooldownEntry struct {
+	until time.Time
+	timer *time.Timer
+}
+
+func newCooldownList(onExpire func(remote netip.Prefix)) *cooldownList {
+	return &cooldownList{
+		entries:  make(map[netip.Prefix]*cooldownEntry),
+		onExpire: onExpire,
+	}
+}
+
+// add adds or replaces the cooldown of the remote.
+func (cl *cooldownList) add(remote netip.Prefix, until time.Time) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	if entry, ok := cl.entries[remote]; ok {
+		entry.timer.Stop()
+	}
+	entry := &cooldownEntry{until: until}
+	entry.timer = time.AfterFunc(time.Until(until), func() {
+		cl.expire(remote, entry)
+	})
+	cl.entries[remote] = entry
+}
+
+// expire removes the cooldown entry of the remote, if it was not replaced or
+// removed in the meantime.
+func (cl *cooldownList) expire(remote netip.Prefix, entry *cooldownEntry) {
+	cl.lock.Lock()
+	current, ok := cl.entries[remote]
+	if !ok || current != entry {
+		cl.lock.Unlock()
+		return
+	}
+	delete(cl.entries, remote)
+	cl.lock.Unlock()
+
+	log.Infof("filter: cooldown of remote %s expired", remote.Addr())
+	if cl.onExpire != nil {
+		cl.onExpire(remote)
+	}
+}
+
+// remove removes the cooldown of the remote and returns whether it existed.
+func (cl *cooldownList) remove(remote netip.Prefix) bool {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	entry, ok := cl.entries[remote]
+	if ok {
+		entry.timer.Stop()
+		delete(cl.entries, remote)
+	}
+	return ok
+}
+
+// lookup returns the end of the cooldown of the IP, if it is in one.
+func (cl *cooldownList) lookup(ip net.IP, now time.Time) (until time.Time, ok bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return time.Time{}, false
+	}
+	addr = addr.Unmap()
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	if len(cl.entries) == 0 {
+		return time.Time{}, false
+	}
+	entry, ok := cl.entries[netip.PrefixFrom(addr, addr.BitLen())]
+	if !ok || !entry.until.After(now) {
+		return time.Time{}, false
+	}
+	return entry.until, true
+}
+
+// list returns the active cooldowns, ordered by their end.
+func (cl *cooldownList) list(now time.Time) []RemoteCooldown {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	cooldowns := make([]RemoteCooldown, 0, len(cl.entries))
+	for remote, entry := range cl.entries {
+		if !entry.until.After(now) {
+			continue
+		}
+		cooldowns = append(cooldowns, RemoteCooldown{
+			Remote:    remote.String(),
+			Until:     entry.until.Unix(),
+			Remaining: int64(entry.until.Sub(now) / time.Second),
+		})
+	}
+	sort.Slice(cooldowns, func(i, j int) bool {
+		return cooldowns[i].Until < cooldowns[j].Until
+	})
+	return cooldowns
+}
+
+func registerRemoteCooldownAPIEndpoints() error {
+	if err := api.RegisterEndpoint(api.Endpoint{
+		Path:      "interception/cooldowns",
+		Read:      api.PermitUser,
+		BelongsTo: interceptionModule,
+		StructFunc: func(ar *api.Request) (i interface{}, err error) {
+			return RemoteCooldowns(), nil
+		},
+		Name:        "Get Remote Cooldowns",
+		Description: "Returns the remotes whose connections are blocked until the end of a cooldown.",
+	}); err != nil {
+		return err
+	}
+
+	return api.RegisterEndpoint(api.Endpoint{
+		Path:      "interception/cooldowns/clear",
+		Write:     api.PermitUser,
+		BelongsTo: interceptionModule,
+		ActionFunc: func(ar *api.Request) (msg string, err error) {
+			ip, err := netip.ParseAddr(ar.Request.URL.Query().Get("ip"))
+			if err != nil {
+				return "", fmt.Errorf("invalid ip: %w", err)
+			}
+
+			if !ClearRemoteCooldown(ip) {
+				return "", errors.New("remote is not in a cooldown")
+			}
+			return "cleared cooldown", nil
+		},
+		Name:        "Clear Remote Cooldown",
+		Description: "Ends the cooldown of a remote before it expires and re-evaluates its connections.",
+		Parameters: []api.Parameter{{
+			Method:      http.MethodGet,
+			Field:       "ip",
+			Value:       "<IP>",
+			Description: "Specify the IP of the remote.",
+		}},
+	})
+}
@@ -0,0 +1,140 @@
+package firewall
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/safing/portmaster/intel"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+func TestCooldownList(t *testing.T) {
+	t.Parallel()
+
+	expired := make(chan netip.Prefix, 1)
+	cl := newCooldownList(func(remote netip.Prefix) {
+		expired <- remote
+	})
+	remote, err := cooldownPrefix(netip.MustParseAddr("::ffff:192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.String() != "192.0.2.1/32" {
+		t.Errorf("unexpected cooldown network %s", remote)
+	}
+	if _, err := cooldownPrefix(netip.Addr{}); err == nil {
+		t.Error("invalid IPs must not be blocked")
+	}
+
+	now := time.Now()
+	cl.add(remote, now.Add(time.Hour))
+	if _, ok := cl.lookup(net.IPv4(192, 0, 2, 1), now); !ok {
+		t.Error("remote should be in a cooldown")
+	}
+	if _, ok := cl.lookup(net.IPv4(192, 0, 2, 2), now); ok {
+		t.Error("other remotes must not be in a cooldown")
+	}
+	if _, ok := cl.lookup(net.IPv4(192, 0, 2, 1), now.Add(2*time.Hour)); ok {
+		t.Error("cooldown should have ended")
+	}
+	if cooldowns := cl.list(now); len(cooldowns) != 1 || cooldowns[0].Remote != "192.0.2.1/32" || cooldowns[0].Remaining != 3600 {
+		t.Errorf("unexpected cooldowns %+v", cooldowns)
+	}
+
+	// Replacing the cooldown makes it expire at the new time.
+	cl.add(remote, time.Now().Add(10*time.Millisecond))
+	select {
+	case expiredRemote := <-expired:
+		if expiredRemote != remote {
+			t.Errorf("unexpected expired remote %s", expiredRemote)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cooldown did not expire")
+	}
+	if len(cl.list(time.Now())) != 0 {
+		t.Error("expired cooldown should have been removed")
+	}
+
+	// Removed cooldowns do not expire.
+	cl.add(remote, time.Now().Add(10*time.Millisecond))
+	if !cl.remove(remote) || cl.remove(remote) {
+		t.Error("cooldown should have been removed once")
+	}
+	select {
+	case <-expired:
+		t.Error("removed cooldown must not expire")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRemoteCooldown(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	var reset int
+	defer func(orig func(*packet.Info) error) { resetVerdictOfConnection = orig }(resetVerdictOfConnection)
+	defer func(orig *cooldownList) { remoteCooldowns = orig }(remoteCooldowns)
+	resetVerdictOfConnection = func(*packet.Info) error {
+		reset++
+		return nil
+	}
+	remoteCooldowns = newCooldownList(nil)
+
+	newConn := func(id string, remote net.IP) *network.Connection {
+		conn := &network.Connection{
+			ID:               id,
+			Type:             network.IPConnection,
+			IPVersion:        packet.IPv4,
+			IPProtocol:       packet.TCP,
+			LocalIP:          net.IPv4(10, 0, 0, 1),
+			LocalPort:        40000,
+			Entity:           &intel.Entity{IP: remote, Port: 443},
+			VerdictPermanent: true,
+		}
+		conn.SetVerdict(network.VerdictAccept, "allowed by rule", "", nil)
+		finalizeVerdict(conn)
+		return conn
+	}
+	blockedConn := newConn("blocked", net.IPv4(192, 0, 2, 1))
+	otherConn := newConn("other", net.IPv4(192, 0, 2, 2))
+	conns := []*network.Connection{blockedConn, otherConn}
+	reEvaluate := func(ctx context.Context, conn *network.Connection) bool {
+		if checkRemoteCooldown(ctx, conn, nil, nil) {
+			finalizeVerdict(conn)
+			return true
+		}
+		conn.Verdict.Active = network.VerdictUndecided
+		conn.SetVerdict(network.VerdictAccept, "allowed by rule", "", nil)
+		finalizeVerdict(conn)
+		return true
+	}
+
+	remote, _ := cooldownPrefix(netip.MustParseAddr("192.0.2.1"))
+	remoteCooldowns.add(remote, time.Now().Add(time.Hour))
+	reEvaluateRemote(remote, conns, reEvaluate)
+	if blockedConn.Verdict.Active != network.VerdictBlock {
+		t.Errorf("connection to remote in cooldown should be blocked, got %s", blockedConn.Verdict.Active)
+	}
+	if otherConn.Verdict.Active != network.VerdictAccept {
+		t.Errorf("connection to other remote should be accepted, got %s", otherConn.Verdict.Active)
+	}
+	if reset != 1 {
+		t.Errorf("expected permanent verdict of one connection to be reset, got %d", reset)
+	}
+
+	// Clearing the cooldown makes the connections of the remote pass again.
+	if !remoteCooldowns.remove(remote) {
+		t.Fatal("cooldown should have been removed")
+	}
+	reEvaluateRemote(remote, conns, reEvaluate)
+	if blockedConn.Verdict.Active != network.VerdictAccept {
+		t.Errorf("connection should be accepted after the cooldown, got %s", blockedConn.Verdict.Active)
+	}
+	if ClearRemoteCooldown(netip.MustParseAddr("192.0.2.1")) {
+		t.Error("cleared cooldown must not be cleared again")
+	}
+	if err := BlockRemoteUntil(netip.MustParseAddr("192.0.2.1"), time.Now().Add(-time.Second)); err == nil {
+		t.Error("cooldowns in the past must be rejected")
+	}
+}
@@ -0,0 +1,65 @@
+package firewall
+
+import (
+	"time"
+
+	"github.com/safing/portmaster/firewall/interception"
+	"github.com/safing/portmaster/network"
+)
+
+// CurrentVerdict returns the verdict that the connection with the given ID,
+// see network.Connection.ID, is currently handled with, together with its
+// reason and whether the verdict is applied by the system integration without
+// handing packets to the Portmaster (fast-pathed), such as with a permanent
+// verdict marked in the connection tracking on Linux. Connections with a
+// verdict restored from before a restart that did not send packets yet report
+// the restored verdict. For unknown connections, network.VerdictUndecided is
+// returned. In contrast to the verdict history, this never changes the
+// connection and reflects its live state.
+func CurrentVerdict(connKey string) (verdict network.Verdict, reason interception.VerdictReason, fastPathed bool) {
+	return currentVerdict(connKey, network.GetConnection)
+}
+
+func currentVerdict(
+	connKey string,
+	getConnection func(id string) (*network.Connection, bool),
+) (verdict network.Verdict, reason interception.VerdictReason, fastPathed bool) {
+	if conn, ok := getConnection(connKey); ok {
+		conn.Lock()
+		defer conn.Unlock()
+
+		reason = interception.VerdictReason{
+			Msg:     conn.Reason.Msg,
+			Context: conn.Reason.Context,
+		}
+		return conn.Verdict.Active, reason, verdictIsFastPathed(conn)
+	}
+
+	// Check the verdicts restored from before the restart.
+	restoredVerdictsLock.Lock()
+	defer restoredVerdictsLock.Unlock()
+
+	if persisted, ok := restoredVerdicts[connKey]; ok && time.Now().Before(restoredVerdictsValidUntil) {
+		reason = interception.VerdictReason{
+			Msg:     persisted.Reason.Msg,
+			Context: persisted.Reason.Context,
+		}
+		return persisted.Verdict, reason, false
+	}
+	return network.VerdictUndecided, reason, false
+}
+
+// verdictIsFastPathed returns whether the verdict of the connection is applied
+// by the system integration without handing packets to the Portmaster. The
+// connection must be locked.
+func verdictIsFastPathed(conn *network.Connection) bool {
+	switch conn.Verdict.Active { //nolint:exhaustive // Only some verdicts are fast-pathed.
+	case network.VerdictAccept, network.VerdictBlock, network.VerdictDrop:
+		return conn.VerdictPermanent
+	case network.VerdictRerouteToNameserver, network.VerdictRerouteToTunnel:
+		// Rerouting is always marked in the system integration.
+		return true
+	default:
+		return false
+	}
+}
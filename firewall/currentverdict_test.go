@@ -0,0 +1,66 @@
+package firewall
+
+import (
+	"testing"
+	"time"
+
+	"github.com/safing/portmaster/network"
+)
+
+func TestCurrentVerdict(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	cached := &network.Connection{ID: "cached"}
+	cached.SetVerdict(network.VerdictBlock, "blocked by rule", "", nil)
+	finalizeVerdict(cached)
+	fastPathed := &network.Connection{ID: "fast-pathed", VerdictPermanent: true}
+	fastPathed.SetVerdict(network.VerdictAccept, "allowed by rule", "", nil)
+	finalizeVerdict(fastPathed)
+
+	conns := map[string]*network.Connection{
+		cached.ID:     cached,
+		fastPathed.ID: fastPathed,
+	}
+	getConnection := func(id string) (*network.Connection, bool) {
+		conn, ok := conns[id]
+		return conn, ok
+	}
+
+	// Cached connection.
+	verdict, reason, fast := currentVerdict("cached", getConnection)
+	if verdict != network.VerdictBlock || reason.Msg != "blocked by rule" || fast {
+		t.Errorf("unexpected verdict of cached connection: %s %q %v", verdict, reason.Msg, fast)
+	}
+
+	// Fast-pathed connection.
+	verdict, reason, fast = currentVerdict("fast-pathed", getConnection)
+	if verdict != network.VerdictAccept || reason.Msg != "allowed by rule" || !fast {
+		t.Errorf("unexpected verdict of fast-pathed connection: %s %q %v", verdict, reason.Msg, fast)
+	}
+
+	// Unknown connection.
+	verdict, reason, fast = currentVerdict("unknown", getConnection)
+	if verdict != network.VerdictUndecided || reason.Msg != "" || fast {
+		t.Errorf("unexpected verdict of unknown connection: %s %q %v", verdict, reason.Msg, fast)
+	}
+
+	// Connection with a restored verdict.
+	restoredVerdictsLock.Lock()
+	restoredVerdicts = map[string]*persistedVerdict{
+		"restored": {
+			ID:      "restored",
+			Verdict: network.VerdictDrop,
+			Reason:  network.Reason{Msg: "dropped by rule"},
+		},
+	}
+	restoredVerdictsValidUntil = time.Now().Add(time.Minute)
+	restoredVerdictsLock.Unlock()
+	defer func() {
+		restoredVerdictsLock.Lock()
+		restoredVerdicts = nil
+		restoredVerdictsLock.Unlock()
+	}()
+
+	verdict, reason, fast = currentVerdict("restored", getConnection)
+	if verdict != network.VerdictDrop || reason.Msg != "dropped by rule" || fast {
+		t.Errorf("unexpected verdict of restored connection: %s %q %v", verdict, reason.Msg, fast)
+	}
+}
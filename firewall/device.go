@@ -0,0 +1,70 @@
+package firewall
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/portmaster/profile"
+)
+
+// checkDeviceRules applies the device rules to forwarded connections of a
+// device with a known identity.
+func checkDeviceRules(_ context.Context, conn *network.Connection, _ *profile.LayeredProfile, _ packet.Packet) bool {
+	device := conn.DeviceIdentity()
+	if device == nil {
+		return false
+	}
+
+	for _, rule := range deviceRules() {
+		permit, ok := matchDeviceRule(rule, device)
+		if !ok {
+			continue
+		}
+
+		if permit {
+			conn.Accept(fmt.Sprintf("device %s is allowed by rule %s", deviceName(device), rule), CfgOptionDeviceRulesKey)
+		} else {
+			conn.Deny(fmt.Sprintf("device %s is blocked by rule %s", deviceName(device), rule), CfgOptionDeviceRulesKey)
+		}
+		return true
+	}
+	return false
+}
+
+// matchDeviceRule returns whether the rule, in the form of "+ device" or
+// "- device", matches the name, IP or MAC address of the device and whether
+// it permits the device.
+func matchDeviceRule(rule string, device *network.DeviceIdentity) (permit, ok bool) {
+	action, value, found := strings.Cut(rule, " ")
+	if !found || (action != "+" && action != "-") {
+		return false, false
+	}
+	value = strings.TrimSpace(value)
+
+	switch {
+	case device.Name != "" && strings.EqualFold(value, device.Name):
+	case device.IP != nil && net.ParseIP(value).Equal(device.IP):
+	case device.MAC != nil && isMAC(value, device.MAC):
+	default:
+		return false, false
+	}
+	return action == "+", true
+}
+
+func isMAC(value string, mac net.HardwareAddr) bool {
+	parsed, err := net.ParseMAC(value)
+	return err == nil && bytes.Equal(parsed, mac)
+}
+
+// deviceName returns a name of the device for the verdict reason.
+func deviceName(device *network.DeviceIdentity) string {
+	if device.Name != "" {
+		return device.Name
+	}
+	return device.IP.String()
+}
@@ -0,0 +1,61 @@
+package firewall
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/safing/portmaster/intel"
+	"github.com/safing/portmaster/network"
+)
+
+// testDeviceResolver maps source IPs to device identities.
+type testDeviceResolver map[string]*network.DeviceIdentity
+
+func (r testDeviceResolver) ResolveDeviceIdentity(ip net.IP) (*network.DeviceIdentity, bool) {
+	identity, ok := r[ip.String()]
+	return identity, ok
+}
+
+//nolint:paralleltest // Modifies global state.
+func TestCheckDeviceRules(t *testing.T) {
+	laptopMAC, _ := net.ParseMAC("02:00:00:00:00:01")
+	network.SetDeviceIdentityResolver(testDeviceResolver{
+		"192.168.1.10": {Name: "laptop", IP: net.ParseIP("192.168.1.10"), MAC: laptopMAC},
+		"192.168.1.11": {Name: "phone", IP: net.ParseIP("192.168.1.11")},
+		"192.168.1.12": {IP: net.ParseIP("192.168.1.12")},
+	})
+	defer network.SetDeviceIdentityResolver(nil)
+
+	defer func(orig func() []string) { deviceRules = orig }(deviceRules)
+	deviceRules = func() []string {
+		return []string{"- 02-00-00-00-00-01", "+ Phone", "- 192.168.1.12"}
+	}
+
+	tests := []struct {
+		name      string
+		srcIP     string
+		forwarded bool
+		decided   bool
+		verdict   network.Verdict
+	}{
+		{"mac", "192.168.1.10", true, true, network.VerdictBlock},
+		{"name", "192.168.1.11", true, true, network.VerdictAccept},
+		{"ip", "192.168.1.12", true, true, network.VerdictBlock},
+		{"unknown device", "192.168.1.13", true, false, network.VerdictUndecided},
+		{"not forwarded", "192.168.1.10", false, false, network.VerdictUndecided},
+	}
+	for _, tt := range tests {
+		conn := &network.Connection{
+			Entity:    &intel.Entity{IP: net.IPv4(198, 51, 100, 1)},
+			LocalIP:   net.ParseIP(tt.srcIP),
+			Forwarded: tt.forwarded,
+		}
+		if decided := checkDeviceRules(context.Background(), conn, nil, nil); decided != tt.decided {
+			t.Errorf("%s: expected decided=%t, got %t", tt.name, tt.decided, decided)
+		}
+		if conn.Verdict.Firewall != tt.verdict {
+			t.Errorf("%s: expected verdict %s, got %s", tt.name, tt.verdict.Verb(), conn.Verdict.Firewall.Verb())
+		}
+	}
+}
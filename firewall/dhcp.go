@@ -0,0 +1,153 @@
+package firewall
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network/netutils"
+	"github.com/safing/portmaster/network/packet"
+)
+
+const (
+	// dhcpv4MinLength is the length of the fixed BOOTP header and the magic
+	// cookie that starts the options.
+	dhcpv4MinLength       = 240
+	dhcpv4MagicCookieAt   = 236
+	dhcpv4MaxHardwareAddr = 16
+
+	dhcpv6HeaderLength      = 4
+	dhcpv6RelayHeaderLength = 34
+	dhcpv6OptionHeader      = 4
+)
+
+var dhcpv4MagicCookie = []byte{99, 130, 83, 99}
+
+// DHCPv6 message types, see RFC 8415.
+const (
+	dhcpv6Solicit    = 1
+	dhcpv6RelayForw  = 12
+	dhcpv6RelayRepl  = 13
+	dhcpv6MaxMsgType = 36 // Highest assigned message type.
+)
+
+// fastTrackDHCP permits DHCP and DHCPv6 packets in local network scopes, so
+// that the device can always acquire and renew its addresses, regardless of
+// the rules. The packets must be recognized as DHCP by their payload, else
+// they are handled like any other connection. The interception always copies
+// the packets of the DHCP ports fully, so that they can be recognized.
+func fastTrackDHCP(pkt packet.Packet) (handled bool) {
+	meta := pkt.Info()
+	if !allowDHCP() {
+		return false
+	}
+
+	// DHCP and DHCPv6 must be UDP.
+	if meta.Protocol != packet.UDP {
+		return false
+	}
+
+	// DHCP is only valid in local network scopes.
+	switch netutils.ClassifyIP(meta.Dst) { //nolint:exhaustive // Checking for specific values only.
+	case netutils.HostLocal, netutils.LinkLocal, netutils.SiteLocal, netutils.LocalMulticast:
+	default:
+		return false
+	}
+
+	// Check the payload.
+	if err := pkt.LoadPacketData(); err != nil {
+		log.Debugf("filter: failed to load DHCP packet data: %s", err)
+		return false
+	}
+	name := matchDHCPMessage(meta.Version, meta.DstPort, pkt.Payload())
+	if name == "" {
+		log.Debugf("filter: not fast-tracking packet to DHCP port, as it is not a %s message: %s", dhcpProtocolName(meta.DstPort), pkt)
+		return false
+	}
+
+	// Log and permit.
+	log.Debugf("filter: fast-track accepting %s: %s", name, pkt)
+	_ = pkt.PermanentAccept()
+	return true
+}
+
+// dhcpProtocolName returns the name of the DHCP protocol that uses the given
+// destination port.
+func dhcpProtocolName(dstPort uint16) string {
+	switch dstPort {
+	case 546, 547:
+		return "DHCPv6"
+	default:
+		return "DHCP"
+	}
+}
+
+// matchDHCPMessage returns the name of the DHCP protocol of the given UDP
+// payload sent to the given destination port, or an empty string if it is not
+// a DHCP message. DHCP is only valid over IPv4 and DHCPv6 over IPv6.
+func matchDHCPMessage(ipVersion packet.IPVersion, dstPort uint16, payload []byte) string {
+	switch {
+	case (dstPort == 67 || dstPort == 68) && ipVersion == packet.IPv4:
+		if isDHCPv4Message(payload) {
+			return "DHCP"
+		}
+	case (dstPort == 546 || dstPort == 547) && ipVersion == packet.IPv6:
+		if isDHCPv6Message(payload) {
+			return "DHCPv6"
+		}
+	}
+	return ""
+}
+
+// isDHCPv4Message checks for a BOOTP request or reply that carries the magic
+// cookie of DHCP options, see RFC 2131.
+func isDHCPv4Message(payload []byte) bool {
+	if len(payload) < dhcpv4MinLength {
+		return false
+	}
+
+	switch payload[0] {
+	case 1, 2: // BOOTREQUEST, BOOTREPLY
+	default:
+		return false
+	}
+	if payload[2] > dhcpv4MaxHardwareAddr {
+		return false
+	}
+	return bytes.Equal(payload[dhcpv4MagicCookieAt:dhcpv4MagicCookieAt+len(dhcpv4MagicCookie)], dhcpv4MagicCookie)
+}
+
+// isDHCPv6Message checks for a DHCPv6 client, server or relay message with
+// well-formed options, see RFC 8415.
+func isDHCPv6Message(payload []byte) bool {
+	if len(payload) < dhcpv6HeaderLength {
+		return false
+	}
+
+	// Message type and the start of the options.
+	var options []byte
+	switch msgType := payload[0]; {
+	case msgType == dhcpv6RelayForw || msgType == dhcpv6RelayRepl:
+		if len(payload) < dhcpv6RelayHeaderLength {
+			return false
+		}
+		options = payload[dhcpv6RelayHeaderLength:]
+	case msgType >= dhcpv6Solicit && msgType <= dhcpv6MaxMsgType:
+		options = payload[dhcpv6HeaderLength:]
+	default:
+		return false
+	}
+
+	// The options must fill the rest of the message exactly.
+	for len(options) > 0 {
+		if len(options) < dhcpv6OptionHeader {
+			return false
+		}
+		optionLength := int(binary.BigEndian.Uint16(options[2:4]))
+		if len(options) < dhcpv6OptionHeader+optionLength {
+			return false
+		}
+		options = options[dhcpv6OptionHeader+optionLength:]
+	}
+	return true
+}
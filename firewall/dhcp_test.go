@@ -0,0 +1,144 @@
+package firewall
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/safing/portmaster/network/packet"
+)
+
+// newTestDHCPDiscover returns the payload of a DHCPDISCOVER message.
+func newTestDHCPDiscover(t *testing.T) []byte {
+	t.Helper()
+
+	dhcp := &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Xid:          0x12345678,
+		ClientHWAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		Options: layers.DHCPOptions{
+			layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeDiscover)}),
+		},
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := dhcp.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// newTestDHCPv6Solicit returns the payload of a DHCPv6 Solicit message.
+func newTestDHCPv6Solicit(t *testing.T) []byte {
+	t.Helper()
+
+	dhcp := &layers.DHCPv6{
+		MsgType:       layers.DHCPv6MsgTypeSolicit,
+		TransactionID: []byte{1, 2, 3},
+		Options: layers.DHCPv6Options{
+			layers.NewDHCPv6Option(layers.DHCPv6OptElapsedTime, []byte{0, 0}),
+		},
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := dhcp.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMatchDHCPMessage(t *testing.T) {
+	t.Parallel()
+
+	discover := newTestDHCPDiscover(t)
+	withoutCookie := append([]byte(nil), discover...)
+	withoutCookie[dhcpv4MagicCookieAt] = 0
+	solicit := newTestDHCPv6Solicit(t)
+	relayed := append([]byte{dhcpv6RelayForw, 0}, make([]byte, dhcpv6RelayHeaderLength-2)...)
+	relayed = append(relayed, 0, 9, 0, byte(len(solicit)))
+	relayed = append(relayed, solicit...)
+
+	tests := []struct {
+		name      string
+		ipVersion packet.IPVersion
+		dstPort   uint16
+		payload   []byte
+		expected  string
+	}{
+		{name: "DHCP discover", ipVersion: packet.IPv4, dstPort: 67, payload: discover, expected: "DHCP"},
+		{name: "DHCP to client port", ipVersion: packet.IPv4, dstPort: 68, payload: discover, expected: "DHCP"},
+		{name: "DHCPv6 solicit", ipVersion: packet.IPv6, dstPort: 547, payload: solicit, expected: "DHCPv6"},
+		{name: "DHCPv6 relayed", ipVersion: packet.IPv6, dstPort: 547, payload: relayed, expected: "DHCPv6"},
+
+		{name: "DHCP without magic cookie", ipVersion: packet.IPv4, dstPort: 67, payload: withoutCookie},
+		{name: "DHCP truncated", ipVersion: packet.IPv4, dstPort: 67, payload: discover[:dhcpv4MagicCookieAt]},
+		{name: "DHCP over IPv6", ipVersion: packet.IPv6, dstPort: 67, payload: discover},
+		{name: "DHCPv6 over IPv4", ipVersion: packet.IPv4, dstPort: 547, payload: solicit},
+		{name: "DHCPv6 truncated option", ipVersion: packet.IPv6, dstPort: 547, payload: solicit[:len(solicit)-1]},
+		{name: "DHCPv6 invalid message type", ipVersion: packet.IPv6, dstPort: 547, payload: append([]byte{0}, solicit[1:]...)},
+		{name: "other payload", ipVersion: packet.IPv4, dstPort: 67, payload: make([]byte, 300)},
+		{name: "other port", ipVersion: packet.IPv4, dstPort: 53, payload: discover},
+	}
+	for _, test := range tests {
+		if name := matchDHCPMessage(test.ipVersion, test.dstPort, test.payload); name != test.expected {
+			t.Errorf("%s: unexpected protocol %q, expected %q", test.name, name, test.expected)
+		}
+	}
+}
+
+func TestFastTrackDHCP(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func() { allowDHCP = nil }()
+
+	newPacket := func(dst net.IP, payload []byte) *failingPacket {
+		ip := &layers.IPv4{
+			Version:  4,
+			IHL:      5,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    net.IPv4zero.To4(),
+			DstIP:    dst.To4(),
+		}
+		udp := &layers.UDP{SrcPort: 68, DstPort: 67}
+		_ = udp.SetNetworkLayerForChecksum(ip)
+		buf := gopacket.NewSerializeBuffer()
+		err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{
+			FixLengths:       true,
+			ComputeChecksums: true,
+		}, ip, udp, gopacket.Payload(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pkt := &failingPacket{}
+		if err := packet.Parse(buf.Bytes(), &pkt.Base); err != nil {
+			t.Fatal(err)
+		}
+		pkt.SetOutbound()
+		return pkt
+	}
+	discover := newTestDHCPDiscover(t)
+	invalidOperation := append([]byte(nil), discover...)
+	invalidOperation[0] = 3
+
+	allowDHCP = func() bool { return true }
+	pkt := newPacket(net.IPv4bcast, discover)
+	if !fastTrackedPermit(pkt) || pkt.applied != 1 {
+		t.Error("DHCP discover should be fast-tracked")
+	}
+	pkt = newPacket(net.IPv4bcast, invalidOperation)
+	if fastTrackedPermit(pkt) || pkt.applied != 0 {
+		t.Error("packets to the DHCP port that are not DHCP must not be fast-tracked")
+	}
+	pkt = newPacket(net.IPv4(1, 1, 1, 1), discover)
+	if fastTrackedPermit(pkt) || pkt.applied != 0 {
+		t.Error("DHCP to the Internet must not be fast-tracked")
+	}
+
+	allowDHCP = func() bool { return false }
+	pkt = newPacket(net.IPv4bcast, discover)
+	if fastTrackedPermit(pkt) || pkt.applied != 0 {
+		t.Error("DHCP must not be fast-tracked if disabled")
+	}
+}
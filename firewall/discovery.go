@@ -0,0 +1,74 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/safing/portmaster/netenv"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/netutils"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/portmaster/profile"
+)
+
+// discoveryProtocol describes the traffic of an essential local network
+// protocol that relies on multicast or broadcast.
+type discoveryProtocol struct {
+	name    string
+	dstPort uint16
+}
+
+var discoveryProtocols = []discoveryProtocol{
+	{name: "mDNS", dstPort: 5353},
+	{name: "SSDP", dstPort: 1900},
+}
+
+// checkDiscoveryProtocols allows the traffic of the discovery protocols. DHCP
+// is not handled here, but by fastTrackDHCP, which only allows packets that are
+// recognized as DHCP messages.
+func checkDiscoveryProtocols(_ context.Context, conn *network.Connection, _ *profile.LayeredProfile, _ packet.Packet) bool {
+	if conn.Type != network.IPConnection || !allowDiscoveryProtocols() {
+		return false
+	}
+
+	name := matchDiscoveryProtocol(connectionInfo(conn), isSubnetBroadcast)
+	if name == "" {
+		return false
+	}
+
+	conn.Accept(fmt.Sprintf("allowing local service discovery via %s", name), CfgOptionAllowDiscoveryProtocolsKey)
+	return true
+}
+
+// matchDiscoveryProtocol returns the name of the discovery protocol that the
+// packets from the initiator of a connection, described by the given info,
+// belong to. It returns an empty string if the packets do not belong to a
+// discovery protocol.
+func matchDiscoveryProtocol(info *packet.Info, isSubnetBroadcast func(net.IP) bool) string {
+	if info.Protocol != packet.UDP ||
+		!(info.IsMulticast() || info.IsBroadcast() || isSubnetBroadcast(info.Dst)) {
+		return ""
+	}
+
+	for _, protocol := range discoveryProtocols {
+		if info.DstPort == protocol.dstPort {
+			return protocol.name
+		}
+	}
+	return ""
+}
+
+// isSubnetBroadcast returns whether the IP is the broadcast address of a local
+// network.
+func isSubnetBroadcast(ip net.IP) bool {
+	if ip.To4() == nil {
+		return false
+	}
+
+	localNet, err := netenv.GetLocalNetwork(ip)
+	if err != nil || localNet == nil {
+		return false
+	}
+	return ip.Equal(netutils.GetBroadcastAddress(localNet.IP, localNet.Mask))
+}
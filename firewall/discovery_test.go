@@ -0,0 +1,49 @@
+package firewall
+
+import (
+	"net"
+	"testing"
+
+	"github.com/safing/portmaster/network/packet"
+)
+
+func TestMatchDiscoveryProtocol(t *testing.T) {
+	t.Parallel()
+
+	// 192.168.1.255 is the broadcast address of the local network.
+	isSubnetBroadcast := func(ip net.IP) bool {
+		return ip.Equal(net.IPv4(192, 168, 1, 255))
+	}
+
+	tests := []struct {
+		name     string
+		protocol packet.IPProtocol
+		dst      string
+		srcPort  uint16
+		dstPort  uint16
+		expected string
+	}{
+		{name: "mDNS IPv4", protocol: packet.UDP, dst: "224.0.0.251", srcPort: 5353, dstPort: 5353, expected: "mDNS"},
+		{name: "mDNS IPv6", protocol: packet.UDP, dst: "ff02::fb", srcPort: 49152, dstPort: 5353, expected: "mDNS"},
+		{name: "SSDP search", protocol: packet.UDP, dst: "239.255.255.250", srcPort: 49152, dstPort: 1900, expected: "SSDP"},
+		{name: "SSDP to subnet broadcast", protocol: packet.UDP, dst: "192.168.1.255", srcPort: 49152, dstPort: 1900, expected: "SSDP"},
+		{name: "mDNS to unicast", protocol: packet.UDP, dst: "192.168.1.10", srcPort: 5353, dstPort: 5353},
+		// DHCP is only allowed by fastTrackDHCP, if its packets are DHCP messages.
+		{name: "DHCP discover", protocol: packet.UDP, dst: "255.255.255.255", srcPort: 68, dstPort: 67},
+		{name: "DHCPv6 solicit", protocol: packet.UDP, dst: "ff02::1:2", srcPort: 546, dstPort: 547},
+		{name: "TCP to multicast port", protocol: packet.TCP, dst: "224.0.0.251", srcPort: 5353, dstPort: 5353},
+		{name: "other multicast", protocol: packet.UDP, dst: "239.255.255.250", srcPort: 49152, dstPort: 3702},
+	}
+	for _, test := range tests {
+		info := &packet.Info{
+			Protocol: test.protocol,
+			Src:      net.IPv4(192, 168, 1, 10),
+			SrcPort:  test.srcPort,
+			Dst:      net.ParseIP(test.dst),
+			DstPort:  test.dstPort,
+		}
+		if name := matchDiscoveryProtocol(info, isSubnetBroadcast); name != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, name)
+		}
+	}
+}
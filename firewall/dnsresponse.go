@@ -0,0 +1,46 @@
+package firewall
+
+import (
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/firewall/interception"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// injectPacket injects raw IP packets. It is a variable for testing.
+var injectPacket = interception.InjectPacket
+
+// respondToBlockedDNSQuery answers the DNS query in the given packet with a
+// forged response, if the packet is blocked and blocked queries are
+// configured to be answered. It returns whether a response was injected, in
+// which case the query itself should be dropped instead of being rejected.
+func respondToBlockedDNSQuery(pkt packet.Packet, verdict network.Verdict) bool {
+	switch {
+	case verdict != network.VerdictBlock && verdict != network.VerdictDrop:
+		return false
+	case !pkt.IsOutbound():
+		return false
+	case pkt.Info().Protocol != packet.UDP || pkt.Info().DstPort != 53:
+		return false
+	case len(pkt.Payload()) == 0:
+		return false
+	}
+
+	responseType := blockedDNSResponse()
+	if responseType == blockedDNSResponseOff || responseType == "" {
+		return false
+	}
+
+	response, err := packet.ForgeDNSResponse(pkt.Raw(), packet.DNSResponseType(responseType))
+	if err != nil {
+		log.Tracer(pkt.Ctx()).Debugf("filter: failed to forge response to blocked DNS query %s: %s", pkt, err)
+		return false
+	}
+	if err := injectPacket(response); err != nil {
+		log.Tracer(pkt.Ctx()).Warningf("filter: failed to inject response to blocked DNS query %s: %s", pkt, err)
+		return false
+	}
+
+	log.Tracer(pkt.Ctx()).Tracef("filter: injected %s response to blocked DNS query %s", responseType, pkt)
+	return true
+}
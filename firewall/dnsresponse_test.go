@@ -0,0 +1,88 @@
+package firewall
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/miekg/dns"
+
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+func TestRespondToBlockedDNSQuery(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	var injected []byte
+	defer func(orig func([]byte) error) { injectPacket = orig }(injectPacket)
+	injectPacket = func(data []byte) error {
+		injected = data
+		return nil
+	}
+	defer func(orig func() string) { blockedDNSResponse = orig }(blockedDNSResponse)
+	responseType := blockedDNSResponseNXDomain
+	blockedDNSResponse = func() string { return responseType }
+
+	query := new(dns.Msg)
+	query.SetQuestion("blocked.example.com.", dns.TypeA)
+	pkt := newTestDNSQueryPacket(t, query)
+
+	// Allowed queries are not answered.
+	if respondToBlockedDNSQuery(pkt, network.VerdictAccept) || injected != nil {
+		t.Fatal("allowed query should not be answered")
+	}
+
+	// Blocked queries are answered.
+	if !respondToBlockedDNSQuery(pkt, network.VerdictBlock) {
+		t.Fatal("blocked query should be answered")
+	}
+	response := gopacket.NewPacket(injected, layers.LayerTypeIPv4, gopacket.Default)
+	dnsLayer, ok := response.Layer(layers.LayerTypeDNS).(*layers.DNS)
+	if !ok {
+		t.Fatal("injected packet is not a DNS response")
+	}
+	if !dnsLayer.QR || dnsLayer.ID != query.Id || dnsLayer.ResponseCode != layers.DNSResponseCodeNXDomain {
+		t.Errorf("unexpected response: id=%d rcode=%s", dnsLayer.ID, dnsLayer.ResponseCode)
+	}
+
+	// Answering can be disabled.
+	injected = nil
+	responseType = blockedDNSResponseOff
+	if respondToBlockedDNSQuery(pkt, network.VerdictDrop) || injected != nil {
+		t.Error("blocked query should not be answered if disabled")
+	}
+}
+
+func newTestDNSQueryPacket(t *testing.T, query *dns.Msg) *failingPacket {
+	t.Helper()
+
+	payload, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4(10, 0, 0, 1).To4(),
+		DstIP:    net.IPv4(9, 9, 9, 9).To4(),
+	}
+	udp := &layers.UDP{SrcPort: 50000, DstPort: 53}
+	_ = udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	err = gopacket.SerializeLayers(buf, gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}, ip, udp, gopacket.Payload(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkt := &failingPacket{}
+	if err := packet.Parse(buf.Bytes(), &pkt.Base); err != nil {
+		t.Fatal(err)
+	}
+	pkt.SetOutbound()
+	return pkt
+}
@@ -0,0 +1,258 @@
+package firewall
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/safing/portbase/api"
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network"
+)
+
+// Format is the format of exported connections, see ExportConnections.
+type Format string
+
+// Export Formats.
+const (
+	// FormatJSON exports the connections as a JSON array of objects.
+	FormatJSON Format = "json"
+	// FormatCSV exports the connections as CSV with a header row.
+	FormatCSV Format = "csv"
+)
+
+var errUnsupportedFormat = errors.New("unsupported export format")
+
+// ExportedConnection is a point-in-time copy of a tracked connection, as
+// exported by ExportConnections.
+type ExportedConnection struct {
+	ID         string
+	Type       string
+	Inbound    bool
+	IPVersion  uint8
+	Protocol   uint8
+	LocalIP    string
+	LocalPort  uint16
+	RemoteIP   string
+	RemotePort uint16
+	Domain     string
+	Process    string
+	PID        int
+	Profile    string
+	Verdict    string
+	Reason     string
+	// State is "active" or "ended".
+	State   string
+	Started time.Time
+	Ended   *time.Time `json:",omitempty"`
+	// Bytes holds the bytes of both directions combined, if known, see
+	// ConnectionRate.
+	Bytes *uint64 `json:",omitempty"`
+}
+
+var exportedConnectionCSVHeader = []string{
+	"ID", "Type", "Inbound", "IPVersion", "Protocol",
+	"LocalIP", "LocalPort", "RemoteIP", "RemotePort", "Domain",
+	"Process", "PID", "Profile", "Verdict", "Reason",
+	"State", "Started", "Ended", "Bytes",
+}
+
+// ExportConnections returns all tracked connections in the given format. For
+// large connection tables, WriteConnections should be used instead, as it
+// does not hold the whole export in memory.
+func ExportConnections(format Format) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := WriteConnections(buf, format); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteConnections writes all tracked connections in the given format to w.
+// The connections are copied one at a time while locked, so that every
+// exported connection is consistent, and are written as they are copied.
+func WriteConnections(w io.Writer, format Format) error {
+	return writeConnections(w, format, network.GetAllConnections(), connectionRates.bytes)
+}
+
+func writeConnections(w io.Writer, format Format, conns []*network.Connection, bytesOf func(id string) (uint64, bool)) error {
+	bw := bufio.NewWriter(w)
+
+	var err error
+	switch format {
+	case FormatJSON:
+		err = writeConnectionsJSON(bw, conns, bytesOf)
+	case FormatCSV:
+		err = writeConnectionsCSV(bw, conns, bytesOf)
+	default:
+		return fmt.Errorf("%w: %q", errUnsupportedFormat, format)
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func writeConnectionsJSON(w io.Writer, conns []*network.Connection, bytesOf func(id string) (uint64, bool)) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	for i, conn := range conns {
+		data, err := json.Marshal(exportConnection(conn, bytesOf))
+		if err != nil {
+			return fmt.Errorf("failed to serialize connection %s: %w", conn.ID, err)
+		}
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]")
+	return err
+}
+
+func writeConnectionsCSV(w io.Writer, conns []*network.Connection, bytesOf func(id string) (uint64, bool)) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(exportedConnectionCSVHeader); err != nil {
+		return err
+	}
+	for _, conn := range conns {
+		if err := cw.Write(exportConnection(conn, bytesOf).csvRecord()); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportConnection copies the exported fields of the connection.
+func exportConnection(conn *network.Connection, bytesOf func(id string) (uint64, bool)) *ExportedConnection {
+	conn.Lock()
+	defer conn.Unlock()
+
+	exported := &ExportedConnection{
+		ID:        conn.ID,
+		Inbound:   conn.Inbound,
+		IPVersion: uint8(conn.IPVersion),
+		Protocol:  uint8(conn.IPProtocol),
+		LocalPort: conn.LocalPort,
+		Process:   conn.ProcessContext.ProcessName,
+		PID:       conn.ProcessContext.PID,
+		Profile:   conn.ProcessContext.Profile,
+		Verdict:   conn.Verdict.Active.Verb(),
+		Reason:    conn.Reason.Msg,
+		State:     "active",
+		Started:   time.Unix(conn.Started, 0).UTC(),
+	}
+	switch conn.Type { //nolint:exhaustive // Only these are exported.
+	case network.IPConnection:
+		exported.Type = "ip"
+	case network.DNSRequest:
+		exported.Type = "dns"
+	}
+	if conn.LocalIP != nil {
+		exported.LocalIP = conn.LocalIP.String()
+	}
+	if conn.Entity != nil {
+		if conn.Entity.IP != nil {
+			exported.RemoteIP = conn.Entity.IP.String()
+		}
+		exported.RemotePort = conn.Entity.Port
+		exported.Domain = conn.Entity.Domain
+	}
+	if conn.Ended > 0 {
+		exported.State = "ended"
+		ended := time.Unix(conn.Ended, 0).UTC()
+		exported.Ended = &ended
+	}
+	if bytesOf != nil {
+		if total, ok := bytesOf(conn.ID); ok {
+			exported.Bytes = &total
+		}
+	}
+
+	return exported
+}
+
+// csvRecord returns the fields in the order of exportedConnectionCSVHeader.
+func (ec *ExportedConnection) csvRecord() []string {
+	var ended, total string
+	if ec.Ended != nil {
+		ended = ec.Ended.Format(time.RFC3339)
+	}
+	if ec.Bytes != nil {
+		total = strconv.FormatUint(*ec.Bytes, 10)
+	}
+
+	return []string{
+		ec.ID,
+		ec.Type,
+		strconv.FormatBool(ec.Inbound),
+		strconv.Itoa(int(ec.IPVersion)),
+		strconv.Itoa(int(ec.Protocol)),
+		ec.LocalIP,
+		strconv.Itoa(int(ec.LocalPort)),
+		ec.RemoteIP,
+		strconv.Itoa(int(ec.RemotePort)),
+		ec.Domain,
+		ec.Process,
+		strconv.Itoa(ec.PID),
+		ec.Profile,
+		ec.Verdict,
+		ec.Reason,
+		ec.State,
+		ec.Started.Format(time.RFC3339),
+		ended,
+		total,
+	}
+}
+
+func registerConnectionExportAPIEndpoints() error {
+	return api.RegisterEndpoint(api.Endpoint{
+		Path:        "interception/connections/export",
+		MimeType:    "application/json",
+		Read:        api.PermitUser,
+		BelongsTo:   interceptionModule,
+		HandlerFunc: handleConnectionExport,
+		Name:        "Export Connections",
+		Description: "Downloads a point-in-time snapshot of all tracked connections.",
+		Parameters: []api.Parameter{{
+			Method:      http.MethodGet,
+			Field:       "format",
+			Value:       "json|csv",
+			Description: "Specify the format of the export. The default is JSON.",
+		}},
+	})
+}
+
+func handleConnectionExport(w http.ResponseWriter, r *http.Request) {
+	format := Format(r.URL.Query().Get("format"))
+	contentType := "application/json"
+	switch format {
+	case "", FormatJSON:
+		format = FormatJSON
+	case FormatCSV:
+		contentType = "text/csv"
+	default:
+		http.Error(w, fmt.Sprintf("%s: %q", errUnsupportedFormat, format), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="connections-%s.%s"`, time.Now().UTC().Format("20060102-150405"), format))
+	if err := WriteConnections(w, format); err != nil {
+		// The response is already started and cannot report the error.
+		log.Warningf("filter: failed to export connections: %s", err)
+	}
+}
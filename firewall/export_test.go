@@ -0,0 +1,151 @@
+package firewall
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/safing/portmaster/network"
+)
+
+func newTestExportConnections() ([]*network.Connection, func(id string) (uint64, bool)) {
+	started := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Unix()
+
+	active := newTestTCPConnection("active")
+	active.Started = started
+	active.Entity.Domain = "example.com."
+	active.ProcessContext.ProcessName = "curl"
+	active.ProcessContext.PID = 1234
+	active.ProcessContext.Profile = "local/curl"
+
+	ended := newTestTCPConnection("ended")
+	ended.Started = started
+	ended.Ended = started + 60
+	ended.SetVerdict(network.VerdictBlock, "blocked, with \"quotes\", and commas", "", nil)
+	finalizeVerdict(ended)
+
+	bytesOf := func(id string) (uint64, bool) {
+		if id == "active" {
+			return 4096, true
+		}
+		return 0, false
+	}
+	return []*network.Connection{active, ended}, bytesOf
+}
+
+func TestExportConnectionsJSON(t *testing.T) {
+	t.Parallel()
+
+	conns, bytesOf := newTestExportConnections()
+	buf := &bytes.Buffer{}
+	if err := writeConnections(buf, FormatJSON, conns, bytesOf); err != nil {
+		t.Fatal(err)
+	}
+
+	var exported []*ExportedConnection
+	if err := json.Unmarshal(buf.Bytes(), &exported); err != nil {
+		t.Fatalf("invalid JSON %q: %s", buf.String(), err)
+	}
+	if len(exported) != 2 {
+		t.Fatalf("unexpected connections %+v", exported)
+	}
+
+	active, ended := exported[0], exported[1]
+	if active.ID != "active" || active.Type != "ip" || active.Protocol != 6 ||
+		active.LocalIP != "10.0.0.1" || active.LocalPort != 40000 ||
+		active.RemoteIP != "1.1.1.1" || active.RemotePort != 443 ||
+		active.Domain != "example.com." || active.Process != "curl" || active.PID != 1234 ||
+		active.Profile != "local/curl" || active.Verdict != "accepted" || active.Reason != "allowed by rule" ||
+		active.State != "active" || active.Ended != nil ||
+		active.Bytes == nil || *active.Bytes != 4096 {
+		t.Errorf("unexpected active connection %+v", active)
+	}
+	if ended.State != "ended" || ended.Verdict != "blocked" ||
+		ended.Ended == nil || !ended.Ended.Equal(ended.Started.Add(time.Minute)) || ended.Bytes != nil {
+		t.Errorf("unexpected ended connection %+v", ended)
+	}
+}
+
+func TestExportConnectionsCSV(t *testing.T) {
+	t.Parallel()
+
+	conns, bytesOf := newTestExportConnections()
+	buf := &bytes.Buffer{}
+	if err := writeConnections(buf, FormatCSV, conns, bytesOf); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("unexpected records %v", records)
+	}
+	fields := make(map[string]int)
+	for i, name := range records[0] {
+		fields[name] = i
+	}
+	if len(fields) != len(exportedConnectionCSVHeader) {
+		t.Fatalf("unexpected header %v", records[0])
+	}
+
+	active, ended := records[1], records[2]
+	for field, expected := range map[string]string{
+		"ID":       "active",
+		"Protocol": "6",
+		"RemoteIP": "1.1.1.1",
+		"Process":  "curl",
+		"Verdict":  "accepted",
+		"State":    "active",
+		"Started":  "2024-01-02T03:04:05Z",
+		"Ended":    "",
+		"Bytes":    "4096",
+	} {
+		if active[fields[field]] != expected {
+			t.Errorf("unexpected %s %q of active connection, expected %q", field, active[fields[field]], expected)
+		}
+	}
+	for field, expected := range map[string]string{
+		"ID":     "ended",
+		"Reason": "blocked, with \"quotes\", and commas",
+		"State":  "ended",
+		"Ended":  "2024-01-02T03:05:05Z",
+		"Bytes":  "",
+	} {
+		if ended[fields[field]] != expected {
+			t.Errorf("unexpected %s %q of ended connection, expected %q", field, ended[fields[field]], expected)
+		}
+	}
+}
+
+func TestExportConnectionsEmpty(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	if err := writeConnections(buf, FormatJSON, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "[]" {
+		t.Errorf("unexpected JSON export of empty table %q", buf.String())
+	}
+
+	buf.Reset()
+	if err := writeConnections(buf, FormatCSV, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || len(records[0]) != len(exportedConnectionCSVHeader) {
+		t.Errorf("CSV export of empty table should only have the header, got %v", records)
+	}
+
+	if _, err := ExportConnections("xml"); !errors.Is(err, errUnsupportedFormat) {
+		t.Errorf("unexpected error for unsupported format: %v", err)
+	}
+}
@@ -10,7 +10,7 @@
 var filterModule *modules.Module
 
 func init() {
-	filterModule = modules.Register("filter", nil, nil, nil, "core", "interception", "intel")
+	filterModule = modules.Register("filter", nil, nil, nil, "core", InterceptionModuleName, "intel")
 	subsystems.Register(
 		"filter",
 		"Privacy Filter",
@@ -0,0 +1,132 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tevino/abool"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// ConnFilter selects connections by their process, remote IP or remote port.
+// Only the set fields are checked and all of them must match. A filter
+// without any set fields matches nothing.
+type ConnFilter struct {
+	// ProcessPID matches the PID of the process of the connection.
+	ProcessPID int
+	// ProcessPath matches the binary path of the process of the connection.
+	ProcessPath string
+	// RemoteIP matches the IP of the remote entity.
+	RemoteIP net.IP
+	// RemotePort matches the port of the remote entity.
+	RemotePort uint16
+}
+
+// Matches returns whether the filter matches the connection.
+func (f ConnFilter) Matches(conn *network.Connection) bool {
+	if f.isEmpty() {
+		return false
+	}
+
+	if f.ProcessPID != 0 && conn.ProcessContext.PID != f.ProcessPID {
+		return false
+	}
+	if f.ProcessPath != "" && conn.ProcessContext.BinaryPath != f.ProcessPath {
+		return false
+	}
+	if f.RemoteIP != nil && (conn.Entity == nil || !f.RemoteIP.Equal(conn.Entity.IP)) {
+		return false
+	}
+	if f.RemotePort != 0 && (conn.Entity == nil || conn.Entity.Port != f.RemotePort) {
+		return false
+	}
+	return true
+}
+
+func (f ConnFilter) isEmpty() bool {
+	return f.ProcessPID == 0 && f.ProcessPath == "" && f.RemoteIP == nil && f.RemotePort == 0
+}
+
+// key returns a comparable representation of the filter.
+func (f ConnFilter) key() string {
+	var ip string
+	if f.RemoteIP != nil {
+		ip = f.RemoteIP.String()
+	}
+	return fmt.Sprintf("%d|%s|%s|%d", f.ProcessPID, f.ProcessPath, ip, f.RemotePort)
+}
+
+var (
+	flowDebugFilters     = make(map[string]ConnFilter)
+	flowDebugFiltersLock sync.RWMutex
+	flowDebugActive      = abool.New()
+)
+
+// SetFlowDebug enables or disables verbose logging of every packet of the
+// connections that match the given filter. For each packet, the applied
+// verdict, the reason and the timing is logged. Filters are additive: Packets
+// are logged if any enabled filter matches, and disabling a filter only
+// removes the exact same filter.
+// Flow debug logging is additive over the global log level: Matching packets
+// are logged at info level, without lowering the global log level and
+// without changing the logging of any other connections.
+func SetFlowDebug(filter ConnFilter, enabled bool) error {
+	if filter.isEmpty() {
+		return errors.New("flow debug filter must match on process, remote IP or port")
+	}
+
+	flowDebugFiltersLock.Lock()
+	defer flowDebugFiltersLock.Unlock()
+
+	if enabled {
+		flowDebugFilters[filter.key()] = filter
+	} else {
+		delete(flowDebugFilters, filter.key())
+	}
+	flowDebugActive.SetTo(len(flowDebugFilters) > 0)
+	return nil
+}
+
+// flowDebugEnabled returns whether any flow debug filter matches the
+// connection.
+func flowDebugEnabled(conn *network.Connection) bool {
+	if flowDebugActive.IsNotSet() {
+		return false
+	}
+
+	flowDebugFiltersLock.RLock()
+	defer flowDebugFiltersLock.RUnlock()
+
+	for _, filter := range flowDebugFilters {
+		if filter.Matches(conn) {
+			return true
+		}
+	}
+	return false
+}
+
+// logFlowDebug logs the verdict applied to a packet of a connection that is
+// debugged.
+func logFlowDebug(conn *network.Connection, pkt packet.Packet, verdict network.Verdict, applyDuration time.Duration, err error) {
+	result := "applied"
+	if err != nil {
+		result = fmt.Sprintf("failed to apply: %s", err)
+	}
+	log.Infof(
+		"filter: flow debug: verdict %s for %s of %s %s in %s (reason: %q, option: %q, connection age: %s)",
+		verdict,
+		pkt,
+		conn,
+		result,
+		applyDuration,
+		conn.Reason.Msg,
+		conn.Reason.OptionKey,
+		time.Since(time.Unix(conn.Started, 0)).Round(time.Second),
+	)
+}
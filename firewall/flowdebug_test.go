@@ -0,0 +1,84 @@
+package firewall
+
+import (
+	"net"
+	"testing"
+
+	"github.com/safing/portmaster/intel"
+	"github.com/safing/portmaster/network"
+)
+
+func TestConnFilterMatches(t *testing.T) {
+	t.Parallel()
+
+	conn := &network.Connection{
+		ProcessContext: network.ProcessContext{
+			PID:        1234,
+			BinaryPath: "/usr/bin/curl",
+		},
+		Entity: &intel.Entity{
+			IP:   net.IPv4(203, 0, 113, 5),
+			Port: 443,
+		},
+	}
+
+	for _, test := range []struct {
+		filter  ConnFilter
+		matches bool
+	}{
+		{ConnFilter{}, false},
+		{ConnFilter{ProcessPID: 1234}, true},
+		{ConnFilter{ProcessPID: 4321}, false},
+		{ConnFilter{ProcessPath: "/usr/bin/curl"}, true},
+		{ConnFilter{RemoteIP: net.ParseIP("203.0.113.5")}, true},
+		{ConnFilter{RemoteIP: net.ParseIP("203.0.113.6")}, false},
+		{ConnFilter{RemotePort: 443}, true},
+		{ConnFilter{ProcessPID: 1234, RemotePort: 443}, true},
+		{ConnFilter{ProcessPID: 1234, RemotePort: 80}, false},
+	} {
+		if matches := test.filter.Matches(conn); matches != test.matches {
+			t.Errorf("filter %+v: expected match %v, got %v", test.filter, test.matches, matches)
+		}
+	}
+}
+
+//nolint:paralleltest // Modifies global state.
+func TestSetFlowDebug(t *testing.T) {
+	conn := &network.Connection{
+		Entity: &intel.Entity{
+			IP:   net.IPv4(203, 0, 113, 5),
+			Port: 443,
+		},
+	}
+
+	if err := SetFlowDebug(ConnFilter{}, true); err == nil {
+		t.Error("empty filter should be rejected")
+	}
+	if flowDebugEnabled(conn) {
+		t.Error("flow debug should not be enabled")
+	}
+
+	if err := SetFlowDebug(ConnFilter{RemotePort: 443}, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetFlowDebug(ConnFilter{RemoteIP: net.ParseIP("203.0.113.5")}, true); err != nil {
+		t.Fatal(err)
+	}
+	if !flowDebugEnabled(conn) {
+		t.Error("flow debug should be enabled")
+	}
+
+	if err := SetFlowDebug(ConnFilter{RemotePort: 443}, false); err != nil {
+		t.Fatal(err)
+	}
+	if !flowDebugEnabled(conn) {
+		t.Error("flow debug should still be enabled by the remote IP filter")
+	}
+
+	if err := SetFlowDebug(ConnFilter{RemoteIP: net.ParseIP("203.0.113.5")}, false); err != nil {
+		t.Fatal(err)
+	}
+	if flowDebugEnabled(conn) || flowDebugActive.IsSet() {
+		t.Error("flow debug should be disabled")
+	}
+}
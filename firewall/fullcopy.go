@@ -0,0 +1,73 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/safing/portmaster/firewall/interception"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// RequestFullCopy makes the interception pass the complete packets of the
+// connection from now on, eg. because the connection is being inspected.
+//
+// The nfqueue integration can be set to only copy the packet headers to
+// userspace in order to save bandwidth (see the --nfqueue-header-copy flag).
+// As the copy mode of nfqueue can only be set per queue, the packets of the
+// connection are routed to dedicated queues that always copy complete packets.
+// The full copy ends when the connection receives a permanent verdict or
+// StopFullCopy is called. The routing is removed when StopFullCopy is called or
+// when the OS stops tracking the connection. Only TCP and UDP connections are
+// supported.
+func RequestFullCopy(conn *network.Connection) error {
+	info, err := connectionPacketInfo(conn)
+	if err != nil {
+		return err
+	}
+
+	if err := interception.RequestFullCopy(info); err != nil {
+		return fmt.Errorf("failed to request full copy of %s: %w", conn, err)
+	}
+	return nil
+}
+
+// StopFullCopy reverts RequestFullCopy, so that the packets of the connection
+// are copied according to the general copy mode again.
+func StopFullCopy(conn *network.Connection) error {
+	info, err := connectionPacketInfo(conn)
+	if err != nil {
+		return err
+	}
+
+	if err := interception.StopFullCopy(info); err != nil {
+		return fmt.Errorf("failed to stop full copy of %s: %w", conn, err)
+	}
+	return nil
+}
+
+// connectionPacketInfo returns the packet info of the first packet of the
+// connection.
+func connectionPacketInfo(conn *network.Connection) (*packet.Info, error) {
+	switch {
+	case conn.Type != network.IPConnection:
+		return nil, errors.New("not an IP connection")
+	case conn.Entity == nil:
+		return nil, errors.New("connection has no destination")
+	}
+
+	info := &packet.Info{
+		Inbound:  conn.Inbound,
+		Version:  conn.IPVersion,
+		Protocol: conn.IPProtocol,
+		Src:      conn.LocalIP,
+		SrcPort:  conn.LocalPort,
+		Dst:      conn.Entity.IP,
+		DstPort:  conn.Entity.Port,
+	}
+	if conn.Inbound {
+		info.Src, info.Dst = info.Dst, info.Src
+		info.SrcPort, info.DstPort = info.DstPort, info.SrcPort
+	}
+	return info, nil
+}
@@ -0,0 +1,117 @@
+package firewall
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/tevino/abool"
+
+	"github.com/safing/portbase/api"
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/firewall/interception"
+	"github.com/safing/portmaster/netenv"
+	"github.com/safing/portmaster/process"
+)
+
+const interceptionWarmupFailedID = "interception:warmup-failed"
+
+// warmupCompleted is set when the interception and the decision engine are
+// warmed up.
+var warmupCompleted = abool.New()
+
+// InterceptionHealth describes the health of the packet interception.
+type InterceptionHealth struct {
+	// WarmupCompleted is set when the interception is warmed up and handles
+	// packets at steady-state latency.
+	WarmupCompleted bool
+	// Degraded is set while the decision engine is bypassed by its circuit
+	// breaker and the network is not filtered.
+	Degraded bool
+	// EngineBreaker describes the circuit breaker of the decision engine.
+	EngineBreaker EngineBreakerState
+}
+
+func registerAPIEndpoints() error {
+	if err := api.RegisterEndpoint(api.Endpoint{
+		Path:      "interception/health",
+		Read:      api.PermitUser,
+		BelongsTo: interceptionModule,
+		StructFunc: func(ar *api.Request) (i interface{}, err error) {
+			breaker := EngineBreaker()
+			return &InterceptionHealth{
+				WarmupCompleted: warmupCompleted.IsSet(),
+				Degraded:        breaker.Tripped,
+				EngineBreaker:   breaker,
+			}, nil
+		},
+		Name:        "Get Interception Health",
+		Description: "Returns health information of the packet interception.",
+	}); err != nil {
+		return err
+	}
+
+	if err := registerTemporaryVerdictAPIEndpoints(); err != nil {
+		return err
+	}
+
+	if err := registerPinnedConnectionAPIEndpoints(); err != nil {
+		return err
+	}
+
+	if err := registerConnectionExportAPIEndpoints(); err != nil {
+		return err
+	}
+
+	if err := registerRemoteCooldownAPIEndpoints(); err != nil {
+		return err
+	}
+
+	return api.RegisterEndpoint(api.Endpoint{
+		Path:      "interception/snapshot",
+		Read:      api.PermitUser,
+		BelongsTo: interceptionModule,
+		StructFunc: func(ar *api.Request) (i interface{}, err error) {
+			// Return the partial snapshot, as it is still helpful.
+			snapshot, _ := Snapshot()
+			return snapshot, nil
+		},
+		Name:        "Get Interception Snapshot",
+		Description: "Returns the configuration and state of the packet interception and the firewall, for support requests.",
+	})
+}
+
+func warmupInterception(ctx context.Context) error {
+	if err := interception.Warmup(ctx); err != nil {
+		interceptionModule.Warning(
+			interceptionWarmupFailedID,
+			"Interception Warmup Failed",
+			"The first connections might be handled slower than usual. Error: "+err.Error(),
+		)
+		return nil
+	}
+
+	warmupDecisionEngine(ctx)
+	warmupCompleted.Set()
+	interceptionModule.Resolve(interceptionWarmupFailedID)
+	return nil
+}
+
+// warmupDecisionEngine loads the data that the decision engine would otherwise
+// load with the first connections: The addresses of the host, which are used
+// to classify packets, and the special processes and their profiles, which
+// are assigned to connections that are not attributed to a process.
+func warmupDecisionEngine(ctx context.Context) {
+	started := time.Now()
+
+	// Checking an IP that is not assigned loads the addresses of the host.
+	if _, err := netenv.IsMyIP(net.IPv4(192, 0, 2, 1)); err != nil {
+		log.Debugf("filter: failed to load addresses of the host during warmup: %s", err)
+	}
+
+	_ = process.GetUnidentifiedProcess(ctx)
+	_ = process.GetUnsolicitedProcess(ctx)
+	_ = process.GetSystemProcess(ctx)
+
+	log.Infof("filter: decision engine warmup completed in %s", time.Since(started))
+}
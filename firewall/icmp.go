@@ -0,0 +1,79 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// handleICMPError handles ICMP and ICMPv6 error messages, such as destination
+// unreachable or time exceeded, by inheriting the verdict of the connection the
+// error refers to. It returns whether the packet was handled.
+// Verdicts are never permanent, as error messages are tracked by the system
+// as part of the connection they refer to.
+func handleICMPError(pkt packet.Packet) (handled bool) {
+	icmpErr, err := packet.ParseICMPError(pkt.Raw())
+	if err != nil {
+		if !errors.Is(err, packet.ErrNotICMPError) {
+			log.Tracer(pkt.Ctx()).Debugf("filter: failed to parse ICMP error message %s: %s", pkt, err)
+		}
+		return false
+	}
+
+	verdict, reason := icmpErrorVerdict(pkt.Ctx(), icmpErr, alwaysAllowPMTUICMP(), network.GetConnection)
+	switch verdict { //nolint:exhaustive // Only a subset is returned.
+	case network.VerdictAccept:
+		log.Tracer(pkt.Ctx()).Debugf("filter: accepting ICMP error message %s: %s", pkt, reason)
+		_ = pkt.Accept()
+	case network.VerdictDrop:
+		log.Tracer(pkt.Ctx()).Debugf("filter: dropping ICMP error message %s: %s", pkt, reason)
+		_ = pkt.Drop()
+	default:
+		return false
+	}
+	return true
+}
+
+// icmpErrorVerdict returns the verdict for the ICMP error message. If the
+// connection that the error refers to is not tracked, VerdictUndecided is
+// returned.
+func icmpErrorVerdict(
+	ctx context.Context,
+	icmpErr *packet.ICMPError,
+	allowPMTU bool,
+	getConnection func(id string) (*network.Connection, bool),
+) (verdict network.Verdict, reason string) {
+	// Path MTU discovery breaks silently if these messages are blocked.
+	if allowPMTU && icmpErr.IsPacketTooBig() {
+		return network.VerdictAccept, "path MTU discovery is always allowed"
+	}
+
+	// Find the connection of the original packet.
+	outboundID, inboundID := icmpErr.Original.ConnectionIDs()
+	conn, ok := getConnection(outboundID)
+	if !ok {
+		conn, ok = getConnection(inboundID)
+		if !ok {
+			log.Tracer(ctx).Tracef("filter: connection %s of ICMP error message not found", icmpErr.Original)
+			return network.VerdictUndecided, ""
+		}
+	}
+
+	conn.Lock()
+	connVerdict := conn.Verdict.Firewall
+	conn.Unlock()
+
+	switch connVerdict { //nolint:exhaustive // Only a subset is accepted.
+	case network.VerdictAccept,
+		network.VerdictRerouteToNameserver,
+		network.VerdictRerouteToTunnel:
+		return network.VerdictAccept, fmt.Sprintf("inherited from connection %s", conn.ID)
+	default:
+		// Never send an error message in response to an error message.
+		return network.VerdictDrop, fmt.Sprintf("inherited from connection %s with verdict %s", conn.ID, connVerdict.Verb())
+	}
+}
@@ -0,0 +1,79 @@
+package firewall
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+func TestICMPErrorVerdict(t *testing.T) {
+	t.Parallel()
+
+	// Connection that the error message refers to.
+	original := &packet.ConntrackTuple{
+		Protocol: packet.TCP,
+		Src:      net.IPv4(10, 0, 0, 1),
+		SrcPort:  50000,
+		Dst:      net.IPv4(203, 0, 113, 5),
+		DstPort:  443,
+	}
+	connID, _ := original.ConnectionIDs()
+	conn := &network.Connection{ID: connID}
+	getConnection := func(id string) (*network.Connection, bool) {
+		if id == connID {
+			return conn, true
+		}
+		return nil, false
+	}
+
+	fragNeeded := &packet.ICMPError{
+		Version:  packet.IPv4,
+		Type:     3,
+		Code:     4,
+		MTU:      1400,
+		Original: original,
+	}
+	hostUnreachable := &packet.ICMPError{
+		Version:  packet.IPv4,
+		Type:     3,
+		Code:     1,
+		Original: original,
+	}
+
+	// Accepted connection.
+	conn.Verdict.Firewall = network.VerdictAccept
+	if verdict, _ := icmpErrorVerdict(context.Background(), hostUnreachable, false, getConnection); verdict != network.VerdictAccept {
+		t.Errorf("error of accepted connection should be accepted, got %s", verdict)
+	}
+
+	// Blocked connection.
+	conn.Verdict.Firewall = network.VerdictBlock
+	if verdict, _ := icmpErrorVerdict(context.Background(), hostUnreachable, true, getConnection); verdict != network.VerdictDrop {
+		t.Errorf("error of blocked connection should be dropped, got %s", verdict)
+	}
+	if verdict, _ := icmpErrorVerdict(context.Background(), fragNeeded, false, getConnection); verdict != network.VerdictDrop {
+		t.Errorf("fragmentation needed of blocked connection should be dropped, got %s", verdict)
+	}
+	if verdict, _ := icmpErrorVerdict(context.Background(), fragNeeded, true, getConnection); verdict != network.VerdictAccept {
+		t.Errorf("fragmentation needed should always be allowed, got %s", verdict)
+	}
+
+	// Unknown connection.
+	unknown := &packet.ICMPError{
+		Version: packet.IPv4,
+		Type:    11,
+		Original: &packet.ConntrackTuple{
+			Protocol: packet.UDP,
+			Src:      net.IPv4(10, 0, 0, 1),
+			SrcPort:  33434,
+			Dst:      net.IPv4(198, 51, 100, 1),
+			DstPort:  33434,
+		},
+	}
+	if verdict, _ := icmpErrorVerdict(context.Background(), unknown, true, getConnection); verdict != network.VerdictUndecided {
+		t.Errorf("error of unknown connection should be undecided, got %s", verdict)
+	}
+}
@@ -0,0 +1,172 @@
+package l7
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/safing/portmaster/network/packet"
+)
+
+type tlsDetector struct{}
+
+func (tlsDetector) Protocol() Protocol { return TLS }
+
+// Detect checks for a TLS handshake record with a client or server hello.
+func (tlsDetector) Detect(transport packet.IPProtocol, payload []byte) bool {
+	if transport != packet.TCP || len(payload) < 6 {
+		return false
+	}
+
+	// Record header: content type, version and length.
+	if payload[0] != 0x16 || // Handshake
+		payload[1] != 0x03 || payload[2] > 0x04 { // SSL 3.0 - TLS 1.3
+		return false
+	}
+	recordLength := binary.BigEndian.Uint16(payload[3:5])
+	if recordLength == 0 || recordLength > 1<<14+2048 {
+		return false
+	}
+
+	// Handshake type.
+	switch payload[5] {
+	case 0x01, 0x02: // ClientHello, ServerHello
+		return true
+	default:
+		return false
+	}
+}
+
+type sshDetector struct{}
+
+func (sshDetector) Protocol() Protocol { return SSH }
+
+// Detect checks for the SSH protocol version exchange.
+func (sshDetector) Detect(transport packet.IPProtocol, payload []byte) bool {
+	return transport == packet.TCP &&
+		(bytes.HasPrefix(payload, []byte("SSH-2.0-")) ||
+			bytes.HasPrefix(payload, []byte("SSH-1.99-")) ||
+			bytes.HasPrefix(payload, []byte("SSH-1.5-")))
+}
+
+type httpDetector struct{}
+
+func (httpDetector) Protocol() Protocol { return HTTP }
+
+var httpMethods = [][]byte{
+	[]byte("GET "),
+	[]byte("POST "),
+	[]byte("HEAD "),
+	[]byte("PUT "),
+	[]byte("DELETE "),
+	[]byte("OPTIONS "),
+	[]byte("PATCH "),
+	[]byte("CONNECT "),
+	[]byte("TRACE "),
+	[]byte("PRI "), // HTTP/2 connection preface
+}
+
+// Detect checks for a plaintext HTTP request or response line.
+func (httpDetector) Detect(transport packet.IPProtocol, payload []byte) bool {
+	if transport != packet.TCP {
+		return false
+	}
+
+	// Response.
+	if bytes.HasPrefix(payload, []byte("HTTP/1.")) {
+		return true
+	}
+
+	// Request.
+	for _, method := range httpMethods {
+		if !bytes.HasPrefix(payload, method) {
+			continue
+		}
+
+		// Check the version at the end of the request line, if it is within
+		// the payload.
+		end := bytes.Index(payload, []byte("\r\n"))
+		if end < 0 {
+			// The request line is cut off, check the start of the target.
+			target := payload[len(method):]
+			return len(target) > 0 && (target[0] == '/' || target[0] == '*')
+		}
+		requestLine := payload[:end]
+		version := requestLine[bytes.LastIndexByte(requestLine, ' ')+1:]
+		return (len(version) == 8 && bytes.HasPrefix(version, []byte("HTTP/1."))) ||
+			bytes.Equal(version, []byte("HTTP/2.0"))
+	}
+
+	return false
+}
+
+type dnsDetector struct{}
+
+func (dnsDetector) Protocol() Protocol { return DNS }
+
+// Detect checks for a plausible DNS message header and first question name.
+func (dnsDetector) Detect(transport packet.IPProtocol, payload []byte) bool {
+	switch transport { //nolint:exhaustive // Only TCP and UDP are supported.
+	case packet.UDP:
+	case packet.TCP:
+		// DNS over TCP prefixes messages with their length.
+		if len(payload) < 2 || binary.BigEndian.Uint16(payload) < 12 {
+			return false
+		}
+		payload = payload[2:]
+	default:
+		return false
+	}
+	if len(payload) < 12 {
+		return false
+	}
+
+	// Check header.
+	flags := binary.BigEndian.Uint16(payload[2:4])
+	switch opcode := flags >> 11 & 0xF; opcode {
+	case 0, 1, 2, 4, 5: // Query, IQuery, Status, Notify, Update
+	default:
+		return false
+	}
+	if flags&0x0040 != 0 { // Z bit must be zero.
+		return false
+	}
+	qdCount := binary.BigEndian.Uint16(payload[4:6])
+	if qdCount == 0 || qdCount > 16 {
+		return false
+	}
+	for _, count := range []uint16{
+		binary.BigEndian.Uint16(payload[6:8]),   // ANCOUNT
+		binary.BigEndian.Uint16(payload[8:10]),  // NSCOUNT
+		binary.BigEndian.Uint16(payload[10:12]), // ARCOUNT
+	} {
+		if count > 256 {
+			return false
+		}
+	}
+
+	// Check labels of the first question name. The name may be cut off.
+	name := payload[12:]
+	if len(name) == 0 {
+		return false
+	}
+	for len(name) > 0 {
+		labelLength := int(name[0])
+		switch {
+		case labelLength == 0:
+			return true
+		case labelLength > 63:
+			return false
+		}
+		name = name[1:]
+		if labelLength > len(name) {
+			labelLength = len(name)
+		}
+		for _, c := range name[:labelLength] {
+			if c < 0x21 || c > 0x7E {
+				return false
+			}
+		}
+		name = name[labelLength:]
+	}
+	return true
+}
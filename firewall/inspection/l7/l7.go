@@ -0,0 +1,77 @@
+// Package l7 detects the application protocol of connections from the first
+// payload they send.
+package l7
+
+import (
+	"sync"
+
+	"github.com/safing/portmaster/network/packet"
+)
+
+// Protocol is an application protocol.
+type Protocol string
+
+// Application protocols detected by the built-in detectors.
+const (
+	Unknown Protocol = ""
+	HTTP    Protocol = "http"
+	TLS     Protocol = "tls"
+	SSH     Protocol = "ssh"
+	DNS     Protocol = "dns"
+)
+
+// MaxInspectedBytes is the amount of bytes from the start of the payload that
+// detectors examine. Longer payloads are truncated before detection.
+const MaxInspectedBytes = 128
+
+// A Detector detects an application protocol.
+type Detector interface {
+	// Protocol returns the protocol that is detected.
+	Protocol() Protocol
+	// Detect returns whether the given start of the first payload of a
+	// connection using the given transport protocol belongs to the protocol.
+	// The payload is at most MaxInspectedBytes long.
+	Detect(transport packet.IPProtocol, payload []byte) bool
+}
+
+var (
+	detectors = []Detector{
+		tlsDetector{},
+		sshDetector{},
+		httpDetector{},
+		dnsDetector{},
+	}
+	detectorsLock sync.RWMutex
+)
+
+// RegisterDetector registers an additional detector. Detectors are checked in
+// order of registration, after the built-in detectors.
+func RegisterDetector(detector Detector) {
+	detectorsLock.Lock()
+	defer detectorsLock.Unlock()
+
+	detectors = append(detectors, detector)
+}
+
+// Detect returns the application protocol of the given first payload of a
+// connection using the given transport protocol. Only the first
+// MaxInspectedBytes of the payload are examined. If no detector matches,
+// Unknown is returned.
+func Detect(transport packet.IPProtocol, payload []byte) Protocol {
+	if len(payload) == 0 {
+		return Unknown
+	}
+	if len(payload) > MaxInspectedBytes {
+		payload = payload[:MaxInspectedBytes]
+	}
+
+	detectorsLock.RLock()
+	defer detectorsLock.RUnlock()
+
+	for _, detector := range detectors {
+		if detector.Detect(transport, payload) {
+			return detector.Protocol()
+		}
+	}
+	return Unknown
+}
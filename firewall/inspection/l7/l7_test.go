@@ -0,0 +1,84 @@
+package l7
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/safing/portmaster/network/packet"
+)
+
+// tlsClientHello is the start of a TLS 1.2 record with a ClientHello.
+var tlsClientHello = []byte{
+	0x16, 0x03, 0x01, 0x02, 0x00, // Record header
+	0x01, 0x00, 0x01, 0xfc, // Handshake header
+	0x03, 0x03, // Client version
+	0x1b, 0x6b, 0x91, 0x86, 0x3b, 0x7c, 0xc3, 0x8c, // Random
+	0x55, 0x9b, 0x34, 0x55, 0x7c, 0x3e, 0x4f, 0xab,
+}
+
+func TestDetect(t *testing.T) {
+	t.Parallel()
+
+	dnsQuery := new(dns.Msg)
+	dnsQuery.SetQuestion("example.com.", dns.TypeA)
+	dnsQueryData, err := dnsQuery.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsQueryTCPData := append([]byte{0x00, byte(len(dnsQueryData))}, dnsQueryData...)
+
+	tests := []struct {
+		name      string
+		transport packet.IPProtocol
+		payload   []byte
+		expected  Protocol
+	}{
+		{"http request", packet.TCP, []byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"), HTTP},
+		{"http request on odd port", packet.TCP, []byte("POST /api HTTP/1.0\r\n"), HTTP},
+		{"http request cut off", packet.TCP, append([]byte("GET /"), bytes.Repeat([]byte("a"), 200)...), HTTP},
+		{"http response", packet.TCP, []byte("HTTP/1.1 200 OK\r\n"), HTTP},
+		{"http2 preface", packet.TCP, []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"), HTTP},
+		{"tls client hello", packet.TCP, tlsClientHello, TLS},
+		{"ssh banner", packet.TCP, []byte("SSH-2.0-OpenSSH_9.3\r\n"), SSH},
+		{"dns query", packet.UDP, dnsQueryData, DNS},
+		{"dns query over tcp", packet.TCP, dnsQueryTCPData, DNS},
+
+		{"empty", packet.TCP, nil, Unknown},
+		{"smtp banner", packet.TCP, []byte("220 mail.example.com ESMTP\r\n"), Unknown},
+		{"not quite http", packet.TCP, []byte("GET something else\r\n"), Unknown},
+		{"http over udp", packet.UDP, []byte("GET / HTTP/1.1\r\n"), Unknown},
+		{"tls over udp", packet.UDP, tlsClientHello, Unknown},
+		{"tls alert", packet.TCP, []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x28}, Unknown},
+		{"random udp", packet.UDP, []byte{0x8f, 0x12, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}, Unknown},
+	}
+
+	for _, tt := range tests {
+		if detected := Detect(tt.transport, tt.payload); detected != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.expected, detected)
+		}
+	}
+}
+
+type fakeDetector struct{}
+
+func (fakeDetector) Protocol() Protocol { return "fake" }
+
+func (fakeDetector) Detect(_ packet.IPProtocol, payload []byte) bool {
+	if len(payload) > MaxInspectedBytes {
+		panic("payload not truncated")
+	}
+	return bytes.HasPrefix(payload, []byte("FAKE"))
+}
+
+func TestRegisterDetector(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	RegisterDetector(fakeDetector{})
+
+	if detected := Detect(packet.UDP, append([]byte("FAKE"), make([]byte, 2*MaxInspectedBytes)...)); detected != "fake" {
+		t.Errorf("expected registered detector to detect the payload, got %q", detected)
+	}
+	if detected := Detect(packet.TCP, []byte("SSH-2.0-OpenSSH_9.3\r\n")); detected != SSH {
+		t.Errorf("built-in detectors must be checked first, got %q", detected)
+	}
+}
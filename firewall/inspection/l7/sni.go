@@ -0,0 +1,216 @@
+package l7
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// MaxClientHelloLength is the maximum length of the start of a TLS stream
+// that is reassembled to parse the ClientHello. Longer ClientHellos are not
+// parsed.
+const MaxClientHelloLength = 1 << 15
+
+const (
+	tlsRecordHeaderLength    = 5
+	tlsHandshakeHeaderLength = 4
+	tlsMaxRecordLength       = 1 << 14
+
+	tlsHandshakeTypeClientHello = 0x01
+
+	tlsExtensionServerName              = 0x0000
+	tlsExtensionEncryptedClientHello    = 0xfe0d
+	tlsServerNameTypeHostName           = 0x00
+	tlsClientHelloRandomAndVersionBytes = 2 + 32
+)
+
+var (
+	// ErrIncomplete is returned when more data is needed.
+	ErrIncomplete = errors.New("incomplete")
+
+	errNotClientHello = errors.New("not a TLS ClientHello")
+	errMalformed      = errors.New("malformed TLS ClientHello")
+)
+
+// ParseTLSServerName parses the server name indication (SNI) from the
+// ClientHello at the given start of a TLS stream. The ClientHello may span
+// multiple TLS records. If the stream ends before the ClientHello,
+// ErrIncomplete is returned and the call should be repeated with more data.
+// An empty server name is returned without error if the ClientHello does not
+// indicate a server name or if it is encrypted with Encrypted Client Hello
+// (ECH), as the visible server name then only names the client-facing server.
+func ParseTLSServerName(stream []byte) (serverName string, err error) {
+	var handshake []byte
+	for {
+		// Read next record.
+		if len(stream) < tlsRecordHeaderLength {
+			return "", ErrIncomplete
+		}
+		if stream[0] != 0x16 { // Handshake
+			return "", errNotClientHello
+		}
+		recordLength := int(binary.BigEndian.Uint16(stream[3:5]))
+		if recordLength == 0 || recordLength > tlsMaxRecordLength {
+			return "", errMalformed
+		}
+		if len(stream) < tlsRecordHeaderLength+recordLength {
+			return "", ErrIncomplete
+		}
+		handshake = append(handshake, stream[tlsRecordHeaderLength:tlsRecordHeaderLength+recordLength]...)
+		stream = stream[tlsRecordHeaderLength+recordLength:]
+
+		// Check if the ClientHello is complete.
+		if len(handshake) < tlsHandshakeHeaderLength {
+			continue
+		}
+		if handshake[0] != tlsHandshakeTypeClientHello {
+			return "", errNotClientHello
+		}
+		helloLength := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+		if helloLength > MaxClientHelloLength {
+			return "", errMalformed
+		}
+		if len(handshake) >= tlsHandshakeHeaderLength+helloLength {
+			return parseClientHello(handshake[tlsHandshakeHeaderLength : tlsHandshakeHeaderLength+helloLength])
+		}
+	}
+}
+
+// parseClientHello parses the server name from the body of a ClientHello.
+func parseClientHello(hello []byte) (serverName string, err error) {
+	msg := tlsReader(hello)
+	if !msg.skip(tlsClientHelloRandomAndVersionBytes) ||
+		!msg.skipVector(1) || // Session ID
+		!msg.skipVector(2) || // Cipher suites
+		!msg.skipVector(1) { // Compression methods
+		return "", errMalformed
+	}
+	if len(msg) == 0 {
+		// No extensions.
+		return "", nil
+	}
+
+	extensions, ok := msg.readVector(2)
+	if !ok {
+		return "", errMalformed
+	}
+	var encrypted bool
+	for len(extensions) > 0 {
+		extType, ok := extensions.readUint16()
+		if !ok {
+			return "", errMalformed
+		}
+		extData, ok := extensions.readVector(2)
+		if !ok {
+			return "", errMalformed
+		}
+
+		switch extType {
+		case tlsExtensionServerName:
+			serverName, err = parseServerNameExtension(extData)
+			if err != nil {
+				return "", err
+			}
+		case tlsExtensionEncryptedClientHello:
+			encrypted = true
+		}
+	}
+
+	if encrypted {
+		return "", nil
+	}
+	return serverName, nil
+}
+
+// parseServerNameExtension parses the host name from the server name
+// extension.
+func parseServerNameExtension(ext tlsReader) (serverName string, err error) {
+	names, ok := ext.readVector(2)
+	if !ok {
+		return "", errMalformed
+	}
+	for len(names) > 0 {
+		nameType, ok := names.readUint8()
+		if !ok {
+			return "", errMalformed
+		}
+		name, ok := names.readVector(2)
+		if !ok {
+			return "", errMalformed
+		}
+		if nameType != tlsServerNameTypeHostName {
+			continue
+		}
+
+		for _, c := range name {
+			if c < 0x21 || c > 0x7E {
+				return "", errMalformed
+			}
+		}
+		return strings.ToLower(strings.TrimSuffix(string(name), ".")), nil
+	}
+	return "", nil
+}
+
+// tlsReader reads the fields of TLS messages.
+type tlsReader []byte
+
+func (r *tlsReader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *tlsReader) readUint8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *tlsReader) readUint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+// readVector reads a vector that is prefixed with its length in the given
+// amount of bytes.
+func (r *tlsReader) readVector(lengthBytes int) (tlsReader, bool) {
+	var length int
+	switch lengthBytes {
+	case 1:
+		l, ok := r.readUint8()
+		if !ok {
+			return nil, false
+		}
+		length = int(l)
+	case 2:
+		l, ok := r.readUint16()
+		if !ok {
+			return nil, false
+		}
+		length = int(l)
+	default:
+		return nil, false
+	}
+
+	if len(*r) < length {
+		return nil, false
+	}
+	v := (*r)[:length]
+	*r = (*r)[length:]
+	return v, true
+}
+
+func (r *tlsReader) skipVector(lengthBytes int) bool {
+	_, ok := r.readVector(lengthBytes)
+	return ok
+}
@@ -0,0 +1,116 @@
+package l7
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+)
+
+// The ClientHellos in testdata were captured from crypto/tls clients
+// connecting to www.example.com and to an IP address, which does not send a
+// server name.
+func readTestClientHello(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// buildClientHello builds a ClientHello record with the given extensions. The
+// extensions are omitted if nil.
+func buildClientHello(extensions []byte) []byte {
+	hello := make([]byte, 0, 64+len(extensions))
+	hello = append(hello, 0x03, 0x03)             // Client version
+	hello = append(hello, make([]byte, 32)...)    // Random
+	hello = append(hello, 0x00)                   // Session ID
+	hello = append(hello, 0x00, 0x02, 0x13, 0x01) // Cipher suites
+	hello = append(hello, 0x01, 0x00)             // Compression methods
+	if extensions != nil {
+		hello = binary.BigEndian.AppendUint16(hello, uint16(len(extensions)))
+		hello = append(hello, extensions...)
+	}
+
+	record := []byte{0x16, 0x03, 0x01}
+	record = binary.BigEndian.AppendUint16(record, uint16(4+len(hello)))
+	record = append(record, 0x01, 0x00)
+	record = binary.BigEndian.AppendUint16(record, uint16(len(hello)))
+	return append(record, hello...)
+}
+
+// serverNameExtension returns a server name extension for the given name.
+func serverNameExtension(name string) []byte {
+	ext := []byte{0x00, 0x00}
+	ext = binary.BigEndian.AppendUint16(ext, uint16(5+len(name)))
+	ext = binary.BigEndian.AppendUint16(ext, uint16(3+len(name)))
+	ext = append(ext, 0x00)
+	ext = binary.BigEndian.AppendUint16(ext, uint16(len(name)))
+	return append(ext, name...)
+}
+
+func TestParseTLSServerName(t *testing.T) {
+	t.Parallel()
+
+	captured := readTestClientHello(t, "clienthello.bin")
+	withECH := buildClientHello(append(
+		serverNameExtension("public.example.net"),
+		0xfe, 0x0d, 0x00, 0x04, 0x00, 0x00, 0x01, 0x00, // Encrypted Client Hello
+	))
+
+	tests := []struct {
+		name       string
+		stream     []byte
+		serverName string
+		err        error
+	}{
+		{"captured", captured, "www.example.com", nil},
+		{"captured without server name", readTestClientHello(t, "clienthello-no-sni.bin"), "", nil},
+		{"built", buildClientHello(serverNameExtension("Example.ORG.")), "example.org", nil},
+		{"no extensions", buildClientHello(nil), "", nil},
+		{"encrypted client hello", withECH, "", nil},
+
+		{"record header only", captured[:3], "", ErrIncomplete},
+		{"first segment only", captured[:1448], "", ErrIncomplete},
+		{"not a handshake", []byte{0x17, 0x03, 0x03, 0x00, 0x10}, "", errNotClientHello},
+		{"server hello", []byte{0x16, 0x03, 0x03, 0x00, 0x04, 0x02, 0x00, 0x00, 0x00}, "", errNotClientHello},
+		{"malformed extensions", buildClientHello([]byte{0x00, 0x00, 0x00, 0x10}), "", errMalformed},
+	}
+	for _, tt := range tests {
+		serverName, err := ParseTLSServerName(tt.stream)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.err, err)
+		}
+		if serverName != tt.serverName {
+			t.Errorf("%s: expected server name %q, got %q", tt.name, tt.serverName, serverName)
+		}
+	}
+}
+
+func TestParseTLSServerNameMultipleRecords(t *testing.T) {
+	t.Parallel()
+
+	// Split the handshake message of the captured ClientHello into two records.
+	captured := readTestClientHello(t, "clienthello.bin")
+	handshake := captured[tlsRecordHeaderLength:]
+	split := 100
+	var stream []byte
+	for _, fragment := range [][]byte{handshake[:split], handshake[split:]} {
+		stream = append(stream, 0x16, 0x03, 0x01)
+		stream = binary.BigEndian.AppendUint16(stream, uint16(len(fragment)))
+		stream = append(stream, fragment...)
+	}
+
+	if _, err := ParseTLSServerName(stream[:tlsRecordHeaderLength+split+3]); !errors.Is(err, ErrIncomplete) {
+		t.Errorf("expected incomplete error for first record, got %v", err)
+	}
+	serverName, err := ParseTLSServerName(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverName != "www.example.com" {
+		t.Errorf("unexpected server name %q", serverName)
+	}
+}
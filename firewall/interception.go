@@ -3,6 +3,7 @@
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"net"
 	"os"
@@ -24,6 +25,7 @@
 	"github.com/safing/portmaster/network/netutils"
 	"github.com/safing/portmaster/network/packet"
 	"github.com/safing/portmaster/network/reference"
+	"github.com/safing/portmaster/profile"
 )
 
 var (
@@ -42,30 +44,39 @@
 	blockedIPv6 = net.ParseIP("::17")
 
 	ownPID = os.Getpid()
+
+	cleanupStaleRules bool
 )
 
 const (
-	configChangeEvent        = "config change"
 	profileConfigChangeEvent = "profile config change"
+	rulesReloadedEvent       = "rules reloaded"
 	onSPNConnectEvent        = "spn connect"
 )
 
 func init() {
 	// TODO: Move interception module to own package (dir).
-	interceptionModule = modules.Register("interception", interceptionPrep, interceptionStart, interceptionStop, "base", "updates", "network", "notifications", "profiles")
+	interceptionModule = modules.Register(InterceptionModuleName, interceptionPrep, interceptionStart, interceptionStop, "base", "updates", "network", "notifications", "profiles")
 
 	network.SetDefaultFirewallHandler(defaultHandler)
+
+	flag.BoolVar(&cleanupStaleRules, "cleanup-stale-rules", false, "remove stale firewall rules and conntrack marks left behind by a crashed Portmaster and exit")
 }
 
 func interceptionPrep() error {
-	// Reset connections every time configuration changes
-	// this will be triggered on spn enable/disable
+	if cleanupStaleRules {
+		modules.SetCmdLineOperation(interception.CleanupStaleRules)
+	}
+
+	// Invalidate outdated verdicts every time the rules were reloaded after a
+	// configuration change. This is also triggered on spn enable/disable.
 	err := interceptionModule.RegisterEventHook(
-		"config",
-		configChangeEvent,
-		"reset connection verdicts",
+		"profiles",
+		rulesReloadedEvent,
+		"invalidate outdated connection verdicts",
 		func(ctx context.Context, _ interface{}) error {
-			resetAllConnectionVerdicts()
+			discardRestoredVerdicts()
+			InvalidateVerdictsOlderThan(profile.CurrentRuleVersion())
 			return nil
 		},
 	)
@@ -73,13 +84,15 @@ func(ctx context.Context, _ interface{}) error {
 		log.Errorf("interception: failed registering event hook: %s", err)
 	}
 
-	// Reset connections every time profile changes
+	// Invalidate the verdicts of the connections of a profile every time it
+	// changes.
 	err = interceptionModule.RegisterEventHook(
 		"profiles",
 		profileConfigChangeEvent,
-		"reset connection verdicts",
+		"invalidate outdated connection verdicts",
 		func(ctx context.Context, _ interface{}) error {
-			resetAllConnectionVerdicts()
+			discardRestoredVerdicts()
+			InvalidateVerdictsOlderThan(profile.CurrentRuleVersion())
 			return nil
 		},
 	)
@@ -94,6 +107,7 @@ func(ctx context.Context, _ interface{}) error {
 		onSPNConnectEvent,
 		"reset connection verdicts",
 		func(ctx context.Context, _ interface{}) error {
+			discardRestoredVerdicts()
 			resetAllConnectionVerdicts()
 			return nil
 		},
@@ -102,10 +116,18 @@ func(ctx context.Context, _ interface{}) error {
 		log.Errorf("failed registering event hook: %s", err)
 	}
 
+	// Release the state of connections as soon as the OS stops tracking them.
+	interception.RegisterConnectionClosedHandler(handleConnectionClosed)
+	interception.SetOpenConnectionsSource(openConnectionIDs)
+
 	if err := registerConfig(); err != nil {
 		return err
 	}
 
+	if err := registerAPIEndpoints(); err != nil {
+		return err
+	}
+
 	return prepAPIAuth()
 }
 
@@ -118,70 +140,126 @@ func resetAllConnectionVerdicts() {
 	ctx, tracer := log.AddTracer(context.Background())
 
 	// Re-evaluate all connections.
-	var changedVerdicts int
-	for _, conn := range network.GetAllConnections() {
+	changedVerdicts := reEvaluateAllConnections(ctx, network.GetAllConnections(), reEvaluateConnection)
+	tracer.Infof("filter: changed verdict on %d connections", changedVerdicts)
+	tracer.Submit()
+
+	err := interception.ResetVerdictOfAllConnections()
+	if err != nil {
+		log.Errorf("interception: failed to remove persistent verdicts: %s", err)
+	}
+}
+
+// reEvaluateAllConnections re-evaluates the verdicts of the given connections
+// with reEvaluate and returns the number of changed verdicts. Connections with
+// a pinned verdict are skipped, see PinConnectionVerdict.
+func reEvaluateAllConnections(
+	ctx context.Context,
+	conns []*network.Connection,
+	reEvaluate func(context.Context, *network.Connection) bool,
+) (changedVerdicts int) {
+	for _, conn := range conns {
 		func() {
 			conn.Lock()
 			defer conn.Unlock()
 
-			// Skip internal connections:
-			// - Pre-authenticated connections from Portmaster
-			// - Redirected DNS requests
-			// - SPN Uplink to Home Hub
-			if conn.Internal {
-				tracer.Tracef("filter: skipping internal connection %s", conn)
+			if verdictPinned(conn) {
+				log.Tracer(ctx).Tracef("filter: skipping connection %s with pinned verdict", conn)
 				return
 			}
+			if reEvaluate(ctx, conn) {
+				changedVerdicts++
+			}
+		}()
+	}
+	return changedVerdicts
+}
 
-			tracer.Debugf("filter: re-evaluating verdict of %s", conn)
-			previousVerdict := conn.Verdict.Firewall
+// reEvaluateConnection re-evaluates the verdict of the connection and returns
+// whether it changed. Internal and killed connections are skipped. The
+// connection must be locked.
+func reEvaluateConnection(ctx context.Context, conn *network.Connection) (changed bool) {
+	tracer := log.Tracer(ctx)
 
-			// Apply privacy filter and check tunneling.
-			FilterConnection(ctx, conn, nil, true, true)
+	// Skip internal connections:
+	// - Pre-authenticated connections from Portmaster
+	// - Redirected DNS requests
+	// - SPN Uplink to Home Hub
+	if conn.Internal {
+		tracer.Tracef("filter: skipping internal connection %s", conn)
+		return false
+	}
+	// Skip killed connections, as they must stay dropped.
+	if conn.Killed {
+		tracer.Tracef("filter: skipping killed connection %s", conn)
+		return false
+	}
+	// Skip connections with a temporary verdict until it expires.
+	if conn.VerdictExpires != 0 {
+		tracer.Tracef("filter: skipping connection %s with temporary verdict", conn)
+		return false
+	}
 
-			// Stop existing SPN tunnel if not needed anymore.
-			if conn.Verdict.Active != network.VerdictRerouteToTunnel && conn.TunnelContext != nil {
-				err := conn.TunnelContext.StopTunnel()
-				if err != nil {
-					tracer.Debugf("filter: failed to stopped unneeded tunnel: %s", err)
-				}
-			}
+	tracer.Debugf("filter: re-evaluating verdict of %s", conn)
+	previousVerdict := conn.Verdict.Firewall
 
-			// Save if verdict changed.
-			if conn.Verdict.Firewall != previousVerdict {
-				conn.Save()
-				tracer.Infof("filter: verdict of connection %s changed from %s to %s", conn, previousVerdict.Verb(), conn.VerdictVerb())
-				changedVerdicts++
-			} else {
-				tracer.Tracef("filter: verdict to connection %s unchanged at %s", conn, conn.VerdictVerb())
-			}
-		}()
+	// Apply privacy filter and check tunneling.
+	FilterConnection(ctx, conn, nil, true, true)
+
+	// Stop existing SPN tunnel if not needed anymore.
+	if conn.Verdict.Active != network.VerdictRerouteToTunnel && conn.TunnelContext != nil {
+		err := conn.TunnelContext.StopTunnel()
+		if err != nil {
+			tracer.Debugf("filter: failed to stopped unneeded tunnel: %s", err)
+		}
 	}
-	tracer.Infof("filter: changed verdict on %d connections", changedVerdicts)
-	tracer.Submit()
 
-	err := interception.ResetVerdictOfAllConnections()
-	if err != nil {
-		log.Errorf("interception: failed to remove persistent verdicts: %s", err)
+	// Save if verdict changed.
+	if conn.Verdict.Firewall != previousVerdict {
+		conn.Save()
+		tracer.Infof("filter: verdict of connection %s changed from %s to %s", conn, previousVerdict.Verb(), conn.VerdictVerb())
+		return true
 	}
+
+	tracer.Tracef("filter: verdict to connection %s unchanged at %s", conn, conn.VerdictVerb())
+	return false
 }
 
 func interceptionStart() error {
 	getConfig()
 
-	if err := registerMetrics(); err != nil {
-		return err
-	}
+	describeMetrics()
 
 	startAPIAuth()
 
+	network.SetVerdictExpiryHandler(expireTemporaryVerdict)
+
+	// Hold packets until the decision engine is ready.
+	startEngineStartupHold()
+
 	interceptionModule.StartWorker("stat logger", statLogger)
+	interceptionModule.StartWorker("gauge reporter", gaugeReporter)
+	interceptionModule.StartWorker("connection rate poller", connectionRatePoller)
+	interceptionModule.StartWorker("pinned connection pruner", pinnedConnectionPruner)
 	interceptionModule.StartWorker("packet handler", packetHandler)
 
-	return interception.Start()
+	// Restore verdicts before the interception starts, as it resets the
+	// verdicts saved in the connection tracking of the OS.
+	restoreVerdictCache(persistVerdicts())
+
+	if err := interception.Start(); err != nil {
+		return err
+	}
+
+	interceptionModule.StartWorker("interception warmup", warmupInterception)
+	interceptionModule.StartWorker("engine readiness signaler", signalEngineReady)
+	return nil
 }
 
 func interceptionStop() error {
+	if persistVerdicts() {
+		persistVerdictCache()
+	}
 	return interception.Stop()
 }
 
@@ -200,12 +278,24 @@ func SetNameserverIPMatcher(fn func(ip net.IP) bool) error {
 func handlePacket(ctx context.Context, pkt packet.Packet) {
 	// Record metrics.
 	startTime := time.Now()
-	defer packetHandlingHistogram.UpdateDuration(startTime)
+	defer recordPacketHandlingDuration(startTime)
+	pkt.Timing().Dequeued = startTime
 
 	if fastTrackedPermit(pkt) {
 		return
 	}
 
+	// Hold packets until the decision engine is ready.
+	if engineStartup.hold(pkt) {
+		return
+	}
+
+	// Bypass the decision engine if it failed repeatedly.
+	if !engineCircuitBreaker.allow(startTime) {
+		applyEngineBreakerVerdict(pkt)
+		return
+	}
+
 	// Add context tracer and set context on packet.
 	traceCtx, tracer := log.AddTracer(ctx)
 	if tracer != nil {
@@ -216,9 +306,16 @@ func handlePacket(ctx context.Context, pkt packet.Packet) {
 
 	// Get connection of packet.
 	conn, err := getConnection(pkt)
+	if errors.Is(err, errTrackingCapReached) {
+		tracer.Debugf("filter: packet %s dropped: %s", pkt, err)
+		_ = interception.DropOnError(pkt, packet.ErrorDropResourceLimit, err)
+		tracer.Submit()
+		return
+	}
 	if err != nil {
 		tracer.Errorf("filter: packet %s dropped: %s", pkt, err)
-		_ = pkt.Drop()
+		_ = interception.DropOnError(pkt, packet.ErrorDropEngine, err)
+		engineCircuitBreaker.recordError(time.Now(), err)
 		return
 	}
 
@@ -239,6 +336,11 @@ func getConnection(pkt packet.Packet) (*network.Connection, error) {
 			return conn, nil
 		}
 
+		// Check if there is room to track another connection.
+		if !checkTrackingCap() {
+			return nil, errTrackingCapReached
+		}
+
 		// Else create new one from the packet.
 		conn = network.NewConnectionFromFirstPacket(pkt)
 		conn.Lock()
@@ -248,6 +350,9 @@ func getConnection(pkt packet.Packet) (*network.Connection, error) {
 		return conn, nil
 	})
 	if err != nil {
+		if errors.Is(err, errTrackingCapReached) {
+			return nil, err
+		}
 		return nil, fmt.Errorf("failed to get connection: %w", err)
 	}
 	if newConn == nil {
@@ -316,6 +421,11 @@ func fastTrackedPermit(pkt packet.Packet) (handled bool) {
 			return true
 		}
 
+		// Error messages inherit the verdict of the connection they refer to.
+		if handleICMPError(pkt) {
+			return true
+		}
+
 		// Handle echo request and replies regularly.
 		// Other ICMP packets are considered system business.
 		icmpLayers := pkt.Layers().LayerClass(layers.LayerClassIPControl)
@@ -343,24 +453,8 @@ func fastTrackedPermit(pkt packet.Packet) (handled bool) {
 		switch meta.DstPort {
 
 		case 67, 68, 546, 547:
-			// Always allow DHCP, DHCPv6.
-
-			// DHCP and DHCPv6 must be UDP.
-			if meta.Protocol != packet.UDP {
-				return false
-			}
-
-			// DHCP is only valid in local network scopes.
-			switch netutils.ClassifyIP(meta.Dst) { //nolint:exhaustive // Checking for specific values only.
-			case netutils.HostLocal, netutils.LinkLocal, netutils.SiteLocal, netutils.LocalMulticast:
-			default:
-				return false
-			}
-
-			// Log and permit.
-			log.Debugf("filter: fast-track accepting DHCP: %s", pkt)
-			_ = pkt.PermanentAccept()
-			return true
+			// Always allow DHCP, DHCPv6, if enabled.
+			return fastTrackDHCP(pkt)
 
 		case apiPort:
 			// Always allow direct access to the Portmaster API.
@@ -390,6 +484,10 @@ func fastTrackedPermit(pkt packet.Packet) (handled bool) {
 				return false
 			}
 
+			// Pin the verdict, so that resetting all verdicts does not
+			// interrupt the connection of the user interface.
+			_ = interception.PinConnection(pkt.GetConnectionID())
+
 			// Log and permit.
 			log.Debugf("filter: fast-track accepting api connection: %s", pkt)
 			_ = pkt.PermanentAccept()
@@ -449,6 +547,15 @@ func initialHandler(conn *network.Connection, pkt packet.Packet) {
 		filterConnection = false
 		log.Tracer(pkt.Ctx()).Infof("filter: granting own pre-authenticated connection %s", conn)
 
+	case inheritRelatedVerdicts() &&
+		inheritRelatedVerdict(pkt.Ctx(), conn, pkt.ConntrackInfo(), network.GetConnection):
+		// Verdict was inherited from the master connection.
+		filterConnection = false
+
+	case restoreVerdict(pkt.Ctx(), conn):
+		// Verdict was restored from before the restart.
+		filterConnection = false
+
 		// Redirect outbound DNS packets if enabled,
 	case dnsQueryInterception() &&
 		pkt.IsOutbound() &&
@@ -470,12 +577,21 @@ func initialHandler(conn *network.Connection, pkt packet.Packet) {
 		// End directly, as no other processing is necessary.
 		conn.StopFirewallHandler()
 		finalizeVerdict(conn)
-		issueVerdict(conn, pkt, 0, true)
+		if err := issueVerdict(conn, pkt, 0, true); err != nil {
+			log.Warningf("filter: pkt %s: %s", pkt, err)
+		}
+		return
+	}
+
+	// Hold the decision while rules are reloading.
+	if filterConnection && !handleRuleReload(conn, pkt) {
 		return
 	}
 
 	// Apply privacy filter and check tunneling.
 	FilterConnection(pkt.Ctx(), conn, pkt, filterConnection, true)
+	journalBlockedConnection(conn)
+	auditBlockedConnection(conn)
 
 	// Decide how to continue handling connection.
 	switch {
@@ -485,13 +601,19 @@ func initialHandler(conn *network.Connection, pkt packet.Packet) {
 		inspectThenVerdict(conn, pkt)
 	default:
 		conn.StopFirewallHandler()
-		issueVerdict(conn, pkt, 0, true)
+		if err := issueVerdict(conn, pkt, 0, true); err != nil {
+			log.Warningf("filter: pkt %s: %s", pkt, err)
+		}
 	}
 }
 
 // FilterConnection runs all the filtering (and tunneling) procedures.
 func FilterConnection(ctx context.Context, conn *network.Connection, pkt packet.Packet, checkFilter, checkTunnel bool) {
 	if checkFilter {
+		// Tag the verdict with the rule version before deciding, so that a
+		// reload during the decision leaves it tagged as outdated.
+		conn.RuleVersion = profile.CurrentRuleVersion()
+
 		if filterEnabled() {
 			log.Tracer(ctx).Trace("filter: starting decision process")
 			decideOnConnection(ctx, conn, pkt)
@@ -501,7 +623,8 @@ func FilterConnection(ctx context.Context, conn *network.Connection, pkt packet.
 	}
 
 	// TODO: Enable inspection framework again.
-	conn.Inspecting = false
+	// Only the application protocol detection uses it for now.
+	conn.Inspecting = shouldDetectProtocol(conn)
 
 	// TODO: Quick fix for the SPN.
 	// Use inspection framework for proper encryption detection.
@@ -540,24 +663,42 @@ func FilterConnection(ctx context.Context, conn *network.Connection, pkt packet.
 
 func defaultHandler(conn *network.Connection, pkt packet.Packet) {
 	// TODO: `pkt` has an active trace log, which we currently don't submit.
-	issueVerdict(conn, pkt, 0, true)
+	if err := issueVerdict(conn, pkt, 0, true); err != nil {
+		log.Warningf("filter: pkt %s: %s", pkt, err)
+	}
 }
 
 func inspectThenVerdict(conn *network.Connection, pkt packet.Packet) {
 	pktVerdict, continueInspection := inspection.RunInspectors(conn, pkt)
 	if continueInspection {
-		issueVerdict(conn, pkt, pktVerdict, false)
+		if err := issueVerdict(conn, pkt, pktVerdict, false); err != nil {
+			log.Warningf("filter: pkt %s: %s", pkt, err)
+		}
 		return
 	}
 
 	// we are done with inspecting
 	conn.StopFirewallHandler()
-	issueVerdict(conn, pkt, 0, true)
+	if err := issueVerdict(conn, pkt, 0, true); err != nil {
+		log.Warningf("filter: pkt %s: %s", pkt, err)
+	}
 }
 
-func issueVerdict(conn *network.Connection, pkt packet.Packet, verdict network.Verdict, allowPermanent bool) {
-	// enable permanent verdict
-	if allowPermanent && !conn.VerdictPermanent {
+func issueVerdict(conn *network.Connection, pkt packet.Packet, verdict network.Verdict, allowPermanent bool) error {
+	if conn.Killed {
+		sendPendingTCPResets(conn, pkt)
+	}
+
+	// Drop the packets of tarpitted connections one by one, as they must keep
+	// reaching the firewall in order to be answered.
+	if answerTarpittedPacket(conn, pkt) {
+		verdict = network.VerdictDrop
+		allowPermanent = false
+	}
+
+	// enable permanent verdict, unless the verdict is temporary or the user is
+	// still asked for a decision
+	if allowPermanent && !conn.VerdictPermanent && conn.VerdictExpires == 0 && conn.Verdict.Active != network.VerdictAsk {
 		conn.VerdictPermanent = permanentVerdicts()
 		if conn.VerdictPermanent {
 			conn.SaveWhenFinished()
@@ -569,47 +710,107 @@ func issueVerdict(conn *network.Connection, pkt packet.Packet, verdict network.V
 		verdict = conn.Verdict.Active
 	}
 
-	var err error
+	// Drop blocked DNS queries that were answered with a forged response, as
+	// rejecting them would signal an error to the querying process.
+	if respondToBlockedDNSQuery(pkt, verdict) {
+		verdict = network.VerdictDrop
+	}
+
+	var (
+		apply func() error
+		// errorDrop is set if the packet is dropped because of an internal
+		// failure instead of a decision.
+		errorDrop error
+		// engineErr is set if the engine did not decide on the packet, which
+		// counts towards tripping the circuit breaker.
+		engineErr error
+	)
 	switch verdict {
 	case network.VerdictAccept:
 		atomic.AddUint64(packetsAccepted, 1)
 		if conn.VerdictPermanent {
-			err = pkt.PermanentAccept()
+			apply = pkt.PermanentAccept
 		} else {
-			err = pkt.Accept()
+			apply = pkt.Accept
 		}
 	case network.VerdictBlock:
 		atomic.AddUint64(packetsBlocked, 1)
 		if conn.VerdictPermanent {
-			err = pkt.PermanentBlock()
+			apply = pkt.PermanentBlock
 		} else {
-			err = pkt.Block()
+			apply = pkt.Block
 		}
 	case network.VerdictDrop:
 		atomic.AddUint64(packetsDropped, 1)
 		if conn.VerdictPermanent {
-			err = pkt.PermanentDrop()
+			apply = pkt.PermanentDrop
 		} else {
-			err = pkt.Drop()
+			apply = pkt.Drop
 		}
 	case network.VerdictRerouteToNameserver:
-		err = pkt.RerouteToNameserver()
+		apply = pkt.RerouteToNameserver
 	case network.VerdictRerouteToTunnel:
-		err = pkt.RerouteToTunnel()
+		apply = pkt.RerouteToTunnel
+	case network.VerdictAsk:
+		// Apply the prompt pending action until the user answers, but never
+		// permanently, so that the answer applies to the following packets.
+		switch askTimeoutAction() {
+		case askTimeoutActionPermit:
+			atomic.AddUint64(packetsAccepted, 1)
+			apply = pkt.Accept
+		case askTimeoutActionDrop:
+			atomic.AddUint64(packetsDropped, 1)
+			apply = pkt.Drop
+		default:
+			atomic.AddUint64(packetsBlocked, 1)
+			apply = pkt.Block
+		}
 	case network.VerdictFailed:
+		// Failed connections are decided by the engine, so they do not count
+		// as engine errors for the circuit breaker.
 		atomic.AddUint64(packetsFailed, 1)
-		err = pkt.Drop()
+		apply = pkt.Drop
+		errorDrop = fmt.Errorf("connection failed: %s", conn.Reason.Msg)
 	case network.VerdictUndecided, network.VerdictUndeterminable:
 		log.Warningf("filter: tried to apply verdict %s to pkt %s: dropping instead", verdict, pkt)
 		fallthrough
 	default:
 		atomic.AddUint64(packetsDropped, 1)
-		err = pkt.Drop()
+		apply = pkt.Drop
+		errorDrop = fmt.Errorf("cannot apply verdict %s", verdict)
+		engineErr = errorDrop
 	}
 
+	applyStart := time.Now()
+	err := apply()
+	if errors.Is(err, packet.ErrVerdictTransient) {
+		// Retry once, as the packet is still waiting for a verdict.
+		err = apply()
+	}
+	recordVerdictLatency(pkt, verdict)
+	recordVerdictByProcess(conn, verdict)
+	if flowDebugEnabled(conn) {
+		logFlowDebug(conn, pkt, verdict, time.Since(applyStart), err)
+	}
 	if err != nil {
-		log.Warningf("filter: failed to apply verdict to pkt %s: %s", pkt, err)
+		// The packet did not get a verdict, whether the retry failed or the
+		// error was not transient. Record it as an error drop and engine error.
+		recordVerdictApplyError()
+		err = fmt.Errorf("failed to apply verdict %s: %w", verdict, err)
+		interception.RecordErrorDrop(packet.ErrorDropEngine, err)
+		engineCircuitBreaker.recordError(time.Now(), err)
+		return err
+	}
+	if errorDrop != nil {
+		interception.RecordErrorDrop(packet.ErrorDropEngine, errorDrop)
+	}
+	if engineErr != nil {
+		engineCircuitBreaker.recordError(time.Now(), engineErr)
+	} else {
+		engineCircuitBreaker.recordSuccess()
 	}
+
+	return nil
 }
 
 // verdictRating rates the privacy and security aspect of verdicts from worst to best.
@@ -652,6 +853,12 @@ func finalizeVerdict(conn *network.Connection) {
 		// Apply first verdict without change.
 		conn.Verdict.Active = conn.Verdict.Firewall
 
+	case conn.Verdict.Active == network.VerdictAsk:
+		// Apply the answer to a prompt without change, as the connection was
+		// only held while waiting for it.
+		conn.Verdict.Active = conn.Verdict.Firewall
+		endPromptOutstanding(conn.ID)
+
 	case conn.Verdict.Worst == network.VerdictBlock ||
 		conn.Verdict.Worst == network.VerdictDrop ||
 		conn.Verdict.Worst == network.VerdictFailed ||
@@ -685,11 +892,16 @@ func finalizeVerdict(conn *network.Connection) {
 // }
 
 func packetHandler(ctx context.Context) error {
+	if classify := getVerdictPriorityClassifier(); classify != nil {
+		return prioritizedPacketHandler(ctx, interception.Packets(), classify)
+	}
+
+	packets := interception.Packets()
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
-		case pkt := <-interception.Packets:
+		case pkt := <-packets:
 			interceptionModule.StartWorker("initial packet handler", func(workerCtx context.Context) error {
 				handlePacket(workerCtx, pkt)
 				return nil
@@ -705,11 +917,12 @@ func statLogger(ctx context.Context) error {
 			return nil
 		case <-time.After(10 * time.Second):
 			log.Tracef(
-				"filter: packets accepted %d, blocked %d, dropped %d, failed %d",
+				"filter: packets accepted %d, blocked %d, dropped %d, failed %d, prompts outstanding %d",
 				atomic.LoadUint64(packetsAccepted),
 				atomic.LoadUint64(packetsBlocked),
 				atomic.LoadUint64(packetsDropped),
 				atomic.LoadUint64(packetsFailed),
+				countOutstandingPrompts(time.Now()),
 			)
 			atomic.StoreUint64(packetsAccepted, 0)
 			atomic.StoreUint64(packetsBlocked, 0)
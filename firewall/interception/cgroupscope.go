@@ -0,0 +1,31 @@
+package interception
+
+// CgroupScope limits the interception to the traffic of processes in the
+// listed cgroups. Traffic of all other processes is accepted without being
+// handed to the Portmaster. An empty scope intercepts all traffic.
+//
+// Matching is based on the socket of a packet, so only traffic of processes
+// in the network namespace of the Portmaster can be matched. Containers with
+// their own network namespace, such as on a bridge network, have their traffic
+// forwarded by the host and cannot be matched. Inbound connections can only be
+// matched if the kernel attributes the packet to a local socket through early
+// socket demuxing, so new inbound connections to scoped processes usually pass
+// without being intercepted.
+type CgroupScope struct {
+	// ClassIDs holds net_cls cgroup (v1) class IDs. The net_cls controller must
+	// be mounted and the class ID has to be set in net_cls.classid of the
+	// cgroups to be intercepted. Class IDs are stable, so containers may start
+	// and stop without affecting the match.
+	ClassIDs []uint32
+	// Paths holds cgroup v2 paths, relative to the cgroup2 mount point, eg.
+	// "system.slice/docker-<id>.scope". This requires the unified cgroup
+	// hierarchy and kernel 4.5 or newer. The kernel resolves the path when the
+	// rule is installed, so the rules are rebuilt whenever one of the cgroups
+	// is created or removed. Paths that do not exist are skipped.
+	Paths []string
+}
+
+// IsEmpty returns whether the scope does not limit the interception.
+func (scope CgroupScope) IsEmpty() bool {
+	return len(scope.ClassIDs) == 0 && len(scope.Paths) == 0
+}
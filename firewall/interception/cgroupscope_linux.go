@@ -0,0 +1,238 @@
+package interception
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/safing/portbase/log"
+)
+
+// cgroupScopeCheckInterval defines how often the cgroups of the scope are
+// checked for being created or removed.
+const cgroupScopeCheckInterval = 5 * time.Second
+
+var (
+	cgroupScopeClassIDsFlag string
+	cgroupScopePathsFlag    string
+
+	cgroupScope     CgroupScope
+	cgroupScopeLock sync.Mutex
+	// cgroupScopeInstalled holds the inodes of the cgroup paths that the
+	// current rules were built with.
+	cgroupScopeInstalled map[string]uint64
+
+	// cgroup2Root is the mount point of the cgroup v2 hierarchy.
+	cgroup2Root = "/sys/fs/cgroup"
+)
+
+func init() {
+	flag.StringVar(&cgroupScopeClassIDsFlag, "nfqueue-cgroup-classids", "", "comma separated list of net_cls cgroup class IDs (eg. 0x100001 or 10:1) to limit the interception to")
+	flag.StringVar(&cgroupScopePathsFlag, "nfqueue-cgroup-paths", "", "comma separated list of cgroup v2 paths, relative to the cgroup2 mount point, to limit the interception to")
+}
+
+// loadCgroupScopeFlags sets the cgroup scope as configured by flags. The scope
+// is not changed if no flags are set.
+func loadCgroupScopeFlags() error {
+	if cgroupScopeClassIDsFlag == "" && cgroupScopePathsFlag == "" {
+		return nil
+	}
+
+	scope := CgroupScope{}
+	for _, value := range splitFlagList(cgroupScopeClassIDsFlag) {
+		classID, err := parseCgroupClassID(value)
+		if err != nil {
+			return err
+		}
+		scope.ClassIDs = append(scope.ClassIDs, classID)
+	}
+	scope.Paths = splitFlagList(cgroupScopePathsFlag)
+
+	return setCgroupScope(scope)
+}
+
+func splitFlagList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// parseCgroupClassID parses a net_cls class ID, either as a number or in the
+// "major:minor" notation with hexadecimal values, as used by tc.
+func parseCgroupClassID(value string) (uint32, error) {
+	if major, minor, ok := strings.Cut(value, ":"); ok {
+		majorID, err := strconv.ParseUint(major, 16, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid cgroup class ID %q: %w", value, err)
+		}
+		minorID, err := strconv.ParseUint(minor, 16, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid cgroup class ID %q: %w", value, err)
+		}
+		return uint32(majorID<<16 | minorID), nil
+	}
+
+	classID, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cgroup class ID %q: %w", value, err)
+	}
+	return uint32(classID), nil
+}
+
+// setCgroupScope checks and sets the cgroup scope. The rules are rebuilt if
+// the interception is active.
+func setCgroupScope(scope CgroupScope) error {
+	for _, classID := range scope.ClassIDs {
+		if classID == 0 {
+			return errors.New("invalid cgroup class ID 0")
+		}
+	}
+	cleanedPaths := make([]string, 0, len(scope.Paths))
+	for _, cgroupPath := range scope.Paths {
+		// The rules are split by spaces.
+		if cgroupPath == "" || strings.ContainsAny(cgroupPath, " \t\n") {
+			return fmt.Errorf("invalid cgroup path %q", cgroupPath)
+		}
+		cleanedPaths = append(cleanedPaths, strings.TrimPrefix(path.Clean("/"+cgroupPath), "/"))
+	}
+	scope.Paths = cleanedPaths
+
+	cgroupScopeLock.Lock()
+	cgroupScope = scope
+	cgroupScopeLock.Unlock()
+
+	if scope.IsEmpty() {
+		log.Infof("interception: intercepting traffic of all cgroups")
+	} else {
+		log.Infof("interception: limiting interception to cgroups with class IDs %v and paths %v", scope.ClassIDs, scope.Paths)
+	}
+
+	if nfqueueActive.IsSet() {
+		RequestRuleRebuild()
+	}
+	return nil
+}
+
+// withCgroupScope returns the rules limited to the cgroup scope: The queue
+// rules of the ingest chains only match packets of the scoped cgroups, while
+// all other packets are marked to be accepted. The accept mark is not saved
+// to the connection, as the cgroup of a connection is only known for local
+// sockets and packets of connections that enter the scope, eg. when their
+// cgroup is created, must be intercepted right away.
+func withCgroupScope(rules []string) []string {
+	matches := cgroupScopeMatches()
+	if matches == nil {
+		return rules
+	}
+
+	scoped := make([]string, 0, len(rules)+2*len(matches))
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule, "mangle PORTMASTER-INGEST-") {
+			scoped = append(scoped, rule)
+			continue
+		}
+		match, target, ok := strings.Cut(rule, " -j NFQUEUE ")
+		if !ok {
+			scoped = append(scoped, rule)
+			continue
+		}
+
+		for _, cgroupMatch := range matches {
+			scoped = append(scoped, match+" "+cgroupMatch+" -j NFQUEUE "+target)
+		}
+		scoped = append(scoped, match+" -j MARK --set-mark 1700")
+	}
+
+	return scoped
+}
+
+// cgroupScopeMatches returns the iptables matches for the cgroup scope and
+// records the cgroup paths they are built with. If the scope is empty, nil is
+// returned.
+func cgroupScopeMatches() []string {
+	cgroupScopeLock.Lock()
+	defer cgroupScopeLock.Unlock()
+
+	cgroupScopeInstalled = nil
+	if cgroupScope.IsEmpty() {
+		return nil
+	}
+
+	matches := make([]string, 0, len(cgroupScope.ClassIDs)+len(cgroupScope.Paths))
+	for _, classID := range cgroupScope.ClassIDs {
+		matches = append(matches, fmt.Sprintf("-m cgroup --cgroup %#x", classID))
+	}
+
+	cgroupScopeInstalled = make(map[string]uint64, len(cgroupScope.Paths))
+	for _, cgroupPath := range cgroupScope.Paths {
+		inode, ok := cgroupInode(cgroupPath)
+		if !ok {
+			log.Debugf("interception: skipping cgroup %s of scope, as it does not exist", cgroupPath)
+			continue
+		}
+		cgroupScopeInstalled[cgroupPath] = inode
+		matches = append(matches, "-m cgroup --path "+cgroupPath)
+	}
+
+	return matches
+}
+
+// cgroupScopeChanged returns whether a cgroup of the scope was created or
+// removed since the rules were built.
+func cgroupScopeChanged() bool {
+	cgroupScopeLock.Lock()
+	defer cgroupScopeLock.Unlock()
+
+	for _, cgroupPath := range cgroupScope.Paths {
+		inode, exists := cgroupInode(cgroupPath)
+		installedInode, installed := cgroupScopeInstalled[cgroupPath]
+		if exists != installed || inode != installedInode {
+			return true
+		}
+	}
+	return false
+}
+
+// cgroupInode returns the inode of the cgroup directory. A cgroup that is
+// removed and created again gets a new inode.
+func cgroupInode(cgroupPath string) (inode uint64, exists bool) {
+	info, err := os.Stat(filepath.Join(cgroup2Root, cgroupPath))
+	if err != nil || !info.IsDir() {
+		return 0, false
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Ino, true
+	}
+	return 0, true
+}
+
+// watchCgroupScope rebuilds the rules when cgroups of the scope are created or
+// removed, eg. when containers start or stop.
+func watchCgroupScope() {
+	ticker := time.NewTicker(cgroupScopeCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-shutdownSignal:
+			return
+		case <-ticker.C:
+			if cgroupScopeChanged() {
+				log.Infof("interception: cgroups of scope changed, rebuilding rules")
+				RequestRuleRebuild()
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package interception
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseCgroupClassID(t *testing.T) {
+	t.Parallel()
+
+	for value, expected := range map[string]uint32{
+		"0x100001": 0x100001,
+		"1048577":  0x100001,
+		"10:1":     0x100001,
+		"ffff:ff":  0xffff00ff,
+	} {
+		classID, err := parseCgroupClassID(value)
+		if err != nil {
+			t.Errorf("failed to parse %q: %s", value, err)
+		} else if classID != expected {
+			t.Errorf("parsed %q as %#x, expected %#x", value, classID, expected)
+		}
+	}
+
+	for _, value := range []string{"", "abc", "10000:1", "0x100000000"} {
+		if _, err := parseCgroupClassID(value); err == nil {
+			t.Errorf("invalid class ID %q should be rejected", value)
+		}
+	}
+}
+
+func TestCgroupScope(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func(root string) {
+		cgroup2Root = root
+		_ = setCgroupScope(CgroupScope{})
+		buildRules()
+	}(cgroup2Root)
+	cgroup2Root = t.TempDir()
+	if err := os.Mkdir(filepath.Join(cgroup2Root, "web"), 0o0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := setCgroupScope(CgroupScope{Paths: []string{"invalid path"}}); err == nil {
+		t.Error("path with space should be rejected")
+	}
+
+	err := setCgroupScope(CgroupScope{
+		ClassIDs: []uint32{0x100001},
+		Paths:    []string{"/web", "db"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buildRules()
+
+	for _, expected := range []string{
+		"mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -m cgroup --cgroup 0x100001 -j NFQUEUE --queue-num 17040 --queue-bypass",
+		"mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -m cgroup --path web -j NFQUEUE --queue-num 17040 --queue-bypass",
+		"mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -j MARK --set-mark 1700",
+		"mangle PORTMASTER-INGEST-INPUT -m mark --mark 0 -m cgroup --cgroup 0x100001 -j NFQUEUE --queue-num 17140 --queue-bypass",
+		"mangle PORTMASTER-INGEST-INPUT -m mark --mark 0 -j MARK --set-mark 1700",
+	} {
+		if !containsRule(v4rules, expected) {
+			t.Errorf("missing rule %q", expected)
+		}
+	}
+	for _, unexpected := range []string{
+		"mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -j NFQUEUE --queue-num 17040 --queue-bypass",
+		"mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -m cgroup --path db -j NFQUEUE --queue-num 17040 --queue-bypass",
+		// Packets outside of the scope must not be accepted permanently.
+		"mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -j MARK --set-mark 1710",
+	} {
+		if containsRule(v4rules, unexpected) {
+			t.Errorf("unexpected rule %q", unexpected)
+		}
+	}
+
+	// Starting a container creates its cgroup.
+	if cgroupScopeChanged() {
+		t.Error("cgroups should not have changed yet")
+	}
+	if err := os.Mkdir(filepath.Join(cgroup2Root, "db"), 0o0755); err != nil {
+		t.Fatal(err)
+	}
+	if !cgroupScopeChanged() {
+		t.Error("created cgroup should be detected")
+	}
+	buildRules()
+	if !containsRule(v4rules, "mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -m cgroup --path db -j NFQUEUE --queue-num 17040 --queue-bypass") {
+		t.Error("rebuilt rules should match created cgroup")
+	}
+
+	// Stopping a container removes its cgroup.
+	if err := os.Remove(filepath.Join(cgroup2Root, "web")); err != nil {
+		t.Fatal(err)
+	}
+	if !cgroupScopeChanged() {
+		t.Error("removed cgroup should be detected")
+	}
+
+	// An empty scope intercepts everything.
+	if err := setCgroupScope(CgroupScope{}); err != nil {
+		t.Fatal(err)
+	}
+	buildRules()
+	if !containsRule(v4rules, "mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -j NFQUEUE --queue-num 17040 --queue-bypass") {
+		t.Error("empty scope should intercept all traffic")
+	}
+}
+
+func containsRule(rules []string, rule string) bool {
+	for _, r := range rules {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,273 @@
+package interception
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/firewall/interception/nfq"
+	"github.com/safing/portmaster/netenv"
+)
+
+const (
+	// portmasterChainPrefix is the prefix of all chains of the Portmaster, in
+	// all versions. All Portmaster rules are either in these chains or in the
+	// chains of the system, where they are marked with portmasterRuleComment.
+	portmasterChainPrefix = "PORTMASTER-"
+
+	// portmasterRuleComment is the comment that marks the Portmaster rules in
+	// the chains of the system. Rules of previous versions are not marked and
+	// are identified by jumping to a Portmaster chain instead.
+	portmasterRuleComment = "portmaster"
+)
+
+// cleanupTables are the iptables tables that the Portmaster installs rules in.
+var cleanupTables = []string{"mangle", "filter", "nat"}
+
+// Stale Rules Policies.
+const (
+	// StaleRulesCleanAndReinstall removes the rules of a previous run on start
+	// and then installs fresh rules.
+	StaleRulesCleanAndReinstall = "clean-and-reinstall"
+	// StaleRulesFail refuses to start if rules of a previous run are still
+	// installed, so that they can be inspected and removed manually, eg. with
+	// the --cleanup-stale-rules flag.
+	StaleRulesFail = "fail"
+)
+
+// staleRulesPolicy defines what is done on start if rules of a previous run
+// are still installed.
+var staleRulesPolicy string
+
+func init() {
+	flag.StringVar(&staleRulesPolicy, "nfqueue-stale-rules", StaleRulesCleanAndReinstall, "what to do on start if rules of a previous run are still installed: clean-and-reinstall or fail")
+}
+
+// handleStaleRules detects rules left behind by a previous run that did not
+// shut down cleanly and handles them according to the given policy. With
+// StaleRulesCleanAndReinstall, cleanup is called in any case, as it also
+// removes stale verdict marks, which cannot be detected. Failing to clean up
+// is not fatal, as the rules are installed idempotently. With StaleRulesFail,
+// the start also fails if the rules cannot be checked.
+func handleStaleRules(policy string, cleanup func() error) error {
+	switch policy {
+	case StaleRulesCleanAndReinstall, StaleRulesFail:
+	default:
+		return fmt.Errorf("invalid stale rules policy %q, must be %s or %s", policy, StaleRulesCleanAndReinstall, StaleRulesFail)
+	}
+
+	stale, err := findStaleRules()
+	switch {
+	case err != nil && policy == StaleRulesFail:
+		// Stale rules cannot be ruled out, so refuse to start as configured.
+		log.Errorf("interception: failed to check for stale rules, refusing to start as configured: %s", err)
+		return fmt.Errorf("failed to check for rules of a previous run: %w", err)
+	case err != nil:
+		log.Warningf("interception: failed to check for stale rules: %s", err)
+	}
+
+	switch {
+	case len(stale) > 0 && policy == StaleRulesFail:
+		log.Errorf("interception: found %d stale rules and chains of a previous run, refusing to start as configured", len(stale))
+		return fmt.Errorf("%d rules and chains of a previous run are still installed, such as %q; remove them with --cleanup-stale-rules", len(stale), stale[0])
+	case len(stale) > 0:
+		log.Warningf("interception: found %d stale rules and chains of a previous run, removing them before installing fresh rules", len(stale))
+	default:
+		log.Debugf("interception: found no stale rules, installing fresh rules")
+	}
+
+	if policy == StaleRulesCleanAndReinstall {
+		if err := cleanup(); err != nil {
+			log.Warningf("interception: failed to clean up stale rules: %s", err)
+		}
+	}
+	return nil
+}
+
+// findStaleRules returns all Portmaster chains and all Portmaster rules in the
+// chains of the system, which must not exist before the interception installs
+// its rules.
+// Chains are returned as "<protocol> <table> <chain>" and rules as
+// "<protocol> <table> <rule>", with the rule as returned by iptables -S.
+func findStaleRules() ([]string, error) {
+	var stale []string
+	var result *multierror.Error
+
+	protocols := []iptables.Protocol{iptables.ProtocolIPv4}
+	if netenv.IPv6Enabled() {
+		protocols = append(protocols, iptables.ProtocolIPv6)
+	}
+	for _, protocol := range protocols {
+		tbls, err := newIPTables(protocol)
+		if err != nil {
+			result = multierror.Append(result, fmt.Errorf("%s: %w", protocolName(protocol), err))
+			continue
+		}
+
+		for _, table := range cleanupTables {
+			chains, err := tbls.ListChains(table)
+			if err != nil {
+				result = multierror.Append(result, fmt.Errorf("%s: %w", protocolName(protocol), err))
+				continue
+			}
+			sort.Strings(chains)
+
+			for _, chain := range chains {
+				if strings.HasPrefix(chain, portmasterChainPrefix) {
+					stale = append(stale, protocolName(protocol)+" "+table+" "+chain)
+					continue
+				}
+
+				rules, err := tbls.List(table, chain)
+				if err != nil {
+					result = multierror.Append(result, fmt.Errorf("%s: %w", protocolName(protocol), err))
+					continue
+				}
+				for _, rule := range rules {
+					if _, ok := portmasterRule(rule); ok {
+						stale = append(stale, protocolName(protocol)+" "+table+" "+rule)
+					}
+				}
+			}
+		}
+	}
+
+	return stale, result.ErrorOrNil()
+}
+
+// cleanupStaleRules removes all Portmaster rules and chains, including the
+// ones of previous runs and versions, and clears all conntrack entries with
+// Portmaster verdict marks. It must not be called while the interception is
+// active.
+func cleanupStaleRules() error {
+	if nfqueueActive.IsSet() {
+		return errors.New("nfqueue interception is active")
+	}
+
+	var result *multierror.Error
+	if err := cleanupStaleIPTables(iptables.ProtocolIPv4); err != nil {
+		result = multierror.Append(result, fmt.Errorf("ipv4: %w", err))
+	}
+	if netenv.IPv6Enabled() {
+		if err := cleanupStaleIPTables(iptables.ProtocolIPv6); err != nil {
+			result = multierror.Append(result, fmt.Errorf("ipv6: %w", err))
+		}
+	}
+	if err := nfq.DeleteAllMarkedConnection(); err != nil {
+		result = multierror.Append(result, fmt.Errorf("failed to clear marked conntrack entries: %w", err))
+	}
+
+	return result.ErrorOrNil()
+}
+
+// cleanupStaleIPTables removes all Portmaster rules from the chains of the
+// system and then all Portmaster chains. Other rules and chains are never
+// touched.
+func cleanupStaleIPTables(protocol iptables.Protocol) error {
+	tbls, err := openIPTables(protocol)
+	if err != nil {
+		return err
+	}
+
+	var multierr *multierror.Error
+	var removed int
+	for _, table := range cleanupTables {
+		chains, err := tbls.ListChains(table)
+		if err != nil {
+			multierr = multierror.Append(multierr, err)
+			continue
+		}
+
+		// Unhook the Portmaster chains from all other chains.
+		var pmChains []string
+		for _, chain := range chains {
+			if strings.HasPrefix(chain, portmasterChainPrefix) {
+				pmChains = append(pmChains, chain)
+				continue
+			}
+
+			rules, err := tbls.List(table, chain)
+			if err != nil {
+				multierr = multierror.Append(multierr, err)
+				continue
+			}
+			for _, rule := range rules {
+				rulespec, ok := portmasterRule(rule)
+				if !ok {
+					continue
+				}
+				if err := tbls.Delete(table, chain, rulespec...); err != nil {
+					multierr = multierror.Append(multierr, err)
+					continue
+				}
+				removed++
+			}
+		}
+
+		// Clear all Portmaster chains before deleting them, as they might
+		// reference each other.
+		for _, chain := range pmChains {
+			if err := tbls.ClearChain(table, chain); err != nil {
+				multierr = multierror.Append(multierr, err)
+			}
+		}
+		for _, chain := range pmChains {
+			if err := tbls.DeleteChain(table, chain); err != nil {
+				multierr = multierror.Append(multierr, err)
+				continue
+			}
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		log.Infof("interception: removed %d stale rules and chains", removed)
+	}
+	return multierr.ErrorOrNil()
+}
+
+// withRuleComment returns the rules marked with the Portmaster rule comment.
+// The jump target stays the last part of the rules.
+func withRuleComment(rules []string) []string {
+	marked := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		match, target, ok := strings.Cut(rule, " -j ")
+		if !ok {
+			marked = append(marked, rule)
+			continue
+		}
+		marked = append(marked, match+" -m comment --comment "+portmasterRuleComment+" -j "+target)
+	}
+	return marked
+}
+
+// portmasterRule parses a rule as returned by iptables -S and returns its
+// rule specification, if it is a Portmaster rule: It is either marked with
+// the Portmaster rule comment or jumps to a Portmaster chain.
+func portmasterRule(rule string) (rulespec []string, ok bool) {
+	fields := strings.Fields(rule)
+	if len(fields) < 4 || fields[0] != "-A" {
+		return nil, false
+	}
+	rulespec = fields[2:]
+
+	for i := 0; i < len(rulespec)-1; i++ {
+		switch rulespec[i] {
+		case "--comment":
+			if strings.Trim(rulespec[i+1], `"`) == portmasterRuleComment {
+				return rulespec, true
+			}
+		case "-j", "--jump", "-g", "--goto":
+			if strings.HasPrefix(rulespec[i+1], portmasterChainPrefix) {
+				return rulespec, true
+			}
+		}
+	}
+	return nil, false
+}
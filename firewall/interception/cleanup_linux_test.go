@@ -0,0 +1,167 @@
+package interception
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+func TestCleanupStaleIPTables(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	opLog := setupShutdownTest(t, false)
+
+	tbls, err := newIPTables(iptables.ProtocolIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := tbls.(*fakeIPTables) //nolint:forcetypeassert // Set up by setupShutdownTest.
+
+	// Add rules of the user and leftovers of a previous run with another
+	// configuration and of an interrupted rebuild.
+	userRules := []string{
+		"filter INPUT -p tcp --dport 22 -j ACCEPT",
+		"filter OUTPUT -m comment --comment PORTMASTER-like -j ACCEPT",
+		"nat PREROUTING -p tcp --dport 80 -j REDIRECT --to-ports 8080",
+	}
+	for _, rule := range userRules {
+		fake.rules[rule] = true
+	}
+	fake.rules["mangle PREROUTING -j PORTMASTER-INGEST-INPUT"] = true
+	fake.rules["filter OUTPUT -j PORTMASTER-FILTER-NEW"] = true
+	fake.rules["filter PORTMASTER-FILTER-NEW -m mark --mark 0 -j DROP"] = true
+	// Marked rules are removed, even if they do not jump to a Portmaster chain.
+	fake.rules["filter OUTPUT -m comment --comment "+portmasterRuleComment+" -j ACCEPT"] = true
+
+	if err := cleanupStaleIPTables(iptables.ProtocolIPv4); err != nil {
+		t.Fatal(err)
+	}
+
+	for rule := range fake.rules {
+		if strings.Contains(rule, "-j "+portmasterChainPrefix) ||
+			strings.Contains(rule, "--comment "+portmasterRuleComment+" ") ||
+			strings.HasPrefix(strings.Split(rule, " ")[1], portmasterChainPrefix) {
+			t.Errorf("rule %q should have been removed", rule)
+		}
+	}
+	for _, rule := range userRules {
+		if !fake.rules[rule] {
+			t.Errorf("user rule %q must not be removed", rule)
+		}
+	}
+	for _, op := range []string{
+		"deletechain mangle PORTMASTER-INGEST-OUTPUT",
+		"deletechain filter PORTMASTER-FILTER",
+		"deletechain filter PORTMASTER-FILTER-NEW",
+		"deletechain nat PORTMASTER-REDIRECT",
+	} {
+		if firstOpIndex(opLog.ops, op) < 0 {
+			t.Errorf("expected operation %q, got %v", op, opLog.ops)
+		}
+	}
+
+	// Cleaning up again must not change anything.
+	opLog.ops = nil
+	if err := cleanupStaleIPTables(iptables.ProtocolIPv4); err != nil {
+		t.Fatal(err)
+	}
+	if len(opLog.ops) > 0 {
+		t.Errorf("expected no operations on second cleanup, got %v", opLog.ops)
+	}
+	if len(fake.rules) != len(userRules) {
+		t.Errorf("expected only user rules to remain, got %v", fake.rules)
+	}
+}
+
+func TestHandleStaleRules(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	setupShutdownTest(t, false)
+
+	// The rules of the previous run are detected by their chain prefix.
+	stale, err := findStaleRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) == 0 {
+		t.Fatal("installed rules should be detected as stale")
+	}
+	for _, entry := range stale {
+		if !strings.Contains(entry, portmasterChainPrefix) {
+			t.Errorf("unexpected stale entry %q", entry)
+		}
+	}
+
+	var cleanups int
+	cleanup := func() error {
+		cleanups++
+		if err := cleanupStaleIPTables(iptables.ProtocolIPv4); err != nil {
+			return err
+		}
+		return cleanupStaleIPTables(iptables.ProtocolIPv6)
+	}
+
+	if err := handleStaleRules("keep", cleanup); err == nil {
+		t.Error("invalid policy should be rejected")
+	}
+
+	// Refuse to start and leave the rules for manual cleanup.
+	if err := handleStaleRules(StaleRulesFail, cleanup); err == nil {
+		t.Error("stale rules should fail the start")
+	}
+	if cleanups != 0 {
+		t.Error("stale rules must not be removed with the fail policy")
+	}
+	if remaining, _ := findStaleRules(); len(remaining) != len(stale) {
+		t.Errorf("stale rules must be kept, got %v", remaining)
+	}
+
+	// Remove the stale rules and install them again without duplicates.
+	if err := handleStaleRules(StaleRulesCleanAndReinstall, cleanup); err != nil {
+		t.Fatal(err)
+	}
+	if remaining, _ := findStaleRules(); len(remaining) != 0 {
+		t.Errorf("stale rules should have been removed, got %v", remaining)
+	}
+	if err := activateNfqueueFirewall(); err != nil {
+		t.Fatal(err)
+	}
+	reinstalled, err := findStaleRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool, len(reinstalled))
+	for _, entry := range reinstalled {
+		if seen[entry] {
+			t.Errorf("duplicate rule %q after reinstalling", entry)
+		}
+		seen[entry] = true
+	}
+	if len(reinstalled) != len(stale) {
+		t.Errorf("expected the %d original rules and chains after reinstalling, got %v", len(stale), reinstalled)
+	}
+
+	// Without stale rules, the fail policy starts.
+	if err := cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := handleStaleRules(StaleRulesFail, cleanup); err != nil {
+		t.Errorf("start without stale rules should not fail: %s", err)
+	}
+
+	// If the rules cannot be checked, the fail policy refuses to start.
+	newIPTables = func(iptables.Protocol) (ipTables, error) {
+		return nil, errors.New("test error")
+	}
+	cleanups = 0
+	if err := handleStaleRules(StaleRulesFail, cleanup); err == nil {
+		t.Error("failed check for stale rules should fail the start")
+	}
+	if cleanups != 0 {
+		t.Error("rules must not be removed with the fail policy")
+	}
+	if err := handleStaleRules(StaleRulesCleanAndReinstall, func() error {
+		cleanups++
+		return nil
+	}); err != nil || cleanups != 1 {
+		t.Errorf("failed check for stale rules should clean up and start, got %v after %d cleanups", err, cleanups)
+	}
+}
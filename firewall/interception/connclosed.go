@@ -0,0 +1,215 @@
+package interception
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// connectionClosedSweepInterval defines how often the tracked connections are
+// reconciled while the conntrack event subscription is not available, and how
+// often the subscription is retried.
+const connectionClosedSweepInterval = 30 * time.Second
+
+// connectionEventSource delivers the connections that are not tracked by the
+// OS anymore.
+type connectionEventSource interface {
+	// subscribe calls fn for every connection that is not tracked anymore,
+	// until the context is canceled. If the subscription fails, the error is
+	// sent to the returned channel and the subscription ends.
+	subscribe(ctx context.Context, fn func(tuple *packet.ConntrackTuple)) (<-chan error, error)
+	// trackedFlows returns the tuples of all connections that are currently
+	// tracked.
+	trackedFlows() ([]*packet.ConntrackTuple, error)
+}
+
+var (
+	connectionClosedHandlers     []func(connKey string)
+	connectionClosedHandlersLock sync.RWMutex
+
+	openConnections     func() []string
+	openConnectionsLock sync.Mutex
+
+	connectionClosedWatcherLock   sync.Mutex
+	connectionClosedWatcherCancel context.CancelFunc
+)
+
+// RegisterConnectionClosedHandler registers fn to be called when the OS stops
+// tracking a connection, such as when it was closed or timed out, so that
+// state kept for the connection can be released promptly. As the OS does not
+// know the direction of a connection, fn is called with both of its possible
+// connection IDs, see packet.Packet.GetConnectionID, and must ignore unknown
+// ones. fn may be called more than once for a connection and must not block.
+// Closed connections are only reported on Linux.
+func RegisterConnectionClosedHandler(fn func(connKey string)) {
+	connectionClosedHandlersLock.Lock()
+	defer connectionClosedHandlersLock.Unlock()
+
+	connectionClosedHandlers = append(connectionClosedHandlers, fn)
+}
+
+// SetOpenConnectionsSource sets the function that returns the IDs of the
+// connections that are considered open. If receiving the events of closed
+// connections from the OS fails, such as when the OS dropped events that
+// were not received in time, these connections are regularly reconciled with
+// the connections tracked by the OS instead, until the events are received
+// again. Open connections that are not tracked anymore are then reported to
+// the handlers registered with RegisterConnectionClosedHandler.
+func SetOpenConnectionsSource(fn func() []string) {
+	openConnectionsLock.Lock()
+	defer openConnectionsLock.Unlock()
+
+	openConnections = fn
+}
+
+func getOpenConnections() []string {
+	openConnectionsLock.Lock()
+	fn := openConnections
+	openConnectionsLock.Unlock()
+
+	if fn == nil {
+		return nil
+	}
+	return fn()
+}
+
+// dispatchConnectionClosed calls the handlers with the given connection ID.
+func dispatchConnectionClosed(connKey string) {
+	connectionClosedHandlersLock.RLock()
+	defer connectionClosedHandlersLock.RUnlock()
+
+	for _, fn := range connectionClosedHandlers {
+		fn(connKey)
+	}
+}
+
+// startConnectionClosedWatcher starts reporting closed connections in the
+// background, if supported on this platform.
+func startConnectionClosedWatcher() {
+	source := newConnectionEventSource()
+	if source == nil {
+		return
+	}
+
+	connectionClosedWatcherLock.Lock()
+	defer connectionClosedWatcherLock.Unlock()
+
+	if connectionClosedWatcherCancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	connectionClosedWatcherCancel = cancel
+	w := &connectionClosedWatcher{
+		source:        source,
+		openKeys:      getOpenConnections,
+		dispatch:      dispatchConnectionClosed,
+		sweepInterval: connectionClosedSweepInterval,
+	}
+	go w.run(ctx)
+}
+
+// stopConnectionClosedWatcher stops reporting closed connections.
+func stopConnectionClosedWatcher() {
+	connectionClosedWatcherLock.Lock()
+	defer connectionClosedWatcherLock.Unlock()
+
+	if connectionClosedWatcherCancel != nil {
+		connectionClosedWatcherCancel()
+		connectionClosedWatcherCancel = nil
+	}
+}
+
+// connectionClosedWatcher reports closed connections from the events of the
+// source and falls back to regularly reconciling the open connections with
+// the tracked connections while the events are not available.
+type connectionClosedWatcher struct {
+	source        connectionEventSource
+	openKeys      func() []string
+	dispatch      func(connKey string)
+	sweepInterval time.Duration
+
+	// swept holds the connection IDs that were reported by the last sweep, so
+	// that they are not reported again.
+	swept map[string]struct{}
+}
+
+func (w *connectionClosedWatcher) run(ctx context.Context) {
+	var degraded bool
+	for {
+		errs, err := w.source.subscribe(ctx, w.dispatchTuple)
+		if err != nil {
+			if !degraded {
+				log.Warningf("interception: failed to subscribe to closed connections, reconciling every %s instead: %s", w.sweepInterval, err)
+			}
+			degraded = true
+		} else {
+			if degraded {
+				log.Info("interception: receiving closed connections again")
+			}
+			degraded = false
+
+			// Report the connections that were closed while not subscribed.
+			w.sweep()
+			select {
+			case <-ctx.Done():
+				return
+			case err := <-errs:
+				log.Warningf("interception: lost events of closed connections, reconciling every %s until resubscribed: %s", w.sweepInterval, err)
+			}
+			degraded = true
+			w.sweep()
+		}
+
+		// Retry subscribing after the sweep interval.
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.sweepInterval):
+		}
+		w.sweep()
+	}
+}
+
+// dispatchTuple reports both possible connection IDs of the connection
+// described by the tuple.
+func (w *connectionClosedWatcher) dispatchTuple(tuple *packet.ConntrackTuple) {
+	outbound, inbound := tuple.ConnectionIDs()
+	w.dispatch(outbound)
+	w.dispatch(inbound)
+}
+
+// sweep reports the open connections that are not tracked anymore.
+func (w *connectionClosedWatcher) sweep() {
+	open := w.openKeys()
+	if len(open) == 0 {
+		w.swept = nil
+		return
+	}
+	flows, err := w.source.trackedFlows()
+	if err != nil {
+		log.Debugf("interception: failed to get tracked connections for reconciling closed connections: %s", err)
+		return
+	}
+
+	tracked := make(map[string]struct{}, 2*len(flows))
+	for _, tuple := range flows {
+		outbound, inbound := tuple.ConnectionIDs()
+		tracked[outbound] = struct{}{}
+		tracked[inbound] = struct{}{}
+	}
+
+	swept := make(map[string]struct{})
+	for _, connKey := range open {
+		if _, ok := tracked[connKey]; ok {
+			continue
+		}
+		swept[connKey] = struct{}{}
+		if _, reported := w.swept[connKey]; !reported {
+			w.dispatch(connKey)
+		}
+	}
+	w.swept = swept
+}
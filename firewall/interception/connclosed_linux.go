@@ -0,0 +1,24 @@
+package interception
+
+import (
+	"context"
+
+	"github.com/safing/portmaster/firewall/interception/nfq"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// conntrackEventSource delivers the connections removed from the conntrack
+// table.
+type conntrackEventSource struct{}
+
+func newConnectionEventSource() connectionEventSource {
+	return conntrackEventSource{}
+}
+
+func (conntrackEventSource) subscribe(ctx context.Context, fn func(tuple *packet.ConntrackTuple)) (<-chan error, error) {
+	return nfq.SubscribeDestroyedConnections(ctx, fn)
+}
+
+func (conntrackEventSource) trackedFlows() ([]*packet.ConntrackTuple, error) {
+	return nfq.TrackedFlows()
+}
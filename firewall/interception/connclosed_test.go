@@ -0,0 +1,217 @@
+package interception
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/safing/portmaster/network/packet"
+)
+
+// mockConnectionEventSource simulates the conntrack event subscription and
+// the tracked connections.
+type mockConnectionEventSource struct {
+	lock sync.Mutex
+
+	fn      func(tuple *packet.ConntrackTuple)
+	errs    chan error
+	flows   []*packet.ConntrackTuple
+	failing bool
+
+	subscribed chan struct{}
+}
+
+func newMockConnectionEventSource() *mockConnectionEventSource {
+	return &mockConnectionEventSource{
+		subscribed: make(chan struct{}, 10),
+	}
+}
+
+func (m *mockConnectionEventSource) subscribe(_ context.Context, fn func(tuple *packet.ConntrackTuple)) (<-chan error, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.failing {
+		return nil, errors.New("subscribing failed")
+	}
+	m.fn = fn
+	m.errs = make(chan error, 1)
+	m.subscribed <- struct{}{}
+	return m.errs, nil
+}
+
+func (m *mockConnectionEventSource) trackedFlows() ([]*packet.ConntrackTuple, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.flows, nil
+}
+
+// destroy removes the connection and sends its event.
+func (m *mockConnectionEventSource) destroy(tuple *packet.ConntrackTuple) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.untrack(tuple)
+	m.fn(tuple)
+}
+
+// overrun removes the connection without sending its event and ends the
+// subscription, like after a buffer overrun.
+func (m *mockConnectionEventSource) overrun(tuple *packet.ConntrackTuple) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.untrack(tuple)
+	m.failing = true
+	m.errs <- errors.New("no buffer space available")
+}
+
+func (m *mockConnectionEventSource) untrack(tuple *packet.ConntrackTuple) {
+	for i, flow := range m.flows {
+		if flow == tuple {
+			m.flows = append(m.flows[:i], m.flows[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *mockConnectionEventSource) recover() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.failing = false
+}
+
+// closedRecorder records the reported connection IDs.
+type closedRecorder struct {
+	lock   sync.Mutex
+	closed []string
+	notify chan struct{}
+}
+
+func (r *closedRecorder) dispatch(connKey string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.closed = append(r.closed, connKey)
+	r.notify <- struct{}{}
+}
+
+func (r *closedRecorder) wait(t *testing.T, n int) []string {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.notify:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %d closed connections", n)
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	closed := r.closed
+	r.closed = nil
+	sort.Strings(closed)
+	return closed
+}
+
+func TestConnectionClosedWatcher(t *testing.T) {
+	t.Parallel()
+
+	tuple := func(port uint16) *packet.ConntrackTuple {
+		return &packet.ConntrackTuple{
+			Protocol: packet.TCP,
+			Src:      net.IPv4(10, 0, 0, 1),
+			SrcPort:  port,
+			Dst:      net.IPv4(1, 1, 1, 1),
+			DstPort:  443,
+		}
+	}
+	first, second := tuple(40001), tuple(40002)
+	firstOut, firstIn := first.ConnectionIDs()
+	secondOut, _ := second.ConnectionIDs()
+
+	source := newMockConnectionEventSource()
+	source.flows = []*packet.ConntrackTuple{first, second}
+	recorder := &closedRecorder{notify: make(chan struct{}, 10)}
+	var open []string
+	var openLock sync.Mutex
+	w := &connectionClosedWatcher{
+		source: source,
+		openKeys: func() []string {
+			openLock.Lock()
+			defer openLock.Unlock()
+			return open
+		},
+		dispatch:      recorder.dispatch,
+		sweepInterval: 50 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.run(ctx)
+	<-source.subscribed
+
+	// Destroy events report both possible IDs.
+	source.destroy(first)
+	closed := recorder.wait(t, 2)
+	expected := []string{firstOut, firstIn}
+	sort.Strings(expected)
+	if len(closed) != 2 || closed[0] != expected[0] || closed[1] != expected[1] {
+		t.Errorf("unexpected closed connections %v, expected %v", closed, expected)
+	}
+
+	// After an overrun, the lost event is reconciled with the open
+	// connections, and reported only once.
+	openLock.Lock()
+	open = []string{secondOut}
+	openLock.Unlock()
+	source.overrun(second)
+	if closed := recorder.wait(t, 1); len(closed) != 1 || closed[0] != secondOut {
+		t.Errorf("unexpected reconciled connections %v", closed)
+	}
+	time.Sleep(3 * w.sweepInterval)
+	select {
+	case <-recorder.notify:
+		t.Error("reconciled connection must only be reported once")
+	default:
+	}
+
+	// The subscription is retried until it succeeds.
+	source.recover()
+	select {
+	case <-source.subscribed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher did not resubscribe")
+	}
+	third := tuple(40003)
+	source.destroy(third)
+	if closed := recorder.wait(t, 2); len(closed) != 2 {
+		t.Errorf("unexpected closed connections after resubscribing %v", closed)
+	}
+}
+
+func TestRegisterConnectionClosedHandler(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func(handlers []func(string)) {
+		connectionClosedHandlers = handlers
+	}(connectionClosedHandlers)
+
+	var closed []string
+	RegisterConnectionClosedHandler(func(connKey string) {
+		closed = append(closed, "a:"+connKey)
+	})
+	RegisterConnectionClosedHandler(func(connKey string) {
+		closed = append(closed, "b:"+connKey)
+	})
+
+	dispatchConnectionClosed("conn")
+	if len(closed) != 2 || closed[0] != "a:conn" || closed[1] != "b:conn" {
+		t.Errorf("unexpected handler calls %v", closed)
+	}
+}
@@ -0,0 +1,398 @@
+package interception
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/firewall/interception/nfq"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// Copy ranges define how much of the packets of a protocol and port is copied
+// to userspace, as different inspections need different amounts of data:
+// DNS needs the full payload, TLS SNI only the start of the ClientHello and
+// bulk traffic only the headers.
+//
+// Nfqueue only supports setting the copy range per queue. Every distinct
+// configured copy range thus gets its own pair of queues per IP version.
+// Packets are routed to them by rules that are placed before the rule of the
+// general queue of the ingest chain, with the most specific rules first.
+// Packets of ports are matched by both their source and destination port, so
+// that both directions of a connection are copied the same way. Configured
+// copy ranges that equal the copy range of the general queues route to the
+// general queues, so that they are not copied by a less specific copy range.
+// If the general queues only copy the headers, the DHCP ports are copied fully
+// unless configured otherwise, as DHCP packets are recognized by their payload.
+// Connections that requested full copies, see RequestFullCopy, are not
+// affected, as their rules are placed before all other rules.
+//
+// As connections with a permanent verdict do not reach any queue anymore, the
+// copy ranges only apply to the packets that are inspected until a verdict is
+// made permanent.
+const (
+	// copyRangeQueueOffset is the offset of the queue number of the first
+	// copy range queue from the number of the general queue.
+	copyRangeQueueOffset = 2
+	// maxCopyRangeQueues is the maximum amount of distinct copy ranges, as
+	// every copy range requires its own queues.
+	maxCopyRangeQueues = 4
+)
+
+var (
+	copyRangesFlag string
+
+	// copyRanges holds the configured copy ranges, most specific first.
+	copyRanges []copyRange
+	// copyRangeLengths holds the distinct lengths of the configured copy
+	// ranges that have their own queues, in order of their queues.
+	copyRangeLengths []uint32
+
+	copyRangeQueues  []*copyRangeQueue
+	copyRangePackets = make(chan packet.Packet, 1000)
+)
+
+func init() {
+	flag.StringVar(
+		&copyRangesFlag,
+		"nfqueue-copy-ranges",
+		"",
+		"comma separated list of protocol[/port]=length entries (eg. udp/53=full,tcp/443=1024,tcp=0) to set how much of the packets to copy to userspace; a length of 0 only copies the headers",
+	)
+}
+
+// copyRange is the copy range of the packets of a protocol and port.
+type copyRange struct {
+	protocol uint8
+	// port matches packets with this source or destination port. It matches
+	// all packets of the protocol if 0.
+	port   uint16
+	length uint32
+}
+
+// copyRangeQueue is a queue that receives the packets of a copy range.
+type copyRangeQueue struct {
+	number    uint16
+	ipVersion uint8
+	inbound   bool
+	length    uint32
+	queue     nfQueue
+}
+
+// loadCopyRangeFlags sets the copy ranges as configured by flags.
+func loadCopyRangeFlags() error {
+	ranges, err := parseCopyRanges(copyRangesFlag)
+	if err != nil {
+		return err
+	}
+	ranges = withDHCPCopyRanges(ranges, generalCopyRange())
+	lengths, err := copyRangeQueueLengths(ranges, generalCopyRange())
+	if err != nil {
+		return err
+	}
+
+	copyRanges = ranges
+	copyRangeLengths = lengths
+	copyRangeQueues = nil
+	if len(ranges) > 0 {
+		log.Infof("interception: using %d copy ranges with %d additional queue pairs", len(ranges), len(lengths))
+	}
+	return nil
+}
+
+// parseCopyRanges parses a list of copy ranges and returns them ordered from
+// most to least specific.
+func parseCopyRanges(value string) ([]copyRange, error) {
+	var ranges []copyRange
+	seen := make(map[string]struct{})
+	for _, entry := range splitFlagList(value) {
+		match, lengthValue, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid copy range %q, must be protocol[/port]=length", entry)
+		}
+
+		var cr copyRange
+		protocolValue, portValue, hasPort := strings.Cut(strings.TrimSpace(match), "/")
+		protocol, err := parseIPProtocol(protocolValue)
+		if err != nil {
+			return nil, err
+		}
+		if protocol == 0 {
+			return nil, fmt.Errorf("invalid copy range %q: invalid IP protocol 0", entry)
+		}
+		cr.protocol = protocol
+
+		if hasPort {
+			if protocol != uint8(packet.TCP) && protocol != uint8(packet.UDP) {
+				return nil, fmt.Errorf("invalid copy range %q: ports are only supported for tcp and udp", entry)
+			}
+			port, err := strconv.ParseUint(portValue, 10, 16)
+			if err != nil || port == 0 {
+				return nil, fmt.Errorf("invalid copy range %q: invalid port %q", entry, portValue)
+			}
+			cr.port = uint16(port)
+		}
+
+		cr.length, err = parseCopyRangeLength(strings.TrimSpace(lengthValue))
+		if err != nil {
+			return nil, fmt.Errorf("invalid copy range %q: %w", entry, err)
+		}
+
+		key := fmt.Sprintf("%d/%d", cr.protocol, cr.port)
+		if _, ok := seen[key]; ok {
+			return nil, fmt.Errorf("duplicate copy range %q", entry)
+		}
+		seen[key] = struct{}{}
+		ranges = append(ranges, cr)
+	}
+
+	sortCopyRanges(ranges)
+	return ranges, nil
+}
+
+// dhcpPorts are the ports of DHCP and DHCPv6, whose packets are only permitted
+// by the firewall if their payload is recognized as a DHCP message.
+var dhcpPorts = []uint16{67, 68, 546, 547}
+
+// withDHCPCopyRanges returns the copy ranges with full copy ranges for the
+// DHCP ports added, if the general queues do not copy full packets. Copy
+// ranges configured for these ports are kept.
+func withDHCPCopyRanges(ranges []copyRange, generalLength uint32) []copyRange {
+	if generalLength == nfq.FullCopyRange {
+		return ranges
+	}
+
+	configured := make(map[uint16]struct{})
+	for _, cr := range ranges {
+		if cr.protocol == uint8(packet.UDP) && cr.port != 0 {
+			configured[cr.port] = struct{}{}
+		}
+	}
+	for _, port := range dhcpPorts {
+		if _, ok := configured[port]; ok {
+			continue
+		}
+		ranges = append(ranges, copyRange{
+			protocol: uint8(packet.UDP),
+			port:     port,
+			length:   nfq.FullCopyRange,
+		})
+	}
+
+	sortCopyRanges(ranges)
+	return ranges
+}
+
+// sortCopyRanges sorts the copy ranges with the most specific first.
+func sortCopyRanges(ranges []copyRange) {
+	sort.Slice(ranges, func(i, j int) bool {
+		if (ranges[i].port != 0) != (ranges[j].port != 0) {
+			return ranges[i].port != 0
+		}
+		if ranges[i].protocol != ranges[j].protocol {
+			return ranges[i].protocol < ranges[j].protocol
+		}
+		return ranges[i].port < ranges[j].port
+	})
+}
+
+// parseCopyRangeLength parses the length of a copy range. A length of 0 and
+// "headers" only copy the headers, "full" copies complete packets. Other
+// lengths must be large enough to hold the headers, see nfq.HeaderCopyRange.
+func parseCopyRangeLength(value string) (uint32, error) {
+	switch strings.ToLower(value) {
+	case "0", "headers":
+		return nfq.HeaderCopyRange, nil
+	case "full":
+		return nfq.FullCopyRange, nil
+	}
+
+	length, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid length %q", value)
+	}
+	if length < nfq.HeaderCopyRange {
+		return 0, fmt.Errorf("length %d is too small to hold the headers, must be at least %d or 0", length, nfq.HeaderCopyRange)
+	}
+	return uint32(length), nil
+}
+
+// copyRangeQueueLengths returns the distinct lengths of the copy ranges that
+// need their own queues, as they differ from the copy range of the general
+// queues.
+func copyRangeQueueLengths(ranges []copyRange, generalLength uint32) ([]uint32, error) {
+	var lengths []uint32
+	seen := make(map[uint32]struct{})
+	for _, cr := range ranges {
+		if _, ok := seen[cr.length]; ok || cr.length == generalLength {
+			continue
+		}
+		seen[cr.length] = struct{}{}
+		lengths = append(lengths, cr.length)
+	}
+	if len(lengths) > maxCopyRangeQueues {
+		return nil, fmt.Errorf("too many distinct copy ranges, at most %d are supported", maxCopyRangeQueues)
+	}
+
+	sort.Slice(lengths, func(i, j int) bool { return lengths[i] < lengths[j] })
+	return lengths, nil
+}
+
+// copyRangeQueueNumber returns the number of the queue that receives the
+// packets with the given copy range instead of the given general queue.
+func copyRangeQueueNumber(generalQueue uint16, length uint32) uint16 {
+	for i, queueLength := range copyRangeLengths {
+		if queueLength == length {
+			return generalQueue + copyRangeQueueOffset + uint16(i)
+		}
+	}
+	return generalQueue
+}
+
+// lookupCopyRange returns the length of the most specific copy range that
+// applies to a packet with the given protocol and ports, like the rules built
+// by withCopyRanges. If no copy range applies, the general copy range is
+// returned.
+func lookupCopyRange(ranges []copyRange, generalLength uint32, protocol uint8, srcPort, dstPort uint16) uint32 {
+	for _, cr := range ranges {
+		if cr.protocol == protocol && (cr.port == 0 || cr.port == srcPort || cr.port == dstPort) {
+			return cr.length
+		}
+	}
+	return generalLength
+}
+
+// withCopyRanges returns the rules with the rules that route packets to the
+// copy range queues placed before the rules of the general queues. It must be
+// applied after all other changes to the queue rules, as these add rules that
+// accept packets right after the queue rules.
+func withCopyRanges(rules []string) []string {
+	if len(copyRanges) == 0 {
+		return rules
+	}
+
+	ranged := make([]string, 0, len(rules)+len(copyRanges)*2)
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule, "mangle PORTMASTER-INGEST-") {
+			ranged = append(ranged, rule)
+			continue
+		}
+		match, target, ok := strings.Cut(rule, " -j NFQUEUE ")
+		if !ok {
+			ranged = append(ranged, rule)
+			continue
+		}
+		var generalQueue uint16
+		if _, err := fmt.Sscanf(target, "--queue-num %d", &generalQueue); err != nil {
+			ranged = append(ranged, rule)
+			continue
+		}
+
+		// Queue rules are limited to one protocol if the interception is
+		// limited to some protocols, see withProtocolScope.
+		ruleProtocol := ruleProtocolMatch(match)
+		for _, cr := range copyRanges {
+			protocol := strconv.Itoa(int(cr.protocol))
+			rangeMatch := match
+			switch {
+			case ruleProtocol == "":
+				rangeMatch += " -p " + protocol
+			case ruleProtocol != protocol:
+				continue
+			}
+			if cr.port != 0 {
+				rangeMatch += fmt.Sprintf(" -m multiport --ports %d", cr.port)
+			}
+			ranged = append(ranged, fmt.Sprintf(
+				"%s -j NFQUEUE --queue-num %d --queue-bypass",
+				rangeMatch, copyRangeQueueNumber(generalQueue, cr.length),
+			))
+		}
+		ranged = append(ranged, rule)
+	}
+
+	return ranged
+}
+
+// ruleProtocolMatch returns the protocol the rule match is limited to, or an
+// empty string.
+func ruleProtocolMatch(match string) string {
+	fields := strings.Fields(match)
+	for i := 0; i < len(fields)-1; i++ {
+		if fields[i] == "-p" {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+// openCopyRangeQueues opens the queues of the copy ranges for the given
+// general queues.
+func openCopyRangeQueues(outQueue, inQueue uint16, v6 bool) error {
+	ipVersion := uint8(4)
+	if v6 {
+		ipVersion = 6
+	}
+
+	for _, length := range copyRangeLengths {
+		for _, generalQueue := range []uint16{outQueue, inQueue} {
+			crq := &copyRangeQueue{
+				number:    copyRangeQueueNumber(generalQueue, length),
+				ipVersion: ipVersion,
+				inbound:   generalQueue == inQueue,
+				length:    length,
+			}
+			q, err := nfq.New(crq.number, v6, length)
+			if err != nil {
+				return fmt.Errorf("nfqueue(IPv%d, copy range %d): %w", ipVersion, length, mapNfqueueError(err))
+			}
+			crq.queue = q
+			copyRangeQueues = append(copyRangeQueues, crq)
+		}
+	}
+	return nil
+}
+
+// handleCopyRangeQueues forwards the packets of the copy range queues to
+// copyRangePackets, which is read by handleInterception.
+func handleCopyRangeQueues() {
+	for _, crq := range copyRangeQueues {
+		go func(crq *copyRangeQueue) {
+			for {
+				select {
+				case <-shutdownSignal:
+					return
+				case pkt := <-crq.queue.PacketChannel():
+					if crq.inbound {
+						pkt.SetInbound()
+					} else {
+						pkt.SetOutbound()
+					}
+
+					select {
+					case copyRangePackets <- pkt:
+					case <-shutdownSignal:
+						return
+					}
+				}
+			}
+		}(crq)
+	}
+}
+
+// copyRangeQueueStates returns the state of the copy range queues.
+func copyRangeQueueStates() []QueueState {
+	states := make([]QueueState, 0, len(copyRangeQueues))
+	for _, crq := range copyRangeQueues {
+		states = append(states, QueueState{
+			Number:    crq.number,
+			IPVersion: crq.ipVersion,
+			Inbound:   crq.inbound,
+			CopyRange: crq.length,
+		})
+	}
+	return states
+}
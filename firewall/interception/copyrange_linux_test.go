@@ -0,0 +1,235 @@
+package interception
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/safing/portmaster/firewall/interception/nfq"
+	"github.com/safing/portmaster/network/packet"
+)
+
+func TestParseCopyRanges(t *testing.T) {
+	t.Parallel()
+
+	ranges, err := parseCopyRanges("tcp=0, udp/53=full, tcp/443=1024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []copyRange{
+		{protocol: 6, port: 443, length: 1024},
+		{protocol: 17, port: 53, length: nfq.FullCopyRange},
+		{protocol: 6, length: nfq.HeaderCopyRange},
+	}
+	if len(ranges) != len(expected) {
+		t.Fatalf("unexpected copy ranges %+v", ranges)
+	}
+	for i, cr := range ranges {
+		if cr != expected[i] {
+			t.Errorf("unexpected copy range %+v at %d, expected %+v", cr, i, expected[i])
+		}
+	}
+
+	for _, value := range []string{
+		"tcp",
+		"sctp=full",
+		"icmp/1=full",
+		"tcp/0=full",
+		"tcp/65536=full",
+		"tcp=100",
+		"tcp=65536",
+		"tcp=full,tcp=0",
+	} {
+		if _, err := parseCopyRanges(value); err == nil {
+			t.Errorf("invalid copy ranges %q should be rejected", value)
+		}
+	}
+
+	// Only copy ranges that differ from the general copy range need queues.
+	lengths, err := copyRangeQueueLengths(ranges, nfq.FullCopyRange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lengths) != 2 || lengths[0] != nfq.HeaderCopyRange || lengths[1] != 1024 {
+		t.Errorf("unexpected queue lengths %v", lengths)
+	}
+	tooMany, err := parseCopyRanges("tcp/1=300,tcp/2=400,tcp/3=500,tcp/4=600,tcp/5=700")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := copyRangeQueueLengths(tooMany, nfq.FullCopyRange); err == nil {
+		t.Error("too many distinct copy ranges should be rejected")
+	}
+}
+
+func TestCopyRangeRules(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func() {
+		copyRangesFlag = ""
+		_ = loadCopyRangeFlags()
+		_ = setInterceptedProtocols(nil)
+		buildRules()
+	}()
+
+	copyRangesFlag = "tcp=0,udp/53=full,tcp/443=1024"
+	if err := loadCopyRangeFlags(); err != nil {
+		t.Fatal(err)
+	}
+	buildRules()
+
+	// The most specific rules come first and copy ranges that equal the
+	// general copy range use the general queue.
+	expectedRules := []string{
+		"mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -p 6 -m multiport --ports 443 -j NFQUEUE --queue-num 17043 --queue-bypass",
+		"mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -p 17 -m multiport --ports 53 -j NFQUEUE --queue-num 17040 --queue-bypass",
+		"mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -p 6 -j NFQUEUE --queue-num 17042 --queue-bypass",
+		"mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -j NFQUEUE --queue-num 17040 --queue-bypass",
+	}
+	start := -1
+	for i, rule := range v4rules {
+		if rule == expectedRules[0] {
+			start = i
+			break
+		}
+	}
+	if start < 0 || start+len(expectedRules) > len(v4rules) {
+		t.Fatalf("missing copy range rules in %v", v4rules)
+	}
+	for i, expected := range expectedRules {
+		if v4rules[start+i] != expected {
+			t.Errorf("unexpected rule %q, expected %q", v4rules[start+i], expected)
+		}
+	}
+	if !containsRule(v4rules, "mangle PORTMASTER-INGEST-INPUT -m mark --mark 0 -p 6 -m multiport --ports 443 -j NFQUEUE --queue-num 17143 --queue-bypass") {
+		t.Error("missing inbound copy range rule")
+	}
+	if !containsRule(v6rules, "mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -p 6 -m multiport --ports 443 -j NFQUEUE --queue-num 17063 --queue-bypass") {
+		t.Error("missing IPv6 copy range rule")
+	}
+
+	// Copy ranges only apply to the queue rules of their protocol when the
+	// interception is limited to some protocols.
+	if err := setInterceptedProtocols([]uint8{6}); err != nil {
+		t.Fatal(err)
+	}
+	buildRules()
+	if !containsRule(v4rules, "mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -p 6 -m multiport --ports 443 -j NFQUEUE --queue-num 17043 --queue-bypass") {
+		t.Errorf("missing copy range rule with protocol scope in %v", v4rules)
+	}
+	for _, rule := range v4rules {
+		if strings.Contains(rule, " -p 6 -p ") || strings.Contains(rule, "--ports 53") {
+			t.Errorf("unexpected rule %q", rule)
+		}
+	}
+}
+
+func TestLookupCopyRange(t *testing.T) {
+	t.Parallel()
+
+	ranges, err := parseCopyRanges("tcp=0,udp/53=full,tcp/443=1024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		protocol uint8
+		srcPort  uint16
+		dstPort  uint16
+		expected uint32
+	}{
+		{6, 40000, 443, 1024},
+		{6, 443, 40000, 1024},
+		{6, 40000, 22, nfq.HeaderCopyRange},
+		{17, 40000, 53, nfq.FullCopyRange},
+		{17, 40000, 443, nfq.HeaderCopyRange + 1},
+	} {
+		length := lookupCopyRange(ranges, nfq.HeaderCopyRange+1, test.protocol, test.srcPort, test.dstPort)
+		if length != test.expected {
+			t.Errorf("unexpected copy range %d for %+v", length, test)
+		}
+	}
+}
+
+func TestDHCPCopyRanges(t *testing.T) {
+	t.Parallel()
+
+	// DHCP packets are copied fully if the general queues do not.
+	ranges, err := parseCopyRanges("udp/67=1024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges = withDHCPCopyRanges(ranges, nfq.HeaderCopyRange)
+	for _, test := range []struct {
+		srcPort  uint16
+		dstPort  uint16
+		expected uint32
+	}{
+		{68, 67, 1024},
+		{67, 68, 1024},
+		{546, 547, nfq.FullCopyRange},
+		{547, 546, nfq.FullCopyRange},
+		{40000, 53, nfq.HeaderCopyRange},
+	} {
+		length := lookupCopyRange(ranges, nfq.HeaderCopyRange, uint8(packet.UDP), test.srcPort, test.dstPort)
+		if length != test.expected {
+			t.Errorf("unexpected copy range %d for %+v", length, test)
+		}
+	}
+
+	// No copy ranges are needed if the general queues copy full packets.
+	if ranges := withDHCPCopyRanges(nil, nfq.FullCopyRange); len(ranges) != 0 {
+		t.Errorf("unexpected copy ranges %+v", ranges)
+	}
+}
+
+// copyRangeBenchmarkTraffic is a typical mix of packets that reach the queues,
+// as packets of connections with a permanent verdict do not.
+var copyRangeBenchmarkTraffic = []struct {
+	protocol uint8
+	srcPort  uint16
+	dstPort  uint16
+	size     int
+	share    int
+}{
+	// DNS queries and responses.
+	{uint8(packet.UDP), 40000, 53, 80, 10},
+	{uint8(packet.UDP), 53, 40000, 400, 10},
+	// TLS handshakes and early data.
+	{uint8(packet.TCP), 40000, 443, 60, 10},
+	{uint8(packet.TCP), 40000, 443, 600, 5},
+	{uint8(packet.TCP), 443, 40000, 1500, 20},
+	// Bulk TCP data and ACKs of other connections.
+	{uint8(packet.TCP), 40000, 8080, 1500, 30},
+	{uint8(packet.TCP), 8080, 40000, 52, 15},
+}
+
+func benchmarkCopyVolume(b *testing.B, ranges []copyRange, generalLength uint32) {
+	b.Helper()
+
+	var copied, packets int
+	for i := 0; i < b.N; i++ {
+		for _, traffic := range copyRangeBenchmarkTraffic {
+			length := int(lookupCopyRange(ranges, generalLength, traffic.protocol, traffic.srcPort, traffic.dstPort))
+			if length > traffic.size {
+				length = traffic.size
+			}
+			copied += length * traffic.share
+			packets += traffic.share
+		}
+	}
+	b.ReportMetric(float64(copied)/float64(packets), "copied-bytes/packet")
+}
+
+func BenchmarkCopyVolume(b *testing.B) {
+	b.Run("full", func(b *testing.B) {
+		benchmarkCopyVolume(b, nil, nfq.FullCopyRange)
+	})
+	b.Run("headers", func(b *testing.B) {
+		benchmarkCopyVolume(b, nil, nfq.HeaderCopyRange)
+	})
+
+	ranges, err := parseCopyRanges("tcp=0,udp/53=full,tcp/443=1024")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("per-protocol", func(b *testing.B) {
+		benchmarkCopyVolume(b, ranges, nfq.FullCopyRange)
+	})
+}
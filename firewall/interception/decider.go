@@ -0,0 +1,109 @@
+package interception
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// VerdictReason describes why a verdict was decided.
+type VerdictReason struct {
+	// Msg is a human readable description of the reason.
+	Msg string
+	// Context holds additional information about the reason.
+	Context interface{}
+}
+
+// VerdictDecider decides about the verdict of intercepted packets. It can be
+// used to replace the built-in profile engine when embedding the interception.
+//
+// Decide is called for every intercepted packet and may be called concurrently
+// from multiple goroutines. The packet is held by the kernel until the verdict
+// is applied, so Decide should return quickly. It is called by a fixed amount
+// of workers, and packets that do not fit into their full queue are handled
+// as if the interception queue was full. The decided verdict is applied
+// to the packet only, never permanently to its connection, so that every
+// packet is decided on. Undecided, undeterminable and failed verdicts result
+// in the packet being dropped.
+type VerdictDecider interface {
+	Decide(pkt packet.Packet) (network.Verdict, VerdictReason)
+}
+
+var (
+	verdictDecider     VerdictDecider
+	verdictDeciderLock sync.Mutex
+)
+
+// SetVerdictDecider sets the verdict decider that is used instead of the
+// built-in profile engine. It must be set before the interception is started.
+// A nil decider restores the built-in profile engine. Custom verdict deciders
+// are only supported by the nfqueue interception on Linux.
+func SetVerdictDecider(decider VerdictDecider) {
+	verdictDeciderLock.Lock()
+	defer verdictDeciderLock.Unlock()
+
+	verdictDecider = decider
+}
+
+func getVerdictDecider() VerdictDecider {
+	verdictDeciderLock.Lock()
+	defer verdictDeciderLock.Unlock()
+
+	return verdictDecider
+}
+
+// deciderWorkers is the amount of workers that let the verdict decider decide
+// about the intercepted packets.
+const deciderWorkers = 32
+
+// startDeciderWorkers starts the workers that let the decider decide about the
+// packets sent to the returned channel, which buffers up to the given amount
+// of packets. The workers stop when the stop channel is closed.
+func startDeciderWorkers(decider VerdictDecider, size int, stop <-chan struct{}) chan<- packet.Packet {
+	decidePackets := make(chan packet.Packet, size)
+	for i := 0; i < deciderWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				case pkt := <-decidePackets:
+					applyDecidedVerdict(decider, pkt)
+				}
+			}
+		}()
+	}
+	return decidePackets
+}
+
+// applyDecidedVerdict lets the decider decide about the packet and applies
+// the verdict.
+func applyDecidedVerdict(decider VerdictDecider, pkt packet.Packet) {
+	verdict, reason := decider.Decide(pkt)
+
+	var err error
+	switch verdict { //nolint:exhaustive // Default is used for all others.
+	case network.VerdictAccept:
+		err = pkt.Accept()
+	case network.VerdictBlock:
+		err = pkt.Block()
+	case network.VerdictDrop:
+		err = pkt.Drop()
+	case network.VerdictRerouteToNameserver:
+		err = pkt.RerouteToNameserver()
+	case network.VerdictRerouteToTunnel:
+		err = pkt.RerouteToTunnel()
+	default:
+		err = DropOnError(pkt, packet.ErrorDropEngine, fmt.Errorf("decider returned unsupported verdict %s", verdict))
+		verdict = network.VerdictDrop
+	}
+	if err != nil {
+		log.Warningf("interception: failed to apply decided verdict %s to %s: %s", verdict, pkt, err)
+		return
+	}
+
+	log.Tracef("interception: decided to %s %s: %s", verdict.Verb(), pkt, reason.Msg)
+}
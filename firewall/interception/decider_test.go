@@ -0,0 +1,142 @@
+package interception
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// allowAllDecider accepts all packets.
+type allowAllDecider struct{}
+
+func (allowAllDecider) Decide(pkt packet.Packet) (network.Verdict, VerdictReason) {
+	return network.VerdictAccept, VerdictReason{Msg: "all packets are allowed"}
+}
+
+// examplePacket is a packet that prints the applied verdict.
+type examplePacket struct {
+	packet.Base
+}
+
+func (pkt *examplePacket) Accept() error {
+	fmt.Println("accepted")
+	return nil
+}
+
+func (pkt *examplePacket) Block() error {
+	fmt.Println("blocked")
+	return nil
+}
+
+func (pkt *examplePacket) Drop() error {
+	fmt.Println("dropped")
+	return nil
+}
+
+func (pkt *examplePacket) PermanentAccept() error     { return pkt.Accept() }
+func (pkt *examplePacket) PermanentBlock() error      { return pkt.Block() }
+func (pkt *examplePacket) PermanentDrop() error       { return pkt.Drop() }
+func (pkt *examplePacket) RerouteToNameserver() error { return nil }
+func (pkt *examplePacket) RerouteToTunnel() error     { return nil }
+
+func ExampleVerdictDecider() {
+	// Use the decider instead of the built-in profile engine.
+	SetVerdictDecider(allowAllDecider{})
+	defer SetVerdictDecider(nil)
+
+	// The interception applies the decided verdict to every intercepted packet.
+	applyDecidedVerdict(getVerdictDecider(), &examplePacket{})
+
+	// Output: accepted
+}
+
+// blockingDecider accepts packets once it is released.
+type blockingDecider struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *blockingDecider) Decide(pkt packet.Packet) (network.Verdict, VerdictReason) {
+	d.started <- struct{}{}
+	<-d.release
+	return network.VerdictAccept, VerdictReason{Msg: "released"}
+}
+
+// countingPacket counts the applied verdicts.
+type countingPacket struct {
+	packet.Base
+	accepted *uint64
+	dropped  *uint64
+}
+
+func (pkt *countingPacket) Accept() error {
+	atomic.AddUint64(pkt.accepted, 1)
+	return nil
+}
+
+func (pkt *countingPacket) Block() error { return pkt.Drop() }
+
+func (pkt *countingPacket) Drop() error {
+	atomic.AddUint64(pkt.dropped, 1)
+	return nil
+}
+
+func (pkt *countingPacket) PermanentAccept() error     { return pkt.Accept() }
+func (pkt *countingPacket) PermanentBlock() error      { return pkt.Block() }
+func (pkt *countingPacket) PermanentDrop() error       { return pkt.Drop() }
+func (pkt *countingPacket) RerouteToNameserver() error { return nil }
+func (pkt *countingPacket) RerouteToTunnel() error     { return nil }
+
+func TestDeciderWorkers(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	decider := &blockingDecider{
+		started: make(chan struct{}, deciderWorkers),
+		release: make(chan struct{}),
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	const queueSize = 10
+	decidePackets := startDeciderWorkers(decider, queueSize, stop)
+
+	var accepted, dropped uint64
+	newPacket := func() packet.Packet {
+		return &countingPacket{accepted: &accepted, dropped: &dropped}
+	}
+
+	// Occupy all workers.
+	for i := 0; i < deciderWorkers; i++ {
+		enqueuePacket(decidePackets, newPacket())
+		select {
+		case <-decider.started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d workers started deciding", i, deciderWorkers)
+		}
+	}
+	// No more packets are decided than there are workers.
+	select {
+	case <-decider.started:
+		t.Fatal("more packets are decided than there are workers")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Packets that do not fit into the queue are dropped.
+	for i := 0; i < queueSize+1; i++ {
+		enqueuePacket(decidePackets, newPacket())
+	}
+	if n := atomic.LoadUint64(&dropped); n != 1 {
+		t.Errorf("expected 1 dropped packet, got %d", n)
+	}
+
+	// All queued packets are decided once the workers are released.
+	close(decider.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&accepted) < deciderWorkers+queueSize && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadUint64(&accepted); n != deciderWorkers+queueSize {
+		t.Errorf("expected %d accepted packets, got %d", deciderWorkers+queueSize, n)
+	}
+}
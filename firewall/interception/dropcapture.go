@@ -0,0 +1,275 @@
+package interception
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network/packet"
+)
+
+const (
+	// dropCaptureSnapLen is the maximum amount of bytes that is recorded per
+	// packet. It matches the copy length of the nfqueue integration.
+	dropCaptureSnapLen = 1600
+
+	// dropCaptureQueueSize is the amount of dropped packets that may wait for
+	// being written to disk. Packets are not captured if the queue is full.
+	dropCaptureQueueSize = 1000
+
+	// DefaultDropCaptureMaxFileSize is the default size in bytes at which the
+	// capture file is rotated.
+	DefaultDropCaptureMaxFileSize = 10 * 1024 * 1024
+)
+
+// DropCaptureFilter decides whether a dropped or blocked packet should be
+// written to the drop capture.
+type DropCaptureFilter func(pkt packet.Packet) bool
+
+var (
+	dropCaptureDestination string
+
+	dropCaptureLock    sync.Mutex
+	activeDropCapture  atomic.Value // *dropCapture
+	dropCaptureMaxSize int64        = DefaultDropCaptureMaxFileSize
+)
+
+func init() {
+	flag.StringVar(&dropCaptureDestination, "capture-dropped-packets", "", "write dropped and blocked packets to the specified PCAP file")
+}
+
+type dropCapture struct {
+	filter DropCaptureFilter
+	path   string
+
+	records chan *dropCaptureRecord
+	done    chan struct{}
+	stopped chan struct{}
+
+	file    *os.File
+	writer  *pcapgo.Writer
+	written int64
+
+	captured uint64
+	skipped  uint64
+}
+
+type dropCaptureRecord struct {
+	captured time.Time
+	data     []byte
+	length   int
+}
+
+// EnableDropCapture starts writing the raw bytes of dropped and blocked
+// packets that match the given filter to a PCAP file at the given path. A nil
+// filter captures all dropped and blocked packets. When the file reaches the
+// maximum size, it is rotated to "<path>.1", replacing any previous rotated
+// file. Writing happens asynchronously and packets are skipped if the writer
+// cannot keep up, so that verdicts are never delayed by the capture.
+func EnableDropCapture(filter DropCaptureFilter, path string) error {
+	if path == "" {
+		return errors.New("no capture file path specified")
+	}
+
+	dropCaptureLock.Lock()
+	defer dropCaptureLock.Unlock()
+
+	// Stop any previous capture.
+	if dc := getDropCapture(); dc != nil {
+		dc.stop()
+	}
+
+	dc := &dropCapture{
+		filter:  filter,
+		path:    path,
+		records: make(chan *dropCaptureRecord, dropCaptureQueueSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if err := dc.openFile(); err != nil {
+		return fmt.Errorf("failed to open capture file: %w", err)
+	}
+
+	go dc.writeRecords()
+	activeDropCapture.Store(dc)
+
+	log.Infof("interception: capturing dropped packets to %s", path)
+	return nil
+}
+
+// DisableDropCapture stops the active drop capture, if any, and closes the
+// capture file.
+func DisableDropCapture() {
+	dropCaptureLock.Lock()
+	defer dropCaptureLock.Unlock()
+
+	if dc := getDropCapture(); dc != nil {
+		dc.stop()
+		activeDropCapture.Store((*dropCapture)(nil))
+		log.Infof(
+			"interception: stopped capturing dropped packets to %s (captured %d, skipped %d)",
+			dc.path,
+			atomic.LoadUint64(&dc.captured),
+			atomic.LoadUint64(&dc.skipped),
+		)
+	}
+}
+
+// SetDropCaptureMaxFileSize sets the size in bytes at which the capture file
+// is rotated. It applies to captures that are enabled afterwards.
+func SetDropCaptureMaxFileSize(size int64) error {
+	if size <= 0 {
+		return errors.New("maximum capture file size must be positive")
+	}
+	atomic.StoreInt64(&dropCaptureMaxSize, size)
+	return nil
+}
+
+func getDropCapture() *dropCapture {
+	dc, _ := activeDropCapture.Load().(*dropCapture)
+	return dc
+}
+
+// wrapForDropCapture wraps the packet so that drops and blocks are captured,
+// if a drop capture is active. Otherwise the packet is returned unchanged.
+func wrapForDropCapture(pkt packet.Packet) packet.Packet {
+	if getDropCapture() == nil {
+		return pkt
+	}
+	return &dropCapturePacket{Packet: pkt}
+}
+
+func captureDroppedPacket(pkt packet.Packet) {
+	dc := getDropCapture()
+	if dc == nil {
+		return
+	}
+	if dc.filter != nil && !dc.filter(pkt) {
+		return
+	}
+
+	raw := pkt.Raw()
+	length := len(raw)
+	if len(raw) > dropCaptureSnapLen {
+		raw = raw[:dropCaptureSnapLen]
+	}
+	// Copy the data, as the packet buffer may be released after the verdict.
+	data := make([]byte, len(raw))
+	copy(data, raw)
+
+	select {
+	case dc.records <- &dropCaptureRecord{
+		captured: time.Now(),
+		data:     data,
+		length:   length,
+	}:
+	case <-dc.done:
+	default:
+		atomic.AddUint64(&dc.skipped, 1)
+	}
+}
+
+func (dc *dropCapture) openFile() error {
+	f, err := os.OpenFile(dc.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o0600)
+	if err != nil {
+		return err
+	}
+
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(dropCaptureSnapLen, layers.LinkTypeRaw); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	dc.file = f
+	dc.writer = w
+	dc.written = 0
+	return nil
+}
+
+func (dc *dropCapture) rotate() error {
+	if err := dc.file.Close(); err != nil {
+		log.Warningf("interception: failed to close drop capture file: %s", err)
+	}
+	if err := os.Rename(dc.path, dc.path+".1"); err != nil {
+		log.Warningf("interception: failed to rotate drop capture file: %s", err)
+	}
+	return dc.openFile()
+}
+
+func (dc *dropCapture) writeRecords() {
+	defer close(dc.stopped)
+	defer func() {
+		if dc.file != nil {
+			_ = dc.file.Close()
+		}
+	}()
+
+	maxSize := atomic.LoadInt64(&dropCaptureMaxSize)
+	for {
+		select {
+		case <-dc.done:
+			return
+		case r := <-dc.records:
+			if dc.written >= maxSize {
+				if err := dc.rotate(); err != nil {
+					log.Errorf("interception: stopping drop capture, failed to rotate capture file: %s", err)
+					dc.file = nil
+					return
+				}
+			}
+
+			err := dc.writer.WritePacket(gopacket.CaptureInfo{
+				Timestamp:     r.captured,
+				CaptureLength: len(r.data),
+				Length:        r.length,
+			}, r.data)
+			if err != nil {
+				log.Warningf("interception: failed to write dropped packet to capture: %s", err)
+				continue
+			}
+			dc.written += int64(16 + len(r.data)) // pcap record header + data
+			atomic.AddUint64(&dc.captured, 1)
+		}
+	}
+}
+
+func (dc *dropCapture) stop() {
+	close(dc.done)
+	<-dc.stopped
+}
+
+// dropCapturePacket captures the packet data when the packet is dropped or
+// blocked. All other verdicts are passed through without any overhead.
+type dropCapturePacket struct {
+	packet.Packet
+}
+
+func (p *dropCapturePacket) Block() error {
+	captureDroppedPacket(p.Packet)
+	return p.Packet.Block()
+}
+
+func (p *dropCapturePacket) Drop() error {
+	captureDroppedPacket(p.Packet)
+	return p.Packet.Drop()
+}
+
+func (p *dropCapturePacket) PermanentBlock() error {
+	captureDroppedPacket(p.Packet)
+	return p.Packet.PermanentBlock()
+}
+
+func (p *dropCapturePacket) PermanentDrop() error {
+	captureDroppedPacket(p.Packet)
+	return p.Packet.PermanentDrop()
+}
@@ -0,0 +1,142 @@
+package interception
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/safing/portmaster/network/packet"
+)
+
+// newDropCaptureTestPacket returns a parsed IPv4 UDP packet to the given
+// destination port.
+func newDropCaptureTestPacket(t *testing.T, dstPort byte, accepted, dropped *uint64) *countingPacket {
+	t.Helper()
+
+	data := make([]byte, 28)
+	data[0] = 0x45
+	data[3] = 28
+	data[8] = 64
+	data[9] = byte(packet.UDP)
+	copy(data[12:16], []byte{10, 0, 0, 1})
+	copy(data[16:20], []byte{10, 0, 0, 2})
+	data[21] = 50
+	data[23] = dstPort
+	data[25] = 8
+
+	pkt := &countingPacket{accepted: accepted, dropped: dropped}
+	if err := packet.Parse(data, &pkt.Base); err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+// readDropCapture returns the data of the packets in the capture file.
+func readDropCapture(t *testing.T, path string) [][]byte {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var records [][]byte
+	for {
+		data, _, err := r.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			return records
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, data)
+	}
+}
+
+func TestDropCapture(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	var accepted, dropped uint64
+	path := filepath.Join(t.TempDir(), "dropped.pcap")
+
+	// Without an active capture, packets are not wrapped.
+	pkt := newDropCaptureTestPacket(t, 53, &accepted, &dropped)
+	if wrapForDropCapture(pkt) != packet.Packet(pkt) {
+		t.Error("packet must not be wrapped without an active capture")
+	}
+
+	// Rotate after the first packet.
+	if err := SetDropCaptureMaxFileSize(40); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = SetDropCaptureMaxFileSize(DefaultDropCaptureMaxFileSize)
+	}()
+	if err := EnableDropCapture(func(pkt packet.Packet) bool {
+		return pkt.Info().DstPort != 123
+	}, path); err != nil {
+		t.Fatal(err)
+	}
+	defer DisableDropCapture()
+	dc := getDropCapture()
+
+	// Only dropped and blocked packets that match the filter are captured.
+	blocked := newDropCaptureTestPacket(t, 53, &accepted, &dropped)
+	droppedPkt := newDropCaptureTestPacket(t, 80, &accepted, &dropped)
+	filtered := newDropCaptureTestPacket(t, 123, &accepted, &dropped)
+	if err := wrapForDropCapture(pkt).Accept(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wrapForDropCapture(blocked).Block(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wrapForDropCapture(droppedPkt).Drop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wrapForDropCapture(filtered).Drop(); err != nil {
+		t.Fatal(err)
+	}
+	if accepted != 1 || dropped != 3 {
+		t.Errorf("verdicts must be passed on, got %d accepted and %d dropped", accepted, dropped)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&dc.captured) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	DisableDropCapture()
+	if getDropCapture() != nil {
+		t.Error("capture should be disabled")
+	}
+
+	// The first packet was rotated to the previous file.
+	rotated := readDropCapture(t, path+".1")
+	if len(rotated) != 1 || !bytes.Equal(rotated[0], blocked.Raw()) {
+		t.Errorf("unexpected packets in rotated capture file: %v", rotated)
+	}
+	current := readDropCapture(t, path)
+	if len(current) != 1 || !bytes.Equal(current[0], droppedPkt.Raw()) {
+		t.Errorf("unexpected packets in capture file: %v", current)
+	}
+}
+
+func TestDropCaptureSettings(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	if err := EnableDropCapture(nil, ""); err == nil {
+		t.Error("capture without path should fail")
+	}
+	if err := SetDropCaptureMaxFileSize(0); err == nil {
+		t.Error("maximum file size of 0 should be rejected")
+	}
+}
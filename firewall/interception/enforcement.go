@@ -0,0 +1,46 @@
+package interception
+
+// Direction is a direction of traffic that the interception enforces verdicts
+// for.
+type Direction uint8
+
+// Directions of traffic.
+const (
+	DirectionOutbound Direction = iota + 1
+	DirectionInbound
+	DirectionForward
+)
+
+// String returns the name of the direction.
+func (dir Direction) String() string {
+	switch dir {
+	case DirectionOutbound:
+		return "outbound"
+	case DirectionInbound:
+		return "inbound"
+	case DirectionForward:
+		return "forward"
+	default:
+		return "unknown"
+	}
+}
+
+// EnforcementStatus returns for every direction whether the interception
+// currently enforces verdicts on its traffic. This reflects the installed
+// rules, so a direction that was paused reports false as soon as the rules
+// are rebuilt, and all directions report false while the interception is not
+// active. It is a synchronous alternative to GetState for integrations that
+// only need to know whether traffic is filtered.
+func EnforcementStatus() map[Direction]bool {
+	status := map[Direction]bool{
+		DirectionOutbound: false,
+		DirectionInbound:  false,
+		DirectionForward:  false,
+	}
+	if disableInterception {
+		return status
+	}
+
+	getEnforcementStatus(status)
+	return status
+}
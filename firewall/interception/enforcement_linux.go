@@ -0,0 +1,117 @@
+package interception
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/safing/portbase/log"
+)
+
+var (
+	pausedDirections = make(map[Direction]bool)
+	// pausedDirectionsBuilt holds the paused directions the current rules were
+	// built with and pausedDirectionsInstalled the ones of the installed rules.
+	pausedDirectionsBuilt     map[Direction]bool
+	pausedDirectionsInstalled map[Direction]bool
+	pausedDirectionsLock      sync.Mutex
+)
+
+// directionIngestChains holds the ingest chains that hand the packets of a
+// direction to the queues.
+var directionIngestChains = map[Direction]string{
+	DirectionOutbound: "mangle PORTMASTER-INGEST-OUTPUT",
+	DirectionInbound:  "mangle PORTMASTER-INGEST-INPUT",
+}
+
+// setDirectionPaused pauses or resumes enforcing verdicts for a direction.
+// The rules are rebuilt if the interception is active.
+func setDirectionPaused(dir Direction, paused bool) error {
+	switch dir {
+	case DirectionOutbound, DirectionInbound:
+	case DirectionForward:
+		return errors.New("forwarded traffic is not intercepted")
+	default:
+		return fmt.Errorf("invalid direction %d", dir)
+	}
+
+	pausedDirectionsLock.Lock()
+	if paused {
+		pausedDirections[dir] = true
+	} else {
+		delete(pausedDirections, dir)
+	}
+	pausedDirectionsLock.Unlock()
+
+	if paused {
+		log.Warningf("interception: pausing enforcement of %s traffic", dir)
+	} else {
+		log.Infof("interception: resuming enforcement of %s traffic", dir)
+	}
+
+	if nfqueueActive.IsSet() {
+		RequestRuleRebuild()
+	}
+	return nil
+}
+
+// withDirectionPauses returns the rules with the queue rules of the ingest
+// chains of paused directions replaced by a rule that marks all packets to be
+// accepted. The accept mark overrides permanent verdicts restored from the
+// connection, but is not saved to it, so that permanent verdicts apply again
+// when the direction is resumed.
+func withDirectionPauses(rules []string) []string {
+	pausedDirectionsLock.Lock()
+	defer pausedDirectionsLock.Unlock()
+
+	pausedDirectionsBuilt = make(map[Direction]bool, len(pausedDirections))
+	pausedChains := make(map[string]bool, len(pausedDirections))
+	for dir := range pausedDirections {
+		pausedDirectionsBuilt[dir] = true
+		pausedChains[directionIngestChains[dir]] = true
+	}
+	if len(pausedChains) == 0 {
+		return rules
+	}
+
+	paused := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		match, _, ok := strings.Cut(rule, " -j NFQUEUE ")
+		if !ok {
+			paused = append(paused, rule)
+			continue
+		}
+		chain := strings.Join(strings.SplitN(match, " ", 3)[:2], " ")
+		if !pausedChains[chain] {
+			paused = append(paused, rule)
+			continue
+		}
+		paused = append(paused, chain+" -j MARK --set-mark 1700")
+	}
+
+	return paused
+}
+
+// markRulesInstalled records that the rules that were built last are
+// installed.
+func markRulesInstalled() {
+	pausedDirectionsLock.Lock()
+	defer pausedDirectionsLock.Unlock()
+
+	pausedDirectionsInstalled = pausedDirectionsBuilt
+}
+
+// nfqueueEnforcementStatus adds the enforcement status of the nfqueue
+// interception to the given status. Forwarded traffic is never intercepted.
+func nfqueueEnforcementStatus(status map[Direction]bool) {
+	if !nfqueueActive.IsSet() {
+		return
+	}
+
+	pausedDirectionsLock.Lock()
+	defer pausedDirectionsLock.Unlock()
+
+	status[DirectionOutbound] = !pausedDirectionsInstalled[DirectionOutbound]
+	status[DirectionInbound] = !pausedDirectionsInstalled[DirectionInbound]
+}
@@ -0,0 +1,73 @@
+package interception
+
+import (
+	"testing"
+)
+
+func TestEnforcementStatus(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func() {
+		nfqueueActive.UnSet()
+		_ = setDirectionPaused(DirectionOutbound, false)
+		_ = setDirectionPaused(DirectionInbound, false)
+		buildRules()
+		markRulesInstalled()
+	}()
+
+	// Nothing is enforced while the interception is not active.
+	buildRules()
+	markRulesInstalled()
+	for dir, enforcing := range EnforcementStatus() {
+		if enforcing {
+			t.Errorf("%s should not be enforced while inactive", dir)
+		}
+	}
+
+	nfqueueActive.Set()
+	status := EnforcementStatus()
+	if !status[DirectionOutbound] || !status[DirectionInbound] || status[DirectionForward] {
+		t.Errorf("unexpected enforcement status while active: %v", status)
+	}
+
+	// Pausing takes effect when the rules are installed.
+	nfqueueActive.UnSet() // Do not request a rebuild.
+	if err := setDirectionPaused(DirectionOutbound, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := setDirectionPaused(DirectionForward, true); err == nil {
+		t.Error("pausing forwarded traffic should fail")
+	}
+	nfqueueActive.Set()
+	if !EnforcementStatus()[DirectionOutbound] {
+		t.Error("outbound should be enforced until the rules are installed")
+	}
+	buildRules()
+	markRulesInstalled()
+	status = EnforcementStatus()
+	if status[DirectionOutbound] || !status[DirectionInbound] {
+		t.Errorf("unexpected enforcement status with paused outbound: %v", status)
+	}
+
+	if !containsRule(v4rules, "mangle PORTMASTER-INGEST-OUTPUT -j MARK --set-mark 1700") ||
+		!containsRule(v6rules, "mangle PORTMASTER-INGEST-OUTPUT -j MARK --set-mark 1700") {
+		t.Error("paused outbound traffic should be accepted")
+	}
+	if containsRule(v4rules, "mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -j NFQUEUE --queue-num 17040 --queue-bypass") {
+		t.Error("paused outbound traffic should not be queued")
+	}
+	if !containsRule(v4rules, "mangle PORTMASTER-INGEST-INPUT -m mark --mark 0 -j NFQUEUE --queue-num 17140 --queue-bypass") {
+		t.Error("inbound traffic should still be queued")
+	}
+
+	// Resuming flips back.
+	nfqueueActive.UnSet()
+	if err := setDirectionPaused(DirectionOutbound, false); err != nil {
+		t.Fatal(err)
+	}
+	nfqueueActive.Set()
+	buildRules()
+	markRulesInstalled()
+	status = EnforcementStatus()
+	if !status[DirectionOutbound] || !status[DirectionInbound] {
+		t.Errorf("unexpected enforcement status after resuming: %v", status)
+	}
+}
@@ -0,0 +1,121 @@
+package interception
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/core/journal"
+	"github.com/safing/portmaster/core/telemetry"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// MetricErrorDrops is the name of the counter of packets that were dropped
+// because of an internal failure, labeled by cause.
+const MetricErrorDrops = "firewall/interception_error_drops/total"
+
+// errorDropEventInterval defines how often an event is sent per error drop
+// cause at most, as error drops usually come in bursts.
+const errorDropEventInterval = time.Minute
+
+var (
+	errorDrops       = make(map[packet.ErrorDropCause]*uint64, len(packet.ErrorDropCauses))
+	errorDropMetrics = make(map[packet.ErrorDropCause]*telemetry.Metric, len(packet.ErrorDropCauses))
+
+	lastErrorDropEvents     = make(map[packet.ErrorDropCause]time.Time, len(packet.ErrorDropCauses))
+	lastErrorDropEventsLock sync.Mutex
+
+	// parseAnomalies holds the anomalies of all packets that were dropped
+	// because of inconsistent headers, see packet.ParseError.
+	parseAnomalies uint32
+)
+
+func init() {
+	for _, cause := range packet.ErrorDropCauses {
+		errorDrops[cause] = new(uint64)
+		errorDropMetrics[cause] = telemetry.NewMetric(MetricErrorDrops, map[string]string{"cause": string(cause)})
+	}
+}
+
+// DropOnError drops the packet because of an internal failure, such as an
+// error of the verdict engine, and records the drop with the given cause.
+// Drops decided by the rules must use the verdict methods of the packet.
+func DropOnError(pkt packet.Packet, cause packet.ErrorDropCause, err error) error {
+	RecordErrorDrop(cause, err)
+	return pkt.Drop()
+}
+
+// RecordErrorDrop records that a packet was dropped because of an internal
+// failure with the given cause. It is counted and an event is sent, at most
+// once per minute per cause. The anomalies of packets with inconsistent
+// headers are recorded too, see ParseAnomalies.
+func RecordErrorDrop(cause packet.ErrorDropCause, err error) {
+	counter, ok := errorDrops[cause]
+	metric := errorDropMetrics[cause]
+	if !ok {
+		log.Warningf("interception: unknown error drop cause %q", cause)
+		counter = errorDrops[packet.ErrorDropEngine]
+		metric = errorDropMetrics[packet.ErrorDropEngine]
+	}
+	total := atomic.AddUint64(counter, 1)
+	metric.IncCounter(1)
+
+	var parseErr *packet.ParseError
+	if errors.As(err, &parseErr) {
+		recordParseAnomaly(parseErr.Anomaly)
+	}
+
+	lastErrorDropEventsLock.Lock()
+	defer lastErrorDropEventsLock.Unlock()
+
+	if time.Since(lastErrorDropEvents[cause]) < errorDropEventInterval {
+		return
+	}
+	lastErrorDropEvents[cause] = time.Now()
+
+	var errMsg string
+	if err != nil {
+		errMsg = err.Error()
+	}
+	log.Warningf("interception: dropped packet because of internal failure (%s): %s", cause, errMsg)
+	fields := journal.Fields{
+		"EVENT": "interception_error_drops",
+		"CAUSE": string(cause),
+		"ERROR": errMsg,
+		"TOTAL": strconv.FormatUint(total, 10),
+	}
+	if parseErr != nil {
+		fields["ANOMALIES"] = parseErr.Anomaly.String()
+	}
+	journal.Send(journal.PriorityWarning, "packet dropped because of internal failure", fields)
+}
+
+// recordParseAnomaly adds the anomaly to the recorded parse anomalies.
+func recordParseAnomaly(anomaly packet.ParseAnomaly) {
+	for {
+		recorded := atomic.LoadUint32(&parseAnomalies)
+		if recorded&uint32(anomaly) == uint32(anomaly) ||
+			atomic.CompareAndSwapUint32(&parseAnomalies, recorded, recorded|uint32(anomaly)) {
+			return
+		}
+	}
+}
+
+// ParseAnomalies returns the set of anomalies of all packets that were
+// dropped because of inconsistent headers since the start.
+func ParseAnomalies() packet.ParseAnomaly {
+	return packet.ParseAnomaly(atomic.LoadUint32(&parseAnomalies))
+}
+
+// ErrorDrops returns the amount of packets that were dropped because of an
+// internal failure, by cause.
+func ErrorDrops() map[packet.ErrorDropCause]uint64 {
+	drops := make(map[packet.ErrorDropCause]uint64, len(errorDrops))
+	for cause, counter := range errorDrops {
+		drops[cause] = atomic.LoadUint64(counter)
+	}
+	return drops
+}
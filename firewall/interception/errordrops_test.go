@@ -0,0 +1,78 @@
+package interception
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+func TestDropOnError(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	for _, cause := range packet.ErrorDropCauses {
+		before := ErrorDrops()
+
+		pkt := &verdictRecordingPacket{}
+		if err := DropOnError(pkt, cause, errors.New("test failure")); err != nil {
+			t.Fatal(err)
+		}
+		if pkt.verdict != "drop" {
+			t.Errorf("%s: packet should have been dropped, got verdict %q", cause, pkt.verdict)
+		}
+
+		after := ErrorDrops()
+		for _, other := range packet.ErrorDropCauses {
+			expected := before[other]
+			if other == cause {
+				expected++
+			}
+			if after[other] != expected {
+				t.Errorf("%s: expected %d drops with cause %s, got %d", cause, expected, other, after[other])
+			}
+		}
+	}
+}
+
+// undecidedDecider does not decide about packets.
+type undecidedDecider struct{}
+
+func (undecidedDecider) Decide(pkt packet.Packet) (network.Verdict, VerdictReason) {
+	return network.VerdictUndecided, VerdictReason{}
+}
+
+func TestDecidedVerdictErrorDrop(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	before := ErrorDrops()[packet.ErrorDropEngine]
+
+	pkt := &verdictRecordingPacket{}
+	applyDecidedVerdict(undecidedDecider{}, pkt)
+	if pkt.verdict != "drop" {
+		t.Errorf("packet should have been dropped, got verdict %q", pkt.verdict)
+	}
+	if ErrorDrops()[packet.ErrorDropEngine] != before+1 {
+		t.Error("undecided packet should have been counted as engine error drop")
+	}
+}
+
+func TestParseAnomalyErrorDrop(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	before := ErrorDrops()[packet.ErrorDropParse]
+
+	// A TCP data offset beyond the packet is rejected by the parser.
+	data := make([]byte, 40)
+	data[0] = 0x45
+	data[3] = 40
+	data[9] = byte(packet.TCP)
+	data[32] = 0xf0
+	err := packet.Parse(data, &packet.Base{})
+	if err == nil {
+		t.Fatal("packet should be rejected")
+	}
+
+	RecordErrorDrop(packet.ErrorDropParse, fmt.Errorf("failed to parse payload: %w", err))
+	if ErrorDrops()[packet.ErrorDropParse] != before+1 {
+		t.Error("packet should have been counted as parse error drop")
+	}
+	if !ParseAnomalies().Has(packet.AnomalyTCPDataOffset) {
+		t.Errorf("anomaly should have been recorded, got %s", ParseAnomalies())
+	}
+}
@@ -0,0 +1,291 @@
+package interception
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-iptables/iptables"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/firewall/interception/nfq"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// Full copy queues receive the packets of connections that requested full
+// copies, see RequestFullCopy.
+const (
+	fullCopyQueueOut4 = 17041
+	fullCopyQueueIn4  = 17141
+	fullCopyQueueOut6 = 17061
+	fullCopyQueueIn6  = 17161
+)
+
+var (
+	nfqueueHeaderCopy bool
+
+	fullCopyFlows     = make(map[string]*fullCopyFlow)
+	fullCopyFlowsLock sync.Mutex
+)
+
+func init() {
+	flag.BoolVar(&nfqueueHeaderCopy, "nfqueue-header-copy", false, "only copy packet headers to userspace, except for DHCP packets and connections that request full copies")
+
+	RegisterConnectionClosedHandler(handleFullCopyConnectionClosed)
+}
+
+// fullCopyFlow holds the rules of a connection that requested full copies.
+// Flows are keyed by the ID of their connection, see fullCopyFlowID.
+type fullCopyFlow struct {
+	protocol iptables.Protocol
+	rules    []string
+}
+
+// generalCopyRange returns the copy range of the general queues.
+func generalCopyRange() uint32 {
+	if nfqueueHeaderCopy {
+		return nfq.HeaderCopyRange
+	}
+	return nfq.FullCopyRange
+}
+
+// requestFullCopy installs iptables rules that route the packets of the
+// connection described by the given packet info to the full copy queues.
+func requestFullCopy(info *packet.Info) error {
+	protocol, rules, err := fullCopyRules(info)
+	if err != nil {
+		return err
+	}
+	id := fullCopyFlowID(info)
+
+	fullCopyFlowsLock.Lock()
+	defer fullCopyFlowsLock.Unlock()
+
+	if _, ok := fullCopyFlows[id]; ok {
+		return nil
+	}
+
+	flow := &fullCopyFlow{
+		protocol: protocol,
+		rules:    rules,
+	}
+	if err := insertFullCopyRules(flow); err != nil {
+		return err
+	}
+	fullCopyFlows[id] = flow
+
+	return nil
+}
+
+// stopFullCopy removes the rules installed by requestFullCopy, so that the
+// packets of the connection are handled by the general queues again.
+func stopFullCopy(info *packet.Info) error {
+	id := fullCopyFlowID(info)
+
+	fullCopyFlowsLock.Lock()
+	defer fullCopyFlowsLock.Unlock()
+
+	flow, ok := fullCopyFlows[id]
+	if !ok {
+		return nil
+	}
+	delete(fullCopyFlows, id)
+
+	return deleteFullCopyRules(flow)
+}
+
+// handleFullCopyConnectionClosed removes the rules of the connection with the
+// given ID when the OS stops tracking it, so that the rules of connections
+// that did not stop their full copy do not pile up.
+func handleFullCopyConnectionClosed(connKey string) {
+	fullCopyFlowsLock.Lock()
+	defer fullCopyFlowsLock.Unlock()
+
+	flow, ok := fullCopyFlows[connKey]
+	if !ok {
+		return
+	}
+	delete(fullCopyFlows, connKey)
+
+	// Closed connection handlers must not block.
+	go func() {
+		if err := deleteFullCopyRules(flow); err != nil {
+			log.Warningf("interception: failed to remove full copy rules of closed connection %s: %s", connKey, err)
+		}
+	}()
+}
+
+// fullCopyRules returns the rules for routing both directions of the
+// connection to the full copy queues. The rules match on the connmark instead
+// of the packet mark, as they are placed before the connmark is restored to
+// the packet. Connections with a permanent verdict have a connmark set and
+// do not reach any queue anymore.
+func fullCopyRules(info *packet.Info) (protocol iptables.Protocol, rules []string, err error) {
+	var proto string
+	switch info.Protocol { //nolint:exhaustive // Only TCP and UDP are supported.
+	case packet.TCP:
+		proto = "tcp"
+	case packet.UDP:
+		proto = "udp"
+	default:
+		return protocol, nil, errors.New("only TCP and UDP connections can be copied in full")
+	}
+
+	outQueue, inQueue := fullCopyQueueOut4, fullCopyQueueIn4
+	protocol = iptables.ProtocolIPv4
+	if info.Version == packet.IPv6 {
+		outQueue, inQueue = fullCopyQueueOut6, fullCopyQueueIn6
+		protocol = iptables.ProtocolIPv6
+	}
+
+	rules = []string{
+		fmt.Sprintf(
+			"mangle PORTMASTER-INGEST-OUTPUT -p %s -s %s --sport %d -d %s --dport %d -m connmark --mark 0 -j NFQUEUE --queue-num %d --queue-bypass",
+			proto, info.LocalIP(), info.LocalPort(), info.RemoteIP(), info.RemotePort(), outQueue,
+		),
+		fmt.Sprintf(
+			"mangle PORTMASTER-INGEST-INPUT -p %s -s %s --sport %d -d %s --dport %d -m connmark --mark 0 -j NFQUEUE --queue-num %d --queue-bypass",
+			proto, info.RemoteIP(), info.RemotePort(), info.LocalIP(), info.LocalPort(), inQueue,
+		),
+	}
+	return protocol, rules, nil
+}
+
+// fullCopyFlowID returns the connection ID of the connection described by the
+// given packet info, see packet.Packet.GetConnectionID. The connection ID
+// starts with the local address in both directions.
+func fullCopyFlowID(info *packet.Info) string {
+	tuple := &packet.ConntrackTuple{
+		Protocol: info.Protocol,
+		Src:      info.LocalIP(),
+		SrcPort:  info.LocalPort(),
+		Dst:      info.RemoteIP(),
+		DstPort:  info.RemotePort(),
+	}
+	outbound, _ := tuple.ConnectionIDs()
+	return outbound
+}
+
+// fullCopyRulePosition is the position at which the full copy rules are
+// inserted into the ingest chains. They must be placed after the first rule,
+// which returns injected packets, so that they keep their mark.
+const fullCopyRulePosition = 2
+
+// isInjectedReturnRule returns whether the rule returns injected packets from
+// one of the ingest chains.
+func isInjectedReturnRule(rule string) bool {
+	return strings.HasPrefix(rule, "mangle PORTMASTER-INGEST-") &&
+		strings.HasSuffix(rule, " -m mark --mark 1700 -j RETURN")
+}
+
+func insertFullCopyRules(flow *fullCopyFlow) error {
+	tbls, err := openIPTables(flow.protocol)
+	if err != nil {
+		return err
+	}
+
+	for i, rule := range flow.rules {
+		splittedRule := strings.Split(rule, " ")
+		if err := tbls.Insert(splittedRule[0], splittedRule[1], fullCopyRulePosition, splittedRule[2:]...); err != nil {
+			// Remove the rules that were already inserted.
+			removeFullCopyRules(tbls, flow.rules[:i])
+			return fmt.Errorf("failed to install full copy rule: %w", err)
+		}
+	}
+	return nil
+}
+
+func deleteFullCopyRules(flow *fullCopyFlow) error {
+	tbls, err := openIPTables(flow.protocol)
+	if err != nil {
+		return err
+	}
+
+	removeFullCopyRules(tbls, flow.rules)
+	return nil
+}
+
+func removeFullCopyRules(tbls ipTables, rules []string) {
+	for _, rule := range rules {
+		splittedRule := strings.Split(rule, " ")
+		ok, err := tbls.Exists(splittedRule[0], splittedRule[1], splittedRule[2:]...)
+		if err == nil && ok {
+			err = tbls.Delete(splittedRule[0], splittedRule[1], splittedRule[2:]...)
+		}
+		if err != nil {
+			log.Warningf("interception: failed to remove full copy rule: %s", err)
+		}
+	}
+}
+
+// withFullCopyFlows returns the rules together with the rules of all
+// connections that requested full copies of the given protocol, so that they
+// survive rebuilding the rules. The full copy rules of a chain are placed
+// after the rule that returns injected packets, as when they are inserted.
+func withFullCopyFlows(protocol iptables.Protocol, rules []string) []string {
+	fullCopyFlowsLock.Lock()
+	defer fullCopyFlowsLock.Unlock()
+
+	if len(fullCopyFlows) == 0 {
+		return rules
+	}
+
+	// Group the full copy rules by their table and chain.
+	chainRules := make(map[string][]string)
+	for _, flow := range fullCopyFlows {
+		if flow.protocol != protocol {
+			continue
+		}
+		for _, rule := range flow.rules {
+			chain := ruleChain(rule)
+			chainRules[chain] = append(chainRules[chain], rule)
+		}
+	}
+	if len(chainRules) == 0 {
+		return rules
+	}
+
+	combined := make([]string, 0, len(rules)+2*len(fullCopyFlows))
+	for _, rule := range rules {
+		combined = append(combined, rule)
+		if isInjectedReturnRule(rule) {
+			chain := ruleChain(rule)
+			combined = append(combined, chainRules[chain]...)
+			delete(chainRules, chain)
+		}
+	}
+	// Chains without a rule for injected packets start with the full copy rules.
+	var unplaced []string
+	for _, remaining := range chainRules {
+		unplaced = append(unplaced, remaining...)
+	}
+	return append(unplaced, combined...)
+}
+
+// ruleChain returns the table and chain of the rule.
+func ruleChain(rule string) string {
+	splittedRule := strings.SplitN(rule, " ", 3)
+	if len(splittedRule) < 2 {
+		return rule
+	}
+	return splittedRule[0] + " " + splittedRule[1]
+}
+
+// resetFullCopyFlows forgets all connections that requested full copies. It
+// is used when the rules are removed.
+func resetFullCopyFlows() {
+	fullCopyFlowsLock.Lock()
+	defer fullCopyFlowsLock.Unlock()
+
+	for id := range fullCopyFlows {
+		delete(fullCopyFlows, id)
+	}
+}
+
+// withDynamicRules returns the rules together with all rules that are added
+// at runtime for single connections.
+func withDynamicRules(protocol iptables.Protocol, rules []string) []string {
+	return withFullCopyFlows(protocol, withLocalPortRedirects(protocol, rules))
+}
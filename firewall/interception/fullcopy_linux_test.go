@@ -0,0 +1,158 @@
+package interception
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+
+	"github.com/safing/portmaster/network/packet"
+)
+
+func TestFullCopyRules(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	opLog := setupShutdownTest(t, false)
+	defer resetFullCopyFlows()
+
+	// Both directions must be matched, regardless of the direction of the
+	// connection.
+	outbound := &packet.Info{
+		Version:  packet.IPv4,
+		Protocol: packet.TCP,
+		Src:      net.IPv4(192, 168, 1, 2),
+		SrcPort:  40000,
+		Dst:      net.IPv4(1, 1, 1, 1),
+		DstPort:  443,
+	}
+	inbound := &packet.Info{
+		Inbound:  true,
+		Version:  packet.IPv4,
+		Protocol: packet.TCP,
+		Src:      net.IPv4(1, 1, 1, 1),
+		SrcPort:  443,
+		Dst:      net.IPv4(192, 168, 1, 2),
+		DstPort:  40000,
+	}
+	expectedRules := []string{
+		"mangle PORTMASTER-INGEST-OUTPUT -p tcp -s 192.168.1.2 --sport 40000 -d 1.1.1.1 --dport 443 -m connmark --mark 0 -j NFQUEUE --queue-num 17041 --queue-bypass",
+		"mangle PORTMASTER-INGEST-INPUT -p tcp -s 1.1.1.1 --sport 443 -d 192.168.1.2 --dport 40000 -m connmark --mark 0 -j NFQUEUE --queue-num 17141 --queue-bypass",
+	}
+	for _, info := range []*packet.Info{outbound, inbound} {
+		_, rules, err := fullCopyRules(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, rule := range rules {
+			if rule != expectedRules[i] {
+				t.Errorf("unexpected rule %q, expected %q", rule, expectedRules[i])
+			}
+		}
+	}
+
+	// Requesting a full copy installs the rules once.
+	if err := requestFullCopy(outbound); err != nil {
+		t.Fatal(err)
+	}
+	if err := requestFullCopy(inbound); err != nil {
+		t.Fatal(err)
+	}
+	if len(opLog.ops) != 2 {
+		t.Errorf("expected 2 inserted rules, got %v", opLog.ops)
+	}
+
+	// The rules are inserted after the rule that returns injected packets.
+	tbls, err := newIPTables(iptables.ProtocolIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := tbls.(*fakeIPTables) //nolint:forcetypeassert // Set up by setupShutdownTest.
+	for _, expected := range expectedRules {
+		if pos := fake.positions[expected]; pos != 2 {
+			t.Errorf("rule %q was inserted at position %d, expected 2", expected, pos)
+		}
+	}
+
+	// The rules survive rebuilding the rules and keep their position.
+	rules := withDynamicRules(iptables.ProtocolIPv4, v4rules)
+	for _, expected := range expectedRules {
+		i := ruleIndex(rules, expected)
+		switch {
+		case i < 0:
+			t.Errorf("missing rule %q after rebuild", expected)
+		case i == 0 || !isInjectedReturnRule(rules[i-1]) || ruleChain(rules[i-1]) != ruleChain(expected):
+			t.Errorf("rule %q must follow the rule for injected packets after rebuild", expected)
+		}
+	}
+	if len(withDynamicRules(iptables.ProtocolIPv6, v6rules)) != len(v6rules) {
+		t.Error("IPv4 connection must not add IPv6 rules")
+	}
+
+	// Stopping the full copy removes the rules.
+	opLog.ops = nil
+	if err := stopFullCopy(inbound); err != nil {
+		t.Fatal(err)
+	}
+	if len(opLog.ops) != 2 {
+		t.Errorf("expected 2 deleted rules, got %v", opLog.ops)
+	}
+	rules = withDynamicRules(iptables.ProtocolIPv4, v4rules)
+	for _, expected := range expectedRules {
+		if containsRule(rules, expected) {
+			t.Errorf("unexpected rule %q after stopping", expected)
+		}
+	}
+
+	// The rules are removed when the OS stops tracking the connection.
+	opLog.ops = nil
+	if err := requestFullCopy(inbound); err != nil {
+		t.Fatal(err)
+	}
+	closedOutbound, closedInbound := (&packet.ConntrackTuple{
+		Protocol: packet.TCP,
+		Src:      net.IPv4(1, 1, 1, 1),
+		SrcPort:  443,
+		Dst:      net.IPv4(192, 168, 1, 2),
+		DstPort:  40000,
+	}).ConnectionIDs()
+	dispatchConnectionClosed(closedOutbound)
+	dispatchConnectionClosed(closedInbound)
+	fullCopyFlowsLock.Lock()
+	remaining := len(fullCopyFlows)
+	fullCopyFlowsLock.Unlock()
+	if remaining != 0 {
+		t.Errorf("expected no full copy flows after the connection closed, got %d", remaining)
+	}
+	// The rules are removed in the background.
+	deleted := func() bool {
+		opLog.Lock()
+		defer opLog.Unlock()
+		return firstOpIndex(opLog.ops, "delete "+expectedRules[0]) >= 0 &&
+			firstOpIndex(opLog.ops, "delete "+expectedRules[1]) >= 0
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !deleted() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !deleted() {
+		t.Errorf("rules were not removed after the connection closed, got %v", opLog.ops)
+	}
+
+	// Only TCP and UDP are supported.
+	if err := requestFullCopy(&packet.Info{
+		Version:  packet.IPv4,
+		Protocol: packet.ICMP,
+		Src:      net.IPv4(192, 168, 1, 2),
+		Dst:      net.IPv4(1, 1, 1, 1),
+	}); err == nil {
+		t.Error("ICMP connections should be rejected")
+	}
+}
+
+func ruleIndex(rules []string, rule string) int {
+	for i, r := range rules {
+		if r == rule {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,114 @@
+package interception
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// gradualResetInterval defines how often a batch of connections is reset by a
+// gradual reset. The rate is spread over the batches of a second.
+const gradualResetInterval = 100 * time.Millisecond
+
+// GradualReset describes a running reset of the verdicts of all connections,
+// see ResetVerdictOfAllConnectionsGradual.
+type GradualReset struct {
+	total     int
+	remaining int64
+	cancel    context.CancelFunc
+	done      chan struct{}
+	err       error
+}
+
+// Total returns the amount of connections that are reset.
+func (gr *GradualReset) Total() int {
+	return gr.total
+}
+
+// Remaining returns the amount of connections that are not reset yet.
+func (gr *GradualReset) Remaining() int {
+	return int(atomic.LoadInt64(&gr.remaining))
+}
+
+// Cancel stops the reset. Connections that are already reset stay reset. It
+// does not wait for the reset to stop, see Done.
+func (gr *GradualReset) Cancel() {
+	gr.cancel()
+}
+
+// Done returns a channel that is closed when the reset finished or stopped.
+func (gr *GradualReset) Done() <-chan struct{} {
+	return gr.done
+}
+
+// Err returns the last error that occurred while resetting connections, or
+// context.Canceled if the reset was cancelled before it finished. It must
+// only be called after Done is closed.
+func (gr *GradualReset) Err() error {
+	return gr.err
+}
+
+// startGradualReset starts resetting the given amount of connections with
+// resetBatch at the given rate of connections per second.
+func startGradualReset(total, rate int, resetBatch func(from, to int) error) (*GradualReset, error) {
+	if rate <= 0 {
+		return nil, errors.New("rate must be positive")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	gr := &GradualReset{
+		total:     total,
+		remaining: int64(total),
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+
+	ticker := time.NewTicker(gradualResetInterval)
+	go func() {
+		defer ticker.Stop()
+		defer cancel()
+		gr.run(ctx, ticker.C, batchSize(rate, gradualResetInterval), resetBatch)
+	}()
+	return gr, nil
+}
+
+// batchSize returns how many connections to reset per interval to reach the
+// given rate per second. At least one connection is reset per interval.
+func batchSize(rate int, interval time.Duration) int {
+	size := int(int64(rate) * int64(interval) / int64(time.Second))
+	if size < 1 {
+		return 1
+	}
+	return size
+}
+
+// run resets a batch of connections with every tick until all connections are
+// reset or the context is cancelled.
+func (gr *GradualReset) run(ctx context.Context, tick <-chan time.Time, size int, resetBatch func(from, to int) error) {
+	defer close(gr.done)
+
+	for from := 0; from < gr.total; from += size {
+		if err := ctx.Err(); err != nil {
+			gr.err = err
+			return
+		}
+
+		to := from + size
+		if to > gr.total {
+			to = gr.total
+		}
+		if err := resetBatch(from, to); err != nil {
+			gr.err = err
+		}
+		atomic.StoreInt64(&gr.remaining, int64(gr.total-to))
+
+		if to == gr.total {
+			return
+		}
+		select {
+		case <-ctx.Done():
+		case <-tick:
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package interception
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGradualReset(t *testing.T) {
+	t.Parallel()
+
+	// 500 connections per second are reset in batches of 50 per interval.
+	size := batchSize(500, gradualResetInterval)
+	if size != 50 {
+		t.Fatalf("expected batches of 50, got %d", size)
+	}
+	if batchSize(1, gradualResetInterval) != 1 {
+		t.Error("at least one connection should be reset per interval")
+	}
+
+	gr := &GradualReset{
+		total:     120,
+		remaining: 120,
+		done:      make(chan struct{}),
+	}
+	tick := make(chan time.Time)
+	var batches []int
+	go gr.run(context.Background(), tick, size, func(from, to int) error {
+		batches = append(batches, to-from)
+		return nil
+	})
+
+	// Only one batch is reset per tick.
+	for _, remaining := range []int{70, 20} {
+		waitForRemaining(t, gr, remaining)
+		tick <- time.Now()
+	}
+	<-gr.Done()
+	if gr.Remaining() != 0 || gr.Err() != nil {
+		t.Errorf("reset should have finished, %d remaining: %v", gr.Remaining(), gr.Err())
+	}
+	if len(batches) != 3 || batches[0] != 50 || batches[1] != 50 || batches[2] != 20 {
+		t.Errorf("unexpected batches: %v", batches)
+	}
+}
+
+func TestGradualResetCancel(t *testing.T) {
+	t.Parallel()
+
+	gr, err := startGradualReset(1000, 10, func(from, to int) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForRemaining(t, gr, 999)
+	gr.Cancel()
+
+	select {
+	case <-gr.Done():
+	case <-time.After(time.Second):
+		t.Fatal("reset should have stopped")
+	}
+	if !errors.Is(gr.Err(), context.Canceled) {
+		t.Errorf("expected cancellation error, got %v", gr.Err())
+	}
+	if gr.Remaining() == 0 {
+		t.Error("reset should have stopped before resetting all connections")
+	}
+
+	if _, err := startGradualReset(1, 0, nil); err == nil {
+		t.Error("a rate of 0 should be rejected")
+	}
+}
+
+func waitForRemaining(t *testing.T, gr *GradualReset, remaining int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for gr.Remaining() != remaining {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d remaining, got %d", remaining, gr.Remaining())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,66 @@
+package interception
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/safing/portmaster/firewall/interception/nfq"
+)
+
+// injectPacket sends the given raw IP packet, including its IP header, via a
+// raw socket. The packet is marked as accepted, so that it is neither handed
+// to the Portmaster again nor is the mark overridden by the mark of the
+// connection it belongs to.
+func injectPacket(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("empty packet")
+	}
+
+	var (
+		family int
+		dst    unix.Sockaddr
+	)
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return errors.New("invalid IPv4 packet")
+		}
+		family = unix.AF_INET
+		sa := &unix.SockaddrInet4{}
+		copy(sa.Addr[:], data[16:20])
+		dst = sa
+	case 6:
+		if len(data) < 40 {
+			return errors.New("invalid IPv6 packet")
+		}
+		family = unix.AF_INET6
+		sa := &unix.SockaddrInet6{}
+		copy(sa.Addr[:], data[24:40])
+		dst = sa
+	default:
+		return errors.New("unknown IP version")
+	}
+
+	// Raw sockets with IPPROTO_RAW expect the packet to include the IP header.
+	var fd int
+	err := nfq.InNetns(func() (err error) {
+		fd, err = unix.Socket(family, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.IPPROTO_RAW)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open raw socket: %w", err)
+	}
+	defer func() {
+		_ = unix.Close(fd)
+	}()
+
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, nfq.MarkAccept); err != nil {
+		return fmt.Errorf("failed to mark raw socket: %w", err)
+	}
+	if err := unix.Sendto(fd, data, 0, dst); err != nil {
+		return fmt.Errorf("failed to send packet: %w", err)
+	}
+	return nil
+}
@@ -4,15 +4,10 @@
 	"flag"
 
 	"github.com/safing/portbase/log"
-	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/portmaster/core/journal"
 )
 
-var (
-	// Packets channel for feeding the firewall.
-	Packets = make(chan packet.Packet, 1000)
-
-	disableInterception bool
-)
+var disableInterception bool
 
 func init() {
 	flag.BoolVar(&disableInterception, "disable-interception", false, "disable packet interception; this breaks a lot of functionality")
@@ -25,18 +20,33 @@ func Start() error {
 		return nil
 	}
 
-	inputPackets := Packets
+	if dropCaptureDestination != "" {
+		if err := EnableDropCapture(nil, dropCaptureDestination); err != nil {
+			log.Warningf("interception: failed to enable drop capture: %s", err)
+		}
+	}
+
 	if packetMetricsDestination != "" {
 		go metrics.writeMetrics()
-		inputPackets = make(chan packet.Packet)
-		go func() {
-			for p := range inputPackets {
-				Packets <- tracePacket(p)
-			}
-		}()
 	}
 
-	return start(inputPackets)
+	if err := start(Packets()); err != nil {
+		journal.Send(journal.PriorityError, "failed to start packet interception", journal.Fields{
+			"EVENT": "interception_start_failed",
+			"ERROR": err.Error(),
+		})
+		return err
+	}
+
+	startRuleRebuilds()
+	interceptionReadiness.signal()
+	startResumeWatcher()
+	startConnectionClosedWatcher()
+
+	journal.Send(journal.PriorityInfo, "packet interception started", journal.Fields{
+		"EVENT": "interception_started",
+	})
+	return nil
 }
 
 // Stop starts the interception.
@@ -46,6 +56,13 @@ func Stop() error {
 	}
 
 	close(metrics.done)
+	stopResumeWatcher()
+	stopConnectionClosedWatcher()
+	DisableDropCapture()
+	stopRuleRebuilds()
 
+	journal.Send(journal.PriorityInfo, "stopping packet interception", journal.Fields{
+		"EVENT": "interception_stopping",
+	})
 	return stop()
 }
@@ -3,6 +3,9 @@
 package interception
 
 import (
+	"errors"
+	"net"
+
 	"github.com/safing/portbase/log"
 	"github.com/safing/portmaster/network/packet"
 )
@@ -18,7 +21,166 @@ func stop() error {
 	return nil
 }
 
+// minimumQueueSize returns the capacity the Packets channel needs at least.
+func minimumQueueSize() int {
+	return DefaultQueueSize
+}
+
+// warmup verifies that the interception is fully set up.
+func warmup() error {
+	return nil
+}
+
+// getState adds the platform specific configuration and state of the
+// interception to the given state.
+func getState(state *State) error {
+	state.Mode = "unsupported"
+	return nil
+}
+
+// getEnforcementStatus adds the platform specific enforcement status of the
+// interception to the given status.
+// This platform does not enforce any verdicts.
+func getEnforcementStatus(_ map[Direction]bool) {}
+
+// reload reinstalls the rules and reopens the queues of the interception.
+func reload() error {
+	return nil
+}
+
+// rebuildRules atomically rebuilds the rules of the interception.
+func rebuildRules() error {
+	return nil
+}
+
+// RedirectToLocalPort redirects the outbound TCP connection described by the
+// given packet info to the given port on the local host.
+// This is not supported on this platform.
+func RedirectToLocalPort(_ *packet.Info, _ uint16) error {
+	return errors.New("redirecting to local ports is not supported on this platform")
+}
+
+// GetOriginalDestination returns the destination of a connection before it was
+// redirected with RedirectToLocalPort.
+// This is not supported on this platform.
+func GetOriginalDestination(_ *net.TCPConn) (ip net.IP, port uint16, err error) {
+	return nil, 0, errors.New("redirecting to local ports is not supported on this platform")
+}
+
+// RequestFullCopy makes the interception copy the complete packets of the
+// connection described by the given packet info.
+// This is not supported on this platform.
+func RequestFullCopy(_ *packet.Info) error {
+	return errors.New("selecting the copy mode is not supported on this platform")
+}
+
+// StopFullCopy routes the packets of the connection described by the given
+// packet info back to the general queues.
+// This is not supported on this platform.
+func StopFullCopy(_ *packet.Info) error {
+	return nil
+}
+
+// SetTTLNormalization sets the IPv4 TTL and IPv6 hop limit that accepted
+// packets are rewritten to. A value of 0 disables the normalization.
+// This is not supported on this platform.
+func SetTTLNormalization(value uint8) {
+	if value != 0 {
+		log.Warning("interception: TTL normalization is not supported on this platform")
+	}
+}
+
+// SetCgroupScope limits the interception to the traffic of processes in the
+// given cgroups.
+// This is not supported on this platform.
+func SetCgroupScope(scope CgroupScope) error {
+	if scope.IsEmpty() {
+		return nil
+	}
+	return errors.New("limiting the interception to cgroups is not supported on this platform")
+}
+
+// InjectPacket sends the given raw IP packet, including its IP header, as if
+// it was sent by its source.
+// This is not supported on this platform.
+func InjectPacket(_ []byte) error {
+	return errors.New("injecting packets is not supported on this platform")
+}
+
+// SetInterceptedProtocols limits the interception to the given IP protocols.
+// This is not supported on this platform.
+func SetInterceptedProtocols(protocols []uint8) error {
+	if len(protocols) == 0 {
+		return nil
+	}
+	return errors.New("limiting the interception to protocols is not supported on this platform")
+}
+
+// SetDirectionPaused pauses or resumes enforcing verdicts for the traffic of
+// the given direction.
+// This is not supported on this platform.
+func SetDirectionPaused(_ Direction, paused bool) error {
+	if !paused {
+		return nil
+	}
+	return errors.New("pausing the interception of a direction is not supported on this platform")
+}
+
+// CleanupStaleRules removes any firewall rules that a previous run did not
+// remove. This platform has no rules.
+func CleanupStaleRules() error {
+	return nil
+}
+
+// DumpInstalledRules returns all Portmaster rules that are currently
+// installed in the system firewall. This platform has no rules.
+func DumpInstalledRules() ([]string, error) {
+	return nil, nil
+}
+
+// TrackedFlows returns the original and reply tuples of all connections that
+// are tracked by the OS.
+// This is not supported on this platform.
+func TrackedFlows() ([]*packet.ConntrackTuple, error) {
+	return nil, errors.New("listing tracked connections is not supported on this platform")
+}
+
+// FlowCounters returns the traffic counters of all connections that are
+// tracked by the OS.
+// This is not supported on this platform.
+func FlowCounters() ([]*packet.ConntrackCounters, error) {
+	return nil, errors.New("reading traffic counters of connections is not supported on this platform")
+}
+
+// newConnectionEventSource returns the source of the connections that are not
+// tracked by the OS anymore.
+// This is not supported on this platform.
+func newConnectionEventSource() connectionEventSource {
+	return nil
+}
+
+// ResetVerdictOfConnection resets the connection described by the given
+// packet info, so that its packets go through the firewall again.
+func ResetVerdictOfConnection(info *packet.Info) error {
+	return nil
+}
+
+// PinConnection excludes the connection with the given ID from resetting the
+// verdicts of all connections.
+// This is not supported on this platform.
+func PinConnection(_ string) error {
+	return errors.New("pinning connections is not supported on this platform")
+}
+
 // ResetVerdictOfAllConnections resets all connections so they are forced to go thought the firewall again.
 func ResetVerdictOfAllConnections() error {
 	return nil
 }
+
+// ResetVerdictOfAllConnectionsGradual resets all connections like
+// ResetVerdictOfAllConnections, but in batches at the given rate of
+// connections per second.
+// This is not supported on this platform.
+func ResetVerdictOfAllConnectionsGradual(_ int) (*GradualReset, error) {
+	return nil, errors.New("resetting connections gradually is not supported on this platform")
+}
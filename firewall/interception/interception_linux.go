@@ -1,13 +1,20 @@
 package interception
 
 import (
+	"net"
+
+	"github.com/safing/portbase/log"
+
 	"github.com/safing/portmaster/firewall/interception/nfq"
 	"github.com/safing/portmaster/network/packet"
 )
 
 // start starts the interception.
 func start(ch chan packet.Packet) error {
-	return StartNfqueueInterception(ch)
+	if nfqueueNetns != "" {
+		return StartNfqueueInterceptionInNetns(ch, nfqueueNetns)
+	}
+	return StartNfqueueInterception(ch, getVerdictDecider())
 }
 
 // stop starts the interception.
@@ -15,7 +22,186 @@ func stop() error {
 	return StopNfqueueInterception()
 }
 
+// minimumQueueSize returns the capacity the Packets channel needs at least:
+// Each of the main queues pauses reading only when its backpressure high
+// watermark is reached, so the channel must be able to hold that many packets
+// of every main queue. The other queues only carry few packets.
+func minimumQueueSize() int {
+	return int(backpressureHighWatermark) * mainNfqueueCount
+}
+
+// warmup verifies that the interception is fully set up.
+func warmup() error {
+	return WarmupNfqueueInterception()
+}
+
+// getState adds the platform specific configuration and state of the
+// interception to the given state.
+func getState(state *State) error {
+	return nfqueueState(state)
+}
+
+// getEnforcementStatus adds the platform specific enforcement status of the
+// interception to the given status.
+func getEnforcementStatus(status map[Direction]bool) {
+	nfqueueEnforcementStatus(status)
+}
+
+// reload reinstalls the rules and reopens the queues of the interception.
+func reload() error {
+	return ReloadNfqueueInterception()
+}
+
+// rebuildRules atomically rebuilds the rules of the interception.
+func rebuildRules() error {
+	return rebuildNfqueueFirewall()
+}
+
+// RedirectToLocalPort redirects the outbound TCP connection described by the
+// given packet info to the given port on the local host, using NAT (the
+// iptables REDIRECT target). The original destination can be retrieved by the
+// receiving proxy with GetOriginalDestination. It must be called before the
+// verdict of the first packet of the connection is issued.
+func RedirectToLocalPort(info *packet.Info, port uint16) error {
+	return redirectToLocalPort(info, port)
+}
+
+// GetOriginalDestination returns the destination of a connection before it was
+// redirected with RedirectToLocalPort.
+func GetOriginalDestination(conn *net.TCPConn) (ip net.IP, port uint16, err error) {
+	return getOriginalDestination(conn)
+}
+
+// RequestFullCopy makes the interception copy the complete packets of the
+// connection described by the given packet info, while packets of other
+// connections are only copied partially, if header copy mode is enabled. As the
+// copy mode can only be set per queue, the packets of the connection are
+// routed to dedicated full copy queues. Only TCP and UDP connections are
+// supported. The full copy ends when the connection gets a permanent verdict
+// or StopFullCopy is called. The rules are removed when StopFullCopy is called
+// or when the OS stops tracking the connection.
+func RequestFullCopy(info *packet.Info) error {
+	return requestFullCopy(info)
+}
+
+// StopFullCopy routes the packets of the connection described by the given
+// packet info back to the general queues.
+func StopFullCopy(info *packet.Info) error {
+	return stopFullCopy(info)
+}
+
+// InjectPacket sends the given raw IP packet, including its IP header, as if
+// it was sent by its source, eg. a forged response to a blocked DNS query.
+// The packet bypasses the interception.
+func InjectPacket(data []byte) error {
+	return injectPacket(data)
+}
+
+// SetTTLNormalization sets the IPv4 TTL and IPv6 hop limit that accepted
+// packets are rewritten to. A value of 0 disables the normalization.
+// While the normalization is enabled, no connection gets a permanent accept
+// verdict, as all of its packets must pass through the queues in order to be
+// rewritten. This increases the load of the interception considerably.
+func SetTTLNormalization(value uint8) {
+	if value != 0 {
+		log.Warningf("interception: normalizing TTL to %d, accepted connections will not be permanently accepted", value)
+	}
+	nfq.SetTTLNormalization(value)
+}
+
+// SetCgroupScope limits the interception to the traffic of processes in the
+// given cgroups. An empty scope intercepts all traffic. If the interception is
+// active, the rules are rebuilt.
+func SetCgroupScope(scope CgroupScope) error {
+	return setCgroupScope(scope)
+}
+
+// SetInterceptedProtocols limits the interception to the given IP protocols,
+// eg. to only TCP for targeted debugging. The queue rules of the ingest
+// chains then only match packets of these protocols, while packets of all
+// other protocols are accepted without being handed to the Portmaster, which
+// includes DNS queries if UDP is not intercepted. An empty list intercepts all
+// protocols. If the interception is active, the rules are rebuilt.
+func SetInterceptedProtocols(protocols []uint8) error {
+	return setInterceptedProtocols(protocols)
+}
+
+// SetDirectionPaused pauses or resumes enforcing verdicts for the traffic of
+// the given direction. While paused, the packets of the direction are
+// accepted without being handed to the Portmaster, including packets of
+// connections with a permanent verdict. Connections that requested full
+// copies are still handed over. If the interception is active, the rules are
+// rebuilt. Forwarded traffic is not intercepted and cannot be paused.
+func SetDirectionPaused(dir Direction, paused bool) error {
+	return setDirectionPaused(dir, paused)
+}
+
+// CleanupStaleRules removes all firewall rules and chains of the Portmaster and
+// clears all conntrack entries with Portmaster verdict marks. This recovers
+// from a previous run that did not shut down cleanly. Rules are identified by
+// the Portmaster rule comment or by jumping to a Portmaster chain, other rules
+// are never touched. It is idempotent and must not be called while the
+// interception is active.
+func CleanupStaleRules() error {
+	return cleanupStaleRules()
+}
+
+// DumpInstalledRules returns all Portmaster rules that are currently
+// installed in the system firewall, independent of the rules the interception
+// intends to install. It includes rules left behind by a previous run or by a
+// partially failed installation.
+func DumpInstalledRules() ([]string, error) {
+	return dumpInstalledRules()
+}
+
+// TrackedFlows returns the original and reply tuples of all connections that
+// are tracked by the OS.
+func TrackedFlows() ([]*packet.ConntrackTuple, error) {
+	return nfq.TrackedFlows()
+}
+
+// FlowCounters returns the traffic counters of all connections that are
+// tracked by the OS.
+func FlowCounters() ([]*packet.ConntrackCounters, error) {
+	return nfq.FlowCounters()
+}
+
+// ResetVerdictOfConnection resets the connection described by the given
+// packet info, so that its packets go through the firewall again.
+func ResetVerdictOfConnection(info *packet.Info) error {
+	return nfq.DeleteConnection(info)
+}
+
+// PinConnection excludes the connection with the given ID, see
+// packet.Packet.GetConnectionID, from ResetVerdictOfAllConnections and
+// ResetVerdictOfAllConnectionsGradual, so that its permanent verdict stays in
+// place. Resetting the connection with ResetVerdictOfConnection is not
+// affected.
+func PinConnection(id string) error {
+	pinConnection(id)
+	return nil
+}
+
 // ResetVerdictOfAllConnections resets all connections so they are forced to go thought the firewall again.
+// Pinned connections are not reset, see PinConnection.
 func ResetVerdictOfAllConnections() error {
 	return nfq.DeleteAllMarkedConnection()
 }
+
+// ResetVerdictOfAllConnectionsGradual resets all connections like
+// ResetVerdictOfAllConnections, but in batches at the given rate of
+// connections per second, so that the load of re-evaluating the connections is
+// spread over time. The connections to reset are collected when called;
+// connections that get a permanent verdict afterwards are not reset. Pinned
+// connections are not reset, see PinConnection.
+func ResetVerdictOfAllConnectionsGradual(rate int) (*GradualReset, error) {
+	marked, err := nfq.MarkedConnections()
+	if err != nil {
+		return nil, err
+	}
+
+	return startGradualReset(len(marked), rate, func(from, to int) error {
+		_, err := nfq.DeleteMarkedConnections(marked[from:to])
+		return err
+	})
+}
@@ -1,8 +1,11 @@
 package interception
 
 import (
+	"errors"
 	"fmt"
+	"net"
 
+	"github.com/safing/portbase/log"
 	"github.com/safing/portmaster/firewall/interception/windowskext"
 	"github.com/safing/portmaster/network/packet"
 	"github.com/safing/portmaster/updates"
@@ -29,7 +32,14 @@ func start(ch chan packet.Packet) error {
 		return fmt.Errorf("interception: could not start windows kext: %s", err)
 	}
 
-	go windowskext.Handler(ch)
+	// Forward packets from the kext without blocking it when the queue is full.
+	kextPackets := make(chan packet.Packet)
+	go windowskext.Handler(kextPackets)
+	go func() {
+		for pkt := range kextPackets {
+			enqueuePacket(ch, pkt)
+		}
+	}()
 
 	return nil
 }
@@ -39,7 +49,178 @@ func stop() error {
 	return windowskext.Stop()
 }
 
+// minimumQueueSize returns the capacity the Packets channel needs at least.
+func minimumQueueSize() int {
+	return DefaultQueueSize
+}
+
+// warmup verifies that the interception is fully set up.
+// The kext is fully set up when started.
+func warmup() error {
+	return nil
+}
+
+// getState adds the platform specific configuration and state of the
+// interception to the given state.
+func getState(state *State) error {
+	state.Mode = "windowskext"
+	state.Active = windowskext.IsReady()
+	return nil
+}
+
+// getEnforcementStatus adds the platform specific enforcement status of the
+// interception to the given status.
+// The kext enforces verdicts for inbound and outbound traffic while it is
+// ready.
+func getEnforcementStatus(status map[Direction]bool) {
+	if windowskext.IsReady() {
+		status[DirectionOutbound] = true
+		status[DirectionInbound] = true
+	}
+}
+
+// reload reinstalls the rules and reopens the queues of the interception.
+// The kext survives system suspends and needs no reload.
+func reload() error {
+	return nil
+}
+
+// rebuildRules atomically rebuilds the rules of the interception.
+// The kext does not use any rules.
+func rebuildRules() error {
+	return nil
+}
+
+// RedirectToLocalPort redirects the outbound TCP connection described by the
+// given packet info to the given port on the local host.
+// This is not supported by the kext.
+func RedirectToLocalPort(_ *packet.Info, _ uint16) error {
+	return errors.New("redirecting to local ports is not supported on this platform")
+}
+
+// GetOriginalDestination returns the destination of a connection before it was
+// redirected with RedirectToLocalPort.
+// This is not supported by the kext.
+func GetOriginalDestination(_ *net.TCPConn) (ip net.IP, port uint16, err error) {
+	return nil, 0, errors.New("redirecting to local ports is not supported on this platform")
+}
+
+// RequestFullCopy makes the interception copy the complete packets of the
+// connection described by the given packet info.
+// The kext always copies complete packets.
+func RequestFullCopy(_ *packet.Info) error {
+	return nil
+}
+
+// StopFullCopy routes the packets of the connection described by the given
+// packet info back to the general queues.
+// The kext always copies complete packets.
+func StopFullCopy(_ *packet.Info) error {
+	return nil
+}
+
+// SetTTLNormalization sets the IPv4 TTL and IPv6 hop limit that accepted
+// packets are rewritten to. A value of 0 disables the normalization.
+// This is not supported by the kext.
+func SetTTLNormalization(value uint8) {
+	if value != 0 {
+		log.Warning("interception: TTL normalization is not supported on this platform")
+	}
+}
+
+// SetCgroupScope limits the interception to the traffic of processes in the
+// given cgroups.
+// This is not supported by the kext.
+func SetCgroupScope(scope CgroupScope) error {
+	if scope.IsEmpty() {
+		return nil
+	}
+	return errors.New("limiting the interception to cgroups is not supported on this platform")
+}
+
+// InjectPacket sends the given raw IP packet, including its IP header, as if
+// it was sent by its source.
+// This is not supported by the kext.
+func InjectPacket(_ []byte) error {
+	return errors.New("injecting packets is not supported on this platform")
+}
+
+// SetInterceptedProtocols limits the interception to the given IP protocols.
+// This is not supported by the kext.
+func SetInterceptedProtocols(protocols []uint8) error {
+	if len(protocols) == 0 {
+		return nil
+	}
+	return errors.New("limiting the interception to protocols is not supported on this platform")
+}
+
+// SetDirectionPaused pauses or resumes enforcing verdicts for the traffic of
+// the given direction.
+// This is not supported by the kext.
+func SetDirectionPaused(_ Direction, paused bool) error {
+	if !paused {
+		return nil
+	}
+	return errors.New("pausing the interception of a direction is not supported on this platform")
+}
+
+// CleanupStaleRules removes any firewall rules that a previous run did not
+// remove. The Windows integration does not use any firewall rules.
+func CleanupStaleRules() error {
+	return nil
+}
+
+// DumpInstalledRules returns all Portmaster rules that are currently
+// installed in the system firewall. The Windows integration does not use any
+// firewall rules.
+func DumpInstalledRules() ([]string, error) {
+	return nil, nil
+}
+
+// TrackedFlows returns the original and reply tuples of all connections that
+// are tracked by the OS.
+// This is not supported by the kext.
+func TrackedFlows() ([]*packet.ConntrackTuple, error) {
+	return nil, errors.New("listing tracked connections is not supported on this platform")
+}
+
+// FlowCounters returns the traffic counters of all connections that are
+// tracked by the OS.
+// This is not supported by the kext.
+func FlowCounters() ([]*packet.ConntrackCounters, error) {
+	return nil, errors.New("reading traffic counters of connections is not supported on this platform")
+}
+
+// newConnectionEventSource returns the source of the connections that are not
+// tracked by the OS anymore.
+// This is not supported on this platform.
+func newConnectionEventSource() connectionEventSource {
+	return nil
+}
+
+// ResetVerdictOfConnection resets the connection described by the given
+// packet info, so that its packets go through the firewall again.
+// This is not supported by the kext.
+func ResetVerdictOfConnection(info *packet.Info) error {
+	return errors.New("resetting the verdict of a single connection is not supported on this platform")
+}
+
+// PinConnection excludes the connection with the given ID from resetting the
+// verdicts of all connections.
+// This is not supported on this platform.
+func PinConnection(_ string) error {
+	return errors.New("pinning connections is not supported on this platform")
+}
+
 // ResetVerdictOfAllConnections resets all connections so they are forced to go thought the firewall again.
 func ResetVerdictOfAllConnections() error {
 	return windowskext.ClearCache()
 }
+
+// ResetVerdictOfAllConnectionsGradual resets all connections like
+// ResetVerdictOfAllConnections, but in batches at the given rate of
+// connections per second.
+// This is not supported by the kext.
+func ResetVerdictOfAllConnectionsGradual(_ int) (*GradualReset, error) {
+	return nil, errors.New("resetting connections gradually is not supported on this platform")
+}
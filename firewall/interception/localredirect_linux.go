@@ -0,0 +1,212 @@
+package interception
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/coreos/go-iptables/iptables"
+	"golang.org/x/sys/unix"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// localPortRedirectTTL defines how long the redirect rule of a connection is
+// kept. The rule is only needed for the first packet of the connection, as the
+// address translation is stored in the conntrack entry from then on.
+const localPortRedirectTTL = 1 * time.Minute
+
+// soOriginalDst is the socket option to get the original destination of a
+// connection before address translation, for both IPv4 and IPv6.
+const soOriginalDst = 80
+
+var (
+	localPortRedirects     = make(map[string]*localPortRedirect)
+	localPortRedirectsLock sync.Mutex
+)
+
+type localPortRedirect struct {
+	protocol iptables.Protocol
+	rule     string
+	timer    *time.Timer
+}
+
+// redirectToLocalPort installs an iptables NAT REDIRECT rule for the outbound
+// TCP connection described by the given packet info. The rule must be
+// installed before the verdict of the first packet of the connection is
+// issued, as NAT rules are only evaluated for the first packet.
+func redirectToLocalPort(info *packet.Info, port uint16) error {
+	if info.Protocol != packet.TCP || info.Inbound {
+		return errors.New("only outbound TCP connections can be redirected")
+	}
+
+	protocol := iptables.ProtocolIPv4
+	if info.Version == packet.IPv6 {
+		protocol = iptables.ProtocolIPv6
+	}
+	rule := fmt.Sprintf(
+		"nat PORTMASTER-REDIRECT -p tcp -s %s --sport %d -d %s --dport %d -j REDIRECT --to-ports %d",
+		info.Src, info.SrcPort, info.Dst, info.DstPort, port,
+	)
+	id := localPortRedirectID(info)
+
+	localPortRedirectsLock.Lock()
+	defer localPortRedirectsLock.Unlock()
+
+	// Replace any existing redirect of the connection.
+	if existing, ok := localPortRedirects[id]; ok {
+		if existing.rule == rule {
+			return nil
+		}
+		existing.timer.Stop()
+		if err := deleteLocalPortRedirectRule(existing); err != nil {
+			return err
+		}
+		delete(localPortRedirects, id)
+	}
+
+	redirect := &localPortRedirect{
+		protocol: protocol,
+		rule:     rule,
+	}
+	if err := insertLocalPortRedirectRule(redirect); err != nil {
+		return err
+	}
+	redirect.timer = time.AfterFunc(localPortRedirectTTL, func() {
+		removeLocalPortRedirect(id, redirect)
+	})
+	localPortRedirects[id] = redirect
+
+	return nil
+}
+
+func localPortRedirectID(info *packet.Info) string {
+	return fmt.Sprintf("%s:%d-%s:%d", info.Src, info.SrcPort, info.Dst, info.DstPort)
+}
+
+func removeLocalPortRedirect(id string, redirect *localPortRedirect) {
+	localPortRedirectsLock.Lock()
+	defer localPortRedirectsLock.Unlock()
+
+	if localPortRedirects[id] != redirect {
+		return
+	}
+	delete(localPortRedirects, id)
+
+	if err := deleteLocalPortRedirectRule(redirect); err != nil {
+		log.Warningf("interception: failed to remove local port redirect: %s", err)
+	}
+}
+
+func insertLocalPortRedirectRule(redirect *localPortRedirect) error {
+	tbls, err := openIPTables(redirect.protocol)
+	if err != nil {
+		return err
+	}
+
+	splittedRule := strings.Split(redirect.rule, " ")
+	if err := tbls.Insert(splittedRule[0], splittedRule[1], 1, splittedRule[2:]...); err != nil {
+		return fmt.Errorf("failed to install local port redirect: %w", err)
+	}
+	return nil
+}
+
+func deleteLocalPortRedirectRule(redirect *localPortRedirect) error {
+	tbls, err := openIPTables(redirect.protocol)
+	if err != nil {
+		return err
+	}
+
+	splittedRule := strings.Split(redirect.rule, " ")
+	ok, err := tbls.Exists(splittedRule[0], splittedRule[1], splittedRule[2:]...)
+	if err != nil || !ok {
+		return err
+	}
+	return tbls.Delete(splittedRule[0], splittedRule[1], splittedRule[2:]...)
+}
+
+// withLocalPortRedirects returns the rules together with the rules of all
+// active local port redirects of the given protocol, so that they survive
+// rebuilding the rules.
+func withLocalPortRedirects(protocol iptables.Protocol, rules []string) []string {
+	localPortRedirectsLock.Lock()
+	defer localPortRedirectsLock.Unlock()
+
+	if len(localPortRedirects) == 0 {
+		return rules
+	}
+
+	combined := make([]string, 0, len(rules)+len(localPortRedirects))
+	for _, redirect := range localPortRedirects {
+		if redirect.protocol == protocol {
+			combined = append(combined, redirect.rule)
+		}
+	}
+	return append(combined, rules...)
+}
+
+// resetLocalPortRedirects forgets all local port redirects. It is used when
+// the rules are removed.
+func resetLocalPortRedirects() {
+	localPortRedirectsLock.Lock()
+	defer localPortRedirectsLock.Unlock()
+
+	for id, redirect := range localPortRedirects {
+		redirect.timer.Stop()
+		delete(localPortRedirects, id)
+	}
+}
+
+// getOriginalDestination returns the destination of a redirected connection
+// before address translation. It is available for connections redirected via
+// NAT, such as the ones redirected by RedirectToLocalPort.
+func getOriginalDestination(conn *net.TCPConn) (ip net.IP, port uint16, err error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	localAddr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, 0, errors.New("unexpected local address type")
+	}
+	v4 := localAddr.IP.To4() != nil
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		// The kernel returns a sockaddr_in or sockaddr_in6, which are read
+		// using structs of matching size.
+		if v4 {
+			var mreq *unix.IPv6Mreq
+			mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+			if sockErr == nil {
+				// struct sockaddr_in: family (2), port (2), address (4)
+				ip = net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7])
+				port = binary.BigEndian.Uint16(mreq.Multiaddr[2:4])
+			}
+		} else {
+			var mtuInfo *unix.IPv6MTUInfo
+			mtuInfo, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst)
+			if sockErr == nil {
+				ip = make(net.IP, net.IPv6len)
+				copy(ip, mtuInfo.Addr.Addr[:])
+				portBytes := (*[2]byte)(unsafe.Pointer(&mtuInfo.Addr.Port))
+				port = binary.BigEndian.Uint16(portBytes[:])
+			}
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if sockErr != nil {
+		return nil, 0, fmt.Errorf("failed to get original destination: %w", sockErr)
+	}
+
+	return ip, port, nil
+}
@@ -0,0 +1,116 @@
+package interception
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+
+	"github.com/safing/portmaster/network/packet"
+)
+
+func filterRulesByTable(rules []string, table string) (filtered []string) {
+	for _, rule := range rules {
+		if strings.HasPrefix(rule, table+" ") {
+			filtered = append(filtered, rule)
+		}
+	}
+	return filtered
+}
+
+func TestRedirectToLocalPort(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	// Skip in CI.
+	if testing.Short() {
+		t.Skip()
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("redirecting requires root")
+	}
+
+	newIPTables = func(protocol iptables.Protocol) (ipTables, error) {
+		return iptables.NewWithProtocol(protocol)
+	}
+	if _, err := newIPTables(iptables.ProtocolIPv4); err != nil {
+		t.Skipf("iptables not available: %s", err)
+	}
+
+	// Only install the NAT rules, as the filter rules would block all
+	// traffic without the queues being handled.
+	buildRules()
+	natChains := filterRulesByTable(v4chains, "nat")
+	natRules := filterRulesByTable(v4rules, "nat")
+	natOnce := filterRulesByTable(v4once, "nat")
+	if err := activateIPTables(iptables.ProtocolIPv4, natRules, natOnce, natChains); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		resetLocalPortRedirects()
+		if err := deactivateIPTables(iptables.ProtocolIPv4, natOnce, natChains); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// Start the local proxy.
+	proxy, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = proxy.Close()
+	}()
+	proxyPort := proxy.Addr().(*net.TCPAddr).Port //nolint:forcetypeassert // TCP listener.
+
+	// Get a free local port for the connection.
+	portListener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	localPort := portListener.Addr().(*net.TCPAddr).Port //nolint:forcetypeassert // TCP listener.
+	_ = portListener.Close()
+
+	// Redirect the connection before it is started.
+	originalDst := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 9}
+	err = redirectToLocalPort(&packet.Info{
+		Version:  packet.IPv4,
+		Protocol: packet.TCP,
+		Src:      net.IPv4(127, 0, 0, 1),
+		SrcPort:  uint16(localPort),
+		Dst:      originalDst.IP,
+		DstPort:  uint16(originalDst.Port),
+	}, uint16(proxyPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dialer := &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: localPort},
+		Timeout:   3 * time.Second,
+	}
+	conn, err := dialer.Dial("tcp4", originalDst.String())
+	if err != nil {
+		t.Fatalf("redirected connection did not reach the local port: %s", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	// Check if the proxy can recover the original destination.
+	_ = proxy.SetDeadline(time.Now().Add(3 * time.Second))
+	proxyConn, err := proxy.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = proxyConn.Close()
+	}()
+	ip, port, err := getOriginalDestination(proxyConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(originalDst.IP) || int(port) != originalDst.Port {
+		t.Errorf("unexpected original destination %s:%d, expected %s", ip, port, originalDst)
+	}
+}
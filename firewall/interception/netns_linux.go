@@ -0,0 +1,112 @@
+package interception
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/coreos/go-iptables/iptables"
+
+	"github.com/safing/portmaster/firewall/interception/nfq"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// StartNfqueueInterceptionInNetns starts the nfqueue interception in the
+// network namespace given by the path of its namespace file, eg.
+// /var/run/netns/<name> or /proc/<pid>/ns/net, instead of the namespace of
+// the Portmaster. The queues are bound and the rules are installed within
+// the namespace, so that only its traffic is filtered. Packets are decided
+// like with StartNfqueueInterception.
+// Entering the namespace requires CAP_SYS_ADMIN. As network namespaces are
+// entered per OS thread, every socket and rule operation is run on a
+// dedicated thread that is pinned to the goroutine for the duration of the
+// operation, see nfq.InNetns. The namespace is left when the interception is
+// stopped.
+func StartNfqueueInterceptionInNetns(packets chan<- packet.Packet, nsPath string) error {
+	if nsPath == "" {
+		return errors.New("no network namespace given")
+	}
+	if err := nfq.SetNetns(nsPath); err != nil {
+		return fmt.Errorf("failed to use network namespace: %w", err)
+	}
+
+	if err := StartNfqueueInterception(packets, getVerdictDecider()); err != nil {
+		_ = nfq.SetNetns("")
+		return err
+	}
+	return nil
+}
+
+// netnsIPTables runs all iptables operations in the network namespace of the
+// interception.
+type netnsIPTables struct {
+	tbls *iptables.IPTables
+}
+
+func newNetnsIPTables(protocol iptables.Protocol) (tbls *netnsIPTables, err error) {
+	tbls = &netnsIPTables{}
+	err = nfq.InNetns(func() (err error) {
+		tbls.tbls, err = iptables.NewWithProtocol(protocol)
+		return err
+	})
+	return tbls, err
+}
+
+func (nt *netnsIPTables) Exists(table, chain string, rulespec ...string) (exists bool, err error) {
+	err = nfq.InNetns(func() (err error) {
+		exists, err = nt.tbls.Exists(table, chain, rulespec...)
+		return err
+	})
+	return exists, err
+}
+
+func (nt *netnsIPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	return nfq.InNetns(func() error {
+		return nt.tbls.Insert(table, chain, pos, rulespec...)
+	})
+}
+
+func (nt *netnsIPTables) Append(table, chain string, rulespec ...string) error {
+	return nfq.InNetns(func() error {
+		return nt.tbls.Append(table, chain, rulespec...)
+	})
+}
+
+func (nt *netnsIPTables) Delete(table, chain string, rulespec ...string) error {
+	return nfq.InNetns(func() error {
+		return nt.tbls.Delete(table, chain, rulespec...)
+	})
+}
+
+func (nt *netnsIPTables) ClearChain(table, chain string) error {
+	return nfq.InNetns(func() error {
+		return nt.tbls.ClearChain(table, chain)
+	})
+}
+
+func (nt *netnsIPTables) DeleteChain(table, chain string) error {
+	return nfq.InNetns(func() error {
+		return nt.tbls.DeleteChain(table, chain)
+	})
+}
+
+func (nt *netnsIPTables) RenameChain(table, oldChain, newChain string) error {
+	return nfq.InNetns(func() error {
+		return nt.tbls.RenameChain(table, oldChain, newChain)
+	})
+}
+
+func (nt *netnsIPTables) List(table, chain string) (rules []string, err error) {
+	err = nfq.InNetns(func() (err error) {
+		rules, err = nt.tbls.List(table, chain)
+		return err
+	})
+	return rules, err
+}
+
+func (nt *netnsIPTables) ListChains(table string) (chains []string, err error) {
+	err = nfq.InNetns(func() (err error) {
+		chains, err = nt.tbls.ListChains(table)
+		return err
+	})
+	return chains, err
+}
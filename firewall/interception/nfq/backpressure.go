@@ -0,0 +1,102 @@
+//go:build linux
+
+package nfq
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Default backpressure watermarks, see SetBackpressureWatermarks.
+const (
+	DefaultBackpressureHighWatermark = 2000
+	DefaultBackpressureLowWatermark  = 1000
+)
+
+// maxBackpressurePause defines how long a queue pauses reading at most, before
+// it reads the next packet, even if the outstanding packets did not drain yet.
+// This keeps packets flowing, if only slowly, when the verdict engine stalls.
+const maxBackpressurePause = 100 * time.Millisecond
+
+var (
+	backpressureHighWatermark uint32 = DefaultBackpressureHighWatermark
+	backpressureLowWatermark  uint32 = DefaultBackpressureLowWatermark
+)
+
+// SetBackpressureWatermarks sets the number of packets waiting for a verdict,
+// per queue, at which a queue pauses reading packets from the kernel (high)
+// and at which it resumes reading (low). While reading is paused, packets
+// wait in the kernel queue instead of in memory. A high watermark of 0
+// disables the backpressure.
+func SetBackpressureWatermarks(high, low uint32) error {
+	if high > 0 && low >= high {
+		return errors.New("low backpressure watermark must be lower than the high watermark")
+	}
+
+	atomic.StoreUint32(&backpressureHighWatermark, high)
+	atomic.StoreUint32(&backpressureLowWatermark, low)
+	return nil
+}
+
+// BackpressureWatermarks returns the backpressure watermarks.
+func BackpressureWatermarks() (high, low uint32) {
+	return atomic.LoadUint32(&backpressureHighWatermark), atomic.LoadUint32(&backpressureLowWatermark)
+}
+
+// backpressure tracks the packets of a queue that wait for a verdict and
+// pauses the read loop while there are too many of them.
+type backpressure struct {
+	outstanding int64
+
+	// completed is signaled when a packet got its verdict.
+	completed chan struct{}
+}
+
+func newBackpressure() *backpressure {
+	return &backpressure{
+		completed: make(chan struct{}, 1),
+	}
+}
+
+// add records a packet that is waiting for a verdict.
+func (bp *backpressure) add() {
+	atomic.AddInt64(&bp.outstanding, 1)
+}
+
+// done records that a packet got its verdict.
+func (bp *backpressure) done() {
+	atomic.AddInt64(&bp.outstanding, -1)
+	select {
+	case bp.completed <- struct{}{}:
+	default:
+	}
+}
+
+// waiting returns the number of packets waiting for a verdict.
+func (bp *backpressure) waiting() int64 {
+	return atomic.LoadInt64(&bp.outstanding)
+}
+
+// wait pauses if the outstanding packets reached the high watermark, until
+// they drained below the low watermark, at most for maxPause. It returns
+// whether it paused.
+func (bp *backpressure) wait(ctx context.Context, high, low uint32, maxPause time.Duration) (paused bool) {
+	if high == 0 || bp.waiting() < int64(high) {
+		return false
+	}
+	timer := time.NewTimer(maxPause)
+	defer timer.Stop()
+
+	for bp.waiting() > int64(low) {
+		select {
+		case <-bp.completed:
+		case <-timer.C:
+			return true
+		case <-ctx.Done():
+			return true
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+//go:build linux
+
+package nfq
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackpressure(t *testing.T) {
+	t.Parallel()
+
+	const (
+		packets = 200
+		high    = 20
+		low     = 10
+	)
+
+	// Simulate a slow verdict engine with an unbounded backlog.
+	bp := newBackpressure()
+	backlog := make(chan struct{}, packets)
+	engineDone := make(chan struct{})
+	go func() {
+		defer close(engineDone)
+		for i := 0; i < packets; i++ {
+			<-backlog
+			time.Sleep(100 * time.Microsecond)
+			bp.done()
+		}
+	}()
+
+	// Simulate the read loop.
+	var pauses int
+	var maxWaiting int64
+	for i := 0; i < packets; i++ {
+		bp.add()
+		backlog <- struct{}{}
+		if waiting := bp.waiting(); waiting > maxWaiting {
+			maxWaiting = waiting
+		}
+
+		if bp.wait(context.Background(), high, low, time.Second) {
+			pauses++
+			if waiting := bp.waiting(); waiting > low {
+				t.Errorf("read loop resumed with %d waiting packets, expected at most %d", waiting, low)
+			}
+		}
+	}
+	<-engineDone
+
+	if maxWaiting > high {
+		t.Errorf("%d packets were waiting for a verdict, expected at most %d", maxWaiting, high)
+	}
+	if pauses == 0 {
+		t.Error("read loop was never paused")
+	}
+	if waiting := bp.waiting(); waiting != 0 {
+		t.Errorf("expected no waiting packets, got %d", waiting)
+	}
+
+	// Disabled backpressure never pauses.
+	for i := 0; i < high; i++ {
+		bp.add()
+	}
+	if bp.wait(context.Background(), 0, 0, time.Second) {
+		t.Error("disabled backpressure should not pause")
+	}
+
+	// A stalled verdict engine only pauses the read loop for the max pause.
+	started := time.Now()
+	if !bp.wait(context.Background(), high, low, 10*time.Millisecond) {
+		t.Error("stalled verdict engine should pause the read loop")
+	}
+	if paused := time.Since(started); paused > time.Second {
+		t.Errorf("read loop was paused for %s, expected about 10ms", paused)
+	}
+}
+
+func TestSetBackpressureWatermarks(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func() {
+		_ = SetBackpressureWatermarks(DefaultBackpressureHighWatermark, DefaultBackpressureLowWatermark)
+	}()
+
+	if err := SetBackpressureWatermarks(10, 10); err == nil {
+		t.Error("low watermark must be lower than the high watermark")
+	}
+	if err := SetBackpressureWatermarks(0, 0); err != nil {
+		t.Errorf("disabling the backpressure should succeed: %s", err)
+	}
+	if err := SetBackpressureWatermarks(100, 50); err != nil {
+		t.Fatal(err)
+	}
+	if high, low := BackpressureWatermarks(); high != 100 || low != 50 {
+		t.Errorf("unexpected watermarks %d/%d", high, low)
+	}
+}
@@ -4,16 +4,80 @@
 
 import (
 	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
 
 	ct "github.com/florianl/go-conntrack"
+	"golang.org/x/sys/unix"
 
 	"github.com/safing/portbase/log"
 	"github.com/safing/portmaster/netenv"
+	pmpacket "github.com/safing/portmaster/network/packet"
 )
 
-// DeleteAllMarkedConnection deletes all marked entries from the conntrack table.
+// conntrackZone holds the conntrack zone the Portmaster operates in.
+var conntrackZone uint32
+
+// SetConntrackZone sets the conntrack zone the Portmaster operates in.
+// Permanent verdicts are only saved to connections of this zone, only
+// connections of this zone are deleted when resetting permanent verdicts and
+// only connections of this zone are returned by lookups of the conntrack table.
+// Packets of connections in other zones still get a verdict, but it is not
+// made permanent. The default is zone 0, which is the zone of all connections
+// that are not explicitly assigned to another zone, eg. with the iptables CT
+// target.
+func SetConntrackZone(zone uint16) {
+	atomic.StoreUint32(&conntrackZone, uint32(zone))
+}
+
+// ConntrackZone returns the conntrack zone the Portmaster operates in.
+func ConntrackZone() uint16 {
+	return uint16(atomic.LoadUint32(&conntrackZone))
+}
+
+var (
+	resetExclusion     func(tuple *pmpacket.ConntrackTuple) bool
+	resetExclusionLock sync.RWMutex
+)
+
+// SetResetExclusion sets the function that decides which connections are
+// excluded from resetting the permanent verdicts of all connections, such as
+// pinned connections. It is called with the original tuple of the connection.
+func SetResetExclusion(fn func(tuple *pmpacket.ConntrackTuple) bool) {
+	resetExclusionLock.Lock()
+	defer resetExclusionLock.Unlock()
+
+	resetExclusion = fn
+}
+
+// excludedFromReset returns whether the entry is excluded from resetting the
+// permanent verdicts of all connections, see SetResetExclusion.
+func excludedFromReset(connection ct.Con) bool {
+	resetExclusionLock.RLock()
+	defer resetExclusionLock.RUnlock()
+
+	if resetExclusion == nil {
+		return false
+	}
+	tuple := conntrackTuple(connection.Origin)
+	return tuple != nil && resetExclusion(tuple)
+}
+
+// openConntrack opens a conntrack socket in the configured network namespace.
+func openConntrack() (nfct *ct.Nfct, err error) {
+	err = InNetns(func() error {
+		nfct, err = ct.Open(&ct.Config{})
+		return err
+	})
+	return nfct, err
+}
+
+// DeleteAllMarkedConnection deletes all marked entries of the configured
+// conntrack zone from the conntrack table, except for the excluded ones, see
+// SetResetExclusion.
 func DeleteAllMarkedConnection() error {
-	nfct, err := ct.Open(&ct.Config{})
+	nfct, err := openConntrack()
 	if err != nil {
 		return err
 	}
@@ -32,14 +96,34 @@ func DeleteAllMarkedConnection() error {
 }
 
 func deleteMarkedConnections(nfct *ct.Nfct, f ct.Family) (deleted int) {
+	numberOfErrors := 0
+	var deleteError error = nil
+	for _, connection := range queryMarkedConnections(nfct, f) {
+		err := nfct.Delete(ct.Conntrack, f, connection)
+		if err != nil {
+			deleteError = err
+			numberOfErrors++
+		} else {
+			deleted++
+		}
+	}
+
+	if numberOfErrors > 0 {
+		log.Warningf("nfq: failed to delete %d conntrack entries last error is: %s", numberOfErrors, deleteError)
+	}
+	return deleted
+}
+
+// queryMarkedConnections returns all entries of the configured conntrack zone
+// with a permanent verdict mark that are not excluded from resets.
+func queryMarkedConnections(nfct *ct.Nfct, f ct.Family) (marked []ct.Con) {
 	// initialize variables
 	permanentFlags := []uint32{MarkAcceptAlways, MarkBlockAlways, MarkDropAlways, MarkRerouteNS, MarkRerouteSPN}
 	filter := ct.FilterAttr{}
 	filter.MarkMask = []byte{0xFF, 0xFF, 0xFF, 0xFF}
 	filter.Mark = []byte{0x00, 0x00, 0x00, 0x00} // 4 zeros starting value
 
-	numberOfErrors := 0
-	var deleteError error = nil
+	zone := ConntrackZone()
 	// Get all connections from the specified family (ipv4 or ipv6)
 	for _, mark := range permanentFlags {
 		binary.BigEndian.PutUint32(filter.Mark, mark) // Little endian is in reverse not sure why. BigEndian makes it in correct order.
@@ -48,19 +132,268 @@ func deleteMarkedConnections(nfct *ct.Nfct, f ct.Family) (deleted int) {
 			log.Warningf("nfq: error on conntrack query: %s", err)
 			continue
 		}
+		marked = append(marked, resettableConnections(currentConnections, zone)...)
+	}
+	return marked
+}
+
+// resettableConnections returns the entries of the given zone that are not
+// excluded from resets.
+func resettableConnections(connections []ct.Con, zone uint16) (resettable []ct.Con) {
+	for _, connection := range connections {
+		if connectionZone(connection) != zone || excludedFromReset(connection) {
+			continue
+		}
+		resettable = append(resettable, connection)
+	}
+	return resettable
+}
+
+// MarkedConnection is an entry of the conntrack table with a permanent verdict
+// mark.
+type MarkedConnection struct {
+	family     ct.Family
+	connection ct.Con
+}
+
+// MarkedConnections returns all entries of the configured conntrack zone with
+// a permanent verdict mark, except for the excluded ones, so that they can be deleted in batches with
+// DeleteMarkedConnections.
+func MarkedConnections() ([]MarkedConnection, error) {
+	nfct, err := openConntrack()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = nfct.Close() }()
+
+	families := []ct.Family{ct.IPv4}
+	if netenv.IPv6Enabled() {
+		families = append(families, ct.IPv6)
+	}
+
+	var marked []MarkedConnection
+	for _, f := range families {
+		for _, connection := range queryMarkedConnections(nfct, f) {
+			marked = append(marked, MarkedConnection{family: f, connection: connection})
+		}
+	}
+	return marked, nil
+}
+
+// DeleteMarkedConnections deletes the given entries from the conntrack table.
+// Entries that do not exist anymore or were excluded from resets since they
+// were collected are ignored. It returns the last error.
+func DeleteMarkedConnections(marked []MarkedConnection) (deleted int, err error) {
+	nfct, err := openConntrack()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = nfct.Close() }()
 
-		for _, connection := range currentConnections {
-			deleteError = nfct.Delete(ct.Conntrack, ct.IPv4, connection)
-			if err != nil {
-				numberOfErrors++
-			} else {
-				deleted++
-			}
+	var lastErr error
+	for _, entry := range marked {
+		if excludedFromReset(entry.connection) {
+			continue
+		}
+		err := nfct.Delete(ct.Conntrack, entry.family, entry.connection)
+		switch {
+		case err == nil:
+			deleted++
+		case !errors.Is(err, unix.ENOENT):
+			lastErr = err
 		}
 	}
+	return deleted, lastErr
+}
 
-	if numberOfErrors > 0 {
-		log.Warningf("nfq: failed to delete %d conntrack entries last error is: %s", numberOfErrors, deleteError)
+func connectionZone(connection ct.Con) uint16 {
+	if connection.Zone == nil {
+		return 0
 	}
-	return deleted
+	return *connection.Zone
+}
+
+// TrackedFlows returns the original and reply tuples of all entries of the
+// configured conntrack zone in the conntrack table.
+func TrackedFlows() ([]*pmpacket.ConntrackTuple, error) {
+	nfct, err := openConntrack()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = nfct.Close() }()
+
+	families := []ct.Family{ct.IPv4}
+	if netenv.IPv6Enabled() {
+		families = append(families, ct.IPv6)
+	}
+
+	zone := ConntrackZone()
+	var flows []*pmpacket.ConntrackTuple
+	for _, f := range families {
+		connections, err := nfct.Dump(ct.Conntrack, f)
+		if err != nil {
+			return nil, err
+		}
+		flows = append(flows, zoneFlows(connections, zone)...)
+	}
+	return flows, nil
+}
+
+// zoneFlows returns the original and reply tuples of the entries of the given
+// zone.
+func zoneFlows(connections []ct.Con, zone uint16) (flows []*pmpacket.ConntrackTuple) {
+	for _, connection := range connections {
+		if connectionZone(connection) != zone {
+			continue
+		}
+		if tuple := conntrackTuple(connection.Origin); tuple != nil {
+			flows = append(flows, tuple)
+		}
+		if tuple := conntrackTuple(connection.Reply); tuple != nil {
+			flows = append(flows, tuple)
+		}
+	}
+	return flows
+}
+
+// FlowCounters returns the traffic counters of all entries of the configured
+// conntrack zone in the conntrack table. The kernel only counts the traffic of
+// connections if connection tracking accounting is enabled with the
+// net.netfilter.nf_conntrack_acct sysctl. Entries without counters are
+// skipped.
+func FlowCounters() ([]*pmpacket.ConntrackCounters, error) {
+	nfct, err := openConntrack()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = nfct.Close() }()
+
+	families := []ct.Family{ct.IPv4}
+	if netenv.IPv6Enabled() {
+		families = append(families, ct.IPv6)
+	}
+
+	zone := ConntrackZone()
+	var counters []*pmpacket.ConntrackCounters
+	for _, f := range families {
+		connections, err := nfct.Dump(ct.Conntrack, f)
+		if err != nil {
+			return nil, err
+		}
+		counters = append(counters, zoneCounters(connections, zone)...)
+	}
+	return counters, nil
+}
+
+// zoneCounters returns the traffic counters of the entries of the given zone.
+// Entries without counters are skipped.
+func zoneCounters(connections []ct.Con, zone uint16) (counters []*pmpacket.ConntrackCounters) {
+	for _, connection := range connections {
+		if connectionZone(connection) != zone {
+			continue
+		}
+		tuple := conntrackTuple(connection.Origin)
+		originBytes, ok := counterBytes(connection.CounterOrigin)
+		if tuple == nil || !ok {
+			continue
+		}
+		replyBytes, _ := counterBytes(connection.CounterReply)
+
+		counters = append(counters, &pmpacket.ConntrackCounters{
+			Origin:      *tuple,
+			OriginBytes: originBytes,
+			ReplyBytes:  replyBytes,
+		})
+	}
+	return counters
+}
+
+func counterBytes(counter *ct.Counter) (bytes uint64, ok bool) {
+	switch {
+	case counter == nil:
+		return 0, false
+	case counter.Bytes != nil:
+		return *counter.Bytes, true
+	case counter.Bytes32 != nil:
+		return uint64(*counter.Bytes32), true
+	default:
+		return 0, false
+	}
+}
+
+func conntrackTuple(t *ct.IPTuple) *pmpacket.ConntrackTuple {
+	if t == nil || t.Src == nil || t.Dst == nil || t.Proto == nil || t.Proto.Number == nil {
+		return nil
+	}
+
+	tuple := &pmpacket.ConntrackTuple{
+		Protocol: pmpacket.IPProtocol(*t.Proto.Number),
+		Src:      *t.Src,
+		Dst:      *t.Dst,
+	}
+	if t.Proto.SrcPort != nil && t.Proto.DstPort != nil {
+		tuple.SrcPort = *t.Proto.SrcPort
+		tuple.DstPort = *t.Proto.DstPort
+	}
+	return tuple
+}
+
+// DeleteConnection deletes the conntrack entry of the connection described by
+// the given packet info from the configured conntrack zone, so that its
+// packets are handed to the Portmaster again. The packet info may be of
+// either direction of the connection. It is not an error if there is no
+// entry.
+func DeleteConnection(info *pmpacket.Info) error {
+	nfct, err := openConntrack()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = nfct.Close() }()
+
+	family := ct.IPv4
+	if info.Version == pmpacket.IPv6 {
+		family = ct.IPv6
+	}
+
+	// Try both directions, as the entry is keyed by the tuple of the first
+	// packet of the connection.
+	zone := ConntrackZone()
+	for _, reversed := range []bool{false, true} {
+		err := nfct.Delete(ct.Conntrack, family, zoneConnection(info, reversed, zone))
+		switch {
+		case err == nil:
+			return nil
+		case !errors.Is(err, unix.ENOENT):
+			return err
+		}
+	}
+
+	return nil
+}
+
+// zoneConnection returns the conntrack entry of the given zone that is keyed
+// by the tuple of the packet info, or by its reverse.
+func zoneConnection(info *pmpacket.Info, reversed bool, zone uint16) ct.Con {
+	src, dst := info.Src, info.Dst
+	srcPort, dstPort := info.SrcPort, info.DstPort
+	if reversed {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+	}
+	protocol := uint8(info.Protocol)
+	connection := ct.Con{
+		Origin: &ct.IPTuple{
+			Src: &src,
+			Dst: &dst,
+			Proto: &ct.ProtoTuple{
+				Number:  &protocol,
+				SrcPort: &srcPort,
+				DstPort: &dstPort,
+			},
+		},
+	}
+	if zone != 0 {
+		connection.Zone = &zone
+	}
+	return connection
 }
@@ -0,0 +1,62 @@
+//go:build linux
+
+package nfq
+
+import (
+	"context"
+
+	ct "github.com/florianl/go-conntrack"
+
+	pmpacket "github.com/safing/portmaster/network/packet"
+)
+
+// SubscribeDestroyedConnections subscribes to the destroy events of the
+// conntrack table and calls fn with the original tuple of every entry of the
+// configured conntrack zone that is removed, until the context is canceled.
+// Entries of other zones are ignored, as they may have the same tuple as a
+// connection of the Portmaster. If the subscription fails while
+// receiving, such as when the kernel drops events because the receive buffer
+// overran, the error is sent to the returned channel and the subscription
+// ends. Events that were dropped are lost.
+func SubscribeDestroyedConnections(ctx context.Context, fn func(tuple *pmpacket.ConntrackTuple)) (<-chan error, error) {
+	nfct, err := openConntrack()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	receiveErrs := nfct.AttachErrChan()
+	err = nfct.Register(ctx, ct.Conntrack, ct.NetlinkCtDestroy, func(connection ct.Con) int {
+		if tuple := destroyedZoneTuple(connection, ConntrackZone()); tuple != nil {
+			fn(tuple)
+		}
+		return 0
+	})
+	if err != nil {
+		cancel()
+		_ = nfct.Close()
+		return nil, err
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		defer func() { _ = nfct.Close() }()
+		defer cancel()
+
+		select {
+		case err := <-receiveErrs:
+			errs <- err
+		case <-ctx.Done():
+		}
+	}()
+	return errs, nil
+}
+
+// destroyedZoneTuple returns the original tuple of the destroyed entry, or nil
+// if it is not of the given zone.
+func destroyedZoneTuple(connection ct.Con, zone uint16) *pmpacket.ConntrackTuple {
+	if connectionZone(connection) != zone {
+		return nil
+	}
+	return conntrackTuple(connection.Origin)
+}
@@ -0,0 +1,140 @@
+//go:build linux
+
+package nfq
+
+import (
+	"net"
+	"testing"
+
+	ct "github.com/florianl/go-conntrack"
+
+	pmpacket "github.com/safing/portmaster/network/packet"
+)
+
+// testConntrackEntry returns a TCP conntrack entry of the given zone with the
+// given source port. A zone of 0 is not set, as by the kernel.
+func testConntrackEntry(srcPort uint16, zone uint16, originBytes uint64) ct.Con {
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	var dstPort uint16 = 443
+	protocol := uint8(pmpacket.TCP)
+	connection := ct.Con{
+		Origin: &ct.IPTuple{
+			Src:   &src,
+			Dst:   &dst,
+			Proto: &ct.ProtoTuple{Number: &protocol, SrcPort: &srcPort, DstPort: &dstPort},
+		},
+		Reply: &ct.IPTuple{
+			Src:   &dst,
+			Dst:   &src,
+			Proto: &ct.ProtoTuple{Number: &protocol, SrcPort: &dstPort, DstPort: &srcPort},
+		},
+		CounterOrigin: &ct.Counter{Bytes: &originBytes},
+	}
+	if zone != 0 {
+		connection.Zone = &zone
+	}
+	return connection
+}
+
+func TestParseZone(t *testing.T) {
+	t.Parallel()
+
+	if zone := parseZone(nil); zone != 0 {
+		t.Errorf("missing zone should be zone 0, got %d", zone)
+	}
+
+	// A tuple attribute, followed by the zone attribute of zone 7.
+	data := make([]byte, 0, 16)
+	attr := make([]byte, 4)
+	nativeEndian.PutUint16(attr[0:2], 8)
+	nativeEndian.PutUint16(attr[2:4], 1)
+	data = append(data, attr...)
+	data = append(data, 0, 0, 0, 0)
+	nativeEndian.PutUint16(attr[0:2], 6)
+	nativeEndian.PutUint16(attr[2:4], ctaZone)
+	data = append(data, attr...)
+	data = append(data, 0, 7, 0, 0)
+	if zone := parseZone(data); zone != 7 {
+		t.Errorf("expected zone 7, got %d", zone)
+	}
+}
+
+func TestZoneLookups(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	connections := []ct.Con{
+		testConntrackEntry(40000, 0, 100),
+		testConntrackEntry(40001, 5, 200),
+		testConntrackEntry(40002, 5, 300),
+	}
+
+	// Only the tuples of the zone are returned, in both directions.
+	flows := zoneFlows(connections, 5)
+	if len(flows) != 4 || flows[0].SrcPort != 40001 || flows[1].DstPort != 40001 || flows[2].SrcPort != 40002 {
+		t.Errorf("unexpected flows of zone 5: %v", flows)
+	}
+	if flows := zoneFlows(connections, 0); len(flows) != 2 || flows[0].SrcPort != 40000 {
+		t.Errorf("unexpected flows of zone 0: %v", flows)
+	}
+
+	// Only the counters of the zone are returned.
+	counters := zoneCounters(connections, 5)
+	if len(counters) != 2 || counters[0].OriginBytes != 200 || counters[1].OriginBytes != 300 {
+		t.Errorf("unexpected counters of zone 5: %v", counters)
+	}
+	if counters := zoneCounters(connections, 1); len(counters) != 0 {
+		t.Errorf("unexpected counters of zone 1: %v", counters)
+	}
+
+	// Only entries of the zone that are not excluded are reset.
+	SetResetExclusion(func(tuple *pmpacket.ConntrackTuple) bool {
+		return tuple.SrcPort == 40002
+	})
+	defer SetResetExclusion(nil)
+	resettable := resettableConnections(connections, 5)
+	if len(resettable) != 1 || *resettable[0].Origin.Proto.SrcPort != 40001 {
+		t.Errorf("unexpected resettable entries: %v", resettable)
+	}
+}
+
+func TestZoneConnection(t *testing.T) {
+	t.Parallel()
+
+	info := &pmpacket.Info{
+		Protocol: pmpacket.UDP,
+		Src:      net.IPv4(10, 0, 0, 1),
+		SrcPort:  5000,
+		Dst:      net.IPv4(10, 0, 0, 2),
+		DstPort:  53,
+	}
+
+	connection := zoneConnection(info, false, 0)
+	if connection.Zone != nil {
+		t.Error("the default zone must not be set")
+	}
+	if !connection.Origin.Src.Equal(info.Src) || *connection.Origin.Proto.SrcPort != 5000 {
+		t.Errorf("unexpected origin %v", connection.Origin)
+	}
+
+	connection = zoneConnection(info, true, 3)
+	if connection.Zone == nil || *connection.Zone != 3 {
+		t.Errorf("zone 3 should be set, got %v", connection.Zone)
+	}
+	if !connection.Origin.Src.Equal(info.Dst) || *connection.Origin.Proto.SrcPort != 53 ||
+		*connection.Origin.Proto.DstPort != 5000 || *connection.Origin.Proto.Number != uint8(pmpacket.UDP) {
+		t.Errorf("unexpected reversed origin %v", connection.Origin)
+	}
+}
+
+func TestDestroyedZoneTuple(t *testing.T) {
+	t.Parallel()
+
+	// Identical tuples of other zones are ignored.
+	if tuple := destroyedZoneTuple(testConntrackEntry(40000, 5, 0), 0); tuple != nil {
+		t.Errorf("entry of zone 5 must be ignored in zone 0, got %v", tuple)
+	}
+	if tuple := destroyedZoneTuple(testConntrackEntry(40000, 0, 0), 5); tuple != nil {
+		t.Errorf("entry of zone 0 must be ignored in zone 5, got %v", tuple)
+	}
+	if tuple := destroyedZoneTuple(testConntrackEntry(40000, 5, 0), 5); tuple == nil || tuple.SrcPort != 40000 {
+		t.Errorf("unexpected tuple of zone 5: %v", tuple)
+	}
+}
@@ -0,0 +1,188 @@
+//go:build linux
+
+package nfq
+
+import (
+	"encoding/binary"
+	"log"
+	"unsafe"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/florianl/go-nfqueue"
+
+	pmpacket "github.com/safing/portmaster/network/packet"
+)
+
+// Values of enum ip_conntrack_info, as passed in NFQA_CT_INFO.
+const (
+	ipCTEstablished      = 0
+	ipCTRelated          = 1
+	ipCTNew              = 2
+	ipCTEstablishedReply = 3
+	ipCTRelatedReply     = 4
+	ipCTUntracked        = 7
+)
+
+const (
+	// ctaTupleOrig is the netlink attribute type of the original tuple.
+	ctaTupleOrig = 1
+	// ctaTupleMaster is the netlink attribute type of the master tuple.
+	ctaTupleMaster = 14
+	// ctaZone is the netlink attribute type of the conntrack zone.
+	ctaZone = 18
+
+	nlaFNested    = 0x8000
+	nlaTypeMask   = ^uint16(0xC000)
+	nlaHeaderSize = 4
+)
+
+// nativeEndian is the byte order of netlink attribute headers.
+var nativeEndian = func() binary.ByteOrder {
+	buf := [2]byte{}
+	*(*uint16)(unsafe.Pointer(&buf[0])) = 0x0102 //nolint:gosec // Endianness detection.
+	if buf[0] == 0x02 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// ctLogger discards all log output of the conntrack attribute parser.
+var ctLogger = log.New(devNull{}, "", 0)
+
+type devNull struct{}
+
+func (devNull) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// parseConntrackInfo extracts the conntrack information from the nfqueue
+// attributes. Packets without conntrack information have an unknown state,
+// as the information may be missing for other reasons than the packet being
+// invalid.
+func parseConntrackInfo(attrs nfqueue.Attribute) *pmpacket.ConntrackInfo {
+	if attrs.CtInfo == nil {
+		return nil
+	}
+
+	ctInfo := &pmpacket.ConntrackInfo{}
+	switch *attrs.CtInfo {
+	case ipCTEstablished:
+		ctInfo.State = pmpacket.ConntrackStateEstablished
+	case ipCTRelated:
+		ctInfo.State = pmpacket.ConntrackStateRelated
+	case ipCTNew:
+		ctInfo.State = pmpacket.ConntrackStateNew
+	case ipCTEstablishedReply:
+		ctInfo.State = pmpacket.ConntrackStateEstablished
+		ctInfo.Reply = true
+	case ipCTRelatedReply:
+		ctInfo.State = pmpacket.ConntrackStateRelated
+		ctInfo.Reply = true
+	case ipCTUntracked:
+		ctInfo.State = pmpacket.ConntrackStateUntracked
+	default:
+		ctInfo.State = pmpacket.ConntrackStateUnknown
+	}
+
+	if attrs.Ct != nil {
+		ctInfo.Zone = parseZone(*attrs.Ct)
+		if ctInfo.State == pmpacket.ConntrackStateRelated {
+			ctInfo.Master = parseMasterTuple(*attrs.Ct)
+		}
+		ctInfo.OriginTuple, ctInfo.ReplyTuple = parseTuples(*attrs.Ct)
+	}
+
+	return ctInfo
+}
+
+// parseMasterTuple extracts the master tuple from the raw conntrack
+// attributes. The conntrack library does not parse the master tuple, so it is
+// re-encoded as an original tuple and then parsed by the library.
+func parseMasterTuple(data []byte) *pmpacket.ConntrackTuple {
+	masterData := findNetlinkAttribute(data, ctaTupleMaster)
+	if masterData == nil {
+		return nil
+	}
+
+	// Re-encode as original tuple.
+	buf := make([]byte, nlaHeaderSize+len(masterData))
+	nativeEndian.PutUint16(buf[0:2], uint16(len(buf)))
+	nativeEndian.PutUint16(buf[2:4], ctaTupleOrig|nlaFNested)
+	copy(buf[nlaHeaderSize:], masterData)
+
+	con, err := ct.ParseAttributes(ctLogger, buf)
+	if err != nil || con.Origin == nil {
+		return nil
+	}
+
+	return convertIPTuple(con.Origin)
+}
+
+// parseTuples extracts the original and the reply tuple from the raw
+// conntrack attributes. They differ if the connection is translated (NAT).
+func parseTuples(data []byte) (origin, reply *pmpacket.ConntrackTuple) {
+	con, err := ct.ParseAttributes(ctLogger, data)
+	if err != nil {
+		return nil, nil
+	}
+
+	return convertIPTuple(con.Origin), convertIPTuple(con.Reply)
+}
+
+// parseZone extracts the conntrack zone from the raw conntrack attributes.
+// If no zone is present, the connection is in the default zone 0.
+func parseZone(data []byte) uint16 {
+	zoneData := findNetlinkAttribute(data, ctaZone)
+	if len(zoneData) < 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(zoneData)
+}
+
+// findNetlinkAttribute returns the payload of the first top level netlink
+// attribute with the given type.
+func findNetlinkAttribute(data []byte, attrType uint16) []byte {
+	for len(data) >= nlaHeaderSize {
+		attrLen := int(nativeEndian.Uint16(data[0:2]))
+		if attrLen < nlaHeaderSize || attrLen > len(data) {
+			return nil
+		}
+
+		if nativeEndian.Uint16(data[2:4])&nlaTypeMask == attrType {
+			return data[nlaHeaderSize:attrLen]
+		}
+
+		// Advance to next attribute, which is aligned to 4 bytes.
+		aligned := (attrLen + 3) &^ 3
+		if aligned > len(data) {
+			return nil
+		}
+		data = data[aligned:]
+	}
+
+	return nil
+}
+
+func convertIPTuple(tuple *ct.IPTuple) *pmpacket.ConntrackTuple {
+	if tuple == nil || tuple.Src == nil || tuple.Dst == nil {
+		return nil
+	}
+
+	t := &pmpacket.ConntrackTuple{
+		Src: *tuple.Src,
+		Dst: *tuple.Dst,
+	}
+	if tuple.Proto != nil {
+		if tuple.Proto.Number != nil {
+			t.Protocol = pmpacket.IPProtocol(*tuple.Proto.Number)
+		}
+		if tuple.Proto.SrcPort != nil {
+			t.SrcPort = *tuple.Proto.SrcPort
+		}
+		if tuple.Proto.DstPort != nil {
+			t.DstPort = *tuple.Proto.DstPort
+		}
+	}
+
+	return t
+}
@@ -0,0 +1,33 @@
+//go:build linux
+
+package nfq
+
+import (
+	"sync"
+
+	pmpacket "github.com/safing/portmaster/network/packet"
+)
+
+var (
+	errorDropReporter     func(cause pmpacket.ErrorDropCause, err error)
+	errorDropReporterLock sync.RWMutex
+)
+
+// SetErrorDropReporter sets the function that is called when a queue drops a
+// packet because of an internal failure, such as a packet that cannot be
+// parsed or that did not get a verdict in time.
+func SetErrorDropReporter(fn func(cause pmpacket.ErrorDropCause, err error)) {
+	errorDropReporterLock.Lock()
+	defer errorDropReporterLock.Unlock()
+
+	errorDropReporter = fn
+}
+
+func reportErrorDrop(cause pmpacket.ErrorDropCause, err error) {
+	errorDropReporterLock.RLock()
+	defer errorDropReporterLock.RUnlock()
+
+	if errorDropReporter != nil {
+		errorDropReporter(cause, err)
+	}
+}
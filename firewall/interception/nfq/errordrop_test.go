@@ -0,0 +1,27 @@
+//go:build linux
+
+package nfq
+
+import (
+	"errors"
+	"testing"
+
+	pmpacket "github.com/safing/portmaster/network/packet"
+)
+
+func TestReportErrorDrop(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	// Reporting without a reporter does nothing.
+	reportErrorDrop(pmpacket.ErrorDropParse, errors.New("test failure"))
+
+	var reported []pmpacket.ErrorDropCause
+	SetErrorDropReporter(func(cause pmpacket.ErrorDropCause, err error) {
+		reported = append(reported, cause)
+	})
+	defer SetErrorDropReporter(nil)
+
+	reportErrorDrop(pmpacket.ErrorDropParse, errors.New("test failure"))
+	reportErrorDrop(pmpacket.ErrorDropVerdictTimeout, errors.New("test failure"))
+	if len(reported) != 2 || reported[0] != pmpacket.ErrorDropParse || reported[1] != pmpacket.ErrorDropVerdictTimeout {
+		t.Errorf("unexpected reported drops: %v", reported)
+	}
+}
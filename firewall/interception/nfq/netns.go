@@ -0,0 +1,127 @@
+//go:build linux
+
+package nfq
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/safing/portbase/log"
+)
+
+var (
+	// netnsFile holds the open namespace file of the network namespace the
+	// Portmaster operates in, or nil if it operates in its own namespace.
+	netnsFile *os.File
+	netnsLock sync.RWMutex
+)
+
+// SetNetns sets the network namespace the queues are opened in and the
+// conntrack table is accessed in. The namespace is given by the path of its
+// namespace file, eg. /var/run/netns/<name> or /proc/<pid>/ns/net. The file
+// is kept open until the namespace is reset with an empty path, so that the
+// namespace stays available while queues are bound to it. Entering the
+// namespace requires CAP_SYS_ADMIN.
+func SetNetns(nsPath string) error {
+	var file *os.File
+	if nsPath != "" {
+		var err error
+		file, err = os.Open(nsPath)
+		if err != nil {
+			return err
+		}
+
+		var stat unix.Statfs_t
+		if err := unix.Fstatfs(int(file.Fd()), &stat); err != nil {
+			_ = file.Close()
+			return err
+		}
+		if stat.Type != unix.NSFS_MAGIC {
+			_ = file.Close()
+			return fmt.Errorf("%s is not a namespace file", nsPath)
+		}
+	}
+
+	netnsLock.Lock()
+	defer netnsLock.Unlock()
+
+	if netnsFile != nil {
+		if err := netnsFile.Close(); err != nil {
+			log.Warningf("nfq: failed to close network namespace %s: %s", netnsFile.Name(), err)
+		}
+	}
+	netnsFile = file
+	return nil
+}
+
+// Netns returns the path of the network namespace the Portmaster operates in,
+// or an empty string if it operates in its own namespace.
+func Netns() string {
+	netnsLock.RLock()
+	defer netnsLock.RUnlock()
+
+	if netnsFile == nil {
+		return ""
+	}
+	return netnsFile.Name()
+}
+
+// InNetns runs fn in the configured network namespace. Sockets keep the
+// namespace they were created in, so sockets created by fn can be used from
+// anywhere after InNetns returns. If no namespace is configured, fn is run
+// directly.
+// As the network namespace is an attribute of the OS thread, fn is run in a
+// new goroutine that is locked to its thread while in the namespace. If the
+// thread cannot be switched back to the original namespace, it is not
+// unlocked and is terminated together with the goroutine, instead of being
+// reused by other goroutines. Goroutines started by fn do not run in the
+// namespace.
+func InNetns(fn func() error) error {
+	netnsLock.RLock()
+	defer netnsLock.RUnlock()
+
+	if netnsFile == nil {
+		return fn()
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			errs <- fmt.Errorf("failed to open current network namespace: %w", err)
+			return
+		}
+		defer func() {
+			_ = origin.Close()
+		}()
+
+		if err := unix.Setns(int(netnsFile.Fd()), unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			if errors.Is(err, unix.EPERM) {
+				err = fmt.Errorf("%w (CAP_SYS_ADMIN is required)", err)
+			}
+			errs <- fmt.Errorf("failed to enter network namespace %s: %w", netnsFile.Name(), err)
+			return
+		}
+
+		fnErr := fn()
+
+		if err := unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET); err != nil {
+			// Keep the thread locked, so that it is terminated.
+			log.Errorf("nfq: failed to leave network namespace %s, terminating thread: %s", netnsFile.Name(), err)
+		} else {
+			runtime.UnlockOSThread()
+		}
+		errs <- fnErr
+	}()
+
+	return <-errs
+}
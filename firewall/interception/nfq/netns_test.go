@@ -0,0 +1,58 @@
+//go:build linux
+
+package nfq
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNetns(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	// Without a namespace, the function is run directly.
+	ran := false
+	if err := InNetns(func() error {
+		ran = true
+		return nil
+	}); err != nil || !ran {
+		t.Fatalf("function should have been run directly: %v", err)
+	}
+
+	// Only namespace files are accepted.
+	path := filepath.Join(t.TempDir(), "netns")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetNetns(path); err == nil {
+		t.Error("regular file should not be accepted as network namespace")
+	}
+	if Netns() != "" {
+		t.Error("network namespace should not be set")
+	}
+
+	// Enter the own network namespace.
+	if err := SetNetns("/proc/self/ns/net"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = SetNetns("")
+	}()
+	if Netns() != "/proc/self/ns/net" {
+		t.Errorf("unexpected network namespace %q", Netns())
+	}
+	testErr := errors.New("test")
+	err := InNetns(func() error { return testErr })
+	switch {
+	case errors.Is(err, unix.EPERM):
+		t.Skip("entering network namespaces requires CAP_SYS_ADMIN")
+	case !errors.Is(err, testErr):
+		t.Errorf("error of the function should be returned, got %v", err)
+	}
+
+	if err := SetNetns(""); err != nil || Netns() != "" {
+		t.Errorf("network namespace should have been reset: %v", err)
+	}
+}
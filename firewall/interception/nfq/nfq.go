@@ -5,6 +5,7 @@
 
 import (
 	"context"
+	"fmt"
 	"runtime"
 	"strings"
 	"sync/atomic"
@@ -29,14 +30,46 @@ type Queue struct {
 
 	pendingVerdicts  uint64
 	verdictCompleted chan struct{}
+
+	// flags holds the nfqueue config flags that were accepted by the kernel.
+	flags uint32
+
+	// copyRange is the maximum amount of bytes that is copied per packet.
+	copyRange uint32
+
+	// backpressure pauses reading packets while too many wait for a verdict.
+	backpressure *backpressure
+}
+
+const (
+	// FullCopyRange makes a queue copy complete packets. The MTU is normally
+	// around 1500, so this captures all of the packet.
+	FullCopyRange = 1600
+
+	// HeaderCopyRange makes a queue only copy the start of packets, which
+	// holds all headers required for handling them, including the packet
+	// headers embedded in ICMP errors. Packets with truncated data cannot be
+	// modified when setting the verdict.
+	HeaderCopyRange = 256
+)
+
+// queueFlagSets are the optional nfqueue config flags that are requested when
+// opening a queue, in order of preference. If the kernel does not support a
+// set of flags, the next one is tried.
+var queueFlagSets = []uint32{
+	nfqueue.NfQaCfgFlagConntrack | nfqueue.NfQaCfgFlagUIDGid | nfqueue.NfQaCfgFlagSecCx,
+	nfqueue.NfQaCfgFlagConntrack | nfqueue.NfQaCfgFlagUIDGid,
+	nfqueue.NfQaCfgFlagConntrack,
+	0,
 }
 
 func (q *Queue) getNfq() *nfqueue.Nfqueue {
 	return q.nf.Load().(*nfqueue.Nfqueue) //nolint:forcetypeassert // TODO: Check.
 }
 
-// New opens a new nfQueue.
-func New(qid uint16, v6 bool) (*Queue, error) { //nolint:gocognit
+// New opens a new nfQueue that copies up to copyRange bytes of every packet,
+// see FullCopyRange and HeaderCopyRange.
+func New(qid uint16, v6 bool, copyRange uint32) (*Queue, error) { //nolint:gocognit
 	afFamily := unix.AF_INET
 	if v6 {
 		afFamily = unix.AF_INET6
@@ -51,6 +84,8 @@ func New(qid uint16, v6 bool) (*Queue, error) { //nolint:gocognit
 		packets:              make(chan pmpacket.Packet, 1000),
 		cancelSocketCallback: cancel,
 		verdictCompleted:     make(chan struct{}, 1),
+		copyRange:            copyRange,
+		backpressure:         newBackpressure(),
 	}
 
 	// Do not retry if the first one fails immediately as it
@@ -95,22 +130,43 @@ func New(qid uint16, v6 bool) (*Queue, error) { //nolint:gocognit
 // Users must use Queue.getNfq to access it. open does not care about
 // any other value or queue that might be stored in Queue.nf at
 // the time open is called.
-func (q *Queue) open(ctx context.Context) error {
+func (q *Queue) open(ctx context.Context) (err error) {
+	for i, flags := range queueFlagSets {
+		err = q.openWithFlags(ctx, flags)
+		if err == nil {
+			return nil
+		}
+
+		// Retry with less optional flags, as older kernels might not support them.
+		if i < len(queueFlagSets)-1 {
+			log.Warningf("nfqueue: failed to open queue %d with optional flags %#x, retrying with %#x: %s", q.id, flags, queueFlagSets[i+1], err)
+		}
+	}
+	return err
+}
+
+func (q *Queue) openWithFlags(ctx context.Context, flags uint32) error {
 	cfg := &nfqueue.Config{
 		NfQueue:      q.id,
-		MaxPacketLen: 1600, // mtu is normally around 1500, make sure to capture it.
+		MaxPacketLen: q.copyRange,
 		MaxQueueLen:  0xffff,
 		AfFamily:     q.afFamily,
 		Copymode:     nfqueue.NfQnlCopyPacket,
+		Flags:        flags,
 		ReadTimeout:  1000 * time.Millisecond,
 		WriteTimeout: 1000 * time.Millisecond,
 	}
 
-	nf, err := nfqueue.Open(cfg)
+	var nf *nfqueue.Nfqueue
+	err := InNetns(func() (err error) {
+		nf, err = nfqueue.Open(cfg)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
+	atomic.StoreUint32(&q.flags, flags)
 	if err := nf.RegisterWithErrorFunc(ctx, q.packetHandler(ctx), q.handleError); err != nil {
 		_ = nf.Close()
 		return err
@@ -186,12 +242,21 @@ func (q *Queue) packetHandler(ctx context.Context) func(nfqueue.Attribute) int {
 			return 0
 		}
 
+		// The capture length is only present if the packet data was truncated.
+		pkt.truncated = attrs.CapLen != nil && int(*attrs.CapLen) > len(*attrs.Payload)
+
 		if err := pmpacket.Parse(*attrs.Payload, &pkt.Base); err != nil {
 			log.Warningf("nfqueue: failed to parse payload: %s", err)
+			reportErrorDrop(pmpacket.ErrorDropParse, err)
 			_ = pkt.Drop()
 			return 0
 		}
 
+		pkt.SetConntrackInfo(parseConntrackInfo(attrs))
+		pkt.SetOrigin(parseOrigin(attrs))
+		pkt.SetOriginSecurityContext(parseSecurityContext(attrs))
+
+		timeoutCause := pmpacket.ErrorDropVerdictTimeout
 		select {
 		case q.packets <- pkt:
 			log.Tracef("nfqueue: queued packet %s (%s -> %s) after %s", pkt.ID(), pkt.Info().Src, pkt.Info().Dst, time.Since(pkt.received))
@@ -199,24 +264,51 @@ func (q *Queue) packetHandler(ctx context.Context) func(nfqueue.Attribute) int {
 			return 0
 		case <-time.After(time.Second):
 			log.Warningf("nfqueue: failed to queue packet (%s since it was handed over by the kernel)", time.Since(pkt.received))
+			timeoutCause = pmpacket.ErrorDropQueueOverflow
 		}
 
+		q.backpressure.add()
 		go func() {
+			defer q.backpressure.done()
+
 			select {
 			case <-pkt.verdictSet:
 
 			case <-time.After(20 * time.Second):
 				log.Warningf("nfqueue: no verdict set for packet %s (%s -> %s) after %s, dropping", pkt.ID(), pkt.Info().Src, pkt.Info().Dst, time.Since(pkt.received))
+				reportErrorDrop(timeoutCause, fmt.Errorf("no verdict set after %s", time.Since(pkt.received)))
 				if err := pkt.Drop(); err != nil {
 					log.Warningf("nfqueue: failed to apply default-drop to unveridcted packet %s (%s -> %s)", pkt.ID(), pkt.Info().Src, pkt.Info().Dst)
 				}
 			}
 		}()
 
+		// Slow down reading from the kernel while the verdict engine is
+		// saturated.
+		high, low := BackpressureWatermarks()
+		if q.backpressure.wait(ctx, high, low, maxBackpressurePause) {
+			log.Tracef("nfqueue: paused reading from queue %d due to backpressure, %d packets are still waiting for a verdict", q.id, q.backpressure.waiting())
+		}
+
 		return 0 // continue calling this fn
 	}
 }
 
+// Reopen closes the netlink socket of the queue, which makes the queue open a
+// new one in the background. Packets that are waiting for a verdict on the
+// closed socket are lost.
+func (q *Queue) Reopen() {
+	if q == nil {
+		return
+	}
+
+	if nf := q.getNfq(); nf != nil {
+		// Closing the connection makes the receive loop fail, which then
+		// triggers a restart of the queue in handleError.
+		_ = nf.Con.Close()
+	}
+}
+
 // Destroy destroys the queue. Any error encountered is logged.
 func (q *Queue) Destroy() {
 	if q == nil {
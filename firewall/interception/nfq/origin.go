@@ -0,0 +1,38 @@
+//go:build linux
+
+package nfq
+
+import (
+	"strings"
+
+	"github.com/florianl/go-nfqueue"
+)
+
+// parseOrigin extracts the user and group ID of the socket that sent the
+// packet from the nfqueue attributes. The kernel only supplies them for
+// locally generated packets that have a socket attached, eg. packets in the
+// OUTPUT hook. Missing IDs are returned as nil.
+func parseOrigin(attrs nfqueue.Attribute) (uid, gid *uint32) {
+	if attrs.UID != nil {
+		id := *attrs.UID
+		uid = &id
+	}
+	if attrs.GID != nil {
+		id := *attrs.GID
+		gid = &id
+	}
+	return uid, gid
+}
+
+// parseSecurityContext extracts the security context of the socket that sent
+// the packet from the nfqueue attributes. Like the user and group ID, it is
+// only supplied for packets with a socket attached and additionally requires
+// a security module with labels, such as SELinux, and a kernel that supports
+// the attribute. A missing context is returned as an empty string.
+func parseSecurityContext(attrs nfqueue.Attribute) string {
+	if attrs.SecCtx == nil {
+		return ""
+	}
+	// The kernel may include the null terminator of the label.
+	return strings.TrimRight(*attrs.SecCtx, "\x00")
+}
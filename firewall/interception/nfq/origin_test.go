@@ -0,0 +1,89 @@
+//go:build linux
+
+package nfq
+
+import (
+	"testing"
+
+	"github.com/florianl/go-nfqueue"
+
+	pmpacket "github.com/safing/portmaster/network/packet"
+)
+
+func TestParseOrigin(t *testing.T) {
+	t.Parallel()
+
+	// Attributes present.
+	uid := uint32(1000)
+	gid := uint32(100)
+	pkt := &pmpacket.Base{}
+	pkt.SetOrigin(parseOrigin(nfqueue.Attribute{
+		UID: &uid,
+		GID: &gid,
+	}))
+	if id, ok := pkt.OriginUID(); !ok || id != 1000 {
+		t.Errorf("unexpected origin UID: %d (present=%v)", id, ok)
+	}
+	if id, ok := pkt.OriginGID(); !ok || id != 100 {
+		t.Errorf("unexpected origin GID: %d (present=%v)", id, ok)
+	}
+
+	// Root must be distinguishable from absent.
+	rootID := uint32(0)
+	pkt = &pmpacket.Base{}
+	pkt.SetOrigin(parseOrigin(nfqueue.Attribute{
+		UID: &rootID,
+	}))
+	if id, ok := pkt.OriginUID(); !ok || id != 0 {
+		t.Errorf("unexpected origin UID: %d (present=%v)", id, ok)
+	}
+	if _, ok := pkt.OriginGID(); ok {
+		t.Error("origin GID should be absent")
+	}
+
+	// Attributes absent, eg. for forwarded or inbound packets.
+	pkt = &pmpacket.Base{}
+	pkt.SetOrigin(parseOrigin(nfqueue.Attribute{}))
+	if _, ok := pkt.OriginUID(); ok {
+		t.Error("origin UID should be absent")
+	}
+	if _, ok := pkt.OriginGID(); ok {
+		t.Error("origin GID should be absent")
+	}
+}
+
+func TestParseSecurityContext(t *testing.T) {
+	t.Parallel()
+
+	// Attribute present, with and without the null terminator.
+	for _, label := range []string{
+		"system_u:system_r:httpd_t:s0",
+		"system_u:system_r:httpd_t:s0\x00",
+	} {
+		label := label
+		pkt := &pmpacket.Base{}
+		pkt.SetOriginSecurityContext(parseSecurityContext(nfqueue.Attribute{
+			SecCtx: &label,
+		}))
+		if secCtx, ok := pkt.OriginSecurityContext(); !ok || secCtx != "system_u:system_r:httpd_t:s0" {
+			t.Errorf("unexpected origin security context: %q (present=%v)", secCtx, ok)
+		}
+	}
+
+	// Attribute absent, eg. for non-local packets or on older kernels.
+	pkt := &pmpacket.Base{}
+	pkt.SetOriginSecurityContext(parseSecurityContext(nfqueue.Attribute{}))
+	if _, ok := pkt.OriginSecurityContext(); ok {
+		t.Error("origin security context should be absent")
+	}
+
+	// An empty label is treated as absent.
+	empty := "\x00"
+	pkt = &pmpacket.Base{}
+	pkt.SetOriginSecurityContext(parseSecurityContext(nfqueue.Attribute{
+		SecCtx: &empty,
+	}))
+	if _, ok := pkt.OriginSecurityContext(); ok {
+		t.Error("empty origin security context should be absent")
+	}
+}
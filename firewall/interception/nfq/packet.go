@@ -59,6 +59,9 @@ type packet struct {
 	queue          *Queue
 	verdictSet     chan struct{}
 	verdictPending *abool.AtomicBool
+
+	// truncated is set if the queue did not copy all of the packet data.
+	truncated bool
 }
 
 func (pkt *packet) ID() string {
@@ -82,8 +85,14 @@ func (pkt *packet) LoadPacketData() error {
 //	raw-socket.
 func (pkt *packet) mark(mark int) (err error) {
 	if pkt.verdictPending.SetToIf(false, true) {
-		defer close(pkt.verdictSet)
-		return pkt.setMark(mark)
+		err := pkt.setMark(mark)
+		if errors.Is(err, pmpacket.ErrVerdictTransient) {
+			// Allow the verdict to be set again, as the packet is still valid.
+			pkt.verdictPending.UnSet()
+			return err
+		}
+		close(pkt.verdictSet)
+		return err
 	}
 
 	return errors.New("verdict already set")
@@ -100,28 +109,38 @@ func (pkt *packet) setMark(mark int) error {
 		}
 	}()
 
-	for {
-		if err := pkt.queue.getNfq().SetVerdictWithMark(pkt.pktID, nfqueue.NfAccept, mark); err != nil {
-			// embedded interface is required to work-around some
-			// dep-vendoring weirdness
-			if opErr, ok := err.(interface { //nolint:errorlint // TODO: Check if we can remove workaround.
-				Timeout() bool
-				Temporary() bool
-			}); ok {
-				if opErr.Timeout() || opErr.Temporary() {
-					continue
-				}
+	if err := pkt.setVerdictWithMark(mark); err != nil {
+		// embedded interface is required to work-around some
+		// dep-vendoring weirdness
+		if opErr, ok := err.(interface { //nolint:errorlint // TODO: Check if we can remove workaround.
+			Timeout() bool
+			Temporary() bool
+		}); ok {
+			if opErr.Timeout() || opErr.Temporary() {
+				return fmt.Errorf("%w: %s", pmpacket.ErrVerdictTransient, err)
 			}
-
-			log.Tracer(pkt.Ctx()).Errorf("nfqueue: failed to set verdict %s for %s (%s -> %s): %s", markToString(mark), pkt.ID(), pkt.Info().Src, pkt.Info().Dst, err)
-			return err
 		}
-		break
+
+		log.Tracer(pkt.Ctx()).Errorf("nfqueue: failed to set verdict %s for %s (%s -> %s): %s", markToString(mark), pkt.ID(), pkt.Info().Src, pkt.Info().Dst, err)
+		return err
 	}
 	log.Tracer(pkt.Ctx()).Tracef("nfqueue: marking packet %s (%s -> %s) on queue %d with %s after %s", pkt.ID(), pkt.Info().Src, pkt.Info().Dst, pkt.queue.id, markToString(mark), time.Since(pkt.received))
 	return nil
 }
 
+// setVerdictWithMark accepts the packet with the given mark. Accepted packets
+// are returned with a normalized TTL, if enabled. Truncated packets are never
+// modified, as returning the truncated data would cut off the packet.
+func (pkt *packet) setVerdictWithMark(mark int) error {
+	if ttl := TTLNormalization(); ttl != 0 && !pkt.truncated && (mark == MarkAccept || mark == MarkAcceptAlways) {
+		if data, ok := pkt.ttlNormalizedPayload(ttl); ok {
+			return pkt.queue.getNfq().SetVerdictModPacketWithMark(pkt.pktID, nfqueue.NfAccept, mark, data)
+		}
+	}
+
+	return pkt.queue.getNfq().SetVerdictWithMark(pkt.pktID, nfqueue.NfAccept, mark)
+}
+
 func (pkt *packet) Accept() error {
 	return pkt.mark(MarkAccept)
 }
@@ -140,7 +159,27 @@ func (pkt *packet) Drop() error {
 	return pkt.mark(MarkDrop)
 }
 
+// inConntrackZone returns whether the connection of the packet is in the
+// conntrack zone of the Portmaster. Permanent verdicts are only applied to
+// connections in that zone.
+func (pkt *packet) inConntrackZone() bool {
+	ctInfo := pkt.ConntrackInfo()
+	if ctInfo == nil {
+		return true
+	}
+	return ctInfo.Zone == ConntrackZone()
+}
+
 func (pkt *packet) PermanentAccept() error {
+	if !pkt.inConntrackZone() {
+		return pkt.Accept()
+	}
+
+	// If the TTL is normalized, all packets need to pass through the queue.
+	if TTLNormalization() != 0 {
+		return pkt.Accept()
+	}
+
 	// If the packet is localhost only, do not permanently accept the outgoing
 	// packet, as the packet mark will be copied to the connection mark, which
 	// will stick and it will bypass the incoming queue.
@@ -152,6 +191,10 @@ func (pkt *packet) PermanentAccept() error {
 }
 
 func (pkt *packet) PermanentBlock() error {
+	if !pkt.inConntrackZone() {
+		return pkt.Block()
+	}
+
 	if pkt.Info().Protocol == pmpacket.ICMP || pkt.Info().Protocol == pmpacket.ICMPv6 {
 		// ICMP packets attributed to a blocked connection are always allowed, as
 		// rejection ICMP packets will have the same mark as the blocked
@@ -162,6 +205,10 @@ func (pkt *packet) PermanentBlock() error {
 }
 
 func (pkt *packet) PermanentDrop() error {
+	if !pkt.inConntrackZone() {
+		return pkt.Drop()
+	}
+
 	return pkt.mark(MarkDropAlways)
 }
 
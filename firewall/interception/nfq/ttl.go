@@ -0,0 +1,42 @@
+//go:build linux
+
+package nfq
+
+import (
+	"sync/atomic"
+
+	"github.com/safing/portbase/log"
+	pmpacket "github.com/safing/portmaster/network/packet"
+)
+
+var ttlNormalization uint32
+
+// SetTTLNormalization sets the IPv4 TTL and IPv6 hop limit that accepted
+// packets are rewritten to before they are returned to the kernel. A value of
+// 0 disables the normalization. While the normalization is enabled, accepted
+// connections do not get permanent verdicts, as all their packets need to pass
+// through the queue in order to be rewritten.
+func SetTTLNormalization(value uint8) {
+	atomic.StoreUint32(&ttlNormalization, uint32(value))
+}
+
+// TTLNormalization returns the TTL that accepted packets are rewritten to.
+// A value of 0 means that the normalization is disabled.
+func TTLNormalization() uint8 {
+	return uint8(atomic.LoadUint32(&ttlNormalization))
+}
+
+// ttlNormalizedPayload returns a copy of the packet data with the TTL set to
+// the given value. If the packet does not need to be modified, or cannot be,
+// ok is false.
+func (pkt *packet) ttlNormalizedPayload(ttl uint8) (data []byte, ok bool) {
+	data = make([]byte, len(pkt.Raw()))
+	copy(data, pkt.Raw())
+
+	modified, err := pmpacket.SetTTL(data, ttl)
+	if err != nil {
+		log.Tracer(pkt.Ctx()).Warningf("nfqueue: failed to normalize TTL of %s: %s", pkt.ID(), err)
+		return nil, false
+	}
+	return data, modified
+}
@@ -0,0 +1,149 @@
+package interception
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// capNetAdmin is the bit of the CAP_NET_ADMIN capability in the capability sets.
+const capNetAdmin = 12
+
+// Errors returned when the system does not support the nfqueue interception.
+var (
+	ErrMissingCapNetAdmin   = errors.New("missing the CAP_NET_ADMIN capability: run the Portmaster as root or grant it CAP_NET_ADMIN")
+	ErrNfqueueModuleMissing = errors.New("the nfnetlink_queue kernel module is not loaded: load it with \"modprobe nfnetlink_queue\"")
+)
+
+// nfqueueModuleState describes the availability of the nfnetlink_queue kernel module.
+type nfqueueModuleState uint8
+
+const (
+	nfqueueModuleUnknown nfqueueModuleState = iota
+	nfqueueModuleLoaded
+	nfqueueModuleAvailable
+	nfqueueModuleUnavailable
+)
+
+// System checks, replaceable for testing.
+var (
+	hasCapNetAdmin          = checkCapNetAdmin
+	getNfqueueModuleState   = checkNfqueueModule
+	procSelfStatusPath      = "/proc/self/status"
+	sysModulePath           = "/sys/module"
+	kernelModulesPathPrefix = "/lib/modules"
+)
+
+// checkNfqueueRequirements checks if the process is allowed to use nfqueue.
+func checkNfqueueRequirements() error {
+	ok, err := hasCapNetAdmin()
+	if err != nil {
+		// Continue if we cannot check, the start will fail later if required.
+		return nil //nolint:nilerr // Check is best effort.
+	}
+	if !ok {
+		return ErrMissingCapNetAdmin
+	}
+	return nil
+}
+
+// mapNfqueueError maps errors returned when opening a queue to an actionable
+// error, if the cause can be identified. Otherwise the error is returned as is.
+func mapNfqueueError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	// Check for missing permissions.
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+		return fmt.Errorf("%w (%s)", ErrMissingCapNetAdmin, err)
+	}
+	if ok, checkErr := hasCapNetAdmin(); checkErr == nil && !ok {
+		return fmt.Errorf("%w (%s)", ErrMissingCapNetAdmin, err)
+	}
+
+	// Check for the kernel module.
+	switch getNfqueueModuleState() {
+	case nfqueueModuleAvailable:
+		return fmt.Errorf("%w (%s)", ErrNfqueueModuleMissing, err)
+	case nfqueueModuleUnavailable:
+		return fmt.Errorf("%w; it is not available for the running kernel, which may need to be built with CONFIG_NETFILTER_NETLINK_QUEUE (%s)", ErrNfqueueModuleMissing, err)
+	case nfqueueModuleUnknown, nfqueueModuleLoaded:
+	}
+
+	return err
+}
+
+// checkCapNetAdmin checks if the process has the CAP_NET_ADMIN capability in
+// its effective capability set.
+func checkCapNetAdmin() (bool, error) {
+	f, err := os.Open(procSelfStatusPath)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			return false, fmt.Errorf("failed to parse effective capabilities: %w", err)
+		}
+		return caps&(1<<capNetAdmin) != 0, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+
+	return false, errors.New("effective capabilities not found")
+}
+
+// checkNfqueueModule checks if the nfnetlink_queue kernel module is loaded,
+// or could be loaded, similar to what modprobe does.
+func checkNfqueueModule() nfqueueModuleState {
+	// Check if the module is loaded or built into the kernel.
+	if _, err := os.Stat(filepath.Join(sysModulePath, "nfnetlink_queue")); err == nil {
+		return nfqueueModuleLoaded
+	}
+
+	// Check if the module is available for the running kernel.
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return nfqueueModuleUnknown
+	}
+	release := unix.ByteSliceToString(uname.Release[:])
+	modulesDir := filepath.Join(kernelModulesPathPrefix, release)
+
+	for _, index := range []string{"modules.builtin", "modules.dep"} {
+		data, err := os.ReadFile(filepath.Join(modulesDir, index))
+		if err != nil {
+			continue
+		}
+		if bytes.Contains(data, []byte("/nfnetlink_queue.ko")) {
+			if index == "modules.builtin" {
+				return nfqueueModuleLoaded
+			}
+			return nfqueueModuleAvailable
+		}
+	}
+
+	// Only report the module as unavailable if the module index could be read.
+	if _, err := os.Stat(filepath.Join(modulesDir, "modules.dep")); err == nil {
+		return nfqueueModuleUnavailable
+	}
+	return nfqueueModuleUnknown
+}
@@ -0,0 +1,152 @@
+package interception
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMapNfqueueError(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func() {
+		hasCapNetAdmin = checkCapNetAdmin
+		getNfqueueModuleState = checkNfqueueModule
+	}()
+
+	hasCap := true
+	moduleState := nfqueueModuleLoaded
+	hasCapNetAdmin = func() (bool, error) {
+		return hasCap, nil
+	}
+	getNfqueueModuleState = func() nfqueueModuleState {
+		return moduleState
+	}
+
+	// Permission errors.
+	err := mapNfqueueError(fmt.Errorf("netlink receive: %w", unix.EPERM))
+	if !errors.Is(err, ErrMissingCapNetAdmin) {
+		t.Errorf("EPERM should map to missing capability, got: %s", err)
+	}
+
+	// Missing capability with unspecific error.
+	hasCap = false
+	err = mapNfqueueError(errors.New("netlink receive: something failed"))
+	if !errors.Is(err, ErrMissingCapNetAdmin) {
+		t.Errorf("missing capability should be detected, got: %s", err)
+	}
+	if err := checkNfqueueRequirements(); !errors.Is(err, ErrMissingCapNetAdmin) {
+		t.Errorf("missing capability should fail requirements check, got: %v", err)
+	}
+	hasCap = true
+	if err := checkNfqueueRequirements(); err != nil {
+		t.Errorf("requirements check should pass, got: %s", err)
+	}
+
+	// Missing kernel module.
+	moduleState = nfqueueModuleAvailable
+	err = mapNfqueueError(errors.New("netlink receive: no such file or directory"))
+	if !errors.Is(err, ErrNfqueueModuleMissing) {
+		t.Errorf("missing module should be detected, got: %s", err)
+	}
+	moduleState = nfqueueModuleUnavailable
+	err = mapNfqueueError(errors.New("netlink receive: no such file or directory"))
+	if !errors.Is(err, ErrNfqueueModuleMissing) {
+		t.Errorf("unavailable module should be detected, got: %s", err)
+	}
+
+	// Unknown errors are passed through.
+	moduleState = nfqueueModuleLoaded
+	unknownErr := errors.New("something else")
+	if err := mapNfqueueError(unknownErr); err != unknownErr { //nolint:errorlint // Must be the same error.
+		t.Errorf("unknown error should be passed through, got: %s", err)
+	}
+	if mapNfqueueError(nil) != nil {
+		t.Error("nil error should stay nil")
+	}
+}
+
+func TestCheckCapNetAdmin(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func() {
+		procSelfStatusPath = "/proc/self/status"
+	}()
+
+	statusFile := filepath.Join(t.TempDir(), "status")
+	procSelfStatusPath = statusFile
+
+	for _, tc := range []struct {
+		capEff   string
+		expected bool
+	}{
+		{capEff: "000001ffffffffff", expected: true},
+		{capEff: "0000000000001000", expected: true},
+		{capEff: "0000000000000000", expected: false},
+		{capEff: "0000000000000fff", expected: false},
+	} {
+		data := "Name:\tportmaster-core\nCapInh:\t0000000000000000\nCapPrm:\t" + tc.capEff + "\nCapEff:\t" + tc.capEff + "\n"
+		if err := os.WriteFile(statusFile, []byte(data), 0o0600); err != nil {
+			t.Fatal(err)
+		}
+		ok, err := checkCapNetAdmin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tc.expected {
+			t.Errorf("CapEff %s: expected %v, got %v", tc.capEff, tc.expected, ok)
+		}
+	}
+}
+
+func TestCheckNfqueueModule(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func() {
+		sysModulePath = "/sys/module"
+		kernelModulesPathPrefix = "/lib/modules"
+	}()
+
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		t.Fatal(err)
+	}
+	release := unix.ByteSliceToString(uname.Release[:])
+
+	root := t.TempDir()
+	sysModulePath = filepath.Join(root, "sys")
+	kernelModulesPathPrefix = filepath.Join(root, "modules")
+	modulesDir := filepath.Join(kernelModulesPathPrefix, release)
+	if err := os.MkdirAll(modulesDir, 0o0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// No module index.
+	if state := checkNfqueueModule(); state != nfqueueModuleUnknown {
+		t.Errorf("expected unknown state, got %d", state)
+	}
+
+	// Module index without nfnetlink_queue.
+	modulesDep := filepath.Join(modulesDir, "modules.dep")
+	if err := os.WriteFile(modulesDep, []byte("kernel/net/netfilter/nfnetlink.ko:\n"), 0o0600); err != nil {
+		t.Fatal(err)
+	}
+	if state := checkNfqueueModule(); state != nfqueueModuleUnavailable {
+		t.Errorf("expected unavailable state, got %d", state)
+	}
+
+	// Module available, but not loaded.
+	data := "kernel/net/netfilter/nfnetlink.ko:\nkernel/net/netfilter/nfnetlink_queue.ko: kernel/net/netfilter/nfnetlink.ko\n"
+	if err := os.WriteFile(modulesDep, []byte(data), 0o0600); err != nil {
+		t.Fatal(err)
+	}
+	if state := checkNfqueueModule(); state != nfqueueModuleAvailable {
+		t.Errorf("expected available state, got %d", state)
+	}
+
+	// Module loaded.
+	if err := os.MkdirAll(filepath.Join(sysModulePath, "nfnetlink_queue"), 0o0700); err != nil {
+		t.Fatal(err)
+	}
+	if state := checkNfqueueModule(); state != nfqueueModuleLoaded {
+		t.Errorf("expected loaded state, got %d", state)
+	}
+}
@@ -1,15 +1,19 @@
 package interception
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"math"
 	"sort"
 	"strings"
 
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/hashicorp/go-multierror"
+	"github.com/tevino/abool"
 
 	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/core/journal"
 	"github.com/safing/portmaster/firewall/interception/nfq"
 	"github.com/safing/portmaster/netenv"
 	"github.com/safing/portmaster/network/packet"
@@ -24,27 +28,114 @@
 	v6rules  []string
 	v6once   []string
 
+	v4failOpen []string
+	v6failOpen []string
+
 	out4Queue nfQueue
 	in4Queue  nfQueue
 	out6Queue nfQueue
 	in6Queue  nfQueue
 
+	// Full copy queues, see RequestFullCopy.
+	out4FullQueue nfQueue
+	in4FullQueue  nfQueue
+	out6FullQueue nfQueue
+	in6FullQueue  nfQueue
+
 	shutdownSignal = make(chan struct{})
+	nfqueueActive  = abool.New()
 
 	experimentalNfqueueBackend bool
+	failClosedOnShutdown       bool
+	conntrackZone              uint
+	nfqueueNetns               string
+
+	backpressureHighWatermark uint
+	backpressureLowWatermark  uint
+
+	// The inbound queue jump rule is installed in the ingest input chain of
+	// the mangle table. The table cannot be changed, as the verdict marks must
+	// be set before the filter table is reached. For the same reason, the
+	// outbound queue jump rule is always installed in the OUTPUT chain.
+	// Packets of the input chain are always treated as inbound, see
+	// handleInterception. When using PREROUTING, the verdicts of forwarded
+	// packets are enforced in the FORWARD chain of the filter table.
+	// Only the inbound queue jump rule is inserted at the rule position, the
+	// other jump rules are always inserted at the top of their chains.
+	ingestInputChain   = "INPUT"
+	ingestRulePosition = 1
+
+	// newIPTables returns a new iptables handler for the given protocol.
+	newIPTables = func(protocol iptables.Protocol) (ipTables, error) {
+		if nfq.Netns() != "" {
+			return newNetnsIPTables(protocol)
+		}
+		return iptables.NewWithProtocol(protocol)
+	}
 )
 
 func init() {
 	flag.BoolVar(&experimentalNfqueueBackend, "experimental-nfqueue", false, "(deprecated flag; always used)")
+	flag.UintVar(&conntrackZone, "conntrack-zone", 0, "conntrack zone to scope permanent verdicts to; zone 0 is the default zone of all connections")
+	flag.StringVar(&nfqueueNetns, "nfqueue-netns", "", "path of the network namespace file, eg. /var/run/netns/<name>, to run the interception in instead of the namespace of the Portmaster; requires CAP_SYS_ADMIN")
+	flag.BoolVar(&failClosedOnShutdown, "fail-closed-on-shutdown", false, "block all network traffic while the interception is shutting down, instead of letting it pass")
+	flag.StringVar(&ingestInputChain, "nfqueue-ingest-input-chain", ingestInputChain, "iptables mangle chain to install the inbound queue jump rule in: INPUT or PREROUTING; packets of forwarded connections are treated as inbound and filtered in the FORWARD chain when using PREROUTING")
+	flag.UintVar(&backpressureHighWatermark, "nfqueue-backpressure-high", nfq.DefaultBackpressureHighWatermark, "number of packets waiting for a verdict per queue at which reading from the queue is paused; 0 disables the backpressure")
+	flag.UintVar(&backpressureLowWatermark, "nfqueue-backpressure-low", nfq.DefaultBackpressureLowWatermark, "number of packets waiting for a verdict per queue at which reading from a paused queue is resumed")
+	flag.IntVar(&ingestRulePosition, "nfqueue-rule-position", ingestRulePosition, "position in the ingest input chain to insert the inbound queue jump rule at, starting with 1; other jump rules are inserted at the top")
 }
 
+// checkIngestConfig checks if the configured location of the queue jump
+// rules is valid.
+func checkIngestConfig() error {
+	switch ingestInputChain {
+	case "INPUT", "PREROUTING":
+	default:
+		return fmt.Errorf("invalid ingest input chain %q, must be INPUT or PREROUTING", ingestInputChain)
+	}
+
+	if ingestRulePosition < 1 {
+		return fmt.Errorf("invalid rule position %d, must be 1 or greater", ingestRulePosition)
+	}
+
+	return nil
+}
+
+// mainNfqueueCount is the number of the main queues, for the inbound and
+// outbound packets of IPv4 and IPv6.
+const mainNfqueueCount = 4
+
 // nfQueue encapsulates nfQueue providers.
 type nfQueue interface {
 	PacketChannel() <-chan packet.Packet
+	Reopen()
 	Destroy()
 }
 
+// ipTables is the subset of iptables operations used for the interception.
+type ipTables interface {
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	Insert(table, chain string, pos int, rulespec ...string) error
+	Append(table, chain string, rulespec ...string) error
+	Delete(table, chain string, rulespec ...string) error
+	ClearChain(table, chain string) error
+	DeleteChain(table, chain string) error
+	RenameChain(table, oldChain, newChain string) error
+	List(table, chain string) ([]string, error)
+	ListChains(table string) ([]string, error)
+}
+
+// rebuildChainSuffix is appended to the chain names to build the temporary
+// chains that are used for rebuilding the rules. Chain names may not be longer
+// than 28 characters.
+const rebuildChainSuffix = "-NEW"
+
 func init() {
+	buildRules()
+}
+
+// buildRules builds all iptables rules using the configured ingest chain.
+func buildRules() {
 	v4chains = []string{
 		"mangle PORTMASTER-INGEST-OUTPUT",
 		"mangle PORTMASTER-INGEST-INPUT",
@@ -53,9 +144,12 @@ func init() {
 	}
 
 	v4rules = []string{
+		// Injected packets are marked as accepted and must keep their mark.
+		"mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 1700 -j RETURN",
 		"mangle PORTMASTER-INGEST-OUTPUT -j CONNMARK --restore-mark",
 		"mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -j NFQUEUE --queue-num 17040 --queue-bypass",
 
+		"mangle PORTMASTER-INGEST-INPUT -m mark --mark 1700 -j RETURN",
 		"mangle PORTMASTER-INGEST-INPUT -j CONNMARK --restore-mark",
 		"mangle PORTMASTER-INGEST-INPUT -m mark --mark 0 -j NFQUEUE --queue-num 17140 --queue-bypass",
 
@@ -85,11 +179,14 @@ func init() {
 
 	v4once = []string{
 		"mangle OUTPUT -j PORTMASTER-INGEST-OUTPUT",
-		"mangle INPUT -j PORTMASTER-INGEST-INPUT",
+		"mangle " + ingestInputChain + " -j PORTMASTER-INGEST-INPUT",
 		"filter OUTPUT -j PORTMASTER-FILTER",
 		"filter INPUT -j PORTMASTER-FILTER",
 		"nat OUTPUT -j PORTMASTER-REDIRECT",
 	}
+	if ingestInputChain == "PREROUTING" {
+		v4once = append(v4once, "filter FORWARD -j PORTMASTER-FILTER")
+	}
 
 	v6chains = []string{
 		"mangle PORTMASTER-INGEST-OUTPUT",
@@ -99,9 +196,12 @@ func init() {
 	}
 
 	v6rules = []string{
+		// Injected packets are marked as accepted and must keep their mark.
+		"mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 1700 -j RETURN",
 		"mangle PORTMASTER-INGEST-OUTPUT -j CONNMARK --restore-mark",
 		"mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -j NFQUEUE --queue-num 17060 --queue-bypass",
 
+		"mangle PORTMASTER-INGEST-INPUT -m mark --mark 1700 -j RETURN",
 		"mangle PORTMASTER-INGEST-INPUT -j CONNMARK --restore-mark",
 		"mangle PORTMASTER-INGEST-INPUT -m mark --mark 0 -j NFQUEUE --queue-num 17160 --queue-bypass",
 
@@ -125,11 +225,38 @@ func init() {
 
 	v6once = []string{
 		"mangle OUTPUT -j PORTMASTER-INGEST-OUTPUT",
-		"mangle INPUT -j PORTMASTER-INGEST-INPUT",
+		"mangle " + ingestInputChain + " -j PORTMASTER-INGEST-INPUT",
 		"filter OUTPUT -j PORTMASTER-FILTER",
 		"filter INPUT -j PORTMASTER-FILTER",
 		"nat OUTPUT -j PORTMASTER-REDIRECT",
 	}
+	if ingestInputChain == "PREROUTING" {
+		v6once = append(v6once, "filter FORWARD -j PORTMASTER-FILTER")
+	}
+
+	// Fail-open rules are inserted at the top of the Portmaster chains when
+	// shutting down, so that traffic passes while the queues are removed.
+	v4failOpen = []string{
+		"mangle PORTMASTER-INGEST-OUTPUT -j RETURN",
+		"mangle PORTMASTER-INGEST-INPUT -j RETURN",
+		"filter PORTMASTER-FILTER -j RETURN",
+	}
+
+	v6failOpen = []string{
+		"mangle PORTMASTER-INGEST-OUTPUT -j RETURN",
+		"mangle PORTMASTER-INGEST-INPUT -j RETURN",
+		"filter PORTMASTER-FILTER -j RETURN",
+	}
+
+	// Mark the rules in the chains of the system as Portmaster rules.
+	v4once = withRuleComment(v4once)
+	v6once = withRuleComment(v6once)
+
+	// Accept the traffic of paused directions, limit the queue rules to the
+	// intercepted protocols and the cgroup scope and route packets to the
+	// queues of their copy ranges.
+	v4rules = withCopyRanges(withCgroupScope(withProtocolScope(withDirectionPauses(v4rules))))
+	v6rules = withCopyRanges(withCgroupScope(withProtocolScope(withDirectionPauses(v6rules))))
 
 	// Reverse because we'd like to insert in a loop
 	_ = sort.Reverse(sort.StringSlice(v4once)) // silence vet (sort is used just like in the docs)
@@ -137,22 +264,57 @@ func init() {
 }
 
 func activateNfqueueFirewall() error {
-	if err := activateIPTables(iptables.ProtocolIPv4, v4rules, v4once, v4chains); err != nil {
+	v4 := withDynamicRules(iptables.ProtocolIPv4, v4rules)
+	if err := activateIPTables(iptables.ProtocolIPv4, v4, v4once, v4chains); err != nil {
+		return err
+	}
+
+	if netenv.IPv6Enabled() {
+		v6 := withDynamicRules(iptables.ProtocolIPv6, v6rules)
+		if err := activateIPTables(iptables.ProtocolIPv6, v6, v6once, v6chains); err != nil {
+			return err
+		}
+	}
+
+	markRulesInstalled()
+	return nil
+}
+
+// rebuildNfqueueFirewall atomically replaces all portmaster related IP tables
+// rules with freshly built ones.
+func rebuildNfqueueFirewall() error {
+	select {
+	case <-shutdownSignal:
+		return errors.New("nfqueue interception is shutting down")
+	default:
+	}
+
+	buildRules()
+
+	v4 := withDynamicRules(iptables.ProtocolIPv4, v4rules)
+	if err := rebuildIPTables(iptables.ProtocolIPv4, v4, v4once, v4chains); err != nil {
 		return err
 	}
 
 	if netenv.IPv6Enabled() {
-		if err := activateIPTables(iptables.ProtocolIPv6, v6rules, v6once, v6chains); err != nil {
+		v6 := withDynamicRules(iptables.ProtocolIPv6, v6rules)
+		if err := rebuildIPTables(iptables.ProtocolIPv6, v6, v6once, v6chains); err != nil {
 			return err
 		}
 	}
 
+	markRulesInstalled()
 	return nil
 }
 
 // DeactivateNfqueueFirewall drops portmaster related IP tables rules.
 // Any errors encountered accumulated into a *multierror.Error.
 func DeactivateNfqueueFirewall() error {
+	// Local port redirects and full copy flows are removed together with the
+	// chains.
+	resetLocalPortRedirects()
+	resetFullCopyFlows()
+
 	// IPv4
 	var result *multierror.Error
 	if err := deactivateIPTables(iptables.ProtocolIPv4, v4once, v4chains); err != nil {
@@ -169,8 +331,28 @@ func DeactivateNfqueueFirewall() error {
 	return result.ErrorOrNil()
 }
 
+// failOpenNfqueueFirewall lets all traffic pass the portmaster related IP
+// tables rules, without removing them.
+// Any errors encountered accumulated into a *multierror.Error.
+func failOpenNfqueueFirewall() error {
+	// IPv4
+	var result *multierror.Error
+	if err := failOpenIPTables(iptables.ProtocolIPv4, v4failOpen); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	// IPv6
+	if netenv.IPv6Enabled() {
+		if err := failOpenIPTables(iptables.ProtocolIPv6, v6failOpen); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	return result.ErrorOrNil()
+}
+
 func activateIPTables(protocol iptables.Protocol, rules, once, chains []string) error {
-	tbls, err := iptables.NewWithProtocol(protocol)
+	tbls, err := openIPTables(protocol)
 	if err != nil {
 		return err
 	}
@@ -190,6 +372,152 @@ func activateIPTables(protocol iptables.Protocol, rules, once, chains []string)
 	}
 
 	for _, rule := range once {
+		splittedRule := strings.Split(rule, " ")
+		ok, err := tbls.Exists(splittedRule[0], splittedRule[1], splittedRule[2:]...)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if err = tbls.Insert(splittedRule[0], splittedRule[1], jumpRulePosition(splittedRule), splittedRule[2:]...); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// rebuildIPTables replaces the rules without a gap in which traffic is not
+// handled: The new rules are built in temporary chains, which are then hooked
+// in before the existing chains. Only then are the existing chains removed and
+// the temporary chains renamed to take their place.
+func rebuildIPTables(protocol iptables.Protocol, rules, once, chains []string) error {
+	tbls, err := openIPTables(protocol)
+	if err != nil {
+		return err
+	}
+
+	// Build the new rules in temporary chains.
+	err = buildTempChains(tbls, rules, once, chains)
+	if err != nil {
+		removeTempChains(tbls, once, chains)
+		return err
+	}
+
+	// Unhook and remove the existing chains.
+	var multierr *multierror.Error
+	for _, rule := range once {
+		splittedRule := strings.Split(rule, " ")
+		ok, err := tbls.Exists(splittedRule[0], splittedRule[1], splittedRule[2:]...)
+		if err != nil {
+			multierr = multierror.Append(multierr, err)
+		}
+		if ok {
+			if err = tbls.Delete(splittedRule[0], splittedRule[1], splittedRule[2:]...); err != nil {
+				multierr = multierror.Append(multierr, err)
+			}
+		}
+	}
+	for _, chain := range chains {
+		splittedRule := strings.Split(chain, " ")
+		if err = tbls.ClearChain(splittedRule[0], splittedRule[1]); err != nil {
+			multierr = multierror.Append(multierr, err)
+		}
+		if err = tbls.DeleteChain(splittedRule[0], splittedRule[1]); err != nil {
+			multierr = multierror.Append(multierr, err)
+		}
+	}
+	if multierr != nil {
+		// The temporary chains are active, so keep them.
+		return fmt.Errorf("failed to remove previous rules: %w", multierr)
+	}
+
+	// Rename the temporary chains. This also updates the jump rules.
+	for _, chain := range chains {
+		splittedRule := strings.Split(chain, " ")
+		if err = tbls.RenameChain(splittedRule[0], splittedRule[1]+rebuildChainSuffix, splittedRule[1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func buildTempChains(tbls ipTables, rules, once, chains []string) error {
+	for _, chain := range chains {
+		splittedRule := strings.Split(chain, " ")
+		if err := tbls.ClearChain(splittedRule[0], splittedRule[1]+rebuildChainSuffix); err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range rules {
+		splittedRule := strings.Split(rule, " ")
+		if err := tbls.Append(splittedRule[0], splittedRule[1]+rebuildChainSuffix, splittedRule[2:]...); err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range once {
+		splittedRule := tempJumpRule(strings.Split(rule, " "))
+		ok, err := tbls.Exists(splittedRule[0], splittedRule[1], splittedRule[2:]...)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if err = tbls.Insert(splittedRule[0], splittedRule[1], jumpRulePosition(splittedRule), splittedRule[2:]...); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeTempChains removes the temporary chains of a failed rebuild.
+// Errors are ignored, as the chains might not exist.
+func removeTempChains(tbls ipTables, once, chains []string) {
+	for _, rule := range once {
+		splittedRule := tempJumpRule(strings.Split(rule, " "))
+		if ok, _ := tbls.Exists(splittedRule[0], splittedRule[1], splittedRule[2:]...); ok {
+			_ = tbls.Delete(splittedRule[0], splittedRule[1], splittedRule[2:]...)
+		}
+	}
+	for _, chain := range chains {
+		splittedRule := strings.Split(chain, " ")
+		_ = tbls.ClearChain(splittedRule[0], splittedRule[1]+rebuildChainSuffix)
+		_ = tbls.DeleteChain(splittedRule[0], splittedRule[1]+rebuildChainSuffix)
+	}
+}
+
+// jumpRulePosition returns the position to insert the given jump rule at.
+// Only the inbound queue jump rule, or its temporary variant, is inserted at
+// the configured rule position.
+func jumpRulePosition(splittedRule []string) int {
+	if splittedRule[0] == "mangle" &&
+		splittedRule[1] == ingestInputChain &&
+		strings.TrimSuffix(splittedRule[len(splittedRule)-1], rebuildChainSuffix) == "PORTMASTER-INGEST-INPUT" {
+		return ingestRulePosition
+	}
+	return 1
+}
+
+// tempJumpRule returns a copy of the jump rule that jumps to the temporary
+// chain instead. The jump target must be the last part of the rule.
+func tempJumpRule(splittedRule []string) []string {
+	tempRule := make([]string, len(splittedRule))
+	copy(tempRule, splittedRule)
+	tempRule[len(tempRule)-1] += rebuildChainSuffix
+	return tempRule
+}
+
+func failOpenIPTables(protocol iptables.Protocol, rules []string) error {
+	tbls, err := openIPTables(protocol)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
 		splittedRule := strings.Split(rule, " ")
 		ok, err := tbls.Exists(splittedRule[0], splittedRule[1], splittedRule[2:]...)
 		if err != nil {
@@ -205,8 +533,28 @@ func activateIPTables(protocol iptables.Protocol, rules, once, chains []string)
 	return nil
 }
 
+func iptablesInstalled(protocol iptables.Protocol, once []string) (bool, error) {
+	tbls, err := openIPTables(protocol)
+	if err != nil {
+		return false, err
+	}
+
+	for _, rule := range once {
+		splittedRule := strings.Split(rule, " ")
+		ok, err := tbls.Exists(splittedRule[0], splittedRule[1], splittedRule[2:]...)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
 func deactivateIPTables(protocol iptables.Protocol, rules, chains []string) error {
-	tbls, err := iptables.NewWithProtocol(protocol)
+	tbls, err := openIPTables(protocol)
 	if err != nil {
 		return err
 	}
@@ -240,66 +588,201 @@ func deactivateIPTables(protocol iptables.Protocol, rules, chains []string) erro
 }
 
 // StartNfqueueInterception starts the nfqueue interception.
-func StartNfqueueInterception(packets chan<- packet.Packet) (err error) {
+// Intercepted packets are sent to the packets channel to be handled by the
+// built-in profile engine. If a decider is given, it decides about the packets
+// instead and the channel is not used.
+func StartNfqueueInterception(packets chan<- packet.Packet, decider VerdictDecider) (err error) {
 	// @deprecated, remove in v1
 	if experimentalNfqueueBackend {
 		log.Warningf("[DEPRECATED] --experimental-nfqueue has been deprecated as the backend is now used by default")
 		log.Warningf("[DEPRECATED] please remove the flag from your configuration!")
 	}
 
+	if conntrackZone > math.MaxUint16 {
+		return fmt.Errorf("invalid conntrack zone %d", conntrackZone)
+	}
+	nfq.SetConntrackZone(uint16(conntrackZone))
+	nfq.SetErrorDropReporter(RecordErrorDrop)
+	nfq.SetResetExclusion(isTuplePinned)
+
+	if backpressureHighWatermark > math.MaxUint32 || backpressureLowWatermark > math.MaxUint32 {
+		return errors.New("invalid backpressure watermarks")
+	}
+	if err := nfq.SetBackpressureWatermarks(uint32(backpressureHighWatermark), uint32(backpressureLowWatermark)); err != nil {
+		return err
+	}
+	if backpressureHighWatermark > 0 && cap(packets) < minimumQueueSize() {
+		log.Warningf(
+			"interception: queue size of %d is smaller than %d packets waiting for a verdict on all queues at the backpressure high watermark, packets may be dropped before reading from the queues is paused",
+			cap(packets), minimumQueueSize(),
+		)
+	}
+
+	if err := checkIngestConfig(); err != nil {
+		return err
+	}
+	if err := loadCgroupScopeFlags(); err != nil {
+		return err
+	}
+	if err := loadProtocolScopeFlags(); err != nil {
+		return err
+	}
+	if err := loadCopyRangeFlags(); err != nil {
+		return err
+	}
+	buildRules()
+
+	if err := checkNfqueueRequirements(); err != nil {
+		return err
+	}
+
+	// Handle rules and verdict marks left behind by a previous run that did
+	// not shut down cleanly.
+	if err := handleStaleRules(staleRulesPolicy, cleanupStaleRules); err != nil {
+		return err
+	}
+
 	err = activateNfqueueFirewall()
 	if err != nil {
 		_ = Stop()
 		return fmt.Errorf("could not initialize nfqueue: %w", err)
 	}
 
-	out4Queue, err = nfq.New(17040, false)
+	copyRange := generalCopyRange()
+	out4Queue, err = nfq.New(17040, false, copyRange)
+	if err != nil {
+		_ = Stop()
+		return fmt.Errorf("nfqueue(IPv4, out): %w", mapNfqueueError(err))
+	}
+	in4Queue, err = nfq.New(17140, false, copyRange)
+	if err != nil {
+		_ = Stop()
+		return fmt.Errorf("nfqueue(IPv4, in): %w", mapNfqueueError(err))
+	}
+	out4FullQueue, err = nfq.New(fullCopyQueueOut4, false, nfq.FullCopyRange)
 	if err != nil {
 		_ = Stop()
-		return fmt.Errorf("nfqueue(IPv4, out): %w", err)
+		return fmt.Errorf("nfqueue(IPv4, out, full copy): %w", mapNfqueueError(err))
 	}
-	in4Queue, err = nfq.New(17140, false)
+	in4FullQueue, err = nfq.New(fullCopyQueueIn4, false, nfq.FullCopyRange)
 	if err != nil {
 		_ = Stop()
-		return fmt.Errorf("nfqueue(IPv4, in): %w", err)
+		return fmt.Errorf("nfqueue(IPv4, in, full copy): %w", mapNfqueueError(err))
+	}
+	if err := openCopyRangeQueues(17040, 17140, false); err != nil {
+		_ = Stop()
+		return err
 	}
 
 	if netenv.IPv6Enabled() {
-		out6Queue, err = nfq.New(17060, true)
+		out6Queue, err = nfq.New(17060, true, copyRange)
+		if err != nil {
+			_ = Stop()
+			return fmt.Errorf("nfqueue(IPv6, out): %w", mapNfqueueError(err))
+		}
+		in6Queue, err = nfq.New(17160, true, copyRange)
 		if err != nil {
 			_ = Stop()
-			return fmt.Errorf("nfqueue(IPv6, out): %w", err)
+			return fmt.Errorf("nfqueue(IPv6, in): %w", mapNfqueueError(err))
 		}
-		in6Queue, err = nfq.New(17160, true)
+		out6FullQueue, err = nfq.New(fullCopyQueueOut6, true, nfq.FullCopyRange)
 		if err != nil {
 			_ = Stop()
-			return fmt.Errorf("nfqueue(IPv6, in): %w", err)
+			return fmt.Errorf("nfqueue(IPv6, out, full copy): %w", mapNfqueueError(err))
+		}
+		in6FullQueue, err = nfq.New(fullCopyQueueIn6, true, nfq.FullCopyRange)
+		if err != nil {
+			_ = Stop()
+			return fmt.Errorf("nfqueue(IPv6, in, full copy): %w", mapNfqueueError(err))
+		}
+		if err := openCopyRangeQueues(17060, 17160, true); err != nil {
+			_ = Stop()
+			return err
 		}
 	} else {
 		log.Warningf("interception: no IPv6 stack detected, disabling IPv6 network integration")
 		out6Queue = &disabledNfQueue{}
 		in6Queue = &disabledNfQueue{}
+		out6FullQueue = &disabledNfQueue{}
+		in6FullQueue = &disabledNfQueue{}
 	}
 
-	go handleInterception(packets)
+	go handleInterception(packets, decider)
+	handleCopyRangeQueues()
+	go watchCgroupScope()
+	nfqueueActive.Set()
 	return nil
 }
 
-// StopNfqueueInterception stops the nfqueue interception.
-func StopNfqueueInterception() error {
-	defer close(shutdownSignal)
+// WarmupNfqueueInterception verifies that all queues are open and that all
+// rules are installed. Missing rules are installed again.
+func WarmupNfqueueInterception() error {
+	if out4Queue == nil || in4Queue == nil || out6Queue == nil || in6Queue == nil {
+		return errors.New("nfqueue interception is not started")
+	}
+
+	installed, err := iptablesInstalled(iptables.ProtocolIPv4, v4once)
+	if err == nil && installed && netenv.IPv6Enabled() {
+		installed, err = iptablesInstalled(iptables.ProtocolIPv6, v6once)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check rules: %w", err)
+	}
+
+	if !installed {
+		ruleRebuildExecLock.Lock()
+		defer ruleRebuildExecLock.Unlock()
+
+		log.Warningf("interception: rules are missing, installing again")
+		if err := activateNfqueueFirewall(); err != nil {
+			return fmt.Errorf("failed to install rules: %w", err)
+		}
+	}
 
-	if out4Queue != nil {
-		out4Queue.Destroy()
+	return nil
+}
+
+// ReloadNfqueueInterception reinstalls all rules and reopens all queues, eg.
+// after a system resume. Rules are replaced atomically, packets waiting for a
+// verdict on the previous queue sockets are lost.
+func ReloadNfqueueInterception() error {
+	if !nfqueueActive.IsSet() {
+		return errors.New("nfqueue interception is not active")
 	}
-	if in4Queue != nil {
-		in4Queue.Destroy()
+
+	ruleRebuildExecLock.Lock()
+	defer ruleRebuildExecLock.Unlock()
+
+	if err := rebuildNfqueueFirewall(); err != nil {
+		return fmt.Errorf("failed to reinstall rules: %w", err)
 	}
-	if out6Queue != nil {
-		out6Queue.Destroy()
+
+	for _, q := range activeQueues() {
+		q.Reopen()
 	}
-	if in6Queue != nil {
-		in6Queue.Destroy()
+
+	return nil
+}
+
+// StopNfqueueInterception stops the nfqueue interception.
+func StopNfqueueInterception() error {
+	defer close(shutdownSignal)
+	nfqueueActive.UnSet()
+
+	// Switch to fail-open before removing the queues, as the filter rules
+	// would otherwise drop all traffic until they are removed.
+	if !failClosedOnShutdown {
+		if err := failOpenNfqueueFirewall(); err != nil {
+			log.Warningf("interception: failed to switch to fail-open for shutdown: %s", err)
+		} else {
+			journal.Send(journal.PriorityNotice, "interception switched to fail-open for shutdown", journal.Fields{
+				"EVENT": "interception_fail_open",
+			})
+		}
+	}
+
+	for _, q := range activeQueues() {
+		q.Destroy()
 	}
 
 	err := DeactivateNfqueueFirewall()
@@ -307,10 +790,24 @@ func StopNfqueueInterception() error {
 		return fmt.Errorf("interception: error while deactivating nfqueue: %w", err)
 	}
 
+	// Leave the network namespace only after the rules were removed from it.
+	if err := nfq.SetNetns(""); err != nil {
+		log.Warningf("interception: failed to leave network namespace: %s", err)
+	}
+
 	return nil
 }
 
-func handleInterception(packets chan<- packet.Packet) {
+func handleInterception(packets chan<- packet.Packet, decider VerdictDecider) {
+	// Packets are passed to a bounded amount of workers if a decider is used,
+	// and the fail policy of the full queue is applied if they fall behind.
+	if decider != nil {
+		packetsLock.Lock()
+		size := queueSize()
+		packetsLock.Unlock()
+		packets = startDeciderWorkers(decider, size, shutdownSignal)
+	}
+
 	for {
 		var pkt packet.Packet
 		select {
@@ -324,14 +821,116 @@ func handleInterception(packets chan<- packet.Packet) {
 			pkt.SetOutbound()
 		case pkt = <-in6Queue.PacketChannel():
 			pkt.SetInbound()
+		case pkt = <-out4FullQueue.PacketChannel():
+			pkt.SetOutbound()
+		case pkt = <-in4FullQueue.PacketChannel():
+			pkt.SetInbound()
+		case pkt = <-out6FullQueue.PacketChannel():
+			pkt.SetOutbound()
+		case pkt = <-in6FullQueue.PacketChannel():
+			pkt.SetInbound()
+		case pkt = <-copyRangePackets:
+			// The direction is set when forwarding.
 		}
 
-		select {
-		case packets <- pkt:
-		case <-shutdownSignal:
-			return
+		enqueuePacket(packets, wrapForDropCapture(pkt))
+	}
+}
+
+// nfqueueState adds the configuration and state of the nfqueue interception
+// to the given state.
+func nfqueueState(state *State) error {
+	state.Mode = "nfqueue"
+	state.Active = nfqueueActive.IsSet()
+	state.Netns = nfq.Netns()
+	state.TTLNormalization = nfq.TTLNormalization()
+
+	state.HeaderCopy = nfqueueHeaderCopy
+	state.BackpressureHighWatermark, state.BackpressureLowWatermark = nfq.BackpressureWatermarks()
+	copyRange := generalCopyRange()
+	state.Queues = []QueueState{
+		{Number: 17040, IPVersion: 4, CopyRange: copyRange},
+		{Number: 17140, IPVersion: 4, Inbound: true, CopyRange: copyRange},
+		{Number: fullCopyQueueOut4, IPVersion: 4, FullCopy: true, CopyRange: nfq.FullCopyRange},
+		{Number: fullCopyQueueIn4, IPVersion: 4, Inbound: true, FullCopy: true, CopyRange: nfq.FullCopyRange},
+	}
+	ipv6 := netenv.IPv6Enabled()
+	if ipv6 {
+		state.Queues = append(state.Queues,
+			QueueState{Number: 17060, IPVersion: 6, CopyRange: copyRange},
+			QueueState{Number: 17160, IPVersion: 6, Inbound: true, CopyRange: copyRange},
+			QueueState{Number: fullCopyQueueOut6, IPVersion: 6, FullCopy: true, CopyRange: nfq.FullCopyRange},
+			QueueState{Number: fullCopyQueueIn6, IPVersion: 6, Inbound: true, FullCopy: true, CopyRange: nfq.FullCopyRange},
+		)
+	}
+	state.Queues = append(state.Queues, copyRangeQueueStates()...)
+	state.Marks = map[string]uint32{
+		"accept":             nfq.MarkAccept,
+		"block":              nfq.MarkBlock,
+		"drop":               nfq.MarkDrop,
+		"accept-permanently": nfq.MarkAcceptAlways,
+		"block-permanently":  nfq.MarkBlockAlways,
+		"drop-permanently":   nfq.MarkDropAlways,
+		"reroute-nameserver": nfq.MarkRerouteNS,
+		"reroute-tunnel":     nfq.MarkRerouteSPN,
+	}
+
+	cgroupScopeLock.Lock()
+	state.CgroupScope = cgroupScope
+	cgroupScopeLock.Unlock()
+	state.InterceptedProtocols = getInterceptedProtocols()
+
+	// Copy the rules, as they are replaced when rebuilding.
+	ruleRebuildExecLock.Lock()
+	v4 := withDynamicRules(iptables.ProtocolIPv4, v4rules)
+	state.Rules = make([]string, 0, len(v4chains)+len(v4)+len(v4once))
+	state.Rules = appendStateRules(state.Rules, "ipv4", v4chains, v4, v4once)
+	v4Once := append([]string(nil), v4once...)
+	var v6Once []string
+	if ipv6 {
+		v6 := withDynamicRules(iptables.ProtocolIPv6, v6rules)
+		state.Rules = appendStateRules(state.Rules, "ipv6", v6chains, v6, v6once)
+		v6Once = append([]string(nil), v6once...)
+	}
+	ruleRebuildExecLock.Unlock()
+
+	// Check if the rules are installed.
+	installed, err := iptablesInstalled(iptables.ProtocolIPv4, v4Once)
+	if err == nil && installed && ipv6 {
+		installed, err = iptablesInstalled(iptables.ProtocolIPv6, v6Once)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check rules: %w", err)
+	}
+	state.RulesInstalled = installed
+
+	return nil
+}
+
+func appendStateRules(rules []string, protocol string, ruleSets ...[]string) []string {
+	for _, ruleSet := range ruleSets {
+		for _, rule := range ruleSet {
+			rules = append(rules, protocol+" "+rule)
+		}
+	}
+	return rules
+}
+
+// activeQueues returns all queues that were opened.
+func activeQueues() []nfQueue {
+	queues := make([]nfQueue, 0, 8)
+	for _, q := range []nfQueue{
+		out4Queue, in4Queue, out6Queue, in6Queue,
+		out4FullQueue, in4FullQueue, out6FullQueue, in6FullQueue,
+	} {
+		if q != nil {
+			queues = append(queues, q)
 		}
 	}
+	for _, crq := range copyRangeQueues {
+		queues = append(queues, crq.queue)
+	}
+	return queues
 }
 
 type disabledNfQueue struct{}
@@ -340,4 +939,6 @@ func (dnfq *disabledNfQueue) PacketChannel() <-chan packet.Packet {
 	return nil
 }
 
+func (dnfq *disabledNfQueue) Reopen() {}
+
 func (dnfq *disabledNfQueue) Destroy() {}
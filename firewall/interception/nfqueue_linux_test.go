@@ -0,0 +1,346 @@
+package interception
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+
+	"github.com/safing/portmaster/network/packet"
+)
+
+type operationLog struct {
+	sync.Mutex
+	ops []string
+}
+
+func (l *operationLog) add(op string) {
+	l.Lock()
+	defer l.Unlock()
+	l.ops = append(l.ops, op)
+}
+
+type fakeIPTables struct {
+	log   *operationLog
+	rules map[string]bool
+	// positions holds the position each rule was inserted at.
+	positions map[string]int
+}
+
+func (t *fakeIPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	return t.rules[table+" "+chain+" "+strings.Join(rulespec, " ")], nil
+}
+
+func (t *fakeIPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	rule := table + " " + chain + " " + strings.Join(rulespec, " ")
+	t.rules[rule] = true
+	if t.positions == nil {
+		t.positions = make(map[string]int)
+	}
+	t.positions[rule] = pos
+	t.log.add("insert " + rule)
+	return nil
+}
+
+func (t *fakeIPTables) Append(table, chain string, rulespec ...string) error {
+	rule := table + " " + chain + " " + strings.Join(rulespec, " ")
+	t.rules[rule] = true
+	t.log.add("append " + rule)
+	return nil
+}
+
+func (t *fakeIPTables) Delete(table, chain string, rulespec ...string) error {
+	rule := table + " " + chain + " " + strings.Join(rulespec, " ")
+	delete(t.rules, rule)
+	t.log.add("delete " + rule)
+	return nil
+}
+
+func (t *fakeIPTables) ClearChain(table, chain string) error {
+	for rule := range t.rules {
+		if strings.HasPrefix(rule, table+" "+chain+" ") {
+			delete(t.rules, rule)
+		}
+	}
+	t.log.add("clear " + table + " " + chain)
+	return nil
+}
+
+func (t *fakeIPTables) DeleteChain(table, chain string) error {
+	t.log.add("deletechain " + table + " " + chain)
+	return nil
+}
+
+func (t *fakeIPTables) RenameChain(table, oldChain, newChain string) error {
+	for rule := range t.rules {
+		parts := strings.Split(rule, " ")
+		if parts[0] != table {
+			continue
+		}
+		renamed := false
+		if parts[1] == oldChain {
+			parts[1] = newChain
+			renamed = true
+		}
+		if parts[len(parts)-1] == oldChain {
+			parts[len(parts)-1] = newChain
+			renamed = true
+		}
+		if renamed {
+			delete(t.rules, rule)
+			t.rules[strings.Join(parts, " ")] = true
+		}
+	}
+	t.log.add("renamechain " + table + " " + oldChain + " " + newChain)
+	return nil
+}
+
+func (t *fakeIPTables) List(table, chain string) ([]string, error) {
+	var rules []string
+	for rule := range t.rules {
+		parts := strings.SplitN(rule, " ", 3)
+		if parts[0] == table && parts[1] == chain {
+			rules = append(rules, "-A "+chain+" "+parts[2])
+		}
+	}
+	return rules, nil
+}
+
+// ListChains returns the built-in chains and all chains that hold rules.
+func (t *fakeIPTables) ListChains(table string) ([]string, error) {
+	chains := map[string]struct{}{"INPUT": {}, "OUTPUT": {}, "PREROUTING": {}}
+	for rule := range t.rules {
+		parts := strings.SplitN(rule, " ", 3)
+		if parts[0] == table {
+			chains[parts[1]] = struct{}{}
+		}
+	}
+
+	list := make([]string, 0, len(chains))
+	for chain := range chains {
+		list = append(list, chain)
+	}
+	return list, nil
+}
+
+type fakeNfQueue struct {
+	log *operationLog
+}
+
+func (q *fakeNfQueue) PacketChannel() <-chan packet.Packet {
+	return nil
+}
+
+func (q *fakeNfQueue) Reopen() {
+	q.log.add("reopen queue")
+}
+
+func (q *fakeNfQueue) Destroy() {
+	q.log.add("destroy queue")
+}
+
+func setupShutdownTest(t *testing.T, failClosed bool) *operationLog {
+	t.Helper()
+
+	opLog := &operationLog{}
+	tables := map[iptables.Protocol]*fakeIPTables{}
+	newIPTables = func(protocol iptables.Protocol) (ipTables, error) {
+		tbls, ok := tables[protocol]
+		if !ok {
+			tbls = &fakeIPTables{log: opLog, rules: make(map[string]bool)}
+			tables[protocol] = tbls
+		}
+		return tbls, nil
+	}
+	failClosedOnShutdown = failClosed
+	shutdownSignal = make(chan struct{})
+	out4Queue = &fakeNfQueue{log: opLog}
+	in4Queue = &fakeNfQueue{log: opLog}
+	out6Queue = &fakeNfQueue{log: opLog}
+	in6Queue = &fakeNfQueue{log: opLog}
+
+	if err := activateNfqueueFirewall(); err != nil {
+		t.Fatal(err)
+	}
+	opLog.ops = nil
+
+	return opLog
+}
+
+func firstOpIndex(ops []string, prefix string) int {
+	for i, op := range ops {
+		if strings.HasPrefix(op, prefix) {
+			return i
+		}
+	}
+	return -1
+}
+
+func lastOpIndex(ops []string, prefix string) int {
+	for i := len(ops) - 1; i >= 0; i-- {
+		if strings.HasPrefix(ops[i], prefix) {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestShutdownRuleOrder(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	opLog := setupShutdownTest(t, false)
+	if err := StopNfqueueInterception(); err != nil {
+		t.Fatal(err)
+	}
+
+	lastFailOpen := lastOpIndex(opLog.ops, "insert ")
+	firstDestroy := firstOpIndex(opLog.ops, "destroy queue")
+	lastDestroy := lastOpIndex(opLog.ops, "destroy queue")
+	firstDelete := firstOpIndex(opLog.ops, "delete ")
+	if lastFailOpen < 0 || firstDestroy < 0 || firstDelete < 0 {
+		t.Fatalf("missing shutdown operations: %v", opLog.ops)
+	}
+	if firstOpIndex(opLog.ops, "insert ") != 0 {
+		t.Errorf("fail-open rules must be installed first: %v", opLog.ops)
+	}
+	if lastFailOpen > firstDestroy {
+		t.Errorf("fail-open rules must be installed before the queues are destroyed: %v", opLog.ops)
+	}
+	if lastDestroy > firstDelete {
+		t.Errorf("queues must be destroyed before the jump rules are removed: %v", opLog.ops)
+	}
+	for _, rule := range v4failOpen {
+		if firstOpIndex(opLog.ops, "insert "+rule) < 0 {
+			t.Errorf("fail-open rule %q was not installed", rule)
+		}
+	}
+}
+
+func TestShutdownFailClosed(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	opLog := setupShutdownTest(t, true)
+	if err := StopNfqueueInterception(); err != nil {
+		t.Fatal(err)
+	}
+
+	if i := firstOpIndex(opLog.ops, "insert "); i >= 0 {
+		t.Errorf("no fail-open rules must be installed when failing closed: %v", opLog.ops)
+	}
+	if lastOpIndex(opLog.ops, "destroy queue") > firstOpIndex(opLog.ops, "delete ") {
+		t.Errorf("queues must be destroyed before the jump rules are removed: %v", opLog.ops)
+	}
+}
+
+func TestIngestChainConfig(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func() {
+		ingestInputChain = "INPUT"
+		buildRules()
+	}()
+
+	ingestInputChain = "FORWARD"
+	if err := checkIngestConfig(); err == nil {
+		t.Fatal("FORWARD must not be accepted as ingest input chain")
+	}
+
+	ingestInputChain = "PREROUTING"
+	ingestRulePosition = 3
+	defer func() {
+		ingestRulePosition = 1
+	}()
+	if err := checkIngestConfig(); err != nil {
+		t.Fatal(err)
+	}
+	buildRules()
+
+	opLog := setupShutdownTest(t, true)
+	tbls, err := newIPTables(iptables.ProtocolIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := tbls.(*fakeIPTables) //nolint:forcetypeassert // Set by setupShutdownTest.
+
+	// Forwarded packets must be filtered.
+	if !fake.rules["filter FORWARD -m comment --comment portmaster -j PORTMASTER-FILTER"] {
+		t.Error("forwarded packets are not filtered")
+	}
+	// Only the inbound queue jump rule is inserted at the configured position.
+	if pos := fake.positions["mangle PREROUTING -m comment --comment portmaster -j PORTMASTER-INGEST-INPUT"]; pos != 3 {
+		t.Errorf("inbound queue jump rule inserted at %d", pos)
+	}
+	for rule, pos := range fake.positions {
+		if rule != "mangle PREROUTING -m comment --comment portmaster -j PORTMASTER-INGEST-INPUT" && pos != 1 {
+			t.Errorf("rule %q inserted at %d", rule, pos)
+		}
+	}
+
+	if err := DeactivateNfqueueFirewall(); err != nil {
+		t.Fatal(err)
+	}
+	if firstOpIndex(opLog.ops, "delete mangle PREROUTING -m comment --comment portmaster -j PORTMASTER-INGEST-INPUT") < 0 {
+		t.Errorf("jump rule in configured chain was not removed: %v", opLog.ops)
+	}
+	if firstOpIndex(opLog.ops, "delete mangle INPUT") >= 0 {
+		t.Errorf("jump rule in unconfigured chain was touched: %v", opLog.ops)
+	}
+	if firstOpIndex(opLog.ops, "delete filter FORWARD -m comment --comment portmaster -j PORTMASTER-FILTER") < 0 {
+		t.Errorf("forward jump rule was not removed: %v", opLog.ops)
+	}
+}
+
+func TestRuleRebuildOrder(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	opLog := setupShutdownTest(t, false)
+	if err := rebuildNfqueueFirewall(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rule := range v4once {
+		splittedRule := strings.Split(rule, " ")
+		tempRule := strings.Join(tempJumpRule(splittedRule), " ")
+		chain := splittedRule[0] + " " + splittedRule[len(splittedRule)-1]
+
+		hookTemp := firstOpIndex(opLog.ops, "insert "+tempRule)
+		unhookOld := firstOpIndex(opLog.ops, "delete "+rule)
+		deleteOld := firstOpIndex(opLog.ops, "deletechain "+chain)
+		rename := firstOpIndex(opLog.ops, "renamechain "+chain+rebuildChainSuffix)
+		if hookTemp < 0 || unhookOld < 0 || deleteOld < 0 || rename < 0 {
+			t.Fatalf("missing rebuild operations for %q: %v", rule, opLog.ops)
+		}
+		if hookTemp > unhookOld {
+			t.Errorf("new rules must be hooked in before the previous rules are removed: %v", opLog.ops)
+		}
+		if deleteOld > rename {
+			t.Errorf("previous chain must be removed before the new chain is renamed: %v", opLog.ops)
+		}
+	}
+
+	// All rules must be in place after the rebuild.
+	installed, err := iptablesInstalled(iptables.ProtocolIPv4, v4once)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !installed {
+		t.Error("jump rules are missing after rebuild")
+	}
+	for _, rule := range v4rules {
+		splittedRule := strings.Split(rule, " ")
+		splittedRule[1] += rebuildChainSuffix
+		if firstOpIndex(opLog.ops, "append "+strings.Join(splittedRule, " ")) < 0 {
+			t.Errorf("rule %q was not built in temporary chain", rule)
+		}
+	}
+}
+
+func TestWarmupNotStarted(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func(out4, in4, out6, in6 nfQueue) {
+		out4Queue, in4Queue, out6Queue, in6Queue = out4, in4, out6, in6
+	}(out4Queue, in4Queue, out6Queue, in6Queue)
+	out4Queue, in4Queue, out6Queue, in6Queue = nil, nil, nil, nil
+	defer warmupCompleted.UnSet()
+	warmupCompleted.UnSet()
+
+	if err := Warmup(context.Background()); err == nil {
+		t.Error("warmup should fail before the interception is started")
+	}
+	if WarmupCompleted() {
+		t.Error("failed warmup should not be completed")
+	}
+}
@@ -0,0 +1,99 @@
+package interception
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/safing/portmaster/network/packet"
+)
+
+var (
+	// pinnedConnections holds the IDs of the pinned connections and when they
+	// were pinned.
+	pinnedConnections     = make(map[string]time.Time)
+	pinnedConnectionsLock sync.RWMutex
+)
+
+// pinConnection pins the connection with the given ID.
+func pinConnection(id string) {
+	pinnedConnectionsLock.Lock()
+	defer pinnedConnectionsLock.Unlock()
+
+	if _, ok := pinnedConnections[id]; !ok {
+		pinnedConnections[id] = time.Now()
+	}
+}
+
+// UnpinConnection removes the pin of the connection with the given ID, see
+// PinConnection.
+func UnpinConnection(id string) {
+	pinnedConnectionsLock.Lock()
+	defer pinnedConnectionsLock.Unlock()
+
+	delete(pinnedConnections, id)
+}
+
+// IsConnectionPinned returns whether the connection with the given ID is
+// pinned, see PinConnection.
+func IsConnectionPinned(id string) bool {
+	pinnedConnectionsLock.RLock()
+	defer pinnedConnectionsLock.RUnlock()
+
+	_, ok := pinnedConnections[id]
+	return ok
+}
+
+// PinnedConnections returns the IDs of all pinned connections, sorted.
+func PinnedConnections() []string {
+	pinnedConnectionsLock.RLock()
+	defer pinnedConnectionsLock.RUnlock()
+
+	ids := make([]string, 0, len(pinnedConnections))
+	for id := range pinnedConnections {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// isTuplePinned returns whether the connection described by the tuple is
+// pinned. As the tuple does not carry the direction of the connection, both
+// possible connection IDs are checked.
+func isTuplePinned(tuple *packet.ConntrackTuple) bool {
+	pinnedConnectionsLock.RLock()
+	defer pinnedConnectionsLock.RUnlock()
+
+	if len(pinnedConnections) == 0 {
+		return false
+	}
+	outbound, inbound := tuple.ConnectionIDs()
+	_, outboundPinned := pinnedConnections[outbound]
+	_, inboundPinned := pinnedConnections[inbound]
+	return outboundPinned || inboundPinned
+}
+
+// PrunePinnedConnections removes the pins of connections that are not in the
+// given tracked flows anymore, see TrackedFlows, as they ended. Connections
+// pinned after the given time are kept, as they might not be tracked yet. It
+// returns the number of removed pins.
+func PrunePinnedConnections(tracked []*packet.ConntrackTuple, pinnedBefore time.Time) (pruned int) {
+	active := make(map[string]struct{}, 2*len(tracked))
+	for _, tuple := range tracked {
+		outbound, inbound := tuple.ConnectionIDs()
+		active[outbound] = struct{}{}
+		active[inbound] = struct{}{}
+	}
+
+	pinnedConnectionsLock.Lock()
+	defer pinnedConnectionsLock.Unlock()
+
+	for id, pinnedAt := range pinnedConnections {
+		if _, ok := active[id]; ok || pinnedAt.After(pinnedBefore) {
+			continue
+		}
+		delete(pinnedConnections, id)
+		pruned++
+	}
+	return pruned
+}
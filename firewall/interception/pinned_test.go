@@ -0,0 +1,63 @@
+package interception
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/safing/portmaster/network/packet"
+)
+
+func TestPinnedConnections(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	pinned := &packet.ConntrackTuple{
+		Protocol: packet.TCP,
+		Src:      net.IPv4(127, 0, 0, 1),
+		SrcPort:  40000,
+		Dst:      net.IPv4(127, 0, 0, 1),
+		DstPort:  817,
+	}
+	other := &packet.ConntrackTuple{
+		Protocol: packet.TCP,
+		Src:      net.IPv4(10, 0, 0, 1),
+		SrcPort:  40001,
+		Dst:      net.IPv4(1, 1, 1, 1),
+		DstPort:  443,
+	}
+	outbound, _ := pinned.ConnectionIDs()
+	defer UnpinConnection(outbound)
+
+	if err := PinConnection(outbound); err != nil {
+		t.Fatal(err)
+	}
+	if !IsConnectionPinned(outbound) || len(PinnedConnections()) != 1 {
+		t.Errorf("connection should be pinned, got %v", PinnedConnections())
+	}
+	if !isTuplePinned(pinned) {
+		t.Error("tuple of pinned connection should be pinned")
+	}
+	if isTuplePinned(other) {
+		t.Error("tuple of other connection should not be pinned")
+	}
+
+	// Pins of tracked connections and of recently pinned connections are kept.
+	if pruned := PrunePinnedConnections([]*packet.ConntrackTuple{pinned, other}, time.Now()); pruned != 0 {
+		t.Errorf("pin of tracked connection should be kept, pruned %d", pruned)
+	}
+	if pruned := PrunePinnedConnections(nil, time.Now().Add(-time.Minute)); pruned != 0 {
+		t.Errorf("pin of recent connection should be kept, pruned %d", pruned)
+	}
+	if pruned := PrunePinnedConnections([]*packet.ConntrackTuple{other}, time.Now()); pruned != 1 {
+		t.Errorf("pin of ended connection should be removed, pruned %d", pruned)
+	}
+	if IsConnectionPinned(outbound) {
+		t.Error("connection should not be pinned anymore")
+	}
+
+	if err := PinConnection(outbound); err != nil {
+		t.Fatal(err)
+	}
+	UnpinConnection(outbound)
+	if isTuplePinned(pinned) {
+		t.Error("unpinned connection should not be pinned")
+	}
+}
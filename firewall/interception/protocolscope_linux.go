@@ -0,0 +1,146 @@
+package interception
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network/packet"
+)
+
+var (
+	interceptedProtocolsFlag string
+
+	interceptedProtocols     []uint8
+	interceptedProtocolsLock sync.Mutex
+)
+
+func init() {
+	flag.StringVar(&interceptedProtocolsFlag, "nfqueue-protocols", "", "comma separated list of IP protocols (eg. tcp, udp or 132) to limit the interception to")
+}
+
+// loadProtocolScopeFlags sets the intercepted protocols as configured by
+// flags. The protocols are not changed if the flag is not set.
+func loadProtocolScopeFlags() error {
+	if interceptedProtocolsFlag == "" {
+		return nil
+	}
+
+	var protocols []uint8
+	for _, value := range splitFlagList(interceptedProtocolsFlag) {
+		protocol, err := parseIPProtocol(value)
+		if err != nil {
+			return err
+		}
+		protocols = append(protocols, protocol)
+	}
+
+	return setInterceptedProtocols(protocols)
+}
+
+// parseIPProtocol parses an IP protocol, either by name or as a number.
+func parseIPProtocol(value string) (uint8, error) {
+	switch strings.ToLower(value) {
+	case "icmp":
+		return uint8(packet.ICMP), nil
+	case "tcp":
+		return uint8(packet.TCP), nil
+	case "udp":
+		return uint8(packet.UDP), nil
+	case "icmpv6":
+		return uint8(packet.ICMPv6), nil
+	case "udplite":
+		return uint8(packet.UDPLite), nil
+	}
+
+	protocol, err := strconv.ParseUint(value, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid IP protocol %q: %w", value, err)
+	}
+	return uint8(protocol), nil
+}
+
+// setInterceptedProtocols checks and sets the intercepted IP protocols. The
+// rules are rebuilt if the interception is active.
+func setInterceptedProtocols(protocols []uint8) error {
+	cleaned := make([]uint8, 0, len(protocols))
+	seen := make(map[uint8]struct{}, len(protocols))
+	for _, protocol := range protocols {
+		if protocol == 0 {
+			return errors.New("invalid IP protocol 0")
+		}
+		if _, ok := seen[protocol]; ok {
+			continue
+		}
+		seen[protocol] = struct{}{}
+		cleaned = append(cleaned, protocol)
+	}
+	sort.Slice(cleaned, func(i, j int) bool { return cleaned[i] < cleaned[j] })
+	if len(cleaned) == 0 {
+		cleaned = nil
+	}
+
+	interceptedProtocolsLock.Lock()
+	interceptedProtocols = cleaned
+	interceptedProtocolsLock.Unlock()
+
+	if cleaned == nil {
+		log.Infof("interception: intercepting all IP protocols")
+	} else {
+		log.Infof("interception: limiting interception to IP protocols %v", cleaned)
+	}
+
+	if nfqueueActive.IsSet() {
+		RequestRuleRebuild()
+	}
+	return nil
+}
+
+// getInterceptedProtocols returns a copy of the intercepted IP protocols. If
+// all protocols are intercepted, nil is returned.
+func getInterceptedProtocols() []uint8 {
+	interceptedProtocolsLock.Lock()
+	defer interceptedProtocolsLock.Unlock()
+
+	if interceptedProtocols == nil {
+		return nil
+	}
+	return append([]uint8(nil), interceptedProtocols...)
+}
+
+// withProtocolScope returns the rules limited to the intercepted protocols:
+// The queue rules of the ingest chains only match packets of the intercepted
+// protocols, while all other packets are marked to be accepted. The accept
+// mark is not saved to the connection, so that connections are intercepted
+// again right away when the limit is lifted.
+func withProtocolScope(rules []string) []string {
+	protocols := getInterceptedProtocols()
+	if protocols == nil {
+		return rules
+	}
+
+	scoped := make([]string, 0, len(rules)+2*len(protocols))
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule, "mangle PORTMASTER-INGEST-") {
+			scoped = append(scoped, rule)
+			continue
+		}
+		match, target, ok := strings.Cut(rule, " -j NFQUEUE ")
+		if !ok {
+			scoped = append(scoped, rule)
+			continue
+		}
+
+		for _, protocol := range protocols {
+			scoped = append(scoped, fmt.Sprintf("%s -p %d -j NFQUEUE %s", match, protocol, target))
+		}
+		scoped = append(scoped, match+" -j MARK --set-mark 1700")
+	}
+
+	return scoped
+}
@@ -0,0 +1,91 @@
+package interception
+
+import (
+	"testing"
+)
+
+func TestParseIPProtocol(t *testing.T) {
+	t.Parallel()
+
+	for value, expected := range map[string]uint8{
+		"tcp":    6,
+		"UDP":    17,
+		"icmpv6": 58,
+		"132":    132,
+	} {
+		protocol, err := parseIPProtocol(value)
+		if err != nil {
+			t.Errorf("failed to parse %q: %s", value, err)
+		} else if protocol != expected {
+			t.Errorf("parsed %q as %d, expected %d", value, protocol, expected)
+		}
+	}
+
+	for _, value := range []string{"", "sctp", "256", "-1"} {
+		if _, err := parseIPProtocol(value); err == nil {
+			t.Errorf("invalid IP protocol %q should be rejected", value)
+		}
+	}
+}
+
+func TestProtocolScope(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func() {
+		_ = setInterceptedProtocols(nil)
+		_ = setCgroupScope(CgroupScope{})
+		buildRules()
+	}()
+
+	if err := setInterceptedProtocols([]uint8{0}); err == nil {
+		t.Error("protocol 0 should be rejected")
+	}
+
+	if err := setInterceptedProtocols([]uint8{17, 6, 17}); err != nil {
+		t.Fatal(err)
+	}
+	buildRules()
+
+	for _, expected := range []string{
+		"mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -p 6 -j NFQUEUE --queue-num 17040 --queue-bypass",
+		"mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -p 17 -j NFQUEUE --queue-num 17040 --queue-bypass",
+		"mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -j MARK --set-mark 1700",
+		"mangle PORTMASTER-INGEST-INPUT -m mark --mark 0 -p 6 -j NFQUEUE --queue-num 17140 --queue-bypass",
+		"mangle PORTMASTER-INGEST-INPUT -m mark --mark 0 -j MARK --set-mark 1700",
+	} {
+		if !containsRule(v4rules, expected) {
+			t.Errorf("missing rule %q", expected)
+		}
+	}
+	if !containsRule(v6rules, "mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -p 6 -j NFQUEUE --queue-num 17060 --queue-bypass") {
+		t.Error("missing IPv6 rule")
+	}
+	if containsRule(v4rules, "mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -j NFQUEUE --queue-num 17040 --queue-bypass") {
+		t.Error("unscoped queue rule should be replaced")
+	}
+
+	// Combined with a cgroup scope.
+	if err := setCgroupScope(CgroupScope{ClassIDs: []uint32{0x100001}}); err != nil {
+		t.Fatal(err)
+	}
+	buildRules()
+	for _, expected := range []string{
+		"mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -p 6 -m cgroup --cgroup 0x100001 -j NFQUEUE --queue-num 17040 --queue-bypass",
+		"mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -p 6 -j MARK --set-mark 1700",
+		"mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -j MARK --set-mark 1700",
+	} {
+		if !containsRule(v4rules, expected) {
+			t.Errorf("missing rule %q", expected)
+		}
+	}
+
+	// No protocols intercept everything.
+	if err := setCgroupScope(CgroupScope{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setInterceptedProtocols(nil); err != nil {
+		t.Fatal(err)
+	}
+	buildRules()
+	if !containsRule(v4rules, "mangle PORTMASTER-INGEST-OUTPUT -m mark --mark 0 -j NFQUEUE --queue-num 17040 --queue-bypass") {
+		t.Error("empty protocol list should intercept all traffic")
+	}
+}
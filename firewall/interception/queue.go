@@ -0,0 +1,142 @@
+package interception
+
+import (
+	"errors"
+	"flag"
+	"sync"
+	"sync/atomic"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/core/telemetry"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// DefaultQueueSize is the default capacity of the Packets channel. The
+// platform may raise it, see minimumQueueSize.
+const DefaultQueueSize = 1000
+
+// MetricQueueFull is the name of the counter of packets that could not be
+// queued, because the Packets channel was full.
+const MetricQueueFull = "firewall/interception/queue/full/total"
+
+var (
+	// packets is the channel for feeding the firewall. It is created on first
+	// use, after which its capacity cannot be changed anymore.
+	packets     chan packet.Packet
+	packetsSize int
+	packetsLock sync.Mutex
+
+	queueHighWaterMark int64
+	queueFullPackets   uint64
+
+	failOpenOnFullQueue bool
+
+	errQueueFull = errors.New("interception queue is full")
+)
+
+func init() {
+	flag.BoolVar(&failOpenOnFullQueue, "fail-open-on-full-queue", false, "accept packets that cannot be queued for the firewall because the queue is full, instead of dropping them")
+}
+
+// Packets returns the channel for feeding the firewall. The channel is created
+// on the first call, after which its capacity is fixed.
+func Packets() chan packet.Packet {
+	packetsLock.Lock()
+	defer packetsLock.Unlock()
+
+	if packets == nil {
+		packets = make(chan packet.Packet, queueSize())
+	}
+	return packets
+}
+
+// SetInterceptionQueueSize sets the capacity of the Packets channel, which
+// buffers intercepted packets until the firewall handles them. When the
+// channel is full, packets are dropped, or accepted if configured to fail
+// open, instead of stalling the interception. If not set, the capacity is
+// large enough to hold all packets the interception passes on before it
+// slows down. It must be called before the channel is first used, which
+// happens when the interception module starts.
+func SetInterceptionQueueSize(n int) error {
+	if n < 1 {
+		return errors.New("interception queue size must be at least 1")
+	}
+
+	packetsLock.Lock()
+	defer packetsLock.Unlock()
+
+	if packets != nil {
+		return errors.New("interception queue size cannot be changed after the interception started")
+	}
+	packetsSize = n
+	return nil
+}
+
+// queueSize returns the capacity for the Packets channel.
+// packetsLock must be held.
+func queueSize() int {
+	switch {
+	case packetsSize > 0:
+		return packetsSize
+	case minimumQueueSize() > DefaultQueueSize:
+		return minimumQueueSize()
+	default:
+		return DefaultQueueSize
+	}
+}
+
+// QueueSize returns the capacity of the Packets channel.
+func QueueSize() int {
+	return cap(Packets())
+}
+
+// QueueDepth returns the amount of packets waiting in the Packets channel.
+func QueueDepth() int {
+	return len(Packets())
+}
+
+// QueueHighWaterMark returns the highest amount of packets that waited in
+// the Packets channel at the same time.
+func QueueHighWaterMark() int {
+	return int(atomic.LoadInt64(&queueHighWaterMark))
+}
+
+// QueueFullPackets returns the amount of packets that could not be queued,
+// because the Packets channel was full.
+func QueueFullPackets() uint64 {
+	return atomic.LoadUint64(&queueFullPackets)
+}
+
+// enqueuePacket queues the packet to be handled by the firewall without
+// blocking. If the queue is full, the fail policy is applied to the packet.
+func enqueuePacket(packets chan<- packet.Packet, pkt packet.Packet) {
+	if packetMetricsDestination != "" {
+		pkt = tracePacket(pkt)
+	}
+
+	select {
+	case packets <- pkt:
+		depth := int64(len(packets))
+		for {
+			highWaterMark := atomic.LoadInt64(&queueHighWaterMark)
+			if depth <= highWaterMark ||
+				atomic.CompareAndSwapInt64(&queueHighWaterMark, highWaterMark, depth) {
+				break
+			}
+		}
+
+	default:
+		atomic.AddUint64(&queueFullPackets, 1)
+		telemetry.IncCounter(MetricQueueFull, nil, 1)
+
+		var err error
+		if failOpenOnFullQueue {
+			err = pkt.Accept()
+		} else {
+			err = DropOnError(pkt, packet.ErrorDropQueueOverflow, errQueueFull)
+		}
+		if err != nil {
+			log.Warningf("interception: failed to apply verdict to packet %s that did not fit into the full queue: %s", pkt, err)
+		}
+	}
+}
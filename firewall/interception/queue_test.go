@@ -0,0 +1,105 @@
+package interception
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/safing/portmaster/network/packet"
+)
+
+// verdictRecordingPacket records the verdict applied to it.
+type verdictRecordingPacket struct {
+	packet.Base
+
+	verdict string
+}
+
+func (pkt *verdictRecordingPacket) Accept() error              { pkt.verdict = "accept"; return nil }
+func (pkt *verdictRecordingPacket) Block() error               { pkt.verdict = "block"; return nil }
+func (pkt *verdictRecordingPacket) Drop() error                { pkt.verdict = "drop"; return nil }
+func (pkt *verdictRecordingPacket) PermanentAccept() error     { return pkt.Accept() }
+func (pkt *verdictRecordingPacket) PermanentBlock() error      { return pkt.Block() }
+func (pkt *verdictRecordingPacket) PermanentDrop() error       { return pkt.Drop() }
+func (pkt *verdictRecordingPacket) RerouteToNameserver() error { return nil }
+func (pkt *verdictRecordingPacket) RerouteToTunnel() error     { return nil }
+
+func TestEnqueuePacketFullQueue(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func(orig bool) { failOpenOnFullQueue = orig }(failOpenOnFullQueue)
+	failOpenOnFullQueue = false
+
+	packets := make(chan packet.Packet, 1)
+	fullBefore := QueueFullPackets()
+	overflowBefore := ErrorDrops()[packet.ErrorDropQueueOverflow]
+
+	// The first packet fits into the queue.
+	queued := &verdictRecordingPacket{}
+	enqueuePacket(packets, queued)
+	if len(packets) != 1 || queued.verdict != "" {
+		t.Fatal("packet should have been queued without a verdict")
+	}
+	if QueueHighWaterMark() < 1 {
+		t.Error("high-water mark should have been updated")
+	}
+
+	// The queue is full, so the packet is dropped without blocking.
+	dropped := &verdictRecordingPacket{}
+	enqueuePacket(packets, dropped)
+	if dropped.verdict != "drop" {
+		t.Errorf("packet should have been dropped, got verdict %q", dropped.verdict)
+	}
+	if QueueFullPackets() != fullBefore+1 {
+		t.Errorf("full queue counter should have been incremented")
+	}
+	if ErrorDrops()[packet.ErrorDropQueueOverflow] != overflowBefore+1 {
+		t.Errorf("drop should have been recorded as queue overflow")
+	}
+
+	// Failing open accepts the packet instead.
+	failOpenOnFullQueue = true
+	accepted := &verdictRecordingPacket{}
+	enqueuePacket(packets, accepted)
+	if accepted.verdict != "accept" {
+		t.Errorf("packet should have been accepted, got verdict %q", accepted.verdict)
+	}
+	if atomic.LoadUint64(&queueFullPackets) != fullBefore+2 {
+		t.Errorf("full queue counter should have been incremented")
+	}
+	if ErrorDrops()[packet.ErrorDropQueueOverflow] != overflowBefore+1 {
+		t.Errorf("accepted packet should not have been recorded as dropped")
+	}
+	if len(packets) != 1 {
+		t.Errorf("queue should still hold only the first packet")
+	}
+}
+
+func TestSetInterceptionQueueSize(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func(orig chan packet.Packet, origSize int) {
+		packets, packetsSize = orig, origSize
+	}(packets, packetsSize)
+	packets, packetsSize = nil, 0
+
+	if err := SetInterceptionQueueSize(0); err == nil {
+		t.Error("queue size of 0 should be rejected")
+	}
+	if err := SetInterceptionQueueSize(50); err != nil {
+		t.Fatal(err)
+	}
+	if QueueSize() != 50 {
+		t.Errorf("unexpected queue size %d", QueueSize())
+	}
+
+	// The channel is created on first use and cannot be replaced afterwards.
+	ch := Packets()
+	if err := SetInterceptionQueueSize(100); err == nil {
+		t.Error("queue size should not be changeable after the start")
+	}
+	if Packets() != ch || cap(ch) != 50 {
+		t.Error("channel should not have been replaced")
+	}
+
+	// By default, the channel holds at least the minimum amount of packets.
+	packets, packetsSize = nil, 0
+	if QueueSize() < minimumQueueSize() || QueueSize() < DefaultQueueSize {
+		t.Errorf("default queue size %d is smaller than the minimum of %d", QueueSize(), minimumQueueSize())
+	}
+}
@@ -0,0 +1,85 @@
+package interception
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// The interception is started before the decision engine finished loading
+// its rules, such as the filter lists, so that no connections slip through
+// while the Portmaster starts. Until the decision engine signals that it is
+// ready, packets are held by the firewall instead of being decided with an
+// incomplete rule set.
+var (
+	interceptionReadiness = newReadiness()
+	engineReadiness       = newReadiness()
+)
+
+// readiness is a one-time signal.
+type readiness struct {
+	ready chan struct{}
+	once  sync.Once
+}
+
+func newReadiness() *readiness {
+	return &readiness{
+		ready: make(chan struct{}),
+	}
+}
+
+// signal signals readiness. It may be called multiple times.
+func (r *readiness) signal() {
+	r.once.Do(func() {
+		close(r.ready)
+	})
+}
+
+// isSet returns whether readiness was signaled.
+func (r *readiness) isSet() bool {
+	select {
+	case <-r.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait waits until readiness is signaled or the context is canceled.
+func (r *readiness) wait(ctx context.Context) error {
+	select {
+	case <-r.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SignalEngineReady signals that the decision engine loaded its rules and
+// profiles and that packets may be decided.
+func SignalEngineReady() {
+	engineReadiness.signal()
+}
+
+// EngineReady returns whether the decision engine signaled that it is ready.
+func EngineReady() bool {
+	return engineReadiness.isSet()
+}
+
+// WaitForInterceptionReady waits until the interception is started and the
+// decision engine signaled that it is ready, so that connections receive
+// their real verdicts. It returns an error if the context is canceled before.
+// If the interception is disabled, it returns immediately.
+func WaitForInterceptionReady(ctx context.Context) error {
+	if disableInterception {
+		return nil
+	}
+
+	if err := interceptionReadiness.wait(ctx); err != nil {
+		return fmt.Errorf("interception is not started: %w", err)
+	}
+	if err := engineReadiness.wait(ctx); err != nil {
+		return fmt.Errorf("decision engine is not ready: %w", err)
+	}
+	return nil
+}
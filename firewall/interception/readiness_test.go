@@ -0,0 +1,50 @@
+package interception
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	t.Parallel()
+
+	r := newReadiness()
+	if r.isSet() {
+		t.Fatal("readiness must not be set initially")
+	}
+
+	// Waiting is bounded by the context.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := r.wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// Waiters that started before the signal are released by it.
+	released := make(chan error, 3)
+	for i := 0; i < cap(released); i++ {
+		go func() {
+			released <- r.wait(context.Background())
+		}()
+	}
+	r.signal()
+	r.signal()
+	for i := 0; i < cap(released); i++ {
+		select {
+		case err := <-released:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("waiter was not released")
+		}
+	}
+	if !r.isSet() {
+		t.Error("readiness must be set after signaling")
+	}
+	if err := r.wait(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,91 @@
+package interception
+
+import (
+	"sync"
+	"time"
+
+	"github.com/safing/portbase/log"
+)
+
+// ruleRebuildDelay defines how long rule rebuild requests are collected
+// before the rules are rebuilt, so that multiple changes in a short time
+// result in a single rebuild.
+const ruleRebuildDelay = 1 * time.Second
+
+var (
+	ruleRebuildLock    sync.Mutex
+	ruleRebuildTimer   *time.Timer
+	ruleRebuildStopped bool
+
+	// ruleRebuildExecLock makes sure only one rebuild runs at a time.
+	ruleRebuildExecLock sync.Mutex
+
+	// executeRebuild rebuilds the rules. It is replaced in tests.
+	executeRebuild = rebuildRules
+)
+
+// RequestRuleRebuild requests the rules of the system integration to be
+// rebuilt, eg. because the configuration they are based on changed. Requests
+// are coalesced: The rebuild runs after a short delay and covers all requests
+// made until then. The rebuild replaces the rules atomically, so that there
+// is no gap in which traffic is not handled by any rules.
+func RequestRuleRebuild() {
+	if disableInterception {
+		return
+	}
+
+	ruleRebuildLock.Lock()
+	defer ruleRebuildLock.Unlock()
+
+	// Check if the rebuild is already scheduled or the interception is stopping.
+	if ruleRebuildTimer != nil || ruleRebuildStopped {
+		return
+	}
+
+	ruleRebuildTimer = time.AfterFunc(ruleRebuildDelay, executeRuleRebuild)
+}
+
+func executeRuleRebuild() {
+	// Requests made from now on result in another rebuild.
+	ruleRebuildLock.Lock()
+	ruleRebuildTimer = nil
+	stopped := ruleRebuildStopped
+	ruleRebuildLock.Unlock()
+	if stopped {
+		return
+	}
+
+	ruleRebuildExecLock.Lock()
+	defer ruleRebuildExecLock.Unlock()
+
+	started := time.Now()
+	if err := executeRebuild(); err != nil {
+		log.Warningf("interception: failed to rebuild rules: %s", err)
+		return
+	}
+	log.Infof("interception: rebuilt rules in %s", time.Since(started))
+}
+
+// startRuleRebuilds allows rule rebuilds again after they were stopped with
+// stopRuleRebuilds, eg. when the interception is started again.
+func startRuleRebuilds() {
+	ruleRebuildLock.Lock()
+	defer ruleRebuildLock.Unlock()
+
+	ruleRebuildStopped = false
+}
+
+// stopRuleRebuilds cancels any scheduled rule rebuild and waits for a running
+// rebuild to finish. Rebuilds requested afterwards are ignored.
+func stopRuleRebuilds() {
+	ruleRebuildLock.Lock()
+	ruleRebuildStopped = true
+	if ruleRebuildTimer != nil {
+		ruleRebuildTimer.Stop()
+		ruleRebuildTimer = nil
+	}
+	ruleRebuildLock.Unlock()
+
+	ruleRebuildExecLock.Lock()
+	defer ruleRebuildExecLock.Unlock()
+}
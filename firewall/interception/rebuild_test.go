@@ -0,0 +1,56 @@
+package interception
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRuleRebuildCoalescing(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	var rebuilds int64
+	defer func(fn func() error) {
+		executeRebuild = fn
+	}(executeRebuild)
+	executeRebuild = func() error {
+		atomic.AddInt64(&rebuilds, 1)
+		return nil
+	}
+	defer stopRuleRebuilds()
+
+	waitForRebuilds := func(expected int64) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * ruleRebuildDelay)
+		for atomic.LoadInt64(&rebuilds) < expected && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		// Leave time for unexpected additional rebuilds.
+		time.Sleep(ruleRebuildDelay / 5)
+		if n := atomic.LoadInt64(&rebuilds); n != expected {
+			t.Fatalf("expected %d rebuilds, got %d", expected, n)
+		}
+	}
+
+	// Requests made in a short time result in a single rebuild.
+	startRuleRebuilds()
+	for i := 0; i < 5; i++ {
+		RequestRuleRebuild()
+	}
+	waitForRebuilds(1)
+
+	// Requests are ignored while rebuilds are stopped.
+	stopRuleRebuilds()
+	RequestRuleRebuild()
+	ruleRebuildLock.Lock()
+	scheduled := ruleRebuildTimer != nil
+	ruleRebuildLock.Unlock()
+	if scheduled {
+		t.Error("rebuild must not be scheduled while rebuilds are stopped")
+	}
+
+	// Rebuilds are possible again after restarting.
+	startRuleRebuilds()
+	RequestRuleRebuild()
+	RequestRuleRebuild()
+	waitForRebuilds(2)
+}
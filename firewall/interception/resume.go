@@ -0,0 +1,139 @@
+package interception
+
+import (
+	"errors"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/core/journal"
+)
+
+const (
+	// resumeCheckInterval defines how often the clocks are compared in order to
+	// detect a system resume.
+	resumeCheckInterval = 5 * time.Second
+
+	// DefaultResumeDetectionThreshold is the default amount of time the wall
+	// clock must have advanced more than the monotonic clock for a system
+	// resume to be detected.
+	DefaultResumeDetectionThreshold = 30 * time.Second
+)
+
+var (
+	resumeDetectionThreshold     time.Duration
+	resumeDetectionThresholdLock sync.Mutex
+
+	resumeWatcherLock sync.Mutex
+	resumeWatcherDone chan struct{}
+)
+
+func init() {
+	flag.DurationVar(
+		&resumeDetectionThreshold,
+		"resume-detection-threshold",
+		DefaultResumeDetectionThreshold,
+		"jump of the wall clock against the monotonic clock that is treated as a system resume and reloads the interception; 0 disables the detection",
+	)
+}
+
+// SetResumeDetectionThreshold sets the amount of time the wall clock must have
+// advanced more than the monotonic clock for a system resume to be detected.
+// The monotonic clock does not advance while the system is suspended, so the
+// difference is about the time the system was suspended. A threshold of 0
+// disables the detection.
+func SetResumeDetectionThreshold(threshold time.Duration) error {
+	if threshold < 0 {
+		return errors.New("resume detection threshold must not be negative")
+	}
+
+	resumeDetectionThresholdLock.Lock()
+	defer resumeDetectionThresholdLock.Unlock()
+
+	resumeDetectionThreshold = threshold
+	return nil
+}
+
+func getResumeDetectionThreshold() time.Duration {
+	resumeDetectionThresholdLock.Lock()
+	defer resumeDetectionThresholdLock.Unlock()
+
+	return resumeDetectionThreshold
+}
+
+// startResumeWatcher starts watching for system resumes in the background.
+func startResumeWatcher() {
+	resumeWatcherLock.Lock()
+	defer resumeWatcherLock.Unlock()
+
+	if resumeWatcherDone != nil {
+		return
+	}
+	resumeWatcherDone = make(chan struct{})
+	go watchForResume(resumeWatcherDone)
+}
+
+// stopResumeWatcher stops watching for system resumes.
+func stopResumeWatcher() {
+	resumeWatcherLock.Lock()
+	defer resumeWatcherLock.Unlock()
+
+	if resumeWatcherDone != nil {
+		close(resumeWatcherDone)
+		resumeWatcherDone = nil
+	}
+}
+
+func watchForResume(done <-chan struct{}) {
+	ticker := time.NewTicker(resumeCheckInterval)
+	defer ticker.Stop()
+
+	lastCheck := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			// Round(0) strips the monotonic clock reading.
+			wallElapsed := now.Round(0).Sub(lastCheck.Round(0))
+			monotonicElapsed := now.Sub(lastCheck)
+			lastCheck = now
+
+			suspended, resumed := detectResume(wallElapsed, monotonicElapsed, getResumeDetectionThreshold())
+			if resumed {
+				reloadAfterResume(suspended)
+			}
+		}
+	}
+}
+
+// detectResume compares the time that passed according to the wall clock and
+// the monotonic clock. As the monotonic clock does not advance while the
+// system is suspended, a difference larger than the threshold is treated as a
+// system resume. A threshold of 0 disables the detection.
+func detectResume(wallElapsed, monotonicElapsed, threshold time.Duration) (suspended time.Duration, resumed bool) {
+	if threshold <= 0 {
+		return 0, false
+	}
+
+	suspended = wallElapsed - monotonicElapsed
+	return suspended, suspended > threshold
+}
+
+// reloadAfterResume gracefully reloads the interception after a system
+// resume, as the system integration might not have survived the suspend.
+func reloadAfterResume(suspended time.Duration) {
+	log.Warningf("interception: system resume detected after about %s, reloading interception", suspended.Round(time.Second))
+	journal.Send(journal.PriorityNotice, "reloading packet interception after system resume", journal.Fields{
+		"EVENT":     "interception_resume_reload",
+		"SUSPENDED": suspended.Round(time.Second).String(),
+	})
+
+	started := time.Now()
+	if err := reload(); err != nil {
+		log.Errorf("interception: failed to reload interception after system resume: %s", err)
+		return
+	}
+	log.Infof("interception: reloaded interception after system resume in %s", time.Since(started))
+}
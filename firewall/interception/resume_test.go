@@ -0,0 +1,50 @@
+package interception
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDetectResume(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name             string
+		wallElapsed      time.Duration
+		monotonicElapsed time.Duration
+		threshold        time.Duration
+		resumed          bool
+	}{
+		{"regular tick", 5 * time.Second, 5 * time.Second, 30 * time.Second, false},
+		{"small clock adjustment", 15 * time.Second, 5 * time.Second, 30 * time.Second, false},
+		{"clock set back", 5 * time.Second, time.Hour, 30 * time.Second, false},
+		{"resume", time.Hour, 5 * time.Second, 30 * time.Second, true},
+		{"disabled", time.Hour, 5 * time.Second, 0, false},
+	}
+
+	for _, tt := range tests {
+		suspended, resumed := detectResume(tt.wallElapsed, tt.monotonicElapsed, tt.threshold)
+		if resumed != tt.resumed {
+			t.Errorf("%s: expected resumed=%v, got %v (suspended %s)", tt.name, tt.resumed, resumed, suspended)
+		}
+		if resumed && suspended != tt.wallElapsed-tt.monotonicElapsed {
+			t.Errorf("%s: unexpected suspended time %s", tt.name, suspended)
+		}
+	}
+}
+
+func TestSetResumeDetectionThreshold(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func() {
+		_ = SetResumeDetectionThreshold(DefaultResumeDetectionThreshold)
+	}()
+
+	if err := SetResumeDetectionThreshold(-time.Second); err == nil {
+		t.Error("negative threshold should be rejected")
+	}
+	if err := SetResumeDetectionThreshold(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if getResumeDetectionThreshold() != time.Minute {
+		t.Errorf("unexpected threshold %s", getResumeDetectionThreshold())
+	}
+}
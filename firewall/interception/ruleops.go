@@ -0,0 +1,51 @@
+package interception
+
+import (
+	"sync"
+	"time"
+)
+
+// maxRuleOperations defines how many rule operations are kept.
+const maxRuleOperations = 1000
+
+// RuleOperation describes a single change to the firewall rules of the system
+// that was issued by the interception.
+type RuleOperation struct {
+	Time time.Time
+	// Protocol is the IP protocol of the changed rules, ie. ipv4 or ipv6.
+	Protocol string
+	// Operation is the kind of change, eg. append or delete-chain.
+	Operation string
+	// Rule holds the table, chain and rule specification that was changed.
+	Rule string
+	// Error holds the error of the operation, if it failed.
+	Error string `json:",omitempty"`
+}
+
+var (
+	ruleOperations     []RuleOperation
+	ruleOperationsLock sync.Mutex
+)
+
+// recordRuleOperation records the given rule operation and drops the oldest
+// recorded operation, if the limit is reached.
+func recordRuleOperation(op RuleOperation) {
+	ruleOperationsLock.Lock()
+	defer ruleOperationsLock.Unlock()
+
+	if len(ruleOperations) >= maxRuleOperations {
+		ruleOperations = append(ruleOperations[:0], ruleOperations[len(ruleOperations)-maxRuleOperations+1:]...)
+	}
+	ruleOperations = append(ruleOperations, op)
+}
+
+// RuleOperations returns the recorded changes to the firewall rules, oldest
+// first. Operations are only recorded if enabled with --log-rule-operations.
+// Together with DumpInstalledRules, this shows which operation failed and
+// which rules were left behind when installing or removing the rules fails.
+func RuleOperations() []RuleOperation {
+	ruleOperationsLock.Lock()
+	defer ruleOperationsLock.Unlock()
+
+	return append([]RuleOperation(nil), ruleOperations...)
+}
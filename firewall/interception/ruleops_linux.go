@@ -0,0 +1,162 @@
+package interception
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/netenv"
+)
+
+var logRuleOperations bool
+
+func init() {
+	flag.BoolVar(&logRuleOperations, "log-rule-operations", false, "log and record every change of the iptables rules when installing and removing the interception, for debugging")
+}
+
+// openIPTables returns an iptables handler for the given protocol. If rule
+// operations are logged, the handler logs and records all changes.
+func openIPTables(protocol iptables.Protocol) (ipTables, error) {
+	tbls, err := newIPTables(protocol)
+	if err != nil || !logRuleOperations {
+		return tbls, err
+	}
+
+	return &recordingIPTables{
+		protocol: protocolName(protocol),
+		tbls:     tbls,
+	}, nil
+}
+
+func protocolName(protocol iptables.Protocol) string {
+	if protocol == iptables.ProtocolIPv6 {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// recordingIPTables logs and records all changes to the rules.
+type recordingIPTables struct {
+	protocol string
+	tbls     ipTables
+}
+
+func (rt *recordingIPTables) record(operation string, err error, rule ...string) {
+	op := RuleOperation{
+		Time:      time.Now(),
+		Protocol:  rt.protocol,
+		Operation: operation,
+		Rule:      strings.Join(rule, " "),
+	}
+	if err != nil {
+		op.Error = err.Error()
+		log.Warningf("interception: rule operation failed: %s %s %s: %s", op.Protocol, op.Operation, op.Rule, op.Error)
+	} else {
+		log.Infof("interception: rule operation: %s %s %s", op.Protocol, op.Operation, op.Rule)
+	}
+	recordRuleOperation(op)
+}
+
+func (rt *recordingIPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	return rt.tbls.Exists(table, chain, rulespec...)
+}
+
+func (rt *recordingIPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	err := rt.tbls.Insert(table, chain, pos, rulespec...)
+	rt.record("insert", err, append([]string{table, chain}, rulespec...)...)
+	return err
+}
+
+func (rt *recordingIPTables) Append(table, chain string, rulespec ...string) error {
+	err := rt.tbls.Append(table, chain, rulespec...)
+	rt.record("append", err, append([]string{table, chain}, rulespec...)...)
+	return err
+}
+
+func (rt *recordingIPTables) Delete(table, chain string, rulespec ...string) error {
+	err := rt.tbls.Delete(table, chain, rulespec...)
+	rt.record("delete", err, append([]string{table, chain}, rulespec...)...)
+	return err
+}
+
+func (rt *recordingIPTables) ClearChain(table, chain string) error {
+	err := rt.tbls.ClearChain(table, chain)
+	rt.record("clear-chain", err, table, chain)
+	return err
+}
+
+func (rt *recordingIPTables) DeleteChain(table, chain string) error {
+	err := rt.tbls.DeleteChain(table, chain)
+	rt.record("delete-chain", err, table, chain)
+	return err
+}
+
+func (rt *recordingIPTables) RenameChain(table, oldChain, newChain string) error {
+	err := rt.tbls.RenameChain(table, oldChain, newChain)
+	rt.record("rename-chain", err, table, oldChain, newChain)
+	return err
+}
+
+func (rt *recordingIPTables) List(table, chain string) ([]string, error) {
+	return rt.tbls.List(table, chain)
+}
+
+func (rt *recordingIPTables) ListChains(table string) ([]string, error) {
+	return rt.tbls.ListChains(table)
+}
+
+// dumpInstalledRules returns all Portmaster rules that are currently installed
+// in the system firewall, as returned by iptables -S and prefixed with the
+// protocol and table. This includes the rules of all Portmaster chains and
+// all Portmaster rules in the chains of the system.
+func dumpInstalledRules() ([]string, error) {
+	var rules []string
+	var result *multierror.Error
+
+	protocols := []iptables.Protocol{iptables.ProtocolIPv4}
+	if netenv.IPv6Enabled() {
+		protocols = append(protocols, iptables.ProtocolIPv6)
+	}
+	for _, protocol := range protocols {
+		tbls, err := newIPTables(protocol)
+		if err != nil {
+			result = multierror.Append(result, fmt.Errorf("%s: %w", protocolName(protocol), err))
+			continue
+		}
+
+		for _, table := range cleanupTables {
+			chains, err := tbls.ListChains(table)
+			if err != nil {
+				result = multierror.Append(result, fmt.Errorf("%s: %w", protocolName(protocol), err))
+				continue
+			}
+			sort.Strings(chains)
+
+			for _, chain := range chains {
+				chainRules, err := tbls.List(table, chain)
+				if err != nil {
+					result = multierror.Append(result, fmt.Errorf("%s: %w", protocolName(protocol), err))
+					continue
+				}
+
+				pmChain := strings.HasPrefix(chain, portmasterChainPrefix)
+				for _, rule := range chainRules {
+					if !strings.HasPrefix(rule, "-A ") {
+						continue
+					}
+					if _, ok := portmasterRule(rule); ok || pmChain {
+						rules = append(rules, protocolName(protocol)+" "+table+" "+rule)
+					}
+				}
+			}
+		}
+	}
+
+	return rules, result.ErrorOrNil()
+}
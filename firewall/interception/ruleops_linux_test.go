@@ -0,0 +1,117 @@
+package interception
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// failingAppendIPTables fails to append rules.
+type failingAppendIPTables struct {
+	*fakeIPTables
+}
+
+func (t *failingAppendIPTables) Append(table, chain string, rulespec ...string) error {
+	return errors.New("append failed")
+}
+
+func TestRecordRuleOperations(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func(orig func(iptables.Protocol) (ipTables, error)) { newIPTables = orig }(newIPTables)
+	defer func(orig bool) { logRuleOperations = orig }(logRuleOperations)
+	defer func() { ruleOperations = nil }()
+
+	fake := &fakeIPTables{log: &operationLog{}, rules: make(map[string]bool)}
+	newIPTables = func(protocol iptables.Protocol) (ipTables, error) {
+		return fake, nil
+	}
+	chains := []string{"mangle PORTMASTER-INGEST-OUTPUT"}
+	rules := []string{"mangle PORTMASTER-INGEST-OUTPUT -j RETURN"}
+	once := []string{"mangle OUTPUT -j PORTMASTER-INGEST-OUTPUT"}
+
+	// Nothing is recorded if disabled.
+	logRuleOperations = false
+	ruleOperations = nil
+	if err := activateIPTables(iptables.ProtocolIPv4, rules, once, chains); err != nil {
+		t.Fatal(err)
+	}
+	if len(RuleOperations()) != 0 {
+		t.Fatalf("operations should not be recorded: %+v", RuleOperations())
+	}
+
+	// Operations are recorded in order.
+	logRuleOperations = true
+	fake.rules = make(map[string]bool)
+	if err := activateIPTables(iptables.ProtocolIPv4, rules, once, chains); err != nil {
+		t.Fatal(err)
+	}
+	if err := deactivateIPTables(iptables.ProtocolIPv4, once, chains); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"clear-chain mangle PORTMASTER-INGEST-OUTPUT",
+		"append mangle PORTMASTER-INGEST-OUTPUT -j RETURN",
+		"insert mangle OUTPUT -j PORTMASTER-INGEST-OUTPUT",
+		"delete mangle OUTPUT -j PORTMASTER-INGEST-OUTPUT",
+		"clear-chain mangle PORTMASTER-INGEST-OUTPUT",
+		"delete-chain mangle PORTMASTER-INGEST-OUTPUT",
+	}
+	ops := RuleOperations()
+	if len(ops) != len(expected) {
+		t.Fatalf("expected %d operations, got %+v", len(expected), ops)
+	}
+	for i, op := range ops {
+		if op.Protocol != "ipv4" || op.Operation+" "+op.Rule != expected[i] || op.Error != "" {
+			t.Errorf("operation %d: expected %q, got %+v", i, expected[i], op)
+		}
+	}
+
+	// Failed operations are recorded with their error.
+	ruleOperations = nil
+	newIPTables = func(protocol iptables.Protocol) (ipTables, error) {
+		return &failingAppendIPTables{fake}, nil
+	}
+	if err := activateIPTables(iptables.ProtocolIPv4, rules, once, chains); err == nil {
+		t.Fatal("activation should have failed")
+	}
+	ops = RuleOperations()
+	if len(ops) != 2 || ops[1].Operation != "append" || ops[1].Error != "append failed" {
+		t.Errorf("failed operation should have been recorded last: %+v", ops)
+	}
+}
+
+func TestDumpInstalledRules(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func(orig func(iptables.Protocol) (ipTables, error)) { newIPTables = orig }(newIPTables)
+
+	fake := &fakeIPTables{log: &operationLog{}, rules: map[string]bool{
+		"mangle OUTPUT -j PORTMASTER-INGEST-OUTPUT":         true,
+		"mangle OUTPUT -j ACCEPT":                           true,
+		"mangle PORTMASTER-INGEST-OUTPUT -j RETURN":         true,
+		"filter INPUT -p tcp --dport 22 -j ACCEPT":          true,
+		"filter PORTMASTER-FILTER -m mark --mark 0 -j DROP": true,
+	}}
+	newIPTables = func(protocol iptables.Protocol) (ipTables, error) {
+		if protocol == iptables.ProtocolIPv6 {
+			return &fakeIPTables{log: &operationLog{}, rules: make(map[string]bool)}, nil
+		}
+		return fake, nil
+	}
+
+	rules, err := dumpInstalledRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"ipv4 mangle -A OUTPUT -j PORTMASTER-INGEST-OUTPUT",
+		"ipv4 mangle -A PORTMASTER-INGEST-OUTPUT -j RETURN",
+		"ipv4 filter -A PORTMASTER-FILTER -m mark --mark 0 -j DROP",
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("unexpected rules: %v", rules)
+	}
+	for i, rule := range rules {
+		if rule != expected[i] {
+			t.Errorf("rule %d: expected %q, got %q", i, expected[i], rule)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package interception
+
+// State describes the configuration and state of the interception.
+type State struct {
+	// Mode is the system integration that is used for intercepting packets.
+	Mode string
+	// Active is set if the interception is running.
+	Active bool
+	// WarmupCompleted is set when the interception is warmed up.
+	WarmupCompleted bool
+	// CustomVerdictDecider is set if packets are decided by a custom verdict
+	// decider instead of the built-in profile engine.
+	CustomVerdictDecider bool
+	// DropCapture is set if dropped and blocked packets are captured.
+	DropCapture bool
+	// Netns is the path of the network namespace the interception runs in,
+	// if it does not run in the namespace of the Portmaster.
+	Netns string `json:",omitempty"`
+
+	// Queues holds the packet queues of the interception.
+	Queues []QueueState `json:",omitempty"`
+	// Marks holds the packet marks used for the verdicts, by verdict name.
+	Marks map[string]uint32 `json:",omitempty"`
+	// Rules holds the firewall rules of the interception.
+	Rules []string `json:",omitempty"`
+	// RulesInstalled is set if the rules that hook the interception into the
+	// system firewall are installed.
+	RulesInstalled bool
+	// CgroupScope is the cgroup scope the interception is limited to.
+	CgroupScope CgroupScope
+	// InterceptedProtocols holds the IP protocols the interception is limited
+	// to. If empty, all protocols are intercepted.
+	InterceptedProtocols []uint8 `json:",omitempty"`
+	// TTLNormalization is the TTL accepted packets are rewritten to, if not 0.
+	// Accepted connections are not permanently accepted while it is set.
+	TTLNormalization uint8
+	// HeaderCopy is set if the general queues only copy the packet headers.
+	HeaderCopy bool
+	// BackpressureHighWatermark is the number of packets waiting for a verdict
+	// per queue at which reading from the queue is paused, if not 0.
+	BackpressureHighWatermark uint32 `json:",omitempty"`
+	// BackpressureLowWatermark is the number of packets waiting for a verdict
+	// per queue at which reading from a paused queue is resumed.
+	BackpressureLowWatermark uint32 `json:",omitempty"`
+}
+
+// QueueState describes a packet queue of the interception.
+type QueueState struct {
+	// Number is the number of the queue.
+	Number uint16
+	// IPVersion is the IP version of the packets in the queue.
+	IPVersion uint8
+	// Inbound is set if the queue receives inbound packets.
+	Inbound bool
+	// FullCopy is set if the queue receives the packets of connections that
+	// requested full copies.
+	FullCopy bool
+	// CopyRange is the maximum amount of bytes that is copied per packet.
+	CopyRange uint32 `json:",omitempty"`
+}
+
+// GetState returns the current configuration and state of the interception.
+// If the state could not be fully determined, the partial state is returned
+// together with the error.
+func GetState() (State, error) {
+	state := State{
+		Mode:                 "disabled",
+		WarmupCompleted:      WarmupCompleted(),
+		CustomVerdictDecider: getVerdictDecider() != nil,
+		DropCapture:          getDropCapture() != nil,
+	}
+	if disableInterception {
+		return state, nil
+	}
+
+	err := getState(&state)
+	return state, err
+}
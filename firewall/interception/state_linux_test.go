@@ -0,0 +1,50 @@
+package interception
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/safing/portmaster/firewall/interception/nfq"
+)
+
+func TestNfqueueState(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	setupShutdownTest(t, false)
+
+	state, err := GetState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Mode != "nfqueue" {
+		t.Errorf("unexpected mode %q", state.Mode)
+	}
+	if !state.RulesInstalled {
+		t.Error("rules should be reported as installed")
+	}
+	if len(state.Queues) < 2 || state.Queues[0].Number != 17040 || !state.Queues[1].Inbound {
+		t.Errorf("unexpected queues %+v", state.Queues)
+	}
+	if state.Marks["accept-permanently"] != nfq.MarkAcceptAlways {
+		t.Errorf("unexpected marks %+v", state.Marks)
+	}
+	if !containsRule(state.Rules, "ipv4 mangle PORTMASTER-INGEST-OUTPUT -j CONNMARK --restore-mark") ||
+		!containsRule(state.Rules, "ipv4 mangle OUTPUT -m comment --comment portmaster -j PORTMASTER-INGEST-OUTPUT") {
+		t.Errorf("rules are missing in %v", state.Rules)
+	}
+
+	// The state must be serializable.
+	if _, err := json.Marshal(state); err != nil {
+		t.Fatal(err)
+	}
+
+	// Removed rules are detected.
+	if err := DeactivateNfqueueFirewall(); err != nil {
+		t.Fatal(err)
+	}
+	state, err = GetState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.RulesInstalled {
+		t.Error("rules should be reported as not installed")
+	}
+}
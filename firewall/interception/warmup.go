@@ -0,0 +1,48 @@
+package interception
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/tevino/abool"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network/state"
+)
+
+var warmupCompleted = abool.New()
+
+// Warmup eagerly performs setup that would otherwise be done when the first
+// packets are handled: The system integration is verified to be fully set up
+// and the system state tables used for attributing packets to processes are
+// loaded. It must be called after the interception was started. If the
+// interception is disabled, there is nothing to warm up and the warmup is
+// completed immediately.
+func Warmup(ctx context.Context) error {
+	if disableInterception {
+		warmupCompleted.Set()
+		return nil
+	}
+
+	started := time.Now()
+	if err := warmup(); err != nil {
+		return err
+	}
+
+	// Load the system state tables.
+	_ = state.GetInfo()
+
+	if ctx.Err() != nil {
+		return errors.New("warmup canceled")
+	}
+
+	warmupCompleted.Set()
+	log.Infof("interception: warmup completed in %s", time.Since(started))
+	return nil
+}
+
+// WarmupCompleted returns whether the interception warmup completed.
+func WarmupCompleted() bool {
+	return warmupCompleted.IsSet()
+}
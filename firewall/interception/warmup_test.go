@@ -0,0 +1,20 @@
+package interception
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWarmupDisabledInterception(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func(orig bool) { disableInterception = orig }(disableInterception)
+	disableInterception = true
+	defer warmupCompleted.UnSet()
+	warmupCompleted.UnSet()
+
+	if err := Warmup(context.Background()); err != nil {
+		t.Fatalf("warmup of disabled interception failed: %s", err)
+	}
+	if !WarmupCompleted() {
+		t.Error("warmup of disabled interception should be completed")
+	}
+}
@@ -133,6 +133,11 @@ func Start() error {
 	return nil
 }
 
+// IsReady returns whether the kext is started and ready to accept commands.
+func IsReady() bool {
+	return ready.IsSet()
+}
+
 // Stop intercepting.
 func Stop() error {
 	kextLock.Lock()
@@ -0,0 +1,39 @@
+package firewall
+
+import (
+	"strconv"
+
+	"github.com/safing/portmaster/core/journal"
+	"github.com/safing/portmaster/network"
+)
+
+// journalBlockedConnection sends an event to the system journal, if the
+// connection was blocked or dropped. The connection must be locked.
+func journalBlockedConnection(conn *network.Connection) {
+	if !journal.Enabled() {
+		return
+	}
+
+	switch conn.Verdict.Firewall { //nolint:exhaustive // Only blocking verdicts are journaled.
+	case network.VerdictBlock, network.VerdictDrop:
+	default:
+		return
+	}
+
+	fields := journal.Fields{
+		"EVENT":         "connection_" + conn.Verdict.Firewall.Verb(),
+		"VERDICT":       conn.Verdict.Firewall.String(),
+		"REASON":        conn.Reason.Msg,
+		"RULE":          conn.Reason.OptionKey,
+		"PROFILE":       conn.ProcessContext.Profile,
+		"CONNECTION_ID": conn.ID,
+		"PROCESS":       conn.ProcessContext.BinaryPath,
+		"PID":           strconv.Itoa(conn.ProcessContext.PID),
+	}
+	if conn.Entity != nil {
+		fields["REMOTE_IP"] = conn.Entity.IP.String()
+		fields["REMOTE_DOMAIN"] = conn.Entity.Domain
+	}
+
+	journal.Send(journal.PriorityNotice, "connection "+conn.Verdict.Firewall.Verb(), fields)
+}
@@ -0,0 +1,150 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/firewall/interception"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// resetVerdictOfConnection resets the verdict of a connection in the system
+// integration. It is a variable for testing.
+var resetVerdictOfConnection = interception.ResetVerdictOfConnection
+
+// KillConnection immediately tears down the given connection. All further
+// packets of the connection are dropped and its verdict is not re-evaluated
+// anymore. Its verdict is reset in the system integration, so that packets
+// that already have a permanent verdict reach the firewall again. TCP
+// connections are additionally reset by injecting RST segments to both the
+// local and the remote endpoint. As the firewall does not see the packets of
+// connections with a permanent verdict, the known sequence numbers may be
+// outdated. The resets are thus sent when the next packet of the connection
+// reaches the firewall, using its sequence numbers. Only if the verdict could
+// not be reset, they are sent right away with the known sequence numbers.
+// This is a stronger action than resetting its verdict, which only lets the
+// connection be evaluated again.
+func KillConnection(conn *network.Connection) error {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if conn.Type != network.IPConnection {
+		return errors.New("only IP connections can be killed")
+	}
+
+	err := killConnection(conn)
+	conn.Save()
+	log.Infof("filter: killed connection %s", conn)
+	return err
+}
+
+// killConnection kills the connection. The connection must be locked.
+func killConnection(conn *network.Connection) error {
+	conn.SetVerdict(network.VerdictDrop, "connection was killed", "", nil)
+	conn.Verdict.Active = network.VerdictDrop
+	conn.Verdict.Worst = network.VerdictDrop
+	conn.Killed = true
+
+	var result *multierror.Error
+	resetErr := resetVerdictOfConnection(connectionInfo(conn))
+	if resetErr != nil {
+		result = multierror.Append(result, fmt.Errorf("failed to reset verdict: %w", resetErr))
+	}
+	if conn.IPProtocol == packet.TCP {
+		if resetErr == nil {
+			conn.KillResetPending = true
+		} else {
+			localSeq, remoteSeq, ok := conn.TCPSequences()
+			if !ok {
+				result = multierror.Append(result, errors.New("sequence numbers of the connection are not known"))
+			} else if err := resetTCPConnection(conn, localSeq, remoteSeq); err != nil {
+				result = multierror.Append(result, err)
+			}
+		}
+	}
+
+	return result.ErrorOrNil()
+}
+
+// sendPendingTCPResets sends the pending resets of a killed TCP connection,
+// using the sequence numbers of the given packet of the connection. The packet
+// must be dropped, so that its receiver still expects its sequence number. The
+// connection must be locked.
+func sendPendingTCPResets(conn *network.Connection, pkt packet.Packet) {
+	if !conn.KillResetPending {
+		return
+	}
+	seq, ok := packet.ParseTCPSequence(pkt.Raw())
+	if !ok || seq.Reset || !seq.HasAck {
+		// Wait for a packet that holds both sequence numbers.
+		return
+	}
+	conn.KillResetPending = false
+
+	localSeq, remoteSeq := seq.Seq, seq.Ack
+	if pkt.IsInbound() {
+		localSeq, remoteSeq = seq.Ack, seq.Seq
+	}
+	if err := resetTCPConnection(conn, localSeq, remoteSeq); err != nil {
+		log.Warningf("filter: failed to reset killed connection %s: %s", conn, err)
+		return
+	}
+	log.Infof("filter: reset killed connection %s", conn)
+}
+
+// connectionInfo returns the packet info of the packets from the initiator of
+// the connection.
+func connectionInfo(conn *network.Connection) *packet.Info {
+	info := &packet.Info{
+		Inbound:  conn.Inbound,
+		Version:  conn.IPVersion,
+		Protocol: conn.IPProtocol,
+	}
+	if conn.Inbound {
+		info.Src, info.SrcPort = conn.Entity.IP, conn.Entity.Port
+		info.Dst, info.DstPort = conn.LocalIP, conn.LocalPort
+	} else {
+		info.Src, info.SrcPort = conn.LocalIP, conn.LocalPort
+		info.Dst, info.DstPort = conn.Entity.IP, conn.Entity.Port
+	}
+	return info
+}
+
+// forgeTCPResets forges the RST segments that reset the TCP connection at the
+// local and at the remote endpoint, which expect the given next sequence
+// numbers of their peers. The connection must be locked.
+func forgeTCPResets(conn *network.Connection, localSeq, remoteSeq uint32) (toLocal, toRemote []byte, err error) {
+	// The reset to the local endpoint is sent as if by the remote endpoint and
+	// vice versa, each with the sequence number the receiver expects next.
+	toLocal, err = packet.ForgeTCPReset(conn.Entity.IP, conn.Entity.Port, conn.LocalIP, conn.LocalPort, remoteSeq)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to forge reset to local endpoint: %w", err)
+	}
+	toRemote, err = packet.ForgeTCPReset(conn.LocalIP, conn.LocalPort, conn.Entity.IP, conn.Entity.Port, localSeq)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to forge reset to remote endpoint: %w", err)
+	}
+	return toLocal, toRemote, nil
+}
+
+// resetTCPConnection injects RST segments to both endpoints of the TCP
+// connection, using the given next sequence numbers of the local and the
+// remote endpoint. The connection must be locked.
+func resetTCPConnection(conn *network.Connection, localSeq, remoteSeq uint32) error {
+	toLocal, toRemote, err := forgeTCPResets(conn, localSeq, remoteSeq)
+	if err != nil {
+		return err
+	}
+
+	if err := injectPacket(toLocal); err != nil {
+		return fmt.Errorf("failed to inject reset to local endpoint: %w", err)
+	}
+	if err := injectPacket(toRemote); err != nil {
+		return fmt.Errorf("failed to inject reset to remote endpoint: %w", err)
+	}
+	return nil
+}
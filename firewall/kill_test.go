@@ -0,0 +1,172 @@
+package firewall
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/safing/portmaster/intel"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// newTestTCPPacket returns a TCP packet with the given sequence and
+// acknowledgment numbers and payload length.
+func newTestTCPPacket(t *testing.T, src, dst net.IP, srcPort, dstPort uint16, seq, ack uint32, payloadLength int) *failingPacket {
+	t.Helper()
+
+	return newTestTCPSegment(t, src, dst, srcPort, dstPort, seq, ack, testTCPFlagACK|testTCPFlagPSH, make([]byte, payloadLength))
+}
+
+// checkTCPResets checks that the injected packets are resets to the local and
+// the remote endpoint with the given sequence numbers.
+func checkTCPResets(t *testing.T, injected [][]byte, localIP, remoteIP net.IP, toLocalSeq, toRemoteSeq uint32) {
+	t.Helper()
+
+	if len(injected) != 2 {
+		t.Fatalf("expected 2 injected resets, got %d", len(injected))
+	}
+	expected := []struct {
+		src, dst net.IP
+		srcPort  layers.TCPPort
+		seq      uint32
+	}{
+		{remoteIP, localIP, 443, toLocalSeq},
+		{localIP, remoteIP, 40000, toRemoteSeq},
+	}
+	for i, data := range injected {
+		pkt := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+		ip, _ := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		tcp, _ := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if ip == nil || tcp == nil {
+			t.Fatalf("reset %d is not a TCP packet", i)
+		}
+		if !ip.SrcIP.Equal(expected[i].src) || !ip.DstIP.Equal(expected[i].dst) || tcp.SrcPort != expected[i].srcPort {
+			t.Errorf("reset %d: unexpected flow %s:%d -> %s:%d", i, ip.SrcIP, tcp.SrcPort, ip.DstIP, tcp.DstPort)
+		}
+		if !tcp.RST || tcp.Seq != expected[i].seq {
+			t.Errorf("reset %d: expected RST with seq %d, got %+v", i, expected[i].seq, tcp)
+		}
+	}
+}
+
+func TestKillConnection(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	var injected [][]byte
+	var reset []*packet.Info
+	var resetErr error
+	defer func(orig func([]byte) error) { injectPacket = orig }(injectPacket)
+	defer func(orig func(*packet.Info) error) { resetVerdictOfConnection = orig }(resetVerdictOfConnection)
+	injectPacket = func(data []byte) error {
+		injected = append(injected, data)
+		return nil
+	}
+	resetVerdictOfConnection = func(info *packet.Info) error {
+		reset = append(reset, info)
+		return resetErr
+	}
+
+	localIP, remoteIP := net.IPv4(10, 0, 0, 1), net.IPv4(1, 1, 1, 1)
+	newConn := func(protocol packet.IPProtocol) *network.Connection {
+		conn := &network.Connection{
+			ID:         "test",
+			Type:       network.IPConnection,
+			IPVersion:  packet.IPv4,
+			IPProtocol: protocol,
+			LocalIP:    localIP,
+			LocalPort:  40000,
+			Entity:     &intel.Entity{IP: remoteIP, Port: 443},
+		}
+		conn.Verdict.Firewall = network.VerdictAccept
+		conn.Verdict.Active = network.VerdictAccept
+		return conn
+	}
+	newTrackedConn := func() *network.Connection {
+		conn := newConn(packet.TCP)
+		outbound := newTestTCPPacket(t, localIP, remoteIP, 40000, 443, 1000, 5000, 100)
+		outbound.SetOutbound()
+		conn.TrackTCPSequence(outbound)
+		inbound := newTestTCPPacket(t, remoteIP, localIP, 443, 40000, 5000, 1100, 200)
+		inbound.SetInbound()
+		conn.TrackTCPSequence(inbound)
+		return conn
+	}
+
+	// The sequence numbers of a permanently accepted connection are outdated,
+	// as its later packets did not reach the firewall.
+	conn := newTrackedConn()
+	conn.VerdictPermanent = true
+	if err := killConnection(conn); err != nil {
+		t.Fatal(err)
+	}
+	if conn.Verdict.Active != network.VerdictDrop || !conn.Killed {
+		t.Errorf("killed connection should be dropped, got %s", conn.Verdict.Active)
+	}
+	if len(reset) != 1 || !reset[0].Src.Equal(localIP) || reset[0].DstPort != 443 {
+		t.Errorf("verdict of connection should have been reset: %+v", reset)
+	}
+	if len(injected) != 0 || !conn.KillResetPending {
+		t.Fatal("resets should be sent with the next packet of the connection")
+	}
+
+	// The resets are sent with the sequence numbers of the next packet, which
+	// is dropped.
+	next := newTestTCPPacket(t, localIP, remoteIP, 40000, 443, 9000, 7000, 100)
+	next.SetOutbound()
+	if err := issueVerdict(conn, next, 0, true); err != nil {
+		t.Fatal(err)
+	}
+	if next.applied != 1 {
+		t.Error("packet of killed connection should have been dropped")
+	}
+	checkTCPResets(t, injected, localIP, remoteIP, 7000, 9000)
+	if conn.KillResetPending {
+		t.Error("resets should not be pending anymore")
+	}
+
+	// Further packets do not send resets again.
+	injected = nil
+	inbound := newTestTCPPacket(t, remoteIP, localIP, 443, 40000, 7000, 9000, 10)
+	inbound.SetInbound()
+	if err := issueVerdict(conn, inbound, 0, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(injected) != 0 {
+		t.Errorf("resets should only be sent once, got %d", len(injected))
+	}
+
+	// If the verdict cannot be reset, no further packets may reach the
+	// firewall, so the resets are sent right away with the known sequence
+	// numbers.
+	resetErr = errors.New("not supported")
+	injected = nil
+	conn = newTrackedConn()
+	if err := killConnection(conn); err == nil {
+		t.Error("failing to reset the verdict should report an error")
+	}
+	checkTCPResets(t, injected, localIP, remoteIP, 5200, 1100)
+	if conn.KillResetPending {
+		t.Error("resets should not be pending")
+	}
+
+	// Without known sequence numbers, no resets are sent.
+	injected = nil
+	if err := killConnection(newConn(packet.TCP)); err == nil {
+		t.Error("killing without known sequence numbers should report an error")
+	}
+	if len(injected) != 0 {
+		t.Errorf("no resets should have been injected")
+	}
+	resetErr = nil
+
+	// UDP connections are only dropped.
+	udpConn := newConn(packet.UDP)
+	if err := killConnection(udpConn); err != nil {
+		t.Fatal(err)
+	}
+	if len(injected) != 0 || udpConn.Verdict.Active != network.VerdictDrop || udpConn.KillResetPending {
+		t.Errorf("UDP connection should only be dropped")
+	}
+}
@@ -46,8 +46,15 @@
 	checkPortmasterConnection,
 	checkSelfCommunication,
 	checkIfBroadcastReply,
+	checkConntrackState,
 	checkConnectionType,
+	checkRemoteCooldown,
+	checkApplicationProtocol,
+	checkConnectionRate,
+	checkDiscoveryProtocols,
+	checkDeviceRules,
 	checkConnectionScope,
+	checkTLSServerName,
 	checkEndpointLists,
 	checkResolverScope,
 	checkConnectivityDomain,
@@ -93,6 +100,19 @@ func decideOnConnection(ctx context.Context, conn *network.Connection, pkt packe
 		}
 	}
 
+	// Apply the settings of an ancestor process, if it shares them with its
+	// child processes.
+	conn.SettingsAncestorPID = 0
+	if ancestor := findSettingsAncestor(ctx, conn.Process(), process.GetOrFindProcess, sharesWithChildProcesses); ancestor != nil {
+		layeredProfile = ancestor.Profile()
+		if layeredProfile.NeedsUpdate() {
+			layeredProfile.Update(ancestor.MatchingData(), ancestor.CreateProfileCallback)
+		}
+		conn.SettingsAncestorPID = ancestor.Pid
+		conn.SaveWhenFinished()
+		log.Tracer(ctx).Debugf("filter: applying settings of ancestor process %s to %s", ancestor, conn)
+	}
+
 	// prepare the entity and resolve all filterlist matches
 	conn.Entity.ResolveSubDomainLists(ctx, layeredProfile.FilterSubDomains())
 	conn.Entity.EnableCNAMECheck(ctx, layeredProfile.FilterCNAMEs())
@@ -104,22 +124,31 @@ func decideOnConnection(ctx context.Context, conn *network.Connection, pkt packe
 		return
 	}
 
+	// Deciders did not conclude, use default action.
+	if applyDefaultAction(conn, defaultAction) {
+		prompt(ctx, conn, pkt)
+	}
+}
+
+// applyDefaultAction sets the verdict of a connection that the deciders did
+// not conclude on. If the user needs to be asked, ask is returned instead.
+func applyDefaultAction(conn *network.Connection, defaultAction uint8) (ask bool) {
 	// DNS Request are always default allowed, as the endpoint lists could not
 	// be checked fully.
 	if conn.Type == network.DNSRequest {
 		conn.Accept("allowing dns request", noReasonOptionKey)
-		return
+		return false
 	}
 
-	// Deciders did not conclude, use default action.
 	switch defaultAction {
 	case profile.DefaultActionPermit:
 		conn.Accept("allowed by default action", profile.CfgOptionDefaultActionKey)
 	case profile.DefaultActionAsk:
-		prompt(ctx, conn, pkt)
+		return true
 	default:
 		conn.Deny("blocked by default action", profile.CfgOptionDefaultActionKey)
 	}
+	return false
 }
 
 func runDeciders(ctx context.Context, selectedDeciders []deciderFn, conn *network.Connection, layeredProfile *profile.LayeredProfile, pkt packet.Packet) (done bool, defaultAction uint8) {
@@ -1,21 +1,121 @@
 package firewall
 
 import (
-	"github.com/safing/portbase/api"
-	"github.com/safing/portbase/config"
-	"github.com/safing/portbase/metrics"
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/safing/portmaster/core/telemetry"
+	"github.com/safing/portmaster/firewall/interception"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// Metric names.
+const (
+	metricPacketHandlingDuration = "firewall/handling/duration/seconds"
+	metricVerdictLatency         = "firewall/verdict/latency/seconds"
+	metricVerdictApplyErrors     = "firewall/verdict_apply_errors/total"
+	metricOutstandingPrompts     = "firewall/prompts/outstanding"
+	metricTrackedConnections     = "firewall/tracked_connections"
+	metricQueueDepth             = "firewall/interception/queue/depth"
+	metricQueueHighWaterMark     = "firewall/interception/queue/high_water_mark"
 )
 
-var packetHandlingHistogram *metrics.Histogram
+// gaugeReportInterval defines how often the gauges are reported to the
+// metrics sink.
+const gaugeReportInterval = 10 * time.Second
+
+var (
+	// verdictLatencyMetrics holds the latency histograms from dequeuing a
+	// packet to applying its verdict, indexed by verdict.
+	verdictLatencyMetrics [network.VerdictAsk + 1]*telemetry.Metric
+	// askVerdictLatencyMetric holds the verdict latency of packets that
+	// waited for a decision of the user.
+	askVerdictLatencyMetric = telemetry.NewMetric(metricVerdictLatency, map[string]string{"verdict": "ask"})
+
+	verdictApplyErrors = new(uint64)
+)
+
+// verdictLabelValues holds the values of the verdict label of metrics.
+var verdictLabelValues = map[network.Verdict]string{
+	network.VerdictAccept:              "accept",
+	network.VerdictBlock:               "block",
+	network.VerdictDrop:                "drop",
+	network.VerdictRerouteToNameserver: "reroute_nameserver",
+	network.VerdictRerouteToTunnel:     "reroute_tunnel",
+	network.VerdictFailed:              "failed",
+	network.VerdictAsk:                 "prompt_pending",
+}
+
+func init() {
+	for verdict, label := range verdictLabelValues {
+		verdictLatencyMetrics[verdict] = telemetry.NewMetric(metricVerdictLatency, map[string]string{"verdict": label})
+	}
+}
+
+func describeMetrics() {
+	telemetry.DescribeMetric(metricPacketHandlingDuration, "Packet Handling Duration")
+	telemetry.DescribeMetric(metricVerdictLatency, "Verdict Latency")
+	telemetry.DescribeMetric(metricVerdictApplyErrors, "Verdict Apply Errors")
+	telemetry.DescribeMetric(metricVerdictsByProcess, "Connection Verdicts By Process")
+	telemetry.DescribeMetric(metricVerdictsByProfile, "Connection Verdicts By Profile")
+	telemetry.DescribeMetric(metricOutstandingPrompts, "Outstanding Prompts")
+	telemetry.DescribeMetric(metricTrackedConnections, "Tracked Connections")
+	telemetry.DescribeMetric(metricQueueDepth, "Interception Queue Depth")
+	telemetry.DescribeMetric(metricQueueHighWaterMark, "Interception Queue High-Water Mark")
+	telemetry.DescribeMetric(interception.MetricQueueFull, "Packets Not Queued Due To Full Interception Queue")
+	telemetry.DescribeMetric(interception.MetricErrorDrops, "Packets Dropped Due To Internal Failures")
+}
+
+// gaugeReporter regularly reports the gauges to the metrics sink.
+func gaugeReporter(ctx context.Context) error {
+	for {
+		reportGauges()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(gaugeReportInterval):
+		}
+	}
+}
+
+func reportGauges() {
+	telemetry.SetGauge(metricOutstandingPrompts, nil, float64(countOutstandingPrompts(time.Now())))
+	telemetry.SetGauge(metricTrackedConnections, nil, float64(countTrackedConnections()))
+	telemetry.SetGauge(metricQueueDepth, nil, float64(interception.QueueDepth()))
+	telemetry.SetGauge(metricQueueHighWaterMark, nil, float64(interception.QueueHighWaterMark()))
+}
+
+// recordPacketHandlingDuration records the time from the given start of the
+// handling of a packet until now.
+func recordPacketHandlingDuration(start time.Time) {
+	telemetry.ObserveHistogram(metricPacketHandlingDuration, nil, time.Since(start).Seconds())
+}
+
+// recordVerdictApplyError records that a verdict could not be applied.
+func recordVerdictApplyError() {
+	atomic.AddUint64(verdictApplyErrors, 1)
+	telemetry.IncCounter(metricVerdictApplyErrors, nil, 1)
+}
 
-func registerMetrics() (err error) {
-	packetHandlingHistogram, err = metrics.NewHistogram(
-		"firewall/handling/duration/seconds",
-		nil,
-		&metrics.Options{
-			Permission:     api.PermitUser,
-			ExpertiseLevel: config.ExpertiseLevelExpert,
-		})
+// recordVerdictLatency records the time from dequeuing the packet until now,
+// when its verdict was applied.
+func recordVerdictLatency(pkt packet.Packet, verdict network.Verdict) {
+	timing := pkt.Timing()
+	if timing.Dequeued.IsZero() {
+		return
+	}
 
-	return err
+	var metric *telemetry.Metric
+	switch {
+	case timing.WaitedForUser:
+		metric = askVerdictLatencyMetric
+	case verdict >= 0 && int(verdict) < len(verdictLatencyMetrics):
+		metric = verdictLatencyMetrics[verdict]
+	}
+	if metric != nil {
+		metric.ObserveHistogram(time.Since(timing.Dequeued).Seconds())
+	}
 }
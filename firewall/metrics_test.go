@@ -0,0 +1,130 @@
+package firewall
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/safing/portmaster/core/telemetry"
+	"github.com/safing/portmaster/firewall/interception"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// recordingSink records the metrics emitted to it.
+type recordingSink struct {
+	lock       sync.Mutex
+	counters   map[string]uint64
+	histograms map[string][]float64
+	gauges     map[string]float64
+}
+
+func newRecordingSink() *recordingSink {
+	return &recordingSink{
+		counters:   make(map[string]uint64),
+		histograms: make(map[string][]float64),
+		gauges:     make(map[string]float64),
+	}
+}
+
+func recordingKey(name string, labels map[string]string) string {
+	key := name
+	for _, label := range []string{"verdict", "cause", "process", "profile"} {
+		if value, ok := labels[label]; ok {
+			key += "{" + label + "=" + value + "}"
+		}
+	}
+	return key
+}
+
+func (s *recordingSink) IncCounter(name string, labels map[string]string, delta uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.counters[recordingKey(name, labels)] += delta
+}
+
+func (s *recordingSink) ObserveHistogram(name string, labels map[string]string, value float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := recordingKey(name, labels)
+	s.histograms[key] = append(s.histograms[key], value)
+}
+
+func (s *recordingSink) SetGauge(name string, labels map[string]string, value float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.gauges[recordingKey(name, labels)] = value
+}
+
+//nolint:paralleltest // Modifies global state.
+func TestRecordVerdictLatency(t *testing.T) {
+	sink := newRecordingSink()
+	telemetry.SetMetricsSink(sink)
+	defer telemetry.SetMetricsSink(nil)
+	accept := metricVerdictLatency + "{verdict=accept}"
+	ask := metricVerdictLatency + "{verdict=ask}"
+
+	// Packets without dequeue time are not recorded.
+	recordVerdictLatency(&failingPacket{}, network.VerdictAccept)
+	if count := len(sink.histograms[accept]); count != 0 {
+		t.Errorf("expected no accept records, got %d", count)
+	}
+
+	// Automatic decision.
+	pkt := &failingPacket{}
+	pkt.Timing().Dequeued = time.Now()
+	recordVerdictLatency(pkt, network.VerdictAccept)
+	if count := len(sink.histograms[accept]); count != 1 {
+		t.Errorf("expected 1 accept record, got %d", count)
+	}
+
+	// Decision of the user.
+	pkt = &failingPacket{}
+	pkt.Timing().Dequeued = time.Now().Add(-time.Second)
+	pkt.Timing().WaitedForUser = true
+	recordVerdictLatency(pkt, network.VerdictAccept)
+	if count := len(sink.histograms[accept]); count != 1 {
+		t.Errorf("expected 1 accept record, got %d", count)
+	}
+	if records := sink.histograms[ask]; len(records) != 1 || records[0] < 1 {
+		t.Errorf("expected 1 ask record of at least a second, got %v", records)
+	}
+}
+
+//nolint:paralleltest // Modifies global state.
+func TestMetricsSink(t *testing.T) {
+	sink := newRecordingSink()
+	telemetry.SetMetricsSink(sink)
+	defer telemetry.SetMetricsSink(nil)
+
+	recordPacketHandlingDuration(time.Now())
+	recordVerdictApplyError()
+	interception.RecordErrorDrop(packet.ErrorDropParse, errors.New("test"))
+	reportGauges()
+
+	if len(sink.histograms[metricPacketHandlingDuration]) != 1 {
+		t.Error("packet handling duration should have been observed")
+	}
+	if sink.counters[metricVerdictApplyErrors] != 1 {
+		t.Error("verdict apply error should have been counted")
+	}
+	if sink.counters[interception.MetricErrorDrops+"{cause=parse_error}"] != 1 {
+		t.Errorf("error drop should have been counted by cause, got %v", sink.counters)
+	}
+	for _, gauge := range []string{metricOutstandingPrompts, metricTrackedConnections, metricQueueDepth, metricQueueHighWaterMark} {
+		if _, ok := sink.gauges[gauge]; !ok {
+			t.Errorf("gauge %s should have been reported", gauge)
+		}
+	}
+
+	// Metrics are discarded by the no-op sink.
+	telemetry.SetMetricsSink(telemetry.NoopSink{})
+	recordVerdictApplyError()
+	if sink.counters[metricVerdictApplyErrors] != 1 {
+		t.Error("metrics should not be emitted to the previous sink")
+	}
+}
@@ -0,0 +1,71 @@
+package firewall
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/safing/portmaster/network/packet"
+)
+
+// TCP flags for buildTestTCPPacket.
+const (
+	testTCPFlagFIN uint8 = 1 << iota
+	testTCPFlagSYN
+	testTCPFlagRST
+	testTCPFlagPSH
+	testTCPFlagACK
+)
+
+// buildTestTCPPacket returns the raw data of an IPv4 TCP packet with the given
+// sequence and acknowledgment numbers, flags and payload.
+func buildTestTCPPacket(t *testing.T, src, dst net.IP, srcPort, dstPort uint16, seq, ack uint32, flags uint8, payload []byte) []byte {
+	t.Helper()
+
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    src.To4(),
+		DstIP:    dst.To4(),
+	}
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Seq:     seq,
+		Ack:     ack,
+		FIN:     flags&testTCPFlagFIN != 0,
+		SYN:     flags&testTCPFlagSYN != 0,
+		RST:     flags&testTCPFlagRST != 0,
+		PSH:     flags&testTCPFlagPSH != 0,
+		ACK:     flags&testTCPFlagACK != 0,
+		Window:  64240,
+	}
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}, ip, tcp, gopacket.Payload(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// newTestTCPSegment returns a parsed TCP packet, see buildTestTCPPacket.
+func newTestTCPSegment(t *testing.T, src, dst net.IP, srcPort, dstPort uint16, seq, ack uint32, flags uint8, payload []byte) *failingPacket {
+	t.Helper()
+
+	pkt := &failingPacket{}
+	if err := packet.Parse(buildTestTCPPacket(t, src, dst, srcPort, dstPort, seq, ack, flags, payload), &pkt.Base); err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
@@ -0,0 +1,77 @@
+package firewall
+
+import (
+	"context"
+	"time"
+
+	"github.com/safing/portbase/api"
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/firewall/interception"
+	"github.com/safing/portmaster/network"
+)
+
+// pinnedConnectionPruneInterval defines how often the pins of connections that
+// ended are removed. Connections pinned within this interval are kept, as they
+// might not be tracked by the OS yet.
+const pinnedConnectionPruneInterval = time.Minute
+
+// PinConnectionVerdict pins the verdict of the connection with the given ID,
+// see network.Connection.ID, so that resetting the verdicts of all
+// connections, such as after a configuration change, does not affect it. This
+// is intended for critical connections that must never be interrupted, like a
+// management or monitoring tunnel. Connections to the Portmaster API are
+// pinned automatically. The pin is removed when the connection ends.
+// Pinning is only supported on Linux.
+func PinConnectionVerdict(connKey string) error {
+	return interception.PinConnection(connKey)
+}
+
+// UnpinConnectionVerdict removes the pin of the connection with the given ID,
+// see PinConnectionVerdict.
+func UnpinConnectionVerdict(connKey string) {
+	interception.UnpinConnection(connKey)
+}
+
+// verdictPinned returns whether the verdict of the connection is pinned. The
+// connection must be locked.
+func verdictPinned(conn *network.Connection) bool {
+	return conn.Type == network.IPConnection && interception.IsConnectionPinned(conn.ID)
+}
+
+// pinnedConnectionPruner regularly removes the pins of connections that ended.
+func pinnedConnectionPruner(ctx context.Context) error {
+	ticker := time.NewTicker(pinnedConnectionPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		if len(interception.PinnedConnections()) == 0 {
+			continue
+		}
+		flows, err := interception.TrackedFlows()
+		if err != nil {
+			log.Debugf("filter: failed to get tracked flows for pruning pinned connections: %s", err)
+			continue
+		}
+		if pruned := interception.PrunePinnedConnections(flows, time.Now().Add(-pinnedConnectionPruneInterval)); pruned > 0 {
+			log.Debugf("filter: removed pins of %d ended connections", pruned)
+		}
+	}
+}
+
+func registerPinnedConnectionAPIEndpoints() error {
+	return api.RegisterEndpoint(api.Endpoint{
+		Path:      "debug/interception/pinned-connections",
+		Read:      api.PermitUser,
+		BelongsTo: interceptionModule,
+		StructFunc: func(ar *api.Request) (i interface{}, err error) {
+			return interception.PinnedConnections(), nil
+		},
+		Name:        "Get Pinned Connections",
+		Description: "Returns the IDs of the connections whose verdicts are not affected by resetting the verdicts of all connections.",
+	})
+}
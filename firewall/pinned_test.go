@@ -0,0 +1,86 @@
+package firewall
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/safing/portmaster/firewall/interception"
+	"github.com/safing/portmaster/intel"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/portmaster/profile"
+)
+
+func TestPinnedVerdictSurvivesReset(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	var reset int
+	defer func(orig func() error) { resetVerdictOfAllConnections = orig }(resetVerdictOfAllConnections)
+	resetVerdictOfAllConnections = func() error {
+		reset++
+		return nil
+	}
+
+	pinned := newTestTCPConnection("pinned")
+	other := newTestTCPConnection("other")
+	conns := []*network.Connection{pinned, other}
+
+	if err := PinConnectionVerdict(pinned.ID); err != nil {
+		t.Fatal(err)
+	}
+	defer UnpinConnectionVerdict(pinned.ID)
+
+	reEvaluated := make(map[string]bool)
+	reEvaluate := func(_ context.Context, conn *network.Connection) bool {
+		reEvaluated[conn.ID] = true
+		conn.SetVerdict(network.VerdictBlock, "blocked by rule", "", nil)
+		finalizeVerdict(conn)
+		return true
+	}
+
+	// Resetting all connections skips the pinned one.
+	if changed := reEvaluateAllConnections(context.Background(), conns, reEvaluate); changed != 1 {
+		t.Errorf("expected 1 changed verdict, got %d", changed)
+	}
+	if reEvaluated[pinned.ID] || pinned.Verdict.Active != network.VerdictAccept {
+		t.Error("pinned connection should keep its verdict")
+	}
+	if !reEvaluated[other.ID] || other.Verdict.Active != network.VerdictBlock {
+		t.Error("other connection should have been re-evaluated")
+	}
+
+	// Invalidating old verdicts skips the pinned one as well.
+	reEvaluated = make(map[string]bool)
+	if invalidated := invalidateVerdictsOlderThan(profile.RuleVersion(1), conns, reEvaluate); invalidated != 1 {
+		t.Errorf("expected 1 invalidated verdict, got %d", invalidated)
+	}
+	if reEvaluated[pinned.ID] || !reEvaluated[other.ID] || reset != 1 {
+		t.Errorf("only the other connection should have been re-evaluated and reset, %d sweeps", reset)
+	}
+
+	// Unpinned connections are reset again.
+	UnpinConnectionVerdict(pinned.ID)
+	reEvaluated = make(map[string]bool)
+	reEvaluateAllConnections(context.Background(), conns, reEvaluate)
+	if !reEvaluated[pinned.ID] {
+		t.Error("unpinned connection should have been re-evaluated")
+	}
+	if len(interception.PinnedConnections()) != 0 {
+		t.Errorf("unexpected pinned connections %v", interception.PinnedConnections())
+	}
+}
+
+func newTestTCPConnection(id string) *network.Connection {
+	conn := &network.Connection{
+		ID:               id,
+		Type:             network.IPConnection,
+		IPVersion:        packet.IPv4,
+		IPProtocol:       packet.TCP,
+		LocalIP:          net.IPv4(10, 0, 0, 1),
+		LocalPort:        40000,
+		Entity:           &intel.Entity{IP: net.IPv4(1, 1, 1, 1), Port: 443},
+		VerdictPermanent: true,
+	}
+	conn.SetVerdict(network.VerdictAccept, "allowed by rule", "", nil)
+	finalizeVerdict(conn)
+	return conn
+}
@@ -0,0 +1,328 @@
+package firewall
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/safing/portmaster/network/packet"
+)
+
+const (
+	// verdictPriorityWorkers is the amount of workers that handle packets
+	// when packets are prioritized.
+	verdictPriorityWorkers = 32
+
+	// verdictPriorityQueueSize is the maximum amount of packets waiting to be
+	// handled when packets are prioritized. Reading new packets from the
+	// interception pauses while the queue is full.
+	verdictPriorityQueueSize = 1000
+
+	// verdictPrioritySlowHandling defines after how long a worker that is
+	// still handling a packet hands over its lane to a new worker.
+	verdictPrioritySlowHandling = 100 * time.Millisecond
+
+	// verdictPriorityMaxSlowHandlers is the maximum amount of slow packets
+	// whose workers handed over their lanes. Further slow packets keep their
+	// lanes.
+	verdictPriorityMaxSlowHandlers = 256
+
+	// dscpExpeditedForwarding is the DSCP value used for latency-sensitive
+	// traffic, such as VoIP.
+	dscpExpeditedForwarding = 46
+
+	// smallPacketSize is the size in bytes up to which packets are considered
+	// to be interactive traffic by the InteractivePriority classifier.
+	smallPacketSize = 256
+)
+
+// Verdict priorities returned by InteractivePriority.
+const (
+	VerdictPriorityBulk        = 0
+	VerdictPriorityInteractive = 1
+	VerdictPriorityRealtime    = 2
+)
+
+// VerdictPriorityClassifier returns the priority of a packet. Packets with a
+// higher priority are handled first when packets queue up. Packets with the
+// same priority are handled in the order they were received.
+// The classifier is called for every intercepted packet before it is handled
+// and must return quickly. The packet data may not be loaded yet.
+type VerdictPriorityClassifier func(pkt packet.Packet) int
+
+var (
+	verdictPriorityClassifier     VerdictPriorityClassifier
+	verdictPriorityClassifierLock sync.Mutex
+)
+
+// SetVerdictPriorityClassifier enables prioritized packet handling using the
+// given classifier. Instead of handling every packet in its own worker,
+// packets are handled by a fixed amount of workers that pick the packets with
+// the highest priority first. Workers that are slow to handle a packet are
+// replaced, so that the packets queued behind it are not held up. It must be set before the interception module
+// is started. A nil classifier disables prioritization.
+func SetVerdictPriorityClassifier(fn VerdictPriorityClassifier) {
+	verdictPriorityClassifierLock.Lock()
+	defer verdictPriorityClassifierLock.Unlock()
+
+	verdictPriorityClassifier = fn
+}
+
+func getVerdictPriorityClassifier() VerdictPriorityClassifier {
+	verdictPriorityClassifierLock.Lock()
+	defer verdictPriorityClassifierLock.Unlock()
+
+	return verdictPriorityClassifier
+}
+
+// InteractivePriority is a classifier that prioritizes packets marked for
+// expedited forwarding via DSCP, such as VoIP, before small packets, which
+// are usually interactive traffic, before all other packets.
+func InteractivePriority(pkt packet.Packet) int {
+	raw := pkt.Raw()
+	if len(raw) < 2 {
+		return VerdictPriorityBulk
+	}
+
+	// Get DSCP from the IPv4 TOS or IPv6 Traffic Class.
+	var dscp uint8
+	switch raw[0] >> 4 {
+	case 4:
+		dscp = raw[1] >> 2
+	case 6:
+		dscp = (raw[0]<<4 | raw[1]>>4) >> 2
+	}
+
+	switch {
+	case dscp == dscpExpeditedForwarding:
+		return VerdictPriorityRealtime
+	case len(raw) <= smallPacketSize:
+		return VerdictPriorityInteractive
+	default:
+		return VerdictPriorityBulk
+	}
+}
+
+// verdictQueue is a priority queue of packets waiting to be handled.
+type verdictQueue struct {
+	lock    sync.Mutex
+	items   verdictQueueItems
+	nextSeq uint64
+
+	// slots holds a token for every queued packet and limits the size of the
+	// queue.
+	slots chan struct{}
+	// available holds a token for every queued packet that can be popped.
+	available chan struct{}
+
+	// lanes holds the lanes of the workers that handle packets.
+	lanes     map[*verdictLane]struct{}
+	lanesLock sync.Mutex
+	// slowHandlers holds a token for every slow packet that is still being
+	// handled after its worker handed over its lane, see handOverSlowLanes.
+	slowHandlers chan struct{}
+}
+
+// verdictLane is the lane of a worker that handles queued packets.
+type verdictLane struct {
+	// busySince holds the time in UNIX nanoseconds at which the worker started
+	// handling its current packet. It is 0 while the worker is idle and -1 if
+	// the lane was handed over to a new worker.
+	busySince int64
+	handle    func(ctx context.Context, pkt packet.Packet)
+}
+
+type verdictQueueItem struct {
+	pkt      packet.Packet
+	priority int
+	seq      uint64
+}
+
+func newVerdictQueue(size int) *verdictQueue {
+	return &verdictQueue{
+		slots:        make(chan struct{}, size),
+		available:    make(chan struct{}, size),
+		lanes:        make(map[*verdictLane]struct{}),
+		slowHandlers: make(chan struct{}, verdictPriorityMaxSlowHandlers),
+	}
+}
+
+// push adds the packet to the queue. It blocks while the queue is full.
+func (q *verdictQueue) push(ctx context.Context, pkt packet.Packet, priority int) error {
+	select {
+	case q.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	q.lock.Lock()
+	heap.Push(&q.items, &verdictQueueItem{
+		pkt:      pkt,
+		priority: priority,
+		seq:      q.nextSeq,
+	})
+	q.nextSeq++
+	q.lock.Unlock()
+
+	// Never blocks, as there is a slot for every available packet.
+	q.available <- struct{}{}
+	return nil
+}
+
+// pop returns the packet with the highest priority, waiting for one to be
+// queued if necessary.
+func (q *verdictQueue) pop(ctx context.Context) (packet.Packet, error) {
+	select {
+	case <-q.available:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	q.lock.Lock()
+	item := heap.Pop(&q.items).(*verdictQueueItem) //nolint:forcetypeassert // Only verdictQueueItem is stored.
+	q.lock.Unlock()
+
+	<-q.slots
+	return item.pkt, nil
+}
+
+// serve handles queued packets in a new lane until the context is canceled or
+// the lane is handed over to a new worker, see handOverSlowLanes.
+func (q *verdictQueue) serve(ctx context.Context, handle func(ctx context.Context, pkt packet.Packet)) error {
+	lane := &verdictLane{handle: handle}
+	q.lanesLock.Lock()
+	q.lanes[lane] = struct{}{}
+	q.lanesLock.Unlock()
+
+	defer func() {
+		q.lanesLock.Lock()
+		delete(q.lanes, lane)
+		q.lanesLock.Unlock()
+	}()
+
+	for {
+		pkt, err := q.pop(ctx)
+		if err != nil {
+			return nil //nolint:nilerr // Stopped by context.
+		}
+
+		started := time.Now().UnixNano()
+		atomic.StoreInt64(&lane.busySince, started)
+		handle(ctx, pkt)
+		if !atomic.CompareAndSwapInt64(&lane.busySince, started, 0) {
+			// The lane was handed over while handling the packet.
+			<-q.slowHandlers
+			return nil
+		}
+	}
+}
+
+// handOverSlowLanes hands over the lanes of workers that are handling a packet
+// for longer than the given threshold to new workers, which are started with
+// startWorker. This keeps a slow packet, such as one waiting for the user to
+// answer a prompt, from blocking the packets queued behind it. The worker of
+// the slow packet stops when it is done. At most
+// verdictPriorityMaxSlowHandlers slow packets are handed over at once.
+func (q *verdictQueue) handOverSlowLanes(now time.Time, threshold time.Duration, startWorker func(fn func(ctx context.Context) error)) {
+	q.lanesLock.Lock()
+	defer q.lanesLock.Unlock()
+
+	for lane := range q.lanes {
+		since := atomic.LoadInt64(&lane.busySince)
+		if since <= 0 || now.UnixNano()-since < threshold.Nanoseconds() {
+			continue
+		}
+
+		select {
+		case q.slowHandlers <- struct{}{}:
+		default:
+			// Too many slow packets are being handled.
+			return
+		}
+		if !atomic.CompareAndSwapInt64(&lane.busySince, since, -1) {
+			// The worker finished the packet in the meantime.
+			<-q.slowHandlers
+			continue
+		}
+
+		delete(q.lanes, lane)
+		handle := lane.handle
+		startWorker(func(ctx context.Context) error {
+			return q.serve(ctx, handle)
+		})
+	}
+}
+
+// handOverSlowLanesWorker regularly hands over the lanes of slow workers until
+// the context is canceled.
+func (q *verdictQueue) handOverSlowLanesWorker(ctx context.Context, startWorker func(fn func(ctx context.Context) error)) error {
+	ticker := time.NewTicker(verdictPrioritySlowHandling / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			q.handOverSlowLanes(now, verdictPrioritySlowHandling, startWorker)
+		}
+	}
+}
+
+// verdictQueueItems implements heap.Interface.
+type verdictQueueItems []*verdictQueueItem
+
+func (items verdictQueueItems) Len() int { return len(items) }
+
+func (items verdictQueueItems) Less(i, j int) bool {
+	if items[i].priority != items[j].priority {
+		return items[i].priority > items[j].priority
+	}
+	return items[i].seq < items[j].seq
+}
+
+func (items verdictQueueItems) Swap(i, j int) { items[i], items[j] = items[j], items[i] }
+
+func (items *verdictQueueItems) Push(x interface{}) {
+	*items = append(*items, x.(*verdictQueueItem)) //nolint:forcetypeassert // Only verdictQueueItem is stored.
+}
+
+func (items *verdictQueueItems) Pop() interface{} {
+	old := *items
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*items = old[:len(old)-1]
+	return item
+}
+
+// prioritizedPacketHandler reads packets from the interception and hands them
+// to a fixed amount of workers, which handle the packets with the highest
+// priority first. Workers that are slow to handle a packet hand over their
+// lane to a new worker.
+func prioritizedPacketHandler(ctx context.Context, packets <-chan packet.Packet, classify VerdictPriorityClassifier) error {
+	q := newVerdictQueue(verdictPriorityQueueSize)
+	startWorker := func(fn func(ctx context.Context) error) {
+		interceptionModule.StartWorker("prioritized packet handler", fn)
+	}
+	for i := 0; i < verdictPriorityWorkers; i++ {
+		startWorker(func(workerCtx context.Context) error {
+			return q.serve(workerCtx, handlePacket)
+		})
+	}
+	interceptionModule.StartWorker("prioritized packet lane monitor", func(workerCtx context.Context) error {
+		return q.handOverSlowLanesWorker(workerCtx, startWorker)
+	})
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case pkt := <-packets:
+			if err := q.push(ctx, pkt, classify(pkt)); err != nil {
+				return nil //nolint:nilerr // Stopped by context.
+			}
+		}
+	}
+}
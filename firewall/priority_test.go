@@ -0,0 +1,226 @@
+package firewall
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/safing/portmaster/network/packet"
+)
+
+func TestVerdictQueuePriority(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := newVerdictQueue(100)
+	first := &failingPacket{}
+	voip := &failingPacket{}
+	bulk := make([]*failingPacket, 10)
+	for i := range bulk {
+		bulk[i] = &failingPacket{}
+	}
+
+	// Start a single worker, which is kept busy by the first packet.
+	var (
+		handled     []packet.Packet
+		handledLock sync.Mutex
+		done        = make(chan struct{})
+	)
+	busy := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		_ = q.serve(ctx, func(ctx context.Context, pkt packet.Packet) {
+			if pkt == first {
+				close(busy)
+				<-release
+			}
+			handledLock.Lock()
+			defer handledLock.Unlock()
+			handled = append(handled, pkt)
+			if len(handled) == len(bulk)+2 {
+				close(done)
+			}
+		})
+	}()
+	if err := q.push(ctx, first, VerdictPriorityBulk); err != nil {
+		t.Fatal(err)
+	}
+	<-busy
+
+	// Queue up bulk packets and then a latency-sensitive packet while the
+	// worker is busy.
+	for _, pkt := range bulk {
+		if err := q.push(ctx, pkt, VerdictPriorityBulk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.push(ctx, voip, VerdictPriorityRealtime); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("packets were not handled")
+	}
+
+	// The latency-sensitive packet must be handled right after the first
+	// packet, and the bulk packets in the order they were received.
+	handledLock.Lock()
+	defer handledLock.Unlock()
+	if handled[0] != first || handled[1] != voip {
+		t.Fatal("latency-sensitive packet was not handled first")
+	}
+	for i, pkt := range bulk {
+		if handled[i+2] != pkt {
+			t.Fatalf("bulk packet %d was handled out of order", i)
+		}
+	}
+}
+
+func TestVerdictQueueCapacity(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := newVerdictQueue(2)
+	for i := 0; i < 2; i++ {
+		if err := q.push(ctx, &failingPacket{}, VerdictPriorityBulk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Pushing to the full queue blocks without queuing the packet.
+	pushCtx, pushCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer pushCancel()
+	if err := q.push(pushCtx, &failingPacket{}, VerdictPriorityRealtime); err == nil {
+		t.Fatal("push to full queue should block")
+	}
+	q.lock.Lock()
+	queued := q.items.Len()
+	q.lock.Unlock()
+	if queued != 2 {
+		t.Errorf("expected 2 queued packets, got %d", queued)
+	}
+
+	// Popping a packet frees a slot.
+	if _, err := q.pop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.push(ctx, &failingPacket{}, VerdictPriorityBulk); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerdictQueueSlowLaneHandover(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := newVerdictQueue(100)
+	slow := &failingPacket{}
+	fast := &failingPacket{}
+	slowStarted := make(chan struct{})
+	releaseSlow := make(chan struct{})
+	fastHandled := make(chan struct{})
+	started := make(chan struct{}, 10)
+	handle := func(ctx context.Context, pkt packet.Packet) {
+		switch pkt {
+		case slow:
+			close(slowStarted)
+			<-releaseSlow
+		case fast:
+			close(fastHandled)
+		}
+	}
+	startWorker := func(fn func(ctx context.Context) error) {
+		started <- struct{}{}
+		go func() {
+			_ = fn(ctx)
+		}()
+	}
+
+	// A single worker is blocked by the slow packet.
+	startWorker(func(ctx context.Context) error {
+		return q.serve(ctx, handle)
+	})
+	<-started
+	if err := q.push(ctx, slow, VerdictPriorityBulk); err != nil {
+		t.Fatal(err)
+	}
+	<-slowStarted
+	if err := q.push(ctx, fast, VerdictPriorityBulk); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lanes are only handed over once the threshold is exceeded.
+	q.handOverSlowLanes(time.Now(), time.Hour, startWorker)
+	select {
+	case <-started:
+		t.Fatal("lane should not be handed over before the threshold")
+	default:
+	}
+
+	// The lane of the slow worker is handed over, so that the next packet is
+	// handled while the slow packet is still being handled.
+	q.handOverSlowLanes(time.Now().Add(time.Second), 100*time.Millisecond, startWorker)
+	select {
+	case <-started:
+	default:
+		t.Fatal("lane of slow worker should have been handed over")
+	}
+	select {
+	case <-fastHandled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet behind slow packet was not handled")
+	}
+
+	// The slow worker stops when it is done, so the amount of lanes stays
+	// the same.
+	close(releaseSlow)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		q.lanesLock.Lock()
+		lanes := len(q.lanes)
+		q.lanesLock.Unlock()
+		if lanes == 1 && len(q.slowHandlers) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 1 lane and no slow handlers, got %d and %d", lanes, len(q.slowHandlers))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInteractivePriority(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		tos      uint8
+		size     int
+		priority int
+	}{
+		{tos: dscpExpeditedForwarding << 2, size: 1000, priority: VerdictPriorityRealtime},
+		{tos: 0, size: 100, priority: VerdictPriorityInteractive},
+		{tos: 0, size: 1000, priority: VerdictPriorityBulk},
+	} {
+		data := buildTestTCPPacket(t, net.IPv4(10, 0, 0, 1), net.IPv4(192, 0, 2, 1), 40000, 443, 1, 1, testTCPFlagACK, make([]byte, test.size))
+		// Only the DSCP in the TOS field is relevant, the header checksum is not.
+		data[1] = test.tos
+		pkt := &failingPacket{}
+		if err := packet.Parse(data, &pkt.Base); err != nil {
+			t.Fatal(err)
+		}
+		if priority := InteractivePriority(pkt); priority != test.priority {
+			t.Errorf("packet with TOS %#x and size %d should have priority %d, got %d", test.tos, test.size, test.priority, priority)
+		}
+	}
+}
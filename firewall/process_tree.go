@@ -0,0 +1,70 @@
+package firewall
+
+import (
+	"context"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/process"
+)
+
+// maxProcessTreeDepth defines how many levels of ancestors are checked for
+// settings that are shared with child processes.
+const maxProcessTreeDepth = 8
+
+// findSettingsAncestor returns the closest ancestor of the given process that
+// shares its settings with its child processes, as reported by the shares
+// function. If no such ancestor is found, nil is returned.
+//
+// The process tree is walked at connection time, so that changed settings of
+// an ancestor take effect the next time the verdicts of its descendants are
+// re-evaluated, which happens on every profile change.
+func findSettingsAncestor(
+	ctx context.Context,
+	proc *process.Process,
+	getProcess func(ctx context.Context, pid int) (*process.Process, error),
+	shares func(*process.Process) bool,
+) *process.Process {
+	if !proc.IsIdentified() {
+		return nil
+	}
+
+	current := proc
+	for i := 0; i < maxProcessTreeDepth; i++ {
+		// Stop at the root of the process tree.
+		if current.ParentPid <= 0 ||
+			current.ParentPid == current.Pid ||
+			current.ParentPid == process.SystemProcessID {
+			return nil
+		}
+
+		parent, err := getProcess(ctx, current.ParentPid)
+		if err != nil {
+			log.Tracer(ctx).Tracef("filter: failed to get parent process %d of %s: %s", current.ParentPid, current, err)
+			return nil
+		}
+		if !parent.IsIdentified() || parent.Pid == proc.Pid {
+			return nil
+		}
+
+		if shares(parent) {
+			return parent
+		}
+		current = parent
+	}
+
+	return nil
+}
+
+// sharesWithChildProcesses returns whether the profile of the given process is
+// configured to share its settings with its child processes.
+func sharesWithChildProcesses(proc *process.Process) bool {
+	layeredProfile := proc.Profile()
+	if layeredProfile == nil {
+		return false
+	}
+
+	layeredProfile.LockForUsage()
+	defer layeredProfile.UnlockForUsage()
+
+	return layeredProfile.ShareWithChildren()
+}
@@ -0,0 +1,75 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/safing/portmaster/process"
+)
+
+func TestFindSettingsAncestor(t *testing.T) {
+	t.Parallel()
+
+	// Process tree: init -> shell -> browser -> helper -> renderer
+	processes := map[int]*process.Process{
+		1:  {Pid: 1, ParentPid: 0},
+		10: {Pid: 10, ParentPid: 1},
+		20: {Pid: 20, ParentPid: 10},
+		30: {Pid: 30, ParentPid: 20},
+		40: {Pid: 40, ParentPid: 30},
+		// Process with a parent that exited.
+		50: {Pid: 50, ParentPid: 99},
+		// Process that claims to be its own parent.
+		60: {Pid: 60, ParentPid: 60},
+	}
+	getProcess := func(_ context.Context, pid int) (*process.Process, error) {
+		if proc, ok := processes[pid]; ok {
+			return proc, nil
+		}
+		return nil, errors.New("process not found")
+	}
+
+	sharing := map[int]bool{}
+	shares := func(proc *process.Process) bool {
+		return sharing[proc.Pid]
+	}
+	find := func(pid int) int {
+		ancestor := findSettingsAncestor(context.Background(), processes[pid], getProcess, shares)
+		if ancestor == nil {
+			return 0
+		}
+		return ancestor.Pid
+	}
+
+	// Nothing is shared.
+	if pid := find(40); pid != 0 {
+		t.Errorf("expected no ancestor, got %d", pid)
+	}
+
+	// The browser shares its settings with all its descendants.
+	sharing[20] = true
+	for _, pid := range []int{30, 40} {
+		if ancestor := find(pid); ancestor != 20 {
+			t.Errorf("expected ancestor 20 for %d, got %d", pid, ancestor)
+		}
+	}
+	for _, pid := range []int{1, 10, 20, 50, 60} {
+		if ancestor := find(pid); ancestor != 0 {
+			t.Errorf("expected no ancestor for %d, got %d", pid, ancestor)
+		}
+	}
+
+	// The closest sharing ancestor wins.
+	sharing[30] = true
+	if ancestor := find(40); ancestor != 30 {
+		t.Errorf("expected ancestor 30, got %d", ancestor)
+	}
+
+	// Settings are no longer applied when the ancestor stops sharing them.
+	sharing[20] = false
+	sharing[30] = false
+	if ancestor := find(40); ancestor != 0 {
+		t.Errorf("expected no ancestor after reset, got %d", ancestor)
+	}
+}
@@ -2,7 +2,9 @@
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
+	"net"
 	"sync"
 	"time"
 
@@ -28,17 +30,32 @@
 	blockServingIP = "block-serving-ip"
 
 	cancelPrompt = "cancel"
+
+	// actions when a prompt is not answered in time.
+	askTimeoutActionBlock  = "block"
+	askTimeoutActionDrop   = "drop"
+	askTimeoutActionPermit = "permit"
+
+	// maxPromptPayloadSnippet defines how many bytes of the payload of the
+	// packet that triggered a prompt are included in the prompt.
+	maxPromptPayloadSnippet = 64
 )
 
 var (
 	promptNotificationCreation sync.Mutex
 
 	decisionTimeout int64 = 10 // in seconds
+
+	// outstandingPrompts holds the expiry of the prompts that are outstanding
+	// for connections, by connection ID.
+	outstandingPrompts     = make(map[string]int64)
+	outstandingPromptsLock sync.Mutex
 )
 
 type promptData struct {
 	Entity  *intel.Entity
 	Profile promptProfile
+	Packet  *promptPacket `json:",omitempty"`
 }
 
 type promptProfile struct {
@@ -47,6 +64,81 @@ type promptProfile struct {
 	LinkedPath string
 }
 
+// promptPacket is a snapshot of the packet that triggered a prompt, so that
+// the user interface can show details of the exact packet. It only holds
+// copies of the packet data, so that the packet can be released while the
+// prompt is outstanding.
+type promptPacket struct {
+	Inbound   bool
+	IPVersion packet.IPVersion
+	Protocol  packet.IPProtocol
+	Src       net.IP
+	SrcPort   uint16
+	Dst       net.IP
+	DstPort   uint16
+	// Length is the length of the packet, as far as it was copied by the
+	// interception.
+	Length int
+	// Domain is the domain the remote IP was resolved from, if any.
+	Domain string `json:",omitempty"`
+	// ServerName is the server name indicated in the TLS ClientHello, if it
+	// was already detected.
+	ServerName string `json:",omitempty"`
+	// Payload holds the start of the payload in hex, see PayloadLength. It is
+	// only included if enabled by the prompt payload snippet option.
+	Payload string `json:",omitempty"`
+	// PayloadLength is the length of the payload, of which at most 64 bytes
+	// are included in Payload.
+	PayloadLength int
+}
+
+// newPromptPacket returns a snapshot of the packet that triggered a prompt for
+// the connection. It returns nil if the prompt was not triggered by a packet,
+// such as when re-evaluating the connection. The connection must be locked.
+func newPromptPacket(conn *network.Connection, pkt packet.Packet, withPayload bool) *promptPacket {
+	if pkt == nil {
+		return nil
+	}
+
+	info := pkt.Info()
+	snapshot := &promptPacket{
+		Inbound:    info.Inbound,
+		IPVersion:  info.Version,
+		Protocol:   info.Protocol,
+		Src:        append(net.IP(nil), info.Src...),
+		SrcPort:    info.SrcPort,
+		Dst:        append(net.IP(nil), info.Dst...),
+		DstPort:    info.DstPort,
+		Length:     len(pkt.Raw()),
+		ServerName: conn.TLSServerName(),
+	}
+	if conn.Entity != nil {
+		snapshot.Domain = conn.Entity.Domain
+	}
+
+	payload := pkt.Payload()
+	snapshot.PayloadLength = len(payload)
+	if !withPayload {
+		return snapshot
+	}
+	if len(payload) > maxPromptPayloadSnippet {
+		payload = payload[:maxPromptPayloadSnippet]
+	}
+	if len(payload) > 0 {
+		snapshot.Payload = hex.EncodeToString(payload)
+	}
+	return snapshot
+}
+
+// prompt asks the user for a decision on the connection. The connection, and
+// with it the packet, is held until the user answers, but at most for the
+// decision timeout. If there is no answer in time, IP connections get the ask
+// verdict, which applies the configured prompt pending action to their
+// packets, but never permanently. As the prompt stays active, a later answer
+// is saved to the profile, which triggers a re-evaluation of the connection
+// and applies the answer to the following packets. When re-evaluating the
+// connection, there is no packet to hold, so the prompt pending action is
+// applied right away.
 func prompt(ctx context.Context, conn *network.Connection, pkt packet.Packet) {
 	// Create notification.
 	n := createPrompt(ctx, conn, pkt)
@@ -55,15 +147,29 @@ func prompt(ctx context.Context, conn *network.Connection, pkt packet.Packet) {
 		return
 	}
 
+	n.Lock()
+	expires := n.Expires
+	n.Unlock()
+	setPromptOutstanding(conn.ID, expires)
+
 	// Get decision timeout and make sure it does not exceed the ask timeout.
 	timeout := decisionTimeout
 	if timeout > askTimeout() {
 		timeout = askTimeout()
 	}
+	if pkt == nil {
+		applyAskTimeoutAction(conn)
+		return
+	}
+
+	// Track the verdict latency of the packet separately, as it includes the
+	// time waiting for the user.
+	pkt.Timing().WaitedForUser = true
 
 	// wait for response/timeout
 	select {
 	case promptResponse := <-n.Response():
+		endPromptOutstanding(conn.ID)
 		switch promptResponse {
 		case allowDomainAll, allowDomainDistinct, allowIP, allowServingIP:
 			conn.Accept("allowed via prompt", profile.CfgOptionEndpointsKey)
@@ -73,14 +179,73 @@ func prompt(ctx context.Context, conn *network.Connection, pkt packet.Packet) {
 
 	case <-time.After(time.Duration(timeout) * time.Second):
 		log.Tracer(ctx).Debugf("filter: continuing prompting async")
-		conn.Deny("prompting in progress, please respond to prompt", profile.CfgOptionDefaultActionKey)
+		applyAskTimeoutAction(conn)
 
 	case <-ctx.Done():
 		log.Tracer(ctx).Debugf("filter: aborting prompting because of shutdown")
+		endPromptOutstanding(conn.ID)
 		conn.Drop("shutting down", noReasonOptionKey)
 	}
 }
 
+// applyAskTimeoutAction sets the verdict of the connection, whose prompt was
+// not answered in time. IP connections get the ask verdict, so that the
+// prompt pending action is applied to their packets until the prompt is
+// answered. Other connections, such as DNS requests, get the verdict of the
+// prompt pending action. The connection must be locked.
+func applyAskTimeoutAction(conn *network.Connection) {
+	action := askTimeoutAction()
+	if conn.Type == network.IPConnection {
+		reason := "prompting in progress, please respond to prompt"
+		if action == askTimeoutActionPermit {
+			reason = "allowed while prompting, please respond to prompt"
+		}
+		conn.SetVerdict(network.VerdictAsk, reason, CfgOptionAskTimeoutActionKey, nil)
+		return
+	}
+
+	switch action {
+	case askTimeoutActionPermit:
+		conn.Accept("allowed while prompting, please respond to prompt", CfgOptionAskTimeoutActionKey)
+	case askTimeoutActionDrop:
+		conn.Drop("prompting in progress, please respond to prompt", CfgOptionAskTimeoutActionKey)
+	default:
+		conn.Deny("prompting in progress, please respond to prompt", profile.CfgOptionDefaultActionKey)
+	}
+}
+
+// setPromptOutstanding records that a prompt that expires at the given time in
+// UNIX epoch seconds is outstanding for the connection with the given ID.
+func setPromptOutstanding(connID string, expires int64) {
+	outstandingPromptsLock.Lock()
+	defer outstandingPromptsLock.Unlock()
+
+	outstandingPrompts[connID] = expires
+}
+
+// endPromptOutstanding records that the prompt of the connection with the
+// given ID is not outstanding anymore.
+func endPromptOutstanding(connID string) {
+	outstandingPromptsLock.Lock()
+	defer outstandingPromptsLock.Unlock()
+
+	delete(outstandingPrompts, connID)
+}
+
+// countOutstandingPrompts returns the number of connections with an
+// outstanding prompt at the given time. Expired prompts are removed.
+func countOutstandingPrompts(now time.Time) int {
+	outstandingPromptsLock.Lock()
+	defer outstandingPromptsLock.Unlock()
+
+	for connID, expires := range outstandingPrompts {
+		if expires <= now.Unix() {
+			delete(outstandingPrompts, connID)
+		}
+	}
+	return len(outstandingPrompts)
+}
+
 // promptIDPrefix is an identifier for privacy filter prompts. This is also use
 // in the UI, so don't change!
 const promptIDPrefix = "filter:prompt"
@@ -110,7 +275,7 @@ func createPrompt(ctx context.Context, conn *network.Connection, pkt packet.Pack
 			promptIDPrefix,
 			localProfile.ID,
 			conn.Inbound,
-			pkt.Info().RemoteIP(),
+			conn.Entity.IP,
 		)
 	default: // connection to domain
 		nID = fmt.Sprintf(
@@ -183,6 +348,7 @@ func createPrompt(ctx context.Context, conn *network.Connection, pkt packet.Pack
 				// TODO: Using the process path is a workaround. Find a cleaner solution.
 				LinkedPath: conn.Process().Path,
 			},
+			Packet: newPromptPacket(conn, pkt, askWithPayloadSnippet()),
 		},
 		Expires: expires,
 	}
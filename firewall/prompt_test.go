@@ -0,0 +1,187 @@
+package firewall
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/safing/portmaster/intel"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+func TestPromptPacket(t *testing.T) {
+	t.Parallel()
+
+	payload := make([]byte, 100)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	pkt := newTestTCPSegment(t, net.IPv4(10, 0, 0, 1), net.IPv4(1, 1, 1, 1), 40000, 443, 1, 1, testTCPFlagACK|testTCPFlagPSH, payload)
+	conn := &network.Connection{
+		Entity: &intel.Entity{Domain: "api.example.com."},
+	}
+	conn.SetTLSServerName("api.example.com")
+
+	snapshot := newPromptPacket(conn, pkt, true)
+	if snapshot.Inbound || snapshot.IPVersion != packet.IPv4 || snapshot.Protocol != packet.TCP {
+		t.Errorf("unexpected packet metadata %+v", snapshot)
+	}
+	if !snapshot.Src.Equal(net.IPv4(10, 0, 0, 1)) || snapshot.SrcPort != 40000 ||
+		!snapshot.Dst.Equal(net.IPv4(1, 1, 1, 1)) || snapshot.DstPort != 443 {
+		t.Errorf("unexpected packet addresses %+v", snapshot)
+	}
+	if snapshot.Length != len(pkt.Raw()) || snapshot.PayloadLength != 100 {
+		t.Errorf("unexpected lengths %d and %d", snapshot.Length, snapshot.PayloadLength)
+	}
+	if snapshot.Domain != "api.example.com." || snapshot.ServerName != "api.example.com" {
+		t.Errorf("unexpected names %q and %q", snapshot.Domain, snapshot.ServerName)
+	}
+
+	// Only the start of the payload is included.
+	if snapshot.Payload != hex.EncodeToString(payload[:maxPromptPayloadSnippet]) {
+		t.Errorf("unexpected payload snippet %s", snapshot.Payload)
+	}
+
+	// The snapshot does not reference the packet data.
+	raw := pkt.Raw()
+	for i := range raw {
+		raw[i] = 0xFF
+	}
+	if !snapshot.Src.Equal(net.IPv4(10, 0, 0, 1)) || !snapshot.Dst.Equal(net.IPv4(1, 1, 1, 1)) {
+		t.Error("snapshot should not change with the packet data")
+	}
+
+	// Packets without payload have no payload snippet.
+	empty := newTestTCPPacket(t, net.IPv4(10, 0, 0, 1), net.IPv4(1, 1, 1, 1), 40000, 443, 1, 1, 0)
+	if snapshot := newPromptPacket(&network.Connection{}, empty, true); snapshot.Payload != "" || snapshot.PayloadLength != 0 {
+		t.Errorf("unexpected payload snippet %q", snapshot.Payload)
+	}
+
+	// The payload snippet is only included if enabled.
+	if snapshot := newPromptPacket(conn, pkt, false); snapshot.Payload != "" || snapshot.PayloadLength != 100 {
+		t.Errorf("payload snippet should not be included, got %q", snapshot.Payload)
+	}
+
+	// Prompts that are not triggered by a packet have no packet snapshot.
+	if snapshot := newPromptPacket(conn, nil, true); snapshot != nil {
+		t.Errorf("expected no snapshot without a packet, got %+v", snapshot)
+	}
+}
+
+// recordingPacket records the verdicts applied to it.
+type recordingPacket struct {
+	*failingPacket
+
+	verdicts []string
+}
+
+func (pkt *recordingPacket) record(verdict string) error {
+	pkt.verdicts = append(pkt.verdicts, verdict)
+	return nil
+}
+
+func (pkt *recordingPacket) Accept() error          { return pkt.record("accept") }
+func (pkt *recordingPacket) Block() error           { return pkt.record("block") }
+func (pkt *recordingPacket) Drop() error            { return pkt.record("drop") }
+func (pkt *recordingPacket) PermanentAccept() error { return pkt.record("permanent-accept") }
+func (pkt *recordingPacket) PermanentBlock() error  { return pkt.record("permanent-block") }
+func (pkt *recordingPacket) PermanentDrop() error   { return pkt.record("permanent-drop") }
+
+func TestAskVerdict(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func(orig func() string) { askTimeoutAction = orig }(askTimeoutAction)
+	defer func(orig func() bool) { permanentVerdicts = orig }(permanentVerdicts)
+	action := askTimeoutActionPermit
+	askTimeoutAction = func() string { return action }
+	permanentVerdicts = func() bool { return true }
+
+	newPacket := func() *recordingPacket {
+		return &recordingPacket{
+			failingPacket: newTestTCPPacket(t, net.IPv4(10, 0, 0, 1), net.IPv4(1, 1, 1, 1), 40000, 443, 1, 1, 0),
+		}
+	}
+	conn := &network.Connection{
+		ID:     "ask-test",
+		Type:   network.IPConnection,
+		Entity: &intel.Entity{},
+	}
+
+	// An unanswered prompt gives IP connections the ask verdict.
+	setPromptOutstanding(conn.ID, time.Now().Add(time.Minute).Unix())
+	applyAskTimeoutAction(conn)
+	finalizeVerdict(conn)
+	if conn.Verdict.Firewall != network.VerdictAsk || conn.Verdict.Active != network.VerdictAsk {
+		t.Fatalf("expected ask verdict, got %s", conn.VerdictVerb())
+	}
+
+	// The prompt pending action is applied, but never permanently.
+	for _, test := range []struct {
+		action   string
+		expected string
+	}{
+		{askTimeoutActionPermit, "accept"},
+		{askTimeoutActionBlock, "block"},
+		{askTimeoutActionDrop, "drop"},
+	} {
+		action = test.action
+		pkt := newPacket()
+		if err := issueVerdict(conn, pkt, 0, true); err != nil {
+			t.Fatal(err)
+		}
+		if len(pkt.verdicts) != 1 || pkt.verdicts[0] != test.expected {
+			t.Errorf("%s: expected verdict %s, got %v", test.action, test.expected, pkt.verdicts)
+		}
+		if conn.VerdictPermanent {
+			t.Errorf("%s: ask verdict should not be permanent", test.action)
+		}
+	}
+	if count := countOutstandingPrompts(time.Now()); count != 1 {
+		t.Errorf("expected 1 outstanding prompt, got %d", count)
+	}
+
+	// A later answer is applied to the following packets.
+	conn.Accept("allowed via prompt", "")
+	finalizeVerdict(conn)
+	if conn.Verdict.Active != network.VerdictAccept {
+		t.Fatalf("answer should be applied, got %s", conn.VerdictVerb())
+	}
+	pkt := newPacket()
+	if err := issueVerdict(conn, pkt, 0, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(pkt.verdicts) != 1 || pkt.verdicts[0] != "permanent-accept" {
+		t.Errorf("answer should be applied permanently, got %v", pkt.verdicts)
+	}
+	if count := countOutstandingPrompts(time.Now()); count != 0 {
+		t.Errorf("expected no outstanding prompts after answer, got %d", count)
+	}
+
+	// Other connections get the verdict of the prompt pending action.
+	action = askTimeoutActionDrop
+	dnsConn := &network.Connection{Type: network.DNSRequest, Entity: &intel.Entity{}}
+	applyAskTimeoutAction(dnsConn)
+	if dnsConn.Verdict.Firewall != network.VerdictDrop {
+		t.Errorf("expected DNS request to be dropped, got %s", dnsConn.Verdict.Firewall)
+	}
+}
+
+func TestOutstandingPrompts(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	now := time.Now()
+
+	// Prompts are counted per connection and expire.
+	setPromptOutstanding("conn-1", now.Add(time.Minute).Unix())
+	setPromptOutstanding("conn-1", now.Add(time.Minute).Unix())
+	setPromptOutstanding("conn-2", now.Add(time.Second).Unix())
+	defer endPromptOutstanding("conn-1")
+	if count := countOutstandingPrompts(now); count != 2 {
+		t.Errorf("expected 2 outstanding prompts, got %d", count)
+	}
+	if count := countOutstandingPrompts(now.Add(2 * time.Second)); count != 1 {
+		t.Errorf("expected 1 outstanding prompt after expiry, got %d", count)
+	}
+	endPromptOutstanding("conn-1")
+	if count := countOutstandingPrompts(now); count != 0 {
+		t.Errorf("expected no outstanding prompts, got %d", count)
+	}
+}
@@ -0,0 +1,106 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/firewall/inspection"
+	"github.com/safing/portmaster/firewall/inspection/l7"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/portmaster/profile"
+)
+
+// maxProtocolDetectionPackets defines how many packets without payload, like
+// handshake packets, are waited for until the detection is given up.
+const maxProtocolDetectionPackets = 8
+
+var protocolInspectorIndex uint8
+
+func init() {
+	protocolInspectorIndex = uint8(inspection.RegisterInspector(
+		"Application Protocol Detection",
+		inspectApplicationProtocol,
+		network.VerdictAccept,
+	))
+}
+
+// shouldDetectProtocol returns whether the application protocol of the
+// connection should be detected.
+func shouldDetectProtocol(conn *network.Connection) bool {
+	switch {
+	case !detectProtocols():
+		return false
+	case conn.Verdict.Firewall != network.VerdictAccept:
+		return false
+	case conn.DetectedProtocol() != "":
+		return false
+	default:
+		return conn.IPProtocol == packet.TCP || conn.IPProtocol == packet.UDP
+	}
+}
+
+// inspectApplicationProtocol detects the application protocol of the
+// connection from the first packet that has a payload. For TLS connections,
+// the server name is then detected from the ClientHello.
+func inspectApplicationProtocol(conn *network.Connection, pkt packet.Packet) uint8 {
+	data := conn.GetInspectorData()
+	if detection, ok := data[protocolInspectorIndex].(*tlsServerNameDetection); ok {
+		return detectTLSServerName(conn, pkt, detection)
+	}
+
+	payload := pkt.Payload()
+	if len(payload) == 0 {
+		// Count packets without payload, eg. of the TCP handshake.
+		seen, _ := data[protocolInspectorIndex].(int)
+		seen++
+		if seen >= maxProtocolDetectionPackets {
+			return inspection.STOP_INSPECTING
+		}
+		data[protocolInspectorIndex] = seen
+		return inspection.DO_NOTHING
+	}
+
+	protocol := l7.Detect(conn.IPProtocol, payload)
+	if protocol == l7.Unknown {
+		log.Tracer(pkt.Ctx()).Tracef("filter: could not detect application protocol of %s", conn)
+		return inspection.STOP_INSPECTING
+	}
+	conn.SetDetectedProtocol(string(protocol))
+	conn.SaveWhenFinished()
+	log.Tracer(pkt.Ctx()).Debugf("filter: detected application protocol %s of %s", protocol, conn)
+
+	if blockDetectedProtocol(conn) {
+		finalizeVerdict(conn)
+		return inspection.STOP_INSPECTING
+	}
+
+	if protocol == l7.TLS && pkt.IsInbound() == conn.Inbound {
+		return startTLSServerNameDetection(conn, pkt)
+	}
+	return inspection.STOP_INSPECTING
+}
+
+// checkApplicationProtocol blocks connections with a detected application
+// protocol that is blocked.
+func checkApplicationProtocol(_ context.Context, conn *network.Connection, _ *profile.LayeredProfile, _ packet.Packet) bool {
+	return blockDetectedProtocol(conn)
+}
+
+// blockDetectedProtocol blocks the connection, if its detected application
+// protocol is blocked. It returns whether the connection was blocked.
+func blockDetectedProtocol(conn *network.Connection) bool {
+	protocol := conn.DetectedProtocol()
+	if protocol == "" {
+		return false
+	}
+
+	for _, blocked := range blockProtocols() {
+		if blocked == protocol {
+			conn.Block(fmt.Sprintf("application protocol %s is blocked", protocol), CfgOptionBlockProtocolsKey)
+			return true
+		}
+	}
+	return false
+}
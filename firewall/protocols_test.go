@@ -0,0 +1,34 @@
+package firewall
+
+import (
+	"testing"
+
+	"github.com/safing/portmaster/firewall/inspection/l7"
+	"github.com/safing/portmaster/network"
+)
+
+//nolint:paralleltest // Modifies global state.
+func TestBlockDetectedProtocol(t *testing.T) {
+	blockProtocols = func() []string { return []string{"ssh"} }
+
+	conn := &network.Connection{}
+	if blockDetectedProtocol(conn) {
+		t.Error("connection without detected protocol should not be blocked")
+	}
+
+	conn.SetDetectedProtocol(string(l7.HTTP))
+	if blockDetectedProtocol(conn) {
+		t.Error("connection with allowed protocol should not be blocked")
+	}
+
+	conn.SetDetectedProtocol(string(l7.SSH))
+	if !blockDetectedProtocol(conn) {
+		t.Error("connection with blocked protocol should be blocked")
+	}
+	if conn.Verdict.Firewall != network.VerdictBlock {
+		t.Errorf("expected verdict %s, got %s", network.VerdictBlock, conn.Verdict.Firewall)
+	}
+	if conn.Reason.Msg != "application protocol ssh is blocked" {
+		t.Errorf("unexpected reason %q", conn.Reason.Msg)
+	}
+}
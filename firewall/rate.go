@@ -0,0 +1,326 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/firewall/interception"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/portmaster/profile"
+)
+
+const (
+	// connectionRatePollInterval defines how often the traffic counters of the
+	// connections are polled from the connection tracking of the OS.
+	connectionRatePollInterval = 5 * time.Second
+	// connectionRateWindowSamples defines over how many polls the rate is
+	// computed. With the poll interval, this makes a sliding window of 30
+	// seconds.
+	connectionRateWindowSamples = 6
+	// connectionRateMaxFlows is the maximum amount of connections for which
+	// the rate is tracked. Connections above this limit are not tracked until
+	// others end.
+	connectionRateMaxFlows = 8192
+	// connectionRateRetryInterval defines how long to wait before polling the
+	// traffic counters again after a failed poll.
+	connectionRateRetryInterval = 1 * time.Minute
+)
+
+var (
+	// ErrConnectionRateUnknown is returned if the rate of a connection is not
+	// known, because it is not tracked or was not polled often enough yet.
+	ErrConnectionRateUnknown = errors.New("rate of connection is not known")
+
+	// flowCounters returns the traffic counters of the tracked connections.
+	// It is a variable for testing.
+	flowCounters = interception.FlowCounters
+
+	connectionRates = newRateTracker(connectionRateWindowSamples, connectionRateMaxFlows)
+)
+
+// ConnectionRate returns the rate of the connection with the given ID, see
+// network.Connection.ID, in bytes per second of both directions combined. The
+// rate is computed over a sliding window of about 30 seconds from the traffic
+// counters of the connection tracking of the OS, which are polled every 5
+// seconds. It is thus available to verdict decisions without counting packets
+// and is used to block connections that exceed the maximum connection rate. Rates are only available on Linux with
+// connection tracking accounting enabled (net.netfilter.nf_conntrack_acct)
+// and once a connection was polled at least twice.
+func ConnectionRate(connKey string) (bps uint64, err error) {
+	return connectionRates.rate(connKey)
+}
+
+// connectionRatePoller regularly polls the traffic counters of the connections,
+// updates their rates and blocks connections that exceed the maximum rate.
+// Failed polls are retried less often, as the counters may not be available
+// yet, eg. while connection tracking accounting is not enabled.
+func connectionRatePoller(ctx context.Context) error {
+	var failed bool
+	for {
+		wait := connectionRatePollInterval
+		counters, err := flowCounters()
+		switch {
+		case err == nil:
+			if failed {
+				log.Infof("filter: connection rates are available again")
+				failed = false
+			}
+			connectionRates.update(time.Now(), counters, trackedConnectionID)
+			enforceConnectionRates(ctx, connectionsExceedingRate(connectionRates), reEvaluateConnection)
+		case !failed:
+			log.Warningf("filter: connection rates are not available, retrying in %s: %s", connectionRateRetryInterval, err)
+			failed = true
+			wait = connectionRateRetryInterval
+		default:
+			log.Debugf("filter: failed to poll connection traffic counters: %s", err)
+			wait = connectionRateRetryInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// checkConnectionRate blocks connections whose rate exceeds the maximum
+// connection rate.
+func checkConnectionRate(_ context.Context, conn *network.Connection, _ *profile.LayeredProfile, _ packet.Packet) bool {
+	limit := maxConnectionRateBps()
+	if limit == 0 {
+		return false
+	}
+
+	bps, err := ConnectionRate(conn.ID)
+	if err != nil || bps <= limit {
+		return false
+	}
+
+	conn.Deny(fmt.Sprintf("rate of %d kB/s exceeds the maximum of %d kB/s", bps/1000, limit/1000), CfgOptionMaxConnectionRateKey)
+	return true
+}
+
+// maxConnectionRateBps returns the maximum connection rate in bytes per second,
+// or 0 if it is disabled.
+func maxConnectionRateBps() uint64 {
+	limit := maxConnectionRate()
+	if limit <= 0 {
+		return 0
+	}
+	return uint64(limit) * 1000
+}
+
+// connectionsExceedingRate returns the connections whose rate exceeds the
+// maximum connection rate.
+func connectionsExceedingRate(rates *rateTracker) []*network.Connection {
+	limit := maxConnectionRateBps()
+	if limit == 0 {
+		return nil
+	}
+
+	var conns []*network.Connection
+	for _, id := range rates.exceeding(limit) {
+		if conn, ok := network.GetConnection(id); ok {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
+// enforceConnectionRates re-evaluates the verdicts of the given connections,
+// whose rate exceeds the maximum connection rate, so that they are blocked.
+// The permanent verdicts of these connections are reset in the system
+// integration, so that their packets reach the firewall again.
+func enforceConnectionRates(
+	ctx context.Context,
+	conns []*network.Connection,
+	reEvaluate func(context.Context, *network.Connection) bool,
+) {
+	for _, conn := range conns {
+		func() {
+			conn.Lock()
+			defer conn.Unlock()
+
+			switch conn.Verdict.Firewall { //nolint:exhaustive // Only already denied connections are skipped.
+			case network.VerdictBlock, network.VerdictDrop:
+				return
+			}
+			if conn.Internal || conn.Killed || verdictPinned(conn) || !reEvaluate(ctx, conn) {
+				return
+			}
+
+			if conn.Type == network.IPConnection && conn.VerdictPermanent {
+				if err := resetVerdictOfConnection(connectionInfo(conn)); err != nil {
+					log.Warningf("filter: failed to reset permanent verdict of %s: %s", conn, err)
+				}
+			}
+		}()
+	}
+}
+
+// trackedConnectionID returns the ID of the connection that has one of the
+// given IDs, if it exists.
+func trackedConnectionID(outbound, inbound string) (id string, ok bool) {
+	if _, ok := network.GetConnection(outbound); ok {
+		return outbound, true
+	}
+	if _, ok := network.GetConnection(inbound); ok {
+		return inbound, true
+	}
+	return "", false
+}
+
+// rateTracker computes the rates of connections from their traffic counters.
+type rateTracker struct {
+	lock sync.Mutex
+
+	flows    map[string]*flowRate
+	samples  int
+	maxFlows int
+}
+
+// flowRate holds the last samples of the traffic counters of a connection,
+// oldest first.
+type flowRate struct {
+	samples []rateSample
+}
+
+type rateSample struct {
+	at    time.Time
+	bytes uint64
+}
+
+func newRateTracker(samples, maxFlows int) *rateTracker {
+	return &rateTracker{
+		flows:    make(map[string]*flowRate),
+		samples:  samples,
+		maxFlows: maxFlows,
+	}
+}
+
+// update adds the polled counters as new samples. Connections are identified
+// with lookup, which returns the ID of the connection with one of the given
+// IDs. Connections that were not polled again are removed. A nil counters
+// slice, as from a failed poll, keeps the tracked connections.
+func (rt *rateTracker) update(now time.Time, counters []*packet.ConntrackCounters, lookup func(outbound, inbound string) (string, bool)) {
+	if counters == nil {
+		return
+	}
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	seen := make(map[string]struct{}, len(counters))
+	for _, counter := range counters {
+		id, ok := lookup(counter.Origin.ConnectionIDs())
+		if !ok {
+			continue
+		}
+		seen[id] = struct{}{}
+
+		flow, ok := rt.flows[id]
+		if !ok {
+			if len(rt.flows) >= rt.maxFlows {
+				continue
+			}
+			flow = &flowRate{}
+			rt.flows[id] = flow
+		}
+		flow.add(rateSample{at: now, bytes: counter.OriginBytes + counter.ReplyBytes}, rt.samples)
+	}
+
+	// Remove connections that ended.
+	for id := range rt.flows {
+		if _, ok := seen[id]; !ok {
+			delete(rt.flows, id)
+		}
+	}
+}
+
+// add adds the sample and keeps up to the given amount of samples plus the
+// sample at the start of the window.
+func (flow *flowRate) add(sample rateSample, samples int) {
+	// Start over if the counters were reset, eg. because the conntrack entry
+	// was recreated.
+	if len(flow.samples) > 0 && sample.bytes < flow.samples[len(flow.samples)-1].bytes {
+		flow.samples = flow.samples[:0]
+	}
+
+	flow.samples = append(flow.samples, sample)
+	if len(flow.samples) > samples+1 {
+		flow.samples = flow.samples[len(flow.samples)-samples-1:]
+	}
+}
+
+// rate returns the rate of the connection in bytes per second over the window.
+func (rt *rateTracker) rate(id string) (bps uint64, err error) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	flow, ok := rt.flows[id]
+	if !ok {
+		return 0, ErrConnectionRateUnknown
+	}
+	bps, ok = flow.rate()
+	if !ok {
+		return 0, ErrConnectionRateUnknown
+	}
+	return bps, nil
+}
+
+// rate returns the rate of the flow in bytes per second over the window and
+// whether it is known.
+func (flow *flowRate) rate() (bps uint64, ok bool) {
+	if len(flow.samples) < 2 {
+		return 0, false
+	}
+
+	first, last := flow.samples[0], flow.samples[len(flow.samples)-1]
+	elapsed := last.at.Sub(first.at)
+	if elapsed <= 0 {
+		return 0, false
+	}
+	return uint64(float64(last.bytes-first.bytes) / elapsed.Seconds()), true
+}
+
+// exceeding returns the IDs of the connections whose rate exceeds the given
+// rate in bytes per second.
+func (rt *rateTracker) exceeding(limit uint64) []string {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	var ids []string
+	for id, flow := range rt.flows {
+		if bps, ok := flow.rate(); ok && bps > limit {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// bytes returns the bytes of both directions of the connection with the given
+// ID, as of the last poll.
+func (rt *rateTracker) bytes(id string) (total uint64, ok bool) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	flow, ok := rt.flows[id]
+	if !ok || len(flow.samples) == 0 {
+		return 0, false
+	}
+	return flow.samples[len(flow.samples)-1].bytes, true
+}
+
+// remove stops tracking the rate of the connection with the given ID.
+func (rt *rateTracker) remove(id string) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	delete(rt.flows, id)
+}
@@ -0,0 +1,233 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/safing/portmaster/intel"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// mockCounterSource simulates the traffic counters of tracked connections.
+type mockCounterSource struct {
+	counters map[uint16]*packet.ConntrackCounters
+}
+
+func (m *mockCounterSource) add(localPort uint16, bytes uint64) {
+	counter, ok := m.counters[localPort]
+	if !ok {
+		counter = &packet.ConntrackCounters{
+			Origin: packet.ConntrackTuple{
+				Protocol: packet.TCP,
+				Src:      net.IPv4(10, 0, 0, 1),
+				SrcPort:  localPort,
+				Dst:      net.IPv4(1, 1, 1, 1),
+				DstPort:  443,
+			},
+		}
+		m.counters[localPort] = counter
+	}
+	// Split the traffic between both directions.
+	counter.OriginBytes += bytes / 4
+	counter.ReplyBytes += bytes - bytes/4
+}
+
+func (m *mockCounterSource) poll() []*packet.ConntrackCounters {
+	counters := make([]*packet.ConntrackCounters, 0, len(m.counters))
+	for _, counter := range m.counters {
+		c := *counter
+		counters = append(counters, &c)
+	}
+	return counters
+}
+
+func TestConnectionRate(t *testing.T) {
+	t.Parallel()
+
+	source := &mockCounterSource{counters: make(map[uint16]*packet.ConntrackCounters)}
+	tracker := newRateTracker(3, 2)
+	// All outbound connections are known.
+	lookup := func(outbound, _ string) (string, bool) {
+		return outbound, true
+	}
+	id := "6-10.0.0.1-40000-1.1.1.1-443"
+
+	now := time.Now()
+	source.add(40000, 1000)
+	tracker.update(now, source.poll(), lookup)
+	if _, err := tracker.rate(id); !errors.Is(err, ErrConnectionRateUnknown) {
+		t.Errorf("rate should not be known after the first poll, got %v", err)
+	}
+
+	// 10000 bytes per second.
+	for i := 1; i <= 3; i++ {
+		source.add(40000, 50000)
+		tracker.update(now.Add(time.Duration(i)*5*time.Second), source.poll(), lookup)
+	}
+	if bps, err := tracker.rate(id); err != nil || bps != 10000 {
+		t.Errorf("expected 10000 bytes per second, got %d, %v", bps, err)
+	}
+
+	// The window slides: the connection becomes idle.
+	for i := 4; i <= 6; i++ {
+		tracker.update(now.Add(time.Duration(i)*5*time.Second), source.poll(), lookup)
+	}
+	if bps, err := tracker.rate(id); err != nil || bps != 0 {
+		t.Errorf("idle connection should have no rate, got %d, %v", bps, err)
+	}
+
+	// The amount of tracked connections is bounded.
+	source.add(40001, 1000)
+	source.add(40002, 1000)
+	tracker.update(now.Add(35*time.Second), source.poll(), lookup)
+	if len(tracker.flows) != 2 {
+		t.Errorf("expected 2 tracked connections, got %d", len(tracker.flows))
+	}
+
+	// A failed poll keeps the connections, ended connections are removed.
+	tracker.update(now.Add(40*time.Second), nil, lookup)
+	if len(tracker.flows) != 2 {
+		t.Errorf("failed poll should keep the connections, got %d", len(tracker.flows))
+	}
+	delete(source.counters, 40000)
+	tracker.update(now.Add(45*time.Second), source.poll(), lookup)
+	if _, err := tracker.rate(id); !errors.Is(err, ErrConnectionRateUnknown) {
+		t.Errorf("ended connection should not be tracked anymore, got %v", err)
+	}
+}
+
+func TestConnectionRateCounterReset(t *testing.T) {
+	t.Parallel()
+
+	flow := &flowRate{}
+	now := time.Now()
+	flow.add(rateSample{at: now, bytes: 5000}, 3)
+	flow.add(rateSample{at: now.Add(time.Second), bytes: 6000}, 3)
+	// The conntrack entry was recreated.
+	flow.add(rateSample{at: now.Add(2 * time.Second), bytes: 100}, 3)
+	if len(flow.samples) != 1 || flow.samples[0].bytes != 100 {
+		t.Errorf("samples should have been reset, got %v", flow.samples)
+	}
+}
+
+//nolint:paralleltest // Modifies global state.
+func TestConnectionRateRemovedWhenClosed(t *testing.T) {
+	defer func(rates *rateTracker) {
+		connectionRates = rates
+	}(connectionRates)
+	connectionRates = newRateTracker(3, 10)
+
+	source := &mockCounterSource{counters: make(map[uint16]*packet.ConntrackCounters)}
+	source.add(40000, 1000)
+	id, _ := source.counters[40000].Origin.ConnectionIDs()
+	lookup := func(outbound, _ string) (string, bool) { return outbound, true }
+	connectionRates.update(time.Now(), source.poll(), lookup)
+	if _, ok := connectionRates.bytes(id); !ok {
+		t.Fatal("connection should be tracked")
+	}
+
+	handleConnectionClosed(id)
+	if _, ok := connectionRates.bytes(id); ok {
+		t.Error("closed connection should not be tracked anymore")
+	}
+}
+
+//nolint:paralleltest // Modifies global state.
+func TestCheckConnectionRate(t *testing.T) {
+	defer func(rates *rateTracker) {
+		connectionRates = rates
+	}(connectionRates)
+	connectionRates = newRateTracker(3, 10)
+	defer func(orig func() int64) { maxConnectionRate = orig }(maxConnectionRate)
+
+	// 10000 bytes per second.
+	source := &mockCounterSource{counters: make(map[uint16]*packet.ConntrackCounters)}
+	id, _ := (&packet.ConntrackTuple{
+		Protocol: packet.TCP,
+		Src:      net.IPv4(10, 0, 0, 1),
+		SrcPort:  40000,
+		Dst:      net.IPv4(1, 1, 1, 1),
+		DstPort:  443,
+	}).ConnectionIDs()
+	lookup := func(outbound, _ string) (string, bool) { return outbound, true }
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		source.add(40000, 50000)
+		connectionRates.update(now.Add(time.Duration(i)*5*time.Second), source.poll(), lookup)
+	}
+
+	tests := []struct {
+		name    string
+		id      string
+		limit   int64
+		blocked bool
+	}{
+		{"exceeded", id, 5, true},
+		{"below", id, 20, false},
+		{"disabled", id, 0, false},
+		{"unknown rate", "unknown", 5, false},
+	}
+	for _, tt := range tests {
+		limit := tt.limit
+		maxConnectionRate = func() int64 { return limit }
+
+		conn := &network.Connection{ID: tt.id, Entity: &intel.Entity{}}
+		if blocked := checkConnectionRate(context.Background(), conn, nil, nil); blocked != tt.blocked {
+			t.Errorf("%s: expected blocked=%t, got %t", tt.name, tt.blocked, blocked)
+		}
+		if tt.blocked && conn.Verdict.Firewall != network.VerdictBlock {
+			t.Errorf("%s: expected block verdict, got %s", tt.name, conn.Verdict.Firewall.Verb())
+		}
+	}
+
+	maxConnectionRate = func() int64 { return 5 }
+	if exceeding := connectionRates.exceeding(maxConnectionRateBps()); len(exceeding) != 1 || exceeding[0] != id {
+		t.Errorf("unexpected connections exceeding the rate %v", exceeding)
+	}
+}
+
+//nolint:paralleltest // Modifies global state.
+func TestEnforceConnectionRates(t *testing.T) {
+	var reset int
+	defer func(orig func(*packet.Info) error) { resetVerdictOfConnection = orig }(resetVerdictOfConnection)
+	resetVerdictOfConnection = func(*packet.Info) error {
+		reset++
+		return nil
+	}
+
+	newConn := func(id string, verdict network.Verdict) *network.Connection {
+		conn := &network.Connection{
+			ID:               id,
+			Type:             network.IPConnection,
+			IPVersion:        packet.IPv4,
+			IPProtocol:       packet.TCP,
+			LocalIP:          net.IPv4(10, 0, 0, 1),
+			LocalPort:        40000,
+			Entity:           &intel.Entity{IP: net.IPv4(1, 1, 1, 1), Port: 443},
+			VerdictPermanent: true,
+		}
+		conn.Verdict.Firewall = verdict
+		return conn
+	}
+	accepted := newConn("accepted", network.VerdictAccept)
+	blocked := newConn("blocked", network.VerdictBlock)
+	internal := newConn("internal", network.VerdictAccept)
+	internal.Internal = true
+
+	var reEvaluated []string
+	reEvaluate := func(_ context.Context, conn *network.Connection) bool {
+		reEvaluated = append(reEvaluated, conn.ID)
+		return true
+	}
+	enforceConnectionRates(context.Background(), []*network.Connection{accepted, blocked, internal}, reEvaluate)
+	if len(reEvaluated) != 1 || reEvaluated[0] != "accepted" {
+		t.Errorf("only the accepted connection should have been re-evaluated, got %v", reEvaluated)
+	}
+	if reset != 1 {
+		t.Errorf("expected the permanent verdict of 1 connection to be reset, got %d", reset)
+	}
+}
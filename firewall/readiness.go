@@ -0,0 +1,206 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tevino/abool"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/firewall/interception"
+	"github.com/safing/portmaster/intel/filterlists"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// EngineStartupSettings configures how packets are handled that arrive after
+// the interception started, but before the decision engine is ready, see
+// interception.WaitForInterceptionReady.
+type EngineStartupSettings struct {
+	// HoldTimeout defines how long after the start of the interception
+	// packets are held until the decision engine is ready.
+	HoldTimeout time.Duration
+	// FailVerdict is applied to packets if the decision engine is not ready
+	// after the hold timeout. Must be network.VerdictAccept,
+	// network.VerdictBlock or network.VerdictDrop.
+	FailVerdict network.Verdict
+}
+
+// DefaultEngineStartupSettings are the settings of the hold at startup, if not
+// changed with SetEngineStartupSettings.
+var DefaultEngineStartupSettings = EngineStartupSettings{
+	HoldTimeout: 10 * time.Second,
+	FailVerdict: network.VerdictAccept,
+}
+
+var (
+	engineStartupSettings     = DefaultEngineStartupSettings
+	engineStartupSettingsLock sync.Mutex
+
+	// engineStartup holds packets at startup. It is nil if the interception
+	// was not started.
+	engineStartup *engineStartupHold
+)
+
+// SetEngineStartupSettings sets how packets are handled while the decision
+// engine is not ready at startup. Packets are held until the engine is ready,
+// but at most until the hold timeout elapsed after the start of the
+// interception. Then, the fail verdict is applied to them until the engine is
+// ready. It must be called before the interception is started.
+func SetEngineStartupSettings(settings EngineStartupSettings) error {
+	if settings.HoldTimeout < 0 {
+		return errors.New("hold timeout must not be negative")
+	}
+	switch settings.FailVerdict { //nolint:exhaustive // Only these are valid.
+	case network.VerdictAccept, network.VerdictBlock, network.VerdictDrop:
+	default:
+		return fmt.Errorf("unsupported fail verdict %s", settings.FailVerdict)
+	}
+
+	engineStartupSettingsLock.Lock()
+	defer engineStartupSettingsLock.Unlock()
+
+	engineStartupSettings = settings
+	return nil
+}
+
+// engineStartupHoldSize defines how many packets are held at most while the
+// decision engine is not ready. Further packets receive the fail verdict.
+const engineStartupHoldSize = 1000
+
+// engineStartupHold holds packets in a buffer until the decision engine is
+// ready, without occupying a packet handler while doing so.
+type engineStartupHold struct {
+	deadline    time.Time
+	failVerdict network.Verdict
+
+	ready func() bool
+	wait  func(ctx context.Context) error
+	// release handles a packet that was held until the engine is ready.
+	release func(pkt packet.Packet)
+
+	held chan packet.Packet
+
+	// expired is set when the first packet was not held anymore.
+	expired *abool.AtomicBool
+}
+
+func newEngineStartupHold(
+	now time.Time,
+	settings EngineStartupSettings,
+	size int,
+	ready func() bool,
+	wait func(ctx context.Context) error,
+	release func(pkt packet.Packet),
+) *engineStartupHold {
+	return &engineStartupHold{
+		deadline:    now.Add(settings.HoldTimeout),
+		failVerdict: settings.FailVerdict,
+		ready:       ready,
+		wait:        wait,
+		release:     release,
+		held:        make(chan packet.Packet, size),
+		expired:     abool.New(),
+	}
+}
+
+// startEngineStartupHold starts holding packets until the decision engine is
+// ready. It must be called before packets are handled.
+func startEngineStartupHold() {
+	engineStartupSettingsLock.Lock()
+	settings := engineStartupSettings
+	engineStartupSettingsLock.Unlock()
+
+	engineStartup = newEngineStartupHold(
+		time.Now(), settings, engineStartupHoldSize,
+		interception.EngineReady, interception.WaitForInterceptionReady,
+		func(pkt packet.Packet) {
+			interceptionModule.StartWorker("held packet handler", func(ctx context.Context) error {
+				handlePacket(ctx, pkt)
+				return nil
+			})
+		},
+	)
+	interceptionModule.StartWorker("startup packet hold", engineStartup.run)
+}
+
+// hold holds the packet until the decision engine is ready and returns true.
+// The packet is then handled again by the release function. If the engine is
+// ready, it returns false, so that the packet is handled regularly. If the
+// hold is full or the deadline passed, the fail verdict is applied to the
+// packet and true is returned.
+func (h *engineStartupHold) hold(pkt packet.Packet) (handled bool) {
+	if h == nil || h.ready() {
+		return false
+	}
+
+	if time.Now().Before(h.deadline) {
+		select {
+		case h.held <- pkt:
+			return true
+		default:
+			h.fail(pkt, errors.New("too many packets are waiting"))
+			return true
+		}
+	}
+
+	h.fail(pkt, errors.New("hold timeout elapsed"))
+	return true
+}
+
+// run waits until the decision engine is ready, but at most until the
+// deadline, and then releases the held packets, or applies the fail verdict to
+// them. It keeps handling packets that are added later, until the context is
+// canceled.
+func (h *engineStartupHold) run(ctx context.Context) error {
+	holdCtx, cancel := context.WithDeadline(ctx, h.deadline)
+	err := h.wait(holdCtx)
+	cancel()
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	for {
+		select {
+		case pkt := <-h.held:
+			if err == nil {
+				h.release(pkt)
+			} else {
+				h.fail(pkt, err)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// fail applies the fail verdict to the packet.
+func (h *engineStartupHold) fail(pkt packet.Packet, reason error) {
+	if h.expired.SetToIf(false, true) {
+		log.Warningf("filter: decision engine is still not ready, packets are %s until it is: %s", h.failVerdict.Verb(), reason)
+	}
+	if err := applyFailVerdict(pkt, h.failVerdict); err != nil {
+		log.Warningf("filter: failed to apply fail verdict to packet %s while decision engine is not ready: %s", pkt, err)
+	}
+}
+
+// signalEngineReady signals that the decision engine is ready, once the
+// filter lists are loaded. If they are not cached yet, they are only used
+// once they are downloaded, which is not waited for.
+func signalEngineReady(ctx context.Context) error {
+	if filterModule.Enabled() {
+		switch err := filterlists.WaitForCacheLoad(ctx); {
+		case ctx.Err() != nil:
+			return nil
+		case err != nil:
+			log.Warningf("filter: decision engine starts without filter lists: %s", err)
+		}
+	}
+
+	interception.SignalEngineReady()
+	log.Info("filter: decision engine is ready")
+	return nil
+}
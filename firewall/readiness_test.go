@@ -0,0 +1,165 @@
+package firewall
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+func TestEngineStartupHold(t *testing.T) {
+	t.Parallel()
+
+	ready := make(chan struct{})
+	isReady := func() bool {
+		select {
+		case <-ready:
+			return true
+		default:
+			return false
+		}
+	}
+	wait := func(ctx context.Context) error {
+		select {
+		case <-ready:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	released := make(chan packet.Packet, 20)
+	release := func(pkt packet.Packet) {
+		released <- pkt
+	}
+	newPacket := func() *failingPacket {
+		return newTestTCPPacket(t, net.IPv4(10, 0, 0, 1), net.IPv4(1, 1, 1, 1), 40000, 443, 1, 0, 0)
+	}
+
+	// Without a hold, packets are handled regularly.
+	var noHold *engineStartupHold
+	if noHold.hold(newPacket()) {
+		t.Error("packets must not be held without a hold")
+	}
+
+	// Early packets are held without blocking until the engine is ready and
+	// then released in order.
+	const (
+		holdSize     = 10
+		earlyPackets = holdSize + 1
+	)
+	h := newEngineStartupHold(time.Now(), EngineStartupSettings{
+		HoldTimeout: time.Minute,
+		FailVerdict: network.VerdictDrop,
+	}, holdSize, isReady, wait, release)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = h.run(ctx)
+	}()
+
+	pkts := make([]*failingPacket, earlyPackets)
+	for i := range pkts {
+		pkts[i] = newPacket()
+		if !h.hold(pkts[i]) {
+			t.Fatal("packets must be held until the engine is ready")
+		}
+	}
+	select {
+	case <-released:
+		t.Fatal("packets must not be released before the engine is ready")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The packet that did not fit into the hold received the fail verdict.
+	overflow := pkts[holdSize]
+	if overflow.applied != 1 {
+		t.Error("fail verdict must be applied to packets that do not fit into the hold")
+	}
+
+	close(ready)
+	for i := 0; i < holdSize; i++ {
+		select {
+		case pkt := <-released:
+			if pkt != pkts[i] {
+				t.Errorf("packet %d was released out of order", i)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("held packets were not released")
+		}
+	}
+	for _, pkt := range pkts[:holdSize] {
+		if pkt.applied != 0 {
+			t.Error("no verdict must be applied to held packets")
+		}
+	}
+	if h.hold(newPacket()) {
+		t.Error("packets must not be held once the engine is ready")
+	}
+}
+
+func TestEngineStartupHoldTimeout(t *testing.T) {
+	t.Parallel()
+
+	neverReady := func() bool { return false }
+	waitForever := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	release := func(pkt packet.Packet) {
+		t.Errorf("packet %s must not be released", pkt)
+	}
+
+	// Packets are held until the deadline, then the fail verdict is applied.
+	h := newEngineStartupHold(time.Now(), EngineStartupSettings{
+		HoldTimeout: 20 * time.Millisecond,
+		FailVerdict: network.VerdictDrop,
+	}, 10, neverReady, waitForever, release)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		_ = h.run(ctx)
+		close(done)
+	}()
+
+	held := &droppedSignalingPacket{
+		failingPacket: newTestTCPPacket(t, net.IPv4(10, 0, 0, 1), net.IPv4(1, 1, 1, 1), 40000, 443, 1, 0, 0),
+		dropped:       make(chan struct{}),
+	}
+	if !h.hold(held) {
+		t.Fatal("packet must be held")
+	}
+	select {
+	case <-held.dropped:
+	case <-time.After(time.Second):
+		t.Fatal("fail verdict must be applied if the engine is not ready after the hold timeout")
+	}
+
+	// After the deadline, packets are not held anymore.
+	pkt := newTestTCPPacket(t, net.IPv4(10, 0, 0, 1), net.IPv4(1, 1, 1, 1), 40000, 443, 1, 0, 0)
+	if !h.hold(pkt) || pkt.applied != 1 {
+		t.Error("fail verdict must be applied after the deadline")
+	}
+
+	cancel()
+	<-done
+
+	if err := SetEngineStartupSettings(EngineStartupSettings{FailVerdict: network.VerdictRerouteToNameserver}); err == nil {
+		t.Error("unsupported fail verdict should be rejected")
+	}
+}
+
+// droppedSignalingPacket signals when it is dropped.
+type droppedSignalingPacket struct {
+	*failingPacket
+
+	dropped chan struct{}
+}
+
+func (pkt *droppedSignalingPacket) Drop() error {
+	close(pkt.dropped)
+	return nil
+}
@@ -0,0 +1,51 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/safing/portmaster/firewall/interception"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// RedirectToLocalPort accepts the connection and transparently redirects it to
+// the given TCP port on the local host, eg. to a filtering proxy.
+//
+// The redirect uses NAT (the iptables REDIRECT target) instead of TPROXY, as
+// TPROXY only works for forwarded and inbound traffic, while the connections
+// to be redirected are generated locally. Thus only outbound TCP connections
+// can be redirected and the proxy must listen on the loopback interface. The
+// proxy can retrieve the original destination of a redirected connection via
+// the SO_ORIGINAL_DST socket option, see interception.GetOriginalDestination.
+//
+// Address translation is only applied to the first packet of a connection, so
+// the redirect must be set up before the verdict for it is issued, eg. while
+// the firewall handler is evaluating the connection. The caller must hold the
+// lock of the connection. Redirecting is only supported on Linux.
+func RedirectToLocalPort(conn *network.Connection, port int) error {
+	switch {
+	case port <= 0 || port > 65535:
+		return fmt.Errorf("invalid port %d", port)
+	case conn.Type != network.IPConnection:
+		return errors.New("only IP connections can be redirected")
+	case conn.Entity == nil:
+		return errors.New("connection has no destination")
+	}
+
+	err := interception.RedirectToLocalPort(&packet.Info{
+		Inbound:  conn.Inbound,
+		Version:  conn.IPVersion,
+		Protocol: conn.IPProtocol,
+		Src:      conn.LocalIP,
+		SrcPort:  conn.LocalPort,
+		Dst:      conn.Entity.IP,
+		DstPort:  conn.Entity.Port,
+	}, uint16(port))
+	if err != nil {
+		return fmt.Errorf("failed to redirect %s to local port %d: %w", conn, port, err)
+	}
+
+	conn.Accept(fmt.Sprintf("redirected to local port %d", port), "")
+	return nil
+}
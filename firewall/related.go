@@ -0,0 +1,57 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// inheritRelatedVerdict sets the verdict of the master connection on the
+// given connection, if the conntrack information marks it as related to a
+// known connection with a final verdict. It returns whether a verdict was
+// inherited. The connection must be locked.
+func inheritRelatedVerdict(
+	ctx context.Context,
+	conn *network.Connection,
+	ctInfo *packet.ConntrackInfo,
+	getConnection func(id string) (*network.Connection, bool),
+) bool {
+	if ctInfo == nil ||
+		ctInfo.State != packet.ConntrackStateRelated ||
+		ctInfo.Master == nil {
+		return false
+	}
+
+	// Find master connection.
+	outboundID, inboundID := ctInfo.Master.ConnectionIDs()
+	master, ok := getConnection(outboundID)
+	if !ok {
+		master, ok = getConnection(inboundID)
+		if !ok {
+			log.Tracer(ctx).Tracef("filter: master connection %s of related connection not found", ctInfo.Master)
+			return false
+		}
+	}
+	if master == conn {
+		return false
+	}
+
+	master.Lock()
+	verdict := master.Verdict.Firewall
+	reasonOptionKey := master.Reason.OptionKey
+	master.Unlock()
+
+	// Only inherit simple and final verdicts.
+	switch verdict { //nolint:exhaustive // Only a subset is inherited.
+	case network.VerdictAccept, network.VerdictBlock, network.VerdictDrop:
+	default:
+		return false
+	}
+
+	conn.SetVerdict(verdict, fmt.Sprintf("inherited from related connection %s", master.ID), reasonOptionKey, nil)
+	log.Tracer(ctx).Infof("filter: related connection %s inherited verdict %s from %s", conn, verdict.Verb(), master.ID)
+	return true
+}
@@ -0,0 +1,75 @@
+package firewall
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+func TestInheritRelatedVerdict(t *testing.T) {
+	t.Parallel()
+
+	// Master connection, eg. an FTP control connection.
+	masterTuple := &packet.ConntrackTuple{
+		Protocol: packet.TCP,
+		Src:      net.IPv4(10, 0, 0, 1),
+		SrcPort:  50000,
+		Dst:      net.IPv4(192, 0, 2, 1),
+		DstPort:  21,
+	}
+	masterID, _ := masterTuple.ConnectionIDs()
+	master := &network.Connection{ID: masterID}
+	master.Verdict.Firewall = network.VerdictAccept
+
+	connections := map[string]*network.Connection{
+		masterID: master,
+	}
+	getConnection := func(id string) (*network.Connection, bool) {
+		conn, ok := connections[id]
+		return conn, ok
+	}
+
+	// Related connection, eg. an FTP data connection.
+	related := &network.Connection{ID: "6-10.0.0.1-50001-192.0.2.1-20"}
+	ok := inheritRelatedVerdict(context.Background(), related, &packet.ConntrackInfo{
+		State:  packet.ConntrackStateRelated,
+		Master: masterTuple,
+	}, getConnection)
+	if !ok {
+		t.Fatal("related connection should have inherited the verdict")
+	}
+	if related.Verdict.Firewall != network.VerdictAccept {
+		t.Errorf("related connection should be accepted, but is %s", related.Verdict.Firewall.Verb())
+	}
+
+	// New connections must not inherit anything.
+	unrelated := &network.Connection{ID: "6-10.0.0.1-50002-192.0.2.1-20"}
+	if inheritRelatedVerdict(context.Background(), unrelated, &packet.ConntrackInfo{
+		State:  packet.ConntrackStateNew,
+		Master: masterTuple,
+	}, getConnection) {
+		t.Error("new connection should not inherit a verdict")
+	}
+
+	// Unknown master connections must not result in a verdict.
+	unknownMaster := *masterTuple
+	unknownMaster.SrcPort = 40000
+	if inheritRelatedVerdict(context.Background(), unrelated, &packet.ConntrackInfo{
+		State:  packet.ConntrackStateRelated,
+		Master: &unknownMaster,
+	}, getConnection) {
+		t.Error("related connection with unknown master should not inherit a verdict")
+	}
+
+	// Undecided master connections must not pass on their verdict.
+	master.Verdict.Firewall = network.VerdictUndecided
+	if inheritRelatedVerdict(context.Background(), unrelated, &packet.ConntrackInfo{
+		State:  packet.ConntrackStateRelated,
+		Master: masterTuple,
+	}, getConnection) {
+		t.Error("related connection should not inherit an undecided verdict")
+	}
+}
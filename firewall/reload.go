@@ -0,0 +1,124 @@
+package firewall
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/firewall/interception"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/portmaster/profile"
+)
+
+// ruleReloadMaxHold defines how long decisions on new connections are held
+// while rules are reloading. This bounds the impact of a stuck reload.
+const ruleReloadMaxHold = 1 * time.Second
+
+var ruleReloadVerdict = new(uint32)
+
+// resetVerdictOfAllConnections resets the permanent verdicts of all
+// connections in the system integration. It is a variable for testing.
+var resetVerdictOfAllConnections = interception.ResetVerdictOfAllConnections
+
+// SetRuleReloadVerdict sets the transitional verdict that is applied to
+// packets of new connections while rules are reloading. The verdict is only
+// applied to the packet and the connection is decided on with the next packet.
+// Set to network.VerdictUndecided (the default) in order to hold the decision
+// until the reload finished instead.
+func SetRuleReloadVerdict(verdict network.Verdict) {
+	atomic.StoreUint32(ruleReloadVerdict, uint32(verdict))
+}
+
+// handleRuleReload holds the decision on the connection while rules are
+// reloading or applies the transitional verdict, if set. It returns whether
+// the normal decision process should continue.
+func handleRuleReload(conn *network.Connection, pkt packet.Packet) (decide bool) {
+	if !profile.RuleReloadInProgress() {
+		return true
+	}
+
+	// Apply transitional verdict, if set.
+	if verdict := network.Verdict(atomic.LoadUint32(ruleReloadVerdict)); verdict != network.VerdictUndecided {
+		log.Tracer(pkt.Ctx()).Infof("filter: rules are reloading, applying transitional verdict %s to %s", verdict, pkt)
+		if err := issueVerdict(conn, pkt, verdict, false); err != nil {
+			log.Warningf("filter: pkt %s: %s", pkt, err)
+		}
+		return false
+	}
+
+	// Otherwise, wait for the reload to finish.
+	if !profile.WaitForRuleReload(pkt.Ctx(), ruleReloadMaxHold) {
+		log.Tracer(pkt.Ctx()).Warningf("filter: rules still reloading after %s, continuing with current rules", ruleReloadMaxHold)
+	}
+	return true
+}
+
+// InvalidateVerdictsOlderThan re-evaluates the verdicts of all connections that
+// were decided with a rule version older than the given one, see
+// profile.CurrentRuleVersion, or whose profile changed since they were
+// decided. If any of these connections had a permanent verdict, the marked
+// connections in the system integration are reset with a single sweep after
+// re-evaluating, so that their packets reach the firewall again. The sweep
+// also clears marks of connections that are no longer tracked. Connections
+// that are not outdated keep their decided verdict, which makes this much
+// cheaper than re-evaluating all connections after a change of a single
+// profile.
+// Connections with a pinned verdict are skipped, see PinConnectionVerdict.
+// It returns the number of connections whose verdict was invalidated.
+func InvalidateVerdictsOlderThan(version profile.RuleVersion) (invalidated int) {
+	return invalidateVerdictsOlderThan(version, network.GetAllConnections(), reEvaluateConnection)
+}
+
+func invalidateVerdictsOlderThan(
+	version profile.RuleVersion,
+	conns []*network.Connection,
+	reEvaluate func(context.Context, *network.Connection) bool,
+) (invalidated int) {
+	ctx, tracer := log.AddTracer(context.Background())
+	defer tracer.Submit()
+
+	var (
+		changedVerdicts int
+		resetPermanent  bool
+	)
+	for _, conn := range conns {
+		func() {
+			conn.Lock()
+			defer conn.Unlock()
+
+			if !verdictOutdated(conn, version) || conn.Internal || conn.Killed || conn.VerdictExpires != 0 || verdictPinned(conn) {
+				return
+			}
+			invalidated++
+
+			if reEvaluate(ctx, conn) {
+				changedVerdicts++
+			}
+
+			if conn.Type == network.IPConnection && conn.VerdictPermanent {
+				resetPermanent = true
+			}
+		}()
+	}
+
+	// Reset permanent verdicts with a single sweep instead of once per
+	// connection, and without holding any connection lock.
+	if resetPermanent {
+		if err := resetVerdictOfAllConnections(); err != nil {
+			tracer.Warningf("filter: failed to reset permanent verdicts: %s", err)
+		}
+	}
+
+	tracer.Infof("filter: invalidated %d verdicts older than rule version %d, %d changed", invalidated, version, changedVerdicts)
+	return invalidated
+}
+
+// verdictOutdated returns whether the verdict of the connection was decided
+// with a rule version older than the given one or with an older revision of
+// its profile. The connection must be locked.
+func verdictOutdated(conn *network.Connection, version profile.RuleVersion) bool {
+	return conn.RuleVersion < version ||
+		conn.Process().Profile().RevisionCnt() != conn.ProfileRevisionCounter
+}
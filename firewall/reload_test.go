@@ -0,0 +1,85 @@
+package firewall
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/safing/portmaster/intel"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/portmaster/profile"
+)
+
+func TestInvalidateVerdictsOlderThan(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	var resets int
+	defer func(orig func() error) { resetVerdictOfAllConnections = orig }(resetVerdictOfAllConnections)
+	resetVerdictOfAllConnections = func() error {
+		resets++
+		return nil
+	}
+	defer func(orig func(*packet.Info) error) { resetVerdictOfConnection = orig }(resetVerdictOfConnection)
+	resetVerdictOfConnection = func(*packet.Info) error {
+		t.Error("connections should not be reset one by one")
+		return nil
+	}
+
+	newConn := func(id string, version profile.RuleVersion) *network.Connection {
+		return &network.Connection{
+			ID:               id,
+			Type:             network.IPConnection,
+			IPVersion:        packet.IPv4,
+			IPProtocol:       packet.TCP,
+			LocalIP:          net.IPv4(10, 0, 0, 1),
+			LocalPort:        40000,
+			Entity:           &intel.Entity{IP: net.IPv4(1, 1, 1, 1), Port: 443},
+			RuleVersion:      version,
+			VerdictPermanent: true,
+		}
+	}
+	stale := newConn("stale", 1)
+	current := newConn("current", 2)
+	newer := newConn("newer", 3)
+	internal := newConn("internal", 1)
+	internal.Internal = true
+	killed := newConn("killed", 1)
+	killed.Killed = true
+	// The profile of the connection changed since it was decided.
+	profileChanged := newConn("profile changed", 2)
+	profileChanged.ProfileRevisionCounter = 1
+
+	var reEvaluated []string
+	reEvaluate := func(_ context.Context, conn *network.Connection) bool {
+		reEvaluated = append(reEvaluated, conn.ID)
+		conn.RuleVersion = 2
+		conn.ProfileRevisionCounter = 0
+		return true
+	}
+
+	invalidated := invalidateVerdictsOlderThan(2, []*network.Connection{stale, current, newer, internal, killed, profileChanged}, reEvaluate)
+	if invalidated != 2 {
+		t.Errorf("expected 2 invalidated verdicts, got %d", invalidated)
+	}
+	if len(reEvaluated) != 2 || reEvaluated[0] != "stale" || reEvaluated[1] != "profile changed" {
+		t.Errorf("only the stale connection and the connection with the changed profile should have been re-evaluated, got %v", reEvaluated)
+	}
+	if resets != 1 {
+		t.Errorf("permanent verdicts should have been reset with a single sweep, got %d", resets)
+	}
+
+	// Nothing is stale anymore.
+	reEvaluated = nil
+	if invalidateVerdictsOlderThan(2, []*network.Connection{stale, current, newer, profileChanged}, reEvaluate) != 0 || len(reEvaluated) != 0 {
+		t.Error("no verdicts should have been invalidated")
+	}
+	if resets != 1 {
+		t.Errorf("nothing should have been reset without invalidated permanent verdicts, got %d sweeps", resets)
+	}
+
+	// Connections without a permanent verdict do not need a reset.
+	transient := newConn("transient", 1)
+	transient.VerdictPermanent = false
+	if invalidateVerdictsOlderThan(2, []*network.Connection{transient}, reEvaluate) != 1 || resets != 1 {
+		t.Errorf("non-permanent verdicts should not trigger a reset, got %d sweeps", resets)
+	}
+}
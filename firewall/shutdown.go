@@ -0,0 +1,94 @@
+package firewall
+
+import (
+	"sort"
+
+	"github.com/safing/portbase/modules"
+)
+
+// InterceptionModuleName is the name of the module that runs the packet
+// interception. Network traffic is no longer handled by the Portmaster after
+// this module stopped. Modules that perform network operations while stopping,
+// such as flushing data to a server, must declare it as a dependency, so that
+// they are stopped before the interception is torn down, as the core, compat
+// and broadcasts modules do. The modules that the interception itself depends
+// on are stopped after it.
+const InterceptionModuleName = "interception"
+
+// ShutdownOrder returns the names of the given modules and all of their
+// dependencies in the order in which they are stopped on shutdown: A module is
+// stopped only after all modules that depend on it have stopped. Modules that
+// may be stopped at the same time are sorted by name.
+// Dependencies are only known after the modules were started.
+func ShutdownOrder(mods ...*modules.Module) []string {
+	dependencies := make(map[string][]string)
+
+	var add func(m *modules.Module)
+	add = func(m *modules.Module) {
+		if _, ok := dependencies[m.Name]; ok {
+			return
+		}
+
+		deps := m.Dependencies()
+		names := make([]string, 0, len(deps))
+		for _, dep := range deps {
+			names = append(names, dep.Name)
+		}
+		dependencies[m.Name] = names
+
+		for _, dep := range deps {
+			add(dep)
+		}
+	}
+	for _, m := range mods {
+		add(m)
+	}
+
+	return shutdownOrder(dependencies)
+}
+
+// ShutdownOrderOfInterception returns the shutdown order of the interception
+// module and its dependencies, which are stopped after it.
+func ShutdownOrderOfInterception() []string {
+	return ShutdownOrder(interceptionModule)
+}
+
+// shutdownOrder returns the stop order of the modules in the given
+// dependency graph, which maps module names to the names of their
+// dependencies. Modules that are part of a dependency loop are omitted.
+func shutdownOrder(dependencies map[string][]string) []string {
+	// Count the modules that need to stop before each module.
+	dependents := make(map[string]int, len(dependencies))
+	for name, deps := range dependencies {
+		if _, ok := dependents[name]; !ok {
+			dependents[name] = 0
+		}
+		for _, dep := range deps {
+			dependents[dep]++
+		}
+	}
+
+	order := make([]string, 0, len(dependents))
+	for {
+		// Find all modules that are ready to stop.
+		var ready []string
+		for name, cnt := range dependents {
+			if cnt == 0 {
+				ready = append(ready, name)
+			}
+		}
+		if len(ready) == 0 {
+			return order
+		}
+		sort.Strings(ready)
+
+		// Stop them.
+		for _, name := range ready {
+			delete(dependents, name)
+			for _, dep := range dependencies[name] {
+				dependents[dep]--
+			}
+		}
+		order = append(order, ready...)
+	}
+}
@@ -0,0 +1,83 @@
+package firewall
+
+import (
+	"testing"
+
+	"github.com/safing/portbase/modules"
+	_ "github.com/safing/portmaster/core"
+)
+
+func TestShutdownOrder(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	// Starting the module system links the registered modules to their
+	// dependencies. Starting fails in the global prep without a data root, so
+	// that no module is prepared or started.
+	if err := modules.Start(); err == nil {
+		t.Fatal("module system should not start in tests")
+	}
+	order := ShutdownOrder(filterModule)
+
+	positions := make(map[string]int, len(order))
+	for i, name := range order {
+		positions[name] = i
+	}
+	for _, name := range []string{"core", "compat", "broadcasts", "updates", "network", "base"} {
+		if _, ok := positions[name]; !ok {
+			t.Fatalf("module %s missing in shutdown order %v", name, order)
+		}
+	}
+
+	// Modules that use the network must be stopped before the interception,
+	// the modules it depends on after it. Modules are stopped concurrently, so
+	// only a dependency on the interception guarantees the order.
+	for _, before := range []string{"filter", "core", "compat", "broadcasts"} {
+		if positions[before] > positions[InterceptionModuleName] {
+			t.Errorf("%s must be stopped before the interception: %v", before, order)
+		}
+		if !dependsOn(findModule(filterModule, before), InterceptionModuleName) {
+			t.Errorf("%s must depend on the interception", before)
+		}
+	}
+	for _, after := range []string{"updates", "network", "profiles", "base"} {
+		if positions[after] < positions[InterceptionModuleName] {
+			t.Errorf("%s must be stopped after the interception: %v", after, order)
+		}
+	}
+}
+
+// findModule returns the module with the given name out of m and its
+// dependencies.
+func findModule(m *modules.Module, name string) *modules.Module {
+	if m.Name == name {
+		return m
+	}
+	for _, dep := range m.Dependencies() {
+		if found := findModule(dep, name); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// dependsOn returns whether m depends on the module with the given name,
+// directly or through its dependencies.
+func dependsOn(m *modules.Module, name string) bool {
+	for _, dep := range m.Dependencies() {
+		if dep.Name == name || dependsOn(dep, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestShutdownOrderLoop(t *testing.T) {
+	t.Parallel()
+
+	order := shutdownOrder(map[string][]string{
+		"a": {"b"},
+		"b": {"a"},
+		"c": nil,
+	})
+	if len(order) != 1 || order[0] != "c" {
+		t.Errorf("modules of dependency loop should be omitted: %v", order)
+	}
+}
@@ -0,0 +1,51 @@
+package firewall
+
+import (
+	"context"
+
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/profile"
+)
+
+// SimulateVerdict returns the verdict the firewall would issue for a
+// connection as described by the given spec, eg. to answer what would happen
+// if an app connected to a certain destination. The decision is made with the
+// current profile of the process, but without any side effects: No packets
+// are handled, nothing is cached or saved, no conntrack entries are changed
+// and the user is not prompted. If the user would be prompted, the verdict is
+// network.VerdictUndecided. Pending profile updates are not applied, so
+// changes that are not yet picked up by the process are not reflected.
+func SimulateVerdict(spec network.ConnSpec) (network.Verdict, network.Reason, error) {
+	conn, err := network.NewSimulatedConnection(spec)
+	if err != nil {
+		return network.VerdictUndecided, network.Reason{}, err
+	}
+
+	ctx := context.Background()
+	layeredProfile := conn.Process().Profile()
+	if layeredProfile != nil {
+		// Prepare the entity and resolve all filterlist matches.
+		conn.Entity.ResolveSubDomainLists(ctx, layeredProfile.FilterSubDomains())
+		conn.Entity.EnableCNAMECheck(ctx, layeredProfile.FilterCNAMEs())
+		conn.Entity.LoadLists(ctx)
+	}
+
+	verdict, reason := simulateVerdict(ctx, conn, layeredProfile, defaultDeciders)
+	return verdict, reason, nil
+}
+
+// simulateVerdict runs the given deciders and applies the default action, but
+// does not prompt the user.
+func simulateVerdict(ctx context.Context, conn *network.Connection, layeredProfile *profile.LayeredProfile, deciders []deciderFn) (network.Verdict, network.Reason) {
+	if layeredProfile == nil {
+		conn.Deny("unknown process or profile", noReasonOptionKey)
+		return conn.Verdict.Firewall, conn.Reason
+	}
+
+	done, defaultAction := runDeciders(ctx, deciders, conn, layeredProfile, nil)
+	if !done && applyDefaultAction(conn, defaultAction) {
+		conn.SetVerdict(network.VerdictUndecided, "would ask the user", profile.CfgOptionDefaultActionKey, nil)
+	}
+
+	return conn.Verdict.Firewall, conn.Reason
+}
@@ -0,0 +1,84 @@
+package firewall
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/safing/portmaster/intel"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/portmaster/profile"
+)
+
+func newSimulationTestConn(id string, ip net.IP) *network.Connection {
+	entity := &intel.Entity{
+		Protocol: uint8(packet.TCP),
+		Port:     443,
+	}
+	entity.SetIP(ip)
+	entity.SetDstPort(443)
+
+	return &network.Connection{
+		ID:         id,
+		Type:       network.IPConnection,
+		IPVersion:  packet.IPv4,
+		IPProtocol: packet.TCP,
+		Entity:     entity,
+	}
+}
+
+func TestSimulateVerdict(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx       = context.Background()
+		allowedIP = net.IPv4(192, 0, 2, 1)
+		blockedIP = net.IPv4(198, 51, 100, 1)
+		otherIP   = net.IPv4(203, 0, 113, 1)
+	)
+	deciders := []deciderFn{
+		func(_ context.Context, conn *network.Connection, _ *profile.LayeredProfile, _ packet.Packet) bool {
+			if conn.Entity.IP.Equal(allowedIP) {
+				conn.Accept("allowed test net", noReasonOptionKey)
+				return true
+			}
+			return false
+		},
+		func(_ context.Context, conn *network.Connection, _ *profile.LayeredProfile, _ packet.Packet) bool {
+			if conn.Entity.IP.Equal(blockedIP) {
+				conn.Block("blocked test net", noReasonOptionKey)
+				return true
+			}
+			return false
+		},
+	}
+	layeredProfile := profile.NewLayeredProfile(profile.New(&profile.Profile{
+		ID:     "simulate-verdict-test",
+		Source: profile.SourceLocal,
+	}))
+
+	tests := []struct {
+		name    string
+		ip      net.IP
+		profile *profile.LayeredProfile
+		verdict network.Verdict
+		reason  string
+	}{
+		{"allowed", allowedIP, layeredProfile, network.VerdictAccept, "allowed test net"},
+		{"blocked", blockedIP, layeredProfile, network.VerdictBlock, "blocked test net"},
+		{"default action", otherIP, layeredProfile, network.VerdictBlock, "blocked by default action"},
+		{"no profile", allowedIP, nil, network.VerdictBlock, "unknown process or profile"},
+	}
+
+	for _, tt := range tests {
+		conn := newSimulationTestConn("simulate-"+tt.name, tt.ip)
+		verdict, reason := simulateVerdict(ctx, conn, tt.profile, deciders)
+		if verdict != tt.verdict {
+			t.Errorf("%s: expected verdict %s, got %s", tt.name, tt.verdict.Verb(), verdict.Verb())
+		}
+		if reason.Msg != tt.reason {
+			t.Errorf("%s: expected reason %q, got %q", tt.name, tt.reason, reason.Msg)
+		}
+	}
+}
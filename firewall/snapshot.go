@@ -0,0 +1,92 @@
+package firewall
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/safing/portmaster/firewall/interception"
+	"github.com/safing/portmaster/updates"
+)
+
+// InterceptionSnapshot holds the configuration and state of the interception
+// and the firewall at a point in time, for diagnosing issues.
+type InterceptionSnapshot struct {
+	// Time is the time the snapshot was taken.
+	Time time.Time
+	// Interception holds the configuration and state of the interception.
+	Interception interception.State
+	// InterceptionError holds the error encountered while getting the state
+	// of the interception, if any.
+	InterceptionError string `json:",omitempty"`
+
+	// TrackedConnections is the amount of currently tracked connections.
+	TrackedConnections int
+	// MaxTrackedConnections is the maximum amount of tracked connections.
+	// Zero means no limit.
+	MaxTrackedConnections int64
+	// TrackingCapReached is set if new connections are not tracked, because
+	// the maximum amount of tracked connections is reached.
+	TrackingCapReached bool
+
+	// Stats holds the packet statistics of the current stat logging interval,
+	// as the packet counters are reset every 10 seconds.
+	Stats InterceptionStats
+	// Restart holds the state of restarts.
+	Restart RestartSnapshot
+}
+
+// InterceptionStats holds packet statistics of the firewall.
+type InterceptionStats struct {
+	PacketsAccepted    uint64
+	PacketsBlocked     uint64
+	PacketsDropped     uint64
+	PacketsFailed      uint64
+	VerdictApplyErrors uint64
+}
+
+// RestartSnapshot holds the state of restarts.
+type RestartSnapshot struct {
+	// Pending is set if a restart is scheduled.
+	Pending bool
+	// RestartAt is the time a pending restart is scheduled for.
+	RestartAt time.Time `json:",omitempty"`
+	// OnNextStart is set if a staged update is only applied on the next start.
+	OnNextStart bool
+	// Restarting is set if a restart was triggered.
+	Restarting bool
+	// Tasks holds the restart tasks that are pending or were triggered.
+	Tasks []updates.TaskInfo `json:",omitempty"`
+}
+
+// Snapshot returns the current configuration and state of the interception
+// and the firewall. Counters are copied atomically, so that taking a snapshot
+// does not block packet handling. If the state of the interception could not
+// be fully determined, the snapshot is still returned together with the error.
+func Snapshot() (InterceptionSnapshot, error) {
+	snapshot := InterceptionSnapshot{
+		Time:                  time.Now(),
+		TrackedConnections:    countTrackedConnections(),
+		MaxTrackedConnections: atomic.LoadInt64(maxTrackedConnections),
+		TrackingCapReached:    trackingCapReached.IsSet(),
+		Stats: InterceptionStats{
+			PacketsAccepted:    atomic.LoadUint64(packetsAccepted),
+			PacketsBlocked:     atomic.LoadUint64(packetsBlocked),
+			PacketsDropped:     atomic.LoadUint64(packetsDropped),
+			PacketsFailed:      atomic.LoadUint64(packetsFailed),
+			VerdictApplyErrors: atomic.LoadUint64(verdictApplyErrors),
+		},
+	}
+
+	snapshot.Restart.Pending, snapshot.Restart.RestartAt = updates.RestartIsPending()
+	snapshot.Restart.OnNextStart = updates.UpdatePendingOnNextStart()
+	snapshot.Restart.Restarting = updates.IsRestarting()
+	snapshot.Restart.Tasks = updates.PendingRestartTasks()
+
+	var err error
+	snapshot.Interception, err = interception.GetState()
+	if err != nil {
+		snapshot.InterceptionError = err.Error()
+	}
+
+	return snapshot, err
+}
@@ -0,0 +1,193 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/miekg/dns"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/firewall/inspection"
+	"github.com/safing/portmaster/firewall/inspection/l7"
+	"github.com/safing/portmaster/intel"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/portmaster/process"
+	"github.com/safing/portmaster/profile"
+	"github.com/safing/portmaster/profile/endpoints"
+)
+
+const (
+	// maxServerNamePackets defines how many packets are waited for until the
+	// TLS server name detection is given up.
+	maxServerNamePackets = 16
+
+	// maxServerNamePendingSegments defines how many segments that arrived
+	// out of order are held for reassembling the ClientHello.
+	maxServerNamePendingSegments = 8
+)
+
+// tlsServerNameDetection reassembles the start of the TCP stream of the
+// initiator of a TLS connection until the server name can be parsed from the
+// ClientHello.
+type tlsServerNameDetection struct {
+	stream  []byte
+	nextSeq uint32
+	packets int
+
+	// pending holds segments that arrived before a preceding segment, by
+	// sequence number.
+	pending map[uint32][]byte
+}
+
+// add adds a segment of the initiator's stream. It returns whether the
+// detection is done and the server name that was detected, if any.
+func (d *tlsServerNameDetection) add(seq uint32, payload []byte) (serverName string, done bool) {
+	if d.stream == nil {
+		d.nextSeq = seq
+	}
+
+	switch offset := int32(seq - d.nextSeq); {
+	case offset > 0:
+		// Hold segments that arrived out of order.
+		if len(d.pending) >= maxServerNamePendingSegments {
+			return "", true
+		}
+		if d.pending == nil {
+			d.pending = make(map[uint32][]byte)
+		}
+		d.pending[seq] = append([]byte(nil), payload...)
+		return "", false
+	case int(-offset) >= len(payload):
+		// Retransmission of data that was already added.
+		return "", false
+	default:
+		d.appendSegment(payload[-offset:])
+	}
+
+	// Add pending segments that continue the stream.
+	for len(d.pending) > 0 {
+		segment, ok := d.pending[d.nextSeq]
+		if !ok {
+			break
+		}
+		delete(d.pending, d.nextSeq)
+		d.appendSegment(segment)
+	}
+
+	serverName, err := l7.ParseTLSServerName(d.stream)
+	if errors.Is(err, l7.ErrIncomplete) && len(d.stream) < l7.MaxClientHelloLength {
+		return "", false
+	}
+	return serverName, true
+}
+
+func (d *tlsServerNameDetection) appendSegment(segment []byte) {
+	d.stream = append(d.stream, segment...)
+	d.nextSeq += uint32(len(segment))
+}
+
+// startTLSServerNameDetection starts detecting the server name of a TLS
+// connection with the packet that carries the start of the ClientHello.
+func startTLSServerNameDetection(conn *network.Connection, pkt packet.Packet) uint8 {
+	detection := &tlsServerNameDetection{}
+	conn.GetInspectorData()[protocolInspectorIndex] = detection
+	return detectTLSServerName(conn, pkt, detection)
+}
+
+// detectTLSServerName adds the payload of packets from the initiator to the
+// reassembled ClientHello and sets the server name on the connection, once it
+// was parsed.
+func detectTLSServerName(conn *network.Connection, pkt packet.Packet, detection *tlsServerNameDetection) uint8 {
+	detection.packets++
+	if detection.packets > maxServerNamePackets {
+		log.Tracer(pkt.Ctx()).Tracef("filter: gave up detecting TLS server name of %s", conn)
+		return inspection.STOP_INSPECTING
+	}
+
+	// Only the initiator sends the ClientHello.
+	payload := pkt.Payload()
+	if pkt.IsInbound() != conn.Inbound || len(payload) == 0 {
+		return inspection.DO_NOTHING
+	}
+
+	// The payload must be complete to be reassembled, which it is not if
+	// only the start of packets is copied by the interception.
+	seq, ok := packet.ParseTCPSequence(pkt.Raw())
+	if !ok || int(seq.Next-seq.Seq) != len(payload) {
+		log.Tracer(pkt.Ctx()).Tracef("filter: cannot detect TLS server name of %s: payload is incomplete", conn)
+		return inspection.STOP_INSPECTING
+	}
+
+	serverName, done := detection.add(seq.Seq, payload)
+	if !done {
+		return inspection.DO_NOTHING
+	}
+
+	if serverName != "" {
+		conn.SetTLSServerName(serverName)
+		conn.SaveWhenFinished()
+		log.Tracer(pkt.Ctx()).Debugf("filter: detected TLS server name %s of %s", serverName, conn)
+
+		// Check the rules again, now that the server name is known.
+		if !conn.Internal && recheckTLSServerName(pkt.Ctx(), conn, pkt) {
+			finalizeVerdict(conn)
+		}
+	}
+	return inspection.STOP_INSPECTING
+}
+
+// checkTLSServerName blocks outgoing TLS connections whose server name is
+// denied by the outgoing rules, as if it was the domain of the connection.
+// This also covers connections without a preceding DNS request, eg. when the
+// domain was resolved via DNS-over-HTTPS. As the server name is chosen by the
+// client, it can never permit a connection, but only deny it.
+func checkTLSServerName(ctx context.Context, conn *network.Connection, p *profile.LayeredProfile, _ packet.Packet) bool {
+	serverName := conn.TLSServerName()
+	if serverName == "" || conn.Inbound || p == nil || conn.Entity == nil {
+		return false
+	}
+
+	entity := &intel.Entity{
+		Protocol: conn.Entity.Protocol,
+		Port:     conn.Entity.Port,
+		Domain:   dns.Fqdn(serverName),
+	}
+	entity.SetIP(conn.Entity.IP)
+	entity.SetDstPort(conn.Entity.DstPort())
+
+	result, reason := p.MatchEndpoint(ctx, entity)
+	switch result { //nolint:exhaustive // Only denials are applied.
+	case endpoints.Denied, endpoints.MatchError:
+		conn.DenyWithContext(fmt.Sprintf("TLS server name %s: %s", serverName, reason), profile.CfgOptionEndpointsKey, reason.Context())
+		return true
+	}
+	return false
+}
+
+// recheckTLSServerName checks the server name of a connection whose verdict
+// was already decided and returns whether the connection was blocked.
+func recheckTLSServerName(ctx context.Context, conn *network.Connection, pkt packet.Packet) bool {
+	layeredProfile := decisionProfile(ctx, conn)
+	if layeredProfile == nil {
+		return false
+	}
+
+	layeredProfile.LockForUsage()
+	defer layeredProfile.UnlockForUsage()
+
+	return checkTLSServerName(ctx, conn, layeredProfile, pkt)
+}
+
+// decisionProfile returns the profile that the verdict of the connection was
+// decided with, which is the profile of a settings ancestor, if one was
+// applied.
+func decisionProfile(ctx context.Context, conn *network.Connection) *profile.LayeredProfile {
+	if conn.SettingsAncestorPID != 0 {
+		if ancestor, err := process.GetOrFindProcess(ctx, conn.SettingsAncestorPID); err == nil {
+			return ancestor.Profile()
+		}
+	}
+	return conn.Process().Profile()
+}
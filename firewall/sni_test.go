@@ -0,0 +1,158 @@
+package firewall
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/safing/portbase/config"
+
+	"github.com/safing/portmaster/firewall/inspection"
+	"github.com/safing/portmaster/firewall/inspection/l7"
+	"github.com/safing/portmaster/intel"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/portmaster/profile"
+)
+
+func TestDetectTLSServerName(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func(orig func() []string) { blockProtocols = orig }(blockProtocols)
+	blockProtocols = func() []string { return nil }
+
+	// Captured ClientHello of a crypto/tls client connecting to
+	// www.example.com, which is larger than a single segment.
+	clientHello, err := os.ReadFile("inspection/l7/testdata/clienthello.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localIP, remoteIP := net.IPv4(10, 0, 0, 1), net.IPv4(93, 184, 216, 34)
+	const isn = 0xfffffe00 // Wraps around during the ClientHello.
+	segment := func(offset, end int) packet.Packet {
+		return newTestTCPSegment(t, localIP, remoteIP, 40000, 443, isn+uint32(offset), 1, testTCPFlagACK|testTCPFlagPSH, clientHello[offset:end])
+	}
+	serverACK := func() packet.Packet {
+		pkt := newTestTCPSegment(t, remoteIP, localIP, 443, 40000, 1, isn, testTCPFlagACK, nil)
+		pkt.SetInbound()
+		return pkt
+	}
+
+	tests := []struct {
+		name    string
+		packets []packet.Packet
+	}{
+		{"in order", []packet.Packet{
+			segment(0, 1448),
+			serverACK(),
+			segment(1448, len(clientHello)),
+		}},
+		{"out of order", []packet.Packet{
+			segment(0, 600),
+			segment(1200, len(clientHello)),
+			segment(600, 1200),
+		}},
+		{"retransmitted", []packet.Packet{
+			segment(0, 600),
+			segment(0, 600),
+			segment(300, 1200),
+			segment(1200, len(clientHello)),
+		}},
+	}
+	for _, tt := range tests {
+		conn := &network.Connection{
+			IPProtocol: packet.TCP,
+			Entity:     &intel.Entity{IP: remoteIP, Port: 443},
+		}
+		conn.SetInspectorData(make(map[uint8]interface{}))
+
+		for i, pkt := range tt.packets {
+			action := inspectApplicationProtocol(conn, pkt)
+			last := i == len(tt.packets)-1
+			switch {
+			case last && action != inspection.STOP_INSPECTING:
+				t.Errorf("%s: inspection should have stopped after the last packet", tt.name)
+			case !last && action != inspection.DO_NOTHING:
+				t.Errorf("%s: inspection should have continued after packet %d, got action %d", tt.name, i, action)
+			}
+			if !last && conn.TLSServerName() != "" {
+				t.Errorf("%s: server name should not be set before the ClientHello is complete", tt.name)
+			}
+		}
+		if conn.DetectedProtocol() != string(l7.TLS) {
+			t.Errorf("%s: expected protocol tls, got %q", tt.name, conn.DetectedProtocol())
+		}
+		if conn.TLSServerName() != "www.example.com" {
+			t.Errorf("%s: unexpected server name %q", tt.name, conn.TLSServerName())
+		}
+	}
+}
+
+var (
+	endpointsOptionOnce sync.Once
+	endpointsOptionErr  error
+)
+
+// registerEndpointsOption registers the endpoints option of the profiles,
+// which is needed to parse the endpoints of a profile.
+func registerEndpointsOption(t *testing.T) {
+	t.Helper()
+
+	endpointsOptionOnce.Do(func() {
+		endpointsOptionErr = config.Register(&config.Option{
+			Name:         "Outgoing Rules",
+			Key:          profile.CfgOptionEndpointsKey,
+			Description:  "Outgoing rules for testing.",
+			OptType:      config.OptTypeStringArray,
+			DefaultValue: []string{},
+		})
+	})
+	if endpointsOptionErr != nil {
+		t.Fatal(endpointsOptionErr)
+	}
+}
+
+func TestCheckTLSServerName(t *testing.T) {
+	t.Parallel()
+	registerEndpointsOption(t)
+
+	ctx := context.Background()
+	layeredProfile := profile.NewLayeredProfile(profile.New(&profile.Profile{
+		ID:     "tls-server-name-test",
+		Source: profile.SourceLocal,
+		Config: map[string]interface{}{
+			profile.CfgOptionEndpointsKey: []string{"+ 192.0.2.1", "- blocked.example.com", "+ allowed.example.com"},
+		},
+	}))
+
+	tests := []struct {
+		name       string
+		serverName string
+		ip         net.IP
+		inbound    bool
+		blocked    bool
+	}{
+		{"denied", "blocked.example.com", net.IPv4(198, 51, 100, 1), false, true},
+		{"permitted", "allowed.example.com", net.IPv4(198, 51, 100, 1), false, false},
+		{"no match", "other.example.com", net.IPv4(198, 51, 100, 1), false, false},
+		{"ip rule first", "blocked.example.com", net.IPv4(192, 0, 2, 1), false, false},
+		{"no server name", "", net.IPv4(198, 51, 100, 1), false, false},
+		{"inbound", "blocked.example.com", net.IPv4(198, 51, 100, 1), true, false},
+	}
+	for _, tt := range tests {
+		conn := newSimulationTestConn("sni-"+tt.name, tt.ip)
+		conn.Inbound = tt.inbound
+		conn.SetTLSServerName(tt.serverName)
+
+		layeredProfile.LockForUsage()
+		blocked := checkTLSServerName(ctx, conn, layeredProfile, nil)
+		layeredProfile.UnlockForUsage()
+		if blocked != tt.blocked {
+			t.Errorf("%s: expected blocked=%t, got %t", tt.name, tt.blocked, blocked)
+		}
+		if blocked && conn.Verdict.Firewall != network.VerdictBlock {
+			t.Errorf("%s: expected block verdict, got %s", tt.name, conn.Verdict.Firewall.Verb())
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/safing/portbase/config"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/portmaster/process"
+	"github.com/safing/portmaster/profile"
+)
+
+// maxStateSnapshots defines how many frozen state snapshots can be held at
+// the same time.
+const maxStateSnapshots = 8
+
+// StateID identifies a frozen state snapshot.
+type StateID uint64
+
+// Errors of frozen state snapshots.
+var (
+	ErrTooManyStateSnapshots = errors.New("too many state snapshots, release one first")
+	ErrStateSnapshotNotFound = errors.New("state snapshot not found")
+	ErrStateSnapshotStale    = errors.New("global configuration changed since the state snapshot was taken")
+)
+
+var (
+	stateSnapshots     = make(map[StateID]*stateSnapshot)
+	stateSnapshotsLock sync.Mutex
+	lastStateID        StateID
+)
+
+// stateSnapshot holds the decision relevant state at a point in time.
+type stateSnapshot struct {
+	created time.Time
+
+	// configValidity is invalidated when the global configuration changes.
+	configValidity *config.ValidityFlag
+
+	// connections holds the tracked connections by ID.
+	connections map[string]*frozenConnection
+	// connectionIDs holds the IDs of the connections in sorted order, so
+	// that lookups are deterministic.
+	connectionIDs []string
+	// translatedIDs maps the translated IDs of translated connections to
+	// their connection IDs, see network.Connection.TranslatedID.
+	translatedIDs map[string]string
+	// processes holds the known processes and the version of their local
+	// profile, by PID.
+	processes map[int]*frozenProcess
+}
+
+type frozenConnection struct {
+	pid       int
+	inbound   bool
+	protocol  packet.IPProtocol
+	localIP   net.IP
+	localPort uint16
+	remoteIP  net.IP
+	domain    string
+	verdict   network.Verdict
+	reason    network.Reason
+	// translatedID is set for translated connections, see
+	// network.Connection.TranslatedID.
+	translatedID string
+}
+
+type frozenProcess struct {
+	process      *process.Process
+	localProfile *profile.Profile
+}
+
+// FreezeStateSnapshot records the decision relevant state, the tracked
+// connections and the profile versions of all known processes, for replaying
+// packets against it later with ReplayPacket. At most 8 snapshots can be held
+// at the same time, release them with ReleaseStateSnapshot when they are no
+// longer needed. The live state is not changed.
+func FreezeStateSnapshot() (StateID, error) {
+	stateSnapshotsLock.Lock()
+	defer stateSnapshotsLock.Unlock()
+
+	if len(stateSnapshots) >= maxStateSnapshots {
+		return 0, ErrTooManyStateSnapshots
+	}
+
+	snapshot := &stateSnapshot{
+		created:        time.Now(),
+		configValidity: config.NewValidityFlag(),
+		connections:    make(map[string]*frozenConnection),
+		translatedIDs:  make(map[string]string),
+		processes:      make(map[int]*frozenProcess),
+	}
+	for pid, proc := range process.All() {
+		if layeredProfile := proc.Profile(); layeredProfile != nil {
+			snapshot.processes[pid] = &frozenProcess{
+				process:      proc,
+				localProfile: layeredProfile.LocalProfile(),
+			}
+		}
+	}
+	for _, conn := range network.GetAllConnections() {
+		if frozen := freezeConnection(conn); frozen != nil {
+			snapshot.connections[conn.ID] = frozen
+			if frozen.translatedID != "" {
+				snapshot.translatedIDs[frozen.translatedID] = conn.ID
+			}
+		}
+	}
+	snapshot.sortConnectionIDs()
+
+	lastStateID++
+	stateSnapshots[lastStateID] = snapshot
+	return lastStateID, nil
+}
+
+func freezeConnection(conn *network.Connection) *frozenConnection {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if conn.Type != network.IPConnection || conn.Entity == nil {
+		return nil
+	}
+
+	return &frozenConnection{
+		pid:       conn.ProcessContext.PID,
+		inbound:   conn.Inbound,
+		protocol:  conn.IPProtocol,
+		localIP:   conn.LocalIP,
+		localPort: conn.LocalPort,
+		remoteIP:  conn.Entity.IP,
+		domain:    conn.Entity.Domain,
+		verdict:   conn.Verdict.Firewall,
+		reason:    conn.Reason,
+
+		translatedID: conn.TranslatedID(),
+	}
+}
+
+func (snapshot *stateSnapshot) sortConnectionIDs() {
+	snapshot.connectionIDs = make([]string, 0, len(snapshot.connections))
+	for id := range snapshot.connections {
+		snapshot.connectionIDs = append(snapshot.connectionIDs, id)
+	}
+	sort.Strings(snapshot.connectionIDs)
+}
+
+// ReleaseStateSnapshot releases the state snapshot with the given ID.
+func ReleaseStateSnapshot(stateID StateID) {
+	stateSnapshotsLock.Lock()
+	defer stateSnapshotsLock.Unlock()
+
+	delete(stateSnapshots, stateID)
+}
+
+// ReplayPacket returns the verdict that the firewall would have issued for
+// the given raw IP packet at the time of the state snapshot. If the packet
+// belongs to a connection that was tracked at that time, the verdict of that
+// connection is returned. Otherwise the packet is evaluated as the first
+// packet of a new connection of the process that owns the local address of
+// the packet, using the profile version of the snapshot. The evaluation has
+// no side effects, see SimulateVerdict. If the user would be prompted, the
+// verdict is network.VerdictUndecided.
+// Global settings and filter lists are not part of the snapshot: If the
+// global configuration changed since the snapshot was taken,
+// ErrStateSnapshotStale is returned.
+func ReplayPacket(stateID StateID, pkt []byte) (network.Verdict, network.Reason, error) {
+	stateSnapshotsLock.Lock()
+	snapshot, ok := stateSnapshots[stateID]
+	stateSnapshotsLock.Unlock()
+	if !ok {
+		return network.VerdictUndecided, network.Reason{}, ErrStateSnapshotNotFound
+	}
+	if !snapshot.configValidity.IsValid() {
+		return network.VerdictUndecided, network.Reason{}, ErrStateSnapshotStale
+	}
+
+	tracked, conn, proc, err := snapshot.replayConnection(pkt)
+	switch {
+	case err != nil:
+		return network.VerdictUndecided, network.Reason{}, err
+	case tracked != nil:
+		return tracked.verdict, tracked.reason, nil
+	}
+
+	// Evaluate with the profile version of the snapshot.
+	ctx := context.Background()
+	layeredProfile := profile.NewDetachedLayeredProfile(proc.localProfile)
+	conn.Entity.ResolveSubDomainLists(ctx, layeredProfile.FilterSubDomains())
+	conn.Entity.EnableCNAMECheck(ctx, layeredProfile.FilterCNAMEs())
+	conn.Entity.LoadLists(ctx)
+
+	verdict, reason := simulateVerdict(ctx, conn, layeredProfile, defaultDeciders)
+	return verdict, reason, nil
+}
+
+// connection returns the tracked connection with the given connection ID or
+// translated ID. The packets of translated connections carry the translated
+// addresses, from which the translated ID is derived.
+func (snapshot *stateSnapshot) connection(id string) (*frozenConnection, bool) {
+	if tracked, ok := snapshot.connections[id]; ok {
+		return tracked, true
+	}
+	if connID, ok := snapshot.translatedIDs[id]; ok {
+		tracked, ok := snapshot.connections[connID]
+		return tracked, ok
+	}
+	return nil, false
+}
+
+// replayConnection returns the tracked connection of the given raw packet.
+// If the packet does not belong to a tracked connection, a new simulated
+// connection and the process owning the local address are returned instead.
+func (snapshot *stateSnapshot) replayConnection(data []byte) (tracked *frozenConnection, conn *network.Connection, proc *frozenProcess, err error) {
+	base := &packet.Base{}
+	if err := packet.Parse(data, base); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to parse packet: %w", err)
+	}
+	info := base.Info()
+
+	// Check if the packet belongs to a tracked connection.
+	outboundID, inboundID := (&packet.ConntrackTuple{
+		Protocol: info.Protocol,
+		Src:      info.Src,
+		SrcPort:  info.SrcPort,
+		Dst:      info.Dst,
+		DstPort:  info.DstPort,
+	}).ConnectionIDs()
+	if tracked, ok := snapshot.connection(outboundID); ok && !tracked.inbound {
+		return tracked, nil, nil, nil
+	}
+	if tracked, ok := snapshot.connection(inboundID); ok && tracked.inbound {
+		return tracked, nil, nil, nil
+	}
+
+	// Find the process by the local address.
+	spec := network.ConnSpec{
+		Protocol:   info.Protocol,
+		LocalIP:    info.Src,
+		LocalPort:  info.SrcPort,
+		RemoteIP:   info.Dst,
+		RemotePort: info.DstPort,
+	}
+	pid, ok := snapshot.findLocalAddressOwner(spec.Protocol, spec.LocalIP, spec.LocalPort)
+	if !ok {
+		spec = network.ConnSpec{
+			Inbound:    true,
+			Protocol:   info.Protocol,
+			LocalIP:    info.Dst,
+			LocalPort:  info.DstPort,
+			RemoteIP:   info.Src,
+			RemotePort: info.SrcPort,
+		}
+		pid, ok = snapshot.findLocalAddressOwner(spec.Protocol, spec.LocalIP, spec.LocalPort)
+	}
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("no process owns the local address of %s in the state snapshot", base)
+	}
+	proc, ok = snapshot.processes[pid]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("process %d is not in the state snapshot", pid)
+	}
+	spec.PID = pid
+	spec.Domain = snapshot.findDomain(pid, spec.RemoteIP)
+
+	conn, err = network.NewSimulatedConnectionForProcess(spec, proc.process)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return nil, conn, proc, nil
+}
+
+// findLocalAddressOwner returns the PID of the process that had a connection
+// from the given local address.
+func (snapshot *stateSnapshot) findLocalAddressOwner(protocol packet.IPProtocol, localIP net.IP, localPort uint16) (pid int, ok bool) {
+	for _, id := range snapshot.connectionIDs {
+		conn := snapshot.connections[id]
+		if conn.protocol == protocol &&
+			conn.localPort == localPort &&
+			(conn.localIP.Equal(localIP) || conn.localIP.IsUnspecified()) {
+			return conn.pid, true
+		}
+	}
+	return 0, false
+}
+
+// findDomain returns the domain that the process resolved the remote IP
+// from, according to its connections.
+func (snapshot *stateSnapshot) findDomain(pid int, remoteIP net.IP) string {
+	for _, id := range snapshot.connectionIDs {
+		conn := snapshot.connections[id]
+		if conn.pid == pid && conn.domain != "" && conn.remoteIP.Equal(remoteIP) {
+			return conn.domain
+		}
+	}
+	return ""
+}
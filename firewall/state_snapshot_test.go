@@ -0,0 +1,143 @@
+package firewall
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/portmaster/process"
+	"github.com/safing/portmaster/profile"
+)
+
+func TestStateSnapshotReplay(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx       = context.Background()
+		localIP   = net.IPv4(192, 168, 1, 2)
+		trackedIP = net.IPv4(192, 0, 2, 1)
+		allowedIP = net.IPv4(198, 51, 100, 1)
+		otherIP   = net.IPv4(203, 0, 113, 1)
+	)
+	deciders := []deciderFn{
+		func(_ context.Context, conn *network.Connection, _ *profile.LayeredProfile, _ packet.Packet) bool {
+			if conn.Entity.IP.Equal(allowedIP) {
+				conn.Accept("allowed test net", noReasonOptionKey)
+				return true
+			}
+			return false
+		},
+		func(_ context.Context, conn *network.Connection, _ *profile.LayeredProfile, _ packet.Packet) bool {
+			conn.Block("blocked test net", noReasonOptionKey)
+			return true
+		},
+	}
+
+	snapshot := &stateSnapshot{
+		connections: map[string]*frozenConnection{
+			"6-192.168.1.2-40000-192.0.2.1-443": {
+				pid:       100,
+				protocol:  packet.TCP,
+				localIP:   localIP,
+				localPort: 40000,
+				remoteIP:  trackedIP,
+				verdict:   network.VerdictBlock,
+				reason:    network.Reason{Msg: "frozen verdict"},
+			},
+			// An inbound connection to port 80 that is redirected to port 8080.
+			"6-192.168.1.2-80-203.0.113.1-50000": {
+				pid:          100,
+				inbound:      true,
+				protocol:     packet.TCP,
+				localIP:      localIP,
+				localPort:    8080,
+				remoteIP:     otherIP,
+				verdict:      network.VerdictAccept,
+				reason:       network.Reason{Msg: "frozen redirected verdict"},
+				translatedID: "6-192.168.1.2-8080-203.0.113.1-50000",
+			},
+		},
+		translatedIDs: map[string]string{
+			"6-192.168.1.2-8080-203.0.113.1-50000": "6-192.168.1.2-80-203.0.113.1-50000",
+		},
+		processes: map[int]*frozenProcess{
+			100: {
+				process: &process.Process{Pid: 100, Name: "replay"},
+				localProfile: profile.New(&profile.Profile{
+					ID:     "state-snapshot-replay-test",
+					Source: profile.SourceLocal,
+				}),
+			},
+		},
+	}
+	snapshot.sortConnectionIDs()
+
+	tests := []struct {
+		name    string
+		pkt     []byte
+		verdict network.Verdict
+		reason  string
+	}{
+		{"tracked connection", buildTestTCPPacket(t, localIP, trackedIP, 40000, 443, 0, 0, testTCPFlagSYN, nil), network.VerdictBlock, "frozen verdict"},
+		{"new connection allowed", buildTestTCPPacket(t, localIP, allowedIP, 40000, 443, 0, 0, testTCPFlagSYN, nil), network.VerdictAccept, "allowed test net"},
+		{"new connection blocked", buildTestTCPPacket(t, localIP, otherIP, 40000, 443, 0, 0, testTCPFlagSYN, nil), network.VerdictBlock, "blocked test net"},
+		{"new inbound connection", buildTestTCPPacket(t, otherIP, localIP, 50000, 40000, 0, 0, testTCPFlagSYN, nil), network.VerdictBlock, "blocked test net"},
+		{"redirected connection", buildTestTCPPacket(t, otherIP, localIP, 50000, 8080, 0, 0, testTCPFlagSYN, nil), network.VerdictAccept, "frozen redirected verdict"},
+	}
+	for _, tt := range tests {
+		tracked, conn, proc, err := snapshot.replayConnection(tt.pkt)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		var verdict network.Verdict
+		var reason network.Reason
+		if tracked != nil {
+			verdict, reason = tracked.verdict, tracked.reason
+		} else {
+			verdict, reason = simulateVerdict(ctx, conn, profile.NewDetachedLayeredProfile(proc.localProfile), deciders)
+		}
+		if verdict != tt.verdict {
+			t.Errorf("%s: expected verdict %s, got %s", tt.name, tt.verdict.Verb(), verdict.Verb())
+		}
+		if reason.Msg != tt.reason {
+			t.Errorf("%s: expected reason %q, got %q", tt.name, tt.reason, reason.Msg)
+		}
+	}
+
+	// Packets without a known local address owner cannot be replayed.
+	if _, _, _, err := snapshot.replayConnection(buildTestTCPPacket(t, localIP, otherIP, 40001, 443, 0, 0, testTCPFlagSYN, nil)); err == nil {
+		t.Error("replaying a packet of an unknown process should fail")
+	}
+}
+
+//nolint:paralleltest // Modifies global state.
+func TestStateSnapshotLimit(t *testing.T) {
+	var ids []StateID
+	for i := 0; i < maxStateSnapshots; i++ {
+		id, err := FreezeStateSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if _, err := FreezeStateSnapshot(); err == nil {
+		t.Error("freezing more than the maximum snapshots should fail")
+	}
+
+	ReleaseStateSnapshot(ids[0])
+	if _, _, err := ReplayPacket(ids[0], nil); err == nil {
+		t.Error("replaying against a released snapshot should fail")
+	}
+	id, err := FreezeStateSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids = append(ids[1:], id)
+
+	for _, id := range ids {
+		ReleaseStateSnapshot(id)
+	}
+}
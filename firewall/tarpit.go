@@ -0,0 +1,217 @@
+package firewall
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+const (
+	// tarpitWindow is the receive window that is advertised to tarpitted
+	// connections when answering their SYN. The peer may only send this many
+	// bytes before the window is closed.
+	tarpitWindow = 10
+	// tarpitMaxConnections is the maximum amount of concurrently tarpitted
+	// connections.
+	tarpitMaxConnections = 256
+	// tarpitIdleTimeout defines after how long without packets a tarpitted
+	// connection is released.
+	tarpitIdleTimeout = 10 * time.Minute
+)
+
+// ErrTarpitFull is returned by TarpitConnection if the maximum amount of
+// connections is tarpitted already.
+var ErrTarpitFull = errors.New("too many tarpitted connections")
+
+// TarpitConnection holds the given inbound TCP connection open without ever
+// letting it reach the local host, in order to slow down port scanners and
+// brute-forcers. All packets of the connection are dropped and answered with
+// forged segments instead: A SYN is answered with a SYN-ACK that advertises a
+// tiny receive window, and all further segments with ACKs that advertise a
+// zero window. The peer thus sees an open port, sends at most a few bytes and
+// then keeps probing the closed window, which most TCP stacks do without ever
+// timing out. Only connections whose SYN arrives after they are tarpitted are
+// answered, which includes retransmissions of a dropped SYN. The connection
+// must not be locked.
+//
+// Tarpitting widens the attack surface: Every tarpitted packet is answered, so
+// that scanners could make the Portmaster send segments to spoofed sources in
+// the rate they send packets. The answers also reveal the host to scanners,
+// instead of hiding it, and the fixed window makes the tarpit easy to
+// fingerprint. Therefore, at most 256 connections are tarpitted at the
+// same time, further connections are rejected with ErrTarpitFull and should be
+// dropped instead, and connections are released after 10 minutes without
+// packets.
+func TarpitConnection(conn *network.Connection) error {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if conn.Type != network.IPConnection || conn.IPProtocol != packet.TCP || !conn.Inbound {
+		return errors.New("only inbound TCP connections can be tarpitted")
+	}
+	if err := connectionTarpit.add(conn.ID, time.Now()); err != nil {
+		return err
+	}
+
+	err := tarpitConnection(conn)
+	conn.Save()
+	log.Infof("filter: tarpitting connection %s", conn)
+	return err
+}
+
+// tarpitConnection drops the packets of the tarpitted connection. The
+// connection must be locked.
+func tarpitConnection(conn *network.Connection) error {
+	conn.SetVerdict(network.VerdictDrop, "connection is tarpitted", "", nil)
+	conn.Verdict.Active = network.VerdictDrop
+	conn.Verdict.Worst = network.VerdictDrop
+	// Packets must keep reaching the firewall in order to be answered.
+	conn.VerdictPermanent = false
+
+	if err := resetVerdictOfConnection(connectionInfo(conn)); err != nil {
+		return fmt.Errorf("failed to reset verdict: %w", err)
+	}
+	return nil
+}
+
+// connectionTarpit holds the tarpitted connections.
+var connectionTarpit = newTarpit(tarpitMaxConnections, tarpitIdleTimeout)
+
+// tarpit tracks the state of the tarpitted connections.
+type tarpit struct {
+	lock sync.Mutex
+
+	conns       map[string]*tarpittedConnection
+	maxConns    int
+	idleTimeout time.Duration
+}
+
+// tarpittedConnection holds the state of a tarpitted connection.
+type tarpittedConnection struct {
+	// isn is the initial sequence number of the forged segments.
+	isn uint32
+	// ackLimit is the highest sequence number of the peer that is
+	// acknowledged, which is the end of the advertised window. It is set once
+	// the SYN was answered.
+	ackLimit    uint32
+	synAnswered bool
+	lastSeen    time.Time
+}
+
+func newTarpit(maxConns int, idleTimeout time.Duration) *tarpit {
+	return &tarpit{
+		conns:       make(map[string]*tarpittedConnection),
+		maxConns:    maxConns,
+		idleTimeout: idleTimeout,
+	}
+}
+
+// add starts tarpitting the connection with the given ID. Idle connections
+// are released first, if the maximum amount of connections is reached.
+func (tp *tarpit) add(connKey string, now time.Time) error {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+
+	if _, ok := tp.conns[connKey]; ok {
+		return nil
+	}
+	if len(tp.conns) >= tp.maxConns {
+		for id, tc := range tp.conns {
+			if now.Sub(tc.lastSeen) > tp.idleTimeout {
+				delete(tp.conns, id)
+			}
+		}
+		if len(tp.conns) >= tp.maxConns {
+			return ErrTarpitFull
+		}
+	}
+
+	var isn [4]byte
+	if _, err := rand.Read(isn[:]); err != nil {
+		return fmt.Errorf("failed to generate initial sequence number: %w", err)
+	}
+	tp.conns[connKey] = &tarpittedConnection{
+		isn:      binary.BigEndian.Uint32(isn[:]),
+		lastSeen: now,
+	}
+	return nil
+}
+
+// remove stops tarpitting the connection with the given ID.
+func (tp *tarpit) remove(connKey string) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+
+	delete(tp.conns, connKey)
+}
+
+// answer returns the forged segment that answers the given inbound segment of
+// the connection with the given ID and whether the connection is tarpitted.
+// No answer is returned for resets, segments that are not understood and
+// segments of connections whose SYN was not answered.
+func (tp *tarpit) answer(connKey string, info *packet.Info, data []byte, now time.Time) (answer []byte, tarpitted bool, err error) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+
+	tc, ok := tp.conns[connKey]
+	if !ok {
+		return nil, false, nil
+	}
+	if now.Sub(tc.lastSeen) > tp.idleTimeout {
+		delete(tp.conns, connKey)
+		return nil, false, nil
+	}
+	tc.lastSeen = now
+
+	seq, ok := packet.ParseTCPSequence(data)
+	switch {
+	case !ok || seq.Reset || info.Protocol != packet.TCP:
+		return nil, true, nil
+
+	case seq.Syn && !seq.HasAck:
+		// Answer the SYN, and any retransmissions of it, with a tiny window.
+		tc.ackLimit = seq.Next + tarpitWindow
+		tc.synAnswered = true
+		answer, err = packet.ForgeTCPSynAck(info.Dst, info.DstPort, info.Src, info.SrcPort, tc.isn, seq.Next, tarpitWindow)
+		return answer, true, err
+
+	case !tc.synAnswered:
+		return nil, true, nil
+
+	default:
+		// Acknowledge the data within the window and close it.
+		ack := seq.Next
+		if int32(ack-tc.ackLimit) > 0 {
+			ack = tc.ackLimit
+		}
+		answer, err = packet.ForgeTCPZeroWindowAck(info.Dst, info.DstPort, info.Src, info.SrcPort, tc.isn+1, ack)
+		return answer, true, err
+	}
+}
+
+// answerTarpittedPacket answers the packet, if its connection is tarpitted,
+// and returns whether it is. Packets of tarpitted connections must be
+// dropped.
+func answerTarpittedPacket(conn *network.Connection, pkt packet.Packet) (tarpitted bool) {
+	if !pkt.IsInbound() {
+		return false
+	}
+
+	answer, tarpitted, err := connectionTarpit.answer(conn.ID, pkt.Info(), pkt.Raw(), time.Now())
+	if err != nil {
+		log.Tracer(pkt.Ctx()).Warningf("filter: failed to forge answer to tarpitted packet %s: %s", pkt, err)
+	}
+	if answer != nil {
+		if err := injectPacket(answer); err != nil {
+			log.Tracer(pkt.Ctx()).Warningf("filter: failed to answer tarpitted packet %s: %s", pkt, err)
+		}
+	}
+	return tarpitted
+}
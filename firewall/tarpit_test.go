@@ -0,0 +1,172 @@
+package firewall
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/safing/portmaster/intel"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+func decodeTestTCP(t *testing.T, data []byte) *layers.TCP {
+	t.Helper()
+
+	tcp, ok := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default).Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		t.Fatal("answer is not a TCP packet")
+	}
+	return tcp
+}
+
+func TestTarpitAnswers(t *testing.T) {
+	t.Parallel()
+
+	localIP, remoteIP := net.IPv4(10, 0, 0, 1), net.IPv4(192, 0, 2, 1)
+	now := time.Now()
+	tp := newTarpit(10, time.Minute)
+	if err := tp.add("scan", now); err != nil {
+		t.Fatal(err)
+	}
+	isn := tp.conns["scan"].isn
+
+	// Segments before the SYN are dropped without an answer.
+	data := newTestTCPPacket(t, remoteIP, localIP, 50000, 22, 5001, 1, 0)
+	data.SetInbound()
+	answer, tarpitted, err := tp.answer("scan", data.Info(), data.Raw(), now)
+	if err != nil || !tarpitted || answer != nil {
+		t.Errorf("segment before SYN should be dropped silently, got %v %v %v", answer, tarpitted, err)
+	}
+
+	// The SYN is answered with a tiny window.
+	syn := newTestTCPSegment(t, remoteIP, localIP, 50000, 22, 5000, 0, testTCPFlagSYN, nil)
+	syn.SetInbound()
+	answer, tarpitted, err = tp.answer("scan", syn.Info(), syn.Raw(), now)
+	if err != nil || !tarpitted {
+		t.Fatalf("SYN should be tarpitted: %v %v", tarpitted, err)
+	}
+	tcp := decodeTestTCP(t, answer)
+	if !tcp.SYN || !tcp.ACK || tcp.Seq != isn || tcp.Ack != 5001 || tcp.Window != tarpitWindow ||
+		tcp.SrcPort != 22 || tcp.DstPort != 50000 {
+		t.Errorf("unexpected SYN-ACK %+v", tcp)
+	}
+
+	// Data is acknowledged up to the window, which is closed.
+	data = newTestTCPPacket(t, remoteIP, localIP, 50000, 22, 5001, isn+1, 100)
+	data.SetInbound()
+	answer, _, err = tp.answer("scan", data.Info(), data.Raw(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp = decodeTestTCP(t, answer)
+	if tcp.SYN || !tcp.ACK || tcp.Seq != isn+1 || tcp.Ack != 5001+tarpitWindow || tcp.Window != 0 {
+		t.Errorf("unexpected zero window ACK %+v", tcp)
+	}
+
+	// Window probes are answered with a closed window.
+	probe := newTestTCPPacket(t, remoteIP, localIP, 50000, 22, 5001+tarpitWindow, isn+1, 1)
+	probe.SetInbound()
+	answer, _, _ = tp.answer("scan", probe.Info(), probe.Raw(), now.Add(time.Second))
+	if tcp := decodeTestTCP(t, answer); tcp.Window != 0 || tcp.Ack != 5001+tarpitWindow {
+		t.Errorf("unexpected answer to window probe %+v", tcp)
+	}
+
+	// Other and idle connections are not tarpitted.
+	if _, tarpitted, _ := tp.answer("other", syn.Info(), syn.Raw(), now); tarpitted {
+		t.Error("other connection must not be tarpitted")
+	}
+	if _, tarpitted, _ := tp.answer("scan", syn.Info(), syn.Raw(), now.Add(time.Hour)); tarpitted {
+		t.Error("idle connection should be released")
+	}
+}
+
+func TestTarpitBounded(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	tp := newTarpit(2, time.Minute)
+	for _, id := range []string{"a", "b", "a"} {
+		if err := tp.add(id, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tp.add("c", now); !errors.Is(err, ErrTarpitFull) {
+		t.Errorf("expected tarpit to be full, got %v", err)
+	}
+
+	// Idle connections make room.
+	if err := tp.add("c", now.Add(2*time.Minute)); err != nil {
+		t.Errorf("idle connections should be released for new ones: %s", err)
+	}
+	tp.remove("c")
+	if len(tp.conns) != 0 {
+		t.Errorf("unexpected tarpitted connections %v", tp.conns)
+	}
+}
+
+func TestTarpitConnection(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	var injected [][]byte
+	defer func(orig func([]byte) error) { injectPacket = orig }(injectPacket)
+	defer func(orig func(*packet.Info) error) { resetVerdictOfConnection = orig }(resetVerdictOfConnection)
+	defer func(orig *tarpit) { connectionTarpit = orig }(connectionTarpit)
+	injectPacket = func(data []byte) error {
+		injected = append(injected, data)
+		return nil
+	}
+	resetVerdictOfConnection = func(*packet.Info) error { return nil }
+	connectionTarpit = newTarpit(10, time.Minute)
+
+	localIP, remoteIP := net.IPv4(10, 0, 0, 1), net.IPv4(192, 0, 2, 1)
+	conn := &network.Connection{
+		ID:         "scan",
+		Type:       network.IPConnection,
+		Inbound:    true,
+		IPVersion:  packet.IPv4,
+		IPProtocol: packet.TCP,
+		LocalIP:    localIP,
+		LocalPort:  22,
+		Entity:     &intel.Entity{IP: remoteIP, Port: 50000},
+	}
+	conn.Verdict.Firewall = network.VerdictAccept
+	conn.Verdict.Active = network.VerdictAccept
+
+	if err := connectionTarpit.add(conn.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tarpitConnection(conn); err != nil {
+		t.Fatal(err)
+	}
+	if conn.Verdict.Active != network.VerdictDrop || conn.VerdictPermanent {
+		t.Errorf("tarpitted connection should be dropped temporarily, got %s", conn.Verdict.Active)
+	}
+
+	// Retransmitted SYNs are dropped and answered, without a permanent verdict.
+	syn := newTestTCPSegment(t, remoteIP, localIP, 50000, 22, 5000, 0, testTCPFlagSYN, nil)
+	syn.SetInbound()
+	if err := issueVerdict(conn, syn, 0, true); err != nil {
+		t.Fatal(err)
+	}
+	if syn.applied != 1 || conn.VerdictPermanent {
+		t.Errorf("SYN should have been dropped temporarily")
+	}
+	if len(injected) != 1 || !decodeTestTCP(t, injected[0]).SYN {
+		t.Errorf("SYN should have been answered with a SYN-ACK, got %d packets", len(injected))
+	}
+
+	// Closed connections are released.
+	handleConnectionClosed("scan")
+	if _, ok := connectionTarpit.conns["scan"]; ok {
+		t.Error("closed connection should not be tarpitted anymore")
+	}
+
+	// Only inbound TCP connections can be tarpitted.
+	conn.Inbound = false
+	if err := TarpitConnection(conn); err == nil {
+		t.Error("outbound connection must not be tarpitted")
+	}
+}
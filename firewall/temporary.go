@@ -0,0 +1,218 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/safing/portbase/api"
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network"
+)
+
+// TemporaryVerdict describes the temporary verdict of a connection.
+type TemporaryVerdict struct {
+	// ConnectionID is the ID of the connection.
+	ConnectionID string
+	// Verdict is the current firewall verdict of the connection.
+	Verdict network.Verdict
+	// Expires holds the number of seconds in UNIX epoch time at which the
+	// temporary verdict expires. It is 0 if the verdict is not temporary.
+	Expires int64
+	// Remaining is the remaining time in seconds until the temporary verdict
+	// expires.
+	Remaining int64
+}
+
+// AllowTemporarily accepts the connection for the given time, regardless of
+// the rules. When the time is up, the verdict of the connection is re-evaluated
+// by the connection cleaner of the network package, so it may only be reverted
+// a few seconds later. The expiry time is recorded in the verdict history of
+// the connection. A temporary verdict is never made permanent in the system
+// integration and its verdict is kept when the rules change.
+func AllowTemporarily(conn *network.Connection, ttl time.Duration) error {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if err := allowTemporarily(conn, ttl, time.Now()); err != nil {
+		return err
+	}
+	conn.Save()
+	log.Infof("filter: allowed connection %s temporarily for %s", conn, ttl)
+	return nil
+}
+
+// allowTemporarily accepts the connection until the given time plus the ttl.
+// The connection must be locked.
+func allowTemporarily(conn *network.Connection, ttl time.Duration, now time.Time) error {
+	switch {
+	case ttl < time.Second:
+		return errors.New("connections must be allowed for at least a second")
+	case conn.Type != network.IPConnection:
+		return errors.New("only IP connections can be allowed temporarily")
+	case conn.Killed:
+		return errors.New("killed connections cannot be allowed")
+	}
+
+	// Set the expiry before the verdict, so that it is recorded with it.
+	conn.VerdictExpires = now.Add(ttl).Unix()
+	conn.SetVerdict(network.VerdictAccept, fmt.Sprintf("allowed temporarily for %s", ttl), "", nil)
+	finalizeVerdict(conn)
+
+	// Reset a permanent verdict in the system integration, so that the
+	// packets of the connection reach the firewall again.
+	if conn.VerdictPermanent {
+		conn.VerdictPermanent = false
+		if err := resetVerdictOfConnection(connectionInfo(conn)); err != nil {
+			return fmt.Errorf("failed to reset verdict: %w", err)
+		}
+	}
+	return nil
+}
+
+// ResetTemporaryVerdict ends the temporary verdict of the connection before it
+// expires and re-evaluates its verdict.
+func ResetTemporaryVerdict(conn *network.Connection) error {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if conn.VerdictExpires == 0 {
+		return errors.New("connection does not have a temporary verdict")
+	}
+	expireTemporaryVerdict(conn)
+	return nil
+}
+
+// expireTemporaryVerdict is called by the network package for connections
+// whose temporary verdict expired. The connection is locked.
+func expireTemporaryVerdict(conn *network.Connection) {
+	// Save the connection also if the verdict did not change, as the
+	// temporary verdict ended.
+	if !resetTemporaryVerdict(conn, reEvaluateConnection) {
+		conn.Save()
+	}
+}
+
+// resetTemporaryVerdict ends the temporary verdict of the connection and
+// re-evaluates its verdict. It returns whether the verdict changed, in which
+// case the connection was saved. The connection must be locked.
+func resetTemporaryVerdict(conn *network.Connection, reEvaluate func(context.Context, *network.Connection) bool) (changed bool) {
+	ctx, tracer := log.AddTracer(context.Background())
+	defer tracer.Submit()
+
+	tracer.Infof("filter: ending temporary verdict of %s", conn)
+	conn.VerdictExpires = 0
+	// Reset the active verdict, so that the connection can be blocked again.
+	conn.Verdict.Active = network.VerdictUndecided
+	return reEvaluate(ctx, conn)
+}
+
+// getTemporaryVerdict returns the temporary verdict of the connection. The
+// connection must be locked.
+func getTemporaryVerdict(conn *network.Connection, now time.Time) *TemporaryVerdict {
+	return &TemporaryVerdict{
+		ConnectionID: conn.ID,
+		Verdict:      conn.Verdict.Firewall,
+		Expires:      conn.VerdictExpires,
+		Remaining:    int64(conn.VerdictRemaining(now) / time.Second),
+	}
+}
+
+func registerTemporaryVerdictAPIEndpoints() error {
+	connectionParameter := api.Parameter{
+		Method:      http.MethodGet,
+		Field:       "id",
+		Value:       "<Connection ID>",
+		Description: "Specify the ID of the connection.",
+	}
+
+	if err := api.RegisterEndpoint(api.Endpoint{
+		Path:      "connection/temporary-verdict",
+		Read:      api.PermitUser,
+		BelongsTo: interceptionModule,
+		StructFunc: func(ar *api.Request) (i interface{}, err error) {
+			conn, err := getConnectionOfRequest(ar)
+			if err != nil {
+				return nil, err
+			}
+
+			conn.Lock()
+			defer conn.Unlock()
+
+			return getTemporaryVerdict(conn, time.Now()), nil
+		},
+		Name:        "Get Temporary Verdict",
+		Description: "Returns the temporary verdict of a connection and the remaining time until it expires.",
+		Parameters:  []api.Parameter{connectionParameter},
+	}); err != nil {
+		return err
+	}
+
+	if err := api.RegisterEndpoint(api.Endpoint{
+		Path:      "connection/allow-temporarily",
+		Write:     api.PermitUser,
+		BelongsTo: interceptionModule,
+		ActionFunc: func(ar *api.Request) (msg string, err error) {
+			conn, err := getConnectionOfRequest(ar)
+			if err != nil {
+				return "", err
+			}
+			ttl, err := time.ParseDuration(ar.Request.URL.Query().Get("ttl"))
+			if err != nil {
+				return "", fmt.Errorf("invalid ttl: %w", err)
+			}
+
+			if err := AllowTemporarily(conn, ttl); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("allowed connection for %s", ttl), nil
+		},
+		Name:        "Allow Connection Temporarily",
+		Description: "Accepts a connection for the given time, after which its verdict is re-evaluated.",
+		Parameters: []api.Parameter{
+			connectionParameter,
+			{
+				Method:      http.MethodGet,
+				Field:       "ttl",
+				Value:       "<Duration>",
+				Description: "Specify for how long the connection is allowed, eg. 10m.",
+			},
+		},
+	}); err != nil {
+		return err
+	}
+
+	return api.RegisterEndpoint(api.Endpoint{
+		Path:      "connection/reset-temporary-verdict",
+		Write:     api.PermitUser,
+		BelongsTo: interceptionModule,
+		ActionFunc: func(ar *api.Request) (msg string, err error) {
+			conn, err := getConnectionOfRequest(ar)
+			if err != nil {
+				return "", err
+			}
+
+			if err := ResetTemporaryVerdict(conn); err != nil {
+				return "", err
+			}
+			return "reset temporary verdict", nil
+		},
+		Name:        "Reset Temporary Verdict",
+		Description: "Ends the temporary verdict of a connection before it expires and re-evaluates its verdict.",
+		Parameters:  []api.Parameter{connectionParameter},
+	})
+}
+
+func getConnectionOfRequest(ar *api.Request) (*network.Connection, error) {
+	id := ar.Request.URL.Query().Get("id")
+	if id == "" {
+		return nil, errors.New("no connection ID specified")
+	}
+	conn, ok := network.GetConnection(id)
+	if !ok {
+		return nil, errors.New("connection not found")
+	}
+	return conn, nil
+}
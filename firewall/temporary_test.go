@@ -0,0 +1,82 @@
+package firewall
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/safing/portmaster/intel"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+func TestAllowTemporarily(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	var reset int
+	defer func(orig func(*packet.Info) error) { resetVerdictOfConnection = orig }(resetVerdictOfConnection)
+	resetVerdictOfConnection = func(*packet.Info) error {
+		reset++
+		return nil
+	}
+
+	conn := &network.Connection{
+		ID:               "temporary",
+		Type:             network.IPConnection,
+		IPVersion:        packet.IPv4,
+		IPProtocol:       packet.TCP,
+		LocalIP:          net.IPv4(10, 0, 0, 1),
+		LocalPort:        40000,
+		Entity:           &intel.Entity{IP: net.IPv4(1, 1, 1, 1), Port: 443},
+		VerdictPermanent: true,
+	}
+	conn.SetVerdict(network.VerdictBlock, "blocked by rule", "", nil)
+	finalizeVerdict(conn)
+
+	if err := allowTemporarily(conn, 0, time.Now()); err == nil {
+		t.Error("allowing without a ttl should fail")
+	}
+
+	now := time.Now().Truncate(time.Second)
+	if err := allowTemporarily(conn, time.Minute, now); err != nil {
+		t.Fatal(err)
+	}
+	if conn.Verdict.Active != network.VerdictAccept {
+		t.Errorf("connection should be accepted, got %s", conn.Verdict.Active)
+	}
+	if conn.VerdictPermanent || reset != 1 {
+		t.Error("permanent verdict should have been reset")
+	}
+	temporary := getTemporaryVerdict(conn, now.Add(20*time.Second))
+	if temporary.Remaining != 40 {
+		t.Errorf("expected 40 seconds remaining, got %d", temporary.Remaining)
+	}
+
+	// Temporary verdicts are kept when re-evaluating.
+	if reEvaluateConnection(context.Background(), conn) || conn.Verdict.Active != network.VerdictAccept {
+		t.Error("temporary verdict should not have been re-evaluated")
+	}
+
+	// Reset the temporary verdict early.
+	var reEvaluated bool
+	changed := resetTemporaryVerdict(conn, func(_ context.Context, conn *network.Connection) bool {
+		reEvaluated = true
+		conn.SetVerdict(network.VerdictBlock, "blocked by rule", "", nil)
+		finalizeVerdict(conn)
+		return true
+	})
+	if !changed || !reEvaluated {
+		t.Error("verdict should have been re-evaluated")
+	}
+	if conn.VerdictExpires != 0 || conn.VerdictRemaining(now) != 0 {
+		t.Error("temporary verdict should have ended")
+	}
+	if conn.Verdict.Active != network.VerdictBlock {
+		t.Errorf("connection should be blocked again, got %s", conn.Verdict.Active)
+	}
+
+	// Killed connections cannot be allowed.
+	conn.Killed = true
+	if err := allowTemporarily(conn, time.Minute, now); err == nil {
+		t.Error("allowing a killed connection should fail")
+	}
+}
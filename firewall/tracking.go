@@ -0,0 +1,79 @@
+package firewall
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tevino/abool"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network"
+)
+
+// trackingEvictionBatchDivisor defines the share of the tracked connections
+// cap that is evicted at once when the cap is reached, so that eviction does
+// not have to run for every new connection during a connection flood.
+const trackingEvictionBatchDivisor = 10
+
+var (
+	maxTrackedConnections = new(int64)
+	trackingCapReached    = abool.New()
+	trackingEvictionLock  sync.Mutex
+
+	// Connection store access, replaceable for testing.
+	countTrackedConnections = network.CountConnections
+	evictIdleConnections    = network.EvictIdleConnections
+
+	errTrackingCapReached = errors.New("tracked connections cap reached")
+)
+
+// SetMaxTrackedConnections sets the maximum amount of connections that are
+// tracked. When the cap is reached, the oldest ended connections are evicted.
+// If no connections can be evicted, packets of new connections are dropped
+// without tracking them until there is room again. A value of zero or less
+// disables the cap.
+func SetMaxTrackedConnections(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt64(maxTrackedConnections, int64(n))
+
+	if n == 0 && trackingCapReached.SetToIf(true, false) {
+		log.Info("filter: tracked connections cap disabled, tracking new connections again")
+	}
+}
+
+// checkTrackingCap returns whether a new connection may be tracked. If the cap
+// is reached, idle connections are evicted to make room.
+func checkTrackingCap() bool {
+	maxConns := int(atomic.LoadInt64(maxTrackedConnections))
+	if maxConns <= 0 || countTrackedConnections() < maxConns {
+		if trackingCapReached.SetToIf(true, false) {
+			log.Infof("filter: tracked connections below cap of %d again, tracking new connections", maxConns)
+		}
+		return true
+	}
+
+	// Evict idle connections. Only one eviction runs at a time.
+	trackingEvictionLock.Lock()
+	defer trackingEvictionLock.Unlock()
+
+	// Check again, as another eviction might have made room in the meantime.
+	tracked := countTrackedConnections()
+	if tracked < maxConns {
+		return true
+	}
+
+	batch := maxConns/trackingEvictionBatchDivisor + 1
+	evicted := evictIdleConnections(tracked - maxConns + batch)
+	if tracked-evicted < maxConns {
+		log.Debugf("filter: evicted %d idle connections to stay below tracked connections cap of %d", evicted, maxConns)
+		return true
+	}
+
+	if trackingCapReached.SetToIf(false, true) {
+		log.Warningf("filter: tracked connections cap of %d reached, dropping packets of new connections without tracking", maxConns)
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package firewall
+
+import (
+	"testing"
+)
+
+func TestTrackingCap(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	tracked := 0
+	ended := 0
+	countTrackedConnections = func() int {
+		return tracked
+	}
+	evictIdleConnections = func(limit int) int {
+		evicted := limit
+		if evicted > ended {
+			evicted = ended
+		}
+		tracked -= evicted
+		ended -= evicted
+		return evicted
+	}
+	defer SetMaxTrackedConnections(0)
+
+	// Without a cap, connections are always tracked.
+	tracked = 1000
+	if !checkTrackingCap() {
+		t.Fatal("connection should be tracked without cap")
+	}
+
+	// Below the cap.
+	SetMaxTrackedConnections(100)
+	tracked = 50
+	if !checkTrackingCap() {
+		t.Fatal("connection should be tracked below cap")
+	}
+
+	// At the cap, with idle connections to evict.
+	tracked = 100
+	ended = 30
+	if !checkTrackingCap() {
+		t.Fatal("connection should be tracked after evicting idle connections")
+	}
+	if tracked >= 100 {
+		t.Errorf("expected idle connections to be evicted, still tracking %d", tracked)
+	}
+
+	// At the cap, without idle connections to evict.
+	tracked = 100
+	ended = 0
+	if checkTrackingCap() {
+		t.Fatal("connection should not be tracked when cap is reached")
+	}
+	if !trackingCapReached.IsSet() {
+		t.Error("cap reached state should be set")
+	}
+
+	// Below the cap again.
+	tracked = 99
+	if !checkTrackingCap() {
+		t.Fatal("connection should be tracked below cap")
+	}
+	if trackingCapReached.IsSet() {
+		t.Error("cap reached state should be reset")
+	}
+}
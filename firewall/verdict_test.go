@@ -0,0 +1,140 @@
+package firewall
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/safing/portmaster/firewall/interception"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// failingPacket fails to apply the first verdicts with the configured error.
+type failingPacket struct {
+	packet.Base
+
+	failures int
+	err      error
+	applied  int
+}
+
+func (pkt *failingPacket) apply() error {
+	if pkt.failures > 0 {
+		pkt.failures--
+		return pkt.err
+	}
+	pkt.applied++
+	return nil
+}
+
+func (pkt *failingPacket) LoadPacketData() error      { return nil }
+func (pkt *failingPacket) Accept() error              { return pkt.apply() }
+func (pkt *failingPacket) Block() error               { return pkt.apply() }
+func (pkt *failingPacket) Drop() error                { return pkt.apply() }
+func (pkt *failingPacket) PermanentAccept() error     { return pkt.apply() }
+func (pkt *failingPacket) PermanentBlock() error      { return pkt.apply() }
+func (pkt *failingPacket) PermanentDrop() error       { return pkt.apply() }
+func (pkt *failingPacket) RerouteToNameserver() error { return pkt.apply() }
+func (pkt *failingPacket) RerouteToTunnel() error     { return pkt.apply() }
+
+func TestIssueVerdictRetry(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func(orig EngineBreakerSettings) {
+		_ = SetEngineBreakerSettings(orig)
+		engineCircuitBreaker.recordSuccess()
+	}(EngineBreaker().Settings)
+	if err := SetEngineBreakerSettings(EngineBreakerSettings{
+		Threshold:   10,
+		Window:      time.Minute,
+		Cooldown:    time.Minute,
+		FailVerdict: network.VerdictAccept,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	engineCircuitBreaker.recordSuccess()
+
+	conn := &network.Connection{}
+	conn.Verdict.Active = network.VerdictAccept
+	engineDrops := func() uint64 {
+		return interception.ErrorDrops()[packet.ErrorDropEngine]
+	}
+
+	// Transient failures are retried once.
+	pkt := &failingPacket{failures: 1, err: packet.ErrVerdictTransient}
+	if err := issueVerdict(conn, pkt, network.VerdictAccept, false); err != nil {
+		t.Fatalf("verdict should have been applied on retry: %s", err)
+	}
+	if pkt.applied != 1 {
+		t.Errorf("verdict should have been applied once, was applied %d times", pkt.applied)
+	}
+
+	// Retrying is bounded.
+	errorsBefore := atomic.LoadUint64(verdictApplyErrors)
+	dropsBefore := engineDrops()
+	pkt = &failingPacket{failures: 2, err: packet.ErrVerdictTransient}
+	err := issueVerdict(conn, pkt, network.VerdictAccept, false)
+	if !errors.Is(err, packet.ErrVerdictTransient) {
+		t.Fatalf("expected transient error, got %v", err)
+	}
+	if pkt.failures != 0 || pkt.applied != 0 {
+		t.Errorf("verdict should have been tried exactly twice")
+	}
+	if atomic.LoadUint64(verdictApplyErrors) != errorsBefore+1 {
+		t.Error("verdict apply error should have been counted")
+	}
+	if engineDrops() != dropsBefore+1 {
+		t.Error("failed retry should have been recorded as error drop")
+	}
+	if errs := EngineBreaker().ConsecutiveErrors; errs != 1 {
+		t.Errorf("failed retry should count as engine error, got %d errors", errs)
+	}
+
+	// Other failures are not retried.
+	errGone := errors.New("packet gone")
+	pkt = &failingPacket{failures: 1, err: errGone}
+	if err := issueVerdict(conn, pkt, network.VerdictAccept, false); !errors.Is(err, errGone) {
+		t.Fatalf("expected error to be returned, got %v", err)
+	}
+	if pkt.applied != 0 {
+		t.Error("verdict should not have been retried")
+	}
+	if engineDrops() != dropsBefore+2 {
+		t.Error("failed verdict should have been recorded as error drop")
+	}
+	if errs := EngineBreaker().ConsecutiveErrors; errs != 2 {
+		t.Errorf("failed verdict should count as engine error, got %d errors", errs)
+	}
+}
+
+func TestIssueVerdictErrorDrop(t *testing.T) { //nolint:paralleltest // Checks global counter.
+	engineDrops := func() uint64 {
+		return interception.ErrorDrops()[packet.ErrorDropEngine]
+	}
+
+	// Policy drops are not counted as error drops.
+	before := engineDrops()
+	conn := &network.Connection{}
+	if err := issueVerdict(conn, &failingPacket{}, network.VerdictDrop, false); err != nil {
+		t.Fatal(err)
+	}
+	if engineDrops() != before {
+		t.Error("policy drop should not be counted as error drop")
+	}
+
+	// Failed connections and undecided packets are.
+	for _, verdict := range []network.Verdict{network.VerdictFailed, network.VerdictUndecided} {
+		before := engineDrops()
+		conn := &network.Connection{}
+		pkt := &failingPacket{}
+		if err := issueVerdict(conn, pkt, verdict, false); err != nil {
+			t.Fatal(err)
+		}
+		if pkt.applied != 1 {
+			t.Errorf("%s: packet should have been dropped", verdict)
+		}
+		if engineDrops() != before+1 {
+			t.Errorf("%s: drop should have been counted as engine error drop", verdict)
+		}
+	}
+}
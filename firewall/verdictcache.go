@@ -0,0 +1,254 @@
+package firewall
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/safing/portbase/dataroot"
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/firewall/interception"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+const (
+	// verdictCacheFileName is the name of the file in the data root
+	// directory that the verdicts are persisted to on shutdown.
+	verdictCacheFileName = "verdict-cache.json"
+
+	// maxPersistedVerdicts defines how many verdicts are persisted at most.
+	// The verdicts of the most recently started connections are kept.
+	maxPersistedVerdicts = 10000
+
+	// maxVerdictCacheAge defines how old a persisted verdict cache may be to
+	// still be restored. This covers planned restarts, such as for updates.
+	maxVerdictCacheAge = 10 * time.Minute
+
+	// restoredVerdictsTTL defines how long restored verdicts are used after
+	// the start. Established connections send packets within this time, or
+	// are evaluated again when they do later.
+	restoredVerdictsTTL = 5 * time.Minute
+)
+
+// verdictCache is the persisted form of the verdicts of active connections.
+type verdictCache struct {
+	// Saved is the time the verdicts were persisted.
+	Saved time.Time
+	// Verdicts holds the persisted verdicts.
+	Verdicts []*persistedVerdict
+}
+
+// persistedVerdict is the verdict of a connection, identified by its flow.
+type persistedVerdict struct {
+	// ID is the connection ID, which is derived from the flow.
+	ID string
+	// BinaryPath is the path of the binary of the process of the connection.
+	// The verdict is only restored for connections of the same binary.
+	BinaryPath string
+	// Verdict is the firewall verdict of the connection.
+	Verdict network.Verdict
+	// Reason is the reason of the verdict.
+	Reason network.Reason
+}
+
+var (
+	restoredVerdicts           map[string]*persistedVerdict
+	restoredVerdictsValidUntil time.Time
+	restoredVerdictsLock       sync.Mutex
+)
+
+// persistVerdictCache writes the verdicts of the active connections to the
+// data root directory, so that they can be restored on the next start.
+func persistVerdictCache() {
+	cache := &verdictCache{
+		Saved:    time.Now(),
+		Verdicts: collectVerdicts(network.GetAllConnections(), maxPersistedVerdicts),
+	}
+	if err := writeVerdictCache(verdictCachePath(), cache); err != nil {
+		log.Warningf("filter: failed to persist verdicts: %s", err)
+		return
+	}
+	log.Infof("filter: persisted verdicts of %d connections", len(cache.Verdicts))
+}
+
+// restoreVerdictCache reads the verdicts persisted by the previous run and
+// keeps the ones of connections that are still tracked by the OS, so that
+// their first packets after the start are handled with the previous verdict.
+// The persisted verdicts are removed in any case, so that they are restored
+// at most once.
+func restoreVerdictCache(enabled bool) {
+	path := verdictCachePath()
+	cache, err := readVerdictCache(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if rmErr := os.Remove(path); rmErr != nil {
+		log.Warningf("filter: failed to remove persisted verdicts: %s", rmErr)
+	}
+	switch {
+	case err != nil:
+		log.Warningf("filter: failed to read persisted verdicts: %s", err)
+		return
+	case !enabled:
+		return
+	}
+
+	flows, err := interception.TrackedFlows()
+	if err != nil {
+		log.Warningf("filter: discarding persisted verdicts, as tracked connections cannot be checked: %s", err)
+		return
+	}
+
+	restored := filterTrackedVerdicts(cache, flows, time.Now())
+	restoredVerdictsLock.Lock()
+	defer restoredVerdictsLock.Unlock()
+	restoredVerdicts = restored
+	restoredVerdictsValidUntil = time.Now().Add(restoredVerdictsTTL)
+
+	log.Infof("filter: restored verdicts of %d of %d persisted connections", len(restored), len(cache.Verdicts))
+}
+
+// restoreVerdict sets the verdict that the connection had before the
+// restart, if one was restored. It returns whether a verdict was restored.
+// Every restored verdict is used once. The connection must be locked.
+func restoreVerdict(ctx context.Context, conn *network.Connection) bool {
+	restoredVerdictsLock.Lock()
+	if restoredVerdicts == nil {
+		restoredVerdictsLock.Unlock()
+		return false
+	}
+	if time.Now().After(restoredVerdictsValidUntil) {
+		restoredVerdicts = nil
+		restoredVerdictsLock.Unlock()
+		return false
+	}
+	persisted, ok := restoredVerdicts[conn.ID]
+	if ok {
+		delete(restoredVerdicts, conn.ID)
+	}
+	restoredVerdictsLock.Unlock()
+
+	if !ok || persisted.BinaryPath != conn.ProcessContext.BinaryPath {
+		return false
+	}
+
+	conn.SetVerdict(persisted.Verdict, persisted.Reason.Msg, persisted.Reason.OptionKey, persisted.Reason.Context)
+	log.Tracer(ctx).Infof("filter: restored verdict %s of %s from before the restart", persisted.Verdict.Verb(), conn)
+	return true
+}
+
+// discardRestoredVerdicts discards the verdicts that were restored from before
+// the restart and were not used yet, as they were decided with rules that
+// changed since. The connections are then decided with the current rules.
+func discardRestoredVerdicts() {
+	restoredVerdictsLock.Lock()
+	defer restoredVerdictsLock.Unlock()
+
+	if len(restoredVerdicts) > 0 {
+		log.Infof("filter: discarding %d restored verdicts, as the rules changed", len(restoredVerdicts))
+	}
+	restoredVerdicts = nil
+}
+
+// collectVerdicts returns the verdicts of the given active IP connections
+// that have a final verdict, of at most limit connections, preferring the
+// most recently started ones.
+func collectVerdicts(conns []*network.Connection, limit int) []*persistedVerdict {
+	type startedVerdict struct {
+		started int64
+		verdict *persistedVerdict
+	}
+
+	collected := make([]startedVerdict, 0, len(conns))
+	for _, conn := range conns {
+		conn.Lock()
+		if conn.Type == network.IPConnection && conn.Ended == 0 && !conn.Internal {
+			// Only persist simple and final verdicts.
+			switch conn.Verdict.Firewall { //nolint:exhaustive // Only a subset is persisted.
+			case network.VerdictAccept, network.VerdictBlock, network.VerdictDrop:
+				collected = append(collected, startedVerdict{
+					started: conn.Started,
+					verdict: &persistedVerdict{
+						ID:         conn.ID,
+						BinaryPath: conn.ProcessContext.BinaryPath,
+						Verdict:    conn.Verdict.Firewall,
+						Reason:     conn.Reason,
+					},
+				})
+			}
+		}
+		conn.Unlock()
+	}
+
+	sort.SliceStable(collected, func(i, j int) bool {
+		return collected[i].started > collected[j].started
+	})
+	if len(collected) > limit {
+		collected = collected[:limit]
+	}
+
+	verdicts := make([]*persistedVerdict, 0, len(collected))
+	for _, c := range collected {
+		verdicts = append(verdicts, c.verdict)
+	}
+	return verdicts
+}
+
+// filterTrackedVerdicts returns the persisted verdicts of the connections
+// that are still tracked by the OS, by connection ID. No verdicts are
+// returned if the cache is too old.
+func filterTrackedVerdicts(cache *verdictCache, flows []*packet.ConntrackTuple, now time.Time) map[string]*persistedVerdict {
+	if now.Sub(cache.Saved) > maxVerdictCacheAge || cache.Saved.After(now) {
+		return nil
+	}
+
+	// The flows hold the original tuples, from which the connection IDs of
+	// translated connections (NAT) are derived, as well as the reply tuples.
+	tracked := make(map[string]struct{}, len(flows)*2)
+	for _, flow := range flows {
+		outboundID, inboundID := flow.ConnectionIDs()
+		tracked[outboundID] = struct{}{}
+		tracked[inboundID] = struct{}{}
+	}
+
+	verdicts := make(map[string]*persistedVerdict)
+	for _, persisted := range cache.Verdicts {
+		if _, ok := tracked[persisted.ID]; ok {
+			verdicts[persisted.ID] = persisted
+		}
+	}
+	return verdicts
+}
+
+func verdictCachePath() string {
+	return filepath.Join(dataroot.Root().Path, verdictCacheFileName)
+}
+
+func writeVerdictCache(path string, cache *verdictCache) error {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return fmt.Errorf("failed to serialize verdicts: %w", err)
+	}
+	return os.WriteFile(path, data, 0o0600)
+}
+
+func readVerdictCache(path string) (*verdictCache, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := &verdictCache{}
+	if err := json.Unmarshal(data, cache); err != nil {
+		return nil, fmt.Errorf("failed to parse persisted verdicts: %w", err)
+	}
+	return cache, nil
+}
@@ -0,0 +1,137 @@
+package firewall
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+func TestVerdictCachePersistence(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Unix()
+	newConn := func(id string, started int64, verdict network.Verdict) *network.Connection {
+		conn := &network.Connection{
+			ID:      id,
+			Type:    network.IPConnection,
+			Started: started,
+		}
+		conn.ProcessContext.BinaryPath = "/usr/bin/app"
+		conn.Verdict.Firewall = verdict
+		conn.Reason.Msg = "test reason"
+		return conn
+	}
+	ended := newConn("6-10.0.0.1-40003-1.1.1.1-443", now, network.VerdictAccept)
+	ended.Ended = now
+	conns := []*network.Connection{
+		newConn("6-10.0.0.1-40001-1.1.1.1-443", now-20, network.VerdictAccept),
+		newConn("6-10.0.0.1-40002-1.1.1.1-443", now-10, network.VerdictBlock),
+		newConn("6-10.0.0.1-40004-1.1.1.1-443", now, network.VerdictRerouteToTunnel),
+		ended,
+	}
+
+	// Only active connections with simple verdicts are collected, most recent
+	// first, up to the limit.
+	verdicts := collectVerdicts(conns, 1)
+	if len(verdicts) != 1 || verdicts[0].ID != "6-10.0.0.1-40002-1.1.1.1-443" {
+		t.Fatalf("unexpected collected verdicts: %+v", verdicts)
+	}
+	verdicts = collectVerdicts(conns, maxPersistedVerdicts)
+	if len(verdicts) != 2 {
+		t.Fatalf("expected 2 collected verdicts, got %d", len(verdicts))
+	}
+
+	// Write and read.
+	path := filepath.Join(t.TempDir(), verdictCacheFileName)
+	saved := time.Now()
+	if err := writeVerdictCache(path, &verdictCache{Saved: saved, Verdicts: verdicts}); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := readVerdictCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.Verdicts) != 2 || cache.Verdicts[0].Verdict != network.VerdictBlock || cache.Verdicts[0].Reason.Msg != "test reason" {
+		t.Fatalf("unexpected read verdicts: %+v", cache.Verdicts)
+	}
+
+	// Only connections that are still tracked are restored.
+	flows := []*packet.ConntrackTuple{{
+		Protocol: packet.TCP,
+		Src:      net.IPv4(10, 0, 0, 1),
+		SrcPort:  40001,
+		Dst:      net.IPv4(1, 1, 1, 1),
+		DstPort:  443,
+	}}
+	restored := filterTrackedVerdicts(cache, flows, saved.Add(time.Minute))
+	if len(restored) != 1 || restored["6-10.0.0.1-40001-1.1.1.1-443"] == nil {
+		t.Errorf("unexpected restored verdicts: %+v", restored)
+	}
+
+	// Old caches are not restored.
+	if restored := filterTrackedVerdicts(cache, flows, saved.Add(maxVerdictCacheAge+time.Second)); len(restored) != 0 {
+		t.Errorf("verdicts of an old cache should not be restored: %+v", restored)
+	}
+}
+
+func TestRestoreVerdict(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	persisted := &persistedVerdict{
+		ID:         "6-10.0.0.1-40001-1.1.1.1-443",
+		BinaryPath: "/usr/bin/app",
+		Verdict:    network.VerdictBlock,
+		Reason:     network.Reason{Msg: "test reason"},
+	}
+	setRestored := func(validUntil time.Time) {
+		restoredVerdictsLock.Lock()
+		defer restoredVerdictsLock.Unlock()
+		restoredVerdicts = map[string]*persistedVerdict{persisted.ID: persisted}
+		restoredVerdictsValidUntil = validUntil
+	}
+	defer func() {
+		restoredVerdictsLock.Lock()
+		defer restoredVerdictsLock.Unlock()
+		restoredVerdicts = nil
+	}()
+	newConn := func(binaryPath string) *network.Connection {
+		conn := &network.Connection{ID: persisted.ID, Type: network.IPConnection}
+		conn.ProcessContext.BinaryPath = binaryPath
+		return conn
+	}
+
+	// Connections of other binaries do not get the verdict.
+	setRestored(time.Now().Add(time.Minute))
+	if restoreVerdict(context.Background(), newConn("/usr/bin/other")) {
+		t.Error("verdict should not be restored for another binary")
+	}
+
+	// The verdict is restored once.
+	setRestored(time.Now().Add(time.Minute))
+	conn := newConn("/usr/bin/app")
+	if !restoreVerdict(context.Background(), conn) {
+		t.Fatal("verdict should have been restored")
+	}
+	if conn.Verdict.Firewall != network.VerdictBlock || conn.Reason.Msg != "test reason" {
+		t.Errorf("unexpected restored verdict %s: %s", conn.Verdict.Firewall, conn.Reason.Msg)
+	}
+	if restoreVerdict(context.Background(), newConn("/usr/bin/app")) {
+		t.Error("verdict should be restored only once")
+	}
+
+	// Expired verdicts are not restored.
+	setRestored(time.Now().Add(-time.Second))
+	if restoreVerdict(context.Background(), newConn("/usr/bin/app")) {
+		t.Error("expired verdict should not be restored")
+	}
+
+	// Verdicts are not restored after the rules changed.
+	setRestored(time.Now().Add(time.Minute))
+	discardRestoredVerdicts()
+	if restoreVerdict(context.Background(), newConn("/usr/bin/app")) {
+		t.Error("discarded verdict should not be restored")
+	}
+}
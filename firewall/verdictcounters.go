@@ -0,0 +1,172 @@
+package firewall
+
+import (
+	"sync"
+
+	"github.com/safing/portmaster/core/telemetry"
+	"github.com/safing/portmaster/network"
+)
+
+// Metric names.
+const (
+	metricVerdictsByProcess = "firewall/verdicts/process/total"
+	metricVerdictsByProfile = "firewall/verdicts/profile/total"
+)
+
+const (
+	// verdictCounterTopN is the amount of processes and profiles with the most
+	// verdicts that are counted with their own label value. The verdicts of
+	// all others are counted with otherLabelValue.
+	verdictCounterTopN = 20
+	// verdictCounterMaxLabelValues caps the amount of distinct label values
+	// that are ever emitted, as the top processes and profiles change over
+	// time and every emitted label value is kept by the metrics backend.
+	verdictCounterMaxLabelValues = 4 * verdictCounterTopN
+	// verdictCounterMaxTracked caps the amount of processes and profiles whose
+	// verdicts are counted to find the top ones.
+	verdictCounterMaxTracked = 1000
+
+	otherLabelValue   = "other"
+	unknownLabelValue = "unknown"
+)
+
+// verdictMetrics holds the counter of a label value for every verdict.
+type verdictMetrics [network.VerdictAsk + 1]*telemetry.Metric
+
+func newVerdictMetrics(name, label, value string) *verdictMetrics {
+	metrics := &verdictMetrics{}
+	for verdict, verdictLabel := range verdictLabelValues {
+		metrics[verdict] = telemetry.NewMetric(name, map[string]string{
+			"verdict": verdictLabel,
+			label:     value,
+		})
+	}
+	return metrics
+}
+
+// topNLabeler limits the values of a label to the values with the most
+// verdicts. Values that are not among the top values are aggregated in
+// otherLabelValue.
+type topNLabeler struct {
+	lock sync.Mutex
+
+	name       string
+	label      string
+	topN       int
+	maxValues  int
+	maxTracked int
+
+	// counts holds the amount of verdicts of every tracked value.
+	counts map[string]uint64
+	// top holds the counters of the current top values.
+	top map[string]*verdictMetrics
+	// lowest holds the top value with the fewest verdicts, if it is known.
+	lowest string
+	// emitted holds the counters of all values that were ever emitted.
+	emitted map[string]*verdictMetrics
+	other   *verdictMetrics
+}
+
+func newTopNLabeler(name, label string, topN, maxValues, maxTracked int) *topNLabeler {
+	return &topNLabeler{
+		name:       name,
+		label:      label,
+		topN:       topN,
+		maxValues:  maxValues,
+		maxTracked: maxTracked,
+		counts:     make(map[string]uint64),
+		top:        make(map[string]*verdictMetrics),
+		emitted:    make(map[string]*verdictMetrics),
+		other:      newVerdictMetrics(name, label, otherLabelValue),
+	}
+}
+
+// metric counts a verdict of the given value and returns the counter to count
+// it with, or nil if the verdict is not counted. A value that has more
+// verdicts than the value with the fewest verdicts of the top values replaces
+// it, as long as the cap of emitted values is not reached.
+func (l *topNLabeler) metric(value string, verdict network.Verdict) *telemetry.Metric {
+	if verdict < 0 || int(verdict) >= len(l.other) || l.other[verdict] == nil {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// Count verdict.
+	count, tracked := l.counts[value]
+	if !tracked && len(l.counts) >= l.maxTracked {
+		return l.other[verdict]
+	}
+	count++
+	l.counts[value] = count
+
+	// Check if value is a top value.
+	if metrics, ok := l.top[value]; ok {
+		if value == l.lowest {
+			l.lowest = ""
+		}
+		return metrics[verdict]
+	}
+	metrics, ok := l.emitted[value]
+	if !ok && len(l.emitted) >= l.maxValues {
+		return l.other[verdict]
+	}
+
+	// Replace the top value with the fewest verdicts, if the top values are
+	// complete.
+	if len(l.top) >= l.topN {
+		if l.lowest == "" {
+			var lowestCount uint64
+			for topValue := range l.top {
+				if topCount := l.counts[topValue]; l.lowest == "" || topCount < lowestCount {
+					l.lowest, lowestCount = topValue, topCount
+				}
+			}
+		}
+		if count <= l.counts[l.lowest] {
+			return l.other[verdict]
+		}
+		delete(l.top, l.lowest)
+		l.lowest = ""
+	}
+
+	if !ok {
+		metrics = newVerdictMetrics(l.name, l.label, value)
+		l.emitted[value] = metrics
+	}
+	l.top[value] = metrics
+	return metrics[verdict]
+}
+
+var (
+	processVerdictLabeler = newTopNLabeler(metricVerdictsByProcess, "process", verdictCounterTopN, verdictCounterMaxLabelValues, verdictCounterMaxTracked)
+	profileVerdictLabeler = newTopNLabeler(metricVerdictsByProfile, "profile", verdictCounterTopN, verdictCounterMaxLabelValues, verdictCounterMaxTracked)
+)
+
+// recordVerdictByProcess counts the first verdict of the connection by the
+// process and profile of the connection. Later verdicts are not counted, so
+// that the counters are updated once per connection instead of for every
+// packet. The connection must be locked.
+func recordVerdictByProcess(conn *network.Connection, verdict network.Verdict) {
+	if conn.ProcessVerdictRecorded {
+		return
+	}
+	conn.ProcessVerdictRecorded = true
+
+	processName := conn.ProcessContext.ProcessName
+	if processName == "" {
+		processName = unknownLabelValue
+	}
+	if metric := processVerdictLabeler.metric(processName, verdict); metric != nil {
+		metric.IncCounter(1)
+	}
+
+	profileID := conn.ProcessContext.Profile
+	if profileID == "" {
+		profileID = unknownLabelValue
+	}
+	if metric := profileVerdictLabeler.metric(profileID, verdict); metric != nil {
+		metric.IncCounter(1)
+	}
+}
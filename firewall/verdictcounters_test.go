@@ -0,0 +1,126 @@
+package firewall
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/safing/portmaster/core/telemetry"
+	"github.com/safing/portmaster/network"
+)
+
+func TestTopNLabeler(t *testing.T) {
+	t.Parallel()
+
+	l := newTopNLabeler(metricVerdictsByProcess, "process", 2, 3, 5)
+	label := func(value string, verdict network.Verdict) string {
+		metric := l.metric(value, verdict)
+		if metric == nil {
+			return ""
+		}
+		labels := metric.Labels()
+		if labels["verdict"] != verdictLabelValues[verdict] {
+			t.Errorf("unexpected verdict label %q for %s", labels["verdict"], verdict)
+		}
+		return labels["process"]
+	}
+
+	// The first values fill the top values.
+	if v := label("a", network.VerdictBlock); v != "a" {
+		t.Errorf("unexpected label %q", v)
+	}
+	if v := label("b", network.VerdictAccept); v != "b" {
+		t.Errorf("unexpected label %q", v)
+	}
+	if v := label("a", network.VerdictBlock); v != "a" {
+		t.Errorf("unexpected label %q", v)
+	}
+
+	// Further values are aggregated, until they have more verdicts than a top
+	// value.
+	if v := label("c", network.VerdictBlock); v != otherLabelValue {
+		t.Errorf("unexpected label %q", v)
+	}
+	if v := label("c", network.VerdictBlock); v != "c" {
+		t.Errorf("value with more verdicts should replace the lowest top value, got %q", v)
+	}
+	if v := label("b", network.VerdictAccept); v != otherLabelValue {
+		t.Errorf("replaced value should be aggregated, got %q", v)
+	}
+
+	// Replaced values may return, but no new values are emitted once the cap
+	// is reached.
+	for i := 0; i < 3; i++ {
+		label("b", network.VerdictAccept)
+	}
+	if v := label("b", network.VerdictAccept); v != "b" {
+		t.Errorf("replaced value should return, got %q", v)
+	}
+	for i := 0; i < 10; i++ {
+		if v := label("d", network.VerdictDrop); v != otherLabelValue {
+			t.Fatalf("new values must not be emitted after the cap is reached, got %q", v)
+		}
+	}
+
+	// Untracked values are aggregated.
+	if v := label("e", network.VerdictDrop); v != otherLabelValue {
+		t.Errorf("unexpected label %q", v)
+	}
+	if v := label("f", network.VerdictDrop); v != otherLabelValue {
+		t.Errorf("untracked value should be aggregated, got %q", v)
+	}
+	if _, tracked := l.counts["f"]; tracked {
+		t.Error("values must not be tracked after the cap is reached")
+	}
+
+	// Undecided verdicts are not counted.
+	if v := label("a", network.VerdictUndecided); v != "" {
+		t.Errorf("undecided verdicts must not be counted, got %q", v)
+	}
+}
+
+//nolint:paralleltest // Modifies global state.
+func TestRecordVerdictByProcess(t *testing.T) {
+	sink := newRecordingSink()
+	telemetry.SetMetricsSink(sink)
+	defer telemetry.SetMetricsSink(nil)
+	defer func(process, profile *topNLabeler) {
+		processVerdictLabeler, profileVerdictLabeler = process, profile
+	}(processVerdictLabeler, profileVerdictLabeler)
+	processVerdictLabeler = newTopNLabeler(metricVerdictsByProcess, "process", 3, 10, 100)
+	profileVerdictLabeler = newTopNLabeler(metricVerdictsByProfile, "profile", 3, 10, 100)
+
+	// Blocked connections of 5 processes with a descending amount of
+	// connections. Only the first verdict of a connection is counted.
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 10-i; j++ {
+			conn := &network.Connection{}
+			conn.ProcessContext.ProcessName = fmt.Sprintf("process-%d", i)
+			conn.ProcessContext.Profile = fmt.Sprintf("profile-%d", i)
+			recordVerdictByProcess(conn, network.VerdictBlock)
+			recordVerdictByProcess(conn, network.VerdictAccept)
+		}
+	}
+	// Connections without a process.
+	recordVerdictByProcess(&network.Connection{}, network.VerdictAccept)
+
+	expected := map[string]uint64{
+		metricVerdictsByProcess + "{verdict=block}{process=process-0}": 10,
+		metricVerdictsByProcess + "{verdict=block}{process=process-1}": 9,
+		metricVerdictsByProcess + "{verdict=block}{process=process-2}": 8,
+		metricVerdictsByProcess + "{verdict=block}{process=other}":     7 + 6,
+		metricVerdictsByProcess + "{verdict=accept}{process=other}":    1,
+		metricVerdictsByProfile + "{verdict=block}{profile=profile-0}": 10,
+		metricVerdictsByProfile + "{verdict=block}{profile=profile-1}": 9,
+		metricVerdictsByProfile + "{verdict=block}{profile=profile-2}": 8,
+		metricVerdictsByProfile + "{verdict=block}{profile=other}":     7 + 6,
+		metricVerdictsByProfile + "{verdict=accept}{profile=other}":    1,
+	}
+	for key, count := range expected {
+		if sink.counters[key] != count {
+			t.Errorf("unexpected count %d of %s, expected %d", sink.counters[key], key, count)
+		}
+	}
+	if len(sink.counters) != len(expected) {
+		t.Errorf("unexpected counters %v", sink.counters)
+	}
+}
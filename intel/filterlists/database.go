@@ -45,6 +45,11 @@
 	urgentFile       *updater.File
 
 	filterListsLoaded chan struct{}
+
+	// cacheLoadDone is closed when loading the filter lists from the cache
+	// at start finished, successfully or not. cacheLoadErr holds the error.
+	cacheLoadDone chan struct{}
+	cacheLoadErr  error
 )
 
 var cache = database.NewInterface(&database.Options{
@@ -64,6 +69,19 @@
 
 func init() {
 	filterListsLoaded = make(chan struct{})
+	cacheLoadDone = make(chan struct{})
+}
+
+// WaitForCacheLoad waits until the filter lists are loaded from the cache at
+// start. If there is no usable cache, it returns the error, and the filter
+// lists are only used once they are downloaded.
+func WaitForCacheLoad(ctx context.Context) error {
+	select {
+	case <-cacheLoadDone:
+		return cacheLoadErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // isLoaded returns true if the filterlists have been
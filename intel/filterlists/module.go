@@ -92,12 +92,15 @@ func start() error {
 		log.Debugf("intel/filterlists: using cache database")
 		close(filterListsLoaded)
 	}
+	cacheLoadErr = err
+	close(cacheLoadDone)
 
 	return nil
 }
 
 func stop() error {
 	filterListsLoaded = make(chan struct{})
+	cacheLoadDone = make(chan struct{})
 	return nil
 }
 
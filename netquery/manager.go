@@ -184,7 +184,7 @@ func convertConnection(conn *network.Connection) (*Conn, error) {
 	case network.VerdictBlock, network.VerdictDrop:
 		allowed := false
 		c.Allowed = &allowed
-	case network.VerdictUndecided, network.VerdictUndeterminable, network.VerdictFailed:
+	case network.VerdictUndecided, network.VerdictUndeterminable, network.VerdictFailed, network.VerdictAsk:
 		c.Allowed = nil
 	}
 
@@ -1,6 +1,7 @@
 package network
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"sort"
@@ -62,6 +63,31 @@ func registerAPIEndpoints() error {
 		return err
 	}
 
+	if err := api.RegisterEndpoint(api.Endpoint{
+		Path:      "debug/network/verdict-history",
+		Read:      api.PermitUser,
+		BelongsTo: module,
+		StructFunc: func(ar *api.Request) (i interface{}, err error) {
+			id := ar.Request.URL.Query().Get("id")
+			if id == "" {
+				return nil, errors.New("no connection ID specified")
+			}
+			return ConnectionVerdictHistory(id), nil
+		},
+		Name:        "Get Connection Verdict History",
+		Description: "Returns the last verdicts and their reasons of a connection, also after the connection was reset or removed.",
+		Parameters: []api.Parameter{
+			{
+				Method:      http.MethodGet,
+				Field:       "id",
+				Value:       "<Connection ID>",
+				Description: "Specify the ID of the connection.",
+			},
+		},
+	}); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -31,6 +31,11 @@ func connectionCleaner(ctx context.Context) error {
 			activePIDs := cleanConnections()
 			process.CleanProcessStorage(activePIDs)
 
+			// re-evaluate expired temporary verdicts
+			if expired := expireTemporaryVerdicts(conns.list(), time.Now()); expired > 0 {
+				log.Debugf("network.clean: re-evaluated %d connections with expired temporary verdicts", expired)
+			}
+
 			// clean udp connection states
 			state.CleanUDPStates(ctx)
 		}
@@ -68,6 +73,7 @@ func cleanConnections() (activePIDs map[int]struct{}) {
 				if !exists {
 					// Step 2: mark end
 					conn.Ended = nowUnix
+					conns.markEnded(conn)
 					conn.Save()
 				}
 			case conn.Ended < deleteOlderThan:
@@ -97,3 +103,30 @@ func cleanConnections() (activePIDs map[int]struct{}) {
 
 	return activePIDs
 }
+
+// CountConnections returns the amount of tracked IP connections.
+func CountConnections() int {
+	return conns.len()
+}
+
+// EvictIdleConnections deletes up to limit ended IP connections, starting with
+// the connections that ended first. It returns the amount of deleted
+// connections. Connections that have not yet ended are never evicted.
+func EvictIdleConnections(limit int) (evicted int) {
+	if limit <= 0 {
+		return 0
+	}
+
+	for _, conn := range conns.oldestEnded(limit) {
+		conn.Lock()
+		// Check again, as the connection might have been deleted in the meantime.
+		if current, ok := conns.get(conn.ID); ok && current == conn {
+			log.Tracef("network.clean: evicted %s (ended at %s)", conn.DatabaseKey(), time.Unix(conn.Ended, 0))
+			conn.delete()
+			evicted++
+		}
+		conn.Unlock()
+	}
+
+	return evicted
+}
@@ -15,6 +15,7 @@
 	"github.com/safing/portmaster/network/packet"
 	"github.com/safing/portmaster/process"
 	_ "github.com/safing/portmaster/process/tags"
+	"github.com/safing/portmaster/profile"
 	"github.com/safing/portmaster/resolver"
 	"github.com/safing/spn/navigator"
 )
@@ -156,6 +157,10 @@ type Connection struct {
 	// that initiated the connection. It is set once when the connection
 	// object is created and is considered immutable afterwards.
 	ProcessContext ProcessContext
+	// SettingsAncestorPID holds the PID of the ancestor process whose settings
+	// were applied to the connection, as it shares them with its child
+	// processes. It is 0 if the settings of the own process were applied.
+	SettingsAncestorPID int
 	// DNSContext holds additional information about the DNS request that was
 	// probably used to resolve the IP of this connection.
 	DNSContext *resolver.DNSRequestContext
@@ -166,6 +171,30 @@ type Connection struct {
 		StopTunnel() error
 	}
 
+	// Killed is set to true if the connection was forcibly torn down. Its
+	// packets are dropped and its verdict is not re-evaluated anymore. Access
+	// to Killed must be guarded by the connection lock.
+	Killed bool
+	// KillResetPending is set if the TCP resets of a killed connection are
+	// sent with the next packet of the connection, as only its sequence
+	// numbers are known to be current. Access to KillResetPending must be
+	// guarded by the connection lock.
+	KillResetPending bool
+	// ProcessVerdictRecorded is set when the verdict of the connection was
+	// counted by its process and profile, which is only done for the first
+	// verdict. Access to ProcessVerdictRecorded must be guarded by the
+	// connection lock.
+	ProcessVerdictRecorded bool
+	// VerdictExpires holds the number of seconds in UNIX epoch time at which
+	// a temporary verdict expires and the verdict of the connection is
+	// re-evaluated again. It is 0 if the verdict is not temporary. Access to
+	// VerdictExpires must be guarded by the connection lock.
+	VerdictExpires int64
+	// Forwarded is set for connections that are forwarded by the host, ie.
+	// neither their source nor their destination is an IP of the host. Their
+	// device identity takes the place of the process for applying policy,
+	// see DeviceIdentity.
+	Forwarded bool
 	// Internal is set to true if the connection is attributed as an
 	// Portmaster internal connection. Internal may be set at different
 	// points and access to it must be guarded by the connection lock.
@@ -195,9 +224,41 @@ type Connection struct {
 	// profile and required for correct re-evaluation of a connections
 	// verdict.
 	ProfileRevisionCounter uint64
+	// RuleVersion is the version of the ruleset the current verdict was
+	// decided with. It must be guarded by the connection lock.
+	RuleVersion profile.RuleVersion
 	// addedToMetrics signifies if the connection has already been counted in
 	// the metrics.
 	addedToMetrics bool
+	// detectedProtocol holds the application protocol that was detected from
+	// the first payload of the connection.
+	detectedProtocol string
+	// tlsServerName holds the server name that the initiator of a TLS
+	// connection indicated in its ClientHello.
+	tlsServerName string
+	// conntrackState holds the conntrack state of the first packet of the
+	// connection and conntrackInbound whether that packet was inbound.
+	conntrackState   packet.ConntrackState
+	conntrackInbound bool
+	// conntrackOrigin and conntrackReply hold the tuples of the connection in
+	// the original and the reply direction, as last supplied by the system
+	// integration. See OriginalTuple and ReplyTuple.
+	conntrackOrigin *packet.ConntrackTuple
+	conntrackReply  *packet.ConntrackTuple
+	// translatedID holds the ID that is derived from the translated addresses
+	// of a translated connection, under which the connection can also be
+	// found. See TranslatedID.
+	translatedID string
+	// tcpSequences holds the next sequence numbers of both endpoints of TCP
+	// connections. See TCPSequences.
+	tcpSequences tcpSequences
+	// deviceIdentity holds the identity of the device that a forwarded
+	// connection originates from. See DeviceIdentity.
+	deviceIdentity        *DeviceIdentity
+	deviceIdentityChecked bool
+	// simulated is set for connections that only exist for simulating a
+	// verdict. They are never saved and their verdicts are not recorded.
+	simulated bool
 }
 
 // Reason holds information justifying a verdict, as well as additional
@@ -330,9 +391,12 @@ func NewConnectionFromExternalDNSRequest(ctx context.Context, fqdn string, cname
 // NewConnectionFromFirstPacket returns a new connection based on the given packet.
 func NewConnectionFromFirstPacket(pkt packet.Packet) *Connection {
 	// get Process
+	var forwarded bool
 	proc, inbound, err := process.GetProcessByConnection(pkt.Ctx(), pkt.Info())
 	if err != nil {
 		log.Tracer(pkt.Ctx()).Debugf("network: failed to find process of packet %s: %s", pkt, err)
+		// Forwarded connections never have a local process.
+		forwarded = isForwardedPacket(pkt.Info())
 		if inbound && !netutils.ClassifyIP(pkt.Info().Dst).IsLocalhost() {
 			proc = process.GetUnsolicitedProcess(pkt.Ctx())
 		} else {
@@ -353,19 +417,7 @@ func NewConnectionFromFirstPacket(pkt packet.Packet) *Connection {
 	var dnsContext *resolver.DNSRequestContext
 
 	if inbound {
-		switch entity.IPScope {
-		case netutils.HostLocal:
-			scope = IncomingHost
-		case netutils.LinkLocal, netutils.SiteLocal, netutils.LocalMulticast:
-			scope = IncomingLAN
-		case netutils.Global, netutils.GlobalMulticast:
-			scope = IncomingInternet
-
-		case netutils.Undefined, netutils.Invalid:
-			fallthrough
-		default:
-			scope = IncomingInvalid
-		}
+		scope = ipConnectionScope(true, entity.IPScope)
 	} else {
 
 		// check if we can find a domain for that IP
@@ -395,19 +447,7 @@ func NewConnectionFromFirstPacket(pkt packet.Packet) *Connection {
 
 		if scope == "" {
 			// outbound direct (possibly P2P) connection
-			switch entity.IPScope {
-			case netutils.HostLocal:
-				scope = PeerHost
-			case netutils.LinkLocal, netutils.SiteLocal, netutils.LocalMulticast:
-				scope = PeerLAN
-			case netutils.Global, netutils.GlobalMulticast:
-				scope = PeerInternet
-
-			case netutils.Undefined, netutils.Invalid:
-				fallthrough
-			default:
-				scope = PeerInvalid
-			}
+			scope = ipConnectionScope(false, entity.IPScope)
 		}
 	}
 
@@ -431,8 +471,11 @@ func NewConnectionFromFirstPacket(pkt packet.Packet) *Connection {
 		// meta
 		Started:                time.Now().Unix(),
 		ProfileRevisionCounter: proc.Profile().RevisionCnt(),
+		Forwarded:              forwarded,
 	}
 	newConn.SetLocalIP(pkt.Info().LocalIP())
+	newConn.SetConntrackState(pkt.ConntrackState(), pkt.IsInbound())
+	newConn.SetConntrackTuples(pkt.ConntrackInfo())
 
 	// Inherit internal status of profile.
 	if localProfile := proc.Profile().LocalProfile(); localProfile != nil {
@@ -446,7 +489,42 @@ func NewConnectionFromFirstPacket(pkt packet.Packet) *Connection {
 	return newConn
 }
 
-// GetConnection fetches a Connection from the database.
+// ipConnectionScope returns the scope of an IP connection without a domain,
+// based on the network scope of the remote IP.
+func ipConnectionScope(inbound bool, ipScope netutils.IPScope) string {
+	if inbound {
+		switch ipScope {
+		case netutils.HostLocal:
+			return IncomingHost
+		case netutils.LinkLocal, netutils.SiteLocal, netutils.LocalMulticast:
+			return IncomingLAN
+		case netutils.Global, netutils.GlobalMulticast:
+			return IncomingInternet
+
+		case netutils.Undefined, netutils.Invalid:
+			fallthrough
+		default:
+			return IncomingInvalid
+		}
+	}
+
+	switch ipScope {
+	case netutils.HostLocal:
+		return PeerHost
+	case netutils.LinkLocal, netutils.SiteLocal, netutils.LocalMulticast:
+		return PeerLAN
+	case netutils.Global, netutils.GlobalMulticast:
+		return PeerInternet
+
+	case netutils.Undefined, netutils.Invalid:
+		fallthrough
+	default:
+		return PeerInvalid
+	}
+}
+
+// GetConnection fetches a Connection from the database. Translated
+// connections are also found by their translated ID, see TranslatedID.
 func GetConnection(id string) (*Connection, bool) {
 	return conns.get(id)
 }
@@ -539,6 +617,19 @@ func (conn *Connection) SetVerdict(newVerdict Verdict, reason, reasonOptionKey s
 		conn.Reason.Profile = conn.Process().Profile().GetProfileSource(conn.Reason.OptionKey)
 	}
 
+	if !conn.simulated {
+		recordVerdict(conn.ID, VerdictRecord{
+			Time:            time.Now(),
+			Verdict:         newVerdict,
+			Reason:          reason,
+			OptionKey:       conn.Reason.OptionKey,
+			Profile:         conn.Reason.Profile,
+			RuleVersion:     conn.RuleVersion,
+			ProfileRevision: conn.ProfileRevisionCounter,
+			Expires:         conn.VerdictExpires,
+		})
+	}
+
 	return true // TODO: remove
 }
 
@@ -576,6 +667,10 @@ func (conn *Connection) SaveWhenFinished() {
 // Callers must make sure to lock the connection itself before calling
 // Save().
 func (conn *Connection) Save() {
+	if conn.simulated {
+		return
+	}
+
 	conn.addToMetrics()
 	conn.UpdateMeta()
 
@@ -676,6 +771,11 @@ func packetHandlerHandleConn(conn *Connection, pkt packet.Packet) {
 	conn.Lock()
 	defer conn.Unlock()
 
+	conn.TrackTCPSequence(pkt)
+	// The reply tuple only holds the translated addresses once the first
+	// packet passed the translation (NAT).
+	conn.SetConntrackTuples(pkt.ConntrackInfo())
+
 	// Handle packet with appropriate handler.
 	if conn.firewallHandler != nil {
 		conn.firewallHandler(conn, pkt)
@@ -716,6 +816,105 @@ func (conn *Connection) SetInspectorData(newInspectorData map[uint8]interface{})
 	conn.inspectorData = newInspectorData
 }
 
+// DetectedProtocol returns the application protocol that was detected from the
+// first payload of the connection, if any.
+func (conn *Connection) DetectedProtocol() string {
+	return conn.detectedProtocol
+}
+
+// SetDetectedProtocol sets the detected application protocol.
+func (conn *Connection) SetDetectedProtocol(protocol string) {
+	conn.detectedProtocol = protocol
+}
+
+// TLSServerName returns the server name (SNI) that the initiator of a TLS
+// connection indicated in its ClientHello. It is empty if the connection is
+// not using TLS, the ClientHello was not parsed yet, or no server name was
+// indicated in the clear, eg. when using Encrypted Client Hello.
+func (conn *Connection) TLSServerName() string {
+	return conn.tlsServerName
+}
+
+// SetTLSServerName sets the server name indicated in the TLS ClientHello.
+func (conn *Connection) SetTLSServerName(serverName string) {
+	conn.tlsServerName = serverName
+}
+
+// ConntrackState returns the conntrack state of the first packet of the
+// connection, as supplied by the system integration, and whether that packet
+// was inbound. If the integration does not supply conntrack information,
+// ConntrackStateUnknown is returned.
+func (conn *Connection) ConntrackState() (state packet.ConntrackState, inboundPacket bool) {
+	return conn.conntrackState, conn.conntrackInbound
+}
+
+// SetConntrackState sets the conntrack state of the first packet of the
+// connection and whether that packet was inbound.
+func (conn *Connection) SetConntrackState(state packet.ConntrackState, inboundPacket bool) {
+	conn.conntrackState = state
+	conn.conntrackInbound = inboundPacket
+}
+
+// OriginalTuple returns the tuple of the connection in the original
+// direction, which holds the addresses before any translation (NAT). It
+// returns nil if the system integration does not supply conntrack tuples.
+// The connection must be locked.
+func (conn *Connection) OriginalTuple() *packet.ConntrackTuple {
+	return conn.conntrackOrigin
+}
+
+// ReplyTuple returns the tuple of the connection in the reply direction. If
+// the connection is translated (NAT), it holds the translated addresses and
+// is not the reverse of the original tuple. It returns nil if the system
+// integration does not supply conntrack tuples. The connection must be locked.
+func (conn *Connection) ReplyTuple() *packet.ConntrackTuple {
+	return conn.conntrackReply
+}
+
+// SetConntrackTuples sets the original and the reply tuple of the connection
+// from the conntrack information of a packet, if it holds them. Packets of
+// both halves of a translated connection belong to the same connection, as
+// their connection ID is derived from the addresses before the translation.
+// The connection must be locked.
+func (conn *Connection) SetConntrackTuples(ctInfo *packet.ConntrackInfo) {
+	if ctInfo == nil || ctInfo.OriginTuple == nil || ctInfo.ReplyTuple == nil {
+		return
+	}
+	// The conntrack information of ICMP errors describes the connection they
+	// refer to.
+	if ctInfo.OriginTuple.Protocol != conn.IPProtocol {
+		return
+	}
+	conn.conntrackOrigin = ctInfo.OriginTuple
+	conn.conntrackReply = ctInfo.ReplyTuple
+
+	// Make the connection findable by the ID of its translated addresses.
+	previousID := conn.translatedID
+	conn.translatedID = ""
+	if ctInfo.Translated() {
+		outbound, inbound := ctInfo.ReplyTuple.Reverse().ConnectionIDs()
+		if conn.Inbound {
+			conn.translatedID = inbound
+		} else {
+			conn.translatedID = outbound
+		}
+	}
+	if conn.translatedID != previousID {
+		conns.updateAlias(conn, previousID)
+	}
+}
+
+// TranslatedID returns the ID that is derived from the translated addresses
+// of the connection, if it is translated (NAT). As the connection ID is
+// derived from the addresses before the translation, packets with translated
+// addresses, such as the original packet of an ICMP error, or its local
+// address, point to this ID instead. GetConnection finds connections by both
+// IDs. It returns an empty string if the connection is not translated.
+// The connection must be locked.
+func (conn *Connection) TranslatedID() string {
+	return conn.translatedID
+}
+
 // String returns a string representation of conn.
 func (conn *Connection) String() string {
 	switch {
@@ -1,39 +1,142 @@
 package network
 
 import (
+	"container/list"
 	"sync"
+	"sync/atomic"
 )
 
 type connectionStore struct {
 	rw    sync.RWMutex
 	items map[string]*Connection
+	// aliases maps the translated IDs of translated connections to their
+	// connection IDs.
+	aliases map[string]string
+
+	// size holds the amount of items and is read without locking.
+	size int64
+	// ended holds the ended connections in the order in which they ended and
+	// endedElems their elements by connection ID, so that the oldest ended
+	// connections can be evicted without going through all connections.
+	ended      *list.List
+	endedElems map[string]*list.Element
 }
 
 func newConnectionStore() *connectionStore {
 	return &connectionStore{
-		items: make(map[string]*Connection, 100),
+		items:      make(map[string]*Connection, 100),
+		aliases:    make(map[string]string),
+		ended:      list.New(),
+		endedElems: make(map[string]*list.Element),
 	}
 }
 
+// add adds the connection to the store. The connection must be locked.
 func (cs *connectionStore) add(conn *Connection) {
 	cs.rw.Lock()
 	defer cs.rw.Unlock()
 
+	if previous, ok := cs.items[conn.ID]; ok {
+		cs.removeEnded(previous)
+	} else {
+		atomic.AddInt64(&cs.size, 1)
+	}
 	cs.items[conn.ID] = conn
+	if conn.translatedID != "" {
+		cs.aliases[conn.translatedID] = conn.ID
+	}
+	if conn.Ended != 0 {
+		cs.addEnded(conn)
+	}
 }
 
+// delete removes the connection from the store. The connection must be
+// locked.
 func (cs *connectionStore) delete(conn *Connection) {
 	cs.rw.Lock()
 	defer cs.rw.Unlock()
 
-	delete(cs.items, conn.ID)
+	if previous, ok := cs.items[conn.ID]; ok {
+		cs.removeEnded(previous)
+		delete(cs.items, conn.ID)
+		atomic.AddInt64(&cs.size, -1)
+	}
+	if cs.aliases[conn.translatedID] == conn.ID {
+		delete(cs.aliases, conn.translatedID)
+	}
 }
 
+// markEnded adds the connection to the ended connections, if it is in the
+// store. It must be called when the connection ended. The connection must be
+// locked.
+func (cs *connectionStore) markEnded(conn *Connection) {
+	cs.rw.Lock()
+	defer cs.rw.Unlock()
+
+	if cs.items[conn.ID] == conn {
+		cs.addEnded(conn)
+	}
+}
+
+// addEnded adds the connection to the end of the ended connections, if it is
+// not yet in there. The write lock must be held.
+func (cs *connectionStore) addEnded(conn *Connection) {
+	if _, ok := cs.endedElems[conn.ID]; !ok {
+		cs.endedElems[conn.ID] = cs.ended.PushBack(conn)
+	}
+}
+
+// removeEnded removes the connection from the ended connections. The write
+// lock must be held.
+func (cs *connectionStore) removeEnded(conn *Connection) {
+	if elem, ok := cs.endedElems[conn.ID]; ok {
+		cs.ended.Remove(elem)
+		delete(cs.endedElems, conn.ID)
+	}
+}
+
+// oldestEnded returns up to limit ended connections, starting with the
+// connection that ended first.
+func (cs *connectionStore) oldestEnded(limit int) []*Connection {
+	cs.rw.RLock()
+	defer cs.rw.RUnlock()
+
+	l := make([]*Connection, 0, limit)
+	for elem := cs.ended.Front(); elem != nil && len(l) < limit; elem = elem.Next() {
+		l = append(l, elem.Value.(*Connection)) //nolint:forcetypeassert // Only connections are added.
+	}
+	return l
+}
+
+// updateAlias replaces the previous translated ID of the connection with its
+// current one, if the connection is in the store. The connection must be
+// locked.
+func (cs *connectionStore) updateAlias(conn *Connection, previousID string) {
+	cs.rw.Lock()
+	defer cs.rw.Unlock()
+
+	if cs.items[conn.ID] != conn {
+		return
+	}
+	if previousID != "" && cs.aliases[previousID] == conn.ID {
+		delete(cs.aliases, previousID)
+	}
+	if conn.translatedID != "" {
+		cs.aliases[conn.translatedID] = conn.ID
+	}
+}
+
+// get returns the connection with the given connection ID or translated ID.
 func (cs *connectionStore) get(id string) (*Connection, bool) {
 	cs.rw.RLock()
 	defer cs.rw.RUnlock()
 
 	conn, ok := cs.items[id]
+	if !ok {
+		if connID, isAlias := cs.aliases[id]; isAlias {
+			conn, ok = cs.items[connID]
+		}
+	}
 	return conn, ok
 }
 
@@ -59,11 +162,8 @@ func (cs *connectionStore) list() []*Connection {
 	return l
 }
 
-func (cs *connectionStore) len() int { //nolint:unused // TODO: Clean up if still unused.
-	cs.rw.RLock()
-	defer cs.rw.RUnlock()
-
-	return len(cs.items)
+func (cs *connectionStore) len() int {
+	return int(atomic.LoadInt64(&cs.size))
 }
 
 func (cs *connectionStore) active() int {
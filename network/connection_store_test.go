@@ -0,0 +1,50 @@
+package network
+
+import (
+	"testing"
+)
+
+func TestConnectionStoreEnded(t *testing.T) {
+	t.Parallel()
+
+	cs := newConnectionStore()
+	a := &Connection{ID: "a"}
+	b := &Connection{ID: "b"}
+	c := &Connection{ID: "c", Ended: 1}
+	cs.add(a)
+	cs.add(b)
+	cs.add(c)
+	if cs.len() != 3 {
+		t.Fatalf("expected 3 connections, got %d", cs.len())
+	}
+
+	// Connections are returned in the order in which they ended.
+	b.Ended = 2
+	cs.markEnded(b)
+	a.Ended = 3
+	cs.markEnded(a)
+	cs.markEnded(a)
+	if ended := cs.oldestEnded(10); len(ended) != 3 || ended[0] != c || ended[1] != b || ended[2] != a {
+		t.Errorf("unexpected ended connections %v", ended)
+	}
+	if ended := cs.oldestEnded(1); len(ended) != 1 || ended[0] != c {
+		t.Errorf("unexpected ended connections %v", ended)
+	}
+
+	// Deleted and replaced connections are removed from the ended connections.
+	cs.delete(c)
+	cs.add(&Connection{ID: "b"})
+	if ended := cs.oldestEnded(10); len(ended) != 1 || ended[0] != a {
+		t.Errorf("unexpected ended connections %v", ended)
+	}
+	if cs.len() != 2 {
+		t.Errorf("expected 2 connections, got %d", cs.len())
+	}
+
+	// Connections that are not in the store are not added.
+	cs.markEnded(c)
+	cs.delete(c)
+	if ended := cs.oldestEnded(10); len(ended) != 1 || cs.len() != 2 {
+		t.Errorf("unexpected ended connections %v of %d connections", ended, cs.len())
+	}
+}
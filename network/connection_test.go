@@ -0,0 +1,108 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"github.com/safing/portmaster/network/packet"
+)
+
+func TestConntrackTuples(t *testing.T) {
+	t.Parallel()
+
+	// An inbound connection to 10.0.0.1:8080 that is translated (DNAT) from
+	// the public address 203.0.113.1:80.
+	origin := &packet.ConntrackTuple{
+		Protocol: packet.TCP,
+		Src:      net.IPv4(198, 51, 100, 1),
+		SrcPort:  50000,
+		Dst:      net.IPv4(203, 0, 113, 1),
+		DstPort:  80,
+	}
+	reply := &packet.ConntrackTuple{
+		Protocol: packet.TCP,
+		Src:      net.IPv4(10, 0, 0, 1),
+		SrcPort:  8080,
+		Dst:      net.IPv4(198, 51, 100, 1),
+		DstPort:  50000,
+	}
+	conn := &Connection{IPProtocol: packet.TCP}
+	if conn.OriginalTuple() != nil || conn.ReplyTuple() != nil {
+		t.Fatal("tuples should be unknown")
+	}
+
+	conn.SetConntrackTuples(&packet.ConntrackInfo{OriginTuple: origin, ReplyTuple: reply})
+	if !conn.OriginalTuple().Equal(origin) || !conn.ReplyTuple().Equal(reply) {
+		t.Errorf("unexpected tuples %s and %s", conn.OriginalTuple(), conn.ReplyTuple())
+	}
+
+	// Packets without tuples and ICMP errors referring to the connection do not
+	// change the tuples.
+	conn.SetConntrackTuples(&packet.ConntrackInfo{})
+	icmpOrigin := &packet.ConntrackTuple{Protocol: packet.ICMP, Src: origin.Src, Dst: origin.Dst}
+	conn.SetConntrackTuples(&packet.ConntrackInfo{OriginTuple: icmpOrigin, ReplyTuple: icmpOrigin.Reverse()})
+	if !conn.OriginalTuple().Equal(origin) || !conn.ReplyTuple().Equal(reply) {
+		t.Errorf("tuples should not change, got %s and %s", conn.OriginalTuple(), conn.ReplyTuple())
+	}
+}
+
+func TestTranslatedConnectionLookup(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	// An inbound connection to 10.0.0.1:80 that is redirected (REDIRECT) to
+	// port 8080.
+	origin := &packet.ConntrackTuple{
+		Protocol: packet.TCP,
+		Src:      net.IPv4(198, 51, 100, 7),
+		SrcPort:  50000,
+		Dst:      net.IPv4(10, 0, 0, 1),
+		DstPort:  80,
+	}
+	reply := &packet.ConntrackTuple{
+		Protocol: packet.TCP,
+		Src:      net.IPv4(10, 0, 0, 1),
+		SrcPort:  8080,
+		Dst:      net.IPv4(198, 51, 100, 7),
+		DstPort:  50000,
+	}
+	_, connID := origin.ConnectionIDs()
+	conn := &Connection{ID: connID, Inbound: true, IPProtocol: packet.TCP}
+	conns.add(conn)
+	defer conns.delete(conn)
+
+	// The original packet of an ICMP error about the reply direction, with its
+	// addresses translated back by the system.
+	icmpOriginal := reply
+	findByICMPError := func() (*Connection, bool) {
+		outboundID, inboundID := icmpOriginal.ConnectionIDs()
+		if found, ok := GetConnection(outboundID); ok {
+			return found, true
+		}
+		return GetConnection(inboundID)
+	}
+	if _, ok := findByICMPError(); ok {
+		t.Fatal("connection should not be found before its tuples are known")
+	}
+
+	// The tuples are supplied with a later packet.
+	conn.SetConntrackTuples(&packet.ConntrackInfo{OriginTuple: origin, ReplyTuple: reply})
+	if conn.TranslatedID() != "6-10.0.0.1-8080-198.51.100.7-50000" {
+		t.Errorf("unexpected translated ID %s", conn.TranslatedID())
+	}
+	if found, ok := findByICMPError(); !ok || found != conn {
+		t.Error("connection should be found by the ICMP error")
+	}
+	if found, ok := GetConnection(connID); !ok || found != conn {
+		t.Error("connection should still be found by its ID")
+	}
+
+	// The translated ID is removed with the connection.
+	conns.delete(conn)
+	if _, ok := findByICMPError(); ok {
+		t.Error("translated ID should be removed with the connection")
+	}
+
+	// Connections that are added with their tuples can be found as well.
+	conns.add(conn)
+	if found, ok := findByICMPError(); !ok || found != conn {
+		t.Error("connection added with tuples should be found by the ICMP error")
+	}
+}
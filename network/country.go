@@ -0,0 +1,105 @@
+package network
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// countryCacheTTL defines how long looked up countries are cached.
+	countryCacheTTL = 1 * time.Hour
+	// countryCacheMaxEntries defines how many IPs are cached at most. When
+	// the cache is full, expired entries are removed, or the whole cache if
+	// there are none.
+	countryCacheMaxEntries = 10000
+)
+
+// CountryLookup looks up the country of IP addresses, eg. via a GeoIP
+// database.
+type CountryLookup interface {
+	// LookupCountry returns the two letter ISO country code of the given IP
+	// and whether it is known.
+	LookupCountry(ip net.IP) (country string, ok bool)
+}
+
+type countryCacheEntry struct {
+	country string
+	expires time.Time
+}
+
+var (
+	countryLookup     CountryLookup
+	countryCache      = make(map[string]countryCacheEntry)
+	countryLookupLock sync.Mutex
+)
+
+// SetCountryLookup sets the lookup that is used to find the country of the
+// remote IPs of connections instead of the GeoIP location of the entity.
+// Setting nil restores the default. The cache of looked up countries is reset.
+func SetCountryLookup(lookup CountryLookup) {
+	countryLookupLock.Lock()
+	defer countryLookupLock.Unlock()
+
+	countryLookup = lookup
+	countryCache = make(map[string]countryCacheEntry)
+}
+
+// lookupCountry returns the country of the given IP, from the cache if
+// possible.
+func lookupCountry(lookup CountryLookup, ip net.IP) string {
+	key := ip.String()
+	now := time.Now()
+
+	countryLookupLock.Lock()
+	entry, ok := countryCache[key]
+	countryLookupLock.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.country
+	}
+
+	// Look up without holding the lock, as the lookup may be slow.
+	country, _ := lookup.LookupCountry(ip)
+
+	countryLookupLock.Lock()
+	defer countryLookupLock.Unlock()
+
+	if len(countryCache) >= countryCacheMaxEntries {
+		for cachedIP, cached := range countryCache {
+			if now.After(cached.expires) {
+				delete(countryCache, cachedIP)
+			}
+		}
+		if len(countryCache) >= countryCacheMaxEntries {
+			countryCache = make(map[string]countryCacheEntry)
+		}
+	}
+	countryCache[key] = countryCacheEntry{
+		country: country,
+		expires: now.Add(countryCacheTTL),
+	}
+	return country
+}
+
+// RemoteCountry returns the two letter ISO country code of the remote IP of
+// the connection, or an empty string if it is not known. By default, the
+// country is taken from the GeoIP location of the entity, which is looked up
+// once per entity and shared with the country rules of the profiles. If a
+// CountryLookup is set, it is used instead and its lookups are cached per IP.
+// The connection must be locked.
+func (conn *Connection) RemoteCountry(ctx context.Context) string {
+	if conn.Entity == nil || conn.Entity.IP == nil {
+		return ""
+	}
+
+	countryLookupLock.Lock()
+	lookup := countryLookup
+	countryLookupLock.Unlock()
+	if lookup != nil {
+		return lookupCountry(lookup, conn.Entity.IP)
+	}
+
+	country, _ := conn.Entity.GetCountry(ctx)
+	return country
+}
@@ -0,0 +1,82 @@
+package network
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/safing/portmaster/intel"
+)
+
+// mockCountryLookup returns known countries and counts the lookups.
+type mockCountryLookup struct {
+	countries map[string]string
+	lookups   int
+}
+
+func (m *mockCountryLookup) LookupCountry(ip net.IP) (string, bool) {
+	m.lookups++
+	country, ok := m.countries[ip.String()]
+	return country, ok
+}
+
+//nolint:paralleltest // Modifies global state.
+func TestRemoteCountry(t *testing.T) {
+	lookup := &mockCountryLookup{
+		countries: map[string]string{
+			"192.0.2.1":   "DE",
+			"2001:db8::1": "AT",
+		},
+	}
+	SetCountryLookup(lookup)
+	defer SetCountryLookup(nil)
+
+	newConn := func(ip string) *Connection {
+		return &Connection{Entity: &intel.Entity{IP: net.ParseIP(ip)}}
+	}
+
+	tests := []struct {
+		ip      string
+		country string
+	}{
+		{"192.0.2.1", "DE"},
+		{"2001:db8::1", "AT"},
+		{"198.51.100.1", ""},
+	}
+	for _, tt := range tests {
+		if country := newConn(tt.ip).RemoteCountry(context.Background()); country != tt.country {
+			t.Errorf("%s: expected country %q, got %q", tt.ip, tt.country, country)
+		}
+	}
+	if lookup.lookups != 3 {
+		t.Errorf("expected 3 lookups, got %d", lookup.lookups)
+	}
+
+	// Lookups are cached per IP, including unknown countries.
+	conn := newConn("192.0.2.1")
+	if conn.RemoteCountry(context.Background()) != "DE" || conn.RemoteCountry(context.Background()) != "DE" {
+		t.Error("cached country should be returned")
+	}
+	if newConn("198.51.100.1").RemoteCountry(context.Background()) != "" {
+		t.Error("cached unknown country should be returned")
+	}
+	if lookup.lookups != 3 {
+		t.Errorf("expected lookups to be cached, got %d lookups", lookup.lookups)
+	}
+
+	// Connections without remote IP have no country.
+	if country := (&Connection{}).RemoteCountry(context.Background()); country != "" {
+		t.Errorf("expected no country, got %q", country)
+	}
+
+	// By default, the country of the entity is used.
+	SetCountryLookup(nil)
+	conn = newConn("192.0.2.1")
+	conn.Entity.Country = "CH"
+	if country := conn.RemoteCountry(context.Background()); country != "CH" {
+		t.Errorf("expected country of the entity with default lookup, got %q", country)
+	}
+	if lookup.lookups != 3 {
+		t.Errorf("expected no lookups with default lookup, got %d lookups", lookup.lookups)
+	}
+}
@@ -0,0 +1,100 @@
+package network
+
+import (
+	"net"
+	"sync"
+
+	"github.com/safing/portmaster/netenv"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// DeviceIdentity identifies the device that a forwarded connection originates
+// from.
+type DeviceIdentity struct {
+	// Name is the name of the device, eg. the hostname of its DHCP lease.
+	Name string
+	// IP is the IP address of the device.
+	IP net.IP
+	// MAC is the hardware address of the device, if known.
+	MAC net.HardwareAddr
+}
+
+// DeviceIdentityResolver resolves the identity of the devices that forwarded
+// connections originate from, eg. via the lease table of a DHCP server.
+// Forwarded connections have no local process, so the device identity takes
+// its place for applying policy.
+type DeviceIdentityResolver interface {
+	// ResolveDeviceIdentity returns the identity of the device with the given
+	// source IP and whether it is known.
+	ResolveDeviceIdentity(ip net.IP) (identity *DeviceIdentity, ok bool)
+}
+
+var (
+	deviceIdentityResolver     DeviceIdentityResolver
+	deviceIdentityResolverLock sync.Mutex
+)
+
+// SetDeviceIdentityResolver sets the resolver that is used to find the device
+// identity of forwarded connections. Setting nil disables resolving device
+// identities.
+func SetDeviceIdentityResolver(resolver DeviceIdentityResolver) {
+	deviceIdentityResolverLock.Lock()
+	defer deviceIdentityResolverLock.Unlock()
+
+	deviceIdentityResolver = resolver
+}
+
+func getDeviceIdentityResolver() DeviceIdentityResolver {
+	deviceIdentityResolverLock.Lock()
+	defer deviceIdentityResolverLock.Unlock()
+
+	return deviceIdentityResolver
+}
+
+// isForwardedPacket returns whether the packet is forwarded by the host, ie.
+// neither its source nor its destination is an IP of the host.
+func isForwardedPacket(info *packet.Info) bool {
+	for _, ip := range []net.IP{info.Src, info.Dst} {
+		mine, err := netenv.IsMyIP(ip)
+		if err != nil || mine {
+			return false
+		}
+	}
+	return true
+}
+
+// sourceIP returns the IP the connection originates from.
+func (conn *Connection) sourceIP() net.IP {
+	if conn.Inbound {
+		if conn.Entity == nil {
+			return nil
+		}
+		return conn.Entity.IP
+	}
+	return conn.LocalIP
+}
+
+// DeviceIdentity returns the identity of the device that the connection
+// originates from, as found by the configured DeviceIdentityResolver, or nil
+// if it is not known. Only forwarded connections have a device identity. The
+// identity is resolved once per connection. The connection must be locked.
+func (conn *Connection) DeviceIdentity() *DeviceIdentity {
+	if !conn.Forwarded {
+		return nil
+	}
+
+	if !conn.deviceIdentityChecked {
+		resolver := getDeviceIdentityResolver()
+		if resolver == nil {
+			return nil
+		}
+
+		conn.deviceIdentityChecked = true
+		if ip := conn.sourceIP(); ip != nil {
+			if identity, ok := resolver.ResolveDeviceIdentity(ip); ok {
+				conn.deviceIdentity = identity
+			}
+		}
+	}
+	return conn.deviceIdentity
+}
@@ -0,0 +1,101 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"github.com/safing/portmaster/intel"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// mockDeviceIdentityResolver maps IPs to device names and counts the lookups.
+type mockDeviceIdentityResolver struct {
+	devices map[string]string
+	lookups int
+}
+
+func (m *mockDeviceIdentityResolver) ResolveDeviceIdentity(ip net.IP) (*DeviceIdentity, bool) {
+	m.lookups++
+	name, ok := m.devices[ip.String()]
+	if !ok {
+		return nil, false
+	}
+	return &DeviceIdentity{Name: name, IP: ip}, true
+}
+
+//nolint:paralleltest // Modifies global state.
+func TestDeviceIdentity(t *testing.T) {
+	resolver := &mockDeviceIdentityResolver{
+		devices: map[string]string{
+			"192.168.1.10": "laptop",
+			"192.168.1.11": "phone",
+		},
+	}
+	newConn := func(srcIP string, inbound, forwarded bool) *Connection {
+		conn := &Connection{
+			Inbound:   inbound,
+			Entity:    &intel.Entity{IP: net.ParseIP("203.0.113.1")},
+			Forwarded: forwarded,
+		}
+		if inbound {
+			conn.Entity.IP = net.ParseIP(srcIP)
+			conn.LocalIP = net.ParseIP("203.0.113.1")
+		} else {
+			conn.LocalIP = net.ParseIP(srcIP)
+		}
+		return conn
+	}
+
+	// Without a resolver, there is no identity.
+	if identity := newConn("192.168.1.10", true, true).DeviceIdentity(); identity != nil {
+		t.Errorf("unexpected identity without resolver: %+v", identity)
+	}
+
+	SetDeviceIdentityResolver(resolver)
+	defer SetDeviceIdentityResolver(nil)
+
+	tests := []struct {
+		srcIP     string
+		inbound   bool
+		forwarded bool
+		device    string
+	}{
+		{"192.168.1.10", true, true, "laptop"},
+		{"192.168.1.11", false, true, "phone"},
+		{"192.168.1.12", true, true, ""},
+		{"192.168.1.10", true, false, ""},
+	}
+	for _, test := range tests {
+		conn := newConn(test.srcIP, test.inbound, test.forwarded)
+		identity := conn.DeviceIdentity()
+		var device string
+		if identity != nil {
+			device = identity.Name
+		}
+		if device != test.device {
+			t.Errorf("%s (forwarded=%v): expected device %q, got %q", test.srcIP, test.forwarded, test.device, device)
+		}
+	}
+
+	// The identity is resolved once per connection.
+	lookups := resolver.lookups
+	conn := newConn("192.168.1.10", true, true)
+	conn.DeviceIdentity()
+	conn.DeviceIdentity()
+	if resolver.lookups != lookups+1 {
+		t.Errorf("expected 1 lookup, got %d", resolver.lookups-lookups)
+	}
+}
+
+func TestIsForwardedPacket(t *testing.T) {
+	t.Parallel()
+
+	local := &packet.Info{Src: net.IPv4(127, 0, 0, 1), Dst: net.IPv4(127, 0, 0, 2)}
+	if isForwardedPacket(local) {
+		t.Error("localhost packet should not be forwarded")
+	}
+	forwarded := &packet.Info{Src: net.IPv4(192, 0, 2, 1), Dst: net.IPv4(198, 51, 100, 1)}
+	if !isForwardedPacket(forwarded) {
+		t.Error("packet between foreign IPs should be forwarded")
+	}
+}
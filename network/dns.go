@@ -123,7 +123,8 @@ func (conn *Connection) ReplyWithDNS(ctx context.Context, request *dns.Msg) *dns
 	case VerdictFailed:
 		return nsutil.BlockIP().ReplyWithDNS(ctx, request)
 	case VerdictUndecided, VerdictUndeterminable,
-		VerdictAccept, VerdictRerouteToNameserver, VerdictRerouteToTunnel:
+		VerdictAccept, VerdictRerouteToNameserver, VerdictRerouteToTunnel,
+		VerdictAsk:
 		fallthrough
 	default:
 		reply := nsutil.ServerFailure().ReplyWithDNS(ctx, request)
@@ -141,7 +142,7 @@ func (conn *Connection) GetExtraRRs(ctx context.Context, request *dns.Msg) []dns
 		level = log.ErrorLevel
 	case VerdictUndecided, VerdictUndeterminable,
 		VerdictAccept, VerdictBlock, VerdictDrop,
-		VerdictRerouteToNameserver, VerdictRerouteToTunnel:
+		VerdictRerouteToNameserver, VerdictRerouteToTunnel, VerdictAsk:
 		fallthrough
 	default:
 		level = log.InfoLevel
@@ -0,0 +1,144 @@
+package packet
+
+import (
+	"fmt"
+	"net"
+)
+
+// ConntrackState describes the state of the connection as tracked by the
+// connection tracking of the OS.
+type ConntrackState uint8
+
+// Conntrack States.
+const (
+	// ConntrackStateUnknown is used when no conntrack information is available.
+	ConntrackStateUnknown ConntrackState = iota
+	// ConntrackStateNew is used for packets that start a new connection.
+	ConntrackStateNew
+	// ConntrackStateEstablished is used for packets of a known connection.
+	ConntrackStateEstablished
+	// ConntrackStateRelated is used for packets that start a new connection
+	// that is related to an existing one, eg. an FTP data connection.
+	ConntrackStateRelated
+	// ConntrackStateInvalid is used for packets that could not be attributed
+	// to a connection by the OS.
+	ConntrackStateInvalid
+	// ConntrackStateUntracked is used for packets that are excluded from
+	// connection tracking.
+	ConntrackStateUntracked
+)
+
+// String returns the string representation of the conntrack state.
+func (cs ConntrackState) String() string {
+	switch cs {
+	case ConntrackStateUnknown:
+		return "unknown"
+	case ConntrackStateNew:
+		return "new"
+	case ConntrackStateEstablished:
+		return "established"
+	case ConntrackStateRelated:
+		return "related"
+	case ConntrackStateInvalid:
+		return "invalid"
+	case ConntrackStateUntracked:
+		return "untracked"
+	default:
+		return fmt.Sprintf("<unknown conntrack state, %d>", uint8(cs))
+	}
+}
+
+// ConntrackInfo holds connection tracking information supplied by the OS
+// integration together with the packet.
+type ConntrackInfo struct {
+	// State is the conntrack state of the packet.
+	State ConntrackState
+	// Reply is set if the packet travels in the reply direction of the
+	// tracked connection.
+	Reply bool
+	// Zone is the conntrack zone of the connection. Zone 0 is the default zone.
+	Zone uint16
+	// Master holds the original tuple of the master connection, if the
+	// connection of the packet is related to another connection.
+	Master *ConntrackTuple
+	// OriginTuple and ReplyTuple describe the tracked connection in the
+	// original and the reply direction. If the addresses of the connection
+	// are translated (NAT), the reply tuple holds the translated addresses and
+	// is not the reverse of the original tuple.
+	OriginTuple *ConntrackTuple
+	ReplyTuple  *ConntrackTuple
+}
+
+// Translated returns whether the addresses or ports of the tracked connection
+// are translated (NAT).
+func (ctInfo *ConntrackInfo) Translated() bool {
+	return ctInfo.OriginTuple != nil &&
+		ctInfo.ReplyTuple != nil &&
+		!ctInfo.OriginTuple.Equal(ctInfo.ReplyTuple.Reverse())
+}
+
+// ConntrackTuple describes one direction of a tracked connection.
+type ConntrackTuple struct {
+	Protocol         IPProtocol
+	Src, Dst         net.IP
+	SrcPort, DstPort uint16
+}
+
+// Reverse returns the tuple of the opposite direction.
+func (t *ConntrackTuple) Reverse() *ConntrackTuple {
+	return &ConntrackTuple{
+		Protocol: t.Protocol,
+		Src:      t.Dst,
+		SrcPort:  t.DstPort,
+		Dst:      t.Src,
+		DstPort:  t.SrcPort,
+	}
+}
+
+// Equal returns whether both tuples describe the same direction of the same
+// connection.
+func (t *ConntrackTuple) Equal(other *ConntrackTuple) bool {
+	return t.Protocol == other.Protocol &&
+		t.SrcPort == other.SrcPort &&
+		t.DstPort == other.DstPort &&
+		t.Src.Equal(other.Src) &&
+		t.Dst.Equal(other.Dst)
+}
+
+// ConnectionIDs returns the possible connection IDs of a connection described
+// by the tuple. As the tuple does not carry the direction of the connection,
+// the IDs for an outbound (source is local) and an inbound (destination is
+// local) connection are returned.
+func (t *ConntrackTuple) ConnectionIDs() (outbound, inbound string) {
+	outPkt := &Base{info: Info{
+		Protocol: t.Protocol,
+		Src:      t.Src,
+		SrcPort:  t.SrcPort,
+		Dst:      t.Dst,
+		DstPort:  t.DstPort,
+	}}
+	inPkt := &Base{info: Info{
+		Inbound:  true,
+		Protocol: t.Protocol,
+		Src:      t.Src,
+		SrcPort:  t.SrcPort,
+		Dst:      t.Dst,
+		DstPort:  t.DstPort,
+	}}
+
+	return outPkt.GetConnectionID(), inPkt.GetConnectionID()
+}
+
+// ConntrackCounters holds the traffic counters of a tracked connection.
+type ConntrackCounters struct {
+	// Origin is the original tuple of the connection.
+	Origin ConntrackTuple
+	// OriginBytes is the amount of bytes sent in the original direction.
+	OriginBytes uint64
+	// ReplyBytes is the amount of bytes sent in the reply direction.
+	ReplyBytes uint64
+}
+
+func (t *ConntrackTuple) String() string {
+	return fmt.Sprintf("%s %s:%d -> %s:%d", t.Protocol, t.Src, t.SrcPort, t.Dst, t.DstPort)
+}
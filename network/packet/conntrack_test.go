@@ -0,0 +1,97 @@
+package packet
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTranslatedConnectionID(t *testing.T) {
+	t.Parallel()
+
+	// A forwarded connection of 192.168.1.10 that is translated (SNAT) to
+	// 203.0.113.1 on its way out.
+	ctInfo := &ConntrackInfo{
+		State: ConntrackStateEstablished,
+		OriginTuple: &ConntrackTuple{
+			Protocol: TCP,
+			Src:      net.IPv4(192, 168, 1, 10),
+			SrcPort:  40000,
+			Dst:      net.IPv4(93, 184, 216, 34),
+			DstPort:  443,
+		},
+		ReplyTuple: &ConntrackTuple{
+			Protocol: TCP,
+			Src:      net.IPv4(93, 184, 216, 34),
+			SrcPort:  443,
+			Dst:      net.IPv4(203, 0, 113, 1),
+			DstPort:  50000,
+		},
+	}
+	if !ctInfo.Translated() {
+		t.Fatal("connection should be translated")
+	}
+	replyInfo := *ctInfo
+	replyInfo.Reply = true
+
+	newPacket := func(ctInfo *ConntrackInfo, inbound bool, src net.IP, srcPort uint16, dst net.IP, dstPort uint16) *Base {
+		pkt := &Base{}
+		pkt.info = Info{
+			Inbound:  inbound,
+			Version:  IPv4,
+			Protocol: TCP,
+			Src:      src,
+			SrcPort:  srcPort,
+			Dst:      dst,
+			DstPort:  dstPort,
+		}
+		pkt.SetConntrackInfo(ctInfo)
+		return pkt
+	}
+	expectedID := "6-192.168.1.10-40000-93.184.216.34-443"
+	for _, test := range []struct {
+		name string
+		pkt  *Base
+	}{
+		{
+			name: "original direction before translation",
+			pkt:  newPacket(ctInfo, false, net.IPv4(192, 168, 1, 10), 40000, net.IPv4(93, 184, 216, 34), 443),
+		},
+		{
+			name: "original direction after translation",
+			pkt:  newPacket(ctInfo, false, net.IPv4(203, 0, 113, 1), 50000, net.IPv4(93, 184, 216, 34), 443),
+		},
+		{
+			name: "reply direction before translation",
+			pkt:  newPacket(&replyInfo, true, net.IPv4(93, 184, 216, 34), 443, net.IPv4(203, 0, 113, 1), 50000),
+		},
+		{
+			name: "reply direction after translation",
+			pkt:  newPacket(&replyInfo, true, net.IPv4(93, 184, 216, 34), 443, net.IPv4(192, 168, 1, 10), 40000),
+		},
+	} {
+		if id := test.pkt.GetConnectionID(); id != expectedID {
+			t.Errorf("%s: expected connection ID %s, got %s", test.name, expectedID, id)
+		}
+	}
+
+	// ICMP errors carry the conntrack information of the connection they refer
+	// to and must keep their own addresses.
+	icmpErr := newPacket(&replyInfo, true, net.IPv4(198, 51, 100, 1), 0, net.IPv4(203, 0, 113, 1), 0)
+	icmpErr.info.Protocol = ICMP
+	if id := icmpErr.GetConnectionID(); id != "1-203.0.113.1-198.51.100.1" {
+		t.Errorf("unexpected connection ID of ICMP error %s", id)
+	}
+
+	// Connections that are not translated keep the addresses of the packet.
+	untranslated := &ConntrackInfo{
+		State:       ConntrackStateEstablished,
+		OriginTuple: ctInfo.OriginTuple,
+		ReplyTuple:  ctInfo.OriginTuple.Reverse(),
+	}
+	if untranslated.Translated() {
+		t.Error("connection should not be translated")
+	}
+	if id := newPacket(untranslated, false, net.IPv4(192, 168, 1, 10), 40000, net.IPv4(93, 184, 216, 34), 443).GetConnectionID(); id != expectedID {
+		t.Errorf("unexpected connection ID of untranslated connection %s", id)
+	}
+}
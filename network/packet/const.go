@@ -48,6 +48,11 @@
 // ErrFailedToLoadPayload is returned by GetPayload if it failed for an unspecified reason, or is not implemented on the current system.
 var ErrFailedToLoadPayload = errors.New("could not load packet payload")
 
+// ErrVerdictTransient is returned by the verdict methods if the verdict could
+// not be applied because of a temporary failure. The verdict may be applied
+// again.
+var ErrVerdictTransient = errors.New("temporary failure while applying verdict")
+
 // ByteSize returns the byte size of the ip (IPv4 = 4 bytes, IPv6 = 16).
 func (v IPVersion) ByteSize() int {
 	switch v {
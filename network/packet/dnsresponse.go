@@ -0,0 +1,143 @@
+package packet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/miekg/dns"
+)
+
+// DNSResponseType defines which response is forged for a DNS query.
+type DNSResponseType string
+
+// DNS response types.
+const (
+	// DNSResponseNXDomain answers that the queried domain does not exist.
+	DNSResponseNXDomain DNSResponseType = "nxdomain"
+	// DNSResponseSinkhole answers A and AAAA queries with the unspecified
+	// address and other queries with an empty answer.
+	DNSResponseSinkhole DNSResponseType = "sinkhole"
+)
+
+// forgedDNSResponseTTL is the TTL of the records of forged DNS responses and
+// the TTL of their IP packet.
+const forgedDNSResponseTTL = 64
+
+// ForgeDNSResponse forges a response to the given raw IP packet, which must
+// hold a DNS query sent via UDP. The response is a raw IP packet with the
+// addresses and ports of the query swapped, the ID and question of the query
+// and recomputed checksums, so that it can be injected as if it was sent by
+// the queried server.
+func ForgeDNSResponse(queryData []byte, responseType DNSResponseType) ([]byte, error) {
+	if len(queryData) == 0 {
+		return nil, errors.New("empty packet")
+	}
+
+	// Parse packet.
+	var networkLayerType gopacket.LayerType
+	switch queryData[0] >> 4 {
+	case 4:
+		networkLayerType = layers.LayerTypeIPv4
+	case 6:
+		networkLayerType = layers.LayerTypeIPv6
+	default:
+		return nil, errors.New("unknown IP version")
+	}
+	// Limit the capacity to the packet, see Parse.
+	queryData = queryData[:len(queryData):len(queryData)]
+	pkt := gopacket.NewPacket(queryData, networkLayerType, gopacket.DecodeOptions{
+		Lazy:   true,
+		NoCopy: true,
+	})
+	udp, ok := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok {
+		return nil, errors.New("not a UDP packet")
+	}
+
+	// Parse query.
+	query := new(dns.Msg)
+	if err := query.Unpack(udp.Payload); err != nil {
+		return nil, fmt.Errorf("failed to parse DNS query: %w", err)
+	}
+	if query.Response || len(query.Question) == 0 {
+		return nil, errors.New("not a DNS query")
+	}
+
+	// Create response.
+	reply := new(dns.Msg)
+	reply.SetReply(query)
+	reply.RecursionAvailable = true
+	switch responseType {
+	case DNSResponseNXDomain:
+		reply.Rcode = dns.RcodeNameError
+	case DNSResponseSinkhole:
+		question := query.Question[0]
+		header := dns.RR_Header{
+			Name:   question.Name,
+			Rrtype: question.Qtype,
+			Class:  question.Qclass,
+			Ttl:    forgedDNSResponseTTL,
+		}
+		switch question.Qtype {
+		case dns.TypeA:
+			reply.Answer = []dns.RR{&dns.A{Hdr: header, A: net.IPv4zero}}
+		case dns.TypeAAAA:
+			reply.Answer = []dns.RR{&dns.AAAA{Hdr: header, AAAA: net.IPv6zero}}
+		}
+	default:
+		return nil, fmt.Errorf("unknown DNS response type %q", responseType)
+	}
+	replyData, err := reply.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack DNS response: %w", err)
+	}
+
+	// Create packet, swapping addresses and ports.
+	var networkLayer gopacket.NetworkLayer
+	switch ip := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		networkLayer = &layers.IPv4{
+			Version:  4,
+			IHL:      5,
+			TTL:      forgedDNSResponseTTL,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    ip.DstIP,
+			DstIP:    ip.SrcIP,
+		}
+	case *layers.IPv6:
+		networkLayer = &layers.IPv6{
+			Version:    6,
+			NextHeader: layers.IPProtocolUDP,
+			HopLimit:   forgedDNSResponseTTL,
+			SrcIP:      ip.DstIP,
+			DstIP:      ip.SrcIP,
+		}
+	default:
+		return nil, errors.New("failed to parse network layer")
+	}
+	replyUDP := &layers.UDP{
+		SrcPort: udp.DstPort,
+		DstPort: udp.SrcPort,
+	}
+	if err := replyUDP.SetNetworkLayerForChecksum(networkLayer); err != nil {
+		return nil, err
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	err = gopacket.SerializeLayers(buf, gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	},
+		networkLayer.(gopacket.SerializableLayer),
+		replyUDP,
+		gopacket.Payload(replyData),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize DNS response: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,239 @@
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/miekg/dns"
+)
+
+func TestForgeDNSResponse(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name         string
+		ipLayer      gopacket.SerializableLayer
+		qtype        uint16
+		responseType DNSResponseType
+		rcode        int
+		answer       net.IP
+	}{
+		{
+			name:         "IPv4 NXDOMAIN",
+			ipLayer:      testDNSQueryIPv4(),
+			qtype:        dns.TypeA,
+			responseType: DNSResponseNXDomain,
+			rcode:        dns.RcodeNameError,
+		},
+		{
+			name:         "IPv4 sinkhole",
+			ipLayer:      testDNSQueryIPv4(),
+			qtype:        dns.TypeA,
+			responseType: DNSResponseSinkhole,
+			rcode:        dns.RcodeSuccess,
+			answer:       net.IPv4zero,
+		},
+		{
+			name:         "IPv6 sinkhole",
+			ipLayer:      testDNSQueryIPv6(),
+			qtype:        dns.TypeAAAA,
+			responseType: DNSResponseSinkhole,
+			rcode:        dns.RcodeSuccess,
+			answer:       net.IPv6zero,
+		},
+		{
+			name:         "IPv6 sinkhole without address",
+			ipLayer:      testDNSQueryIPv6(),
+			qtype:        dns.TypeTXT,
+			responseType: DNSResponseSinkhole,
+			rcode:        dns.RcodeSuccess,
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			query := new(dns.Msg)
+			query.SetQuestion("blocked.example.com.", test.qtype)
+			query.Id = 4242
+			queryPayload, err := query.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			queryData := serializeLayers(t,
+				test.ipLayer,
+				&layers.UDP{SrcPort: 50000, DstPort: 53},
+				gopacket.Payload(queryPayload),
+			)
+
+			responseData, err := ForgeDNSResponse(queryData, test.responseType)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Check packet.
+			queryPkt := gopacket.NewPacket(queryData, test.ipLayer.LayerType(), gopacket.Default)
+			responsePkt := gopacket.NewPacket(responseData, test.ipLayer.LayerType(), gopacket.Default)
+			if errLayer := responsePkt.ErrorLayer(); errLayer != nil {
+				t.Fatal(errLayer.Error())
+			}
+			if responsePkt.NetworkLayer().NetworkFlow() != queryPkt.NetworkLayer().NetworkFlow().Reverse() {
+				t.Errorf("addresses not swapped: %s", responsePkt.NetworkLayer().NetworkFlow())
+			}
+			udp, ok := responsePkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+			if !ok {
+				t.Fatal("response is not a UDP packet")
+			}
+			if udp.SrcPort != 53 || udp.DstPort != 50000 {
+				t.Errorf("ports not swapped: %d -> %d", udp.SrcPort, udp.DstPort)
+			}
+			if !validUDPChecksum(responsePkt.NetworkLayer(), udp) {
+				t.Error("invalid UDP checksum")
+			}
+			if ip, ok := responsePkt.NetworkLayer().(*layers.IPv4); ok {
+				if internetChecksum(0, responseData[:ip.IHL*4]) != 0xffff {
+					t.Error("invalid IPv4 header checksum")
+				}
+			}
+
+			// Check response.
+			response := new(dns.Msg)
+			if err := response.Unpack(udp.Payload); err != nil {
+				t.Fatal(err)
+			}
+			if !response.Response || response.Id != query.Id {
+				t.Errorf("response does not match query ID: %d", response.Id)
+			}
+			if len(response.Question) != 1 || response.Question[0] != query.Question[0] {
+				t.Errorf("response does not match question: %v", response.Question)
+			}
+			if response.Rcode != test.rcode {
+				t.Errorf("unexpected rcode %s", dns.RcodeToString[response.Rcode])
+			}
+			switch {
+			case test.answer == nil && len(response.Answer) != 0:
+				t.Errorf("unexpected answer: %v", response.Answer)
+			case test.answer != nil && len(response.Answer) != 1:
+				t.Errorf("expected one answer, got %v", response.Answer)
+			case test.answer != nil:
+				var answer net.IP
+				switch rr := response.Answer[0].(type) {
+				case *dns.A:
+					answer = rr.A
+				case *dns.AAAA:
+					answer = rr.AAAA
+				}
+				if !answer.Equal(test.answer) || response.Answer[0].Header().Name != query.Question[0].Name {
+					t.Errorf("unexpected answer: %v", response.Answer[0])
+				}
+			}
+		})
+	}
+}
+
+func TestForgeDNSResponseInvalid(t *testing.T) {
+	t.Parallel()
+
+	// Not a DNS message.
+	data := serializeLayers(t,
+		testDNSQueryIPv4(),
+		&layers.UDP{SrcPort: 50000, DstPort: 53},
+		gopacket.Payload([]byte("not dns")),
+	)
+	if _, err := ForgeDNSResponse(data, DNSResponseNXDomain); err == nil {
+		t.Error("should fail for a non-DNS payload")
+	}
+
+	// DNS response.
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Response = true
+	payload, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = serializeLayers(t,
+		testDNSQueryIPv4(),
+		&layers.UDP{SrcPort: 53, DstPort: 50000},
+		gopacket.Payload(payload),
+	)
+	if _, err := ForgeDNSResponse(data, DNSResponseNXDomain); err == nil {
+		t.Error("should fail for a DNS response")
+	}
+
+	// Unknown response type.
+	msg.Response = false
+	payload, err = msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = serializeLayers(t,
+		testDNSQueryIPv4(),
+		&layers.UDP{SrcPort: 50000, DstPort: 53},
+		gopacket.Payload(payload),
+	)
+	if _, err := ForgeDNSResponse(data, "refused"); err == nil {
+		t.Error("should fail for an unknown response type")
+	}
+}
+
+func testDNSQueryIPv4() *layers.IPv4 {
+	return &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4(10, 0, 0, 1).To4(),
+		DstIP:    net.IPv4(9, 9, 9, 9).To4(),
+	}
+}
+
+func testDNSQueryIPv6() *layers.IPv6 {
+	return &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolUDP,
+		HopLimit:   64,
+		SrcIP:      net.ParseIP("fd00::1"),
+		DstIP:      net.ParseIP("2620:fe::fe"),
+	}
+}
+
+// validUDPChecksum checks the UDP checksum using the pseudo header of the
+// given network layer.
+func validUDPChecksum(networkLayer gopacket.NetworkLayer, udp *layers.UDP) bool {
+	var pseudoHeader []byte
+	data := append(append([]byte(nil), udp.Contents...), udp.Payload...)
+	switch ip := networkLayer.(type) {
+	case *layers.IPv4:
+		pseudoHeader = append(pseudoHeader, ip.SrcIP.To4()...)
+		pseudoHeader = append(pseudoHeader, ip.DstIP.To4()...)
+		pseudoHeader = append(pseudoHeader, 0, byte(layers.IPProtocolUDP))
+		pseudoHeader = binary.BigEndian.AppendUint16(pseudoHeader, uint16(len(data)))
+	case *layers.IPv6:
+		pseudoHeader = append(pseudoHeader, ip.SrcIP.To16()...)
+		pseudoHeader = append(pseudoHeader, ip.DstIP.To16()...)
+		pseudoHeader = binary.BigEndian.AppendUint32(pseudoHeader, uint32(len(data)))
+		pseudoHeader = append(pseudoHeader, 0, 0, 0, byte(layers.IPProtocolUDP))
+	default:
+		return false
+	}
+	return internetChecksum(internetChecksum(0, pseudoHeader), data) == 0xffff
+}
+
+// internetChecksum adds the data to the given one's complement sum.
+func internetChecksum(sum uint16, data []byte) uint16 {
+	acc := uint32(sum)
+	for i := 0; i+1 < len(data); i += 2 {
+		acc += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		acc += uint32(data[len(data)-1]) << 8
+	}
+	for acc > 0xffff {
+		acc = acc&0xffff + acc>>16
+	}
+	return uint16(acc)
+}
@@ -0,0 +1,32 @@
+package packet
+
+// ErrorDropCause classifies why a packet was dropped because of an internal
+// failure, as opposed to a drop that was decided by the rules.
+type ErrorDropCause string
+
+// Error drop causes.
+const (
+	// ErrorDropParse is used for packets that could not be parsed.
+	ErrorDropParse ErrorDropCause = "parse_error"
+	// ErrorDropQueueOverflow is used for packets that could not be queued to
+	// be handled, because the queue was full.
+	ErrorDropQueueOverflow ErrorDropCause = "queue_overflow"
+	// ErrorDropVerdictTimeout is used for packets that did not get a verdict
+	// in time.
+	ErrorDropVerdictTimeout ErrorDropCause = "verdict_timeout"
+	// ErrorDropEngine is used for packets that the verdict engine failed to
+	// handle.
+	ErrorDropEngine ErrorDropCause = "engine_error"
+	// ErrorDropResourceLimit is used for packets that were not handled,
+	// because a resource limit was reached.
+	ErrorDropResourceLimit ErrorDropCause = "resource_limit"
+)
+
+// ErrorDropCauses holds all error drop causes.
+var ErrorDropCauses = []ErrorDropCause{
+	ErrorDropParse,
+	ErrorDropQueueOverflow,
+	ErrorDropVerdictTimeout,
+	ErrorDropEngine,
+	ErrorDropResourceLimit,
+}
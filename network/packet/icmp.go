@@ -0,0 +1,222 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// ICMP and ICMPv6 error message types.
+const (
+	icmpv4TypeDestinationUnreachable = 3
+	icmpv4TypeTimeExceeded           = 11
+	icmpv4TypeParameterProblem       = 12
+	icmpv4CodeFragmentationNeeded    = 4
+
+	icmpv6TypeDestinationUnreachable = 1
+	icmpv6TypePacketTooBig           = 2
+	icmpv6TypeTimeExceeded           = 3
+	icmpv6TypeParameterProblem       = 4
+
+	icmpHeaderSize    = 8
+	ipv4MinHeaderSize = 20
+	ipv6HeaderSize    = 40
+)
+
+// ErrNotICMPError is returned by ParseICMPError if the packet is not an ICMP
+// or ICMPv6 error message.
+var ErrNotICMPError = errors.New("not an ICMP error message")
+
+// ICMPError describes an ICMP or ICMPv6 error message, such as destination
+// unreachable or time exceeded, together with the packet it was sent for.
+type ICMPError struct {
+	// Version is the IP version of the error message.
+	Version IPVersion
+	// Type and Code are the type and code of the error message.
+	Type, Code uint8
+	// MTU is the next-hop MTU reported by a packet too big message. It may be
+	// zero for IPv4 routers that do not report it.
+	MTU uint32
+	// Original describes the packet that caused the error, as embedded in the
+	// error message. As the original packet usually was sent by this host,
+	// the source is usually the local address.
+	Original *ConntrackTuple
+}
+
+// IsPacketTooBig returns whether the error message is used for path MTU
+// discovery: "Fragmentation Needed" for ICMP or "Packet Too Big" for ICMPv6.
+func (e *ICMPError) IsPacketTooBig() bool {
+	switch e.Version {
+	case IPv4:
+		return e.Type == icmpv4TypeDestinationUnreachable && e.Code == icmpv4CodeFragmentationNeeded
+	case IPv6:
+		return e.Type == icmpv6TypePacketTooBig
+	default:
+		return false
+	}
+}
+
+// ParseICMPError parses the given raw IP packet as an ICMP or ICMPv6 error
+// message, including the header of the original packet embedded in it.
+// ErrNotICMPError is returned if the packet is not an error message.
+func ParseICMPError(ipData []byte) (*ICMPError, error) {
+	if len(ipData) == 0 {
+		return nil, errors.New("empty packet")
+	}
+
+	var (
+		icmpErr  = &ICMPError{}
+		icmpData []byte
+		err      error
+	)
+	switch ipData[0] >> 4 {
+	case 4:
+		icmpErr.Version = IPv4
+		var protocol IPProtocol
+		protocol, _, _, icmpData, err = parseIPv4Header(ipData)
+		if err != nil {
+			return nil, err
+		}
+		if protocol != ICMP {
+			return nil, ErrNotICMPError
+		}
+	case 6:
+		icmpErr.Version = IPv6
+		var protocol IPProtocol
+		protocol, _, _, icmpData, err = parseIPv6Header(ipData)
+		if err != nil {
+			return nil, err
+		}
+		if protocol != ICMPv6 {
+			return nil, ErrNotICMPError
+		}
+	default:
+		return nil, errors.New("unknown IP version")
+	}
+
+	if len(icmpData) < icmpHeaderSize {
+		return nil, errors.New("ICMP message too short")
+	}
+	icmpErr.Type = icmpData[0]
+	icmpErr.Code = icmpData[1]
+	if !icmpErr.isError() {
+		return nil, ErrNotICMPError
+	}
+	if icmpErr.IsPacketTooBig() {
+		if icmpErr.Version == IPv4 {
+			icmpErr.MTU = uint32(binary.BigEndian.Uint16(icmpData[6:8]))
+		} else {
+			icmpErr.MTU = binary.BigEndian.Uint32(icmpData[4:8])
+		}
+	}
+
+	// Parse the embedded original packet.
+	icmpErr.Original, err = parseEmbeddedPacket(icmpErr.Version, icmpData[icmpHeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	return icmpErr, nil
+}
+
+func (e *ICMPError) isError() bool {
+	switch e.Version {
+	case IPv4:
+		switch e.Type {
+		case icmpv4TypeDestinationUnreachable, icmpv4TypeTimeExceeded, icmpv4TypeParameterProblem:
+			return true
+		}
+	case IPv6:
+		switch e.Type {
+		case icmpv6TypeDestinationUnreachable, icmpv6TypePacketTooBig, icmpv6TypeTimeExceeded, icmpv6TypeParameterProblem:
+			return true
+		}
+	}
+	return false
+}
+
+// parseEmbeddedPacket parses the original packet embedded in an ICMP error
+// message. This is the full IP header and at least the first 8 bytes of the
+// payload, which include the ports of TCP and UDP.
+func parseEmbeddedPacket(version IPVersion, data []byte) (*ConntrackTuple, error) {
+	var (
+		protocol IPProtocol
+		src, dst net.IP
+		payload  []byte
+		err      error
+	)
+	switch version {
+	case IPv4:
+		protocol, src, dst, payload, err = parseIPv4Header(data)
+	case IPv6:
+		protocol, src, dst, payload, err = parseIPv6Header(data)
+	}
+	if err != nil {
+		return nil, errors.New("invalid embedded packet: " + err.Error())
+	}
+
+	// Copy the addresses, as the packet data may be reused.
+	tuple := &ConntrackTuple{
+		Protocol: protocol,
+		Src:      append(net.IP(nil), src...),
+		Dst:      append(net.IP(nil), dst...),
+	}
+	switch protocol { //nolint:exhaustive // Only protocols with ports are relevant.
+	case TCP, UDP, UDPLite:
+		if len(payload) < 4 {
+			return nil, errors.New("embedded packet too short for ports")
+		}
+		tuple.SrcPort = binary.BigEndian.Uint16(payload[0:2])
+		tuple.DstPort = binary.BigEndian.Uint16(payload[2:4])
+	}
+
+	return tuple, nil
+}
+
+// parseIPv4Header parses an IPv4 header and returns the payload. The payload
+// may be truncated, as is the case for embedded packets.
+func parseIPv4Header(data []byte) (protocol IPProtocol, src, dst net.IP, payload []byte, err error) {
+	if len(data) < ipv4MinHeaderSize || data[0]>>4 != 4 {
+		return 0, nil, nil, nil, errors.New("invalid IPv4 header")
+	}
+	headerLen := int(data[0]&0x0f) * 4
+	if headerLen < ipv4MinHeaderSize || headerLen > len(data) {
+		return 0, nil, nil, nil, errors.New("invalid IPv4 header length")
+	}
+
+	return IPProtocol(data[9]), net.IP(data[12:16]), net.IP(data[16:20]), data[headerLen:], nil
+}
+
+// parseIPv6Header parses an IPv6 header, skipping any extension headers, and
+// returns the payload. The payload may be truncated, as is the case for
+// embedded packets.
+func parseIPv6Header(data []byte) (protocol IPProtocol, src, dst net.IP, payload []byte, err error) {
+	if len(data) < ipv6HeaderSize || data[0]>>4 != 6 {
+		return 0, nil, nil, nil, errors.New("invalid IPv6 header")
+	}
+
+	nextHeader := data[6]
+	payload = data[ipv6HeaderSize:]
+	for {
+		switch nextHeader {
+		case 0, 43, 60: // Hop-by-Hop, Routing, Destination Options
+			if len(payload) < 8 {
+				return 0, nil, nil, nil, errors.New("invalid IPv6 extension header")
+			}
+			extLen := (int(payload[1]) + 1) * 8
+			if extLen > len(payload) {
+				return 0, nil, nil, nil, errors.New("invalid IPv6 extension header length")
+			}
+			nextHeader = payload[0]
+			payload = payload[extLen:]
+		case 44: // Fragment
+			if len(payload) < 8 {
+				return 0, nil, nil, nil, errors.New("invalid IPv6 fragment header")
+			}
+			nextHeader = payload[0]
+			payload = payload[8:]
+		default:
+			return IPProtocol(nextHeader), net.IP(data[8:24]), net.IP(data[24:40]), payload, nil
+		}
+	}
+}
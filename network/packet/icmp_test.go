@@ -0,0 +1,212 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestParseICMPErrorFragmentationNeeded(t *testing.T) {
+	t.Parallel()
+
+	// Original packet, sent by this host.
+	original := serializeLayers(t,
+		&layers.IPv4{
+			Version:  4,
+			IHL:      5,
+			TTL:      64,
+			Flags:    layers.IPv4DontFragment,
+			Protocol: layers.IPProtocolTCP,
+			SrcIP:    net.IPv4(10, 0, 0, 1),
+			DstIP:    net.IPv4(203, 0, 113, 5),
+		},
+		&layers.TCP{
+			SrcPort: 50000,
+			DstPort: 443,
+			SYN:     true,
+		},
+	)
+
+	// Fragmentation Needed with a next-hop MTU of 1400, embedding the IP
+	// header and the first 8 bytes of the original packet.
+	icmpMsg := []byte{icmpv4TypeDestinationUnreachable, icmpv4CodeFragmentationNeeded, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(icmpMsg[6:8], 1400)
+	icmpMsg = append(icmpMsg, original[:28]...)
+
+	ipData := serializeLayers(t,
+		&layers.IPv4{
+			Version:  4,
+			IHL:      5,
+			TTL:      64,
+			Protocol: layers.IPProtocolICMPv4,
+			SrcIP:    net.IPv4(192, 0, 2, 254),
+			DstIP:    net.IPv4(10, 0, 0, 1),
+		},
+		gopacket.Payload(icmpMsg),
+	)
+
+	icmpErr, err := ParseICMPError(ipData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !icmpErr.IsPacketTooBig() {
+		t.Error("fragmentation needed should be detected as packet too big")
+	}
+	if icmpErr.MTU != 1400 {
+		t.Errorf("unexpected MTU %d", icmpErr.MTU)
+	}
+	checkOriginal(t, icmpErr.Original, &ConntrackTuple{
+		Protocol: TCP,
+		Src:      net.IPv4(10, 0, 0, 1),
+		SrcPort:  50000,
+		Dst:      net.IPv4(203, 0, 113, 5),
+		DstPort:  443,
+	})
+
+	// The connection ID must match the connection of the original packet.
+	outboundID, _ := icmpErr.Original.ConnectionIDs()
+	originalPkt := &Base{}
+	if err := Parse(original, originalPkt); err != nil {
+		t.Fatal(err)
+	}
+	if outboundID != originalPkt.GetConnectionID() {
+		t.Errorf("connection ID %s does not match original connection %s", outboundID, originalPkt.GetConnectionID())
+	}
+}
+
+func TestParseICMPErrorPacketTooBig(t *testing.T) {
+	t.Parallel()
+
+	src := net.ParseIP("2001:db8::1")
+	dst := net.ParseIP("2001:db8:1::5")
+	original := serializeLayers(t,
+		&layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolUDP,
+			SrcIP:      src,
+			DstIP:      dst,
+		},
+		&layers.UDP{
+			SrcPort: 40000,
+			DstPort: 4433,
+		},
+	)
+
+	icmpMsg := []byte{icmpv6TypePacketTooBig, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(icmpMsg[4:8], 1280)
+	icmpMsg = append(icmpMsg, original...)
+
+	ipData := serializeLayers(t,
+		&layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolICMPv6,
+			SrcIP:      net.ParseIP("2001:db8::fe"),
+			DstIP:      src,
+		},
+		gopacket.Payload(icmpMsg),
+	)
+
+	icmpErr, err := ParseICMPError(ipData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !icmpErr.IsPacketTooBig() || icmpErr.MTU != 1280 {
+		t.Errorf("unexpected packet too big message: %+v", icmpErr)
+	}
+	checkOriginal(t, icmpErr.Original, &ConntrackTuple{
+		Protocol: UDP,
+		Src:      src,
+		SrcPort:  40000,
+		Dst:      dst,
+		DstPort:  4433,
+	})
+}
+
+func TestParseICMPErrorNoError(t *testing.T) {
+	t.Parallel()
+
+	// Echo requests are not error messages.
+	ipData := serializeLayers(t,
+		&layers.IPv4{
+			Version:  4,
+			IHL:      5,
+			TTL:      64,
+			Protocol: layers.IPProtocolICMPv4,
+			SrcIP:    net.IPv4(10, 0, 0, 1),
+			DstIP:    net.IPv4(192, 0, 2, 1),
+		},
+		gopacket.Payload([]byte{8, 0, 0, 0, 0, 1, 0, 1}),
+	)
+	if _, err := ParseICMPError(ipData); !errors.Is(err, ErrNotICMPError) {
+		t.Errorf("expected ErrNotICMPError, got %v", err)
+	}
+
+	// Neither are other protocols.
+	if _, err := ParseICMPError(buildUDPPacket(t)); !errors.Is(err, ErrNotICMPError) {
+		t.Errorf("expected ErrNotICMPError, got %v", err)
+	}
+
+	// Truncated embedded packets are rejected.
+	ipData = serializeLayers(t,
+		&layers.IPv4{
+			Version:  4,
+			IHL:      5,
+			TTL:      64,
+			Protocol: layers.IPProtocolICMPv4,
+			SrcIP:    net.IPv4(192, 0, 2, 254),
+			DstIP:    net.IPv4(10, 0, 0, 1),
+		},
+		gopacket.Payload([]byte{icmpv4TypeTimeExceeded, 0, 0, 0, 0, 0, 0, 0, 0x45, 0}),
+	)
+	if _, err := ParseICMPError(ipData); err == nil || errors.Is(err, ErrNotICMPError) {
+		t.Errorf("expected error for truncated embedded packet, got %v", err)
+	}
+}
+
+func serializeLayers(t *testing.T, serializableLayers ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+
+	for _, layer := range serializableLayers {
+		switch l := layer.(type) {
+		case *layers.TCP:
+			if ip, ok := serializableLayers[0].(gopacket.NetworkLayer); ok {
+				_ = l.SetNetworkLayerForChecksum(ip)
+			}
+		case *layers.UDP:
+			if ip, ok := serializableLayers[0].(gopacket.NetworkLayer); ok {
+				_ = l.SetNetworkLayerForChecksum(ip)
+			}
+		}
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}, serializableLayers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func checkOriginal(t *testing.T, original, expected *ConntrackTuple) {
+	t.Helper()
+
+	if original == nil {
+		t.Fatal("missing original packet")
+	}
+	if original.Protocol != expected.Protocol ||
+		!original.Src.Equal(expected.Src) ||
+		original.SrcPort != expected.SrcPort ||
+		!original.Dst.Equal(expected.Dst) ||
+		original.DstPort != expected.DstPort {
+		t.Errorf("unexpected original packet %s, expected %s", original, expected)
+	}
+}
@@ -4,6 +4,7 @@
 	"context"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/google/gopacket"
 )
@@ -12,7 +13,13 @@
 type Base struct {
 	ctx        context.Context
 	info       Info
+	timing     Timing
+	ctInfo     *ConntrackInfo
 	connID     string
+	vlanID     uint16
+	originUID  *uint32
+	originGID  *uint32
+	originCtx  string
 	layers     gopacket.Packet
 	layer3Data []byte
 	layer5Data []byte
@@ -39,6 +46,21 @@ func (pkt *Base) Info() *Info {
 	return &pkt.info
 }
 
+// Timing holds timing information about the handling of a packet.
+type Timing struct {
+	// Dequeued is the time the packet was taken from the interception queue
+	// for handling.
+	Dequeued time.Time
+	// WaitedForUser is set if handling the packet waited for a decision of
+	// the user, eg. a prompt.
+	WaitedForUser bool
+}
+
+// Timing returns the timing information of the packet handling.
+func (pkt *Base) Timing() *Timing {
+	return &pkt.timing
+}
+
 // SetPacketInfo sets a new packet Info. This must only used when initializing the packet structure.
 func (pkt *Base) SetPacketInfo(packetInfo Info) {
 	pkt.info = packetInfo
@@ -54,6 +76,73 @@ func (pkt *Base) SetOutbound() {
 	pkt.info.Inbound = false
 }
 
+// SetConntrackInfo sets the conntrack information of the packet. This must only used when initializing the packet structure.
+func (pkt *Base) SetConntrackInfo(ctInfo *ConntrackInfo) {
+	pkt.ctInfo = ctInfo
+}
+
+// ConntrackInfo returns the conntrack information of the packet, if available.
+func (pkt *Base) ConntrackInfo() *ConntrackInfo {
+	return pkt.ctInfo
+}
+
+// ConntrackState returns the conntrack state of the packet.
+// It returns ConntrackStateUnknown if no conntrack information is available.
+func (pkt *Base) ConntrackState() ConntrackState {
+	if pkt.ctInfo == nil {
+		return ConntrackStateUnknown
+	}
+	return pkt.ctInfo.State
+}
+
+// SetOrigin sets the user and group ID of the socket that sent the packet.
+// Either may be nil if unknown. This must only used when initializing the packet structure.
+func (pkt *Base) SetOrigin(uid, gid *uint32) {
+	pkt.originUID = uid
+	pkt.originGID = gid
+}
+
+// OriginUID returns the user ID of the socket that sent the packet. It is
+// only available for locally generated packets and if supported by the OS
+// integration.
+func (pkt *Base) OriginUID() (uid uint32, ok bool) {
+	if pkt.originUID == nil {
+		return 0, false
+	}
+	return *pkt.originUID, true
+}
+
+// OriginGID returns the group ID of the socket that sent the packet. It is
+// only available for locally generated packets and if supported by the OS
+// integration.
+func (pkt *Base) OriginGID() (gid uint32, ok bool) {
+	if pkt.originGID == nil {
+		return 0, false
+	}
+	return *pkt.originGID, true
+}
+
+// SetOriginSecurityContext sets the security context, eg. the SELinux label,
+// of the socket that sent the packet. An empty string means unknown. This must
+// only used when initializing the packet structure.
+func (pkt *Base) SetOriginSecurityContext(secCtx string) {
+	pkt.originCtx = secCtx
+}
+
+// OriginSecurityContext returns the security context, eg. the SELinux label,
+// of the socket that sent the packet. It is only available for locally
+// generated packets and if supported by the OS integration and an active
+// security module.
+func (pkt *Base) OriginSecurityContext() (secCtx string, ok bool) {
+	return pkt.originCtx, pkt.originCtx != ""
+}
+
+// VLANID returns the VLAN ID of the outermost VLAN tag the packet was
+// received with. It returns 0 if the packet was not VLAN tagged.
+func (pkt *Base) VLANID() uint16 {
+	return pkt.vlanID
+}
+
 // IsInbound checks if the packet is inbound.
 func (pkt *Base) IsInbound() bool {
 	return pkt.info.Inbound
@@ -107,21 +196,59 @@ func (pkt *Base) GetConnectionID() string {
 }
 
 func (pkt *Base) createConnectionID() {
-	if pkt.info.Protocol == TCP || pkt.info.Protocol == UDP {
-		if pkt.info.Inbound {
-			pkt.connID = fmt.Sprintf("%d-%s-%d-%s-%d", pkt.info.Protocol, pkt.info.Dst, pkt.info.DstPort, pkt.info.Src, pkt.info.SrcPort)
+	// Use the addresses before the translation (NAT), so that the packets of
+	// both directions belong to the same connection, no matter whether they
+	// were seen before or after being translated.
+	info := pkt.info
+	if tuple := pkt.untranslatedTuple(); tuple != nil {
+		info.Src, info.SrcPort = tuple.Src, tuple.SrcPort
+		info.Dst, info.DstPort = tuple.Dst, tuple.DstPort
+	}
+
+	if info.Protocol == TCP || info.Protocol == UDP {
+		if info.Inbound {
+			pkt.connID = fmt.Sprintf("%d-%s-%d-%s-%d", info.Protocol, info.Dst, info.DstPort, info.Src, info.SrcPort)
 		} else {
-			pkt.connID = fmt.Sprintf("%d-%s-%d-%s-%d", pkt.info.Protocol, pkt.info.Src, pkt.info.SrcPort, pkt.info.Dst, pkt.info.DstPort)
+			pkt.connID = fmt.Sprintf("%d-%s-%d-%s-%d", info.Protocol, info.Src, info.SrcPort, info.Dst, info.DstPort)
 		}
 	} else {
-		if pkt.info.Inbound {
-			pkt.connID = fmt.Sprintf("%d-%s-%s", pkt.info.Protocol, pkt.info.Dst, pkt.info.Src)
+		if info.Inbound {
+			pkt.connID = fmt.Sprintf("%d-%s-%s", info.Protocol, info.Dst, info.Src)
 		} else {
-			pkt.connID = fmt.Sprintf("%d-%s-%s", pkt.info.Protocol, pkt.info.Src, pkt.info.Dst)
+			pkt.connID = fmt.Sprintf("%d-%s-%s", info.Protocol, info.Src, info.Dst)
 		}
 	}
 }
 
+// untranslatedTuple returns the addresses of the packet before they were
+// translated (NAT), if the packet was seen with translated addresses: Packets
+// in the original direction after the translation, and packets in the reply
+// direction before the translation is reversed. It returns nil otherwise.
+func (pkt *Base) untranslatedTuple() *ConntrackTuple {
+	ctInfo := pkt.ctInfo
+	// The conntrack information of ICMP errors describes the connection they
+	// refer to, which is why the protocol must match.
+	if ctInfo == nil || !ctInfo.Translated() || ctInfo.OriginTuple.Protocol != pkt.info.Protocol {
+		return nil
+	}
+
+	seen := &ConntrackTuple{
+		Protocol: pkt.info.Protocol,
+		Src:      pkt.info.Src,
+		SrcPort:  pkt.info.SrcPort,
+		Dst:      pkt.info.Dst,
+		DstPort:  pkt.info.DstPort,
+	}
+	switch {
+	case ctInfo.Reply && seen.Equal(ctInfo.ReplyTuple):
+		return ctInfo.OriginTuple.Reverse()
+	case !ctInfo.Reply && seen.Equal(ctInfo.ReplyTuple.Reverse()):
+		return ctInfo.OriginTuple
+	default:
+		return nil
+	}
+}
+
 // MatchesAddress checks if a the packet matches a given endpoint (remote or local) in protocol, network and port.
 //
 // Comparison matrix:
@@ -241,7 +368,14 @@ type Packet interface {
 	SetCtx(context.Context)
 	Ctx() context.Context
 	Info() *Info
+	Timing() *Timing
 	SetPacketInfo(Info)
+	ConntrackInfo() *ConntrackInfo
+	ConntrackState() ConntrackState
+	VLANID() uint16
+	OriginUID() (uint32, bool)
+	OriginGID() (uint32, bool)
+	OriginSecurityContext() (string, bool)
 	IsInbound() bool
 	IsOutbound() bool
 	SetInbound()
@@ -46,3 +46,17 @@ func (pi *Info) RemotePort() uint16 {
 	}
 	return pi.DstPort
 }
+
+// IsMulticast returns whether the packet is sent to a multicast group, ie.
+// whether its destination is in 224.0.0.0/4 or ff00::/8.
+func (pi *Info) IsMulticast() bool {
+	return pi.Dst.IsMulticast()
+}
+
+// IsBroadcast returns whether the packet is sent to the limited broadcast
+// address 255.255.255.255. Broadcasts to the broadcast address of a subnet can
+// only be recognized with knowledge of the network, see
+// netutils.GetBroadcastAddress.
+func (pi *Info) IsBroadcast() bool {
+	return pi.Dst.Equal(net.IPv4bcast)
+}
@@ -0,0 +1,39 @@
+package packet
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMulticastAndBroadcast(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		dst       string
+		multicast bool
+		broadcast bool
+	}{
+		{dst: "224.0.0.251", multicast: true},     // mDNS
+		{dst: "239.255.255.250", multicast: true}, // SSDP
+		{dst: "239.255.255.255", multicast: true},
+		{dst: "ff02::fb", multicast: true},  // mDNS
+		{dst: "ff02::1:2", multicast: true}, // DHCPv6
+		{dst: "ff0e::c", multicast: true},   // SSDP
+		{dst: "255.255.255.255", broadcast: true},
+		{dst: "192.168.1.255"}, // Subnet broadcast needs the network.
+		{dst: "223.255.255.255"},
+		{dst: "240.0.0.1"},
+		{dst: "1.1.1.1"},
+		{dst: "fe80::1"},
+		{dst: "2001:db8::1"},
+	}
+	for _, test := range tests {
+		info := &Info{Dst: net.ParseIP(test.dst)}
+		if info.IsMulticast() != test.multicast {
+			t.Errorf("%s: expected multicast to be %v", test.dst, test.multicast)
+		}
+		if info.IsBroadcast() != test.broadcast {
+			t.Errorf("%s: expected broadcast to be %v", test.dst, test.broadcast)
+		}
+	}
+}
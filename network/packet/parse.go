@@ -1,6 +1,7 @@
 package packet
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 
@@ -8,6 +9,23 @@
 	"github.com/google/gopacket/layers"
 )
 
+// maxVLANTags is the maximum amount of stacked VLAN tags that are stripped
+// from a packet. Two tags cover double-tagged (QinQ) frames.
+const maxVLANTags = 2
+
+// VLAN tag and EtherType values.
+const (
+	tpid8021Q      = 0x8100
+	tpid8021AD     = 0x88a8
+	tpidQinQLegacy = 0x9100
+
+	vlanTagSize   = 4
+	etherTypeSize = 2
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86DD
+	vlanIDMask    = 0x0fff
+)
+
 var layerType2IPProtocol map[gopacket.LayerType]IPProtocol
 
 func genIPProtocolFromLayerType() {
@@ -36,6 +54,12 @@ func parseIPv6(packet gopacket.Packet, info *Info) error {
 		// UDP layers are detected (somewhere in the list of options)
 		// the Protocol field is adjusted correctly.
 		info.Protocol = IPProtocol(ipv6.NextHeader)
+		// The decoders stop at some extension headers, such as the fragment
+		// header, so take the protocol from the end of the extension header
+		// chain, if it is complete.
+		if protocol, _, _, _, err := parseIPv6Header(packet.Data()); err == nil {
+			info.Protocol = protocol
+		}
 	}
 	return nil
 }
@@ -106,11 +130,68 @@ func checkError(packet gopacket.Packet, info *Info) error {
 	return nil
 }
 
+func isVLANTPID(tpid uint16) bool {
+	switch tpid {
+	case tpid8021Q, tpid8021AD, tpidQinQLegacy:
+		return true
+	default:
+		return false
+	}
+}
+
+// stripVLANTags removes up to maxVLANTags stacked 802.1Q/802.1ad tags and the
+// following EtherType from the start of the packet data. It returns the
+// remaining IP packet data and the VLAN ID of the outermost tag. Packet data
+// without a VLAN tag is returned unchanged with a VLAN ID of 0.
+func stripVLANTags(packetData []byte) (ipData []byte, vlanID uint16, err error) {
+	var tags int
+	for len(packetData) >= etherTypeSize && isVLANTPID(binary.BigEndian.Uint16(packetData)) {
+		if tags >= maxVLANTags {
+			return nil, 0, fmt.Errorf("packet has more than %d VLAN tags", maxVLANTags)
+		}
+		if len(packetData) < vlanTagSize+etherTypeSize {
+			return nil, 0, errors.New("truncated VLAN tag")
+		}
+		if tags == 0 {
+			vlanID = binary.BigEndian.Uint16(packetData[2:4]) & vlanIDMask
+		}
+		packetData = packetData[vlanTagSize:]
+		tags++
+	}
+	if tags == 0 {
+		return packetData, 0, nil
+	}
+
+	// Remove the EtherType of the encapsulated packet.
+	switch etherType := binary.BigEndian.Uint16(packetData); etherType {
+	case etherTypeIPv4, etherTypeIPv6:
+		return packetData[etherTypeSize:], vlanID, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported VLAN encapsulated EtherType: %04x", etherType)
+	}
+}
+
 // Parse parses an IP packet and saves the information in the given packet object.
+// Packets carrying VLAN tags are stripped of them before parsing.
+// Packets whose header lengths are inconsistent with each other or with the
+// captured data are rejected with a *ParseError.
 func Parse(packetData []byte, pktBase *Base) (err error) {
 	if len(packetData) == 0 {
 		return errors.New("empty packet")
 	}
+
+	packetData, pktBase.vlanID, err = stripVLANTags(packetData)
+	if err != nil {
+		return err
+	}
+	if len(packetData) == 0 {
+		return errors.New("empty packet")
+	}
+	// Limit the capacity to the packet, as the decoders slice the data by the
+	// lengths declared in the headers. Slicing beyond the capacity fails,
+	// while slicing beyond the length would read unrelated data, such as
+	// leftovers of earlier packets in a reused buffer.
+	packetData = packetData[:len(packetData):len(packetData)]
 	pktBase.layer3Data = packetData
 
 	ipVersion := packetData[0] >> 4
@@ -124,6 +205,11 @@ func Parse(packetData []byte, pktBase *Base) (err error) {
 	default:
 		return fmt.Errorf("unknown IP version or network protocol: %02x", ipVersion)
 	}
+	// Reject packets with inconsistent header lengths before decoding, so
+	// that they are not parsed at the wrong offsets.
+	if err := validateHeaders(packetData); err != nil {
+		return err
+	}
 
 	packet := gopacket.NewPacket(packetData, networkLayerType, gopacket.DecodeOptions{
 		Lazy:   true,
@@ -0,0 +1,217 @@
+package packet
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func buildUDPPacket(t *testing.T) []byte {
+	t.Helper()
+
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4(10, 0, 0, 1),
+		DstIP:    net.IPv4(192, 0, 2, 1),
+	}
+	udp := &layers.UDP{
+		SrcPort: 50000,
+		DstPort: 5000,
+	}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}, ip, udp, gopacket.Payload([]byte("test")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// vlanTag returns a VLAN tag with the given TPID and VLAN ID.
+func vlanTag(tpid, vlanID uint16) []byte {
+	return []byte{byte(tpid >> 8), byte(tpid), byte(vlanID >> 8), byte(vlanID)}
+}
+
+func checkParsedUDPPacket(t *testing.T, pkt *Base, expectedVLANID uint16) {
+	t.Helper()
+
+	info := pkt.Info()
+	if info.Version != IPv4 || info.Protocol != UDP {
+		t.Errorf("unexpected version or protocol: %s %s", info.Version, info.Protocol)
+	}
+	if !info.Src.Equal(net.IPv4(10, 0, 0, 1)) || !info.Dst.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("unexpected addresses: %s -> %s", info.Src, info.Dst)
+	}
+	if info.SrcPort != 50000 || info.DstPort != 5000 {
+		t.Errorf("unexpected ports: %d -> %d", info.SrcPort, info.DstPort)
+	}
+	if string(pkt.Payload()) != "test" {
+		t.Errorf("unexpected payload: %q", pkt.Payload())
+	}
+	if pkt.VLANID() != expectedVLANID {
+		t.Errorf("unexpected VLAN ID: got %d, expected %d", pkt.VLANID(), expectedVLANID)
+	}
+}
+
+func TestParseVLAN(t *testing.T) {
+	t.Parallel()
+
+	ipData := buildUDPPacket(t)
+	etherType := []byte{0x08, 0x00}
+
+	// Untagged.
+	pkt := &Base{}
+	if err := Parse(ipData, pkt); err != nil {
+		t.Fatal(err)
+	}
+	checkParsedUDPPacket(t, pkt, 0)
+
+	// Single tag.
+	data := append(append(vlanTag(tpid8021Q, 100), etherType...), ipData...)
+	pkt = &Base{}
+	if err := Parse(data, pkt); err != nil {
+		t.Fatal(err)
+	}
+	checkParsedUDPPacket(t, pkt, 100)
+	if len(pkt.Raw()) != len(ipData) {
+		t.Errorf("raw data still contains VLAN tag: %d bytes instead of %d", len(pkt.Raw()), len(ipData))
+	}
+
+	// Double tag (QinQ), with priority bits set on the outer tag.
+	data = append(vlanTag(tpid8021AD, 0xE000|200), vlanTag(tpid8021Q, 100)...)
+	data = append(append(data, etherType...), ipData...)
+	pkt = &Base{}
+	if err := Parse(data, pkt); err != nil {
+		t.Fatal(err)
+	}
+	checkParsedUDPPacket(t, pkt, 200)
+
+	// Too many tags.
+	data = append(vlanTag(tpid8021AD, 300), vlanTag(tpid8021AD, 200)...)
+	data = append(data, vlanTag(tpid8021Q, 100)...)
+	data = append(append(data, etherType...), ipData...)
+	if err := Parse(data, &Base{}); err == nil {
+		t.Error("expected error for packet with too many VLAN tags")
+	}
+
+	// Truncated tag.
+	if err := Parse(vlanTag(tpid8021Q, 100)[:3], &Base{}); err == nil {
+		t.Error("expected error for truncated VLAN tag")
+	}
+
+	// Unsupported encapsulated EtherType.
+	data = append(append(vlanTag(tpid8021Q, 100), 0x08, 0x06), ipData...)
+	if err := Parse(data, &Base{}); err == nil {
+		t.Error("expected error for unsupported encapsulated EtherType")
+	}
+}
+
+// FuzzParse feeds arbitrary data to the parsers of raw packets, which must
+// return an error for malformed input instead of panicking. The seed corpus in
+// testdata/fuzz/FuzzParse holds TCP, UDP, ICMP and ICMPv6 packets, IPv6
+// packets with extension header chains and VLAN tagged packets.
+func FuzzParse(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Keep a copy, as parsing must not modify the packet data.
+		original := append([]byte(nil), data...)
+		// Parse from a buffer with spare capacity, as packets are usually
+		// read into larger buffers, and decoders that slice beyond the packet
+		// would return the spare data instead of failing.
+		data = append(make([]byte, 0, len(data)+0x10000), data...)
+
+		pkt := &Base{}
+		err := Parse(data, pkt)
+		if string(data) != string(original) {
+			t.Fatal("parsing modified the packet data")
+		}
+		if err == nil {
+			info := pkt.Info()
+			if info.Version != IPv4 && info.Version != IPv6 {
+				t.Fatalf("parsed packet without IP version: %s", info.Version)
+			}
+			if len(pkt.Raw()) == 0 || len(pkt.Raw()) > len(data) {
+				t.Fatalf("raw data of %d bytes does not fit the packet of %d bytes", len(pkt.Raw()), len(data))
+			}
+			if len(pkt.Payload()) > len(pkt.Raw()) {
+				t.Fatalf("payload of %d bytes does not fit the packet of %d bytes", len(pkt.Payload()), len(pkt.Raw()))
+			}
+			_ = pkt.GetConnectionID()
+			_ = pkt.FmtPacket()
+			_ = pkt.HasPorts()
+			_ = info.IsMulticast()
+			_ = info.IsBroadcast()
+			for _, layer := range pkt.Layers().Layers() {
+				_ = layer.LayerPayload()
+			}
+		}
+
+		// The other parsers of raw packets get the same input.
+		_, _ = ParseTCPSequence(data)
+		if icmpErr, err := ParseICMPError(data); err == nil && icmpErr.Original == nil {
+			t.Fatal("parsed ICMP error without original packet")
+		}
+		_, _ = ForgeDNSResponse(data, DNSResponseSinkhole)
+		_, _ = SetTTL(original, 1)
+	})
+}
+
+func TestParseWithinPacket(t *testing.T) {
+	t.Parallel()
+
+	// An IPv4 packet with an RUDP header that declares more data than the
+	// packet holds, in a buffer that holds more data after the packet.
+	data := []byte("F\x00\x00 \x00\x00\x00\x00\x1b\x1b\x1b\x1b\x1b\x1b\x1b\x1b\xc0\x00\x02\x01\x94\x04\x00\x00\x00D\x00B\xed\x00\b\x19\xc7")
+	buf := make([]byte, len(data), 0x10000)
+	copy(buf, data)
+
+	pkt := &Base{}
+	if err := Parse(buf, pkt); err == nil {
+		t.Errorf("expected error for truncated packet, got payload of %d bytes", len(pkt.Payload()))
+	}
+}
+
+func TestParseIPv6ExtensionHeaders(t *testing.T) {
+	t.Parallel()
+
+	// An IPv6 packet with a fragment header before the UDP header, which is
+	// not decoded further.
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolIPv6Fragment,
+		SrcIP:      net.ParseIP("fd00::1"),
+		DstIP:      net.ParseIP("2001:db8::1"),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, ip); err != nil {
+		t.Fatal(err)
+	}
+	data := append(buf.Bytes(), 17, 0, 0, 1, 0, 0, 0, 1)
+	data = append(data, 0xc3, 0x50, 0x13, 0x88, 0, 12, 0, 0, 't', 'e', 's', 't')
+	data[4], data[5] = 0, byte(len(data)-40)
+
+	pkt := &Base{}
+	if err := Parse(data, pkt); err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Info().Protocol != UDP {
+		t.Errorf("expected protocol of fragment to be UDP, got %s", pkt.Info().Protocol)
+	}
+
+	// Truncated extension headers fall back to the first next header.
+	data = data[:44]
+	data[4], data[5] = 0, 4
+	if err := Parse(data, pkt); err == nil && pkt.Info().Protocol == UDP {
+		t.Error("protocol of truncated extension header chain must not be UDP")
+	}
+}
@@ -0,0 +1,41 @@
+package packet
+
+import (
+	"net"
+
+	"github.com/google/gopacket/layers"
+)
+
+// ForgeTCPSynAck forges a TCP SYN-ACK segment from the given source to the
+// given destination, which answers a SYN with the next sequence number ack.
+// The segment opens the connection with the initial sequence number seq and
+// advertises the given receive window. It is a raw IP packet with computed
+// checksums, so that it can be injected as if it was sent by the source.
+func ForgeTCPSynAck(srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16, seq, ack uint32, window uint16) ([]byte, error) {
+	return forgeTCPSegment(srcIP, dstIP, &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Seq:     seq,
+		Ack:     ack,
+		SYN:     true,
+		ACK:     true,
+		Window:  window,
+	})
+}
+
+// ForgeTCPZeroWindowAck forges a TCP ACK segment from the given source to the
+// given destination with the given sequence and acknowledgment numbers, which
+// advertises a receive window of zero. The destination may then not send any
+// more data and only probes the window until it opens again. It is a raw IP
+// packet with computed checksums, so that it can be injected as if it was sent
+// by the source.
+func ForgeTCPZeroWindowAck(srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16, seq, ack uint32) ([]byte, error) {
+	return forgeTCPSegment(srcIP, dstIP, &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Seq:     seq,
+		Ack:     ack,
+		ACK:     true,
+		Window:  0,
+	})
+}
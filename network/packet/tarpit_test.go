@@ -0,0 +1,85 @@
+package packet
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestForgeTCPSynAck(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		src, dst  net.IP
+		layerType gopacket.LayerType
+	}{
+		{net.IPv4(10, 0, 0, 1), net.IPv4(1, 1, 1, 1), layers.LayerTypeIPv4},
+		{net.ParseIP("fd00::1"), net.ParseIP("2606:4700::1111"), layers.LayerTypeIPv6},
+	}
+	for _, test := range tests {
+		data, err := ForgeTCPSynAck(test.src, 22, test.dst, 40000, 1000, 5001, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pkt := gopacket.NewPacket(data, test.layerType, gopacket.Default)
+		if errLayer := pkt.ErrorLayer(); errLayer != nil {
+			t.Fatalf("%s: failed to decode forged SYN-ACK: %s", test.src, errLayer.Error())
+		}
+		tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if !ok {
+			t.Fatalf("%s: no TCP layer in forged SYN-ACK", test.src)
+		}
+		if !tcp.SYN || !tcp.ACK || tcp.RST || tcp.FIN || tcp.PSH ||
+			tcp.Seq != 1000 || tcp.Ack != 5001 || tcp.Window != 10 ||
+			tcp.SrcPort != 22 || tcp.DstPort != 40000 || len(tcp.Payload) != 0 {
+			t.Errorf("%s: unexpected TCP header: %+v", test.src, tcp)
+		}
+		flow := pkt.NetworkLayer().NetworkFlow()
+		if !net.IP(flow.Src().Raw()).Equal(test.src) || !net.IP(flow.Dst().Raw()).Equal(test.dst) {
+			t.Errorf("%s: unexpected addresses %s", test.src, flow)
+		}
+
+		// Verify the checksum by recomputing it.
+		checksum := tcp.Checksum
+		if err := tcp.SetNetworkLayerForChecksum(pkt.NetworkLayer()); err != nil {
+			t.Fatal(err)
+		}
+		buf := gopacket.NewSerializeBuffer()
+		if err := tcp.SerializeTo(buf, gopacket.SerializeOptions{ComputeChecksums: true}); err != nil {
+			t.Fatal(err)
+		}
+		if tcp.Checksum != checksum {
+			t.Errorf("%s: invalid TCP checksum %#x, expected %#x", test.src, checksum, tcp.Checksum)
+		}
+
+		// The SYN counts as one byte.
+		seq, ok := ParseTCPSequence(data)
+		if !ok || !seq.Syn || !seq.HasAck || seq.Seq != 1000 || seq.Next != 1001 || seq.Ack != 5001 {
+			t.Errorf("%s: unexpected parsed sequence: %+v", test.src, seq)
+		}
+	}
+
+	if _, err := ForgeTCPSynAck(net.IPv4(10, 0, 0, 1), 1, net.ParseIP("fd00::1"), 2, 0, 0, 10); err == nil {
+		t.Error("mismatching IP versions should be rejected")
+	}
+}
+
+func TestForgeTCPZeroWindowAck(t *testing.T) {
+	t.Parallel()
+
+	data, err := ForgeTCPZeroWindowAck(net.IPv4(10, 0, 0, 1), 22, net.IPv4(1, 1, 1, 1), 40000, 1001, 5011)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+	tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		t.Fatal("no TCP layer in forged ACK")
+	}
+	if tcp.SYN || !tcp.ACK || tcp.Seq != 1001 || tcp.Ack != 5011 || tcp.Window != 0 {
+		t.Errorf("unexpected TCP header: %+v", tcp)
+	}
+}
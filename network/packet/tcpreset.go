@@ -0,0 +1,166 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// forgedTCPSegmentTTL is the TTL of the IP packets of forged TCP segments.
+const forgedTCPSegmentTTL = 64
+
+// TCP flags, as used in the TCP header.
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+)
+
+// TCPSequence holds the sequence information of a TCP segment.
+type TCPSequence struct {
+	// Seq is the sequence number of the segment.
+	Seq uint32
+	// Ack is the acknowledgment number of the segment, if HasAck is set. It is
+	// the next sequence number the sender expects from its peer.
+	Ack    uint32
+	HasAck bool
+	// Next is the sequence number the sender uses after this segment, ie. the
+	// sequence number plus the length of the segment. SYN and FIN count as
+	// one byte.
+	Next uint32
+	// Reset is set if the segment resets the connection.
+	Reset bool
+	// Syn is set if the segment synchronizes the sequence numbers, ie. opens
+	// the connection.
+	Syn bool
+}
+
+// ParseTCPSequence parses the sequence information of the TCP segment in the
+// given raw IP packet. The packet may be truncated after the TCP header, as
+// the segment length is taken from the IP header. Fragments and IPv6 packets
+// with extension headers are not supported.
+func ParseTCPSequence(data []byte) (seq TCPSequence, ok bool) {
+	var tcp []byte
+	var ipPayloadLength int
+
+	if len(data) == 0 {
+		return seq, false
+	}
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 || data[9] != byte(TCP) {
+			return seq, false
+		}
+		// Only the first fragment holds the TCP header, and the segment length
+		// is unknown for all fragments.
+		if binary.BigEndian.Uint16(data[6:8])&0x3fff != 0 {
+			return seq, false
+		}
+		headerLength := int(data[0]&0x0f) * 4
+		ipPayloadLength = int(binary.BigEndian.Uint16(data[2:4])) - headerLength
+		if headerLength < 20 || len(data) < headerLength {
+			return seq, false
+		}
+		tcp = data[headerLength:]
+	case 6:
+		if len(data) < 40 || data[6] != byte(TCP) {
+			return seq, false
+		}
+		ipPayloadLength = int(binary.BigEndian.Uint16(data[4:6]))
+		tcp = data[40:]
+	default:
+		return seq, false
+	}
+
+	if len(tcp) < 14 {
+		return seq, false
+	}
+	tcpHeaderLength := int(tcp[12]>>4) * 4
+	if tcpHeaderLength < 20 || ipPayloadLength < tcpHeaderLength {
+		return seq, false
+	}
+	flags := tcp[13]
+
+	seq.Seq = binary.BigEndian.Uint32(tcp[4:8])
+	if flags&tcpFlagACK != 0 {
+		seq.Ack = binary.BigEndian.Uint32(tcp[8:12])
+		seq.HasAck = true
+	}
+	seq.Reset = flags&tcpFlagRST != 0
+	seq.Syn = flags&tcpFlagSYN != 0
+
+	segmentLength := uint32(ipPayloadLength - tcpHeaderLength)
+	if flags&tcpFlagSYN != 0 {
+		segmentLength++
+	}
+	if flags&tcpFlagFIN != 0 {
+		segmentLength++
+	}
+	seq.Next = seq.Seq + segmentLength
+
+	return seq, true
+}
+
+// ForgeTCPReset forges a TCP RST segment from the given source to the given
+// destination with the given sequence number. The reset is a raw IP packet
+// with computed checksums, so that it can be injected as if it was sent by
+// the source. It is only accepted by the destination if the sequence number
+// is the next one it expects from the source.
+func ForgeTCPReset(srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16, seq uint32) ([]byte, error) {
+	return forgeTCPSegment(srcIP, dstIP, &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Seq:     seq,
+		RST:     true,
+	})
+}
+
+// forgeTCPSegment serializes the given TCP header without payload from the
+// given source to the given destination as a raw IP packet with computed
+// checksums.
+func forgeTCPSegment(srcIP, dstIP net.IP, tcp *layers.TCP) ([]byte, error) {
+	var networkLayer gopacket.NetworkLayer
+	switch {
+	case srcIP.To4() != nil && dstIP.To4() != nil:
+		networkLayer = &layers.IPv4{
+			Version:  4,
+			IHL:      5,
+			TTL:      forgedTCPSegmentTTL,
+			Protocol: layers.IPProtocolTCP,
+			SrcIP:    srcIP.To4(),
+			DstIP:    dstIP.To4(),
+		}
+	case srcIP.To4() == nil && dstIP.To4() == nil && srcIP.To16() != nil && dstIP.To16() != nil:
+		networkLayer = &layers.IPv6{
+			Version:    6,
+			NextHeader: layers.IPProtocolTCP,
+			HopLimit:   forgedTCPSegmentTTL,
+			SrcIP:      srcIP,
+			DstIP:      dstIP,
+		}
+	default:
+		return nil, errors.New("invalid or mismatching IP versions")
+	}
+
+	if err := tcp.SetNetworkLayerForChecksum(networkLayer); err != nil {
+		return nil, err
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	},
+		networkLayer.(gopacket.SerializableLayer),
+		tcp,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,112 @@
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestForgeTCPReset(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		src, dst  net.IP
+		layerType gopacket.LayerType
+	}{
+		{net.IPv4(10, 0, 0, 1), net.IPv4(1, 1, 1, 1), layers.LayerTypeIPv4},
+		{net.ParseIP("fd00::1"), net.ParseIP("2606:4700::1111"), layers.LayerTypeIPv6},
+	}
+	for _, test := range tests {
+		data, err := ForgeTCPReset(test.src, 40000, test.dst, 443, 123456)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pkt := gopacket.NewPacket(data, test.layerType, gopacket.Default)
+		tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if !ok {
+			t.Fatalf("%s: no TCP layer in forged reset", test.src)
+		}
+		if !tcp.RST || tcp.ACK || tcp.SYN || tcp.Seq != 123456 || tcp.SrcPort != 40000 || tcp.DstPort != 443 {
+			t.Errorf("%s: unexpected TCP header: %+v", test.src, tcp)
+		}
+		flow := pkt.NetworkLayer().NetworkFlow()
+		if !net.IP(flow.Src().Raw()).Equal(test.src) || !net.IP(flow.Dst().Raw()).Equal(test.dst) {
+			t.Errorf("%s: unexpected addresses %s", test.src, flow)
+		}
+
+		// Verify the checksum using the pseudo header.
+		var pseudoHeader []byte
+		pseudoHeader = append(pseudoHeader, flow.Src().Raw()...)
+		pseudoHeader = append(pseudoHeader, flow.Dst().Raw()...)
+		pseudoHeader = append(pseudoHeader, 0, byte(layers.IPProtocolTCP))
+		pseudoHeader = binary.BigEndian.AppendUint16(pseudoHeader, uint16(len(tcp.Contents)))
+		if internetChecksum(internetChecksum(0, pseudoHeader), tcp.Contents) != 0xffff {
+			t.Errorf("%s: invalid TCP checksum", test.src)
+		}
+
+		// The forged reset can be parsed again.
+		seq, ok := ParseTCPSequence(data)
+		if !ok || !seq.Reset || seq.Seq != 123456 || seq.Next != 123456 || seq.HasAck {
+			t.Errorf("%s: unexpected parsed sequence: %+v", test.src, seq)
+		}
+	}
+
+	if _, err := ForgeTCPReset(net.IPv4(10, 0, 0, 1), 1, net.ParseIP("fd00::1"), 2, 0); err == nil {
+		t.Error("mismatching IP versions should be rejected")
+	}
+}
+
+func TestParseTCPSequence(t *testing.T) {
+	t.Parallel()
+
+	serialize := func(networkLayer gopacket.SerializableLayer, tcp *layers.TCP, payload []byte) []byte {
+		if err := tcp.SetNetworkLayerForChecksum(networkLayer.(gopacket.NetworkLayer)); err != nil {
+			t.Fatal(err)
+		}
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+			networkLayer, tcp, gopacket.Payload(payload)); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	ipv4 := func() *layers.IPv4 {
+		return &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(1, 1, 1, 1)}
+	}
+
+	// Data segment, truncated after the header as with header copies.
+	data := serialize(ipv4(), &layers.TCP{SrcPort: 1, DstPort: 2, Seq: 1000, Ack: 5000, ACK: true, PSH: true}, make([]byte, 100))
+	seq, ok := ParseTCPSequence(data[:40])
+	if !ok || seq.Seq != 1000 || seq.Next != 1100 || !seq.HasAck || seq.Ack != 5000 || seq.Reset {
+		t.Errorf("unexpected sequence of data segment: %+v", seq)
+	}
+
+	// SYN counts as one byte.
+	data = serialize(ipv4(), &layers.TCP{SrcPort: 1, DstPort: 2, Seq: 0xffffffff, SYN: true}, nil)
+	seq, ok = ParseTCPSequence(data)
+	if !ok || seq.Next != 0 || seq.HasAck {
+		t.Errorf("unexpected sequence of SYN: %+v", seq)
+	}
+
+	// IPv6 FIN.
+	ipv6 := &layers.IPv6{Version: 6, NextHeader: layers.IPProtocolTCP, HopLimit: 64, SrcIP: net.ParseIP("fd00::1"), DstIP: net.ParseIP("fd00::2")}
+	data = serialize(ipv6, &layers.TCP{SrcPort: 1, DstPort: 2, Seq: 10, Ack: 20, ACK: true, FIN: true}, []byte("bye"))
+	seq, ok = ParseTCPSequence(data)
+	if !ok || seq.Next != 14 || seq.Ack != 20 {
+		t.Errorf("unexpected sequence of IPv6 FIN: %+v", seq)
+	}
+
+	// Non-TCP and truncated packets are rejected.
+	udp := ipv4()
+	udp.Protocol = layers.IPProtocolUDP
+	udpData := serialize(udp, &layers.TCP{}, nil)
+	for _, invalid := range [][]byte{nil, data[:30], udpData, data[:45]} {
+		if _, ok := ParseTCPSequence(invalid); ok {
+			t.Errorf("invalid packet %x should not be parsed", invalid)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// IP header layout.
+const (
+	ipv4MinHeaderLen    = 20
+	ipv4HeaderLenFactor = 4
+	ipv4TTLOffset       = 8
+	ipv4ChecksumOffset  = 10
+
+	ipv6HeaderLen      = 40
+	ipv6HopLimitOffset = 7
+)
+
+// SetTTL sets the IPv4 TTL or the IPv6 hop limit of the raw IP packet data in
+// place. The IPv4 header checksum is recomputed. Transport layer checksums are
+// not affected, as the TTL is not part of their pseudo header. It returns
+// whether the packet was modified.
+func SetTTL(ipData []byte, ttl uint8) (modified bool, err error) {
+	if len(ipData) == 0 {
+		return false, errors.New("empty packet")
+	}
+
+	switch ipData[0] >> 4 {
+	case 4:
+		if len(ipData) < ipv4MinHeaderLen {
+			return false, errors.New("truncated IPv4 header")
+		}
+		headerLen := int(ipData[0]&0x0f) * ipv4HeaderLenFactor
+		if headerLen < ipv4MinHeaderLen || headerLen > len(ipData) {
+			return false, errors.New("invalid IPv4 header length")
+		}
+		if ipData[ipv4TTLOffset] == ttl {
+			return false, nil
+		}
+
+		ipData[ipv4TTLOffset] = ttl
+		binary.BigEndian.PutUint16(ipData[ipv4ChecksumOffset:], 0)
+		binary.BigEndian.PutUint16(ipData[ipv4ChecksumOffset:], ipv4HeaderChecksum(ipData[:headerLen]))
+		return true, nil
+
+	case 6:
+		if len(ipData) < ipv6HeaderLen {
+			return false, errors.New("truncated IPv6 header")
+		}
+		if ipData[ipv6HopLimitOffset] == ttl {
+			return false, nil
+		}
+
+		ipData[ipv6HopLimitOffset] = ttl
+		return true, nil
+
+	default:
+		return false, errors.New("unknown IP version")
+	}
+}
+
+// ipv4HeaderChecksum computes the checksum of the given IPv4 header.
+func ipv4HeaderChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
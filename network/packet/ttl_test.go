@@ -0,0 +1,88 @@
+package packet
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestSetTTL(t *testing.T) {
+	t.Parallel()
+
+	// IPv4.
+	ipData := buildUDPPacket(t)
+	modified, err := SetTTL(ipData, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !modified {
+		t.Fatal("packet should be modified")
+	}
+
+	// Compare with the checksum computed by gopacket.
+	decoded := gopacket.NewPacket(ipData, layers.LayerTypeIPv4, gopacket.Default)
+	ipv4, ok := decoded.NetworkLayer().(*layers.IPv4)
+	if !ok {
+		t.Fatal("failed to decode modified packet")
+	}
+	if ipv4.TTL != 128 {
+		t.Errorf("unexpected TTL %d", ipv4.TTL)
+	}
+	receivedChecksum := ipv4.Checksum
+	buf := gopacket.NewSerializeBuffer()
+	if err := ipv4.SerializeTo(buf, gopacket.SerializeOptions{ComputeChecksums: true}); err != nil {
+		t.Fatal(err)
+	}
+	expected := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default).NetworkLayer().(*layers.IPv4) //nolint:forcetypeassert // Decoded as IPv4.
+	if receivedChecksum != expected.Checksum {
+		t.Errorf("unexpected IPv4 header checksum %#04x, expected %#04x", receivedChecksum, expected.Checksum)
+	}
+	// A correct header sums up to zero, including the checksum.
+	if ipv4HeaderChecksum(ipData[:ipv4.IHL*4]) != 0 {
+		t.Error("IPv4 header checksum is invalid")
+	}
+
+	// Setting the same TTL again does not modify the packet.
+	modified, err = SetTTL(ipData, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if modified {
+		t.Error("packet should not be modified")
+	}
+
+	// IPv6.
+	ip6 := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolNoNextHeader,
+		SrcIP:      net.ParseIP("fd00::1"),
+		DstIP:      net.ParseIP("fd00::2"),
+	}
+	buf = gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ip6); err != nil {
+		t.Fatal(err)
+	}
+	ipData = buf.Bytes()
+	modified, err = SetTTL(ipData, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !modified {
+		t.Fatal("packet should be modified")
+	}
+	decoded = gopacket.NewPacket(ipData, layers.LayerTypeIPv6, gopacket.Default)
+	if ipv6, ok := decoded.NetworkLayer().(*layers.IPv6); !ok || ipv6.HopLimit != 32 {
+		t.Errorf("hop limit was not set: %v", decoded)
+	}
+
+	// Invalid packets.
+	if _, err := SetTTL([]byte{0x45, 0x00}, 64); err == nil {
+		t.Error("truncated packet should fail")
+	}
+	if _, err := SetTTL([]byte{0x00}, 64); err == nil {
+		t.Error("unknown IP version should fail")
+	}
+}
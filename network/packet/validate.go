@@ -0,0 +1,249 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// ParseAnomaly classifies how the headers of a packet are inconsistent with
+// each other or with the captured data. Anomalies are bit flags and can be
+// combined into a set.
+type ParseAnomaly uint16
+
+// Parse anomalies.
+const (
+	// AnomalyIPv4HeaderLength is set if the IPv4 header length (IHL) is below
+	// the minimum or exceeds the captured data or the total length.
+	AnomalyIPv4HeaderLength ParseAnomaly = 1 << iota
+	// AnomalyIPv4Options is set if an IPv4 option exceeds the header.
+	AnomalyIPv4Options
+	// AnomalyIPv6Header is set if the IPv6 header exceeds the captured data.
+	AnomalyIPv6Header
+	// AnomalyIPv6ExtensionHeader is set if an IPv6 extension header exceeds
+	// the payload.
+	AnomalyIPv6ExtensionHeader
+	// AnomalyTCPDataOffset is set if the TCP data offset is below the minimum
+	// or exceeds the segment.
+	AnomalyTCPDataOffset
+	// AnomalyTCPOptions is set if a TCP option exceeds the header.
+	AnomalyTCPOptions
+	// AnomalyUDPLength is set if the UDP header exceeds the segment or if the
+	// UDP length is below the minimum or exceeds the IP payload.
+	AnomalyUDPLength
+)
+
+var parseAnomalyNames = []struct {
+	anomaly ParseAnomaly
+	name    string
+}{
+	{AnomalyIPv4HeaderLength, "ipv4_header_length"},
+	{AnomalyIPv4Options, "ipv4_options"},
+	{AnomalyIPv6Header, "ipv6_header"},
+	{AnomalyIPv6ExtensionHeader, "ipv6_extension_header"},
+	{AnomalyTCPDataOffset, "tcp_data_offset"},
+	{AnomalyTCPOptions, "tcp_options"},
+	{AnomalyUDPLength, "udp_length"},
+}
+
+// Has returns whether all of the given anomalies are set.
+func (a ParseAnomaly) Has(anomalies ParseAnomaly) bool {
+	return a&anomalies == anomalies
+}
+
+// String returns the names of the set anomalies, separated by commas.
+func (a ParseAnomaly) String() string {
+	names := make([]string, 0, len(parseAnomalyNames))
+	for _, entry := range parseAnomalyNames {
+		if a.Has(entry.anomaly) {
+			names = append(names, entry.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseError is returned by Parse for packets whose headers are inconsistent
+// with each other or with the captured data, instead of parsing the packet at
+// the wrong offsets.
+type ParseError struct {
+	Anomaly ParseAnomaly
+	Msg     string
+}
+
+func (err *ParseError) Error() string {
+	return err.Msg
+}
+
+func parseAnomaly(anomaly ParseAnomaly, format string, a ...interface{}) *ParseError {
+	return &ParseError{
+		Anomaly: anomaly,
+		Msg:     fmt.Sprintf(format, a...),
+	}
+}
+
+// TCP and UDP header values.
+const (
+	tcpMinHeaderSize = 20
+	udpHeaderSize    = 8
+
+	// optionEnd and optionNOP are the option kinds without a length field,
+	// which are the same for IPv4 and TCP options.
+	optionEnd = 0
+	optionNOP = 1
+)
+
+// validateHeaders checks the header lengths of the IP packet against each
+// other and against the captured data. The IP packet may be truncated after
+// the transport header, as is the case if the OS integration does not copy
+// all of the packet data, but the headers themselves must be complete.
+func validateHeaders(data []byte) error {
+	switch data[0] >> 4 {
+	case 4:
+		return validateIPv4(data)
+	case 6:
+		return validateIPv6(data)
+	default:
+		return nil
+	}
+}
+
+func validateIPv4(data []byte) error {
+	if len(data) < ipv4MinHeaderSize {
+		return parseAnomaly(AnomalyIPv4HeaderLength, "IPv4 header of %d bytes exceeds the captured %d bytes", ipv4MinHeaderSize, len(data))
+	}
+
+	headerLen := int(data[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(data[2:4]))
+	// The total length is zero for packets with TCP segmentation offload.
+	if totalLen == 0 {
+		totalLen = len(data)
+	}
+	switch {
+	case headerLen < ipv4MinHeaderSize:
+		return parseAnomaly(AnomalyIPv4HeaderLength, "IPv4 header length %d is below the minimum of %d bytes", headerLen, ipv4MinHeaderSize)
+	case headerLen > len(data):
+		return parseAnomaly(AnomalyIPv4HeaderLength, "IPv4 header length %d exceeds the captured %d bytes", headerLen, len(data))
+	case headerLen > totalLen:
+		return parseAnomaly(AnomalyIPv4HeaderLength, "IPv4 header length %d exceeds the total length of %d bytes", headerLen, totalLen)
+	}
+	if err := validateOptions(data[ipv4MinHeaderSize:headerLen]); err != nil {
+		return parseAnomaly(AnomalyIPv4Options, "invalid IPv4 options: %s", err)
+	}
+
+	// Only the first fragment holds the transport header.
+	if binary.BigEndian.Uint16(data[6:8])&0x1fff != 0 {
+		return nil
+	}
+	payload, truncated := data[headerLen:], totalLen > len(data)
+	if !truncated {
+		payload = data[headerLen:totalLen]
+	}
+	return validateTransport(IPProtocol(data[9]), payload, truncated)
+}
+
+func validateIPv6(data []byte) error {
+	if len(data) < ipv6HeaderSize {
+		return parseAnomaly(AnomalyIPv6Header, "IPv6 header of %d bytes exceeds the captured %d bytes", ipv6HeaderSize, len(data))
+	}
+
+	// A payload length of zero is used by jumbograms, whose length is part of
+	// the Hop-by-Hop options, which are checked by the decoder.
+	payloadLen := int(binary.BigEndian.Uint16(data[4:6]))
+	if payloadLen == 0 {
+		return nil
+	}
+	payload, truncated := data[ipv6HeaderSize:], ipv6HeaderSize+payloadLen > len(data)
+	if !truncated {
+		payload = data[ipv6HeaderSize : ipv6HeaderSize+payloadLen]
+	}
+
+	nextHeader := data[6]
+	for {
+		switch nextHeader {
+		case 0, 43, 60: // Hop-by-Hop, Routing, Destination Options
+			if len(payload) < 8 {
+				return parseAnomaly(AnomalyIPv6ExtensionHeader, "IPv6 extension header %d exceeds the remaining %d bytes", nextHeader, len(payload))
+			}
+			extLen := (int(payload[1]) + 1) * 8
+			if extLen > len(payload) {
+				return parseAnomaly(AnomalyIPv6ExtensionHeader, "IPv6 extension header %d of %d bytes exceeds the remaining %d bytes", nextHeader, extLen, len(payload))
+			}
+			nextHeader = payload[0]
+			payload = payload[extLen:]
+		case 44: // Fragment
+			if len(payload) < 8 {
+				return parseAnomaly(AnomalyIPv6ExtensionHeader, "IPv6 fragment header exceeds the remaining %d bytes", len(payload))
+			}
+			// Only the first fragment holds the transport header.
+			if binary.BigEndian.Uint16(payload[2:4])&0xfff8 != 0 {
+				return nil
+			}
+			nextHeader = payload[0]
+			payload = payload[8:]
+		default:
+			return validateTransport(IPProtocol(nextHeader), payload, truncated)
+		}
+	}
+}
+
+// validateTransport checks the TCP or UDP header in the given IP payload.
+func validateTransport(protocol IPProtocol, segment []byte, truncated bool) error {
+	switch protocol { //nolint:exhaustive // Only TCP and UDP are checked.
+	case TCP:
+		if len(segment) < tcpMinHeaderSize {
+			return parseAnomaly(AnomalyTCPDataOffset, "TCP header of %d bytes exceeds the segment of %d bytes", tcpMinHeaderSize, len(segment))
+		}
+		dataOffset := int(segment[12]>>4) * 4
+		switch {
+		case dataOffset < tcpMinHeaderSize:
+			return parseAnomaly(AnomalyTCPDataOffset, "TCP data offset %d is below the minimum of %d bytes", dataOffset, tcpMinHeaderSize)
+		case dataOffset > len(segment):
+			return parseAnomaly(AnomalyTCPDataOffset, "TCP data offset %d exceeds the segment of %d bytes", dataOffset, len(segment))
+		}
+		if err := validateOptions(segment[tcpMinHeaderSize:dataOffset]); err != nil {
+			return parseAnomaly(AnomalyTCPOptions, "invalid TCP options: %s", err)
+		}
+
+	case UDP:
+		if len(segment) < udpHeaderSize {
+			return parseAnomaly(AnomalyUDPLength, "UDP header of %d bytes exceeds the segment of %d bytes", udpHeaderSize, len(segment))
+		}
+		// A length of zero is used by jumbograms.
+		length := int(binary.BigEndian.Uint16(segment[4:6]))
+		switch {
+		case length == 0:
+		case length < udpHeaderSize:
+			return parseAnomaly(AnomalyUDPLength, "UDP length %d is below the minimum of %d bytes", length, udpHeaderSize)
+		case length > len(segment) && !truncated:
+			return parseAnomaly(AnomalyUDPLength, "UDP length %d exceeds the IP payload of %d bytes", length, len(segment))
+		}
+	}
+
+	return nil
+}
+
+// validateOptions checks that the IPv4 or TCP options do not exceed the
+// given option space.
+func validateOptions(options []byte) error {
+	for len(options) > 0 {
+		switch options[0] {
+		case optionEnd:
+			return nil
+		case optionNOP:
+			options = options[1:]
+		default:
+			if len(options) < 2 {
+				return fmt.Errorf("option %d misses its length", options[0])
+			}
+			optionLen := int(options[1])
+			switch {
+			case optionLen < 2:
+				return fmt.Errorf("option %d has invalid length %d", options[0], optionLen)
+			case optionLen > len(options):
+				return fmt.Errorf("option %d of %d bytes exceeds the remaining %d bytes", options[0], optionLen, len(options))
+			}
+			options = options[optionLen:]
+		}
+	}
+	return nil
+}
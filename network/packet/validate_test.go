@@ -0,0 +1,303 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func serializeTestPacket(t *testing.T, serializable ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}, serializable...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// buildIPv4TCPPacket returns an IPv4 packet with a Router Alert option that
+// holds a TCP segment with an MSS option and a payload of 4 bytes.
+func buildIPv4TCPPacket(t *testing.T) []byte {
+	t.Helper()
+
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.IPv4(10, 0, 0, 1),
+		DstIP:    net.IPv4(192, 0, 2, 1),
+		Options: []layers.IPv4Option{{
+			OptionType:   148,
+			OptionLength: 4,
+			OptionData:   []byte{0, 0},
+		}},
+	}
+	tcp := &layers.TCP{
+		SrcPort: 50000,
+		DstPort: 443,
+		SYN:     true,
+		Window:  1024,
+		Options: []layers.TCPOption{{
+			OptionType:   layers.TCPOptionKindMSS,
+			OptionLength: 4,
+			OptionData:   []byte{0x05, 0xb4},
+		}},
+	}
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	return serializeTestPacket(t, ip, tcp, gopacket.Payload([]byte("test")))
+}
+
+// buildIPv6UDPPacket returns an IPv6 packet with a Destination Options header
+// that holds a UDP datagram with a payload of 4 bytes.
+func buildIPv6UDPPacket(t *testing.T) []byte {
+	t.Helper()
+
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolIPv6Destination,
+		SrcIP:      net.ParseIP("2001:db8::1"),
+		DstIP:      net.ParseIP("2001:db8::2"),
+	}
+	udp := &layers.UDP{
+		SrcPort: 50000,
+		DstPort: 5000,
+	}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	payload := serializeTestPacket(t, udp, gopacket.Payload([]byte("test")))
+	// Destination Options header of 8 bytes with a PadN option.
+	destOpts := []byte{byte(layers.IPProtocolUDP), 0, 1, 4, 0, 0, 0, 0}
+
+	return serializeTestPacket(t, ip, gopacket.Payload(append(destOpts, payload...)))
+}
+
+func TestParseHeaderMismatches(t *testing.T) {
+	t.Parallel()
+
+	ipv4TCP := buildIPv4TCPPacket(t)
+	ipv4UDP := buildUDPPacket(t)
+	ipv6UDP := buildIPv6UDPPacket(t)
+	const (
+		ipv4HeaderLen = 24
+		tcpOffset     = ipv4HeaderLen
+		tcpHeaderLen  = 24
+	)
+
+	// The unmodified packets must parse.
+	for _, data := range [][]byte{ipv4TCP, ipv4UDP, ipv6UDP} {
+		if err := Parse(data, &Base{}); err != nil {
+			t.Fatalf("valid packet failed to parse: %s", err)
+		}
+	}
+
+	modified := func(data []byte, modify func(data []byte) []byte) []byte {
+		return modify(append([]byte(nil), data...))
+	}
+	for _, test := range []struct {
+		name    string
+		data    []byte
+		anomaly ParseAnomaly
+	}{
+		{
+			name: "IPv4 header length below minimum",
+			data: modified(ipv4TCP, func(data []byte) []byte {
+				data[0] = 0x44
+				return data
+			}),
+			anomaly: AnomalyIPv4HeaderLength,
+		},
+		{
+			name: "IPv4 header length beyond captured data",
+			data: modified(ipv4TCP, func(data []byte) []byte {
+				data[0] = 0x4f
+				return data[:40]
+			}),
+			anomaly: AnomalyIPv4HeaderLength,
+		},
+		{
+			name: "IPv4 header length beyond total length",
+			data: modified(ipv4TCP, func(data []byte) []byte {
+				data[0] = 0x4f
+				binary.BigEndian.PutUint16(data[2:4], 40)
+				return data
+			}),
+			anomaly: AnomalyIPv4HeaderLength,
+		},
+		{
+			name:    "IPv4 header truncated",
+			data:    ipv4TCP[:12],
+			anomaly: AnomalyIPv4HeaderLength,
+		},
+		{
+			name: "IPv4 option beyond header",
+			data: modified(ipv4TCP, func(data []byte) []byte {
+				data[21] = 8
+				return data
+			}),
+			anomaly: AnomalyIPv4Options,
+		},
+		{
+			name: "IPv4 option with invalid length",
+			data: modified(ipv4TCP, func(data []byte) []byte {
+				data[21] = 1
+				return data
+			}),
+			anomaly: AnomalyIPv4Options,
+		},
+		{
+			name: "TCP data offset below minimum",
+			data: modified(ipv4TCP, func(data []byte) []byte {
+				data[tcpOffset+12] = 0x40
+				return data
+			}),
+			anomaly: AnomalyTCPDataOffset,
+		},
+		{
+			name: "TCP data offset beyond segment",
+			data: modified(ipv4TCP, func(data []byte) []byte {
+				data[tcpOffset+12] = 0xf0
+				return data
+			}),
+			anomaly: AnomalyTCPDataOffset,
+		},
+		{
+			name: "TCP data offset beyond captured data",
+			data: modified(ipv4TCP, func(data []byte) []byte {
+				// Declare the full packet, but only capture half of the TCP header.
+				return data[:tcpOffset+tcpHeaderLen/2]
+			}),
+			anomaly: AnomalyTCPDataOffset,
+		},
+		{
+			name: "TCP data offset beyond total length",
+			data: modified(ipv4TCP, func(data []byte) []byte {
+				binary.BigEndian.PutUint16(data[2:4], tcpOffset+20)
+				return data
+			}),
+			anomaly: AnomalyTCPDataOffset,
+		},
+		{
+			name: "TCP option beyond header",
+			data: modified(ipv4TCP, func(data []byte) []byte {
+				data[tcpOffset+21] = 12
+				return data
+			}),
+			anomaly: AnomalyTCPOptions,
+		},
+		{
+			name: "UDP length below minimum",
+			data: modified(ipv4UDP, func(data []byte) []byte {
+				binary.BigEndian.PutUint16(data[24:26], 4)
+				return data
+			}),
+			anomaly: AnomalyUDPLength,
+		},
+		{
+			name: "UDP length beyond IP payload",
+			data: modified(ipv4UDP, func(data []byte) []byte {
+				binary.BigEndian.PutUint16(data[24:26], 100)
+				return data
+			}),
+			anomaly: AnomalyUDPLength,
+		},
+		{
+			name: "UDP header beyond IP payload",
+			data: modified(ipv4UDP, func(data []byte) []byte {
+				binary.BigEndian.PutUint16(data[2:4], 24)
+				return data
+			}),
+			anomaly: AnomalyUDPLength,
+		},
+		{
+			name:    "IPv6 header truncated",
+			data:    ipv6UDP[:30],
+			anomaly: AnomalyIPv6Header,
+		},
+		{
+			name: "IPv6 extension header beyond payload",
+			data: modified(ipv6UDP, func(data []byte) []byte {
+				data[41] = 4
+				return data
+			}),
+			anomaly: AnomalyIPv6ExtensionHeader,
+		},
+		{
+			name: "IPv6 payload length cuts UDP header",
+			data: modified(ipv6UDP, func(data []byte) []byte {
+				binary.BigEndian.PutUint16(data[4:6], 12)
+				return data
+			}),
+			anomaly: AnomalyUDPLength,
+		},
+	} {
+		err := Parse(test.data, &Base{})
+		var parseErr *ParseError
+		switch {
+		case err == nil:
+			t.Errorf("%s: packet should be rejected", test.name)
+		case !errors.As(err, &parseErr):
+			t.Errorf("%s: expected parse error, got %s", test.name, err)
+		case parseErr.Anomaly != test.anomaly:
+			t.Errorf("%s: expected anomaly %s, got %s: %s", test.name, test.anomaly, parseErr.Anomaly, err)
+		}
+	}
+}
+
+func TestParseTruncatedPackets(t *testing.T) {
+	t.Parallel()
+
+	// Packets that are truncated after the transport header, as copied by the
+	// OS integration, must still be parsed.
+	ipv4UDP := buildUDPPacket(t)
+	pkt := &Base{}
+	if err := Parse(ipv4UDP[:len(ipv4UDP)-2], pkt); err != nil {
+		t.Errorf("truncated UDP packet should parse: %s", err)
+	} else if pkt.Info().DstPort != 5000 {
+		t.Errorf("unexpected destination port %d", pkt.Info().DstPort)
+	}
+
+	ipv4TCP := buildIPv4TCPPacket(t)
+	if err := Parse(ipv4TCP[:len(ipv4TCP)-4], &Base{}); err != nil {
+		t.Errorf("truncated TCP packet should parse: %s", err)
+	}
+
+	// The total length is zero for packets with TCP segmentation offload.
+	tso := append([]byte(nil), ipv4TCP...)
+	binary.BigEndian.PutUint16(tso[2:4], 0)
+	if err := Parse(tso, &Base{}); err != nil {
+		t.Errorf("packet without total length should parse: %s", err)
+	}
+
+	// Non-first fragments do not hold a transport header.
+	fragment := append([]byte(nil), ipv4UDP...)
+	binary.BigEndian.PutUint16(fragment[6:8], 1)
+	binary.BigEndian.PutUint16(fragment[24:26], 4)
+	if err := validateHeaders(fragment); err != nil {
+		t.Errorf("non-first fragment should not be checked for a transport header: %s", err)
+	}
+}
+
+func TestParseAnomalyString(t *testing.T) {
+	t.Parallel()
+
+	anomalies := AnomalyIPv4Options | AnomalyTCPDataOffset
+	if !anomalies.Has(AnomalyTCPDataOffset) || anomalies.Has(AnomalyUDPLength) {
+		t.Errorf("unexpected anomalies %d", anomalies)
+	}
+	if s := anomalies.String(); s != "ipv4_options,tcp_data_offset" {
+		t.Errorf("unexpected anomaly names %q", s)
+	}
+}
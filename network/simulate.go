@@ -0,0 +1,137 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/safing/portmaster/intel"
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/portmaster/process"
+)
+
+// ConnSpec describes a hypothetical IP connection, for simulating the verdict
+// the firewall would issue for it.
+type ConnSpec struct {
+	// PID is the ID of the process that makes the connection. The process
+	// must already be known to the Portmaster.
+	PID int
+	// Inbound is set if the connection is initiated by the remote entity.
+	Inbound bool
+	// Protocol is the IP protocol of the connection.
+	Protocol packet.IPProtocol
+	// LocalIP is the local IP of the connection. If not set, the unspecified
+	// address of the IP version of the remote IP is used.
+	LocalIP net.IP
+	// LocalPort is the local port of the connection.
+	LocalPort uint16
+	// RemoteIP is the IP of the remote entity.
+	RemoteIP net.IP
+	// RemotePort is the port of the remote entity.
+	RemotePort uint16
+	// Domain is the domain that the remote IP was resolved from, if any.
+	Domain string
+}
+
+// NewSimulatedConnection returns a connection as described by the given spec.
+// The connection is not added to the connection storage and is never saved,
+// its verdicts are not recorded in the verdict history. The process must
+// already be known, as looking it up would add it to the process storage.
+func NewSimulatedConnection(spec ConnSpec) (*Connection, error) {
+	proc, ok := process.GetProcessFromStorage(spec.PID)
+	if !ok {
+		return nil, fmt.Errorf("process %d is not known", spec.PID)
+	}
+	return newSimulatedConnection(context.Background(), spec, proc)
+}
+
+// NewSimulatedConnectionForProcess is like NewSimulatedConnection, but uses
+// the given process instead of looking it up, eg. to simulate connections of
+// processes that are recorded elsewhere.
+func NewSimulatedConnectionForProcess(spec ConnSpec, proc *process.Process) (*Connection, error) {
+	if proc == nil {
+		return nil, errors.New("no process specified")
+	}
+	return newSimulatedConnection(context.Background(), spec, proc)
+}
+
+func newSimulatedConnection(ctx context.Context, spec ConnSpec, proc *process.Process) (*Connection, error) {
+	if spec.RemoteIP == nil {
+		return nil, errors.New("no remote IP specified")
+	}
+
+	ipVersion := packet.IPv4
+	localIP := spec.LocalIP
+	if spec.RemoteIP.To4() == nil {
+		ipVersion = packet.IPv6
+		if localIP == nil {
+			localIP = net.IPv6unspecified
+		}
+	} else if localIP == nil {
+		localIP = net.IPv4zero
+	}
+
+	// Create the (remote) entity.
+	entity := &intel.Entity{
+		Protocol: uint8(spec.Protocol),
+		Port:     spec.RemotePort,
+		Domain:   spec.Domain,
+	}
+	entity.SetIP(spec.RemoteIP)
+	if spec.Inbound {
+		entity.SetDstPort(spec.LocalPort)
+	} else {
+		entity.SetDstPort(spec.RemotePort)
+	}
+
+	scope := spec.Domain
+	if spec.Inbound || scope == "" {
+		scope = ipConnectionScope(spec.Inbound, entity.IPScope)
+	}
+
+	// Derive the ID from the first packet of the connection.
+	var id string
+	if spec.Inbound {
+		_, id = (&packet.ConntrackTuple{
+			Protocol: spec.Protocol,
+			Src:      spec.RemoteIP,
+			SrcPort:  spec.RemotePort,
+			Dst:      localIP,
+			DstPort:  spec.LocalPort,
+		}).ConnectionIDs()
+	} else {
+		id, _ = (&packet.ConntrackTuple{
+			Protocol: spec.Protocol,
+			Src:      localIP,
+			SrcPort:  spec.LocalPort,
+			Dst:      spec.RemoteIP,
+			DstPort:  spec.RemotePort,
+		}).ConnectionIDs()
+	}
+
+	conn := &Connection{
+		ID:                     id,
+		Type:                   IPConnection,
+		Scope:                  scope,
+		IPVersion:              ipVersion,
+		Inbound:                spec.Inbound,
+		IPProtocol:             spec.Protocol,
+		LocalPort:              spec.LocalPort,
+		ProcessContext:         getProcessContext(ctx, proc),
+		process:                proc,
+		Entity:                 entity,
+		Started:                time.Now().Unix(),
+		ProfileRevisionCounter: proc.Profile().RevisionCnt(),
+		simulated:              true,
+	}
+	conn.SetLocalIP(localIP)
+
+	// Inherit internal status of profile.
+	if localProfile := proc.Profile().LocalProfile(); localProfile != nil {
+		conn.Internal = localProfile.Internal
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,75 @@
+package network
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/safing/portmaster/network/packet"
+	"github.com/safing/portmaster/process"
+)
+
+func TestNewSimulatedConnection(t *testing.T) {
+	t.Parallel()
+
+	proc := &process.Process{Pid: 4242, Name: "simulated"}
+
+	// Outbound connection to a domain.
+	conn, err := newSimulatedConnection(context.Background(), ConnSpec{
+		Protocol:   packet.TCP,
+		LocalIP:    net.IPv4(192, 168, 1, 2),
+		LocalPort:  40000,
+		RemoteIP:   net.IPv4(1, 1, 1, 1),
+		RemotePort: 443,
+		Domain:     "one.one.one.one.",
+	}, proc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.ID != "6-192.168.1.2-40000-1.1.1.1-443" {
+		t.Errorf("unexpected ID %s", conn.ID)
+	}
+	if conn.Scope != "one.one.one.one." || conn.Entity.Domain != "one.one.one.one." {
+		t.Errorf("unexpected scope %s", conn.Scope)
+	}
+	if conn.IPVersion != packet.IPv4 || conn.Entity.DstPort() != 443 {
+		t.Errorf("unexpected connection %+v", conn)
+	}
+
+	// Inbound connection without a local IP.
+	inbound, err := newSimulatedConnection(context.Background(), ConnSpec{
+		Inbound:    true,
+		Protocol:   packet.UDP,
+		LocalPort:  53,
+		RemoteIP:   net.ParseIP("2001:db8::1"),
+		RemotePort: 50000,
+		Domain:     "ignored.example.",
+	}, proc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inbound.ID != "17-::-53-2001:db8::1-50000" {
+		t.Errorf("unexpected ID %s", inbound.ID)
+	}
+	if inbound.Scope != IncomingInternet {
+		t.Errorf("unexpected scope %s", inbound.Scope)
+	}
+	if inbound.IPVersion != packet.IPv6 || inbound.Entity.DstPort() != 53 {
+		t.Errorf("unexpected connection %+v", inbound)
+	}
+
+	// Simulated connections leave no traces.
+	conn.Accept("simulated", "")
+	conn.Save()
+	if _, ok := GetConnection(conn.ID); ok {
+		t.Error("simulated connection must not be stored")
+	}
+	if ConnectionVerdictHistory(conn.ID) != nil {
+		t.Error("simulated verdict must not be recorded")
+	}
+
+	// A remote IP is required.
+	if _, err := newSimulatedConnection(context.Background(), ConnSpec{Protocol: packet.TCP}, proc); err == nil {
+		t.Error("spec without remote IP should be rejected")
+	}
+}
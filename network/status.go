@@ -15,6 +15,11 @@
 	VerdictRerouteToNameserver Verdict = 5
 	VerdictRerouteToTunnel     Verdict = 6
 	VerdictFailed              Verdict = 7
+	// VerdictAsk is the verdict of connections whose prompt was not answered
+	// in time. The prompt pending action is applied to their packets until the
+	// user answers, but is never made permanent, so that the answer applies to
+	// the following packets.
+	VerdictAsk Verdict = 8
 )
 
 func (v Verdict) String() string {
@@ -35,6 +40,8 @@ func (v Verdict) String() string {
 		return "RerouteToTunnel"
 	case VerdictFailed:
 		return "Failed"
+	case VerdictAsk:
+		return "Ask"
 	default:
 		return "<INVALID VERDICT>"
 	}
@@ -59,6 +66,8 @@ func (v Verdict) Verb() string {
 		return "tunneled"
 	case VerdictFailed:
 		return "failed"
+	case VerdictAsk:
+		return "prompted"
 	default:
 		return "invalid"
 	}
@@ -0,0 +1,56 @@
+package network
+
+import (
+	"github.com/safing/portmaster/network/packet"
+)
+
+// tcpSequences holds the next sequence numbers of both endpoints of a TCP
+// connection, as seen in its packets.
+type tcpSequences struct {
+	local       uint32
+	localKnown  bool
+	remote      uint32
+	remoteKnown bool
+}
+
+// updateSequence sets the next sequence number of an endpoint, unless an already
+// known sequence number is more recent, eg. because of a retransmission.
+func updateSequence(current *uint32, known *bool, next uint32) {
+	if !*known || int32(next-*current) > 0 {
+		*current = next
+		*known = true
+	}
+}
+
+// TrackTCPSequence updates the known sequence numbers of the connection with
+// the given packet. It is called for every packet that is handled by the
+// firewall handler of the connection. The connection must be locked.
+func (conn *Connection) TrackTCPSequence(pkt packet.Packet) {
+	if pkt.Info().Protocol != packet.TCP {
+		return
+	}
+	seq, ok := packet.ParseTCPSequence(pkt.Raw())
+	if !ok || seq.Reset {
+		return
+	}
+
+	sender, senderKnown := &conn.tcpSequences.local, &conn.tcpSequences.localKnown
+	peer, peerKnown := &conn.tcpSequences.remote, &conn.tcpSequences.remoteKnown
+	if pkt.IsInbound() {
+		sender, senderKnown, peer, peerKnown = peer, peerKnown, sender, senderKnown
+	}
+
+	updateSequence(sender, senderKnown, seq.Next)
+	if seq.HasAck {
+		updateSequence(peer, peerKnown, seq.Ack)
+	}
+}
+
+// TCPSequences returns the next sequence numbers the local and the remote
+// endpoint of the TCP connection are expected to send, as seen in the most
+// recent packets of the connection that were handled. ok is only set if both
+// are known. The connection must be locked.
+func (conn *Connection) TCPSequences() (local, remote uint32, ok bool) {
+	seqs := conn.tcpSequences
+	return seqs.local, seqs.remote, seqs.localKnown && seqs.remoteKnown
+}
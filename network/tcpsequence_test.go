@@ -0,0 +1,83 @@
+package network
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/safing/portmaster/network/packet"
+)
+
+// testPacket is a packet that ignores all verdicts.
+type testPacket struct {
+	packet.Base
+}
+
+func (pkt *testPacket) Accept() error              { return nil }
+func (pkt *testPacket) Block() error               { return nil }
+func (pkt *testPacket) Drop() error                { return nil }
+func (pkt *testPacket) PermanentAccept() error     { return nil }
+func (pkt *testPacket) PermanentBlock() error      { return nil }
+func (pkt *testPacket) PermanentDrop() error       { return nil }
+func (pkt *testPacket) RerouteToNameserver() error { return nil }
+func (pkt *testPacket) RerouteToTunnel() error     { return nil }
+
+// testTCPPacket returns a packet holding an IPv4 TCP segment with the given
+// sequence numbers and payload length.
+func testTCPPacket(t *testing.T, inbound bool, seq, ack uint32, payloadLength int) packet.Packet {
+	t.Helper()
+
+	data := make([]byte, 40+payloadLength)
+	data[0] = 0x45
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)))
+	data[8] = 64
+	data[9] = byte(packet.TCP)
+	copy(data[12:16], []byte{10, 0, 0, 1})
+	copy(data[16:20], []byte{1, 1, 1, 1})
+	if inbound {
+		copy(data[12:16], []byte{1, 1, 1, 1})
+		copy(data[16:20], []byte{10, 0, 0, 1})
+	}
+	binary.BigEndian.PutUint32(data[24:28], seq)
+	binary.BigEndian.PutUint32(data[28:32], ack)
+	data[32] = 5 << 4
+	data[33] = 0x10 // ACK
+
+	pkt := &testPacket{}
+	if err := packet.Parse(data, &pkt.Base); err != nil {
+		t.Fatal(err)
+	}
+	if inbound {
+		pkt.SetInbound()
+	} else {
+		pkt.SetOutbound()
+	}
+	return pkt
+}
+
+func TestTrackTCPSequence(t *testing.T) {
+	t.Parallel()
+
+	conn := &Connection{}
+	if _, _, ok := conn.TCPSequences(); ok {
+		t.Fatal("sequences should not be known yet")
+	}
+
+	conn.TrackTCPSequence(testTCPPacket(t, false, 1000, 5000, 100))
+	local, remote, ok := conn.TCPSequences()
+	if !ok || local != 1100 || remote != 5000 {
+		t.Errorf("unexpected sequences %d/%d (%v)", local, remote, ok)
+	}
+
+	conn.TrackTCPSequence(testTCPPacket(t, true, 5000, 1100, 50))
+	local, remote, _ = conn.TCPSequences()
+	if local != 1100 || remote != 5050 {
+		t.Errorf("unexpected sequences %d/%d", local, remote)
+	}
+
+	// Retransmissions do not move the sequence numbers back.
+	conn.TrackTCPSequence(testTCPPacket(t, false, 1000, 5000, 10))
+	local, remote, _ = conn.TCPSequences()
+	if local != 1100 || remote != 5050 {
+		t.Errorf("retransmission should not change sequences, got %d/%d", local, remote)
+	}
+}
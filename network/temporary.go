@@ -0,0 +1,73 @@
+package network
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	verdictExpiryHandler     func(conn *Connection)
+	verdictExpiryHandlerLock sync.Mutex
+)
+
+// SetVerdictExpiryHandler sets the function that is called for connections
+// whose temporary verdict expired, see Connection.VerdictExpires. It is called
+// with the connection locked and must re-evaluate the verdict and reset
+// VerdictExpires. Expired verdicts are checked by the connection cleaner, so
+// they are re-evaluated up to a few seconds after they expired.
+func SetVerdictExpiryHandler(fn func(conn *Connection)) {
+	verdictExpiryHandlerLock.Lock()
+	defer verdictExpiryHandlerLock.Unlock()
+
+	verdictExpiryHandler = fn
+}
+
+func getVerdictExpiryHandler() func(conn *Connection) {
+	verdictExpiryHandlerLock.Lock()
+	defer verdictExpiryHandlerLock.Unlock()
+
+	return verdictExpiryHandler
+}
+
+// VerdictRemaining returns the remaining time until the temporary verdict of
+// the connection expires. It returns 0 if the verdict is not temporary or has
+// expired. The connection must be locked.
+func (conn *Connection) VerdictRemaining(now time.Time) time.Duration {
+	return remainingUntil(conn.VerdictExpires, now)
+}
+
+func remainingUntil(expires int64, now time.Time) time.Duration {
+	if expires == 0 {
+		return 0
+	}
+	remaining := time.Unix(expires, 0).Sub(now)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// expireTemporaryVerdicts hands the active connections with a temporary
+// verdict that expired at the given time to the verdict expiry handler. It
+// returns the amount of expired verdicts.
+func expireTemporaryVerdicts(conns []*Connection, now time.Time) (expired int) {
+	handler := getVerdictExpiryHandler()
+	if handler == nil {
+		return 0
+	}
+	nowUnix := now.Unix()
+
+	for _, conn := range conns {
+		func() {
+			conn.Lock()
+			defer conn.Unlock()
+
+			if conn.VerdictExpires == 0 || conn.VerdictExpires > nowUnix || conn.Ended != 0 {
+				return
+			}
+			handler(conn)
+			expired++
+		}()
+	}
+	return expired
+}
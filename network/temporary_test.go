@@ -0,0 +1,39 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpireTemporaryVerdicts(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	var expired []string
+	SetVerdictExpiryHandler(func(conn *Connection) {
+		expired = append(expired, conn.ID)
+		conn.VerdictExpires = 0
+	})
+	defer SetVerdictExpiryHandler(nil)
+
+	now := time.Now().Truncate(time.Second)
+	conns := []*Connection{
+		{ID: "due", VerdictExpires: now.Add(-time.Second).Unix()},
+		{ID: "pending", VerdictExpires: now.Add(time.Minute).Unix()},
+		{ID: "permanent"},
+		{ID: "ended", VerdictExpires: now.Add(-time.Second).Unix(), Ended: now.Unix()},
+	}
+
+	if count := expireTemporaryVerdicts(conns, now); count != 1 || len(expired) != 1 || expired[0] != "due" {
+		t.Errorf("only the due verdict should have expired, got %v", expired)
+	}
+	if remaining := conns[1].VerdictRemaining(now); remaining != time.Minute {
+		t.Errorf("expected a minute remaining, got %s", remaining)
+	}
+
+	// The pending verdict expires later.
+	expired = nil
+	if count := expireTemporaryVerdicts(conns, now.Add(2*time.Minute)); count != 1 || expired[0] != "pending" {
+		t.Errorf("pending verdict should have expired, got %v", expired)
+	}
+	if conns[1].VerdictRemaining(now) != 0 {
+		t.Error("no time should remain after the verdict expired")
+	}
+}
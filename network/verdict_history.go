@@ -0,0 +1,108 @@
+package network
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/safing/portmaster/profile"
+)
+
+const (
+	// verdictHistoryLength is the maximum amount of verdicts that are kept
+	// per connection.
+	verdictHistoryLength = 10
+
+	// verdictHistoryMaxConnections is the maximum amount of connections for
+	// which the verdict history is kept. The history of the connection that
+	// was updated least recently is removed first.
+	verdictHistoryMaxConnections = 4096
+)
+
+// VerdictRecord describes a verdict that was set for a connection.
+type VerdictRecord struct {
+	// Time is the time the verdict was set.
+	Time time.Time
+	// Verdict is the firewall verdict.
+	Verdict Verdict
+	// Reason is the reason message of the verdict.
+	Reason string
+	// OptionKey is the key of the setting that produced the verdict, if any.
+	OptionKey string `json:",omitempty"`
+	// Profile is the profile that provided the setting, if any.
+	Profile string `json:",omitempty"`
+	// RuleVersion is the version of the ruleset the verdict was decided with.
+	RuleVersion profile.RuleVersion
+	// ProfileRevision is the revision of the profile the verdict was decided
+	// with.
+	ProfileRevision uint64
+	// Expires holds the number of seconds in UNIX epoch time at which the
+	// verdict expires, if it is temporary.
+	Expires int64 `json:",omitempty"`
+}
+
+// Remaining returns the remaining time until the verdict expires, if it is
+// temporary. It returns 0 if the verdict is not temporary or has expired.
+func (record VerdictRecord) Remaining(now time.Time) time.Duration {
+	return remainingUntil(record.Expires, now)
+}
+
+type verdictHistory struct {
+	key     string
+	records []VerdictRecord
+}
+
+var (
+	verdictHistories     = make(map[string]*list.Element)
+	verdictHistoryOrder  = list.New()
+	verdictHistoriesLock sync.Mutex
+)
+
+// ConnectionVerdictHistory returns the last verdicts that were set for the
+// connection with the given ID, oldest first. The history is kept separately
+// from the connection, so that it is still available after the connection was
+// reset or removed, until it is pushed out by the histories of other
+// connections.
+func ConnectionVerdictHistory(connKey string) []VerdictRecord {
+	verdictHistoriesLock.Lock()
+	defer verdictHistoriesLock.Unlock()
+
+	element, ok := verdictHistories[connKey]
+	if !ok {
+		return nil
+	}
+
+	history := element.Value.(*verdictHistory) //nolint:forcetypeassert // Only verdictHistory is stored.
+	records := make([]VerdictRecord, len(history.records))
+	copy(records, history.records)
+	return records
+}
+
+// recordVerdict adds the verdict record to the history of the connection with
+// the given ID.
+func recordVerdict(connKey string, record VerdictRecord) {
+	verdictHistoriesLock.Lock()
+	defer verdictHistoriesLock.Unlock()
+
+	var history *verdictHistory
+	if element, ok := verdictHistories[connKey]; ok {
+		history = element.Value.(*verdictHistory) //nolint:forcetypeassert // Only verdictHistory is stored.
+		verdictHistoryOrder.MoveToFront(element)
+	} else {
+		history = &verdictHistory{key: connKey}
+		verdictHistories[connKey] = verdictHistoryOrder.PushFront(history)
+
+		// Remove the least recently updated history, if over the limit.
+		if verdictHistoryOrder.Len() > verdictHistoryMaxConnections {
+			oldest := verdictHistoryOrder.Back()
+			verdictHistoryOrder.Remove(oldest)
+			delete(verdictHistories, oldest.Value.(*verdictHistory).key) //nolint:forcetypeassert // Only verdictHistory is stored.
+		}
+	}
+
+	if len(history.records) >= verdictHistoryLength {
+		copy(history.records, history.records[1:])
+		history.records = history.records[:verdictHistoryLength-1]
+	}
+	history.records = append(history.records, record)
+}
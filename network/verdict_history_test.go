@@ -0,0 +1,49 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestVerdictHistory(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	conn := &Connection{ID: "verdict-history-test", RuleVersion: 7}
+
+	// Set more verdicts than are kept.
+	for i := 0; i < verdictHistoryLength+2; i++ {
+		verdict := VerdictAccept
+		if i%2 == 1 {
+			verdict = VerdictBlock
+		}
+		conn.SetVerdict(verdict, fmt.Sprintf("reason %d", i), "", nil)
+	}
+
+	history := ConnectionVerdictHistory(conn.ID)
+	if len(history) != verdictHistoryLength {
+		t.Fatalf("expected %d records, got %d", verdictHistoryLength, len(history))
+	}
+	if history[0].Reason != "reason 2" || history[len(history)-1].Reason != fmt.Sprintf("reason %d", verdictHistoryLength+1) {
+		t.Errorf("unexpected records: %+v", history)
+	}
+	if history[len(history)-1].Verdict != VerdictBlock {
+		t.Errorf("unexpected last verdict %s", history[len(history)-1].Verdict)
+	}
+	if history[len(history)-1].RuleVersion != 7 {
+		t.Errorf("record should carry the rule version of the verdict, got %d", history[len(history)-1].RuleVersion)
+	}
+	for i := 1; i < len(history); i++ {
+		if history[i].Time.Before(history[i-1].Time) {
+			t.Error("records must be ordered oldest first")
+		}
+	}
+
+	// Fill up the history of other connections.
+	for i := 0; i < verdictHistoryMaxConnections; i++ {
+		recordVerdict(fmt.Sprintf("other-%d", i), VerdictRecord{Verdict: VerdictDrop})
+	}
+	if ConnectionVerdictHistory(conn.ID) != nil {
+		t.Error("least recently updated history should have been removed")
+	}
+	if len(ConnectionVerdictHistory("other-0")) != 1 {
+		t.Error("history of other connection should be kept")
+	}
+}
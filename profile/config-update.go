@@ -36,6 +36,9 @@ func(ctx context.Context, _ interface{}) error {
 const globalConfigProfileErrorID = "profile:global-profile-error"
 
 func updateGlobalConfigProfile(ctx context.Context, task *modules.Task) error {
+	BeginRuleReload()
+	defer EndRuleReload()
+
 	cfgLock.Lock()
 	defer cfgLock.Unlock()
 
@@ -102,6 +102,10 @@
 	cfgOptionDisableAutoPermit      config.IntOption // security level option
 	cfgOptionDisableAutoPermitOrder = 65
 
+	CfgOptionShareWithChildProcessesKey   = "filter/shareWithChildProcesses"
+	cfgOptionShareWithChildProcesses      config.BoolOption
+	cfgOptionShareWithChildProcessesOrder = 66
+
 	// Setting "Permanent Verdicts" at order 96.
 
 	// Setting "Enable SPN" at order 128.
@@ -238,6 +242,25 @@ func registerConfiguration() error { //nolint:maintidx
 	cfgOptionDisableAutoPermit = config.Concurrent.GetAsInt(CfgOptionDisableAutoPermitKey, int64(status.SecurityLevelsAll))
 	cfgIntOptions[CfgOptionDisableAutoPermitKey] = cfgOptionDisableAutoPermit
 
+	// Share With Child Processes
+	err = config.Register(&config.Option{
+		Name:         "Apply Settings to Child Processes",
+		Key:          CfgOptionShareWithChildProcessesKey,
+		Description:  "Connections of processes started by this app, like helper processes of a browser, are filtered with the settings of this app instead of their own.",
+		OptType:      config.OptTypeBool,
+		ReleaseLevel: config.ReleaseLevelExperimental,
+		DefaultValue: false,
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: cfgOptionShareWithChildProcessesOrder,
+			config.CategoryAnnotation:     "Advanced",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	cfgOptionShareWithChildProcesses = config.Concurrent.GetAsBool(CfgOptionShareWithChildProcessesKey, false)
+	cfgBoolOptions[CfgOptionShareWithChildProcessesKey] = cfgOptionShareWithChildProcesses
+
 	rulesHelp := strings.ReplaceAll(`Rules are checked from top to bottom, stopping after the first match. They can match:
 
 - By address: "192.168.0.1"
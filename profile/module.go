@@ -18,11 +18,13 @@
 
 const (
 	profileConfigChange = "profile config change"
+	rulesReloaded       = "rules reloaded"
 )
 
 func init() {
 	module = modules.Register("profiles", prep, start, nil, "base", "updates")
 	module.RegisterEvent(profileConfigChange, true)
+	module.RegisterEvent(rulesReloaded, false)
 }
 
 func prep() error {
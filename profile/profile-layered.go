@@ -36,6 +36,7 @@ type LayeredProfile struct {
 	// by DSD this WILL BREAK!
 
 	DisableAutoPermit   config.BoolOption   `json:"-"`
+	ShareWithChildren   config.BoolOption   `json:"-"`
 	BlockScopeLocal     config.BoolOption   `json:"-"`
 	BlockScopeLAN       config.BoolOption   `json:"-"`
 	BlockScopeInternet  config.BoolOption   `json:"-"`
@@ -53,6 +54,29 @@ type LayeredProfile struct {
 
 // NewLayeredProfile returns a new layered profile based on the given local profile.
 func NewLayeredProfile(localProfile *Profile) *LayeredProfile {
+	lp := newLayeredProfile(localProfile)
+
+	lp.CreateMeta()
+	lp.SetKey(runtime.DefaultRegistry.DatabaseName() + ":" + revisionProviderPrefix + localProfile.ScopedID())
+
+	// Inform database subscribers about the new layered profile.
+	lp.Lock()
+	defer lp.Unlock()
+
+	pushLayeredProfile(lp)
+
+	return lp
+}
+
+// NewDetachedLayeredProfile returns a new layered profile based on the given
+// local profile, which is not published to database subscribers. It can be
+// used to evaluate connections against a fixed version of a profile, without
+// affecting the layered profile that is in use.
+func NewDetachedLayeredProfile(localProfile *Profile) *LayeredProfile {
+	return newLayeredProfile(localProfile)
+}
+
+func newLayeredProfile(localProfile *Profile) *LayeredProfile {
 	var securityLevelVal uint32
 
 	lp := &LayeredProfile{
@@ -112,6 +136,10 @@ func NewLayeredProfile(localProfile *Profile) *LayeredProfile {
 		CfgOptionDomainHeuristicsKey,
 		cfgOptionDomainHeuristics,
 	)
+	lp.ShareWithChildren = lp.wrapBoolOption(
+		CfgOptionShareWithChildProcessesKey,
+		cfgOptionShareWithChildProcesses,
+	)
 	lp.UseSPN = lp.wrapBoolOption(
 		CfgOptionUseSPNKey,
 		cfgOptionUseSPN,
@@ -128,15 +156,6 @@ func NewLayeredProfile(localProfile *Profile) *LayeredProfile {
 
 	lp.updateCaches()
 
-	lp.CreateMeta()
-	lp.SetKey(runtime.DefaultRegistry.DatabaseName() + ":" + revisionProviderPrefix + localProfile.ScopedID())
-
-	// Inform database subscribers about the new layered profile.
-	lp.Lock()
-	defer lp.Unlock()
-
-	pushLayeredProfile(lp)
-
 	return lp
 }
 
@@ -0,0 +1,98 @@
+package profile
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RuleVersion identifies a version of the ruleset. It is increased with every
+// finished rules reload, so verdicts that were decided with an older version
+// may be outdated.
+type RuleVersion uint64
+
+var (
+	ruleReloadLock sync.Mutex
+	ruleReloadCnt  int
+	ruleReloadDone chan struct{}
+
+	ruleVersion = new(uint64)
+)
+
+// CurrentRuleVersion returns the version of the ruleset that decisions are
+// currently made with.
+func CurrentRuleVersion() RuleVersion {
+	return RuleVersion(atomic.LoadUint64(ruleVersion))
+}
+
+// BeginRuleReload marks the start of a rules reload. Decisions on new
+// connections should wait until EndRuleReload is called, so that they are not
+// made with a partially swapped ruleset. Calls may be nested and every call
+// must be followed by a call to EndRuleReload.
+func BeginRuleReload() {
+	ruleReloadLock.Lock()
+	defer ruleReloadLock.Unlock()
+
+	if ruleReloadCnt == 0 {
+		ruleReloadDone = make(chan struct{})
+	}
+	ruleReloadCnt++
+}
+
+// EndRuleReload marks the end of a rules reload and releases all waiting
+// decisions, once all nested reloads have ended. The rule version is then
+// increased, see CurrentRuleVersion, and the "rules reloaded" event is
+// triggered.
+func EndRuleReload() {
+	if endRuleReload() {
+		module.TriggerEvent(rulesReloaded, nil)
+	}
+}
+
+func endRuleReload() (reloaded bool) {
+	ruleReloadLock.Lock()
+	defer ruleReloadLock.Unlock()
+
+	if ruleReloadCnt == 0 {
+		return false
+	}
+	ruleReloadCnt--
+	if ruleReloadCnt == 0 {
+		atomic.AddUint64(ruleVersion, 1)
+		close(ruleReloadDone)
+		ruleReloadDone = nil
+		return true
+	}
+	return false
+}
+
+// RuleReloadInProgress returns whether a rules reload is currently in progress.
+func RuleReloadInProgress() bool {
+	ruleReloadLock.Lock()
+	defer ruleReloadLock.Unlock()
+
+	return ruleReloadCnt > 0
+}
+
+// WaitForRuleReload waits until a rules reload in progress has finished, but
+// at most for the given duration. It returns whether no reload is in progress
+// anymore.
+func WaitForRuleReload(ctx context.Context, maxWait time.Duration) (finished bool) {
+	ruleReloadLock.Lock()
+	done := ruleReloadDone
+	ruleReloadLock.Unlock()
+
+	if done == nil {
+		return true
+	}
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(maxWait):
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
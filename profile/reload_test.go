@@ -0,0 +1,58 @@
+package profile
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRuleReloadBarrier(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	if !WaitForRuleReload(context.Background(), time.Second) {
+		t.Fatal("should not wait without reload")
+	}
+
+	// Nested reloads.
+	version := CurrentRuleVersion()
+	BeginRuleReload()
+	BeginRuleReload()
+	EndRuleReload()
+	if !RuleReloadInProgress() {
+		t.Fatal("reload should still be in progress")
+	}
+	if CurrentRuleVersion() != version {
+		t.Fatal("rule version should only change when the outermost reload ends")
+	}
+
+	// Waiting is bounded.
+	start := time.Now()
+	if WaitForRuleReload(context.Background(), 10*time.Millisecond) {
+		t.Fatal("reload should not have finished")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("waiting should be bounded")
+	}
+
+	// Waiting is released when the reload ends.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		EndRuleReload()
+	}()
+	if !WaitForRuleReload(context.Background(), 10*time.Second) {
+		t.Fatal("reload should have finished")
+	}
+	if RuleReloadInProgress() {
+		t.Fatal("reload should not be in progress anymore")
+	}
+	if CurrentRuleVersion() != version+1 {
+		t.Fatalf("rule version should have been incremented once, got %d", CurrentRuleVersion())
+	}
+
+	// Unpaired end calls are ignored.
+	EndRuleReload()
+	if RuleReloadInProgress() {
+		t.Fatal("reload should not be in progress")
+	}
+	if CurrentRuleVersion() != version+1 {
+		t.Fatal("unpaired end call should not change the rule version")
+	}
+}
@@ -1,14 +1,95 @@
 package updates
 
 import (
+	"fmt"
+	"net/http"
+
 	"github.com/safing/portbase/api"
 )
 
 const (
 	apiPathCheckForUpdates = "updates/check"
+	apiPathTestRestart     = "updates/restart/test"
+	apiPathEventLog        = "updates/events"
+	apiPathChannels        = "updates/channels"
+	apiPathSetChannel      = "updates/channels/set"
 )
 
 func registerAPIEndpoints() error {
+	if err := api.RegisterEndpoint(api.Endpoint{
+		Path:      apiPathTestRestart,
+		Write:     api.PermitAdmin,
+		BelongsTo: module,
+		StructFunc: func(ar *api.Request) (i interface{}, err error) {
+			return TestRestart(ar.Context())
+		},
+		Name:        "Test Restart",
+		Description: "Runs all restart preparations without restarting and returns what a restart would do.",
+	}); err != nil {
+		return err
+	}
+
+	if err := api.RegisterEndpoint(api.Endpoint{
+		Path:      apiPathEventLog,
+		Read:      api.PermitUser,
+		BelongsTo: module,
+		StructFunc: func(_ *api.Request) (i interface{}, err error) {
+			return UpdateEventLog(), nil
+		},
+		Name:        "Get Update Event Log",
+		Description: "Returns the recorded update and restart events, oldest first.",
+	}); err != nil {
+		return err
+	}
+
+	if err := api.RegisterEndpoint(api.Endpoint{
+		Path:      apiPathChannels,
+		Read:      api.PermitUser,
+		BelongsTo: module,
+		StructFunc: func(_ *api.Request) (i interface{}, err error) {
+			return GetUpdateChannels(), nil
+		},
+		Name:        "Get Update Channels",
+		Description: "Returns the release channel used for every resource, including the channels set for specific resources.",
+	}); err != nil {
+		return err
+	}
+
+	if err := api.RegisterEndpoint(api.Endpoint{
+		Path:      apiPathSetChannel,
+		Write:     api.PermitAdmin,
+		BelongsTo: module,
+		ActionFunc: func(ar *api.Request) (msg string, err error) {
+			resource := ar.Request.URL.Query().Get("resource")
+			channel := ar.Request.URL.Query().Get("channel")
+			if err := SetUpdateChannel(resource, channel); err != nil {
+				return "", err
+			}
+			if channel == "" {
+				return fmt.Sprintf("%s uses the default release channel", resource), nil
+			}
+			return fmt.Sprintf("%s uses the release channel %s", resource, channel), nil
+		},
+		Name:        "Set Update Channel",
+		Description: "Sets the release channel used for a resource instead of the configured release channel and checks for updates. The channel is kept across restarts.",
+		Parameters: []api.Parameter{
+			{
+				Method:      http.MethodGet,
+				Field:       "resource",
+				Value:       "<Resource identifier or prefix ending with a slash>",
+				Description: "Specify the resource, eg. `all/ui/` for all UI modules.",
+			},
+			{
+				Method:      http.MethodGet,
+				Field:       "channel",
+				Value:       "stable|beta|staging|support",
+				Description: "Specify the release channel. Leave empty to use the configured release channel again.",
+			},
+		},
+	}); err != nil {
+		return err
+	}
+
 	return api.RegisterEndpoint(api.Endpoint{
 		Path:      apiPathCheckForUpdates,
 		Write:     api.PermitUser,
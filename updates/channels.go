@@ -0,0 +1,360 @@
+package updates
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	semver "github.com/hashicorp/go-version"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portbase/updater"
+	"github.com/safing/portmaster/updates/helper"
+)
+
+const (
+	intelIndexPath = "all/intel/intel.json"
+
+	// resourceChannelsFile is the file in the updates directory that holds
+	// the channels set for resources, so that they are kept across restarts.
+	resourceChannelsFile = "resource-channels.json"
+)
+
+var (
+	// resourceChannels holds the release channels that are used for specific
+	// resources instead of the configured release channel.
+	resourceChannels     = make(map[string]string)
+	resourceChannelsLock sync.Mutex
+)
+
+// UpdateChannels describes the release channels used for the resources.
+type UpdateChannels struct {
+	// Default is the configured release channel.
+	Default string
+	// Overrides holds the channels set with SetUpdateChannel, by resource
+	// identifier or identifier prefix.
+	Overrides map[string]string
+	// Resources holds the channel used for every known resource.
+	Resources map[string]string
+}
+
+// SetUpdateChannel sets the release channel used for the given resource,
+// instead of the configured release channel, and triggers an update check.
+// The resource is either a resource identifier, such as
+// "linux_amd64/core/portmaster-core", or a prefix ending with a slash that
+// covers all resources below it, such as "all/intel/". The most specific
+// entry applies. An empty channel removes the entry for the resource.
+//
+// If the channel lists a different version of a resource, it becomes the
+// current release of the resource and is downloaded and verified by the next
+// update check, like any other update. Channels set this way are saved in the
+// updates directory and are used again after the Portmaster is restarted.
+func SetUpdateChannel(resource string, channel string) error {
+	if err := checkUpdateChannel(resource, channel); err != nil {
+		return err
+	}
+
+	resourceChannelsLock.Lock()
+	previous, ok := resourceChannels[resource]
+	switch {
+	case channel == "" && ok:
+		delete(resourceChannels, resource)
+	case channel != "" && channel != previous:
+		resourceChannels[resource] = channel
+	default:
+		resourceChannelsLock.Unlock()
+		return nil
+	}
+	err := saveResourceChannels()
+	resourceChannelsLock.Unlock()
+	if err != nil {
+		log.Warningf("updates: failed to save release channels of resources: %s", err)
+	}
+
+	if channel == "" {
+		log.Infof("updates: resource %s uses the default release channel again", resource)
+	} else {
+		log.Infof("updates: resource %s now uses the release channel %s", resource, channel)
+	}
+
+	// Make the indexes of the channel available and select the versions.
+	if warning := setIndexes(previousReleaseChannel, false); warning != nil {
+		log.Warningf("updates: %s", warning)
+	}
+	if err := registry.LoadIndexes(module.Ctx); err != nil {
+		log.Warningf("updates: failed to load indexes: %s", err)
+	}
+	applyUpdateChannels()
+	registry.SelectVersions()
+	module.TriggerEvent(VersionUpdateEvent, nil)
+
+	if err := TriggerUpdate(false); err != nil {
+		log.Warningf("updates: failed to trigger update: %s", err)
+	}
+	return nil
+}
+
+// checkUpdateChannel checks whether the channel can be set for the resource.
+func checkUpdateChannel(resource string, channel string) error {
+	switch channel {
+	case "",
+		helper.ReleaseChannelStable,
+		helper.ReleaseChannelBeta,
+		helper.ReleaseChannelStaging,
+		helper.ReleaseChannelSupport:
+	default:
+		return fmt.Errorf("unknown release channel %q", channel)
+	}
+
+	if resource == "" {
+		return errors.New("no resource specified")
+	}
+	if registry == nil {
+		return errors.New("updates are not initialized")
+	}
+	for identifier := range registry.Export() {
+		if identifier == resource ||
+			(strings.HasSuffix(resource, "/") && strings.HasPrefix(identifier, resource)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown resource %s", resource)
+}
+
+// loadResourceChannels loads the channels set for resources from the updates
+// directory. Entries with unknown channels are ignored.
+func loadResourceChannels() error {
+	data, err := os.ReadFile(filepath.Join(registry.StorageDir().Path, resourceChannelsFile))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	var channels map[string]string
+	if err := json.Unmarshal(data, &channels); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", resourceChannelsFile, err)
+	}
+
+	resourceChannelsLock.Lock()
+	defer resourceChannelsLock.Unlock()
+
+	resourceChannels = make(map[string]string, len(channels))
+	for resource, channel := range channels {
+		switch channel {
+		case helper.ReleaseChannelStable,
+			helper.ReleaseChannelBeta,
+			helper.ReleaseChannelStaging,
+			helper.ReleaseChannelSupport:
+			resourceChannels[resource] = channel
+		default:
+			log.Warningf("updates: ignoring unknown release channel %q of resource %s", channel, resource)
+		}
+	}
+	return nil
+}
+
+// saveResourceChannels saves the channels set for resources to the updates
+// directory. resourceChannelsLock must be held.
+func saveResourceChannels() error {
+	path := filepath.Join(registry.StorageDir().Path, resourceChannelsFile)
+	if len(resourceChannels) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(resourceChannels)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o0600)
+}
+
+// GetUpdateChannels returns the release channels used for the resources.
+func GetUpdateChannels() *UpdateChannels {
+	channels := &UpdateChannels{
+		Default:   previousReleaseChannel,
+		Overrides: make(map[string]string),
+		Resources: make(map[string]string),
+	}
+
+	resourceChannelsLock.Lock()
+	defer resourceChannelsLock.Unlock()
+
+	for resource, channel := range resourceChannels {
+		channels.Overrides[resource] = channel
+	}
+	if registry != nil {
+		for identifier := range registry.Export() {
+			channels.Resources[identifier] = channelOfResource(identifier, channels.Default)
+		}
+	}
+	return channels
+}
+
+// channelOfResource returns the release channel of the resource.
+// resourceChannelsLock must be held.
+func channelOfResource(identifier, defaultChannel string) string {
+	channel, ok := resourceChannels[identifier]
+	if ok {
+		return channel
+	}
+
+	channel = defaultChannel
+	var matched string
+	for resource, resourceChannel := range resourceChannels {
+		if strings.HasSuffix(resource, "/") &&
+			strings.HasPrefix(identifier, resource) &&
+			len(resource) > len(matched) {
+			matched = resource
+			channel = resourceChannel
+		}
+	}
+	return channel
+}
+
+// channelIndexes returns the paths of the indexes that make up the channel,
+// in the order in which they override each other, see helper.SetIndexes.
+func channelIndexes(channel string) []string {
+	switch channel {
+	case helper.ReleaseChannelBeta:
+		return []string{intelIndexPath, helper.ReleaseChannelStable + ".json", helper.ReleaseChannelBeta + ".json"}
+	case helper.ReleaseChannelStaging:
+		return []string{intelIndexPath, helper.ReleaseChannelStable + ".json", helper.ReleaseChannelBeta + ".json", helper.ReleaseChannelStaging + ".json"}
+	case helper.ReleaseChannelSupport:
+		return []string{intelIndexPath, helper.ReleaseChannelStable + ".json", helper.ReleaseChannelSupport + ".json"}
+	default:
+		return []string{intelIndexPath, helper.ReleaseChannelStable + ".json"}
+	}
+}
+
+// setIndexes sets the indexes of the configured release channel, see
+// helper.SetIndexes, and adds the indexes of the channels set for resources.
+// Unused indexes are only deleted if no channels are set for resources.
+func setIndexes(defaultChannel string, deleteUnusedIndexes bool) (warning error) {
+	resourceChannelsLock.Lock()
+	channels := make([]string, 0, len(resourceChannels))
+	for _, channel := range resourceChannels {
+		channels = append(channels, channel)
+	}
+	resourceChannelsLock.Unlock()
+
+	warning = helper.SetIndexes(registry, defaultChannel, deleteUnusedIndexes && len(channels) == 0)
+	for _, indexPath := range additionalIndexes(defaultChannel, channels) {
+		registry.AddIndex(updater.Index{
+			Path: indexPath,
+			PreRelease: indexPath == helper.ReleaseChannelBeta+".json" ||
+				indexPath == helper.ReleaseChannelStaging+".json",
+		})
+	}
+	return warning
+}
+
+// additionalIndexes returns the indexes required by the given channels that
+// are not part of the default channel, in a stable order.
+func additionalIndexes(defaultChannel string, channels []string) []string {
+	defaultIndexes := make(map[string]struct{})
+	for _, indexPath := range channelIndexes(defaultChannel) {
+		defaultIndexes[indexPath] = struct{}{}
+	}
+
+	var indexes []string
+	seen := make(map[string]struct{})
+	for _, channel := range channels {
+		for _, indexPath := range channelIndexes(channel) {
+			_, isDefault := defaultIndexes[indexPath]
+			_, isSeen := seen[indexPath]
+			if !isDefault && !isSeen {
+				seen[indexPath] = struct{}{}
+				indexes = append(indexes, indexPath)
+			}
+		}
+	}
+	sort.Strings(indexes)
+	return indexes
+}
+
+// applyUpdateChannels marks the version listed by the release channel of
+// every resource as its current release. As the indexes of all channels in use
+// are loaded, the current release would otherwise be taken from the last index
+// only. It must be called after the indexes are loaded and before the
+// versions are selected or updates are downloaded.
+func applyUpdateChannels() {
+	resourceChannelsLock.Lock()
+	defer resourceChannelsLock.Unlock()
+
+	if len(resourceChannels) == 0 {
+		return
+	}
+
+	// Load the releases of the channels.
+	defaultChannel := previousReleaseChannel
+	releases := make(map[string]map[string]string)
+	for identifier := range registry.Export() {
+		channel := channelOfResource(identifier, defaultChannel)
+		if _, ok := releases[channel]; !ok {
+			releases[channel] = channelReleases(registry.StorageDir().Path, channel)
+		}
+	}
+
+	for identifier, res := range registry.Export() {
+		version, ok := releases[channelOfResource(identifier, defaultChannel)][identifier]
+		if !ok || !hasVersion(res, version) {
+			continue
+		}
+		if err := registry.AddResource(identifier, version, false, true, false); err != nil {
+			log.Warningf("updates: failed to set current release of %s to %s: %s", identifier, version, err)
+		}
+	}
+}
+
+// channelReleases returns the releases of the channel from the index files in
+// the given storage directory. Indexes that are later in the channel override
+// the releases of earlier ones.
+func channelReleases(storageDir, channel string) map[string]string {
+	releases := make(map[string]string)
+	for _, indexPath := range channelIndexes(channel) {
+		indexData, err := os.ReadFile(filepath.Join(storageDir, filepath.FromSlash(indexPath)))
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				log.Warningf("updates: failed to read index %s: %s", indexPath, err)
+			}
+			continue
+		}
+		indexFile, err := updater.ParseIndexFile(indexData, "", time.Time{})
+		if err != nil {
+			log.Warningf("updates: failed to parse index %s: %s", indexPath, err)
+			continue
+		}
+		for identifier, version := range indexFile.Releases {
+			releases[identifier] = version
+		}
+	}
+	return releases
+}
+
+// hasVersion returns whether the version is known for the exported resource.
+// Only versions that were added by the registry when loading the indexes are
+// considered, as the index files are not verified again.
+func hasVersion(res *updater.Resource, version string) bool {
+	sv, err := semver.NewVersion(version)
+	if err != nil {
+		return false
+	}
+	for _, rv := range res.Versions {
+		if rv.VersionNumber == sv.String() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package updates
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/safing/portbase/updater"
+	"github.com/safing/portbase/utils"
+	"github.com/safing/portmaster/updates/helper"
+)
+
+const (
+	testCoreIdentifier = "linux_amd64/core/portmaster-core"
+	testUIIdentifier   = "all/ui/modules/portmaster.zip"
+)
+
+// setupChannelTest sets up a registry with a stable and a beta index, which
+// both list a new version of the core and the UI.
+func setupChannelTest(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	indexes := map[string]string{
+		"stable.json": `{"Channel":"stable","Releases":{"` + testCoreIdentifier + `":"1.0.0","` + testUIIdentifier + `":"1.0.0"}}`,
+		"beta.json":   `{"Channel":"beta","Releases":{"` + testCoreIdentifier + `":"1.1.0-beta","` + testUIIdentifier + `":"1.1.0-beta"}}`,
+	}
+	for name, data := range indexes {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	registry = &updater.ResourceRegistry{
+		Name: "test",
+	}
+	if err := registry.Initialize(utils.NewDirStructure(dir, 0o0755)); err != nil {
+		t.Fatal(err)
+	}
+	previousReleaseChannel = helper.ReleaseChannelStable
+	resourceChannels = make(map[string]string)
+
+	// The beta index is only loaded for resources that use the beta channel.
+	if warning := setIndexes(previousReleaseChannel, true); warning != nil {
+		t.Fatal(warning)
+	}
+	// Loading fails for the missing intel index only.
+	_ = registry.LoadIndexes(context.Background())
+	// Restore the unused beta index that was deleted, as it cannot be
+	// downloaded by the offline registry.
+	if err := os.WriteFile(filepath.Join(dir, "beta.json"), []byte(indexes["beta.json"]), 0o0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make all versions available, as the registry is offline.
+	for _, identifier := range []string{testCoreIdentifier, testUIIdentifier} {
+		for _, version := range []string{"1.0.0", "1.1.0-beta"} {
+			if err := registry.AddResource(identifier, version, true, false, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	registry.SelectVersions()
+}
+
+func checkVersions(t *testing.T, core, ui string) {
+	t.Helper()
+
+	for identifier, expected := range map[string]string{
+		testCoreIdentifier: core,
+		testUIIdentifier:   ui,
+	} {
+		res := registry.Export()[identifier]
+		if res.SelectedVersion == nil || res.SelectedVersion.VersionNumber != expected {
+			t.Errorf("expected %s to select %s, got %v", identifier, expected, res.SelectedVersion)
+		}
+		for _, rv := range res.Versions {
+			if rv.CurrentRelease != (rv.VersionNumber == expected) {
+				t.Errorf("expected %s to have the current release %s, got %s", identifier, expected, rv.VersionNumber)
+			}
+		}
+	}
+}
+
+func TestSetUpdateChannel(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func(reg *updater.ResourceRegistry, channel string) {
+		registry = reg
+		previousReleaseChannel = channel
+		resourceChannels = make(map[string]string)
+	}(registry, previousReleaseChannel)
+	setupChannelTest(t)
+	checkVersions(t, "1.0.0", "1.0.0")
+
+	// Switching the core to the beta channel only changes the core.
+	if err := SetUpdateChannel(testCoreIdentifier, helper.ReleaseChannelBeta); err != nil {
+		t.Fatal(err)
+	}
+	checkVersions(t, "1.1.0-beta", "1.0.0")
+	channels := GetUpdateChannels()
+	if channels.Resources[testCoreIdentifier] != helper.ReleaseChannelBeta ||
+		channels.Resources[testUIIdentifier] != helper.ReleaseChannelStable ||
+		channels.Overrides[testCoreIdentifier] != helper.ReleaseChannelBeta {
+		t.Errorf("unexpected update channels %+v", channels)
+	}
+
+	// The channels are loaded again after a restart.
+	resourceChannels = make(map[string]string)
+	if err := loadResourceChannels(); err != nil {
+		t.Fatal(err)
+	}
+	if channels := GetUpdateChannels(); len(channels.Overrides) != 1 || channels.Overrides[testCoreIdentifier] != helper.ReleaseChannelBeta {
+		t.Errorf("channels should have been loaded, got %v", channels.Overrides)
+	}
+
+	// More specific entries apply.
+	if err := SetUpdateChannel("all/", helper.ReleaseChannelBeta); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetUpdateChannel(testCoreIdentifier, helper.ReleaseChannelStable); err != nil {
+		t.Fatal(err)
+	}
+	checkVersions(t, "1.0.0", "1.1.0-beta")
+
+	// Removing the entries switches back to the default channel.
+	if err := SetUpdateChannel("all/", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetUpdateChannel(testCoreIdentifier, ""); err != nil {
+		t.Fatal(err)
+	}
+	checkVersions(t, "1.0.0", "1.0.0")
+	if channels := GetUpdateChannels(); len(channels.Overrides) != 0 {
+		t.Errorf("unexpected overrides %v", channels.Overrides)
+	}
+	if _, err := os.Stat(filepath.Join(registry.StorageDir().Path, resourceChannelsFile)); !os.IsNotExist(err) {
+		t.Errorf("channels file should have been removed, got %v", err)
+	}
+}
+
+func TestSetUpdateChannelValidation(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func(reg *updater.ResourceRegistry, channel string) {
+		registry = reg
+		previousReleaseChannel = channel
+		resourceChannels = make(map[string]string)
+	}(registry, previousReleaseChannel)
+	setupChannelTest(t)
+
+	for _, test := range []struct {
+		resource string
+		channel  string
+	}{
+		{testCoreIdentifier, "nightly"},
+		{testCoreIdentifier, "Beta"},
+		{"", helper.ReleaseChannelBeta},
+		{"linux_amd64/core/unknown", helper.ReleaseChannelBeta},
+		{"linux_amd64/core", helper.ReleaseChannelBeta},
+		{"windows_amd64/", helper.ReleaseChannelBeta},
+	} {
+		if err := SetUpdateChannel(test.resource, test.channel); err == nil {
+			t.Errorf("setting channel %q for %q should fail", test.channel, test.resource)
+		}
+	}
+	if channels := GetUpdateChannels(); len(channels.Overrides) != 0 {
+		t.Errorf("invalid channels must not be set, got %v", channels.Overrides)
+	}
+}
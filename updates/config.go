@@ -70,6 +70,42 @@ func registerConfig() error {
 		return err
 	}
 
+	err = config.Register(&config.Option{
+		Name:            "Restart Strategy",
+		Key:             cfgRestartStrategyKey,
+		Description:     "How the Portmaster is started again when it restarts, eg. to apply updates. The supervisor that manages the Portmaster process must be set up accordingly.",
+		OptType:         config.OptTypeString,
+		ExpertiseLevel:  config.ExpertiseLevelDeveloper,
+		ReleaseLevel:    config.ReleaseLevelExperimental,
+		RequiresRestart: false,
+		DefaultValue:    RestartStrategyPortmasterStart,
+		PossibleValues: []config.PossibleValue{
+			{
+				Name:        "Portmaster Start",
+				Description: "Exit with the restart exit code 23, which makes portmaster-start start the Portmaster again.",
+				Value:       RestartStrategyPortmasterStart,
+			},
+			{
+				Name:        "Systemd",
+				Description: "Exit with the exit code set with the restart-systemd-exit-code flag (75 by default), so that systemd starts the service again with Restart=on-failure.",
+				Value:       RestartStrategySystemd,
+			},
+			{
+				Name:        "Restart Request File",
+				Description: "Write a restart request file to the data directory and exit with 0, for supervisors that watch for the file.",
+				Value:       RestartStrategyRequestFile,
+			},
+		},
+		Annotations: config.Annotations{
+			config.DisplayOrderAnnotation: -3,
+			config.DisplayHintAnnotation:  config.DisplayHintOneOf,
+			config.CategoryAnnotation:     "Updates",
+		},
+	})
+	if err != nil {
+		return err
+	}
+
 	err = config.Register(&config.Option{
 		Name:            "Automatic Updates",
 		Key:             enableUpdatesKey,
@@ -101,6 +137,8 @@ func initConfig() {
 
 	devMode = config.Concurrent.GetAsBool(cfgDevModeKey, false)
 	previousDevMode = devMode()
+
+	restartStrategyOption = config.Concurrent.GetAsString(cfgRestartStrategyKey, RestartStrategyPortmasterStart)
 }
 
 func createWarningNotification() {
@@ -123,10 +161,11 @@ func updateRegistryConfig(_ context.Context, _ interface{}) error {
 
 	if releaseChannel() != previousReleaseChannel {
 		previousReleaseChannel = releaseChannel()
-		warning := helper.SetIndexes(registry, releaseChannel(), true)
+		warning := setIndexes(releaseChannel(), true)
 		if warning != nil {
 			log.Warningf("updates: %s", warning)
 		}
+		applyUpdateChannels()
 		changed = true
 	}
 
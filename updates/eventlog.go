@@ -0,0 +1,243 @@
+package updates
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/safing/portbase/dataroot"
+	"github.com/safing/portbase/info"
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/updates/helper"
+)
+
+// UpdateEventType is the type of an update event.
+type UpdateEventType string
+
+// Update Event Types.
+const (
+	// UpdateEventChecked is recorded when the check for updates succeeded.
+	// Repeated checks are coalesced, see updateCheckEventInterval.
+	UpdateEventChecked UpdateEventType = "checked"
+	// UpdateEventDownloaded is recorded when a new version was downloaded.
+	UpdateEventDownloaded UpdateEventType = "downloaded"
+	// UpdateEventVerified is recorded when the staged version passed its
+	// validation and self-test before a restart.
+	UpdateEventVerified UpdateEventType = "verified"
+	// UpdateEventArmed is recorded when a restart into the staged version was
+	// scheduled or the staged version is applied on the next start.
+	UpdateEventArmed UpdateEventType = "armed"
+	// UpdateEventTriggered is recorded when the restart is initiated.
+	UpdateEventTriggered UpdateEventType = "triggered"
+	// UpdateEventAborted is recorded when the restart was aborted or blocked.
+	UpdateEventAborted UpdateEventType = "aborted"
+	// UpdateEventApplied is recorded when a version is started for the first
+	// time.
+	UpdateEventApplied UpdateEventType = "applied"
+)
+
+const (
+	// updateEventLogFileName is the name of the file in the data root
+	// directory that holds the update event log.
+	updateEventLogFileName = "update-events.log"
+	// updateEventLogMaxSize is the size after which the event log is rotated.
+	// One rotated log is kept, so the log uses at most twice this size.
+	updateEventLogMaxSize = 64 * 1024
+	// updateCheckEventInterval is the interval in which repeated checks of the
+	// same version are recorded only once, so that routine checks do not push
+	// the other events out of the log.
+	updateCheckEventInterval = 24 * time.Hour
+)
+
+// UpdateEvent is an entry of the update event log.
+type UpdateEvent struct {
+	// Time is the time at which the event occurred.
+	Time time.Time `json:"time"`
+	// Type is the type of the event.
+	Type UpdateEventType `json:"type"`
+	// Version is the version the event relates to, if known.
+	Version string `json:"version,omitempty"`
+	// Message optionally describes the event further, such as why a restart
+	// was aborted.
+	Message string `json:"message,omitempty"`
+}
+
+var updateEventLogLock sync.Mutex
+
+// UpdateEventLog returns the events of the update event log, oldest first.
+// The log is kept in the data root directory across restarts and is rotated
+// when it grows too large, so older events are removed eventually.
+func UpdateEventLog() []UpdateEvent {
+	if dataroot.Root() == nil {
+		return nil
+	}
+
+	updateEventLogLock.Lock()
+	defer updateEventLogLock.Unlock()
+
+	events, err := readUpdateEventLog(updateEventLogPath())
+	if err != nil {
+		log.Warningf("updates: failed to read event log: %s", err)
+	}
+	return events
+}
+
+// recordUpdateEvent appends the event to the update event log.
+func recordUpdateEvent(eventType UpdateEventType, version, message string) {
+	if dataroot.Root() == nil {
+		return
+	}
+
+	updateEventLogLock.Lock()
+	defer updateEventLogLock.Unlock()
+
+	err := appendUpdateEvent(updateEventLogPath(), &UpdateEvent{
+		Time:    time.Now(),
+		Type:    eventType,
+		Version: version,
+		Message: message,
+	}, updateEventLogMaxSize)
+	if err != nil {
+		log.Warningf("updates: failed to record %s event: %s", eventType, err)
+	}
+}
+
+// recordUpdateCheck records a successful check for updates, unless it repeats
+// a check that was recorded recently, see updateCheckEventInterval.
+func recordUpdateCheck(version string) {
+	if checkRepeatsLastEvent(UpdateEventLog(), version, time.Now()) {
+		return
+	}
+	recordUpdateEvent(UpdateEventChecked, version, "")
+}
+
+// checkRepeatsLastEvent returns whether a check of the given version repeats
+// the newest of the events, which is the case if it is a check of the same
+// version that was recorded less than updateCheckEventInterval ago.
+func checkRepeatsLastEvent(events []UpdateEvent, version string, now time.Time) bool {
+	if len(events) == 0 {
+		return false
+	}
+	last := events[len(events)-1]
+	return last.Type == UpdateEventChecked &&
+		last.Version == version &&
+		now.Sub(last.Time) < updateCheckEventInterval
+}
+
+// recordAppliedVersion records that the running version was applied, if it
+// is not the version that was last recorded as applied.
+func recordAppliedVersion() {
+	version := info.Version()
+	events := UpdateEventLog()
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Type == UpdateEventApplied {
+			if events[i].Version == version {
+				return
+			}
+			break
+		}
+	}
+	recordUpdateEvent(UpdateEventApplied, version, "")
+}
+
+// stagedVersion returns the selected version of the binary to restart into.
+func stagedVersion() string {
+	identifier, ok := stagedBinaryIdentifier()
+	if !ok || registry == nil {
+		return ""
+	}
+	return registry.GetSelectedVersions()[helper.PlatformIdentifier(identifier)]
+}
+
+func updateEventLogPath() string {
+	return filepath.Join(dataroot.Root().Path, updateEventLogFileName)
+}
+
+// rotatedUpdateEventLogPath returns the path of the rotated event log.
+func rotatedUpdateEventLogPath(path string) string {
+	return path + ".1"
+}
+
+// appendUpdateEvent appends the event as a line of JSON to the event log at
+// path and syncs it to disk. If the log would grow larger than maxSize, it is
+// rotated first by atomically renaming it, which replaces the previously
+// rotated log.
+func appendUpdateEvent(path string, event *UpdateEvent, maxSize int64) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to serialize event: %w", err)
+	}
+	line = append(line, '\n')
+
+	// Rotate the log if it would grow too large.
+	stat, err := os.Stat(path)
+	switch {
+	case err == nil:
+		if stat.Size() > 0 && stat.Size()+int64(len(line)) > maxSize {
+			if err := os.Rename(path, rotatedUpdateEventLogPath(path)); err != nil {
+				return fmt.Errorf("failed to rotate event log: %w", err)
+			}
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("failed to check event log: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o0600)
+	if err != nil {
+		return fmt.Errorf("failed to open event log: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	// Terminate a line that was cut off by a crash, so that the new event
+	// starts on its own line.
+	if stat, err := f.Stat(); err == nil && stat.Size() > 0 {
+		lastByte := make([]byte, 1)
+		if _, err := f.ReadAt(lastByte, stat.Size()-1); err == nil && lastByte[0] != '\n' {
+			line = append([]byte{'\n'}, line...)
+		}
+	}
+
+	// Write the event with a single write, which is appended atomically.
+	if _, err := f.Write(line); err != nil {
+		return fmt.Errorf("failed to write event: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync event log: %w", err)
+	}
+	return nil
+}
+
+// readUpdateEventLog reads the rotated and the current event log at path.
+// Lines that cannot be parsed, such as a line that was cut off by a crash,
+// are skipped.
+func readUpdateEventLog(path string) ([]UpdateEvent, error) {
+	var events []UpdateEvent
+	for _, logPath := range []string{rotatedUpdateEventLogPath(path), path} {
+		data, err := os.ReadFile(logPath)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return events, fmt.Errorf("failed to read event log: %w", err)
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			var event UpdateEvent
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				continue
+			}
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,119 @@
+package updates
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpdateEventLog(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), updateEventLogFileName)
+
+	// An empty log is not an error.
+	events, err := readUpdateEventLog(path)
+	if err != nil || len(events) != 0 {
+		t.Fatalf("expected no events, got %v, %s", events, err)
+	}
+
+	for _, eventType := range []UpdateEventType{UpdateEventChecked, UpdateEventDownloaded, UpdateEventArmed} {
+		if err := appendUpdateEvent(path, &UpdateEvent{Type: eventType, Version: "1.0.0"}, updateEventLogMaxSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Simulate a crash during a write.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"time":"2023-`); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	// The torn line is skipped and the next event is still readable.
+	if err := appendUpdateEvent(path, &UpdateEvent{Type: UpdateEventTriggered, Version: "1.0.0"}, updateEventLogMaxSize); err != nil {
+		t.Fatal(err)
+	}
+	events, err = readUpdateEventLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, event := range events {
+		types = append(types, string(event.Type))
+	}
+	if strings.Join(types, ",") != "checked,downloaded,armed,triggered" {
+		t.Errorf("unexpected events: %v", types)
+	}
+}
+
+func TestUpdateEventLogRotation(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), updateEventLogFileName)
+	const maxSize = 512
+
+	for i := 0; i < 50; i++ {
+		if err := appendUpdateEvent(path, &UpdateEvent{Type: UpdateEventChecked, Version: "1.0.0"}, maxSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := appendUpdateEvent(path, &UpdateEvent{Type: UpdateEventApplied, Version: "1.0.1"}, maxSize); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both the current and the rotated log stay within the size limit.
+	for _, logPath := range []string{path, rotatedUpdateEventLogPath(path)} {
+		stat, err := os.Stat(logPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Size() > maxSize {
+			t.Errorf("%s is larger than the size limit: %d", logPath, stat.Size())
+		}
+	}
+
+	events, err := readUpdateEventLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) == 0 || len(events) >= 51 {
+		t.Fatalf("older events should have been rotated out, got %d events", len(events))
+	}
+	if last := events[len(events)-1]; last.Type != UpdateEventApplied || last.Version != "1.0.1" {
+		t.Errorf("last event should be the newest, got %+v", last)
+	}
+}
+
+func TestCheckRepeatsLastEvent(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	checked := UpdateEvent{Time: now.Add(-time.Hour), Type: UpdateEventChecked, Version: "1.0.0"}
+	tests := []struct {
+		name    string
+		events  []UpdateEvent
+		version string
+		repeats bool
+	}{
+		{"empty log", nil, "1.0.0", false},
+		{"recent check of same version", []UpdateEvent{checked}, "1.0.0", true},
+		{"recent check of other version", []UpdateEvent{checked}, "1.0.1", false},
+		{"old check of same version", []UpdateEvent{{
+			Time: now.Add(-2 * updateCheckEventInterval), Type: UpdateEventChecked, Version: "1.0.0",
+		}}, "1.0.0", false},
+		{"other event after check", []UpdateEvent{checked, {
+			Time: now.Add(-time.Minute), Type: UpdateEventAborted, Version: "1.0.0",
+		}}, "1.0.0", false},
+	}
+	for _, test := range tests {
+		if repeats := checkRepeatsLastEvent(test.events, test.version, now); repeats != test.repeats {
+			t.Errorf("%s: expected repeats to be %v", test.name, test.repeats)
+		}
+	}
+}
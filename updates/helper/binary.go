@@ -0,0 +1,147 @@
+package helper
+
+import (
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ValidateBinary checks that the executable at the given path can be run on
+// the given platform, as described by GOOS and GOARCH values: It must be a
+// regular file, have the executable permission (except on Windows) and use the
+// executable format and architecture of the platform. The file size is
+// checked against the size expected from the headers of the executable, in
+// order to detect truncated files.
+func ValidateBinary(path, goos, goarch string) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to access binary: %w", err)
+	}
+	if !stat.Mode().IsRegular() {
+		return errors.New("binary is not a regular file")
+	}
+	if goos != "windows" && stat.Mode().Perm()&0o0111 == 0 {
+		return errors.New("binary is not executable")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open binary: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var expectedSize int64
+	switch goos {
+	case "windows":
+		expectedSize, err = validatePE(f, goarch)
+	case "darwin":
+		expectedSize, err = validateMachO(f, goarch)
+	default:
+		expectedSize, err = validateELF(f, goarch)
+	}
+	if err != nil {
+		return err
+	}
+
+	if stat.Size() < expectedSize {
+		return fmt.Errorf("binary is truncated: size is %d bytes, but expected at least %d bytes", stat.Size(), expectedSize)
+	}
+	return nil
+}
+
+var elfMachines = map[string]elf.Machine{
+	"386":     elf.EM_386,
+	"amd64":   elf.EM_X86_64,
+	"arm":     elf.EM_ARM,
+	"arm64":   elf.EM_AARCH64,
+	"riscv64": elf.EM_RISCV,
+}
+
+func validateELF(f *os.File, goarch string) (expectedSize int64, err error) {
+	machine, ok := elfMachines[goarch]
+	if !ok {
+		return 0, fmt.Errorf("unsupported architecture %s", goarch)
+	}
+
+	ef, err := elf.NewFile(f)
+	if err != nil {
+		return 0, fmt.Errorf("binary is not a valid ELF executable: %w", err)
+	}
+	if ef.Machine != machine {
+		return 0, fmt.Errorf("binary is built for %s, expected %s", ef.Machine, machine)
+	}
+
+	for _, prog := range ef.Progs {
+		expectedSize = maxInt64(expectedSize, int64(prog.Off+prog.Filesz))
+	}
+	for _, section := range ef.Sections {
+		if section.Type != elf.SHT_NOBITS {
+			expectedSize = maxInt64(expectedSize, int64(section.Offset+section.FileSize))
+		}
+	}
+	return expectedSize, nil
+}
+
+var peMachines = map[string]uint16{
+	"386":   pe.IMAGE_FILE_MACHINE_I386,
+	"amd64": pe.IMAGE_FILE_MACHINE_AMD64,
+	"arm":   pe.IMAGE_FILE_MACHINE_ARMNT,
+	"arm64": pe.IMAGE_FILE_MACHINE_ARM64,
+}
+
+func validatePE(f *os.File, goarch string) (expectedSize int64, err error) {
+	machine, ok := peMachines[goarch]
+	if !ok {
+		return 0, fmt.Errorf("unsupported architecture %s", goarch)
+	}
+
+	pf, err := pe.NewFile(f)
+	if err != nil {
+		return 0, fmt.Errorf("binary is not a valid PE executable: %w", err)
+	}
+	if pf.Machine != machine {
+		return 0, fmt.Errorf("binary is built for machine %#x, expected %#x", pf.Machine, machine)
+	}
+
+	for _, section := range pf.Sections {
+		expectedSize = maxInt64(expectedSize, int64(section.Offset)+int64(section.Size))
+	}
+	return expectedSize, nil
+}
+
+var machOCPUs = map[string]macho.Cpu{
+	"amd64": macho.CpuAmd64,
+	"arm64": macho.CpuArm64,
+}
+
+func validateMachO(f *os.File, goarch string) (expectedSize int64, err error) {
+	cpu, ok := machOCPUs[goarch]
+	if !ok {
+		return 0, fmt.Errorf("unsupported architecture %s", goarch)
+	}
+
+	mf, err := macho.NewFile(f)
+	if err != nil {
+		return 0, fmt.Errorf("binary is not a valid Mach-O executable: %w", err)
+	}
+	if mf.Cpu != cpu {
+		return 0, fmt.Errorf("binary is built for %s, expected %s", mf.Cpu, cpu)
+	}
+
+	for _, load := range mf.Loads {
+		if segment, ok := load.(*macho.Segment); ok {
+			expectedSize = maxInt64(expectedSize, int64(segment.Offset+segment.Filesz))
+		}
+	}
+	return expectedSize, nil
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,90 @@
+package helper
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func copyTestBinary(t *testing.T, size int64, perm os.FileMode) string {
+	t.Helper()
+
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := os.Open(executable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = src.Close() }()
+
+	path := filepath.Join(t.TempDir(), "binary")
+	dst, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, perm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = dst.Close() }()
+
+	if size > 0 {
+		_, err = io.CopyN(dst, src, size)
+	} else {
+		_, err = io.Copy(dst, src)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidateBinary(t *testing.T) {
+	t.Parallel()
+
+	otherArch := "arm64"
+	if runtime.GOARCH == otherArch {
+		otherArch = "amd64"
+	}
+	otherOS := "windows"
+	if runtime.GOOS == otherOS {
+		otherOS = "linux"
+	}
+
+	// The test binary itself is valid.
+	valid := copyTestBinary(t, 0, 0o0700)
+	if err := ValidateBinary(valid, runtime.GOOS, runtime.GOARCH); err != nil {
+		t.Fatalf("test binary should be valid: %s", err)
+	}
+
+	// Mismatched platform.
+	if err := ValidateBinary(valid, runtime.GOOS, otherArch); err == nil {
+		t.Error("binary with mismatched architecture should be invalid")
+	}
+	if err := ValidateBinary(valid, otherOS, runtime.GOARCH); err == nil {
+		t.Error("binary with mismatched OS should be invalid")
+	}
+
+	// Truncated file.
+	stat, err := os.Stat(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := copyTestBinary(t, stat.Size()/2, 0o0700)
+	if err := ValidateBinary(truncated, runtime.GOOS, runtime.GOARCH); err == nil {
+		t.Error("truncated binary should be invalid")
+	}
+
+	// Missing executable permission.
+	if runtime.GOOS != "windows" {
+		notExecutable := copyTestBinary(t, 0, 0o0600)
+		if err := ValidateBinary(notExecutable, runtime.GOOS, runtime.GOARCH); err == nil {
+			t.Error("binary without executable permission should be invalid")
+		}
+	}
+
+	// Missing file.
+	if err := ValidateBinary(filepath.Join(t.TempDir(), "missing"), runtime.GOOS, runtime.GOARCH); err == nil {
+		t.Error("missing binary should be invalid")
+	}
+}
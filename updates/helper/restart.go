@@ -0,0 +1,198 @@
+package helper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RestartReasonFileName is the name of the file in the data root directory
+// that a restarting service uses to tell portmaster-start why it restarts.
+const RestartReasonFileName = "restart-reason.json"
+
+// RestartReason describes why a service requested to be restarted. It is
+// written as JSON to RestartReasonFileName before the service exits with the
+// restart exit code and is consumed by portmaster-start afterwards.
+type RestartReason struct {
+	// Reason is a human readable description of why the restart was requested.
+	Reason string `json:"reason"`
+	// Version is the version of the service that requested the restart.
+	Version string `json:"version"`
+	// Time is the time at which the restart was initiated.
+	Time time.Time `json:"time"`
+}
+
+// WriteRestartReason writes the restart reason to the data root directory.
+func WriteRestartReason(dataRoot string, reason *RestartReason) error {
+	data, err := json.Marshal(reason)
+	if err != nil {
+		return fmt.Errorf("failed to serialize restart reason: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dataRoot, RestartReasonFileName), data, 0o0644); err != nil { //nolint:gosec // Readable by the supervisor.
+		return fmt.Errorf("failed to write restart reason: %w", err)
+	}
+	return nil
+}
+
+// ConsumeRestartReason reads and then removes the restart reason from the
+// data root directory. If no restart reason was written, nil is returned
+// without error.
+func ConsumeRestartReason(dataRoot string) (*RestartReason, error) {
+	path := filepath.Join(dataRoot, RestartReasonFileName)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil //nolint:nilnil // No restart reason is not an error.
+		}
+		return nil, fmt.Errorf("failed to read restart reason: %w", err)
+	}
+
+	// Remove the file first, so that a broken file does not linger.
+	if err := os.Remove(path); err != nil {
+		return nil, fmt.Errorf("failed to remove restart reason: %w", err)
+	}
+
+	reason := &RestartReason{}
+	if err := json.Unmarshal(data, reason); err != nil {
+		return nil, fmt.Errorf("failed to parse restart reason: %w", err)
+	}
+	return reason, nil
+}
+
+// RestartRequestFileName is the name of the file in the data root directory
+// that a service writes to request a restart from a supervisor that watches
+// for it, instead of exiting with the restart exit code.
+const RestartRequestFileName = "restart-requested.json"
+
+// WriteRestartRequest writes the restart reason as a restart request to the
+// data root directory.
+func WriteRestartRequest(dataRoot string, reason *RestartReason) error {
+	data, err := json.Marshal(reason)
+	if err != nil {
+		return fmt.Errorf("failed to serialize restart request: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dataRoot, RestartRequestFileName), data, 0o0644); err != nil { //nolint:gosec // Readable by the supervisor.
+		return fmt.Errorf("failed to write restart request: %w", err)
+	}
+	return nil
+}
+
+// RemoveRestartRequest removes the restart request from the data root
+// directory. It is not an error if there is no restart request.
+func RemoveRestartRequest(dataRoot string) error {
+	err := os.Remove(filepath.Join(dataRoot, RestartRequestFileName))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove restart request: %w", err)
+	}
+	return nil
+}
+
+// LastRestartFileName is the name of the file in the data root directory that
+// records when the service was last restarted.
+const LastRestartFileName = "last-restart.json"
+
+// LastRestart records a restart of the service. In contrast to the restart
+// reason, it is kept across restarts.
+type LastRestart struct {
+	// Time is the time at which the restart was initiated.
+	Time time.Time `json:"time"`
+	// Version is the version of the service that restarted.
+	Version string `json:"version"`
+}
+
+// WriteLastRestart writes the last restart record to the data root directory.
+func WriteLastRestart(dataRoot string, lastRestart *LastRestart) error {
+	data, err := json.Marshal(lastRestart)
+	if err != nil {
+		return fmt.Errorf("failed to serialize last restart record: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dataRoot, LastRestartFileName), data, 0o0600); err != nil {
+		return fmt.Errorf("failed to write last restart record: %w", err)
+	}
+	return nil
+}
+
+// ReadLastRestart reads the last restart record from the data root directory.
+// If no restart was recorded yet, nil is returned without error.
+func ReadLastRestart(dataRoot string) (*LastRestart, error) {
+	data, err := os.ReadFile(filepath.Join(dataRoot, LastRestartFileName))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil //nolint:nilnil // No recorded restart is not an error.
+		}
+		return nil, fmt.Errorf("failed to read last restart record: %w", err)
+	}
+
+	lastRestart := &LastRestart{}
+	if err := json.Unmarshal(data, lastRestart); err != nil {
+		return nil, fmt.Errorf("failed to parse last restart record: %w", err)
+	}
+	return lastRestart, nil
+}
+
+// PendingUpdateFileName is the name of the file in the data root directory
+// that records a staged update that is applied on the next start of the
+// service instead of through a restart.
+const PendingUpdateFileName = "pending-update.json"
+
+// PendingUpdate describes a staged and verified update that is applied when
+// the service is started the next time, for any reason. It is removed by
+// portmaster-start, which validates the staged binary again before starting
+// it.
+type PendingUpdate struct {
+	// Identifier is the update identifier of the staged binary.
+	Identifier string `json:"identifier"`
+	// Version is the version of the staged binary.
+	Version string `json:"version"`
+	// Time is the time at which the update was staged.
+	Time time.Time `json:"time"`
+}
+
+// WritePendingUpdate writes the pending update to the data root directory.
+func WritePendingUpdate(dataRoot string, update *PendingUpdate) error {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return fmt.Errorf("failed to serialize pending update: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dataRoot, PendingUpdateFileName), data, 0o0644); err != nil { //nolint:gosec // Readable by the supervisor.
+		return fmt.Errorf("failed to write pending update: %w", err)
+	}
+	return nil
+}
+
+// ReadPendingUpdate reads the pending update from the data root directory. If
+// no update is pending, nil is returned without error.
+func ReadPendingUpdate(dataRoot string) (*PendingUpdate, error) {
+	data, err := os.ReadFile(filepath.Join(dataRoot, PendingUpdateFileName))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil //nolint:nilnil // No pending update is not an error.
+		}
+		return nil, fmt.Errorf("failed to read pending update: %w", err)
+	}
+
+	update := &PendingUpdate{}
+	if err := json.Unmarshal(data, update); err != nil {
+		return nil, fmt.Errorf("failed to parse pending update: %w", err)
+	}
+	return update, nil
+}
+
+// RemovePendingUpdate removes the pending update from the data root
+// directory, if there is one.
+func RemovePendingUpdate(dataRoot string) error {
+	err := os.Remove(filepath.Join(dataRoot, PendingUpdateFileName))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove pending update: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package helper
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestartReason(t *testing.T) {
+	t.Parallel()
+
+	dataRoot := t.TempDir()
+
+	// Nothing to consume yet.
+	reason, err := ConsumeRestartReason(dataRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason != nil {
+		t.Fatalf("unexpected restart reason: %+v", reason)
+	}
+
+	// Write and consume.
+	written := &RestartReason{
+		Reason:  "test",
+		Version: "1.2.3",
+		Time:    time.Now().Round(time.Second),
+	}
+	if err := WriteRestartReason(dataRoot, written); err != nil {
+		t.Fatal(err)
+	}
+	reason, err = ConsumeRestartReason(dataRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason == nil ||
+		reason.Reason != written.Reason ||
+		reason.Version != written.Version ||
+		!reason.Time.Equal(written.Time) {
+		t.Fatalf("unexpected restart reason: %+v", reason)
+	}
+
+	// Reason must be removed after consuming.
+	reason, err = ConsumeRestartReason(dataRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason != nil {
+		t.Fatalf("restart reason was not removed: %+v", reason)
+	}
+}
+
+func TestLastRestart(t *testing.T) {
+	t.Parallel()
+
+	dataRoot := t.TempDir()
+
+	// Nothing recorded yet.
+	lastRestart, err := ReadLastRestart(dataRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastRestart != nil {
+		t.Fatalf("unexpected last restart: %+v", lastRestart)
+	}
+
+	// Write and read twice, the record must be kept.
+	written := &LastRestart{
+		Time:    time.Now().Round(time.Second),
+		Version: "1.2.3",
+	}
+	if err := WriteLastRestart(dataRoot, written); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		lastRestart, err = ReadLastRestart(dataRoot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastRestart == nil ||
+			lastRestart.Version != written.Version ||
+			!lastRestart.Time.Equal(written.Time) {
+			t.Fatalf("unexpected last restart: %+v", lastRestart)
+		}
+	}
+}
+
+func TestPendingUpdate(t *testing.T) {
+	t.Parallel()
+
+	dataRoot := t.TempDir()
+
+	// Nothing pending yet.
+	update, err := ReadPendingUpdate(dataRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update != nil {
+		t.Fatalf("unexpected pending update: %+v", update)
+	}
+	if err := RemovePendingUpdate(dataRoot); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write and read.
+	written := &PendingUpdate{
+		Identifier: "hub/spn-hub",
+		Version:    "1.2.3",
+		Time:       time.Now().Round(time.Second),
+	}
+	if err := WritePendingUpdate(dataRoot, written); err != nil {
+		t.Fatal(err)
+	}
+	update, err = ReadPendingUpdate(dataRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update == nil ||
+		update.Identifier != written.Identifier ||
+		update.Version != written.Version ||
+		!update.Time.Equal(written.Time) {
+		t.Fatalf("unexpected pending update: %+v", update)
+	}
+
+	// Remove.
+	if err := RemovePendingUpdate(dataRoot); err != nil {
+		t.Fatal(err)
+	}
+	update, err = ReadPendingUpdate(dataRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update != nil {
+		t.Fatalf("pending update was not removed: %+v", update)
+	}
+}
@@ -0,0 +1,37 @@
+package helper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// SelfTestFlag is the flag that makes the binary run its self-test and exit
+// instead of starting up. The binary exits with 0 if the self-test passed.
+const SelfTestFlag = "--self-test"
+
+// ProbeBinary runs the binary at the given path in self-test mode, with the
+// given additional arguments, and waits for it to exit. It returns an error if
+// the binary cannot be started, exits with a non-zero exit code or does not
+// exit within the timeout, in which case it is killed.
+func ProbeBinary(path string, timeout time.Duration, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path, append([]string{SelfTestFlag}, args...)...) //nolint:gosec // The path is the staged binary.
+	err := cmd.Run()
+	switch {
+	case ctx.Err() != nil:
+		return fmt.Errorf("self-test did not finish within %s", timeout)
+	case err == nil:
+		return nil
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("self-test failed with exit code %d", exitErr.ExitCode())
+	}
+	return fmt.Errorf("failed to run self-test: %w", err)
+}
@@ -0,0 +1,54 @@
+package helper
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func writeMockBinary(t *testing.T, script string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "binary")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0o0700); err != nil { //nolint:gosec // Must be executable.
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestProbeBinary(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("mock binaries are shell scripts")
+	}
+
+	// Passing binary, which checks that it is run in self-test mode.
+	passing := writeMockBinary(t, `[ "$1" = "--self-test" ] && [ "$2" = "--data=/tmp" ] || exit 3`)
+	if err := ProbeBinary(passing, 10*time.Second, "--data=/tmp"); err != nil {
+		t.Errorf("passing binary should pass: %s", err)
+	}
+
+	// Failing binary.
+	failing := writeMockBinary(t, "exit 1")
+	if err := ProbeBinary(failing, 10*time.Second); err == nil {
+		t.Error("failing binary should fail")
+	}
+
+	// Hanging binary.
+	hanging := writeMockBinary(t, "exec sleep 10")
+	start := time.Now()
+	if err := ProbeBinary(hanging, 100*time.Millisecond); err == nil {
+		t.Error("hanging binary should fail")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("hanging binary should be killed after the timeout")
+	}
+
+	// Missing binary.
+	if err := ProbeBinary(filepath.Join(t.TempDir(), "missing"), 10*time.Second); err == nil {
+		t.Error("missing binary should fail")
+	}
+}
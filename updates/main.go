@@ -39,6 +39,14 @@
 	// to check if new versions of their resources are
 	// available by checking File.UpgradeAvailable().
 	ResourceUpdateEvent = "resource update"
+
+	// RestartPendingEvent is emitted when a restart is scheduled. The event
+	// data is a *RestartEvent.
+	RestartPendingEvent = "restart pending"
+
+	// RestartAbortedEvent is emitted when a pending restart is aborted. The
+	// event data is a *RestartEvent.
+	RestartAbortedEvent = "restart aborted"
 )
 
 var (
@@ -74,8 +82,11 @@ func init() {
 	module = modules.Register(ModuleName, prep, start, stop, "base")
 	module.RegisterEvent(VersionUpdateEvent, true)
 	module.RegisterEvent(ResourceUpdateEvent, true)
+	module.RegisterEvent(RestartPendingEvent, true)
+	module.RegisterEvent(RestartAbortedEvent, true)
 
 	flag.StringVar(&userAgentFromFlag, "update-agent", "", "set the user agent for requests to the update server")
+	flag.DurationVar(&restartMaxDelay, "restart-max-delay", defaultRestartMaxDelay, "maximum delay the internal task scheduling may add to a scheduled restart")
 
 	var dummy bool
 	flag.BoolVar(&dummy, "staging", false, "deprecated, configure in settings instead")
@@ -86,13 +97,27 @@ func prep() error {
 		return err
 	}
 
+	if selfTestMode {
+		modules.SetCmdLineOperation(runSelfTest)
+	}
+	if applyOnNextStartFlag {
+		SetApplyUpdatesOnNextStart(true)
+	}
+	if rolloutPercentageFlag < 0 || rolloutPercentageFlag > rolloutBuckets {
+		return fmt.Errorf("invalid update rollout percentage %d, must be between 0 and 100", rolloutPercentageFlag)
+	}
+	SetRolloutPercentage(rolloutPercentageFlag)
+
 	return registerAPIEndpoints()
 }
 
 func start() error {
 	initConfig()
 
-	restartTask = module.NewTask("automatic restart", automaticRestart).MaxDelay(10 * time.Minute)
+	if restartMaxDelay <= 0 {
+		return fmt.Errorf("invalid restart max delay %s, must be positive", restartMaxDelay)
+	}
+	restartTask = module.NewTask(restartTaskName, automaticRestart).MaxDelay(RestartTaskMaxDelay())
 
 	if err := module.RegisterEventHook(
 		"config",
@@ -125,8 +150,12 @@ func start() error {
 		return err
 	}
 
-	// Set indexes based on the release channel.
-	warning := helper.SetIndexes(registry, initialReleaseChannel, true)
+	// Set indexes based on the release channel and the channels set for
+	// resources.
+	if err := loadResourceChannels(); err != nil {
+		log.Warningf("updates: failed to load release channels of resources: %s", err)
+	}
+	warning := setIndexes(initialReleaseChannel, true)
 	if warning != nil {
 		log.Warningf("updates: %s", warning)
 	}
@@ -135,6 +164,7 @@ func start() error {
 	if err != nil {
 		log.Warningf("updates: failed to load indexes: %s", err)
 	}
+	applyUpdateChannels()
 
 	err = registry.ScanStorage("")
 	if err != nil {
@@ -143,6 +173,13 @@ func start() error {
 
 	registry.SelectVersions()
 	module.TriggerEvent(VersionUpdateEvent, nil)
+	recordAppliedVersion()
+
+	// Remove the restart request of the previous run, see
+	// RestartStrategyRequestFile.
+	if err := helper.RemoveRestartRequest(dataroot.Root().Path); err != nil {
+		log.Warningf("updates: %s", err)
+	}
 
 	if !updatesCurrentlyEnabled {
 		createWarningNotification()
@@ -174,6 +211,16 @@ func start() error {
 		return err
 	}
 
+	// notify the desktop about restarts
+	if err := initRestartNotifications(); err != nil {
+		return err
+	}
+
+	// expose the restart state to clients
+	if err := initRestartState(); err != nil {
+		return err
+	}
+
 	warnOnIncorrectParentPath()
 
 	return nil
@@ -228,9 +275,21 @@ func checkForUpdates(ctx context.Context) (err error) {
 		return nil
 	}
 
+	// Signal that an update is in progress, so that restarts wait for it.
+	updateInProgress.Set()
+	defer updateInProgress.UnSet()
+
+	previousVersion := stagedVersion()
 	defer func() {
 		// Resolve any error and and send succes notification.
 		if err == nil {
+			// Record the check and whether a new version was downloaded.
+			version := stagedVersion()
+			if version != previousVersion && version != "" {
+				recordUpdateEvent(UpdateEventDownloaded, version, "")
+			}
+			recordUpdateCheck(version)
+
 			updateFailedCnt.Store(0)
 			log.Infof("updates: successfully checked for updates")
 			module.Resolve(updateFailed)
@@ -276,6 +335,7 @@ func checkForUpdates(ctx context.Context) (err error) {
 		err = fmt.Errorf("failed to update indexes: %w", err)
 		return
 	}
+	applyUpdateChannels()
 
 	err = registry.DownloadUpdates(ctx)
 	if err != nil {
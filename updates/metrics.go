@@ -0,0 +1,21 @@
+package updates
+
+import (
+	"github.com/safing/portmaster/core/journal"
+	"github.com/safing/portmaster/core/telemetry"
+)
+
+// metricEvents is the name of the counter of update and restart events,
+// labeled by event.
+const metricEvents = "updates/events/total"
+
+func init() {
+	telemetry.DescribeMetric(metricEvents, "Update Events")
+}
+
+// sendEvent sends the event to the journal and counts it by the name given in
+// its EVENT field.
+func sendEvent(priority journal.Priority, message string, fields journal.Fields) {
+	journal.Send(priority, message, fields)
+	telemetry.IncCounter(metricEvents, map[string]string{"event": fields["EVENT"]}, 1)
+}
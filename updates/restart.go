@@ -2,38 +2,89 @@
 
 import (
 	"context"
+	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/tevino/abool"
 
+	"github.com/safing/portbase/dataroot"
+	"github.com/safing/portbase/info"
 	"github.com/safing/portbase/log"
 	"github.com/safing/portbase/modules"
+	"github.com/safing/portmaster/core/journal"
+	"github.com/safing/portmaster/updates/helper"
 )
 
 const (
 	// RestartExitCode will instruct portmaster-start to restart the process immediately, potentially with a new version.
 	RestartExitCode = 23
+
+	restartTaskName = "automatic restart"
+
+	defaultRestartReason = "automatic restart"
+
+	// defaultRestartMaxDelay is the default maximum delay the internal task
+	// scheduling may add to a scheduled restart.
+	defaultRestartMaxDelay = 10 * time.Minute
 )
 
 var (
 	restartTask      *modules.Task
+	restartReason    string
 	restartPending   = abool.New()
 	restartTriggered = abool.New()
+	restartForced    = abool.New()
 
 	restartTime     time.Time
 	restartTimeLock sync.Mutex
+
+	// restartMaxDelay is the upper bound for the max delay of the restart
+	// task, as configured by flag.
+	restartMaxDelay = defaultRestartMaxDelay
+	// restartTaskMaxDelay is the max delay of the restart task. If zero,
+	// restartMaxDelay is used.
+	restartTaskMaxDelay time.Duration
+
+	// minRestartInterval is the minimum time between two automatic restarts.
+	// If zero, restarts are not limited.
+	minRestartInterval time.Duration
 )
 
+// TaskInfo describes the state of a scheduled restart task.
+type TaskInfo struct {
+	// Name is the name of the task.
+	Name string
+	// ScheduledAt is the time the task is scheduled to execute at.
+	// The internal task scheduling may delay the actual execution.
+	ScheduledAt time.Time
+	// Pending is set if the task is scheduled and will run.
+	Pending bool
+	// Triggered is set if the task has already initiated a restart.
+	Triggered bool
+}
+
+// RestartEvent is the data of the RestartPendingEvent and the
+// RestartAbortedEvent.
+type RestartEvent struct {
+	// RestartAt is the time the restart was scheduled for.
+	RestartAt time.Time
+	// Reason is the reason of the restart.
+	Reason string
+}
+
 // IsRestarting returns whether a restart has been triggered.
 func IsRestarting() bool {
 	return restartTriggered.IsSet()
 }
 
-// RestartIsPending returns whether a restart is pending.
+// RestartIsPending returns whether a restart is pending. If a staged update
+// will only apply on the next restart, see SetApplyUpdatesOnNextStart, it
+// returns true with a zero restart time.
 func RestartIsPending() (pending bool, restartAt time.Time) {
 	if restartPending.IsNotSet() {
-		return false, time.Time{}
+		return updatePendingOnNextStart.IsSet(), time.Time{}
 	}
 
 	restartTimeLock.Lock()
@@ -42,12 +93,153 @@ func RestartIsPending() (pending bool, restartAt time.Time) {
 	return true, restartTime
 }
 
+// RestartTaskMaxDelay returns the maximum delay the internal task scheduling
+// may add to a scheduled restart. The restart task does not repeat, so this is
+// its only scheduling parameter.
+func RestartTaskMaxDelay() time.Duration {
+	restartTimeLock.Lock()
+	defer restartTimeLock.Unlock()
+
+	if restartTaskMaxDelay == 0 {
+		return restartMaxDelay
+	}
+	return restartTaskMaxDelay
+}
+
+// SetRestartTaskMaxDelay sets the maximum delay the internal task scheduling
+// may add to a scheduled restart. It must be positive and may not exceed the
+// maximum configured via the restart-max-delay flag. The new delay applies to
+// restarts that are triggered afterwards. Restarts executed via RestartNow or
+// TriggerRestartIfPending are started as soon as possible and are not
+// affected by the delay.
+func SetRestartTaskMaxDelay(maxDelay time.Duration) error {
+	restartTimeLock.Lock()
+	defer restartTimeLock.Unlock()
+
+	switch {
+	case maxDelay <= 0:
+		return fmt.Errorf("invalid restart task max delay %s, must be positive", maxDelay)
+	case maxDelay > restartMaxDelay:
+		return fmt.Errorf("restart task max delay %s exceeds configured restart max delay of %s", maxDelay, restartMaxDelay)
+	}
+
+	restartTaskMaxDelay = maxDelay
+	if restartTask != nil {
+		restartTask.MaxDelay(maxDelay)
+	}
+	return nil
+}
+
+// SetMinRestartInterval sets the minimum time between two restarts. If an
+// automatic restart is due within the interval after the last restart, as
+// recorded in the data root directory, it is deferred until the interval has
+// elapsed. Restarts executed via RestartNow are never deferred. A zero or
+// negative interval disables the limit.
+func SetMinRestartInterval(interval time.Duration) {
+	restartTimeLock.Lock()
+	defer restartTimeLock.Unlock()
+
+	if interval < 0 {
+		interval = 0
+	}
+	minRestartInterval = interval
+}
+
+// SetRestartReason sets the reason that is passed on to portmaster-start when
+// the next restart is executed.
+func SetRestartReason(reason string) {
+	restartTimeLock.Lock()
+	restartReason = reason
+	restartTimeLock.Unlock()
+
+	pushRestartState()
+}
+
 // DelayedRestart triggers a restart of the application by shutting down the
-// module system gracefully and returning with RestartExitCode. The restart
-// may be further delayed by up to 10 minutes by the internal task scheduling
-// system. This only works if the process is managed by portmaster-start.
+// module system gracefully and exiting as the restart strategy requires, see
+// SetRestartStrategy. The restart may be further delayed by the internal task
+// scheduling system, by up to RestartTaskMaxDelay (10 minutes by default).
+// This only works if the process is managed by the supervisor of the restart
+// strategy.
+// The restart is not armed if the staged binary is not runnable, see
+// ValidateStagedBinary, or fails its self-test, see SetRestartSelfTest, so
+// that the current version keeps running. The self-test runs in the
+// background and the restart is armed once it passed, unless the restart was
+// aborted in the meantime. It is also not armed if the host is not part of the
+// rollout cohort, see SetRolloutPercentage. If updates are applied on the next
+// start, see SetApplyUpdatesOnNextStart, the restart is never armed.
 func DelayedRestart(delay time.Duration) {
 	// Check if restart is already pending.
+	if restartPending.IsSet() {
+		return
+	}
+
+	// Check if the binary to restart into is runnable.
+	if err := ValidateStagedBinary(); err != nil {
+		log.Criticalf("updates: not restarting, as the new version would fail to start: %s", err)
+		sendEvent(journal.PriorityError, "restart blocked by invalid staged binary", journal.Fields{
+			"EVENT": "restart_blocked",
+			"ERROR": err.Error(),
+		})
+		recordUpdateEvent(UpdateEventAborted, stagedVersion(), "invalid staged binary: "+err.Error())
+		return
+	}
+
+	// Check if the binary to restart into actually starts up. As this takes
+	// up to the self-test timeout, the restart is armed in the background.
+	if restartSelfTestEnabled() {
+		if !restartSelfTestRunning.SetToIf(false, true) {
+			return
+		}
+		module.StartWorker("probe staged binary", func(_ context.Context) error {
+			err := probeStagedBinary()
+			// Check if the restart was aborted while probing.
+			if !restartSelfTestRunning.SetToIf(true, false) {
+				return nil
+			}
+			if err != nil {
+				log.Criticalf("updates: not restarting, as the new version failed its self-test: %s", err)
+				sendEvent(journal.PriorityError, "restart blocked by failed self-test", journal.Fields{
+					"EVENT": "restart_blocked",
+					"ERROR": err.Error(),
+				})
+				recordUpdateEvent(UpdateEventAborted, stagedVersion(), "failed self-test: "+err.Error())
+				return nil
+			}
+			armRestart(delay)
+			return nil
+		})
+		return
+	}
+
+	armRestart(delay)
+}
+
+// armRestart arms the restart of DelayedRestart after the staged binary was
+// verified.
+func armRestart(delay time.Duration) {
+	recordUpdateEvent(UpdateEventVerified, stagedVersion(), "")
+
+	// Keep the update staged, if this host is not part of the rollout.
+	inCohort, err := inRolloutCohort()
+	if err != nil {
+		log.Warningf("updates: failed to check if host is part of the rollout: %s", err)
+	}
+	if !inCohort {
+		log.Warningf("updates: not restarting, as this host is not part of the rollout to %d%% of hosts", RolloutPercentage())
+		sendEvent(journal.PriorityNotice, "restart skipped by staged rollout", journal.Fields{
+			"EVENT":              "restart_not_in_rollout",
+			"ROLLOUT_PERCENTAGE": strconv.Itoa(RolloutPercentage()),
+		})
+		return
+	}
+
+	// Leave the restart to the user, if configured.
+	if applyOnNextStart.IsSet() {
+		markUpdateForNextStart()
+		return
+	}
+
 	if !restartPending.SetToIf(false, true) {
 		return
 	}
@@ -56,25 +248,122 @@ func DelayedRestart(delay time.Duration) {
 	log.Warningf("updates: restart triggered, will execute in %s", delay)
 	restartAt := time.Now().Add(delay)
 	restartTask.Schedule(restartAt)
+	sendEvent(journal.PriorityNotice, "restart scheduled", journal.Fields{
+		"EVENT":      "restart_scheduled",
+		"RESTART_AT": restartAt.Format(time.RFC3339),
+	})
+	recordUpdateEvent(UpdateEventArmed, stagedVersion(), "restart at "+restartAt.Format(time.RFC3339))
 
 	// Set restartTime.
 	restartTimeLock.Lock()
-	defer restartTimeLock.Unlock()
 	restartTime = restartAt
+	reason := restartReason
+	restartTimeLock.Unlock()
+
+	module.TriggerEvent(RestartPendingEvent, &RestartEvent{
+		RestartAt: restartAt,
+		Reason:    reason,
+	})
+	pushRestartState()
 }
 
-// AbortRestart aborts a (delayed) restart.
+// AbortRestart aborts a (delayed) restart. An update that was to be applied
+// on the next start is aborted too.
 func AbortRestart() {
+	unmarkUpdateForNextStart()
+	restartSelfTestRunning.UnSet()
+
 	if restartPending.SetToIf(true, false) {
 		log.Warningf("updates: restart aborted")
+		sendEvent(journal.PriorityNotice, "restart aborted", journal.Fields{
+			"EVENT": "restart_aborted",
+		})
+		recordUpdateEvent(UpdateEventAborted, stagedVersion(), "")
 
 		// Cancel schedule.
 		restartTask.Schedule(time.Time{})
+
+		restartTimeLock.Lock()
+		event := &RestartEvent{
+			RestartAt: restartTime,
+			Reason:    restartReason,
+		}
+		restartTimeLock.Unlock()
+
+		restartForced.UnSet()
+		SetRestartReason("")
+
+		module.TriggerEvent(RestartAbortedEvent, event)
+		pushRestartState()
+	}
+}
+
+// PendingRestartTasks returns information about all restart related tasks
+// that are currently pending or have already been triggered.
+func PendingRestartTasks() []TaskInfo {
+	restartTimeLock.Lock()
+	defer restartTimeLock.Unlock()
+
+	if restartPending.IsNotSet() && restartTriggered.IsNotSet() {
+		return nil
+	}
+
+	return []TaskInfo{{
+		Name:        restartTaskName,
+		ScheduledAt: restartTime,
+		Pending:     restartPending.IsSet(),
+		Triggered:   restartTriggered.IsSet(),
+	}}
+}
+
+// CancelAllRestartTasks cancels all pending restart tasks and resets the
+// complete restart state atomically. It returns the tasks as they were before
+// cancelling. The following state is reset:
+//   - The schedule of the restart task is removed.
+//   - The restart pending flag is cleared.
+//   - The restart triggered flag is cleared.
+//   - The scheduled restart time is reset.
+//
+// Note that a module shutdown that was already initiated by a triggered
+// restart cannot be stopped anymore.
+func CancelAllRestartTasks() []TaskInfo {
+	// Push the state once the lock is released.
+	defer pushRestartState()
+
+	restartTimeLock.Lock()
+	defer restartTimeLock.Unlock()
+
+	if restartPending.IsNotSet() && restartTriggered.IsNotSet() {
+		return nil
+	}
+
+	cancelled := []TaskInfo{{
+		Name:        restartTaskName,
+		ScheduledAt: restartTime,
+		Pending:     restartPending.IsSet(),
+		Triggered:   restartTriggered.IsSet(),
+	}}
+
+	if restartTask != nil {
+		restartTask.Schedule(time.Time{})
 	}
+	restartPending.UnSet()
+	restartTriggered.UnSet()
+	restartForced.UnSet()
+	restartTime = time.Time{}
+	restartReason = ""
+
+	log.Warningf("updates: cancelled all restart tasks")
+	sendEvent(journal.PriorityNotice, "restart cancelled", journal.Fields{
+		"EVENT": "restart_cancelled",
+	})
+	return cancelled
 }
 
 // TriggerRestartIfPending triggers an automatic restart, if one is pending.
 // This can be used to prepone a scheduled restart if the conditions are preferable.
+// The restart task is started as soon as possible, which overrides both the
+// schedule and the max delay of the task.
 func TriggerRestartIfPending() {
 	if restartPending.IsSet() {
 		restartTask.StartASAP()
@@ -82,27 +371,143 @@ func TriggerRestartIfPending() {
 }
 
 // RestartNow immediately executes a restart.
-// This only works if the process is managed by portmaster-start.
+// The restart task is started as soon as possible, which overrides both the
+// schedule and the max delay of the task. The minimum restart interval does
+// not apply.
+// This only works if the process is managed by the supervisor of the restart
+// strategy.
 func RestartNow() {
+	restartForced.Set()
 	restartPending.Set()
 	restartTask.StartASAP()
 }
 
-func automaticRestart(_ context.Context, _ *modules.Task) error {
+func automaticRestart(ctx context.Context, _ *modules.Task) error {
 	// Check if the restart is still scheduled.
 	if restartPending.IsNotSet() {
 		return nil
 	}
 
+	// Defer the restart if the last restart was too recent.
+	if restartForced.IsNotSet() && deferRestart() {
+		return nil
+	}
+
+	// Wait for the network, eg. after a resume from sleep, unless forced.
+	if restartForced.IsNotSet() {
+		awaitNetworkForRestart(ctx)
+		// Check if the restart was aborted in the meantime.
+		if restartPending.IsNotSet() {
+			return nil
+		}
+	}
+
 	// Trigger restart.
 	if restartTriggered.SetToIf(false, true) {
 		log.Warning("updates: initiating (automatic) restart")
+		sendEvent(journal.PriorityNotice, "restart initiated", journal.Fields{
+			"EVENT": "restart_initiated",
+		})
+		recordUpdateEvent(UpdateEventTriggered, stagedVersion(), "")
+
+		strategy := getRestartStrategy()
+		if !strategy.Supervised() {
+			log.Warningf("updates: process does not seem to be managed by a supervisor for the %s restart strategy and might not be started again", strategy.Name())
+		}
+
+		// Prepare for restart. The built-in hooks drain running update
+		// operations, let the strategy prepare the supervisor and set the
+		// restart exit code. Failing hooks do not stop the restart.
+		runPreRestartHooks(ctx, false)
+		writeLastRestart()
 
-		// Set restart exit code.
-		modules.SetExitStatusCode(RestartExitCode)
 		// Do not use a worker, as this would block itself here.
 		go modules.Shutdown() //nolint:errcheck
 	}
 
 	return nil
 }
+
+// currentRestartReason returns the reason of the restart for the supervisor.
+func currentRestartReason() *helper.RestartReason {
+	restartTimeLock.Lock()
+	reason := restartReason
+	restartTimeLock.Unlock()
+	if reason == "" {
+		reason = defaultRestartReason
+	}
+
+	return &helper.RestartReason{
+		Reason:  reason,
+		Version: info.Version(),
+		Time:    time.Now(),
+	}
+}
+
+// deferRestart reschedules the restart task if the minimum restart interval
+// has not yet elapsed since the last restart. It returns whether the restart
+// was deferred.
+func deferRestart() bool {
+	restartTimeLock.Lock()
+	interval := minRestartInterval
+	restartTimeLock.Unlock()
+	if interval == 0 {
+		return false
+	}
+
+	lastRestart, err := helper.ReadLastRestart(dataroot.Root().Path)
+	if err != nil {
+		log.Warningf("updates: failed to check minimum restart interval: %s", err)
+		return false
+	}
+	deferUntil := restartDeferredUntil(time.Now(), lastRestart, interval)
+	if deferUntil.IsZero() {
+		return false
+	}
+
+	log.Warningf(
+		"updates: deferring restart to %s, as the last restart was at %s and the minimum restart interval is %s",
+		deferUntil.Format(time.RFC3339),
+		lastRestart.Time.Format(time.RFC3339),
+		interval,
+	)
+	sendEvent(journal.PriorityNotice, "restart deferred", journal.Fields{
+		"EVENT":      "restart_deferred",
+		"RESTART_AT": deferUntil.Format(time.RFC3339),
+	})
+
+	restartTimeLock.Lock()
+	restartTime = deferUntil
+	restartTask.Schedule(deferUntil)
+	restartTimeLock.Unlock()
+
+	pushRestartState()
+	return true
+}
+
+// restartDeferredUntil returns until when a restart at now must be deferred
+// to keep the minimum restart interval after the last restart. If the restart
+// does not need to be deferred, the zero time is returned.
+func restartDeferredUntil(now time.Time, lastRestart *helper.LastRestart, interval time.Duration) time.Time {
+	if lastRestart == nil || interval <= 0 {
+		return time.Time{}
+	}
+
+	earliest := lastRestart.Time.Add(interval)
+	if !now.Before(earliest) {
+		return time.Time{}
+	}
+	return earliest
+}
+
+// writeLastRestart records the restart in the data root directory, so that
+// the minimum restart interval can be enforced after the restart.
+func writeLastRestart() {
+	err := helper.WriteLastRestart(dataroot.Root().Path, &helper.LastRestart{
+		Time:    time.Now(),
+		Version: info.Version(),
+	})
+	if err != nil {
+		log.Warningf("updates: %s", err)
+	}
+}
@@ -0,0 +1,89 @@
+package updates
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/safing/portbase/log"
+)
+
+// restartNetworkCheckInterval defines how often the network is checked while
+// a restart waits for it.
+const restartNetworkCheckInterval = 1 * time.Second
+
+var (
+	// restartAwaitNetwork is the maximum time an automatic restart waits for
+	// a network connection. If zero, restarts do not wait.
+	restartAwaitNetwork time.Duration
+	// restartNetworkCheck reports whether a network connection is available.
+	restartNetworkCheck func() bool
+
+	restartNetworkLock sync.Mutex
+)
+
+// SetRestartAwaitNetwork sets the maximum time an automatic restart waits for
+// a usable network connection, eg. after a resume from sleep or the boot. If
+// no network connection is available after the max wait, the restart proceeds
+// anyway, as the staged update is already available locally. Restarts
+// executed via RestartNow never wait. A zero or negative max wait disables the
+// wait.
+func SetRestartAwaitNetwork(maxWait time.Duration) {
+	restartNetworkLock.Lock()
+	defer restartNetworkLock.Unlock()
+
+	if maxWait < 0 {
+		maxWait = 0
+	}
+	restartAwaitNetwork = maxWait
+}
+
+// SetRestartNetworkCheck sets the function that reports whether a usable
+// network connection is available. It is used by automatic restarts to wait
+// for the network, see SetRestartAwaitNetwork.
+func SetRestartNetworkCheck(check func() bool) {
+	restartNetworkLock.Lock()
+	defer restartNetworkLock.Unlock()
+
+	restartNetworkCheck = check
+}
+
+// awaitNetworkForRestart waits until a network connection is available, at
+// most for the configured max wait.
+func awaitNetworkForRestart(ctx context.Context) {
+	restartNetworkLock.Lock()
+	maxWait := restartAwaitNetwork
+	check := restartNetworkCheck
+	restartNetworkLock.Unlock()
+	if maxWait == 0 || check == nil || check() {
+		return
+	}
+
+	log.Warningf("updates: waiting up to %s for a network connection before restarting", maxWait)
+	if !waitForNetwork(ctx, check, maxWait, restartNetworkCheckInterval) {
+		log.Warningf("updates: no network connection after %s, restarting anyway", maxWait)
+	}
+}
+
+// waitForNetwork checks the network at the given interval until it is
+// available, the max wait is reached or the context is canceled. It returns whether
+// the network is available.
+func waitForNetwork(ctx context.Context, check func() bool, maxWait, interval time.Duration) (available bool) {
+	timeout := time.NewTimer(maxWait)
+	defer timeout.Stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if check() {
+				return true
+			}
+		case <-timeout.C:
+			return check()
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package updates
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWaitForNetwork(t *testing.T) {
+	t.Parallel()
+
+	// Network becomes available.
+	var checks int32
+	check := func() bool {
+		return atomic.AddInt32(&checks, 1) >= 3
+	}
+	if !waitForNetwork(context.Background(), check, time.Second, time.Millisecond) {
+		t.Error("network should be available")
+	}
+
+	// Network does not become available.
+	offline := func() bool { return false }
+	start := time.Now()
+	if waitForNetwork(context.Background(), offline, 20*time.Millisecond, time.Millisecond) {
+		t.Error("network should not be available")
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("should have waited for the max, waited %s", waited)
+	}
+
+	// Context is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if waitForNetwork(ctx, offline, time.Minute, time.Millisecond) {
+		t.Error("network should not be available")
+	}
+}
@@ -0,0 +1,86 @@
+package updates
+
+import (
+	"flag"
+	"time"
+
+	"github.com/tevino/abool"
+
+	"github.com/safing/portbase/dataroot"
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/core/journal"
+	"github.com/safing/portmaster/updates/helper"
+)
+
+var (
+	applyOnNextStart = abool.New()
+	// applyOnNextStartFlag is set if updates are applied on the next start,
+	// as configured by flag.
+	applyOnNextStartFlag bool
+
+	updatePendingOnNextStart = abool.New()
+)
+
+func init() {
+	flag.BoolVar(&applyOnNextStartFlag, "apply-updates-on-next-start", false, "never restart for updates, but apply them when the process is started the next time")
+}
+
+// SetApplyUpdatesOnNextStart enables or disables applying updates on the next
+// start of the process only: Instead of arming the automatic restart, a
+// staged and verified update is recorded in the data root directory and
+// portmaster-start starts the new version the next time the process is
+// started for any reason, such as a reboot or a manual restart. Restarts that
+// are already pending are not affected.
+func SetApplyUpdatesOnNextStart(enabled bool) {
+	applyOnNextStart.SetTo(enabled)
+}
+
+// UpdatePendingOnNextStart returns whether a staged update will be applied on
+// the next start of the process.
+func UpdatePendingOnNextStart() bool {
+	return updatePendingOnNextStart.IsSet()
+}
+
+// markUpdateForNextStart records the staged binary to be applied on the next
+// start instead of arming a restart.
+func markUpdateForNextStart() {
+	if !updatePendingOnNextStart.SetToIf(false, true) {
+		return
+	}
+
+	pending := &helper.PendingUpdate{
+		Time: time.Now(),
+	}
+	if identifier, ok := stagedBinaryIdentifier(); ok {
+		pending.Identifier = identifier
+		if file, err := GetPlatformFile(identifier); err == nil {
+			pending.Version = file.Version()
+		}
+	}
+	if err := helper.WritePendingUpdate(dataroot.Root().Path, pending); err != nil {
+		log.Warningf("updates: %s", err)
+	}
+
+	log.Warningf("updates: not restarting, update to version %s will apply on next restart", pending.Version)
+	sendEvent(journal.PriorityNotice, "update pending on next start", journal.Fields{
+		"EVENT":   "update_pending_on_next_start",
+		"VERSION": pending.Version,
+	})
+	recordUpdateEvent(UpdateEventArmed, pending.Version, "apply on next start")
+	pushRestartState()
+}
+
+// unmarkUpdateForNextStart removes the record of a staged update that was to
+// be applied on the next start.
+func unmarkUpdateForNextStart() {
+	if !updatePendingOnNextStart.SetToIf(true, false) {
+		return
+	}
+
+	if err := helper.RemovePendingUpdate(dataroot.Root().Path); err != nil {
+		log.Warningf("updates: %s", err)
+	}
+	log.Warningf("updates: update on next restart aborted")
+	recordUpdateEvent(UpdateEventAborted, stagedVersion(), "apply on next start")
+	pushRestartState()
+}
@@ -0,0 +1,53 @@
+package updates
+
+import (
+	"testing"
+	"time"
+
+	"github.com/safing/portbase/dataroot"
+	"github.com/safing/portmaster/updates/helper"
+)
+
+func TestApplyUpdatesOnNextStart(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	if dataroot.Root() == nil {
+		if err := dataroot.Initialize(t.TempDir(), 0o0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	SetApplyUpdatesOnNextStart(true)
+	defer SetApplyUpdatesOnNextStart(false)
+
+	// The restart must not be armed.
+	DelayedRestart(time.Hour)
+	defer AbortRestart()
+	if restartPending.IsSet() {
+		t.Fatal("restart must not be armed")
+	}
+	pending, restartAt := RestartIsPending()
+	if !pending || !restartAt.IsZero() {
+		t.Errorf("restart should be pending on next start, got pending=%v restartAt=%s", pending, restartAt)
+	}
+	if !UpdatePendingOnNextStart() {
+		t.Error("update should be pending on next start")
+	}
+	update, err := helper.ReadPendingUpdate(dataroot.Root().Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update == nil {
+		t.Fatal("pending update should be recorded")
+	}
+
+	// Aborting removes the pending update.
+	AbortRestart()
+	if pending, _ := RestartIsPending(); pending {
+		t.Error("restart should not be pending after abort")
+	}
+	update, err = helper.ReadPendingUpdate(dataroot.Root().Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update != nil {
+		t.Errorf("pending update should be removed after abort: %+v", update)
+	}
+}
@@ -0,0 +1,131 @@
+package updates
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/safing/portbase/log"
+)
+
+// desktopNotifications enables notifying about pending and aborted restarts
+// via the desktop notification system.
+var desktopNotifications bool
+
+func init() {
+	flag.BoolVar(&desktopNotifications, "restart-desktop-notifications", false, "notify about pending and aborted restarts via desktop notifications (D-Bus)")
+}
+
+// restartNotifier shows a desktop notification. If replacesID is not zero,
+// the notification with this ID is replaced. It returns the ID of the shown
+// notification.
+type restartNotifier interface {
+	Notify(summary, body string, replacesID uint32) (id uint32, err error)
+}
+
+// initRestartNotifications hooks the desktop notifications into the restart
+// events, if enabled. Without a desktop notification system, nothing happens.
+func initRestartNotifications() error {
+	if !desktopNotifications {
+		return nil
+	}
+
+	notifier := newDesktopNotifier()
+	if notifier == nil {
+		log.Infof("updates: desktop notifications are not available, not notifying about restarts")
+		return nil
+	}
+
+	var (
+		lastID     uint32
+		lastIDLock sync.Mutex
+	)
+	notify := func(summary, body string) {
+		lastIDLock.Lock()
+		defer lastIDLock.Unlock()
+
+		id, err := notifier.Notify(summary, body, lastID)
+		if err != nil {
+			log.Debugf("updates: failed to show restart desktop notification: %s", err)
+			return
+		}
+		lastID = id
+	}
+
+	if err := module.RegisterEventHook(
+		ModuleName,
+		RestartPendingEvent,
+		"notify desktop about pending restart",
+		func(_ context.Context, data interface{}) error {
+			if event, ok := data.(*RestartEvent); ok {
+				notify(pendingRestartMessage(event, time.Now()))
+			}
+			return nil
+		},
+	); err != nil {
+		return err
+	}
+
+	return module.RegisterEventHook(
+		ModuleName,
+		RestartAbortedEvent,
+		"notify desktop about aborted restart",
+		func(_ context.Context, data interface{}) error {
+			if event, ok := data.(*RestartEvent); ok {
+				notify(abortedRestartMessage(event))
+			}
+			return nil
+		},
+	)
+}
+
+// pendingRestartMessage returns the summary and body of the notification
+// about a pending restart.
+func pendingRestartMessage(event *RestartEvent, now time.Time) (summary, body string) {
+	summary = fmt.Sprintf("Portmaster will restart in %s", humanDelay(event.RestartAt.Sub(now)))
+	if event.Reason == "" {
+		summary += " for an update."
+	} else {
+		summary += "."
+		body = fmt.Sprintf("Reason: %s\n", event.Reason)
+	}
+	body += fmt.Sprintf("Scheduled for %s.", event.RestartAt.Format("15:04"))
+	return summary, body
+}
+
+// abortedRestartMessage returns the summary and body of the notification
+// about an aborted restart.
+func abortedRestartMessage(event *RestartEvent) (summary, body string) {
+	summary = "Portmaster restart aborted."
+	if event.Reason != "" {
+		body = fmt.Sprintf("Reason: %s", event.Reason)
+	}
+	return summary, body
+}
+
+// humanDelay formats the delay in minutes and hours.
+func humanDelay(delay time.Duration) string {
+	minutes := int(delay.Round(time.Minute) / time.Minute)
+	hours := minutes / 60
+	minutes %= 60
+
+	switch {
+	case hours == 0 && minutes == 0:
+		return "less than a minute"
+	case hours == 0:
+		return plural(minutes, "minute")
+	case minutes == 0:
+		return plural(hours, "hour")
+	default:
+		return plural(hours, "hour") + " and " + plural(minutes, "minute")
+	}
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package updates
+
+// newDesktopNotifier returns nil, as desktop notifications are only
+// supported on Linux.
+func newDesktopNotifier() restartNotifier {
+	return nil
+}
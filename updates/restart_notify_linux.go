@@ -0,0 +1,81 @@
+package updates
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	notificationsDest  = "org.freedesktop.Notifications"
+	notificationsPath  = "/org/freedesktop/Notifications"
+	notificationsCall  = "org.freedesktop.Notifications.Notify"
+	notificationsAppID = "Portmaster"
+)
+
+// dbusNotifier shows notifications via org.freedesktop.Notifications on the
+// session bus.
+type dbusNotifier struct {
+	address string
+
+	conn     *dbus.Conn
+	connLock sync.Mutex
+}
+
+// newDesktopNotifier returns a notifier for the session bus, or nil if no
+// session bus is available, eg. when running as a system service.
+func newDesktopNotifier() restartNotifier {
+	address := sessionBusAddress()
+	if address == "" {
+		return nil
+	}
+	return &dbusNotifier{address: address}
+}
+
+// sessionBusAddress returns the address of the session bus. It does not
+// launch a session bus if there is none.
+func sessionBusAddress() string {
+	if address := os.Getenv("DBUS_SESSION_BUS_ADDRESS"); address != "" {
+		return address
+	}
+
+	runtimeBus := fmt.Sprintf("/run/user/%d/bus", os.Getuid())
+	if _, err := os.Stat(runtimeBus); err == nil {
+		return "unix:path=" + runtimeBus
+	}
+	return ""
+}
+
+// Notify shows a desktop notification.
+func (n *dbusNotifier) Notify(summary, body string, replacesID uint32) (id uint32, err error) {
+	n.connLock.Lock()
+	defer n.connLock.Unlock()
+
+	if n.conn == nil {
+		n.conn, err = dbus.Connect(n.address)
+		if err != nil {
+			return 0, fmt.Errorf("failed to connect to session bus: %w", err)
+		}
+	}
+
+	err = n.conn.Object(notificationsDest, notificationsPath).Call(
+		notificationsCall, 0,
+		notificationsAppID,
+		replacesID,
+		"", // Icon
+		summary,
+		body,
+		[]string{}, // Actions
+		map[string]dbus.Variant{},
+		int32(-1), // Default expiry
+	).Store(&id)
+	if err != nil {
+		// Reconnect on the next notification.
+		_ = n.conn.Close()
+		n.conn = nil
+		return 0, err
+	}
+	return id, nil
+}
@@ -0,0 +1,54 @@
+package updates
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestartMessages(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.Local)
+
+	summary, body := pendingRestartMessage(&RestartEvent{RestartAt: now.Add(5 * time.Minute)}, now)
+	if summary != "Portmaster will restart in 5 minutes for an update." {
+		t.Errorf("unexpected summary %q", summary)
+	}
+	if body != "Scheduled for 12:05." {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	summary, body = pendingRestartMessage(&RestartEvent{
+		RestartAt: now.Add(2*time.Hour + time.Minute),
+		Reason:    "update of spn hub to version 1.0.0",
+	}, now)
+	if summary != "Portmaster will restart in 2 hours and 1 minute." {
+		t.Errorf("unexpected summary %q", summary)
+	}
+	if body != "Reason: update of spn hub to version 1.0.0\nScheduled for 14:01." {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	summary, body = abortedRestartMessage(&RestartEvent{Reason: "update of spn hub to version 1.0.0"})
+	if summary != "Portmaster restart aborted." {
+		t.Errorf("unexpected summary %q", summary)
+	}
+	if body != "Reason: update of spn hub to version 1.0.0" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+func TestHumanDelay(t *testing.T) {
+	t.Parallel()
+
+	for delay, expected := range map[time.Duration]string{
+		10 * time.Second: "less than a minute",
+		time.Minute:      "1 minute",
+		61 * time.Minute: "1 hour and 1 minute",
+		3 * time.Hour:    "3 hours",
+	} {
+		if actual := humanDelay(delay); actual != expected {
+			t.Errorf("humanDelay(%s) = %q, expected %q", delay, actual, expected)
+		}
+	}
+}
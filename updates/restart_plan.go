@@ -0,0 +1,264 @@
+package updates
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	processInfo "github.com/shirou/gopsutil/process"
+	"github.com/tevino/abool"
+
+	"github.com/safing/portbase/dataroot"
+	"github.com/safing/portbase/log"
+	"github.com/safing/portbase/modules"
+	"github.com/safing/portmaster/updates/helper"
+)
+
+// restartDrainTimeout defines how long a restart waits for running update
+// operations to finish.
+const restartDrainTimeout = 1 * time.Minute
+
+var (
+	preRestartHooks     = make(map[string]PreRestartHook)
+	preRestartHooksLock sync.Mutex
+
+	updateInProgress = abool.New()
+)
+
+// Names of the built-in pre-restart hooks.
+const (
+	drainRestartHookName   = "drain update operations"
+	prepareRestartHookName = "prepare restart strategy"
+)
+
+// builtinPreRestartHooks finish the preparation of a restart. They are run in
+// order after all registered pre-restart hooks.
+var builtinPreRestartHooks = []struct {
+	name string
+	hook PreRestartHook
+}{
+	{name: drainRestartHookName, hook: drainRestartHook},
+	{name: prepareRestartHookName, hook: prepareRestartHook},
+}
+
+// PreRestartHook is run before a restart is executed. If dryRun is set, the
+// hook is run as part of a test restart and must not change any state.
+type PreRestartHook func(ctx context.Context, dryRun bool) error
+
+// RestartPlan describes what a restart would do if it was executed now.
+type RestartPlan struct {
+	// Hooks holds the names of the pre-restart hooks that would run, including
+	// the built-in hooks.
+	Hooks []string
+	// HookErrors holds the errors the hooks returned, by hook name.
+	HookErrors map[string]string `json:",omitempty"`
+	// Drained is set if all running update operations finished in time.
+	Drained bool
+	// Strategy is the name of the restart strategy, see SetRestartStrategy.
+	Strategy string
+	// SupervisorPresent is set if the process is managed by the supervisor of
+	// the restart strategy, which is required to start the process again.
+	SupervisorPresent bool
+	// Blockers holds the reasons why the restart would not succeed.
+	Blockers []string `json:",omitempty"`
+	// Ready is set if the restart would succeed.
+	Ready bool
+}
+
+// RegisterPreRestartHook registers a hook that is run before a restart is
+// executed. Registered hooks run in the order of their names, before the
+// built-in hooks that drain running update operations and prepare the
+// supervisor of the restart strategy. Registering a hook with an existing name
+// replaces it.
+func RegisterPreRestartHook(name string, hook PreRestartHook) {
+	preRestartHooksLock.Lock()
+	defer preRestartHooksLock.Unlock()
+
+	preRestartHooks[name] = hook
+}
+
+// TestRestart runs a full restart cycle without actually restarting: All
+// pre-restart hooks, including draining running update operations, are run in
+// dry-run mode and the readiness gates are checked. The resulting plan is
+// returned. TestRestart never shuts down or exits the process.
+func TestRestart(ctx context.Context) (RestartPlan, error) {
+	plan := RestartPlan{}
+
+	// Run pre-restart hooks.
+	plan.Hooks, plan.HookErrors = runPreRestartHooks(ctx, true)
+	if ctx.Err() != nil {
+		return plan, ctx.Err()
+	}
+	for name, errMsg := range plan.HookErrors {
+		plan.Blockers = append(plan.Blockers, fmt.Sprintf("pre-restart hook %q failed: %s", name, errMsg))
+	}
+	_, drainFailed := plan.HookErrors[drainRestartHookName]
+	plan.Drained = !drainFailed
+
+	// Check readiness gates.
+	strategy := getRestartStrategy()
+	plan.Strategy = strategy.Name()
+	plan.SupervisorPresent = strategy.Supervised()
+	plan.Blockers = append(plan.Blockers, checkRestartReadiness(strategy)...)
+	sort.Strings(plan.Blockers)
+
+	plan.Ready = len(plan.Blockers) == 0
+	log.Infof("updates: test restart finished, ready=%v, blockers=%v", plan.Ready, plan.Blockers)
+	return plan, nil
+}
+
+// runPreRestartHooks runs all registered pre-restart hooks in the order of
+// their names, followed by the built-in hooks, and returns the names of all
+// hooks together with any errors encountered.
+func runPreRestartHooks(ctx context.Context, dryRun bool) (names []string, errs map[string]string) {
+	preRestartHooksLock.Lock()
+	defer preRestartHooksLock.Unlock()
+
+	names = make([]string, 0, len(preRestartHooks))
+	for name := range preRestartHooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hooks := make([]PreRestartHook, 0, len(names)+len(builtinPreRestartHooks))
+	for _, name := range names {
+		hooks = append(hooks, preRestartHooks[name])
+	}
+	for _, builtin := range builtinPreRestartHooks {
+		names = append(names, builtin.name)
+		hooks = append(hooks, builtin.hook)
+	}
+
+	for i, hook := range hooks {
+		if err := hook(ctx, dryRun); err != nil {
+			if errs == nil {
+				errs = make(map[string]string)
+			}
+			errs[names[i]] = err.Error()
+			log.Warningf("updates: pre-restart hook %q failed: %s", names[i], err)
+		}
+	}
+
+	return names, errs
+}
+
+// drainRestartHook waits for running update operations to finish, see
+// drainForRestart. The restart continues if they do not finish in time.
+func drainRestartHook(ctx context.Context, _ bool) error {
+	return drainForRestart(ctx)
+}
+
+// prepareRestartHook lets the restart strategy prepare its supervisor for the
+// restart and sets the exit code the supervisor expects. It does nothing in
+// dry-run mode.
+func prepareRestartHook(_ context.Context, dryRun bool) error {
+	if dryRun {
+		return nil
+	}
+
+	exitCode, err := getRestartStrategy().Prepare(dataroot.Root().Path, currentRestartReason())
+	modules.SetExitStatusCode(exitCode)
+	return err
+}
+
+// drainForRestart waits for running update operations to finish, as
+// restarting in the middle of an update could leave it incomplete.
+func drainForRestart(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, restartDrainTimeout)
+	defer cancel()
+
+	for updateInProgress.IsSet() {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("update still in progress after %s", restartDrainTimeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	return nil
+}
+
+// checkRestartReadiness returns the reasons why a restart would not succeed.
+func checkRestartReadiness(strategy RestartStrategy) (blockers []string) {
+	if !strategy.Supervised() {
+		blockers = append(blockers, fmt.Sprintf("process is not managed by a supervisor for the %s restart strategy and would not be started again", strategy.Name()))
+	}
+	if restartTriggered.IsSet() {
+		blockers = append(blockers, "a restart has already been triggered")
+	}
+	if !module.Online() {
+		blockers = append(blockers, "updates module is not online")
+	}
+	if err := ValidateStagedBinary(); err != nil {
+		blockers = append(blockers, err.Error())
+	} else if err := ProbeStagedBinary(); err != nil {
+		blockers = append(blockers, err.Error())
+	}
+
+	return blockers
+}
+
+// ValidateStagedBinary checks that the newest binary of the running service,
+// which would be started after a restart, is runnable on this platform: It
+// must use the executable format and architecture of the platform, be
+// executable and not be truncated. If the running process is not an
+// updatable service, there is no staged binary and nil is returned.
+func ValidateStagedBinary() error {
+	identifier, ok := stagedBinaryIdentifier()
+	if !ok {
+		return nil
+	}
+
+	file, err := GetPlatformFile(identifier)
+	if err != nil {
+		return fmt.Errorf("failed to get staged binary %s: %w", identifier, err)
+	}
+	if err := helper.ValidateBinary(file.Path(), runtime.GOOS, runtime.GOARCH); err != nil {
+		return fmt.Errorf("staged binary %s v%s is invalid: %w", identifier, file.Version(), err)
+	}
+	return nil
+}
+
+// stagedBinaryIdentifier returns the update identifier of the binary of the
+// running service.
+func stagedBinaryIdentifier() (identifier string, ok bool) {
+	binBaseName := strings.Split(filepath.Base(os.Args[0]), "_")[0]
+	switch binBaseName {
+	case "portmaster-core":
+		identifier = "core/portmaster-core"
+	case "spn-hub":
+		identifier = "hub/spn-hub"
+	default:
+		return "", false
+	}
+
+	if onWindows {
+		identifier += exeExt
+	}
+	return identifier, true
+}
+
+// supervisorPresent returns whether the parent process is portmaster-start.
+func supervisorPresent() bool {
+	expectedFileName := "portmaster-start"
+	if onWindows {
+		expectedFileName += exeExt
+	}
+
+	parent, err := processInfo.NewProcess(int32(os.Getppid()))
+	if err != nil {
+		return false
+	}
+	parentName, err := parent.Name()
+	if err != nil {
+		return false
+	}
+
+	return parentName == expectedFileName
+}
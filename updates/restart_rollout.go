@@ -0,0 +1,152 @@
+package updates
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/safing/portbase/dataroot"
+)
+
+const (
+	// rolloutIDFileName is the name of the file in the data root directory
+	// that holds the stable identifier of the host for staged rollouts.
+	rolloutIDFileName = "rollout-id"
+
+	// rolloutBuckets is the number of buckets hosts are distributed into.
+	rolloutBuckets = 100
+)
+
+var (
+	rolloutPercentage = rolloutBuckets
+	rolloutID         string
+	rolloutLock       sync.Mutex
+
+	// rolloutPercentageFlag is the rollout percentage configured by flag.
+	rolloutPercentageFlag int
+)
+
+func init() {
+	flag.IntVar(&rolloutPercentageFlag, "update-rollout-percentage", rolloutBuckets, "percentage of hosts that restart to apply updates, for staged rollouts; other hosts keep updates staged")
+}
+
+// SetRolloutPercentage sets the percentage of hosts that restart to apply a
+// staged update. For every version, each host is assigned to a rollout bucket
+// from 0 to 99 by hashing a stable identifier of the host together with the
+// version, see RolloutBucket, so that different hosts are first to receive
+// each version. A host is in the rollout cohort if its bucket is lower than
+// the percentage. Hosts outside of
+// the cohort keep the update staged, but the restart is not armed. The
+// percentage is limited to 0-100. The default of 100 applies updates on all
+// hosts.
+func SetRolloutPercentage(pct int) {
+	switch {
+	case pct < 0:
+		pct = 0
+	case pct > rolloutBuckets:
+		pct = rolloutBuckets
+	}
+
+	rolloutLock.Lock()
+	defer rolloutLock.Unlock()
+
+	rolloutPercentage = pct
+}
+
+// RolloutPercentage returns the percentage of hosts that restart to apply a
+// staged update.
+func RolloutPercentage() int {
+	rolloutLock.Lock()
+	defer rolloutLock.Unlock()
+
+	return rolloutPercentage
+}
+
+// RolloutBucket returns the rollout bucket of this host for the given version,
+// from 0 to 99. The identifier of the host it is derived from is created on
+// first use and is stored in the data root directory.
+func RolloutBucket(version string) (int, error) {
+	rolloutLock.Lock()
+	defer rolloutLock.Unlock()
+
+	id, err := getRolloutID(dataroot.Root().Path)
+	if err != nil {
+		return 0, err
+	}
+	return rolloutBucket(id, version), nil
+}
+
+// inRolloutCohort returns whether this host is part of the rollout cohort and
+// should restart to apply a staged update. Hosts whose bucket cannot be
+// determined are not part of a partial rollout.
+func inRolloutCohort() (inCohort bool, err error) {
+	pct := RolloutPercentage()
+	switch pct {
+	case 0:
+		return false, nil
+	case rolloutBuckets:
+		return true, nil
+	}
+
+	bucket, err := RolloutBucket(stagedVersion())
+	if err != nil {
+		return false, err
+	}
+	return rolloutBucketInCohort(bucket, pct), nil
+}
+
+// rolloutBucketInCohort returns whether the given bucket is part of the cohort
+// of the given rollout percentage.
+func rolloutBucketInCohort(bucket, pct int) bool {
+	return bucket < pct
+}
+
+// rolloutBucket returns the rollout bucket of the given host identifier for
+// the given version.
+func rolloutBucket(id, version string) int {
+	sum := sha256.Sum256([]byte(id + "/" + version))
+	return int(binary.BigEndian.Uint64(sum[:8]) % rolloutBuckets)
+}
+
+// getRolloutID returns the rollout identifier of the host, which is read from
+// the given data root directory or created there. It must be called with
+// rolloutLock held.
+func getRolloutID(dataRoot string) (string, error) {
+	if rolloutID != "" {
+		return rolloutID, nil
+	}
+
+	path := filepath.Join(dataRoot, rolloutIDFileName)
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		id := strings.TrimSpace(string(data))
+		if id == "" {
+			return "", fmt.Errorf("rollout identifier in %s is empty", path)
+		}
+		rolloutID = id
+		return rolloutID, nil
+	case !errors.Is(err, fs.ErrNotExist):
+		return "", fmt.Errorf("failed to read rollout identifier: %w", err)
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("failed to create rollout identifier: %w", err)
+	}
+	id := hex.EncodeToString(random)
+	if err := os.WriteFile(path, []byte(id), 0o0644); err != nil { //nolint:gosec // Not secret.
+		return "", fmt.Errorf("failed to write rollout identifier: %w", err)
+	}
+	rolloutID = id
+	return rolloutID, nil
+}
@@ -0,0 +1,114 @@
+package updates
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRolloutBucket(t *testing.T) {
+	t.Parallel()
+
+	// Buckets are stable and distributed over the full range.
+	seen := make(map[int]bool)
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("host-%d", i)
+		bucket := rolloutBucket(id, "1.0.0")
+		if bucket < 0 || bucket >= rolloutBuckets {
+			t.Fatalf("bucket %d of %s out of range", bucket, id)
+		}
+		if rolloutBucket(id, "1.0.0") != bucket {
+			t.Fatalf("bucket of %s is not stable", id)
+		}
+		seen[bucket] = true
+	}
+	if len(seen) < 90 {
+		t.Errorf("buckets are not distributed, only %d of %d used", len(seen), rolloutBuckets)
+	}
+
+	// Different hosts are first to receive each version.
+	var firstForBoth, firstForOne int
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("host-%d", i)
+		first := rolloutBucketInCohort(rolloutBucket(id, "1.0.0"), 10)
+		second := rolloutBucketInCohort(rolloutBucket(id, "1.0.1"), 10)
+		switch {
+		case first && second:
+			firstForBoth++
+		case first:
+			firstForOne++
+		}
+	}
+	if firstForBoth >= firstForOne {
+		t.Errorf("the same hosts are first to receive versions: %d hosts for both, %d for one", firstForBoth, firstForOne)
+	}
+}
+
+func TestRolloutBucketInCohort(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		bucket, pct int
+		inCohort    bool
+	}{
+		{0, 0, false},
+		{99, 0, false},
+		{0, 1, true},
+		{1, 1, false},
+		{9, 10, true},
+		{10, 10, false},
+		{98, 99, true},
+		{99, 99, false},
+		{0, 100, true},
+		{99, 100, true},
+	}
+	for _, test := range tests {
+		if rolloutBucketInCohort(test.bucket, test.pct) != test.inCohort {
+			t.Errorf("bucket %d at %d%%: expected in cohort to be %v", test.bucket, test.pct, test.inCohort)
+		}
+	}
+}
+
+func TestRolloutPercentage(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer SetRolloutPercentage(rolloutBuckets)
+
+	for pct, expected := range map[int]int{-5: 0, 0: 0, 50: 50, 100: 100, 150: 100} {
+		SetRolloutPercentage(pct)
+		if RolloutPercentage() != expected {
+			t.Errorf("percentage %d: expected %d, got %d", pct, expected, RolloutPercentage())
+		}
+	}
+
+	// The boundary percentages do not need the host identifier.
+	SetRolloutPercentage(0)
+	if inCohort, err := inRolloutCohort(); err != nil || inCohort {
+		t.Errorf("no host should be in the cohort at 0%%: %v", err)
+	}
+	SetRolloutPercentage(100)
+	if inCohort, err := inRolloutCohort(); err != nil || !inCohort {
+		t.Errorf("all hosts should be in the cohort at 100%%: %v", err)
+	}
+}
+
+func TestRolloutID(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func() { rolloutID = "" }()
+	dataRoot := t.TempDir()
+
+	// The identifier is created and stored.
+	rolloutID = ""
+	id, err := getRolloutID(dataRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dataRoot, rolloutIDFileName))
+	if err != nil || string(data) != id {
+		t.Fatalf("identifier should have been stored: %v", err)
+	}
+
+	// After a restart, the stored identifier is used.
+	rolloutID = ""
+	if reread, err := getRolloutID(dataRoot); err != nil || reread != id {
+		t.Errorf("stored identifier should have been used, got %q: %v", reread, err)
+	}
+}
@@ -0,0 +1,121 @@
+package updates
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tevino/abool"
+
+	"github.com/safing/portbase/dataroot"
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/updates/helper"
+)
+
+// defaultRestartSelfTestTimeout is the default time the staged binary has to
+// pass its self-test.
+const defaultRestartSelfTestTimeout = 1 * time.Minute
+
+var (
+	restartSelfTest        bool
+	restartSelfTestTimeout = defaultRestartSelfTestTimeout
+	restartSelfTestLock    sync.Mutex
+
+	// restartSelfTestRunning is set while the staged binary is probed before
+	// arming a restart, see DelayedRestart.
+	restartSelfTestRunning = abool.New()
+	// probeStagedBinary probes the staged binary. It is replaced in tests.
+	probeStagedBinary = ProbeStagedBinary
+
+	// selfTestMode is set if the process was started to run its self-test.
+	selfTestMode bool
+)
+
+func init() {
+	flag.BoolVar(&selfTestMode, "self-test", false, "run the self-test and exit with 0 if it passed, used to verify new versions before restarting into them")
+}
+
+// SetRestartSelfTest enables or disables probing the staged binary before a
+// restart is armed: The staged binary is started with the --self-test flag
+// and the restart is only armed if it exits with 0 within the given timeout.
+// A zero or negative timeout resets it to the default of 1 minute.
+func SetRestartSelfTest(enabled bool, timeout time.Duration) {
+	restartSelfTestLock.Lock()
+	defer restartSelfTestLock.Unlock()
+
+	if timeout <= 0 {
+		timeout = defaultRestartSelfTestTimeout
+	}
+	restartSelfTest = enabled
+	restartSelfTestTimeout = timeout
+}
+
+// restartSelfTestEnabled returns whether the staged binary is probed before a
+// restart is armed.
+func restartSelfTestEnabled() bool {
+	restartSelfTestLock.Lock()
+	defer restartSelfTestLock.Unlock()
+
+	return restartSelfTest
+}
+
+// ProbeStagedBinary runs the self-test of the newest binary of the running
+// service, which would be started after a restart, if enabled via
+// SetRestartSelfTest. If probing is disabled or the running process is not an
+// updatable service, nil is returned.
+func ProbeStagedBinary() error {
+	restartSelfTestLock.Lock()
+	enabled := restartSelfTest
+	timeout := restartSelfTestTimeout
+	restartSelfTestLock.Unlock()
+	if !enabled {
+		return nil
+	}
+
+	identifier, ok := stagedBinaryIdentifier()
+	if !ok {
+		return nil
+	}
+	file, err := GetPlatformFile(identifier)
+	if err != nil {
+		return fmt.Errorf("failed to get staged binary %s: %w", identifier, err)
+	}
+
+	log.Infof("updates: running self-test of staged binary %s v%s", identifier, file.Version())
+	if err := helper.ProbeBinary(file.Path(), timeout, "--data="+dataroot.Root().Path); err != nil {
+		return fmt.Errorf("staged binary %s v%s failed: %w", identifier, file.Version(), err)
+	}
+	return nil
+}
+
+// runSelfTest is the command line operation of the self-test mode. It is
+// only reached if the flags were parsed and all modules were prepared
+// successfully. As command line operations always exit with 0, it exits
+// with 1 by itself on failure.
+func runSelfTest() error {
+	if err := checkSelfTest(); err != nil {
+		fmt.Fprintf(os.Stderr, "self-test failed: %s\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("self-test passed")
+	return nil
+}
+
+func checkSelfTest() error {
+	root := dataroot.Root()
+	if root == nil {
+		return errors.New("data root is not set")
+	}
+	stat, err := os.Stat(root.Path)
+	if err != nil {
+		return fmt.Errorf("data root is not accessible: %w", err)
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("data root %s is not a directory", root.Path)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package updates
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/safing/portbase/dataroot"
+)
+
+func waitForUpdatePendingOnNextStart(expected bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for UpdatePendingOnNextStart() != expected && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return UpdatePendingOnNextStart() == expected
+}
+
+func TestDelayedRestartProbesInBackground(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	if dataroot.Root() == nil {
+		if err := dataroot.Initialize(t.TempDir(), 0o0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	SetRestartSelfTest(true, 0)
+	defer SetRestartSelfTest(false, 0)
+	// Without a restart task, only restarts on the next start can be armed.
+	SetApplyUpdatesOnNextStart(true)
+	defer SetApplyUpdatesOnNextStart(false)
+	defer AbortRestart()
+
+	// The probe returns the result sent to it.
+	release := make(chan error)
+	defer func(fn func() error) {
+		probeStagedBinary = fn
+	}(probeStagedBinary)
+	probeStagedBinary = func() error {
+		return <-release
+	}
+
+	// The restart is armed after the probe passed, without blocking the caller.
+	DelayedRestart(time.Hour)
+	if UpdatePendingOnNextStart() {
+		t.Fatal("restart must not be armed before the probe passed")
+	}
+	release <- nil
+	if !waitForUpdatePendingOnNextStart(true) {
+		t.Fatal("restart should be armed after the probe passed")
+	}
+
+	// Aborting the restart while probing keeps it from being armed.
+	AbortRestart()
+	DelayedRestart(time.Hour)
+	AbortRestart()
+	release <- nil
+	time.Sleep(50 * time.Millisecond)
+	if UpdatePendingOnNextStart() {
+		t.Error("restart must not be armed if it was aborted while probing")
+	}
+
+	// A failed probe keeps the restart from being armed.
+	DelayedRestart(time.Hour)
+	release <- errors.New("test failure")
+	time.Sleep(50 * time.Millisecond)
+	if UpdatePendingOnNextStart() {
+		t.Error("restart must not be armed if the probe failed")
+	}
+}
@@ -0,0 +1,121 @@
+package updates
+
+import (
+	"context"
+	"sync"
+
+	"github.com/safing/portbase/database/record"
+	"github.com/safing/portbase/runtime"
+)
+
+const (
+	// restartStateKey is the runtime key of the restart state.
+	restartStateKey = "updates/restart"
+
+	// restartStateDBKey is the database key of the restart state.
+	restartStateDBKey = "runtime:" + restartStateKey
+)
+
+var (
+	pushRestartStateUpdate     runtime.PushFunc
+	pushRestartStateUpdateLock sync.Mutex
+)
+
+// RestartState describes the state of a pending restart and of the staged
+// update. It is a read-only record exposed via runtime:updates/restart, so
+// that clients can subscribe to it and are updated when a restart becomes
+// pending, is rescheduled or aborted, or when a new version is staged.
+type RestartState struct {
+	record.Base
+	sync.Mutex
+
+	// Pending is set if a restart is pending, or if a staged update is applied
+	// on the next start, see SetApplyUpdatesOnNextStart.
+	Pending bool
+	// RestartAt holds the number of seconds in UNIX epoch time at which the
+	// restart is scheduled. It is zero if no restart is scheduled, even if an
+	// update is applied on the next start.
+	RestartAt int64
+	// Reason is the reason of the restart, if one was set.
+	Reason string
+	// StagedVersion is the version of the core that is started by the next
+	// restart.
+	StagedVersion string
+	// SupervisorSupported is set if the process is managed by the supervisor
+	// of the restart strategy, which starts it again after the restart.
+	SupervisorSupported bool
+}
+
+// GetRestartState returns the current restart state.
+func GetRestartState() *RestartState {
+	pending, restartAt := RestartIsPending()
+
+	restartTimeLock.Lock()
+	reason := restartReason
+	restartTimeLock.Unlock()
+
+	state := &RestartState{
+		Pending:             pending,
+		Reason:              reason,
+		StagedVersion:       stagedVersion(),
+		SupervisorSupported: getRestartStrategy().Supervised(),
+	}
+	if !restartAt.IsZero() {
+		state.RestartAt = restartAt.Unix()
+	}
+
+	state.CreateMeta()
+	state.SetKey(restartStateDBKey)
+	return state
+}
+
+// registerRestartState registers the restart state at the given runtime
+// registry and pushes updates of the state to its subscribers from then on.
+func registerRestartState(reg *runtime.Registry) error {
+	push, err := reg.Register(restartStateKey, runtime.SimpleValueGetterFunc(func(_ string) ([]record.Record, error) {
+		return []record.Record{GetRestartState()}, nil
+	}))
+	if err != nil {
+		return err
+	}
+
+	pushRestartStateUpdateLock.Lock()
+	defer pushRestartStateUpdateLock.Unlock()
+	pushRestartStateUpdate = push
+	return nil
+}
+
+// initRestartState exposes the restart state via the runtime database and
+// pushes an update whenever a new version is selected.
+func initRestartState() error {
+	if err := registerRestartState(runtime.DefaultRegistry); err != nil {
+		return err
+	}
+
+	return module.RegisterEventHook(
+		ModuleName,
+		VersionUpdateEvent,
+		"push restart state",
+		func(_ context.Context, _ interface{}) error {
+			pushRestartState()
+			return nil
+		},
+	)
+}
+
+// pushRestartState pushes the current restart state to its subscribers.
+// restartTimeLock must not be held.
+func pushRestartState() {
+	pushRestartStateUpdateLock.Lock()
+	defer pushRestartStateUpdateLock.Unlock()
+
+	if pushRestartStateUpdate == nil {
+		return
+	}
+
+	state := GetRestartState()
+	state.Lock()
+	defer state.Unlock()
+
+	pushRestartStateUpdate(state)
+}
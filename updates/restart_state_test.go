@@ -0,0 +1,112 @@
+package updates
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/safing/portbase/database"
+	"github.com/safing/portbase/database/query"
+	"github.com/safing/portbase/database/record"
+	"github.com/safing/portbase/dataroot"
+	"github.com/safing/portbase/runtime"
+)
+
+var (
+	restartStateDBOnce sync.Once
+	restartStateDBErr  error
+)
+
+// setupRestartStateDB injects a runtime registry as the runtime database and
+// registers the restart state at it. This can only be done once per process.
+func setupRestartStateDB(t *testing.T) {
+	t.Helper()
+
+	restartStateDBOnce.Do(func() {
+		if restartStateDBErr = database.InitializeWithPath(t.TempDir()); restartStateDBErr != nil {
+			return
+		}
+		if _, restartStateDBErr = database.Register(&database.Database{
+			Name:        "runtime",
+			Description: "Runtime database",
+			StorageType: "injected",
+		}); restartStateDBErr != nil {
+			return
+		}
+		reg := runtime.NewRegistry()
+		if restartStateDBErr = reg.InjectAsDatabase("runtime"); restartStateDBErr != nil {
+			return
+		}
+		restartStateDBErr = registerRestartState(reg)
+	})
+	if restartStateDBErr != nil {
+		t.Fatal(restartStateDBErr)
+	}
+}
+
+func nextRestartState(t *testing.T, feed chan record.Record) *RestartState {
+	t.Helper()
+
+	select {
+	case r := <-feed:
+		state, ok := r.(*RestartState)
+		if !ok {
+			t.Fatalf("unexpected record %T", r)
+		}
+		return state
+	case <-time.After(5 * time.Second):
+		t.Fatal("no restart state was pushed")
+		return nil
+	}
+}
+
+func TestRestartStateSubscription(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	if dataroot.Root() == nil {
+		if err := dataroot.Initialize(t.TempDir(), 0o0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setupRestartStateDB(t)
+
+	dbInterface := database.NewInterface(&database.Options{
+		Local:    true,
+		Internal: true,
+	})
+	r, err := dbInterface.Get(restartStateDBKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, ok := r.(*RestartState); !ok || state.Pending {
+		t.Errorf("unexpected initial restart state %+v", r)
+	}
+
+	sub, err := dbInterface.Subscribe(query.New(restartStateDBKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = sub.Cancel()
+	}()
+
+	// Setting the reason publishes it.
+	SetRestartReason("test reason")
+	defer SetRestartReason("")
+	if state := nextRestartState(t, sub.Feed); state.Reason != "test reason" || state.Pending {
+		t.Errorf("unexpected restart state %+v", state)
+	}
+
+	// Staging an update for the next start makes the restart pending.
+	SetApplyUpdatesOnNextStart(true)
+	defer SetApplyUpdatesOnNextStart(false)
+	DelayedRestart(time.Hour)
+	defer AbortRestart()
+	if state := nextRestartState(t, sub.Feed); !state.Pending || state.RestartAt != 0 {
+		t.Errorf("restart should be pending on the next start, got %+v", state)
+	}
+
+	// Aborting publishes that the restart is no longer pending.
+	AbortRestart()
+	if state := nextRestartState(t, sub.Feed); state.Pending {
+		t.Errorf("restart should not be pending after abort, got %+v", state)
+	}
+}
@@ -0,0 +1,148 @@
+package updates
+
+import (
+	"flag"
+	"os"
+	"sync"
+
+	"github.com/safing/portbase/config"
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/updates/helper"
+)
+
+// Restart Strategies.
+const (
+	// RestartStrategyPortmasterStart exits with RestartExitCode, which makes
+	// portmaster-start start the process again.
+	RestartStrategyPortmasterStart = "portmaster-start"
+	// RestartStrategySystemd exits with the configured systemd restart exit
+	// code, which makes systemd start the service again, if it is configured
+	// with Restart=on-failure or RestartForceExitStatus.
+	RestartStrategySystemd = "systemd"
+	// RestartStrategyRequestFile writes a restart request to the data root
+	// directory, see helper.RestartRequestFileName, and exits with 0, for
+	// supervisors that watch for the file, such as container orchestrators.
+	RestartStrategyRequestFile = "request-file"
+
+	// DefaultSystemdRestartExitCode is the default exit code of the systemd
+	// restart strategy. It is EX_TEMPFAIL, as the exit is temporary.
+	DefaultSystemdRestartExitCode = 75
+
+	cfgRestartStrategyKey = "core/restartStrategy"
+)
+
+// RestartStrategy executes a restart with the help of the supervisor that
+// manages the process, see SetRestartStrategy.
+type RestartStrategy interface {
+	// Name returns the name of the strategy.
+	Name() string
+	// Supervised returns whether the process seems to be managed by a
+	// supervisor that starts it again when restarting with this strategy.
+	Supervised() bool
+	// Prepare prepares the supervisor for the restart with the given reason
+	// and returns the exit code the process must exit with to be started
+	// again. The process exits with the returned exit code even if an error
+	// is returned.
+	Prepare(dataRoot string, reason *helper.RestartReason) (exitCode int, err error)
+}
+
+var (
+	restartStrategy     RestartStrategy
+	restartStrategyLock sync.Mutex
+
+	restartStrategyOption  config.StringOption
+	systemdRestartExitCode int
+)
+
+func init() {
+	flag.IntVar(&systemdRestartExitCode, "restart-systemd-exit-code", DefaultSystemdRestartExitCode, "exit code to exit with when restarting with the systemd restart strategy")
+}
+
+// SetRestartStrategy sets the strategy used for restarts, which overrides the
+// configured strategy. This is intended for embedding the Portmaster under
+// other supervisors. Setting nil restores the configured strategy.
+func SetRestartStrategy(strategy RestartStrategy) {
+	restartStrategyLock.Lock()
+	defer restartStrategyLock.Unlock()
+
+	restartStrategy = strategy
+}
+
+// getRestartStrategy returns the strategy that is set or configured. Unknown
+// configured strategies fall back to the portmaster-start strategy.
+func getRestartStrategy() RestartStrategy {
+	restartStrategyLock.Lock()
+	strategy := restartStrategy
+	restartStrategyLock.Unlock()
+	if strategy != nil {
+		return strategy
+	}
+
+	name := RestartStrategyPortmasterStart
+	if restartStrategyOption != nil {
+		name = restartStrategyOption()
+	}
+	switch name {
+	case RestartStrategyPortmasterStart:
+		return portmasterStartStrategy{}
+	case RestartStrategySystemd:
+		return systemdStrategy{exitCode: systemdRestartExitCode}
+	case RestartStrategyRequestFile:
+		return requestFileStrategy{}
+	default:
+		log.Warningf("updates: unknown restart strategy %q, using %s", name, RestartStrategyPortmasterStart)
+		return portmasterStartStrategy{}
+	}
+}
+
+// portmasterStartStrategy restarts via portmaster-start.
+type portmasterStartStrategy struct{}
+
+func (portmasterStartStrategy) Name() string {
+	return RestartStrategyPortmasterStart
+}
+
+func (portmasterStartStrategy) Supervised() bool {
+	return supervisorPresent()
+}
+
+// Prepare tells portmaster-start why the process is restarting.
+func (portmasterStartStrategy) Prepare(dataRoot string, reason *helper.RestartReason) (exitCode int, err error) {
+	return RestartExitCode, helper.WriteRestartReason(dataRoot, reason)
+}
+
+// systemdStrategy restarts via systemd.
+type systemdStrategy struct {
+	exitCode int
+}
+
+func (systemdStrategy) Name() string {
+	return RestartStrategySystemd
+}
+
+// Supervised checks for the invocation ID that systemd sets for the processes
+// of services.
+func (systemdStrategy) Supervised() bool {
+	return os.Getenv("INVOCATION_ID") != ""
+}
+
+func (s systemdStrategy) Prepare(_ string, _ *helper.RestartReason) (exitCode int, err error) {
+	return s.exitCode, nil
+}
+
+// requestFileStrategy restarts via a supervisor that watches for the restart
+// request file.
+type requestFileStrategy struct{}
+
+func (requestFileStrategy) Name() string {
+	return RestartStrategyRequestFile
+}
+
+// Supervised always returns true, as the supervisor cannot be detected.
+func (requestFileStrategy) Supervised() bool {
+	return true
+}
+
+func (requestFileStrategy) Prepare(dataRoot string, reason *helper.RestartReason) (exitCode int, err error) {
+	return 0, helper.WriteRestartRequest(dataRoot, reason)
+}
@@ -0,0 +1,128 @@
+package updates
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/safing/portmaster/updates/helper"
+)
+
+func TestRestartStrategies(t *testing.T) {
+	t.Parallel()
+
+	reason := &helper.RestartReason{
+		Reason:  "test",
+		Version: "1.2.3",
+		Time:    time.Now().Round(time.Second),
+	}
+
+	for _, test := range []struct {
+		strategy      RestartStrategy
+		exitCode      int
+		writtenFile   string
+		unwrittenFile string
+	}{
+		{
+			strategy:      portmasterStartStrategy{},
+			exitCode:      RestartExitCode,
+			writtenFile:   helper.RestartReasonFileName,
+			unwrittenFile: helper.RestartRequestFileName,
+		},
+		{
+			strategy: systemdStrategy{exitCode: DefaultSystemdRestartExitCode},
+			exitCode: DefaultSystemdRestartExitCode,
+		},
+		{
+			strategy: systemdStrategy{exitCode: 1},
+			exitCode: 1,
+		},
+		{
+			strategy:      requestFileStrategy{},
+			exitCode:      0,
+			writtenFile:   helper.RestartRequestFileName,
+			unwrittenFile: helper.RestartReasonFileName,
+		},
+	} {
+		dataRoot := t.TempDir()
+		exitCode, err := test.strategy.Prepare(dataRoot, reason)
+		if err != nil {
+			t.Errorf("%s: %s", test.strategy.Name(), err)
+			continue
+		}
+		if exitCode != test.exitCode {
+			t.Errorf("%s: unexpected exit code %d, expected %d", test.strategy.Name(), exitCode, test.exitCode)
+		}
+
+		entries, err := os.ReadDir(dataRoot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.writtenFile == "" {
+			if len(entries) > 0 {
+				t.Errorf("%s: unexpected files in data root: %v", test.strategy.Name(), entries)
+			}
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dataRoot, test.writtenFile)); err != nil {
+			t.Errorf("%s: %s was not written: %s", test.strategy.Name(), test.writtenFile, err)
+		}
+		if _, err := os.Stat(filepath.Join(dataRoot, test.unwrittenFile)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: %s must not be written", test.strategy.Name(), test.unwrittenFile)
+		}
+	}
+
+	// The restart request is removed at the next start.
+	dataRoot := t.TempDir()
+	if _, err := (requestFileStrategy{}).Prepare(dataRoot, reason); err != nil {
+		t.Fatal(err)
+	}
+	if err := helper.RemoveRestartRequest(dataRoot); err != nil {
+		t.Fatal(err)
+	}
+	if err := helper.RemoveRestartRequest(dataRoot); err != nil {
+		t.Errorf("removing a missing restart request must not fail: %s", err)
+	}
+}
+
+func TestGetRestartStrategy(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func() {
+		restartStrategyOption = nil
+		SetRestartStrategy(nil)
+	}()
+
+	for configured, expected := range map[string]string{
+		RestartStrategyPortmasterStart: RestartStrategyPortmasterStart,
+		RestartStrategySystemd:         RestartStrategySystemd,
+		RestartStrategyRequestFile:     RestartStrategyRequestFile,
+		"unknown":                      RestartStrategyPortmasterStart,
+	} {
+		configured := configured
+		restartStrategyOption = func() string { return configured }
+		if name := getRestartStrategy().Name(); name != expected {
+			t.Errorf("unexpected strategy %s for configured %q, expected %s", name, configured, expected)
+		}
+	}
+
+	// A set strategy overrides the configured strategy.
+	SetRestartStrategy(requestFileStrategy{})
+	restartStrategyOption = func() string { return RestartStrategySystemd }
+	if name := getRestartStrategy().Name(); name != RestartStrategyRequestFile {
+		t.Errorf("set strategy must override the configured strategy, got %s", name)
+	}
+	SetRestartStrategy(nil)
+	if name := getRestartStrategy().Name(); name != RestartStrategySystemd {
+		t.Errorf("configured strategy must be used again, got %s", name)
+	}
+
+	// Readiness reports missing supervisors of the strategy.
+	for _, blocker := range checkRestartReadiness(requestFileStrategy{}) {
+		if strings.Contains(blocker, "supervisor") {
+			t.Errorf("unexpected blocker %q", blocker)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package updates
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/safing/portbase/modules"
+	"github.com/safing/portmaster/updates/helper"
+)
+
+// preparingStrategy is a supervised restart strategy that counts how often it
+// was prepared.
+type preparingStrategy struct {
+	prepared int
+}
+
+func (s *preparingStrategy) Name() string { return "test" }
+
+func (s *preparingStrategy) Supervised() bool { return true }
+
+func (s *preparingStrategy) Prepare(_ string, _ *helper.RestartReason) (exitCode int, err error) {
+	s.prepared++
+	return 42, nil
+}
+
+func TestTestRestart(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	var calledWithDryRun, calledWithoutDryRun bool
+	RegisterPreRestartHook("test hook", func(ctx context.Context, dryRun bool) error {
+		if dryRun {
+			calledWithDryRun = true
+		} else {
+			calledWithoutDryRun = true
+		}
+		return nil
+	})
+	RegisterPreRestartHook("failing hook", func(ctx context.Context, dryRun bool) error {
+		return errors.New("not ready")
+	})
+	defer func() {
+		preRestartHooksLock.Lock()
+		defer preRestartHooksLock.Unlock()
+		delete(preRestartHooks, "test hook")
+		delete(preRestartHooks, "failing hook")
+	}()
+	strategy := &preparingStrategy{}
+	SetRestartStrategy(strategy)
+	defer SetRestartStrategy(nil)
+
+	plan, err := TestRestart(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !calledWithDryRun || calledWithoutDryRun {
+		t.Error("hooks must only be run in dry-run mode")
+	}
+	if len(plan.Hooks) != 4 || plan.Hooks[0] != "failing hook" || plan.Hooks[1] != "test hook" ||
+		plan.Hooks[2] != drainRestartHookName || plan.Hooks[3] != prepareRestartHookName {
+		t.Errorf("unexpected hooks in plan: %v", plan.Hooks)
+	}
+	if strategy.prepared != 0 {
+		t.Error("test restart must not prepare the restart strategy")
+	}
+	if plan.HookErrors["failing hook"] != "not ready" {
+		t.Errorf("hook error missing in plan: %v", plan.HookErrors)
+	}
+	if !plan.Drained {
+		t.Error("plan should be drained, as no update is in progress")
+	}
+	if plan.Ready {
+		t.Error("plan must not be ready with a failing hook")
+	}
+	if restartTriggered.IsSet() || restartPending.IsSet() {
+		t.Error("test restart must not trigger a restart")
+	}
+}
+
+func TestRunPreRestartHooks(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	strategy := &preparingStrategy{}
+	SetRestartStrategy(strategy)
+	defer SetRestartStrategy(nil)
+	defer modules.SetExitStatusCode(0)
+
+	names, errs := runPreRestartHooks(context.Background(), false)
+	if len(names) != 2 || names[0] != drainRestartHookName || names[1] != prepareRestartHookName {
+		t.Errorf("only the built-in hooks should have run, got %v", names)
+	}
+	if errs != nil {
+		t.Errorf("unexpected hook errors: %v", errs)
+	}
+	if strategy.prepared != 1 {
+		t.Errorf("restart strategy should have been prepared once, got %d", strategy.prepared)
+	}
+}
+
+func TestSetRestartTaskMaxDelay(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	defer func() {
+		restartTaskMaxDelay = 0
+	}()
+
+	if RestartTaskMaxDelay() != restartMaxDelay {
+		t.Errorf("restart task max delay should default to restart max delay, got %s", RestartTaskMaxDelay())
+	}
+
+	if err := SetRestartTaskMaxDelay(0); err == nil {
+		t.Error("zero max delay should be rejected")
+	}
+	if err := SetRestartTaskMaxDelay(restartMaxDelay + time.Second); err == nil {
+		t.Error("max delay exceeding the restart max delay should be rejected")
+	}
+
+	if err := SetRestartTaskMaxDelay(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if RestartTaskMaxDelay() != time.Minute {
+		t.Errorf("unexpected restart task max delay %s", RestartTaskMaxDelay())
+	}
+}
+
+func TestRestartDeferredUntil(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	lastRestart := &helper.LastRestart{Time: now.Add(-10 * time.Minute)}
+
+	if !restartDeferredUntil(now, nil, time.Hour).IsZero() {
+		t.Error("restart without recorded last restart must not be deferred")
+	}
+	if !restartDeferredUntil(now, lastRestart, 0).IsZero() {
+		t.Error("restart without minimum interval must not be deferred")
+	}
+	if !restartDeferredUntil(now, lastRestart, 5*time.Minute).IsZero() {
+		t.Error("restart after the minimum interval must not be deferred")
+	}
+	if deferUntil := restartDeferredUntil(now, lastRestart, time.Hour); !deferUntil.Equal(lastRestart.Time.Add(time.Hour)) {
+		t.Errorf("restart should be deferred until the interval elapsed, got %s", deferUntil)
+	}
+}
+
+func TestPendingRestartTasks(t *testing.T) { //nolint:paralleltest // Modifies global state.
+	if tasks := PendingRestartTasks(); tasks != nil {
+		t.Fatalf("expected no pending restart tasks, got %+v", tasks)
+	}
+	if cancelled := CancelAllRestartTasks(); cancelled != nil {
+		t.Errorf("expected no cancelled restart tasks, got %+v", cancelled)
+	}
+
+	// Simulate a scheduled restart.
+	restartAt := time.Now().Add(time.Hour)
+	restartTimeLock.Lock()
+	restartTime = restartAt
+	restartTimeLock.Unlock()
+	restartPending.Set()
+	restartForced.Set()
+	defer func() {
+		restartPending.UnSet()
+		restartForced.UnSet()
+		restartTimeLock.Lock()
+		restartTime = time.Time{}
+		restartTimeLock.Unlock()
+	}()
+
+	tasks := PendingRestartTasks()
+	if len(tasks) != 1 || tasks[0].Name != restartTaskName || !tasks[0].ScheduledAt.Equal(restartAt) ||
+		!tasks[0].Pending || tasks[0].Triggered {
+		t.Fatalf("unexpected pending restart tasks %+v", tasks)
+	}
+
+	// Cancelling returns the tasks as they were and resets the restart state.
+	cancelled := CancelAllRestartTasks()
+	if len(cancelled) != 1 || cancelled[0] != tasks[0] {
+		t.Errorf("unexpected cancelled restart tasks %+v", cancelled)
+	}
+	if restartPending.IsSet() || restartTriggered.IsSet() || restartForced.IsSet() {
+		t.Error("restart state should be reset")
+	}
+	if pending, at := RestartIsPending(); pending || !at.IsZero() {
+		t.Errorf("restart should not be pending after cancelling, got pending=%v at %s", pending, at)
+	}
+	if tasks := PendingRestartTasks(); tasks != nil {
+		t.Errorf("expected no pending restart tasks after cancelling, got %+v", tasks)
+	}
+}
@@ -140,6 +140,7 @@ func upgradeCoreNotifyActionHandler(_ context.Context, n *notifications.Notifica
 	switch n.SelectedActionID {
 	case "restart":
 		log.Infof("updates: user triggered restart via core update notification")
+		SetRestartReason("user triggered restart via core update notification")
 		RestartNow()
 	case "later":
 		n.Delete()
@@ -175,6 +176,7 @@ func upgradeHub() error {
 		}
 
 		// Delay restart for at least one hour for preparations.
+		SetRestartReason(fmt.Sprintf("update of spn hub to version %s", spnHubUpdate.Version()))
 		DelayedRestart(time.Duration(delayMinutes+60) * time.Minute)
 
 		// Increase update checks in order to detect aborts better.